@@ -0,0 +1,64 @@
+// Package alert sends operational alerts to a webhook.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Alert is posted as JSON to the webhook.
+type Alert struct {
+	// Type identifies the kind of alert, e.g. consumer-stale.
+	Type    string            `json:"type"`
+	Message string            `json:"message"`
+	Time    time.Time         `json:"time"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// Webhook posts alerts to URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+func (wh *Webhook) Notify(ctx context.Context, a Alert) error {
+	d, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("could not marshal alert: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.URL, bytes.NewReader(d))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Set("content-type", "application/json")
+
+	client := wh.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not post alert: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		rd, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	return nil
+}
@@ -0,0 +1,762 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/auth"
+	"github.com/draganm/event-buffer/backup"
+	"github.com/draganm/event-buffer/leader"
+	"github.com/draganm/event-buffer/outbox"
+	"github.com/draganm/event-buffer/remotewrite"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/statefile"
+	"github.com/draganm/event-buffer/statsd"
+	"github.com/draganm/event-buffer/tracing"
+	"github.com/draganm/event-buffer/ui"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+)
+
+// Run runs the event buffer until ctx is cancelled or one of its servers
+// fails.
+func Run(ctx context.Context, opts ...Option) error {
+	o := &options{
+		log:             logr.Discard(),
+		retentionPeriod: 2 * time.Hour,
+		pruneFrequency:  5 * time.Minute,
+	}
+	o.serverOptions.RetentionPeriod = o.retentionPeriod
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	log := o.log
+
+	db := o.db
+	stateFile := func() string { return o.stateFile }
+	var relocatable *relocatableDB
+	if db == nil {
+		if o.stateFile == "" {
+			return errors.New("either storage or state file must be provided")
+		}
+
+		err := statefile.Recover(o.stateFile)
+		if err != nil {
+			return fmt.Errorf("could not recover state: %w", err)
+		}
+
+		opened, err := embedded.Open(o.stateFile, 0700, embedded.Options{})
+		if err != nil {
+			return fmt.Errorf("could not open state: %w", err)
+		}
+		relocatable = newRelocatableDB(opened, o.stateFile)
+		stateFile = relocatable.Path
+		db = relocatable
+
+		if len(o.stateShards) > 0 {
+			db, err = openShards(relocatable, o.stateShards)
+			if err != nil {
+				relocatable.Close()
+				return err
+			}
+		}
+		defer db.Close()
+	}
+
+	sharded := len(o.stateShards) > 0
+	if sharded && o.backupStore != nil {
+		return errors.New("backups of a sharded state are not supported")
+	}
+
+	// backups and dumps only contain the state, not the payloads in the log
+	payloadLog := o.payloadLogDir != ""
+	if payloadLog && o.backupStore != nil {
+		return errors.New("backups of a state with a payload log are not supported")
+	}
+	if payloadLog {
+		pl, err := server.OpenPayloadLog(o.payloadLogDir, o.payloadLogSize)
+		if err != nil {
+			return fmt.Errorf("could not open payload log: %w", err)
+		}
+		defer pl.Close()
+		o.serverOptions.PayloadLog = pl
+	}
+
+	// publishes over gRPC would diverge from the primary
+	if o.followURL != "" && o.grpcListener != nil {
+		return errors.New("gRPC is not supported on a follower")
+	}
+
+	if o.leaderElection != nil {
+		if o.followURL != "" {
+			return errors.New("leader election and following a primary can't be combined")
+		}
+		// publishes over gRPC would bypass the leader
+		if o.grpcListener != nil {
+			return errors.New("gRPC is not supported with leader election")
+		}
+		if o.leaderElection.URL == "" {
+			return errors.New("leader election needs the internal API URL of the instance")
+		}
+	}
+
+	if o.followURL != "" && o.serverOptions.Peering.Self.Role == "" {
+		o.serverOptions.Peering.Self.Role = server.PeerRoleReplica
+	}
+
+	srv, err := server.New(log, db, o.serverOptions)
+	if err != nil {
+		return fmt.Errorf("could not start server: %w", err)
+	}
+
+	err = srv.Prune(srv.PruneTime().Add(-o.retentionPeriod))
+	if err != nil {
+		return fmt.Errorf("could not prune stale events: %w", err)
+	}
+
+	publishSystemEvent := func(eventType string, data any) {
+		err := srv.PublishSystemEvent(context.Background(), eventType, data)
+		if err != nil {
+			log.Error(err, "could not publish system event", "type", eventType)
+		}
+	}
+	publishSystemEvent(server.SystemEventStarted, nil)
+
+	eg, ctx := errgroup.WithContext(ctx)
+	conns := newConnTracker()
+
+	// run API servers
+	var api http.Handler = srv
+	if o.followURL != "" {
+		api = readOnly(o.followURL, srv)
+	}
+	var ap *activePassive
+	if o.leaderElection != nil {
+		ap, err = newActivePassive(ctx, log, srv, o.leaderElection.URL)
+		if err != nil {
+			return err
+		}
+		api = ap.handler(srv)
+	}
+	for _, l := range o.listeners {
+		eg.Go(runHttp(ctx, log, l, api, conns))
+	}
+
+	// run metrics server
+	if o.metricsListener != nil {
+		metricsRouter := mux.NewRouter()
+		metricsRouter.Methods("GET").Path("/metrics").Handler(promhttp.Handler())
+		eg.Go(runHttp(ctx, log, *o.metricsListener, metricsRouter, conns))
+	}
+
+	// run internal api
+	if o.internalListener != nil {
+		internalRouter := mux.NewRouter()
+		internalRouter.Methods("GET").Path("/dump").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			format := r.URL.Query().Get("format")
+			if format != "" && format != "raw" && format != "snapshot" {
+				http.Error(w, fmt.Errorf("invalid dump format: %s", format).Error(), http.StatusBadRequest)
+				return
+			}
+
+			filter, selective, err := dumpFilter(r.URL.Query())
+			if err != nil {
+				http.Error(w, fmt.Errorf("invalid dump filter: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+
+			// selective dumps are snapshots written by the server, which
+			// reads sharded states and inlines payloads of the payload log
+			if selective {
+				if format == "raw" {
+					http.Error(w, "selective dumps are only written as snapshots", http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("content-type", "application/binary")
+				err = srv.WriteDump(r.Context(), w, filter)
+				if errors.Is(err, server.ErrTopicNotFound) {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				if err != nil {
+					log.Error(err, "could not write selective dump")
+					http.Error(w, fmt.Errorf("could not write dump: %w", err).Error(), http.StatusInternalServerError)
+					return
+				}
+				return
+			}
+
+			if sharded {
+				http.Error(w, "a sharded state can't be dumped", http.StatusNotImplemented)
+				return
+			}
+
+			if payloadLog {
+				http.Error(w, "a state with a payload log can't be dumped", http.StatusNotImplemented)
+				return
+			}
+
+			w.Header().Set("content-type", "application/binary")
+			if format == "snapshot" {
+				err = srv.WriteSnapshot(w)
+			} else {
+				err = bolted.SugaredRead(db, func(tx bolted.SugaredReadTx) error {
+					tx.Dump(w)
+					return nil
+				})
+			}
+			if err != nil {
+				http.Error(w, fmt.Errorf("could not write dump: %w", err).Error(), http.StatusInternalServerError)
+				return
+			}
+		})
+
+		// the counterpart of /dump, the state is replaced while serving
+		internalRouter.Methods("POST").Path("/restore").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			format := r.URL.Query().Get("format")
+			if format == "" {
+				format = "raw"
+			}
+			if format != "raw" && format != "snapshot" {
+				http.Error(w, fmt.Errorf("invalid dump format: %s", format).Error(), http.StatusBadRequest)
+				return
+			}
+
+			if relocatable == nil || sharded {
+				http.Error(w, "only a state stored in a single file can be restored", http.StatusNotImplemented)
+				return
+			}
+
+			if payloadLog {
+				http.Error(w, "a state with a payload log can't be restored", http.StatusNotImplemented)
+				return
+			}
+
+			log.Info("restoring state", "path", relocatable.Path(), "format", format)
+			rs, err := relocatable.Restore(r.Context(), r.Body, format)
+			if errors.Is(err, errRelocating) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				log.Error(err, "could not restore state")
+				http.Error(w, fmt.Errorf("could not restore state: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+
+			err = srv.Restored()
+			if err != nil {
+				log.Error(err, "could not prepare restored state")
+				http.Error(w, fmt.Errorf("could not prepare restored state: %w", err).Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Info("restored state", "path", rs.Path, "size", rs.Size, "duration", rs.Duration)
+			publishSystemEvent(server.SystemEventRestored, rs)
+
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(rs)
+		})
+
+		internalRouter.Methods("GET").Path("/replication/events").HandlerFunc(srv.ServeReplication)
+
+		internalRouter.Methods("GET").Path("/stats").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			stats, err := srv.Stats()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(stats)
+		})
+
+		if o.ui {
+			// the page reads events through the API, limited to reads
+			api := http.StripPrefix("/ui/api", srv)
+			internalRouter.Methods("GET").Path("/ui/api/events").Handler(api)
+			internalRouter.Methods("GET").Path("/ui/api/events/{id}").Handler(api)
+			internalRouter.Methods("GET").Path("/ui").Handler(http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+			internalRouter.Methods("GET").PathPrefix("/ui/").Handler(ui.Handler())
+		}
+
+		internalRouter.Methods("GET").Path("/usage").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			report, err := srv.UsageReport(q.Get("from"), q.Get("to"), q.Get("principal"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(report)
+		})
+
+		internalRouter.Methods("GET").Path("/integrity").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			report, err := srv.CheckIntegrity(r.Context(), r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(report)
+		})
+
+		if o.effectiveConfig != nil {
+			internalRouter.Methods("GET").Path("/config").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("content-type", "application/json")
+				json.NewEncoder(w).Encode(o.effectiveConfig)
+			})
+		}
+
+		// moving the state to another volume without a restart
+		if relocatable != nil {
+			internalRouter.Methods("POST").Path("/state/relocate").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path := r.URL.Query().Get("path")
+				if path == "" {
+					http.Error(w, "path is required", http.StatusBadRequest)
+					return
+				}
+
+				log.Info("relocating state", "from", relocatable.Path(), "to", path)
+				rl, err := relocatable.Relocate(r.Context(), path)
+				if errors.Is(err, errRelocating) || errors.Is(err, errTargetExists) {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				if err != nil {
+					log.Error(err, "could not relocate state")
+					http.Error(w, fmt.Errorf("could not relocate state: %w", err).Error(), http.StatusInternalServerError)
+					return
+				}
+				log.Info("relocated state", "path", rl.Path, "previous", rl.Previous, "caughtUp", rl.CaughtUp, "duration", rl.Duration)
+				publishSystemEvent(server.SystemEventRelocated, rl)
+
+				w.Header().Set("content-type", "application/json")
+				json.NewEncoder(w).Encode(rl)
+			})
+		}
+
+		// reclaiming space without waiting for the next prune
+		internalRouter.Methods("POST").Path("/prune").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cutoff := srv.PruneTime().Add(-o.retentionPeriod)
+			if before := r.URL.Query().Get("before"); before != "" {
+				t, err := time.Parse(time.RFC3339Nano, before)
+				if err != nil {
+					http.Error(w, fmt.Errorf("invalid before: %w", err).Error(), http.StatusBadRequest)
+					return
+				}
+				cutoff = t
+			}
+
+			log.Info("pruning events", "cutoff", cutoff)
+			ps, err := srv.PruneReport(cutoff)
+			if err != nil {
+				log.Error(err, "could not prune events")
+				http.Error(w, fmt.Errorf("could not prune events: %w", err).Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Info("pruned events", "events", ps.Events, "bytes", ps.Bytes, "duration", ps.Duration)
+
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(ps)
+		})
+
+		// downstream mirrors advance their retention with the buffer
+		internalRouter.Methods("GET").Path("/prune-subscriptions").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			subs, err := srv.PruneSubscriptions()
+			if err != nil {
+				log.Error(err, "could not read prune subscriptions")
+				http.Error(w, fmt.Errorf("could not read prune subscriptions: %w", err).Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(subs)
+		})
+
+		internalRouter.Methods("PUT").Path("/prune-subscriptions/{name}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req := server.PruneSubscription{}
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, fmt.Errorf("could not decode request: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+
+			sub, err := srv.PutPruneSubscription(mux.Vars(r)["name"], req.URL)
+			if err != nil {
+				http.Error(w, fmt.Errorf("could not subscribe to prunes: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(sub)
+		})
+
+		internalRouter.Methods("DELETE").Path("/prune-subscriptions/{name}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := srv.DeletePruneSubscription(mux.Vars(r)["name"])
+			if errors.Is(err, server.ErrPruneSubscriptionNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Error(err, "could not delete prune subscription")
+				http.Error(w, fmt.Errorf("could not delete prune subscription: %w", err).Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		if relocatable != nil {
+			internalRouter.Methods("POST").Path("/compact").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				log.Info("compacting state", "path", relocatable.Path())
+				c, err := relocatable.Compact(r.Context())
+				if errors.Is(err, errRelocating) {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				if err != nil {
+					log.Error(err, "could not compact state")
+					http.Error(w, fmt.Errorf("could not compact state: %w", err).Error(), http.StatusInternalServerError)
+					return
+				}
+				log.Info("compacted state", "size", c.Size, "reclaimed", c.Reclaimed, "caughtUp", c.CaughtUp, "duration", c.Duration)
+				publishSystemEvent(server.SystemEventCompacted, c)
+
+				w.Header().Set("content-type", "application/json")
+				json.NewEncoder(w).Encode(c)
+			})
+		}
+
+		// sampled live events for debugging, for authenticated clients
+		internalRouter.Methods("GET").Path("/tap").HandlerFunc(srv.ServeTap)
+
+		internalRouter.Methods("POST").Path("/redactions").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req := server.RedactionRequest{}
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, fmt.Errorf("could not decode request: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+
+			principal := ""
+			p, found := auth.FromContext(r.Context())
+			if found {
+				principal = p.Name
+			}
+
+			rd, err := srv.Redact(req, principal)
+			if err != nil {
+				log.Error(err, "could not redact events")
+				http.Error(w, fmt.Errorf("could not redact events: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(rd)
+		})
+
+		internalRouter.Methods("GET").Path("/redactions").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			redactions, err := srv.Redactions()
+			if err != nil {
+				log.Error(err, "could not read redactions")
+				http.Error(w, fmt.Errorf("could not read redactions: %w", err).Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(redactions)
+		})
+
+		if o.bundleKey != nil {
+			internalRouter.Methods("GET").Path("/bundle").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("content-type", "application/gzip")
+				err := srv.ExportBundle(w, r.URL.Query().Get("topic"), r.URL.Query().Get("after"), o.bundleKey)
+				if errors.Is(err, server.ErrTopicNotFound) {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				if err != nil {
+					log.Error(err, "could not export bundle")
+					http.Error(w, fmt.Errorf("could not export bundle: %w", err).Error(), http.StatusInternalServerError)
+					return
+				}
+			})
+		}
+
+		if len(o.bundleTrusted) > 0 {
+			internalRouter.Methods("POST").Path("/bundle").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				m, imported, err := srv.ImportBundle(r.Body, o.bundleTrusted)
+				if err != nil {
+					log.Error(err, "could not import bundle")
+					http.Error(w, fmt.Errorf("could not import bundle: %w", err).Error(), http.StatusBadRequest)
+					return
+				}
+
+				w.Header().Set("content-type", "application/json")
+				json.NewEncoder(w).Encode(map[string]any{
+					"manifest": m,
+					"imported": imported,
+				})
+			})
+		}
+
+		if ap != nil {
+			internalRouter.Methods("GET").Path("/leader").HandlerFunc(ap.serveLeader)
+		}
+
+		eg.Go(runHttp(ctx, log, *o.internalListener, internalRouter, conns))
+	}
+
+	// run the pruner
+	eg.Go(func() error {
+		ticker := time.NewTicker(o.pruneFrequency)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				err := srv.Prune(srv.PruneTime().Add(-o.retentionPeriod))
+				if err != nil {
+					log.Error(err, "prune failed")
+				}
+				if o.walStore != nil && o.walRetention > 0 {
+					err = server.PruneWAL(ctx, o.walStore, time.Now().Add(-o.walRetention))
+					if err != nil {
+						log.Error(err, "could not prune WAL segments")
+					}
+				}
+			}
+
+		}
+	})
+
+	// persist usage accounting
+	eg.Go(func() error {
+		return srv.FlushUsagePeriodically(ctx, 10*time.Second)
+	})
+
+	// watch for stale consumers
+	if o.staleAfter > 0 {
+		eg.Go(func() error {
+			return srv.WatchConsumers(ctx, o.staleAfter, o.alerts)
+		})
+	}
+
+	// check integrity
+	if o.integrityCheck > 0 {
+		eg.Go(func() error {
+			ticker := time.NewTicker(o.integrityCheck)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+					report, err := srv.CheckIntegrity(ctx, "", "")
+					if err != nil {
+						log.Error(err, "integrity check failed")
+						continue
+					}
+					if len(report.Problems) > 0 {
+						log.Info("integrity check found problems", "problems", report.Problems)
+					}
+				}
+			}
+		})
+	}
+
+	// run gRPC API
+	if o.grpcListener != nil {
+		eg.Go(runGRPC(ctx, log, o.grpcListener, srv, o.grpcOptions))
+	}
+
+	// take part in the leader election, a lost leadership stops the app
+	if ap != nil {
+		eg.Go(func() error {
+			defer ap.stop()
+			err := leader.Run(ctx, log, *o.leaderElection, leader.Callbacks{
+				OnStartedLeading: ap.startedLeading,
+				OnNewLeader:      ap.newLeader,
+			})
+			ap.stoppedLeading()
+			return err
+		})
+	}
+
+	// stream changes to local subscribers
+	// copy the events of the primary
+	if o.followURL != "" {
+		eg.Go(func() error {
+			return srv.Follow(ctx, o.followURL)
+		})
+	}
+
+	if o.cdcListener != nil {
+		eg.Go(func() error {
+			return srv.ServeCDC(ctx, o.cdcListener)
+		})
+	}
+
+	// push metrics
+	if o.remoteWrite != nil {
+		eg.Go(func() error {
+			return remotewrite.Run(ctx, log, prometheus.DefaultGatherer, *o.remoteWrite)
+		})
+	}
+
+	if o.statsd != nil {
+		eg.Go(func() error {
+			return statsd.Run(ctx, log, prometheus.DefaultGatherer, *o.statsd)
+		})
+	}
+
+	if o.tracing != nil {
+		eg.Go(func() error {
+			return tracing.Run(ctx, log, *o.tracing)
+		})
+	}
+
+	// ingest the outbox
+	if o.outbox != nil {
+		eg.Go(func() error {
+			return outbox.Run(ctx, log, srv, *o.outbox)
+		})
+	}
+
+	// ship WAL segments
+	if o.walStore != nil {
+		eg.Go(func() error {
+			return srv.ShipWAL(ctx, o.walStore, o.walInterval)
+		})
+	}
+
+	// run scheduled backups
+	if o.backupStore != nil && o.backupFrequency > 0 {
+		eg.Go(func() error {
+			ticker := time.NewTicker(o.backupFrequency)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+					key, err := backup.Take(ctx, srv.WriteSnapshot, o.backupStore)
+					if err != nil {
+						log.Error(err, "backup failed")
+						continue
+					}
+					log.Info("backup taken", "key", key)
+					publishSystemEvent(server.SystemEventBackupTaken, map[string]string{"key": key})
+
+					if o.backupKeep > 0 {
+						err = backup.Prune(ctx, o.backupStore, o.backupKeep)
+						if err != nil {
+							log.Error(err, "could not prune backups")
+						}
+					}
+				}
+			}
+		})
+	}
+
+	eg.Go(dumpDiagnostics(ctx, log, srv, stateFile, conns))
+
+	err = eg.Wait()
+	publishSystemEvent(server.SystemEventStopped, nil)
+	return err
+}
+
+func runHttp(ctx context.Context, log logr.Logger, l Listener, handler http.Handler, conns *connTracker) func() error {
+
+	return func() error {
+		nl := l.Listener
+		if nl == nil {
+			var err error
+			nl, err = net.Listen("tcp", l.Addr)
+			if err != nil {
+				return fmt.Errorf("could not listen for %s requests: %w", l.Name, err)
+			}
+		}
+
+		if l.Middleware != nil {
+			handler = l.Middleware(handler)
+		}
+
+		s := &http.Server{
+			Handler:   handler,
+			TLSConfig: l.TLSConfig,
+			ConnState: conns.hook(l.Name),
+		}
+
+		go func() {
+			<-ctx.Done()
+			shutdownContext, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			log.Info(fmt.Sprintf("graceful shutdown of the %s server", l.Name))
+			err := s.Shutdown(shutdownContext)
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Info(fmt.Sprintf("%s server did not shut down gracefully, forcing close", l.Name))
+				s.Close()
+			}
+		}()
+
+		log.Info(fmt.Sprintf("%s server started", l.Name), "addr", nl.Addr().String(), "tls", l.TLSConfig != nil)
+
+		var err error
+		if l.TLSConfig != nil {
+			err = s.ServeTLS(nl, "", "")
+		} else {
+			err = s.Serve(nl)
+		}
+
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+
+		return err
+	}
+}
+
+func runGRPC(ctx context.Context, log logr.Logger, l net.Listener, srv *server.Server, opts []grpc.ServerOption) func() error {
+	return func() error {
+		g := grpc.NewServer(opts...)
+		srv.RegisterGRPC(g)
+
+		go func() {
+			<-ctx.Done()
+			log.Info("graceful shutdown of the grpc server")
+			stopped := make(chan struct{})
+			go func() {
+				g.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(time.Second):
+				// streams only end with their clients
+				log.Info("grpc server did not shut down gracefully, forcing close")
+				g.Stop()
+			}
+		}()
+
+		log.Info("grpc server started", "addr", l.Addr().String())
+
+		return g.Serve(l)
+	}
+}
@@ -0,0 +1,130 @@
+package app_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/app"
+	"github.com/draganm/event-buffer/backup"
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/snapshot"
+	"github.com/go-logr/logr"
+)
+
+func TestScheduledBackupsAreTakenAndPruned(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	td := t.TempDir()
+	store, err := objectstore.Open("file://" + filepath.ToSlash(filepath.Join(td, "backups")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Run(
+			ctx,
+			app.WithLogger(logr.Discard()),
+			app.WithStateFile(filepath.Join(td, "state")),
+			app.WithListeners(app.Listener{Name: "api", Listener: l}),
+			app.WithBackups(store, 20*time.Millisecond, 2),
+		)
+	}()
+	defer func() {
+		cancel()
+		err := <-done
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+
+	cl, err := client.New("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cl.SendEvents(ctx, []any{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := time.Now()
+
+	// the latest backup was taken after the events were sent and the older
+	// ones were pruned
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		keys, err := backup.List(ctx, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) > 2 {
+			t.Fatalf("expected at most 2 backups to be kept, got %v", keys)
+		}
+		if len(keys) == 2 {
+			taken, err := backup.Time(keys[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if taken.After(sent) {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no backups were taken after the events were sent, got %v", keys)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	key, err := backup.Latest(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	db, err := embedded.Open(filepath.Join(td, "restored"), 0700, embedded.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
+		_, err := snapshot.Restore(src, tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := server.New(logr.Discard(), db, server.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := srv.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Events != 3 {
+		t.Fatalf("expected 3 events in the backup, got %d", stats.Events)
+	}
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+
+	"github.com/draganm/event-buffer/server"
+	"github.com/go-logr/logr"
+)
+
+// connTracker counts the connections of the http servers by listener and
+// state, for the diagnostics dump.
+type connTracker struct {
+	mu     sync.Mutex
+	states map[string]map[net.Conn]http.ConnState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{states: map[string]map[net.Conn]http.ConnState{}}
+}
+
+// hook returns the http.Server ConnState hook of the named listener.
+func (t *connTracker) hook(name string) func(net.Conn, http.ConnState) {
+	return func(c net.Conn, state http.ConnState) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		conns := t.states[name]
+		if conns == nil {
+			conns = map[net.Conn]http.ConnState{}
+			t.states[name] = conns
+		}
+		if state == http.StateClosed || state == http.StateHijacked {
+			// hijacked connections are websockets, they are no longer
+			// tracked by the http server
+			delete(conns, c)
+			return
+		}
+		conns[c] = state
+	}
+}
+
+// counts returns the number of connections by listener and state.
+func (t *connTracker) counts() map[string]map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := map[string]map[string]int{}
+	for name, conns := range t.states {
+		byState := map[string]int{}
+		for _, state := range conns {
+			byState[state.String()]++
+		}
+		counts[name] = byState
+	}
+	return counts
+}
+
+// dumpDiagnostics logs the state of the process on every diagnostics
+// signal until ctx is cancelled, for hosts where the pprof port of the
+// internal api can't be reached.
+func dumpDiagnostics(ctx context.Context, log logr.Logger, srv *server.Server, stateFile func() string, conns *connTracker) func() error {
+	return func() error {
+		signals := make(chan os.Signal, 1)
+		notifyDiagnostics(signals)
+		defer stopDiagnostics(signals)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-signals:
+				logDiagnostics(log, srv, stateFile, conns)
+			}
+		}
+	}
+}
+
+func logDiagnostics(log logr.Logger, srv *server.Server, stateFile func() string, conns *connTracker) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	values := []any{
+		"goroutines", runtime.NumGoroutine(),
+		"heapAlloc", mem.HeapAlloc,
+		"sys", mem.Sys,
+		"numGC", mem.NumGC,
+		"connections", conns.counts(),
+		"prune", srv.PruneStatus(),
+	}
+
+	stats, err := srv.Stats()
+	if err != nil {
+		log.Error(err, "could not get storage stats")
+	} else {
+		values = append(values, "storage", stats)
+	}
+
+	if stateFile() != "" {
+		fi, err := os.Stat(stateFile())
+		if err != nil {
+			log.Error(err, "could not stat state file")
+		} else {
+			values = append(values, "stateFileSize", fi.Size())
+		}
+	}
+
+	log.Info("diagnostics", values...)
+
+	buf := &bytes.Buffer{}
+	err = pprof.Lookup("goroutine").WriteTo(buf, 2)
+	if err != nil {
+		log.Error(err, "could not dump goroutines")
+		return
+	}
+
+	// one entry per goroutine keeps the dump readable in structured logs
+	goroutines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n\n"))
+	stacks := make([]string, len(goroutines))
+	for i, g := range goroutines {
+		stacks[i] = string(g)
+	}
+	log.Info("goroutine stacks", "count", len(stacks), "stacks", stacks)
+}
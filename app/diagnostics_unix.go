@@ -0,0 +1,17 @@
+//go:build !windows
+
+package app
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func notifyDiagnostics(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+func stopDiagnostics(c chan<- os.Signal) {
+	signal.Stop(c)
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package app
+
+import "os"
+
+// windows has no SIGUSR1, diagnostics are only available on the
+// internal api there
+func notifyDiagnostics(c chan<- os.Signal) {}
+
+func stopDiagnostics(c chan<- os.Signal) {}
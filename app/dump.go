@@ -0,0 +1,42 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+// dumpFilter parses the selection of a selective dump: the topic and the
+// time range of its events, from inclusive and to exclusive, in RFC 3339.
+// The buffer has no tenants of its own, a tenant's events are those of
+// its topic. selective is false for dumps of the whole state.
+func dumpFilter(q url.Values) (f server.DumpFilter, selective bool, err error) {
+	if q.Get("tenant") != "" {
+		return f, false, errors.New("tenants are not known to the buffer, select their topic instead")
+	}
+
+	f.Topic = q.Get("topic")
+
+	for _, b := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		v := q.Get(b.name)
+		if v == "" {
+			continue
+		}
+		*b.t, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return f, false, fmt.Errorf("invalid %s time: %w", b.name, err)
+		}
+	}
+
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		return f, false, errors.New("from has to be before to")
+	}
+
+	return f, f.Topic != "" || !f.From.IsZero() || !f.To.IsZero(), nil
+}
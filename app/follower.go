@@ -0,0 +1,40 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// readOnly rejects requests changing the state of a follower, they would
+// be lost when it is promoted or diverge from the primary. Fetching events
+// by id is a POST without changes, WebSockets are rejected as they publish
+// as well.
+func readOnly(primaryURL string, h http.Handler) http.Handler {
+	primary := primaryURL
+	u, err := url.Parse(primaryURL)
+	if err == nil {
+		primary = u.Redacted()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isRead(r) {
+			http.Error(w, fmt.Sprintf("this instance is a read-only follower of %s", primary), http.StatusServiceUnavailable)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isRead returns true for requests that don't change the state.
+func isRead(r *http.Request) bool {
+	if strings.HasSuffix(r.URL.Path, "/ws") {
+		return false
+	}
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/events/get") {
+		return true
+	}
+	return r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/draganm/event-buffer/server"
+	"github.com/go-logr/logr"
+)
+
+// activePassive runs the instance as one of an active/passive pair, only
+// the leader elected with a Kubernetes lease accepts writes. The other
+// instance follows the leader, so it holds its events when it takes over.
+type activePassive struct {
+	ctx context.Context
+	log logr.Logger
+	srv *server.Server
+	// credentials of the own URL are used to follow the leader, leaders
+	// don't advertise them.
+	credentials *url.Userinfo
+
+	leading   atomic.Bool
+	leaderURL atomic.Value
+
+	mu            sync.Mutex
+	stopFollowing func()
+}
+
+func newActivePassive(ctx context.Context, log logr.Logger, srv *server.Server, ownURL string) (*activePassive, error) {
+	u, err := url.Parse(ownURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url of the instance: %w", err)
+	}
+
+	a := &activePassive{ctx: ctx, log: log, srv: srv, credentials: u.User}
+	a.leaderURL.Store("")
+	return a, nil
+}
+
+// startedLeading stops copying events of the previous leader before
+// writes are accepted.
+func (a *activePassive) startedLeading() {
+	a.stop()
+	a.leading.Store(true)
+}
+
+// stoppedLeading rejects writes again.
+func (a *activePassive) stoppedLeading() {
+	a.leading.Store(false)
+}
+
+// newLeader follows the leader at leaderURL.
+func (a *activePassive) newLeader(identity, leaderURL string) {
+	a.stop()
+	a.leaderURL.Store(leaderURL)
+
+	if leaderURL == "" {
+		a.log.Info("leader advertises no url, its events are not copied", "leader", identity)
+		return
+	}
+
+	u, err := url.Parse(leaderURL)
+	if err != nil {
+		a.log.Error(err, "invalid url of the leader", "leader", identity)
+		return
+	}
+	u.User = a.credentials
+
+	ctx, cancel := context.WithCancel(a.ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := a.srv.Follow(ctx, u.String())
+		if err != nil {
+			a.log.Error(err, "could not follow the leader", "leader", identity)
+		}
+	}()
+
+	a.mu.Lock()
+	a.stopFollowing = func() {
+		cancel()
+		<-done
+	}
+	a.mu.Unlock()
+}
+
+// stop stops following the leader and waits until no more events are
+// copied.
+func (a *activePassive) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stopFollowing != nil {
+		a.stopFollowing()
+		a.stopFollowing = nil
+	}
+}
+
+// handler rejects requests changing the state unless the instance leads.
+func (a *activePassive) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.leading.Load() && !isRead(r) {
+			msg := "this instance is not the leader"
+			if leader := a.leaderURL.Load().(string); leader != "" {
+				msg = fmt.Sprintf("%s, the leader is %s", msg, leader)
+			}
+			http.Error(w, msg, http.StatusServiceUnavailable)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveLeader answers with 200 on the leader and 503 otherwise, e.g. for a
+// readiness probe that sends traffic of a service only to the leader.
+func (a *activePassive) serveLeader(w http.ResponseWriter, r *http.Request) {
+	if !a.leading.Load() {
+		http.Error(w, "not the leader", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
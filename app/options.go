@@ -0,0 +1,482 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/event-buffer/alert"
+	"github.com/draganm/event-buffer/leader"
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/draganm/event-buffer/outbox"
+	"github.com/draganm/event-buffer/remotewrite"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/statsd"
+	"github.com/draganm/event-buffer/tracing"
+	"github.com/go-logr/logr"
+	"google.golang.org/grpc"
+)
+
+// Listener is an HTTP listener served by the app.
+type Listener struct {
+	Name string
+	// Addr is bound when Listener is nil.
+	Addr     string
+	Listener net.Listener
+	// TLSConfig enables HTTPS on the listener when set.
+	TLSConfig *tls.Config
+	// Middleware wraps the handler of the listener, e.g. for authentication.
+	Middleware func(http.Handler) http.Handler
+}
+
+type options struct {
+	log              logr.Logger
+	db               bolted.Database
+	stateFile        string
+	stateShards      []string
+	payloadLogDir    string
+	payloadLogSize   int64
+	followURL        string
+	leaderElection   *leader.Options
+	listeners        []Listener
+	metricsListener  *Listener
+	internalListener *Listener
+	retentionPeriod  time.Duration
+	pruneFrequency   time.Duration
+	serverOptions    server.Options
+	bundleKey        ed25519.PrivateKey
+	bundleTrusted    []ed25519.PublicKey
+	backupStore      objectstore.Store
+	backupFrequency  time.Duration
+	backupKeep       int
+	walStore         objectstore.Store
+	walInterval      time.Duration
+	walRetention     time.Duration
+	outbox           *outbox.Options
+	cdcListener      net.Listener
+	integrityCheck   time.Duration
+	staleAfter       time.Duration
+	alerts           alert.Notifier
+	ui               bool
+	remoteWrite      *remotewrite.Options
+	statsd           *statsd.Options
+	tracing          *tracing.Options
+	effectiveConfig  any
+	grpcListener     net.Listener
+	grpcOptions      []grpc.ServerOption
+}
+
+type Option func(o *options)
+
+func WithLogger(log logr.Logger) Option {
+	return func(o *options) {
+		o.log = log
+	}
+}
+
+// WithStorage uses an already opened database, it is not closed when Run
+// returns.
+func WithStorage(db bolted.Database) Option {
+	return func(o *options) {
+		o.db = db
+	}
+}
+
+// WithStateFile opens an embedded database at path.
+func WithStateFile(path string) Option {
+	return func(o *options) {
+		o.stateFile = path
+	}
+}
+
+// WithStateShards spreads the topics of the state file across the shard
+// files at paths, e.g. on separate disks. The same shards have to be given
+// in the same order on every start.
+func WithStateShards(paths ...string) Option {
+	return func(o *options) {
+		o.stateShards = append(o.stateShards, paths...)
+	}
+}
+
+// WithPayloadLog appends payloads of at least minSize bytes to segment
+// files of segmentSize bytes in dir instead of storing them in the state.
+// The same dir has to be given on every start once payloads were logged.
+func WithPayloadLog(dir string, minSize int, segmentSize int64) Option {
+	return func(o *options) {
+		o.payloadLogDir = dir
+		o.payloadLogSize = segmentSize
+		o.serverOptions.PayloadLogMinSize = minSize
+	}
+}
+
+// WithFollower makes the server a standby of the primary with the internal
+// API at primaryURL, it copies the events of the primary and serves them
+// read-only.
+func WithFollower(primaryURL string) Option {
+	return func(o *options) {
+		o.followURL = primaryURL
+	}
+}
+
+// WithLeaderElection runs the server as one of an active/passive pair,
+// only the leader elected with a Kubernetes lease accepts writes. The
+// other instance follows the internal API the leader advertises.
+func WithLeaderElection(opts leader.Options) Option {
+	return func(o *options) {
+		o.leaderElection = &opts
+	}
+}
+
+// WithListeners adds listeners serving the events API.
+func WithListeners(listeners ...Listener) Option {
+	return func(o *options) {
+		o.listeners = append(o.listeners, listeners...)
+	}
+}
+
+// WithMetricsListener serves prometheus metrics on /metrics.
+func WithMetricsListener(l Listener) Option {
+	return func(o *options) {
+		o.metricsListener = &l
+	}
+}
+
+// WithInternalListener serves the internal API.
+func WithInternalListener(l Listener) Option {
+	return func(o *options) {
+		o.internalListener = &l
+	}
+}
+
+// WithRetention sets how long events are kept and how often stale events
+// are pruned.
+func WithRetention(period, pruneFrequency time.Duration) Option {
+	return func(o *options) {
+		o.retentionPeriod = period
+		o.pruneFrequency = pruneFrequency
+		o.serverOptions.RetentionPeriod = period
+	}
+}
+
+func WithTrustedProxies(trustedProxies server.TrustedProxies) Option {
+	return func(o *options) {
+		o.serverOptions.TrustedProxies = trustedProxies
+	}
+}
+
+// WithBundleKeys enables exporting bundles signed with signingKey and
+// importing bundles signed by one of the trusted keys on the internal API.
+func WithBundleKeys(signingKey ed25519.PrivateKey, trusted []ed25519.PublicKey) Option {
+	return func(o *options) {
+		o.bundleKey = signingKey
+		o.bundleTrusted = trusted
+	}
+}
+
+// WithConsumerProtection keeps events that have not been consumed by all
+// registered consumers past the retention period, but never longer than
+// maxRetentionPeriod.
+func WithConsumerProtection(maxRetentionPeriod time.Duration) Option {
+	return func(o *options) {
+		o.serverOptions.ProtectConsumers = true
+		o.serverOptions.MaxRetentionPeriod = maxRetentionPeriod
+	}
+}
+
+// WithSizeBudget prunes the oldest events of all streams once the buffer
+// holds more than maxEvents events or maxBytes bytes of payloads, zero
+// disables a budget.
+func WithSizeBudget(maxEvents, maxBytes uint64) Option {
+	return func(o *options) {
+		o.serverOptions.MaxBufferEvents = maxEvents
+		o.serverOptions.MaxBufferBytes = maxBytes
+	}
+}
+
+// WithAckRetention prunes events as soon as all registered consumers
+// have acknowledged them, the retention period still applies to events
+// that have not been acknowledged.
+func WithAckRetention() Option {
+	return func(o *options) {
+		o.serverOptions.AckRetention = true
+	}
+}
+
+// WithCloudEvents only accepts events that are CloudEvents 1.0, consumers
+// can read them in the structured or binary content mode.
+func WithCloudEvents() Option {
+	return func(o *options) {
+		o.serverOptions.CloudEvents = true
+	}
+}
+
+// WithMaxPublishAge rejects events that occurred longer than maxAge or the
+// retention period ago.
+func WithMaxPublishAge(maxAge time.Duration) Option {
+	return func(o *options) {
+		o.serverOptions.MaxPublishAge = maxAge
+	}
+}
+
+// WithTraceIndex indexes events by the trace id they were published
+// with, for polls with a trace_id.
+func WithTraceIndex() Option {
+	return func(o *options) {
+		o.serverOptions.TraceIndex = true
+	}
+}
+
+// WithIDPrefix generates event ids as <prefix>:<uuid>, so the buffer an
+// event comes from is known from its id.
+func WithIDPrefix(prefix string) Option {
+	return func(o *options) {
+		o.serverOptions.IDPrefix = prefix
+	}
+}
+
+// WithSystemEvents publishes lifecycle events of the buffer, such as
+// startups, prunes and backups, to the _system topic.
+func WithSystemEvents() Option {
+	return func(o *options) {
+		o.serverOptions.SystemEvents = true
+	}
+}
+
+// WithRedactionRules strips or masks payload fields of events delivered
+// to matching consumers.
+func WithRedactionRules(rules ...server.RedactionRule) Option {
+	return func(o *options) {
+		o.serverOptions.RedactionRules = append(o.serverOptions.RedactionRules, rules...)
+	}
+}
+
+// WithDeliveryRateLimits caps the rate events are delivered to the named
+// consumers.
+func WithDeliveryRateLimits(limits ...server.DeliveryRateLimit) Option {
+	return func(o *options) {
+		o.serverOptions.DeliveryRateLimits = append(o.serverOptions.DeliveryRateLimits, limits...)
+	}
+}
+
+// WithDeduplication stores payloads of at least minSize bytes content
+// addressed, so identical payloads are stored only once.
+func WithDeduplication(minSize int) Option {
+	return func(o *options) {
+		o.serverOptions.DedupMinSize = minSize
+	}
+}
+
+// WithIdempotencyWindow remembers the idempotency keys of publishes for
+// window, retries within it are not stored again.
+func WithIdempotencyWindow(window time.Duration) Option {
+	return func(o *options) {
+		o.serverOptions.IdempotencyWindow = window
+	}
+}
+
+// WithLoadTargets sets the values at which the components of the load
+// score reach 100.
+func WithLoadTargets(targets server.LoadTargets) Option {
+	return func(o *options) {
+		o.serverOptions.Load = targets
+	}
+}
+
+// WithPayloadCompression compresses payloads stored in the state file with
+// zstd or snappy, an empty compression stores them as they are.
+func WithPayloadCompression(compression string) Option {
+	return func(o *options) {
+		o.serverOptions.PayloadCompression = compression
+	}
+}
+
+// WithEncryption encrypts payloads in the state file and the payload log
+// with the first of keys, the others decrypt payloads of rotated keys.
+func WithEncryption(keys []server.EncryptionKey) Option {
+	return func(o *options) {
+		o.serverOptions.EncryptionKeys = keys
+	}
+}
+
+// WithMaxDecompressedSize limits the size of compressed publish requests
+// after decompression.
+func WithMaxDecompressedSize(size int64) Option {
+	return func(o *options) {
+		o.serverOptions.MaxDecompressedSize = size
+	}
+}
+
+// WithConcurrency limits the concurrent storage reads of polls and the
+// concurrent publish requests, zero keeps the default of twice GOMAXPROCS.
+func WithConcurrency(read, write int) Option {
+	return func(o *options) {
+		o.serverOptions.ReadConcurrency = read
+		o.serverOptions.WriteConcurrency = write
+	}
+}
+
+// WithWriteQueueSize rejects publish requests with 429 Too Many Requests
+// while size others wait for a write slot.
+func WithWriteQueueSize(size int) Option {
+	return func(o *options) {
+		o.serverOptions.WriteQueueSize = size
+	}
+}
+
+// WithReadAhead prefetches up to size bytes of payloads for consumers
+// catching up with sequential polls.
+func WithReadAhead(size int) Option {
+	return func(o *options) {
+		o.serverOptions.ReadAheadSize = size
+	}
+}
+
+// WithTopicMetrics limits the topics with their own label in metrics.
+func WithTopicMetrics(tm server.TopicMetrics) Option {
+	return func(o *options) {
+		o.serverOptions.TopicMetrics = tm
+	}
+}
+
+// WithOffloading stores payloads of at least minSize bytes in the object
+// store instead of the database.
+func WithOffloading(store objectstore.Store, minSize int) Option {
+	return func(o *options) {
+		o.serverOptions.OffloadStore = store
+		o.serverOptions.OffloadMinSize = minSize
+	}
+}
+
+// WithArchive archives events to store in segments of format before they
+// are pruned.
+func WithArchive(store objectstore.Store, format string) Option {
+	return func(o *options) {
+		o.serverOptions.ArchiveStore = store
+		o.serverOptions.ArchiveFormat = format
+	}
+}
+
+// WithPeering describes the instance and its peers, a follower is a
+// replica unless its role is given.
+func WithPeering(p server.Peering) Option {
+	return func(o *options) {
+		o.serverOptions.Peering = p
+	}
+}
+
+// WithClaimChecks configures the URLs of payloads delivered as claim
+// checks, see server.Options for the meaning of the values.
+func WithClaimChecks(secret []byte, ttl time.Duration, publicURL string) Option {
+	return func(o *options) {
+		o.serverOptions.ClaimCheckSecret = secret
+		o.serverOptions.ClaimCheckTTL = ttl
+		o.serverOptions.PublicURL = publicURL
+	}
+}
+
+// WithBackups takes a snapshot of the state every frequency and stores it
+// in store, keeping the keep most recent ones.
+func WithBackups(store objectstore.Store, frequency time.Duration, keep int) Option {
+	return func(o *options) {
+		o.backupStore = store
+		o.backupFrequency = frequency
+		o.backupKeep = keep
+	}
+}
+
+// WithWALShipping ships appended events to store every interval, segments
+// older than retention are deleted when pruning.
+func WithWALShipping(store objectstore.Store, interval, retention time.Duration) Option {
+	return func(o *options) {
+		o.walStore = store
+		o.walInterval = interval
+		o.walRetention = retention
+	}
+}
+
+// WithOutbox appends rows of a Postgres outbox table to the buffer.
+func WithOutbox(opts outbox.Options) Option {
+	return func(o *options) {
+		o.outbox = &opts
+	}
+}
+
+// WithRemoteWrite pushes the metrics of the app to a Prometheus remote
+// write endpoint.
+func WithRemoteWrite(opts remotewrite.Options) Option {
+	return func(o *options) {
+		o.remoteWrite = &opts
+	}
+}
+
+// WithStatsD emits the metrics of the app to a StatsD or DogStatsD agent.
+func WithStatsD(opts statsd.Options) Option {
+	return func(o *options) {
+		o.statsd = &opts
+	}
+}
+
+// WithTracing exports the spans of the app to an OpenTelemetry collector.
+func WithTracing(opts tracing.Options) Option {
+	return func(o *options) {
+		o.tracing = &opts
+	}
+}
+
+// WithEffectiveConfig serves the configuration the app runs with on GET
+// /config of the internal API, secrets have to be masked already.
+func WithEffectiveConfig(cfg any) Option {
+	return func(o *options) {
+		o.effectiveConfig = cfg
+	}
+}
+
+// WithGRPCListener serves the gRPC API on l.
+func WithGRPCListener(l net.Listener, opts ...grpc.ServerOption) Option {
+	return func(o *options) {
+		o.grpcListener = l
+		o.grpcOptions = opts
+	}
+}
+
+// WithCDCListener streams appended events to local processes connecting
+// to l, see server.ServeCDC for the protocol.
+func WithCDCListener(l net.Listener) Option {
+	return func(o *options) {
+		o.cdcListener = l
+	}
+}
+
+// WithIntegrityChecks verifies all events every frequency, the results are
+// exported as metrics.
+func WithIntegrityChecks(frequency time.Duration) Option {
+	return func(o *options) {
+		o.integrityCheck = frequency
+	}
+}
+
+// WithAlerts sends operational alerts to notifier.
+func WithAlerts(notifier alert.Notifier) Option {
+	return func(o *options) {
+		o.alerts = notifier
+	}
+}
+
+// WithStaleConsumerAlerts alerts when a registered consumer has not sent a
+// heartbeat or cursor update for longer than staleAfter.
+func WithStaleConsumerAlerts(staleAfter time.Duration) Option {
+	return func(o *options) {
+		o.staleAfter = staleAfter
+	}
+}
+
+// WithUI serves a page for browsing events and stats under /ui/ on the
+// internal listener.
+func WithUI() Option {
+	return func(o *options) {
+		o.ui = true
+	}
+}
@@ -0,0 +1,664 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/statefile"
+	"go.etcd.io/bbolt"
+)
+
+// catchUpOps is the size of the journal below which the state is switched,
+// larger journals are replayed while writes continue.
+const catchUpOps = 1000
+
+var (
+	errRelocating   = errors.New("state is already being relocated")
+	errTargetExists = errors.New("relocation target already exists")
+)
+
+// relocatableDB is the state of the server, it can be moved to another path
+// while the server is running. Write transactions hold a read lock of
+// writes for their lifetime and the switch to the new state takes its write
+// lock, so it happens between write transactions. Read transactions are not
+// held up, the ones still reading the previous state delay closing it.
+type relocatableDB struct {
+	writes sync.RWMutex
+
+	// mu guards db and path, it is never held during a transaction, so
+	// reads within write transactions can't deadlock with a switch
+	mu   sync.Mutex
+	db   bolted.Database
+	path string
+
+	// journal records the changes committed while the state is copied,
+	// it is nil when no relocation is in progress
+	jmu     sync.Mutex
+	journal []journalOp
+
+	relocating sync.Mutex
+
+	omu       sync.Mutex
+	observers map[*relocatedObserver]struct{}
+}
+
+func newRelocatableDB(db bolted.Database, path string) *relocatableDB {
+	return &relocatableDB{db: db, path: path, observers: map[*relocatedObserver]struct{}{}}
+}
+
+// Path returns the current path of the state file.
+func (d *relocatableDB) Path() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.path
+}
+
+func (d *relocatableDB) current() bolted.Database {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.db
+}
+
+func (d *relocatableDB) BeginWrite() (bolted.WriteTx, error) {
+	d.writes.RLock()
+	tx, err := d.current().BeginWrite()
+	if err != nil {
+		d.writes.RUnlock()
+		return nil, err
+	}
+
+	d.jmu.Lock()
+	journaled := d.journal != nil
+	d.jmu.Unlock()
+
+	return &relocatableWriteTx{WriteTx: tx, d: d, journaled: journaled}, nil
+}
+
+func (d *relocatableDB) BeginRead() (bolted.ReadTx, error) {
+	return d.current().BeginRead()
+}
+
+func (d *relocatableDB) Stats() (*bbolt.Stats, error) {
+	return d.current().Stats()
+}
+
+func (d *relocatableDB) Close() error {
+	d.writes.Lock()
+	defer d.writes.Unlock()
+	return d.current().Close()
+}
+
+// Observe follows the changes of the current state, observers are moved to
+// the new state when it is switched.
+func (d *relocatableDB) Observe(m dbpath.Matcher) (<-chan bolted.ObservedChanges, func()) {
+	o := &relocatedObserver{
+		out:      make(chan bolted.ObservedChanges, 1),
+		switched: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+
+	// registering under omu makes sure a switch after the current state was
+	// observed moves the observer
+	d.omu.Lock()
+	changes, done := d.current().Observe(m)
+	d.observers[o] = struct{}{}
+	d.omu.Unlock()
+
+	go func() {
+		defer close(o.out)
+		defer func() {
+			done()
+		}()
+		for {
+			select {
+			case ch, ok := <-changes:
+				if !ok {
+					changes = nil
+					continue
+				}
+				select {
+				case o.out <- ch:
+				case <-o.stop:
+					return
+				}
+			case <-o.switched:
+				done()
+				changes, done = d.current().Observe(m)
+			case <-o.stop:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return o.out, func() {
+		once.Do(func() {
+			d.omu.Lock()
+			delete(d.observers, o)
+			d.omu.Unlock()
+			close(o.stop)
+		})
+	}
+}
+
+type relocatedObserver struct {
+	out      chan bolted.ObservedChanges
+	switched chan struct{}
+	stop     chan struct{}
+}
+
+// Relocation reports a finished relocation of the state.
+type Relocation struct {
+	Path     string `json:"path"`
+	Previous string `json:"previous"`
+	Size     int64  `json:"size"`
+	// CaughtUp is the number of changes replayed on the copy.
+	CaughtUp int    `json:"caught_up"`
+	Duration string `json:"duration"`
+}
+
+// Relocate copies the state to path, replays the changes made during the
+// copy and switches to it. The previous state file is closed and left in
+// place, the server uses the new path until it is restarted.
+func (d *relocatableDB) Relocate(ctx context.Context, path string) (*Relocation, error) {
+	if !d.relocating.TryLock() {
+		return nil, errRelocating
+	}
+	defer d.relocating.Unlock()
+
+	started := time.Now()
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve path: %w", err)
+	}
+
+	_, err = os.Stat(path)
+	if err == nil {
+		return nil, fmt.Errorf("%w: %s", errTargetExists, path)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not stat %s: %w", path, err)
+	}
+
+	previous := d.Path()
+	caughtUp, err := d.relocate(ctx, path, copyState, "")
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat state file: %w", err)
+	}
+
+	return &Relocation{
+		Path:     path,
+		Previous: previous,
+		Size:     fi.Size(),
+		CaughtUp: caughtUp,
+		Duration: time.Since(started).String(),
+	}, nil
+}
+
+// Compaction reports a finished compaction of the state.
+type Compaction struct {
+	Path       string `json:"path"`
+	SizeBefore int64  `json:"size_before"`
+	Size       int64  `json:"size"`
+	Reclaimed  int64  `json:"reclaimed"`
+	// CaughtUp is the number of changes replayed on the copy.
+	CaughtUp int    `json:"caught_up"`
+	Duration string `json:"duration"`
+}
+
+// Compact rewrites the state without the free pages of pruned events,
+// bbolt never shrinks its file. The state is copied like it is relocated,
+// the copy replaces the state file before the server switches to it, so a
+// crash leaves either of them at the path. Shards are not compacted.
+func (d *relocatableDB) Compact(ctx context.Context) (*Compaction, error) {
+	if !d.relocating.TryLock() {
+		return nil, errRelocating
+	}
+	defer d.relocating.Unlock()
+
+	started := time.Now()
+	path := d.Path()
+
+	before, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat state file: %w", err)
+	}
+
+	tmp := path + ".compact"
+	err = os.Remove(tmp)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not remove stale compaction: %w", err)
+	}
+
+	caughtUp, err := d.relocate(ctx, tmp, compactState, path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat state file: %w", err)
+	}
+
+	return &Compaction{
+		Path:       path,
+		SizeBefore: before.Size(),
+		Size:       fi.Size(),
+		Reclaimed:  before.Size() - fi.Size(),
+		CaughtUp:   caughtUp,
+		Duration:   time.Since(started).String(),
+	}, nil
+}
+
+// relocate copies the state to path with copy, replays the changes made
+// during the copy and switches to it. With final set, the copy is renamed
+// to final between write transactions, before the switch. It returns the
+// number of replayed changes, d.relocating has to be held.
+func (d *relocatableDB) relocate(ctx context.Context, path string, copy func(bolted.ReadTx, string) error, final string) (int, error) {
+	// begin the copy between write transactions, so every change the copy
+	// does not contain is journaled
+	d.writes.Lock()
+	snapshot, err := d.current().BeginRead()
+	if err != nil {
+		d.writes.Unlock()
+		return 0, fmt.Errorf("could not start snapshot: %w", err)
+	}
+	d.jmu.Lock()
+	d.journal = []journalOp{}
+	d.jmu.Unlock()
+	d.writes.Unlock()
+
+	stopJournal := func() {
+		d.jmu.Lock()
+		d.journal = nil
+		d.jmu.Unlock()
+	}
+
+	err = copy(snapshot, path)
+	snapshot.Finish()
+	if err != nil {
+		stopJournal()
+		return 0, err
+	}
+
+	db, err := embedded.Open(path, 0700, embedded.Options{})
+	if err != nil {
+		stopJournal()
+		os.Remove(path)
+		return 0, fmt.Errorf("could not open copied state: %w", err)
+	}
+
+	abort := func(err error) (int, error) {
+		stopJournal()
+		db.Close()
+		os.Remove(path)
+		return 0, err
+	}
+
+	// replay while the server keeps writing until the rest is small enough
+	// to be replayed between transactions
+	caughtUp := 0
+	for {
+		if ctx.Err() != nil {
+			return abort(ctx.Err())
+		}
+
+		d.jmu.Lock()
+		ops := d.journal
+		if len(ops) > catchUpOps {
+			d.journal = []journalOp{}
+		}
+		d.jmu.Unlock()
+
+		if len(ops) <= catchUpOps {
+			break
+		}
+
+		err = replay(db, ops)
+		if err != nil {
+			return abort(err)
+		}
+		caughtUp += len(ops)
+	}
+
+	d.writes.Lock()
+	d.jmu.Lock()
+	ops := d.journal
+	d.journal = nil
+	d.jmu.Unlock()
+
+	err = replay(db, ops)
+	if err != nil {
+		d.writes.Unlock()
+		db.Close()
+		os.Remove(path)
+		return 0, err
+	}
+	caughtUp += len(ops)
+
+	if final != "" {
+		// the copy has every change, the previous state file is not needed
+		// anymore
+		err = os.Rename(path, final)
+		if err != nil {
+			d.writes.Unlock()
+			db.Close()
+			os.Remove(path)
+			return 0, fmt.Errorf("could not replace state file: %w", err)
+		}
+		path = final
+	}
+
+	previous := d.switchTo(db, path)
+	d.writes.Unlock()
+
+	// waits for the read transactions of the previous state
+	err = previous.Close()
+	if err != nil {
+		return 0, fmt.Errorf("could not close previous state: %w", err)
+	}
+
+	return caughtUp, nil
+}
+
+// switchTo makes db at path the current state, moves the observers to it
+// and returns the previous state. d.writes has to be locked.
+func (d *relocatableDB) switchTo(db bolted.Database, path string) bolted.Database {
+	d.omu.Lock()
+	defer d.omu.Unlock()
+
+	d.mu.Lock()
+	previous := d.db
+	d.db, d.path = db, path
+	d.mu.Unlock()
+
+	for o := range d.observers {
+		select {
+		case o.switched <- struct{}{}:
+		default:
+		}
+	}
+
+	return previous
+}
+
+// copyState writes the state of tx to path through a temporary file, so a
+// failed copy never leaves a partial state at path.
+func copyState(tx bolted.ReadTx, path string) error {
+	tmp := statefile.TempPath(path)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0700)
+	if err != nil {
+		return fmt.Errorf("could not create state file: %w", err)
+	}
+
+	_, err = tx.Dump(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not copy state: %w", err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not move copied state: %w", err)
+	}
+
+	return nil
+}
+
+// compactBatchOps is the number of changes a compaction commits at once,
+// so the copy of a large state doesn't have to fit into memory.
+const compactBatchOps = 10000
+
+// compactState writes the state of tx to path entry by entry, unlike
+// copyState it leaves the free pages behind. It writes through a temporary
+// file like copyState.
+func compactState(tx bolted.ReadTx, path string) error {
+	tmp := statefile.TempPath(path)
+	os.Remove(tmp)
+
+	db, err := embedded.Open(tmp, 0700, embedded.Options{})
+	if err != nil {
+		return fmt.Errorf("could not create state file: %w", err)
+	}
+
+	c := &compactor{db: db}
+	err = c.walk(tx, dbpath.NilPath)
+	if err == nil {
+		err = c.commit()
+	} else if c.tx != nil {
+		c.tx.Rollback()
+		c.tx.Finish()
+	}
+	closeErr := db.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not compact state: %w", err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not move compacted state: %w", err)
+	}
+
+	return nil
+}
+
+// compactor copies entries into db in transactions of compactBatchOps.
+type compactor struct {
+	db  bolted.Database
+	tx  bolted.WriteTx
+	ops int
+}
+
+func (c *compactor) walk(src bolted.ReadTx, path dbpath.Path) error {
+	it, err := src.Iterator(path)
+	if err != nil {
+		return err
+	}
+	for {
+		done, err := it.IsDone()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		key, err := it.GetKey()
+		if err != nil {
+			return err
+		}
+		p := path.Append(key)
+		isMap, err := src.IsMap(p)
+		if err != nil {
+			return err
+		}
+
+		if isMap {
+			err = c.write(func(tx bolted.WriteTx) error {
+				return tx.CreateMap(p)
+			})
+			if err == nil {
+				err = c.walk(src, p)
+			}
+		} else {
+			var value []byte
+			value, err = it.GetValue()
+			if err == nil {
+				err = c.write(func(tx bolted.WriteTx) error {
+					return tx.Put(p, value)
+				})
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("could not copy %s: %w", p, err)
+		}
+
+		err = it.Next()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *compactor) write(op func(tx bolted.WriteTx) error) error {
+	if c.tx == nil {
+		tx, err := c.db.BeginWrite()
+		if err != nil {
+			return err
+		}
+		c.tx = tx
+	}
+
+	err := op(c.tx)
+	if err != nil {
+		return err
+	}
+
+	c.ops++
+	if c.ops >= compactBatchOps {
+		return c.commit()
+	}
+	return nil
+}
+
+func (c *compactor) commit() error {
+	if c.tx == nil {
+		return nil
+	}
+	err := c.tx.Finish()
+	c.tx, c.ops = nil, 0
+	return err
+}
+
+type journalOpType int
+
+const (
+	journalPut journalOpType = iota
+	journalDelete
+	journalCreateMap
+)
+
+type journalOp struct {
+	op    journalOpType
+	path  dbpath.Path
+	value []byte
+}
+
+// replay applies journaled changes in one transaction.
+func replay(db bolted.Database, ops []journalOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	tx, err := db.BeginWrite()
+	if err != nil {
+		return fmt.Errorf("could not start catch up: %w", err)
+	}
+
+	for _, op := range ops {
+		switch op.op {
+		case journalPut:
+			err = tx.Put(op.path, op.value)
+		case journalDelete:
+			err = tx.Delete(op.path)
+		case journalCreateMap:
+			err = tx.CreateMap(op.path)
+		}
+		if err != nil {
+			tx.Rollback()
+			tx.Finish()
+			return fmt.Errorf("could not catch up with %s: %w", op.path, err)
+		}
+	}
+
+	err = tx.Finish()
+	if err != nil {
+		return fmt.Errorf("could not catch up: %w", err)
+	}
+
+	return nil
+}
+
+// relocatableWriteTx records its changes when a relocation is in progress.
+type relocatableWriteTx struct {
+	bolted.WriteTx
+	d          *relocatableDB
+	once       sync.Once
+	journaled  bool
+	rolledBack bool
+	ops        []journalOp
+}
+
+func (tx *relocatableWriteTx) Put(path dbpath.Path, value []byte) error {
+	err := tx.WriteTx.Put(path, value)
+	if err == nil && tx.journaled {
+		tx.ops = append(tx.ops, journalOp{op: journalPut, path: path, value: append([]byte(nil), value...)})
+	}
+	return err
+}
+
+func (tx *relocatableWriteTx) Delete(path dbpath.Path) error {
+	err := tx.WriteTx.Delete(path)
+	if err == nil && tx.journaled {
+		tx.ops = append(tx.ops, journalOp{op: journalDelete, path: path})
+	}
+	return err
+}
+
+func (tx *relocatableWriteTx) CreateMap(path dbpath.Path) error {
+	err := tx.WriteTx.CreateMap(path)
+	if err == nil && tx.journaled {
+		tx.ops = append(tx.ops, journalOp{op: journalCreateMap, path: path})
+	}
+	return err
+}
+
+func (tx *relocatableWriteTx) Rollback() error {
+	tx.rolledBack = true
+	return tx.WriteTx.Rollback()
+}
+
+func (tx *relocatableWriteTx) Finish() error {
+	defer tx.once.Do(tx.d.writes.RUnlock)
+
+	if !tx.journaled || tx.rolledBack {
+		return tx.WriteTx.Finish()
+	}
+
+	// the journal is locked during the commit, so changes are journaled in
+	// the order they are committed
+	tx.d.jmu.Lock()
+	defer tx.d.jmu.Unlock()
+	err := tx.WriteTx.Finish()
+	if err == nil && tx.d.journal != nil {
+		tx.d.journal = append(tx.d.journal, tx.ops...)
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+	"github.com/go-logr/logr"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestRelocateWhilePublishingAndPolling(t *testing.T) {
+	td := t.TempDir()
+	path := filepath.Join(td, "state")
+	target := filepath.Join(td, "relocated", "state")
+
+	opened, err := embedded.Open(path, 0700, embedded.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := newRelocatableDB(opened, path)
+	t.Cleanup(func() { db.Close() })
+
+	srv, err := server.New(logr.Discard(), db, server.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := httptest.NewServer(srv)
+	t.Cleanup(hs.Close)
+
+	cl, err := client.New(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err = os.MkdirAll(filepath.Dir(target), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const total = 300
+	published := &atomic.Int32{}
+	received := []int{}
+
+	eg, egCtx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		for i := 0; i < total; i++ {
+			err := cl.SendEvents(egCtx, []any{i})
+			if err != nil {
+				return err
+			}
+			published.Add(1)
+		}
+		return nil
+	})
+
+	eg.Go(func() error {
+		after := ""
+		for len(received) < total {
+			evts := []int{}
+			ids, err := cl.PollForEvents(egCtx, after, 50, "asc", &evts)
+			if err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			received = append(received, evts...)
+			after = ids[len(ids)-1]
+		}
+		return nil
+	})
+
+	var rl *Relocation
+	eg.Go(func() error {
+		for published.Load() < total/3 {
+			time.Sleep(time.Millisecond)
+		}
+		var err error
+		rl, err = db.Relocate(egCtx, target)
+		return err
+	})
+
+	err = eg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, n := range received {
+		if n != i {
+			t.Fatalf("expected event %d at position %d, got %v", i, i, received)
+		}
+	}
+
+	if rl.Path != target || rl.Previous != path || db.Path() != target {
+		t.Fatalf("unexpected relocation %+v to %s", rl, db.Path())
+	}
+
+	stats, err := srv.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Events != total {
+		t.Fatalf("expected %d events in the relocated state, got %d", total, stats.Events)
+	}
+}
+
+func TestRelocateMovesObservers(t *testing.T) {
+	td := t.TempDir()
+	path := filepath.Join(td, "state")
+
+	opened, err := embedded.Open(path, 0700, embedded.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := newRelocatableDB(opened, path)
+	t.Cleanup(func() { db.Close() })
+
+	srv, err := server.New(logr.Discard(), db, server.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := httptest.NewServer(srv)
+	t.Cleanup(hs.Close)
+
+	cl, err := client.New(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// the long poll waits on an observer of the state before the switch
+	polled := make(chan []int, 1)
+	pollErr := make(chan error, 1)
+	go func() {
+		evts := []int{}
+		_, err := cl.PollForEvents(ctx, "", 10, "asc", &evts)
+		if err != nil {
+			pollErr <- err
+			return
+		}
+		polled <- evts
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = db.Relocate(ctx, filepath.Join(td, "relocated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cl.SendEvents(ctx, []any{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case evts := <-polled:
+		if len(evts) != 1 || evts[0] != 1 {
+			t.Fatalf("unexpected events %v", evts)
+		}
+	case err := <-pollErr:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting poll was not woken by an event of the relocated state")
+	}
+}
@@ -0,0 +1,146 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/snapshot"
+	"github.com/draganm/event-buffer/statefile"
+)
+
+// Restoration reports a finished restore of the state.
+type Restoration struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	// Created and Sequences are read from the header of a snapshot.
+	Created   *time.Time          `json:"created,omitempty"`
+	Sequences []snapshot.Sequence `json:"sequences,omitempty"`
+	Size      int64               `json:"size"`
+	Duration  string              `json:"duration"`
+}
+
+// Restore replaces the state with a dump written by /dump, in the raw or
+// the snapshot format. The dump is written next to the state file and
+// swapped in between write transactions, changes committed since the dump
+// was taken are lost. A crash leaves either state at the path.
+func (d *relocatableDB) Restore(ctx context.Context, src io.Reader, format string) (*Restoration, error) {
+	if !d.relocating.TryLock() {
+		return nil, errRelocating
+	}
+	defer d.relocating.Unlock()
+
+	started := time.Now()
+	path := d.Path()
+	tmp := statefile.TempPath(path)
+	err := os.Remove(tmp)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not remove stale restore: %w", err)
+	}
+
+	rs := &Restoration{Path: path, Format: format}
+	var db bolted.Database
+	if format == "snapshot" {
+		db, err = restoreSnapshot(src, tmp, rs)
+	} else {
+		db, err = restoreRaw(src, tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	if ctx.Err() != nil {
+		db.Close()
+		os.Remove(tmp)
+		return nil, ctx.Err()
+	}
+
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		db.Close()
+		os.Remove(tmp)
+		return nil, fmt.Errorf("could not stat restored state: %w", err)
+	}
+	rs.Size = fi.Size()
+
+	d.writes.Lock()
+	err = statefile.Swap(path)
+	if err != nil {
+		d.writes.Unlock()
+		db.Close()
+		return nil, fmt.Errorf("could not replace state file: %w", err)
+	}
+	previous := d.switchTo(db, path)
+	d.writes.Unlock()
+
+	// waits for the read transactions of the previous state
+	err = previous.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not close previous state: %w", err)
+	}
+
+	rs.Duration = time.Since(started).String()
+	return rs, nil
+}
+
+// restoreRaw writes a raw dump to path and opens it, which fails for dumps
+// that are not a state.
+func restoreRaw(src io.Reader, path string) (bolted.Database, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create state file: %w", err)
+	}
+
+	n, err := io.Copy(f, src)
+	if err == nil && n == 0 {
+		err = errors.New("dump is empty")
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not write dump: %w", err)
+	}
+
+	db, err := embedded.Open(path, 0700, embedded.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("could not open dump: %w", err)
+	}
+
+	return db, nil
+}
+
+// restoreSnapshot writes the entries of a snapshot to a new state at path,
+// its header is added to rs.
+func restoreSnapshot(src io.Reader, path string, rs *Restoration) (bolted.Database, error) {
+	db, err := embedded.Open(path, 0700, embedded.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("could not create state file: %w", err)
+	}
+
+	var header snapshot.Header
+	err = bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
+		header, err = snapshot.Restore(src, tx)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not restore snapshot: %w", err)
+	}
+
+	created := header.Created.UTC()
+	rs.Created = &created
+	rs.Sequences = header.Sequences
+
+	return db, nil
+}
@@ -0,0 +1,44 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/statefile"
+)
+
+// openShards opens the shard files at paths and spreads the topics of main
+// across them. The shards are closed with the returned database.
+func openShards(main bolted.Database, paths []string) (bolted.Database, error) {
+	shards := []bolted.Database{}
+	closeShards := func() {
+		for _, s := range shards {
+			s.Close()
+		}
+	}
+
+	for _, p := range paths {
+		err := statefile.Recover(p)
+		if err != nil {
+			closeShards()
+			return nil, fmt.Errorf("could not recover state shard %s: %w", p, err)
+		}
+
+		shard, err := embedded.Open(p, 0700, embedded.Options{})
+		if err != nil {
+			closeShards()
+			return nil, fmt.Errorf("could not open state shard %s: %w", p, err)
+		}
+		shards = append(shards, shard)
+	}
+
+	db, err := server.ShardTopics(main, shards...)
+	if err != nil {
+		closeShards()
+		return nil, err
+	}
+
+	return db, nil
+}
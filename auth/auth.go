@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// ErrUnauthenticated is returned by an Authenticator when the request does
+// not carry valid credentials.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// ErrForbidden is returned when the principal of a request lacks the scope
+// the request requires.
+var ErrForbidden = errors.New("forbidden")
+
+// Principal is the authenticated identity behind a request.
+type Principal struct {
+	Name  string
+	Roles []string
+	// Scopes limits the requests of the principal, nil allows all of them.
+	Scopes []string
+}
+
+// HasRole returns true if the principal has been granted the given role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope returns true if the principal may make requests of the scope.
+func (p *Principal) HasScope(scope string) bool {
+	if p.Scopes == nil {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+	// Challenge is sent in the WWW-Authenticate header of 401 responses.
+	Challenge() string
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal stored by the auth middleware, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(*Principal)
+	return p, ok
+}
+
+// Middleware rejects requests that can't be authenticated and stores the
+// principal of authenticated ones in the request context.
+func Middleware(log logr.Logger, a Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := a.Authenticate(r)
+			if errors.Is(err, ErrUnauthenticated) {
+				w.Header().Set("WWW-Authenticate", a.Challenge())
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			if errors.Is(err, ErrForbidden) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+
+			if err != nil {
+				log.Error(err, "could not authenticate request", "method", r.Method, "path", r.URL.Path)
+				http.Error(w, "could not authenticate request", http.StatusInternalServerError)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+		})
+	}
+}
+
+type anyOf []Authenticator
+
+// Any combines authenticators, a request is authenticated by the first one
+// that accepts its credentials.
+func Any(authenticators ...Authenticator) Authenticator {
+	return anyOf(authenticators)
+}
+
+func (a anyOf) Authenticate(r *http.Request) (*Principal, error) {
+	for _, au := range a {
+		p, err := au.Authenticate(r)
+		if errors.Is(err, ErrUnauthenticated) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrUnauthenticated
+}
+
+func (a anyOf) Challenge() string {
+	challenges := make([]string, len(a))
+	for i, au := range a {
+		challenges[i] = au.Challenge()
+	}
+	return strings.Join(challenges, ", ")
+}
+
+type scoped struct {
+	Authenticator
+	scope func(r *http.Request) string
+}
+
+// Scoped rejects requests with ErrForbidden when the principal lacks the
+// scope returned by scope for the request.
+func Scoped(a Authenticator, scope func(r *http.Request) string) Authenticator {
+	return scoped{Authenticator: a, scope: scope}
+}
+
+func (s scoped) Authenticate(r *http.Request) (*Principal, error) {
+	p, err := s.Authenticator.Authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := s.scope(r)
+	if !p.HasScope(scope) {
+		return nil, fmt.Errorf("%w: %s requires the %s scope", ErrForbidden, p.Name, scope)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,66 @@
+package auth_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/draganm/event-buffer/auth"
+)
+
+func TestScoped(t *testing.T) {
+	tokens, err := auth.NewTokens([]string{"reader:r-token:read", "admin:a-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := auth.Scoped(tokens, func(r *http.Request) string {
+		if r.Method == http.MethodGet {
+			return auth.ScopeRead
+		}
+		return auth.ScopeWrite
+	})
+
+	cases := []struct {
+		name   string
+		method string
+		token  string
+		err    error
+	}{
+		{name: "read with read scope", method: http.MethodGet, token: "r-token"},
+		{name: "write with read scope", method: http.MethodPost, token: "r-token", err: auth.ErrForbidden},
+		{name: "read with all scopes", method: http.MethodGet, token: "a-token"},
+		{name: "write with all scopes", method: http.MethodPost, token: "a-token"},
+		{name: "unknown token", method: http.MethodGet, token: "x-token", err: auth.ErrUnauthenticated},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(c.method, "/events", nil)
+			r.Header.Set("Authorization", "Bearer "+c.token)
+
+			_, err := a.Authenticate(r)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("expected error %v, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestNewTokensRejectsMalformedEntries(t *testing.T) {
+	entries := [][]string{
+		{"reader"},
+		{"reader:"},
+		{"reader:r-token:read:extra"},
+		{"reader:r-token:admin"},
+		{"reader:r-token", "writer:r-token"},
+	}
+
+	for _, e := range entries {
+		_, err := auth.NewTokens(e)
+		if err == nil {
+			t.Fatalf("expected %q to be rejected", e)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Basic authenticates requests using HTTP Basic auth against a set of
+// users with bcrypt hashed passwords.
+type Basic struct {
+	users map[string][]byte
+}
+
+// NewBasic creates a Basic authenticator from `user:bcrypt-hash` entries.
+func NewBasic(entries []string) (*Basic, error) {
+	users := map[string][]byte{}
+	for i, e := range entries {
+		user, hash, found := strings.Cut(e, ":")
+		if !found || user == "" || hash == "" {
+			// the entry itself is not reported, it may hold a password
+			return nil, fmt.Errorf("basic auth entry %d must have the form user:bcrypt-hash", i)
+		}
+
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for user %q: %w", user, err)
+		}
+
+		users[user] = []byte(hash)
+	}
+
+	return &Basic{users: users}, nil
+}
+
+func (b *Basic) Authenticate(r *http.Request) (*Principal, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	hash, found := b.users[user]
+	if !found {
+		return nil, ErrUnauthenticated
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	return &Principal{Name: user}, nil
+}
+
+func (b *Basic) Challenge() string {
+	return `Basic realm="event-buffer"`
+}
@@ -0,0 +1,82 @@
+package auth_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/draganm/event-buffer/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasic(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := auth.NewBasic([]string{"alice:" + string(hash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		user     string
+		password string
+		noAuth   bool
+		err      error
+	}{
+		{name: "valid credentials", user: "alice", password: "secret"},
+		{name: "wrong password", user: "alice", password: "guess", err: auth.ErrUnauthenticated},
+		{name: "unknown user", user: "bob", password: "secret", err: auth.ErrUnauthenticated},
+		{name: "no credentials", noAuth: true, err: auth.ErrUnauthenticated},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/events", nil)
+			if !c.noAuth {
+				r.SetBasicAuth(c.user, c.password)
+			}
+
+			p, err := b.Authenticate(r)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("expected error %v, got %v", c.err, err)
+			}
+			if c.err == nil && p.Name != c.user {
+				t.Fatalf("expected principal %s, got %s", c.user, p.Name)
+			}
+		})
+	}
+}
+
+func TestNewBasicRejectsMalformedEntries(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		entry    string
+		contains string
+	}{
+		{entry: "alice" + string(hash), contains: "entry 1 "},
+		{entry: ":" + string(hash), contains: "entry 1 "},
+		{entry: "alice:", contains: "entry 1 "},
+		{entry: "alice:secret", contains: `user "alice"`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.entry, func(t *testing.T) {
+			_, err := auth.NewBasic([]string{"bob:" + string(hash), c.entry})
+			if err == nil {
+				t.Fatal("expected entry to be rejected")
+			}
+			if !strings.Contains(err.Error(), c.contains) {
+				t.Fatalf("expected error to mention %s, got %v", c.contains, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// defaultCacheSize bounds caches of authenticators that don't set a size.
+const defaultCacheSize = 10000
+
+// principalCache remembers principals of expensive authentications, keyed
+// by a hash of the credentials. It holds at most size principals and
+// evicts the least recently used one when full. Rejections are not cached,
+// so guessing credentials can't fill the cache.
+type principalCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     list.List
+}
+
+type principalCacheEntry struct {
+	key       [sha256.Size]byte
+	principal *Principal
+	expires   time.Time
+}
+
+func credentialsKey(parts ...string) [sha256.Size]byte {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+func (pc *principalCache) get(key [sha256.Size]byte, now time.Time) (*Principal, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	el, found := pc.entries[key]
+	if !found {
+		return nil, false
+	}
+	e := el.Value.(*principalCacheEntry)
+	if !now.Before(e.expires) {
+		pc.lru.Remove(el)
+		delete(pc.entries, key)
+		return nil, false
+	}
+	pc.lru.MoveToFront(el)
+	return e.principal, true
+}
+
+func (pc *principalCache) put(key [sha256.Size]byte, p *Principal, expires time.Time, size int) {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.entries == nil {
+		pc.entries = map[[sha256.Size]byte]*list.Element{}
+	}
+
+	el, found := pc.entries[key]
+	if found {
+		e := el.Value.(*principalCacheEntry)
+		e.principal = p
+		e.expires = expires
+		pc.lru.MoveToFront(el)
+		return
+	}
+
+	pc.entries[key] = pc.lru.PushFront(&principalCacheEntry{key: key, principal: p, expires: expires})
+	for pc.lru.Len() > size {
+		oldest := pc.lru.Back()
+		pc.lru.Remove(oldest)
+		delete(pc.entries, oldest.Value.(*principalCacheEntry).key)
+	}
+}
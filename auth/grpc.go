@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/go-logr/logr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// authenticateCall authenticates a gRPC call by the credentials in its
+// metadata, e.g. the authorization header, and stores the principal in the
+// returned context.
+func authenticateCall(ctx context.Context, log logr.Logger, a Authenticator, method string) (context.Context, error) {
+	r := (&http.Request{Method: "POST", URL: &url.URL{Path: method}, Header: http.Header{}}).WithContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, values := range md {
+		for _, v := range values {
+			r.Header.Add(k, v)
+		}
+	}
+
+	p, err := a.Authenticate(r)
+	if errors.Is(err, ErrUnauthenticated) {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if errors.Is(err, ErrForbidden) {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if err != nil {
+		log.Error(err, "could not authenticate call", "method", method)
+		return nil, status.Error(codes.Internal, "could not authenticate call")
+	}
+
+	return NewContext(ctx, p), nil
+}
+
+// UnaryServerInterceptor rejects unary gRPC calls that can't be
+// authenticated, like Middleware does for HTTP requests.
+func UnaryServerInterceptor(log logr.Logger, a Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authenticateCall(ctx, log, a, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rejects streaming gRPC calls that can't be
+// authenticated.
+func StreamServerInterceptor(log logr.Logger, a Authenticator) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticateCall(ss.Context(), log, a, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Introspection authenticates opaque bearer tokens by asking an OAuth2
+// token introspection endpoint (RFC 7662) about them. Active tokens are
+// cached for CacheTTL, but never beyond the expiry of the token. At most
+// CacheSize tokens are cached, 10000 when it is zero.
+type Introspection struct {
+	Endpoint     string
+	ClientID     string
+	ClientSecret string
+	CacheTTL     time.Duration
+	CacheSize    int
+	Client       *http.Client
+
+	cache principalCache
+}
+
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope"`
+	Subject  string `json:"sub"`
+	Username string `json:"username"`
+	Expires  int64  `json:"exp"`
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func (in *Introspection) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	key := credentialsKey(token)
+	now := time.Now()
+
+	p, found := in.cache.get(key, now)
+	if found {
+		return p, nil
+	}
+
+	ir, err := in.introspect(r, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ir.Active {
+		return nil, ErrUnauthenticated
+	}
+
+	name := ir.Username
+	if name == "" {
+		name = ir.Subject
+	}
+	p = &Principal{Name: name, Roles: strings.Fields(ir.Scope)}
+
+	expires := now.Add(in.CacheTTL)
+	if ir.Expires != 0 {
+		exp := time.Unix(ir.Expires, 0)
+		if exp.Before(expires) {
+			expires = exp
+		}
+	}
+
+	in.cache.put(key, p, expires, in.CacheSize)
+
+	return p, nil
+}
+
+func (in *Introspection) introspect(r *http.Request, token string) (*introspectionResponse, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	req, err := http.NewRequestWithContext(r.Context(), "POST", in.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create introspection request: %w", err)
+	}
+
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.Header.Set("accept", "application/json")
+	if in.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(in.ClientID), url.QueryEscape(in.ClientSecret))
+	}
+
+	client := in.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform introspection request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		rd, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("unexpected introspection status %s: %s", res.Status, string(rd))
+	}
+
+	ir := &introspectionResponse{}
+	err = json.NewDecoder(res.Body).Decode(ir)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode introspection response: %w", err)
+	}
+
+	return ir, nil
+}
+
+func (in *Introspection) Challenge() string {
+	return `Bearer realm="event-buffer"`
+}
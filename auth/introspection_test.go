@@ -0,0 +1,133 @@
+package auth_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/draganm/event-buffer/auth"
+)
+
+// introspectionServer answers introspection requests with the responses
+// keyed by token and counts the requests.
+func introspectionServer(t *testing.T, responses map[string]map[string]any) (*httptest.Server, *atomic.Int32) {
+	requests := &atomic.Int32{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		res, found := responses[r.PostFormValue("token")]
+		if !found {
+			res = map[string]any{"active": false}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(s.Close)
+	return s, requests
+}
+
+func authenticateBearer(a auth.Authenticator, token string) (*auth.Principal, error) {
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return a.Authenticate(r)
+}
+
+func TestIntrospectionCachesPrincipals(t *testing.T) {
+	s, requests := introspectionServer(t, map[string]map[string]any{
+		"valid": {"active": true, "username": "alice", "scope": "read write"},
+	})
+	in := &auth.Introspection{Endpoint: s.URL, CacheTTL: time.Minute}
+
+	for i := 0; i < 3; i++ {
+		p, err := authenticateBearer(in, "valid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Name != "alice" || !p.HasRole("write") {
+			t.Fatalf("unexpected principal %+v", p)
+		}
+	}
+
+	if requests.Load() != 1 {
+		t.Fatalf("expected 1 introspection request, got %d", requests.Load())
+	}
+}
+
+func TestIntrospectionDoesNotCacheRejections(t *testing.T) {
+	s, requests := introspectionServer(t, nil)
+	in := &auth.Introspection{Endpoint: s.URL, CacheTTL: time.Minute}
+
+	for i := 0; i < 3; i++ {
+		_, err := authenticateBearer(in, "revoked")
+		if !errors.Is(err, auth.ErrUnauthenticated) {
+			t.Fatalf("expected %v, got %v", auth.ErrUnauthenticated, err)
+		}
+	}
+
+	if requests.Load() != 3 {
+		t.Fatalf("expected 3 introspection requests, got %d", requests.Load())
+	}
+}
+
+func TestIntrospectionDoesNotCacheBeyondTokenExpiry(t *testing.T) {
+	s, requests := introspectionServer(t, map[string]map[string]any{
+		"expired": {"active": true, "sub": "alice", "exp": time.Now().Add(-time.Second).Unix()},
+	})
+	in := &auth.Introspection{Endpoint: s.URL, CacheTTL: time.Minute}
+
+	for i := 0; i < 2; i++ {
+		_, err := authenticateBearer(in, "expired")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if requests.Load() != 2 {
+		t.Fatalf("expected 2 introspection requests, got %d", requests.Load())
+	}
+}
+
+func TestIntrospectionCachesPerToken(t *testing.T) {
+	s, requests := introspectionServer(t, map[string]map[string]any{
+		"first":  {"active": true, "sub": "alice"},
+		"second": {"active": true, "sub": "bob"},
+	})
+	in := &auth.Introspection{Endpoint: s.URL, CacheTTL: time.Minute}
+
+	for token, name := range map[string]string{"first": "alice", "second": "bob"} {
+		p, err := authenticateBearer(in, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Name != name {
+			t.Fatalf("expected principal %s, got %s", name, p.Name)
+		}
+	}
+
+	if requests.Load() != 2 {
+		t.Fatalf("expected 2 introspection requests, got %d", requests.Load())
+	}
+}
+
+func TestIntrospectionEvictsLeastRecentlyUsedTokens(t *testing.T) {
+	s, requests := introspectionServer(t, map[string]map[string]any{
+		"first":  {"active": true, "sub": "alice"},
+		"second": {"active": true, "sub": "bob"},
+		"third":  {"active": true, "sub": "carol"},
+	})
+	in := &auth.Introspection{Endpoint: s.URL, CacheTTL: time.Minute, CacheSize: 2}
+
+	// third evicts second, first was used more recently
+	for _, token := range []string{"first", "second", "first", "third", "first", "second"} {
+		_, err := authenticateBearer(in, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if requests.Load() != 4 {
+		t.Fatalf("expected 4 introspection requests, got %d", requests.Load())
+	}
+}
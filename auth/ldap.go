@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP authenticates HTTP Basic credentials by binding to an LDAP server
+// (e.g. Active Directory) as the user. Groups listed in the memberOf
+// attribute of the user are mapped to roles. Connections to ldap:// URLs
+// are upgraded with StartTLS before the credentials are sent.
+type LDAP struct {
+	URL string
+	// TLSConfig is used for ldaps:// URLs and StartTLS.
+	TLSConfig *tls.Config
+	// Timeout bounds dialing and each request, 10s when zero.
+	Timeout time.Duration
+	// UserDNTemplate is the DN (or UPN for Active Directory) used to bind,
+	// {user} is replaced by the user name.
+	UserDNTemplate string
+	// BaseDN and UserFilter are used to look up the group memberships of
+	// the bound user. {user} in the filter is replaced by the user name.
+	BaseDN     string
+	UserFilter string
+	// GroupRoles maps group DNs to roles.
+	GroupRoles map[string]string
+	// Successful binds are cached for CacheTTL, at most CacheSize of them,
+	// 10000 when it is zero.
+	CacheTTL  time.Duration
+	CacheSize int
+
+	cache principalCache
+}
+
+// ParseGroupRoles parses `group-dn=role` entries, the mapping is split on
+// the last `=` since group DNs contain `=` themselves.
+func ParseGroupRoles(entries []string) (map[string]string, error) {
+	groupRoles := map[string]string{}
+	for _, e := range entries {
+		idx := strings.LastIndex(e, "=")
+		if idx <= 0 || idx == len(e)-1 {
+			return nil, fmt.Errorf("group role mapping %q must have the form group-dn=role", e)
+		}
+		groupRoles[strings.ToLower(e[:idx])] = e[idx+1:]
+	}
+	return groupRoles, nil
+}
+
+func (l *LDAP) Authenticate(r *http.Request) (*Principal, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok || user == "" || password == "" {
+		// an empty password would result in an unauthenticated bind
+		return nil, ErrUnauthenticated
+	}
+
+	if strings.ContainsAny(user, ",+\"\\<>;=#*()\x00") {
+		return nil, ErrUnauthenticated
+	}
+
+	key := credentialsKey(user, password)
+	now := time.Now()
+
+	p, found := l.cache.get(key, now)
+	if found {
+		return p, nil
+	}
+
+	p, err := l.bind(user, password)
+	if err != nil {
+		return nil, err
+	}
+
+	l.cache.put(key, p, now.Add(l.CacheTTL), l.CacheSize)
+
+	return p, nil
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse ldap url: %w", err)
+	}
+
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	tc := &tls.Config{}
+	if l.TLSConfig != nil {
+		tc = l.TLSConfig.Clone()
+	}
+	if tc.ServerName == "" {
+		tc.ServerName = u.Hostname()
+	}
+
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}), ldap.DialWithTLSConfig(tc))
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to ldap server: %w", err)
+	}
+
+	conn.SetTimeout(timeout)
+
+	if u.Scheme == "ldap" {
+		err = conn.StartTLS(tc)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not start tls with ldap server: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (l *LDAP) bind(user, password string) (*Principal, error) {
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	err = conn.Bind(strings.ReplaceAll(l.UserDNTemplate, "{user}", user), password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrUnauthenticated
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not bind to ldap server: %w", err)
+	}
+
+	p := &Principal{Name: user}
+
+	if l.BaseDN == "" || len(l.GroupRoles) == 0 {
+		return p, nil
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		1,
+		0,
+		false,
+		strings.ReplaceAll(l.UserFilter, "{user}", ldap.EscapeFilter(user)),
+		[]string{"memberOf"},
+		nil,
+	))
+
+	if err != nil {
+		return nil, fmt.Errorf("could not look up ldap groups: %w", err)
+	}
+
+	for _, entry := range res.Entries {
+		for _, group := range entry.GetAttributeValues("memberOf") {
+			role, found := l.GroupRoles[strings.ToLower(group)]
+			if found && !p.HasRole(role) {
+				p.Roles = append(p.Roles, role)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func (l *LDAP) Challenge() string {
+	return `Basic realm="event-buffer"`
+}
@@ -0,0 +1,107 @@
+package auth_test
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/draganm/event-buffer/auth"
+)
+
+func TestLDAPRejectsUsersThatWouldChangeTheDN(t *testing.T) {
+	// the server is never dialed, a user that got past the check would fail
+	// with a connection error instead of ErrUnauthenticated
+	l := &auth.LDAP{
+		URL:            "ldap://127.0.0.1:1",
+		UserDNTemplate: "uid={user},ou=people,dc=example,dc=com",
+	}
+
+	for _, user := range []string{
+		"admin,ou=admins",
+		"a+cn=admin",
+		`a"b`,
+		`a\2cb`,
+		"<admin>",
+		"a;b",
+		"cn=admin",
+		"#admin",
+		"*",
+		"a(b)",
+		"a\x00b",
+		"",
+	} {
+		t.Run(user, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/events", nil)
+			r.SetBasicAuth(user, "secret")
+
+			_, err := l.Authenticate(r)
+			if !errors.Is(err, auth.ErrUnauthenticated) {
+				t.Fatalf("expected %v, got %v", auth.ErrUnauthenticated, err)
+			}
+		})
+	}
+}
+
+func TestParseGroupRoles(t *testing.T) {
+	roles, err := auth.ParseGroupRoles([]string{"CN=Admins,OU=Groups,DC=example,DC=com=admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	role := roles["cn=admins,ou=groups,dc=example,dc=com"]
+	if role != "admin" {
+		t.Fatalf("expected the admin role, got %v", roles)
+	}
+
+	for _, e := range []string{"admin", "=admin", "cn=admins="} {
+		_, err := auth.ParseGroupRoles([]string{e})
+		if err == nil {
+			t.Fatalf("expected %q to be rejected", e)
+		}
+	}
+}
+
+func TestLDAPTimesOutUnresponsiveServers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	// accept connections but never answer, the StartTLS request must time out
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+
+	l := &auth.LDAP{
+		URL:            "ldap://" + ln.Addr().String(),
+		UserDNTemplate: "uid={user},ou=people,dc=example,dc=com",
+		Timeout:        100 * time.Millisecond,
+	}
+
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.SetBasicAuth("alice", "secret")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Authenticate(r)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || errors.Is(err, auth.ErrUnauthenticated) {
+			t.Fatalf("expected a connection error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("authentication did not time out")
+	}
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Scopes of API tokens, read covers polling and consuming, write covers
+// publishing and changing topics.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// Tokens authenticates requests carrying one of a set of static bearer
+// tokens. Tokens are kept as hashes, so they are not compared byte by byte.
+type Tokens struct {
+	tokens map[[sha256.Size]byte]*Principal
+}
+
+// NewTokens creates a Tokens authenticator from `name:token[:scopes]`
+// entries, scopes is a comma separated list of read and write and defaults
+// to both.
+func NewTokens(entries []string) (*Tokens, error) {
+	tokens := map[[sha256.Size]byte]*Principal{}
+	for _, e := range entries {
+		parts := strings.Split(e, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("token entry for %q must have the form name:token[:scopes]", parts[0])
+		}
+
+		scopes := []string{ScopeRead, ScopeWrite}
+		if len(parts) == 3 {
+			scopes = strings.Split(parts[2], ",")
+			for _, s := range scopes {
+				if s != ScopeRead && s != ScopeWrite {
+					return nil, fmt.Errorf("token %q has unknown scope %q, expected read or write", parts[0], s)
+				}
+			}
+		}
+
+		key := credentialsKey(parts[1])
+		if _, found := tokens[key]; found {
+			return nil, fmt.Errorf("token of %q is used by another entry", parts[0])
+		}
+		tokens[key] = &Principal{Name: parts[0], Scopes: scopes}
+	}
+
+	return &Tokens{tokens: tokens}, nil
+}
+
+// LoadTokenFile reads token entries from a file with one entry per line,
+// empty lines and lines starting with # are skipped.
+func LoadTokenFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open token file: %w", err)
+	}
+	defer f.Close()
+
+	entries := []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+
+	err = s.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read token file: %w", err)
+	}
+
+	return entries, nil
+}
+
+func (t *Tokens) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	p, found := t.tokens[credentialsKey(token)]
+	if !found {
+		return nil, ErrUnauthenticated
+	}
+
+	principal := *p
+	return &principal, nil
+}
+
+func (t *Tokens) Challenge() string {
+	return `Bearer realm="event-buffer"`
+}
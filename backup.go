@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/draganm/event-buffer/objectstore"
+)
+
+// openBackupTarget opens the object store for backups, plain paths are
+// used as local directories.
+func openBackupTarget(target string) (objectstore.Store, error) {
+	if strings.Contains(target, "://") {
+		return objectstore.Open(target)
+	}
+
+	dir, err := filepath.Abs(target)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve backup directory: %w", err)
+	}
+
+	return objectstore.Open("file://" + filepath.ToSlash(dir))
+}
@@ -0,0 +1,145 @@
+// Package backup stores snapshots of the state in an object store.
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/draganm/event-buffer/objectstore"
+)
+
+const (
+	prefix = "backups/"
+	suffix = ".snapshot"
+	// keyTimeFormat sorts lexically in the order backups were taken.
+	keyTimeFormat = "20060102T150405.000000000Z"
+)
+
+// ErrNoBackup is returned by Latest when the store contains no backups.
+var ErrNoBackup = errors.New("no backup found")
+
+// Key returns the object key of a backup taken at t.
+func Key(t time.Time) string {
+	return prefix + t.UTC().Format(keyTimeFormat) + suffix
+}
+
+// Time returns when the backup with the given key was taken.
+func Time(key string) (time.Time, error) {
+	name := strings.TrimSuffix(path.Base(key), suffix)
+	return time.Parse(keyTimeFormat, name)
+}
+
+// Take writes a consistent snapshot with write to the store and returns its
+// key. The snapshot is spooled to a temporary file first, so the read
+// transaction is not held open during the upload.
+func Take(ctx context.Context, write func(io.Writer) error, store objectstore.Store) (string, error) {
+	f, err := os.CreateTemp("", "event-buffer-backup-*")
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	now := time.Now()
+
+	err = write(f)
+	if err != nil {
+		return "", fmt.Errorf("could not write snapshot: %w", err)
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("could not determine snapshot size: %w", err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", fmt.Errorf("could not rewind snapshot: %w", err)
+	}
+
+	key := Key(now)
+	err = store.Put(ctx, key, f, size)
+	if err != nil {
+		return "", fmt.Errorf("could not upload backup: %w", err)
+	}
+
+	return key, nil
+}
+
+// List returns the keys of all backups, oldest first.
+func List(ctx context.Context, store objectstore.Store) ([]string, error) {
+	keys, err := store.List(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not list backups: %w", err)
+	}
+
+	backups := []string{}
+	for _, k := range keys {
+		if strings.HasSuffix(k, suffix) {
+			backups = append(backups, k)
+		}
+	}
+	sort.Strings(backups)
+
+	return backups, nil
+}
+
+// Latest returns the key of the most recent backup.
+func Latest(ctx context.Context, store objectstore.Store) (string, error) {
+	backups, err := List(ctx, store)
+	if err != nil {
+		return "", err
+	}
+	if len(backups) == 0 {
+		return "", ErrNoBackup
+	}
+	return backups[len(backups)-1], nil
+}
+
+// Before returns the key of the most recent backup taken at or before t.
+func Before(ctx context.Context, store objectstore.Store, t time.Time) (string, error) {
+	backups, err := List(ctx, store)
+	if err != nil {
+		return "", err
+	}
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		bt, err := Time(backups[i])
+		if err != nil {
+			continue
+		}
+		if !bt.After(t) {
+			return backups[i], nil
+		}
+	}
+
+	return "", ErrNoBackup
+}
+
+// Prune deletes all but the keep most recent backups.
+func Prune(ctx context.Context, store objectstore.Store, keep int) error {
+	backups, err := List(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	if len(backups) <= keep {
+		return nil
+	}
+
+	for _, k := range backups[:len(backups)-keep] {
+		err = store.Delete(ctx, k)
+		if err != nil {
+			return fmt.Errorf("could not delete backup %s: %w", k, err)
+		}
+	}
+
+	return nil
+}
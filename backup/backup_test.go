@@ -0,0 +1,178 @@
+package backup_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/backup"
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/server/testrig"
+	"github.com/draganm/event-buffer/snapshot"
+	"github.com/go-logr/logr"
+)
+
+func openStore(t *testing.T) objectstore.Store {
+	store, err := objectstore.Open("file://" + filepath.ToSlash(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// restoredEvents restores the backup with the given key into a new state
+// and returns the number of events a server on it holds.
+func restoredEvents(t *testing.T, ctx context.Context, store objectstore.Store, key string) uint64 {
+	src, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	db, err := embedded.Open(filepath.Join(t.TempDir(), "state"), 0700, embedded.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
+		_, err := snapshot.Restore(src, tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := server.New(logr.Discard(), db, server.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := srv.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats.Events
+}
+
+func TestBackupsRestoreTheEventsTheyWereTakenWith(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	url, srv, err := testrig.StartServer(ctx, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl, err := client.New(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := openStore(t)
+
+	err = cl.SendEvents(ctx, []any{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := backup.Take(ctx, srv.WriteSnapshot, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cl.SendEvents(ctx, []any{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := backup.Take(ctx, srv.WriteSnapshot, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := backup.Latest(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != second {
+		t.Fatalf("expected the latest backup %s, got %s", second, latest)
+	}
+
+	for key, expected := range map[string]uint64{first: 2, second: 3} {
+		n := restoredEvents(t, ctx, store, key)
+		if n != expected {
+			t.Fatalf("expected %d events restored from %s, got %d", expected, key, n)
+		}
+	}
+}
+
+func TestBefore(t *testing.T) {
+	ctx := context.Background()
+	store := openStore(t)
+
+	first, err := backup.Take(ctx, func(w io.Writer) error { return nil }, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	taken, err := backup.Time(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	_, err = backup.Take(ctx, func(w io.Writer) error { return nil }, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := backup.Before(ctx, store, taken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != first {
+		t.Fatalf("expected %s, got %s", first, key)
+	}
+
+	_, err = backup.Before(ctx, store, taken.Add(-time.Second))
+	if !errors.Is(err, backup.ErrNoBackup) {
+		t.Fatalf("expected %v, got %v", backup.ErrNoBackup, err)
+	}
+}
+
+func TestPruneKeepsTheMostRecentBackups(t *testing.T) {
+	ctx := context.Background()
+	store := openStore(t)
+
+	keys := []string{}
+	for i := 0; i < 3; i++ {
+		key, err := backup.Take(ctx, func(w io.Writer) error { return nil }, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		time.Sleep(time.Millisecond)
+	}
+
+	err := backup.Prune(ctx, store, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	left, err := backup.List(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || left[0] != keys[1] || left[1] != keys[2] {
+		t.Fatalf("expected %v to be kept, got %v", keys[1:], left)
+	}
+}
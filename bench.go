@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+var benchCommand = &cli.Command{
+	Name:  "bench",
+	Usage: "work with results of the benchmarks in server/benchmarks",
+	Subcommands: []*cli.Command{
+		benchCompareCommand,
+	},
+}
+
+var benchCompareCommand = &cli.Command{
+	Name:      "compare",
+	Usage:     "compare two files of go test -bench output and fail when a benchmark regressed",
+	ArgsUsage: "<old results> <new results>",
+	Flags: []cli.Flag{
+		&cli.Float64Flag{
+			Name:  "threshold",
+			Usage: "largest tolerated increase of ns/op in percent",
+			Value: 10,
+		},
+		&cli.Float64Flag{
+			Name:  "alloc-threshold",
+			Usage: "largest tolerated increase of B/op and allocs/op in percent",
+			Value: 10,
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 2 {
+			return fmt.Errorf("expected the old and the new results, got %d arguments", c.NArg())
+		}
+
+		old, err := readBenchResults(c.Args().Get(0))
+		if err != nil {
+			return err
+		}
+		current, err := readBenchResults(c.Args().Get(1))
+		if err != nil {
+			return err
+		}
+
+		thresholds := map[string]float64{
+			"ns/op":     c.Float64("threshold"),
+			"B/op":      c.Float64("alloc-threshold"),
+			"allocs/op": c.Float64("alloc-threshold"),
+		}
+
+		regressions := compareBenchResults(os.Stdout, old, current, thresholds)
+		if regressions > 0 {
+			return fmt.Errorf("%d benchmark metrics regressed beyond their threshold", regressions)
+		}
+		return nil
+	},
+}
+
+// benchResults maps the names of benchmarks to the mean of each of their
+// metrics, e.g. ns/op, across all runs.
+type benchResults map[string]map[string]float64
+
+// readBenchResults reads the benchmark lines of go test -bench output,
+// other lines are skipped. The GOMAXPROCS suffix of names is dropped, so
+// results of machines with different numbers of CPUs can be compared.
+func readBenchResults(path string) (benchResults, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open benchmark results: %w", err)
+	}
+	defer f.Close()
+
+	sums := map[string]map[string]float64{}
+	counts := map[string]map[string]int{}
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		// name, iterations and at least one value with its unit
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+
+		name := fields[0]
+		if i := strings.LastIndex(name, "-"); i > 0 {
+			if _, err := strconv.Atoi(name[i+1:]); err == nil {
+				name = name[:i]
+			}
+		}
+
+		if sums[name] == nil {
+			sums[name] = map[string]float64{}
+			counts[name] = map[string]int{}
+		}
+		for i := 2; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q of %s in %s", fields[i], name, path)
+			}
+			sums[name][fields[i+1]] += v
+			counts[name][fields[i+1]]++
+		}
+	}
+
+	err = s.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read benchmark results: %w", err)
+	}
+
+	if len(sums) == 0 {
+		return nil, fmt.Errorf("%s has no benchmark results", path)
+	}
+
+	results := benchResults{}
+	for name, metrics := range sums {
+		results[name] = map[string]float64{}
+		for unit, sum := range metrics {
+			results[name][unit] = sum / float64(counts[name][unit])
+		}
+	}
+	return results, nil
+}
+
+// compareBenchResults writes a table of the changes of the metrics with a
+// threshold and returns the number of metrics that increased by more than
+// theirs. Benchmarks missing in one of the results are listed, they don't
+// count as regressions.
+func compareBenchResults(w io.Writer, old, current benchResults, thresholds map[string]float64) int {
+	names := []string{}
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, found := old[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	units := []string{"ns/op", "B/op", "allocs/op"}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "benchmark\tunit\told\tnew\tdelta\t")
+
+	regressions := 0
+	for _, name := range names {
+		o, inOld := old[name]
+		n, inNew := current[name]
+		switch {
+		case !inOld:
+			fmt.Fprintf(tw, "%s\t\t\t\tnew\t\n", name)
+			continue
+		case !inNew:
+			fmt.Fprintf(tw, "%s\t\t\t\tmissing\t\n", name)
+			continue
+		}
+
+		for _, unit := range units {
+			ov, foundOld := o[unit]
+			nv, foundNew := n[unit]
+			if !foundOld || !foundNew {
+				continue
+			}
+
+			delta := 0.0
+			if ov != 0 {
+				delta = (nv - ov) / ov * 100
+			} else if nv != 0 {
+				delta = 100
+			}
+
+			verdict := ""
+			if delta > thresholds[unit] {
+				verdict = "REGRESSION"
+				regressions++
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%+.2f%%\t%s\n", name, unit, formatBenchValue(ov), formatBenchValue(nv), delta, verdict)
+		}
+	}
+
+	tw.Flush()
+	return regressions
+}
+
+func formatBenchValue(v float64) string {
+	if v >= 100 {
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/draganm/event-buffer/server"
+	"github.com/urfave/cli/v2"
+)
+
+var bundleCommand = &cli.Command{
+	Name:  "bundle",
+	Usage: "manage offline replication bundles",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "internal-url",
+			Usage:   "base URL of the internal API of the server",
+			Value:   "http://localhost:5000",
+			EnvVars: []string{"INTERNAL_URL"},
+		},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:      "export",
+			Usage:     "export a signed bundle of events after an event id",
+			ArgsUsage: "<file>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "after",
+					Usage: "id of the last event that is not included in the bundle",
+				},
+				&cli.StringFlag{
+					Name:  "topic",
+					Usage: "topic to export instead of the events of the buffer",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return errors.New("bundle file must be provided")
+				}
+
+				u, err := url.Parse(c.String("internal-url"))
+				if err != nil {
+					return fmt.Errorf("could not parse internal URL: %w", err)
+				}
+
+				u = u.JoinPath("bundle")
+				q := url.Values{"after": []string{c.String("after")}}
+				if c.String("topic") != "" {
+					q.Set("topic", c.String("topic"))
+				}
+				u.RawQuery = q.Encode()
+
+				req, err := http.NewRequestWithContext(c.Context, "GET", u.String(), nil)
+				if err != nil {
+					return fmt.Errorf("could not create request: %w", err)
+				}
+
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return fmt.Errorf("could not perform request: %w", err)
+				}
+
+				defer res.Body.Close()
+
+				if res.StatusCode != http.StatusOK {
+					rd, _ := io.ReadAll(res.Body)
+					return fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+				}
+
+				f, err := os.Create(c.Args().First())
+				if err != nil {
+					return fmt.Errorf("could not create bundle file: %w", err)
+				}
+
+				_, err = io.Copy(f, res.Body)
+				if err != nil {
+					f.Close()
+					return fmt.Errorf("could not write bundle: %w", err)
+				}
+
+				err = f.Sync()
+				if err != nil {
+					f.Close()
+					return fmt.Errorf("could not sync bundle: %w", err)
+				}
+
+				return f.Close()
+			},
+		},
+		{
+			Name:      "import",
+			Usage:     "validate and import a bundle",
+			ArgsUsage: "<file>",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return errors.New("bundle file must be provided")
+				}
+
+				f, err := os.Open(c.Args().First())
+				if err != nil {
+					return fmt.Errorf("could not open bundle: %w", err)
+				}
+
+				defer f.Close()
+
+				u, err := url.Parse(c.String("internal-url"))
+				if err != nil {
+					return fmt.Errorf("could not parse internal URL: %w", err)
+				}
+
+				req, err := http.NewRequestWithContext(c.Context, "POST", u.JoinPath("bundle").String(), f)
+				if err != nil {
+					return fmt.Errorf("could not create request: %w", err)
+				}
+
+				req.Header.Set("content-type", "application/gzip")
+
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return fmt.Errorf("could not perform request: %w", err)
+				}
+
+				defer res.Body.Close()
+
+				rd, _ := io.ReadAll(res.Body)
+				if res.StatusCode != http.StatusOK {
+					return fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+				}
+
+				fmt.Print(string(rd))
+
+				return nil
+			},
+		},
+		{
+			Name:  "keygen",
+			Usage: "generate a key pair for signing bundles",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "out",
+					Usage: "prefix of the generated .key and .pub files",
+					Value: "bundle",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				private, public, err := server.GenerateBundleKeys()
+				if err != nil {
+					return err
+				}
+
+				err = os.WriteFile(c.String("out")+".key", private, 0600)
+				if err != nil {
+					return fmt.Errorf("could not write private key: %w", err)
+				}
+
+				err = os.WriteFile(c.String("out")+".pub", public, 0644)
+				if err != nil {
+					return fmt.Errorf("could not write public key: %w", err)
+				}
+
+				return nil
+			},
+		},
+	},
+}
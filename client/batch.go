@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Batch is the range of ids and sequence numbers assigned to the events of
+// a batch publish. Sequence numbers count the events appended to the
+// buffer or topic, they are consecutive within a batch.
+type Batch struct {
+	Count         int    `json:"count"`
+	FirstID       string `json:"first_id"`
+	LastID        string `json:"last_id"`
+	FirstSequence uint64 `json:"first_sequence"`
+	LastSequence  uint64 `json:"last_sequence"`
+}
+
+// PublishBatch appends events atomically, either all of them are stored
+// or none. Unlike SendEvents the events are never spooled or published to
+// other targets, the returned range is the one assigned by the buffer of
+// the client.
+func (c *Client) PublishBatch(ctx context.Context, events []any) (*Batch, error) {
+	return c.publishBatch(ctx, events, nil)
+}
+
+// publishBatch publishes events atomically with the headers h.
+func (c *Client) publishBatch(ctx context.Context, events []any, h http.Header) (b *Batch, err error) {
+	if c.breaker != nil {
+		if !c.breaker.allow() {
+			return nil, ErrCircuitOpen
+		}
+		defer func() {
+			c.breaker.record(err)
+		}()
+	}
+
+	d, err := json.Marshal(events)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal events: %w", err)
+	}
+
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	req, err := c.newPublishRequest(ctx, c.eventsURL.JoinPath("batch").String(), d)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range h {
+		req.Header[k] = v
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, newStatusError(res)
+	}
+
+	b = &Batch{}
+	err = json.NewDecoder(res.Body).Decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode response: %w", err)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of publishing while the circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// WithCircuitBreaker stops publishing for cooldown after failures
+// consecutive publish requests found the buffer unavailable. Once the
+// cooldown is over a single request probes the buffer and closes the
+// circuit again if it succeeds.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(c *Client) {
+		c.breaker = &breaker{threshold: failures, cooldown: cooldown}
+	}
+}
+
+// Fallback handles a JSON encoded batch of events that could not be
+// published because the buffer is unavailable or the circuit is open,
+// cause is the error of the publish, its result is returned by
+// SendEvents.
+type Fallback func(ctx context.Context, batch []byte, cause error) error
+
+// WithFallback calls f with batches that could not be published. It is not
+// called when events are spooled, see WithSpool.
+func WithFallback(f Fallback) Option {
+	return func(c *Client) {
+		c.fallback = f
+	}
+}
+
+// Drop discards batches that could not be published.
+func Drop() Fallback {
+	return func(ctx context.Context, batch []byte, cause error) error {
+		return nil
+	}
+}
+
+// Alternate publishes batches that could not be published to another
+// buffer, e.g. one in a different region.
+func Alternate(alternate *Client) Fallback {
+	return func(ctx context.Context, batch []byte, cause error) error {
+		return alternate.publish(ctx, batch, "")
+	}
+}
+
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow returns false while the circuit is open, once the cooldown is
+// over it lets a single probe through.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	// cancelled requests tell nothing about the buffer
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+
+	if !unavailable(err) {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		cooldown := b.cooldown
+		// an overloaded buffer tells how long to back off
+		se := &StatusError{}
+		if errors.As(err, &se) && se.RetryAfter > cooldown {
+			cooldown = se.RetryAfter
+		}
+		b.openUntil = time.Now().Add(cooldown)
+	}
+}
+
+func (b *breaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold
+}
+
+// CircuitOpen returns true if publishing is suspended by the circuit
+// breaker.
+func (c *Client) CircuitOpen() bool {
+	return c.breaker != nil && c.breaker.open()
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,23 +11,204 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/klauspost/compress/zstd"
 )
 
 type Client struct {
-	eventsURL *url.URL
+	eventsURL    *url.URL
+	consumersURL *url.URL
+	producersURL *url.URL
+	seenSetsURL  *url.URL
+	topicsURL    *url.URL
+	peersURL     *url.URL
+	// compression is the content encoding of published events.
+	compression  string
+	spoolDir     string
+	spool        *spool
+	breaker      *breaker
+	fallback     Fallback
+	targetURLs   []string
+	targets      []*url.URL
+	targetPolicy TargetPolicy
+	replicaURLs  []string
+	replicas     []*url.URL
+	hedgeDelay   time.Duration
+	// replicasFirst sends polls to the replicas before the buffer.
+	replicasFirst bool
+	// requestTimeout bounds each request except polls.
+	requestTimeout time.Duration
+	topic          string
+	// pollWait is how long polls wait for new events, zero leaves it to
+	// the buffer.
+	pollWait time.Duration
+	// token is sent as bearer token with every request.
+	token string
+}
+
+type Option func(c *Client)
+
+// WithCompression compresses published events with gzip or zstd.
+func WithCompression(encoding string) Option {
+	return func(c *Client) {
+		c.compression = encoding
+	}
+}
+
+// WithPollWait makes polls wait up to d for new events instead of the 20
+// seconds of the buffer. Polls that time out return no events instead of
+// being retried, so Poll and PollForEvents may return empty results.
+func WithPollWait(d time.Duration) Option {
+	return func(c *Client) {
+		c.pollWait = d
+	}
+}
+
+// WithTopic publishes to and polls the topic instead of the events of the
+// buffer, the topic has to exist, see CreateTopic. Consumer cursors and
+// transactions always refer to the events of the buffer.
+func WithTopic(topic string) Option {
+	return func(c *Client) {
+		c.topic = topic
+	}
+}
+
+// WithToken authenticates every request with the bearer token, e.g. an
+// API token of the buffer.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// do performs a request of the client.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return http.DefaultClient.Do(req)
 }
 
-func New(baseURL string) (*Client, error) {
+// topicEventsURL returns the URL events of the topic of the client are
+// published to and polled from.
+func (c *Client) topicEventsURL(base *url.URL) *url.URL {
+	if c.topic == "" {
+		return base.JoinPath("events")
+	}
+	return base.JoinPath("topics", c.topic, "events")
+}
+
+// WithRequestTimeout bounds every request but polls, which wait for
+// events, by timeout. Deadlines of the context passed to a call are
+// honored as well.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.requestTimeout = timeout
+	}
+}
+
+// callContext applies the request timeout to ctx.
+func (c *Client) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.requestTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.requestTimeout)
+}
+
+func New(baseURL string, opts ...Option) (*Client, error) {
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse base URL: %w", err)
 	}
-	eventsURL := u.JoinPath("events")
+	c := &Client{consumersURL: u.JoinPath("consumers"), producersURL: u.JoinPath("producers"), seenSetsURL: u.JoinPath("seen-sets"), topicsURL: u.JoinPath("topics"), peersURL: u.JoinPath("peers")}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.eventsURL = c.topicEventsURL(u)
+
+	switch c.compression {
+	case "", "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", c.compression)
+	}
+
+	for _, t := range c.targetURLs {
+		tu, err := url.Parse(t)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse target URL: %w", err)
+		}
+		c.targets = append(c.targets, c.topicEventsURL(tu))
+	}
+
+	for _, r := range c.replicaURLs {
+		ru, err := url.Parse(r)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse replica URL: %w", err)
+		}
+		c.replicas = append(c.replicas, c.topicEventsURL(ru))
+	}
 
-	return &Client{eventsURL: eventsURL}, nil
+	if c.spoolDir != "" {
+		c.spool, err = openSpool(c.spoolDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
 
 }
 
+// newPublishRequest creates a request publishing the JSON body d,
+// compressing it if configured.
+func (c *Client) newPublishRequest(ctx context.Context, u string, d []byte) (*http.Request, error) {
+	if c.compression != "" {
+		buf := &bytes.Buffer{}
+		var w io.WriteCloser
+		switch c.compression {
+		case "gzip":
+			w = gzip.NewWriter(buf)
+		case "zstd":
+			zw, err := zstd.NewWriter(buf)
+			if err != nil {
+				return nil, fmt.Errorf("could not create zstd writer: %w", err)
+			}
+			w = zw
+		}
+
+		_, err := w.Write(d)
+		if err != nil {
+			return nil, fmt.Errorf("could not compress request: %w", err)
+		}
+
+		err = w.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not compress request: %w", err)
+		}
+
+		d = buf.Bytes()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(d))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Set("content-type", "application/json")
+	if c.compression != "" {
+		req.Header.Set("content-encoding", c.compression)
+	}
+
+	return req, nil
+}
+
+// SendEvents publishes events. With a spool, events that can't be
+// published because the buffer is unavailable are spooled and nil is
+// returned, see WithSpool.
 func (c *Client) SendEvents(ctx context.Context, events []any) error {
 
 	d, err := json.Marshal(events)
@@ -34,14 +216,155 @@ func (c *Client) SendEvents(ctx context.Context, events []any) error {
 		return fmt.Errorf("could not marshal events: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", c.eventsURL.String(), bytes.NewReader(d))
+	if c.spool != nil {
+		return c.sendSpooled(ctx, d)
+	}
+
+	err = c.publish(ctx, d, "")
+	if err != nil && c.fallback != nil && unavailable(err) {
+		return c.fallback(ctx, d, err)
+	}
+
+	return err
+}
+
+// SendEventsOnce publishes events with an idempotency key. A buffer
+// remembering idempotency keys stores the events only once, when they are
+// sent again with the same key, e.g. after a lost response. The events
+// are not spooled.
+func (c *Client) SendEventsOnce(ctx context.Context, key string, events []any) error {
+	d, err := json.Marshal(events)
+	if err != nil {
+		return fmt.Errorf("could not marshal events: %w", err)
+	}
+
+	err = c.publish(ctx, d, key)
+	if err != nil && c.fallback != nil && unavailable(err) {
+		return c.fallback(ctx, d, err)
+	}
+
+	return err
+}
+
+// publish sends a JSON encoded list of events, key is the idempotency key
+// of the request and may be empty.
+func (c *Client) publish(ctx context.Context, d []byte, key string) (err error) {
+	if c.breaker != nil {
+		if !c.breaker.allow() {
+			return ErrCircuitOpen
+		}
+		defer func() {
+			c.breaker.record(err)
+		}()
+	}
+
+	switch {
+	case len(c.targets) == 0:
+		return c.publishTo(ctx, c.eventsURL, d, key)
+	case c.targetPolicy == PublishToAll:
+		return c.publishToAll(ctx, d, key)
+	default:
+		return c.publishToFirst(ctx, d, key)
+	}
+}
+
+// publishTo sends a JSON encoded list of events to one buffer.
+func (c *Client) publishTo(ctx context.Context, eventsURL *url.URL, d []byte, key string) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	req, err := c.newPublishRequest(ctx, eventsURL.String(), d)
+	if err != nil {
+		return err
+	}
+
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return newStatusError(res)
+	}
+
+	return nil
+}
+
+// newStatusError reads the rejection of a publish request.
+func newStatusError(res *http.Response) *StatusError {
+	rd, _ := io.ReadAll(res.Body)
+	se := &StatusError{StatusCode: res.StatusCode, Status: res.Status, Message: string(rd)}
+	seconds, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err == nil && seconds > 0 {
+		se.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return se
+}
+
+// StatusError is returned when the buffer rejects a publish request.
+// RetryAfter is set when the buffer is overloaded and asks producers to
+// wait before publishing again.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s: %s", e.Status, e.Message)
+}
+
+// unavailable returns true if a request failed because the buffer could
+// not be reached or was not able to handle it, as opposed to rejecting it.
+func unavailable(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	te := &TargetsError{}
+	if errors.As(err, &te) {
+		return te.unavailable()
+	}
+
+	se := &StatusError{}
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500 || se.StatusCode == http.StatusTooManyRequests
+	}
+
+	ue := &url.Error{}
+	return errors.As(err, &ue)
+}
+
+// UpdateCursor registers the consumer and stores the id of the last event
+// it has processed.
+func (c *Client) UpdateCursor(ctx context.Context, consumer, position string) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	d, err := json.Marshal(map[string]string{"position": position})
+	if err != nil {
+		return fmt.Errorf("could not marshal cursor: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.consumersURL.JoinPath(consumer, "cursor").String(), bytes.NewReader(d))
 	if err != nil {
 		return fmt.Errorf("could not create request: %w", err)
 	}
 
 	req.Header.Set("content-type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("could not perform request: %w", err)
 	}
@@ -56,6 +379,104 @@ func (c *Client) SendEvents(ctx context.Context, events []any) error {
 	return nil
 }
 
+// Heartbeat tells the buffer the consumer is alive, a non empty position
+// also moves its cursor.
+func (c *Client) Heartbeat(ctx context.Context, consumer, position string) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	d, err := json.Marshal(map[string]string{"position": position})
+	if err != nil {
+		return fmt.Errorf("could not marshal heartbeat: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.consumersURL.JoinPath(consumer, "heartbeat").String(), bytes.NewReader(d))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Set("content-type", "application/json")
+
+	res, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		rd, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	return nil
+}
+
+// PositionConflictError is returned when a transaction expects the
+// consumer at a different position, e.g. because it has already been
+// committed.
+type PositionConflictError struct {
+	Message  string `json:"error"`
+	Position string `json:"position"`
+}
+
+func (e *PositionConflictError) Error() string {
+	return fmt.Sprintf("position conflict: %s", e.Message)
+}
+
+// Commit moves the cursor of the consumer from expected to position and
+// publishes events atomically, expected is empty for a consumer that is
+// not registered yet. The ids of the published events are returned.
+func (c *Client) Commit(ctx context.Context, consumer, expected, position string, events []any) ([]string, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	d, err := json.Marshal(map[string]any{
+		"expected": expected,
+		"position": position,
+		"events":   events,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal transaction: %w", err)
+	}
+
+	req, err := c.newPublishRequest(ctx, c.consumersURL.JoinPath(consumer, "transactions").String(), d)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		pce := &PositionConflictError{}
+		err = json.NewDecoder(res.Body).Decode(pce)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode position conflict: %w", err)
+		}
+		return nil, pce
+	}
+
+	if res.StatusCode != http.StatusOK {
+		rd, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	committed := struct {
+		IDs []string `json:"ids"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&committed)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode response: %w", err)
+	}
+
+	return committed.IDs, nil
+}
+
 type event struct {
 	ID      string
 	Payload json.RawMessage
@@ -69,8 +490,9 @@ func (e *event) UnmarshalJSON(p []byte) error {
 		return fmt.Errorf("could not unmarshal parts: %w", err)
 	}
 
-	if len(parts) != 2 {
-		return fmt.Errorf("expected 2 parts, got %d", len(parts))
+	// parts after the payload carry metadata like the expiry time
+	if len(parts) < 2 {
+		return fmt.Errorf("expected at least 2 parts, got %d", len(parts))
 	}
 	var id string
 	err = json.Unmarshal(parts[0], &id)
@@ -87,9 +509,78 @@ func (e *event) UnmarshalJSON(p []byte) error {
 
 var errTimeout = errors.New("timeout")
 
+// RetentionExpiredError is returned when polling after an event that has
+// already been pruned. Oldest is the id of the oldest event still in the
+// buffer, or empty when the buffer is empty.
+type RetentionExpiredError struct {
+	Message string `json:"error"`
+	Oldest  string `json:"oldest"`
+}
+
+func (e *RetentionExpiredError) Error() string {
+	return fmt.Sprintf("retention expired: %s", e.Message)
+}
+
 func (c *Client) PollForEvents(ctx context.Context, lastID string, limit int, sort string, evts any) ([]string, error) {
+	p, err := c.Poll(ctx, lastID, limit, sort, evts)
+	if err != nil {
+		return nil, err
+	}
+	return p.IDs, nil
+}
+
+// Poll is the result of polling for events. Head is the id of the newest
+// event in the buffer and ServerTime the time of the server when the
+// events were read. Cursor is the id to poll after next, it is past the
+// last of IDs when events of a seen set were skipped.
+type Poll struct {
+	IDs        []string
+	Head       string
+	ServerTime time.Time
+	Cursor     string
+}
+
+// Lag returns how far the newest event of the buffer was stored after the
+// last polled event.
+func (p *Poll) Lag() (time.Duration, error) {
+	if len(p.IDs) == 0 || p.Head == "" {
+		return 0, nil
+	}
+
+	last, err := eventTime(p.IDs[len(p.IDs)-1])
+	if err != nil {
+		return 0, err
+	}
+
+	head, err := eventTime(p.Head)
+	if err != nil {
+		return 0, err
+	}
+
+	return head.Sub(last), nil
+}
+
+// eventTime returns the time encoded in an event id, ids of buffers with
+// an id prefix are <prefix>:<uuid>.
+func eventTime(id string) (time.Time, error) {
+	u, err := uuid.FromString(id[strings.LastIndex(id, ":")+1:])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse event id %s: %w", id, err)
+	}
+
+	ts, err := uuid.TimestampFromV6(u)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not get timestamp of event id %s: %w", id, err)
+	}
+
+	return ts.Time()
+}
+
+// Poll waits for events after lastID like PollForEvents and returns them
+// together with the head of the buffer.
+func (c *Client) Poll(ctx context.Context, lastID string, limit int, sort string, evts any) (*Poll, error) {
 	for {
-		ids, err := c.pollForEvents(ctx, lastID, limit, sort, evts)
+		p, err := c.poll(ctx, lastID, limit, sort, nil, evts)
 
 		if err == errTimeout {
 			continue
@@ -99,41 +590,110 @@ func (c *Client) PollForEvents(ctx context.Context, lastID string, limit int, so
 			return nil, err
 		}
 
-		return ids, nil
+		return p, nil
 	}
 }
 
-func (c *Client) pollForEvents(ctx context.Context, lastID string, limit int, sort string, evts any) ([]string, error) {
-	uc := *c.eventsURL
+// poll performs a poll, params are added to its query.
+func (c *Client) poll(ctx context.Context, lastID string, limit int, sort string, params url.Values, evts any) (*Poll, error) {
+	var p *Poll
+	var body []byte
+	var err error
+	if len(c.replicas) > 0 {
+		p, body, err = c.hedgedPoll(ctx, lastID, limit, sort, params)
+	} else {
+		p, body, err = c.pollOnce(ctx, pollURL(c.eventsURL, lastID, limit, sort, params, c.pollWait))
+	}
+
+	if err != nil {
+		return nil, err
+	}
 
-	u := &uc
+	p.IDs, err = decodeEvents(bytes.NewReader(body), evts)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Cursor == "" && len(p.IDs) > 0 {
+		p.Cursor = p.IDs[len(p.IDs)-1]
+	}
+
+	return p, nil
+}
+
+func pollURL(eventsURL *url.URL, lastID string, limit int, sort string, params url.Values, wait time.Duration) string {
+	u := *eventsURL
 	q := u.Query()
 	q.Set("limit", strconv.FormatInt(int64(limit), 10))
 	q.Set("after", lastID)
+	if sort != "" {
+		q.Set("sort", sort)
+	}
+	for k, v := range params {
+		q[k] = v
+	}
+	if wait > 0 {
+		q.Set("wait", wait.String())
+	}
 	u.RawQuery = q.Encode()
-	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	return u.String()
+}
+
+// pollOnce performs a single poll request and returns the undecoded events.
+func (c *Client) pollOnce(ctx context.Context, u string) (*Poll, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
-		return nil, fmt.Errorf("could not create request: %w", err)
+		return nil, nil, fmt.Errorf("could not create request: %w", err)
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.do(req)
 	if err != nil {
-		return nil, fmt.Errorf("could not perform request: %w", err)
+		return nil, nil, fmt.Errorf("could not perform request: %w", err)
 	}
 
 	defer res.Body.Close()
 
 	if res.StatusCode == http.StatusRequestTimeout {
-		return nil, errTimeout
+		return nil, nil, errTimeout
+	}
+
+	if res.StatusCode == http.StatusGone {
+		re := &RetentionExpiredError{}
+		err = json.NewDecoder(res.Body).Decode(re)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not decode retention expired response: %w", err)
+		}
+		return nil, nil, re
 	}
 
 	if res.StatusCode != http.StatusOK {
 		rd, _ := io.ReadAll(res.Body)
-		return nil, fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+		return nil, nil, fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
 	}
 
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read response: %w", err)
+	}
+
+	p := &Poll{Head: res.Header.Get("X-Buffer-Head"), Cursor: res.Header.Get("X-Buffer-Scanned")}
+
+	st := res.Header.Get("X-Server-Time")
+	if st != "" {
+		p.ServerTime, err = time.Parse(time.RFC3339Nano, st)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse server time: %w", err)
+		}
+	}
+
+	return p, body, nil
+}
+
+// decodeEvents unmarshals the payloads of a list of events into evts and
+// returns their ids.
+func decodeEvents(r io.Reader, evts any) ([]string, error) {
 	resp := []event{}
-	err = json.NewDecoder(res.Body).Decode(&resp)
+	err := json.NewDecoder(r).Decode(&resp)
 	if err != nil {
 		return nil, fmt.Errorf("could not decode response: %w", err)
 	}
@@ -162,3 +722,37 @@ func (c *Client) pollForEvents(ctx context.Context, lastID string, limit int, so
 
 	return ids, nil
 }
+
+// GetEvents fetches the events with the given ids, events that don't exist
+// anymore are left out. The payloads are unmarshalled into evts and their
+// ids returned in the same order.
+func (c *Client) GetEvents(ctx context.Context, ids []string, evts any) ([]string, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	d, err := json.Marshal(ids)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal ids: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.eventsURL.JoinPath("get").String(), bytes.NewReader(d))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Set("content-type", "application/json")
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		rd, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	return decodeEvents(res.Body, evts)
+}
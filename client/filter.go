@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// Filter selects the events a poll returns. Events match when their type
+// field is one of Types, if any are given, and the value at each JSON
+// pointer of Fields is equal to its value.
+type Filter struct {
+	Types  []string
+	Fields map[string]any
+}
+
+func (f Filter) params() (url.Values, error) {
+	q := url.Values{}
+	for _, t := range f.Types {
+		q.Add("type", t)
+	}
+	for pointer, value := range f.Fields {
+		d, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal value of %s: %w", pointer, err)
+		}
+		q.Add("match", pointer+"="+string(d))
+	}
+	return q, nil
+}
+
+// PollFiltered polls like Poll but only returns events matching f. When
+// the server skipped many events without finding a match, the poll
+// returns without IDs and its Cursor is where the next poll has to start.
+func (c *Client) PollFiltered(ctx context.Context, f Filter, lastID string, limit int, sort string, evts any) (*Poll, error) {
+	params, err := f.params()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p, err := c.poll(ctx, lastID, limit, sort, params, evts)
+
+		if err == errTimeout {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	}
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// WithHedgedPolls sends a poll to the next of the replicas when the buffer
+// or the previous replica has not answered it after delay. The first
+// answer is used and the other polls are cancelled. Replicas have to hold
+// the same events under the same ids, e.g. standbys of the buffer.
+func WithHedgedPolls(delay time.Duration, replicaURLs ...string) Option {
+	return func(c *Client) {
+		c.hedgeDelay = delay
+		c.replicaURLs = append(c.replicaURLs, replicaURLs...)
+	}
+}
+
+type pollResult struct {
+	poll *Poll
+	body []byte
+	err  error
+}
+
+// final returns true for answers that are used even when other replicas
+// have not answered yet.
+func (r pollResult) final() bool {
+	re := &RetentionExpiredError{}
+	return r.err == nil || errors.As(r.err, &re)
+}
+
+func (c *Client) hedgedPoll(ctx context.Context, lastID string, limit int, sort string, params url.Values) (*Poll, []byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	targets := append([]*url.URL{c.eventsURL}, c.replicas...)
+	if c.replicasFirst {
+		targets = append(append([]*url.URL{}, c.replicas...), c.eventsURL)
+	}
+	results := make(chan pollResult, len(targets))
+
+	next := 0
+	launch := func() {
+		u := pollURL(targets[next], lastID, limit, sort, params, c.pollWait)
+		next++
+		go func() {
+			p, body, err := c.pollOnce(ctx, u)
+			results <- pollResult{poll: p, body: body, err: err}
+		}()
+	}
+
+	launch()
+	pending := 1
+
+	timer := time.NewTimer(c.hedgeDelay)
+	defer timer.Stop()
+
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(targets) {
+				launch()
+				pending++
+				timer.Reset(c.hedgeDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.final() {
+				return r.poll, r.body, r.err
+			}
+
+			// a timeout means a buffer is reachable but had no events,
+			// the poll is retried then instead of failing
+			if err == nil || r.err == errTimeout {
+				err = r.err
+			}
+
+			if next < len(targets) {
+				launch()
+				pending++
+			}
+		}
+	}
+
+	return nil, nil, err
+}
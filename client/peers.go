@@ -0,0 +1,157 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Roles of the peers of a buffer.
+const (
+	PeerRolePrimary = "primary"
+	PeerRoleReplica = "replica"
+	PeerRoleMirror  = "mirror"
+	PeerRoleShard   = "shard"
+)
+
+// Peer is an instance listed in the peers catalog of a buffer. Shards list
+// the topics they hold.
+type Peer struct {
+	Name     string   `json:"name"`
+	URL      string   `json:"url"`
+	Role     string   `json:"role"`
+	Topics   []string `json:"topics,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+}
+
+// PeerCatalog describes the buffer a client talks to and its peers.
+type PeerCatalog struct {
+	Self  Peer   `json:"self"`
+	Peers []Peer `json:"peers"`
+}
+
+// Peers fetches the peers catalog of the buffer.
+func (c *Client) Peers(ctx context.Context) (*PeerCatalog, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.peersURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		rd, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	pc := &PeerCatalog{}
+	err = json.NewDecoder(res.Body).Decode(pc)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode peers: %w", err)
+	}
+
+	return pc, nil
+}
+
+// writers returns the URLs of the peers accepting publishes of topic, in
+// the order of their priority: primaries and the shards holding the topic.
+func (pc *PeerCatalog) writers(topic string) []string {
+	return pc.urls(func(p Peer) bool {
+		return p.Role == PeerRolePrimary || p.Role == PeerRoleShard && topic != "" && contains(p.Topics, topic)
+	})
+}
+
+// replicas returns the URLs of the replicas in the order of their
+// priority.
+func (pc *PeerCatalog) replicas() []string {
+	return pc.urls(func(p Peer) bool {
+		return p.Role == PeerRoleReplica
+	})
+}
+
+func (pc *PeerCatalog) urls(include func(Peer) bool) []string {
+	peers := append([]Peer{pc.Self}, pc.Peers...)
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].Priority < peers[j].Priority
+	})
+
+	urls := []string{}
+	seen := map[string]bool{}
+	for _, p := range peers {
+		if include(p) && !seen[p.URL] {
+			urls = append(urls, p.URL)
+			seen[p.URL] = true
+		}
+	}
+	return urls
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// NewFromPeers creates a client for the buffers listed in the peers
+// catalog of the buffer at bootstrapURL. Publishes and consumer requests
+// go to the primary with the lowest priority, publishes fail over to the
+// next primary when it is unavailable. Polls go to the replicas first and
+// fail over to the next replica and finally the primaries. The catalog is
+// read once, create a new client to pick up changes of the topology.
+func NewFromPeers(ctx context.Context, bootstrapURL string, opts ...Option) (*Client, error) {
+	opts = append([]Option{}, opts...)
+	// the spool belongs to the client that is returned
+	bootstrap, err := New(bootstrapURL, append(opts, WithSpool(""))...)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := bootstrap.Peers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover peers: %w", err)
+	}
+
+	writers := pc.writers(bootstrap.topic)
+	if len(writers) == 0 {
+		return nil, errors.New("the peers catalog lists no primary")
+	}
+
+	opts = append(opts, WithTargets(PrimaryBackup, writers[1:]...))
+	replicas := pc.replicas()
+	if len(replicas) > 0 {
+		opts = append(opts, withReplicasFirst())
+	}
+	readers := append(replicas, writers[1:]...)
+	if len(readers) > 0 {
+		// polls only move on when a buffer fails, long polls wait too
+		// long for hedging
+		opts = append(opts, WithHedgedPolls(time.Duration(math.MaxInt64), readers...))
+	}
+
+	return New(writers[0], opts...)
+}
+
+// withReplicasFirst sends polls to the replicas before the buffer, it is
+// polled last.
+func withReplicasFirst() Option {
+	return func(c *Client) {
+		c.replicasFirst = true
+	}
+}
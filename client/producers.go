@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+var (
+	// ErrProducerFenced is returned when a newer session of the producer
+	// was registered, the session can't publish anymore.
+	ErrProducerFenced = errors.New("producer session was fenced")
+	// ErrSequenceOutOfOrder is returned when a sequence neither follows
+	// nor repeats the last one stored for the producer.
+	ErrSequenceOutOfOrder = errors.New("sequence out of order")
+)
+
+// ProducerSession publishes batches exactly once. Every publish has a
+// sequence, the first one of a session follows Sequence. Publishing again
+// with the sequence of the last stored batch returns that batch without
+// storing the events again, so failed publishes are retried with the same
+// sequence and events.
+type ProducerSession struct {
+	c *Client
+	// ID and Epoch identify the session, registering the producer again
+	// fences it.
+	ID    string `json:"session"`
+	Epoch uint64 `json:"epoch"`
+	// Sequence is the sequence of the last batch stored for the producer
+	// when the session was registered.
+	Sequence uint64 `json:"sequence"`
+}
+
+// RegisterProducer starts a new session of the producer name, earlier
+// sessions of the producer are fenced.
+func (c *Client) RegisterProducer(ctx context.Context, name string) (*ProducerSession, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.producersURL.JoinPath(name, "sessions").String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		rd, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	ps := &ProducerSession{c: c}
+	err = json.NewDecoder(res.Body).Decode(ps)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode session: %w", err)
+	}
+
+	return ps, nil
+}
+
+// PublishBatch appends events atomically as the publish with the given
+// sequence of the session.
+func (p *ProducerSession) PublishBatch(ctx context.Context, sequence uint64, events []any) (*Batch, error) {
+	h := http.Header{}
+	h.Set("Producer-Session", p.ID)
+	h.Set("Producer-Epoch", strconv.FormatUint(p.Epoch, 10))
+	h.Set("Producer-Sequence", strconv.FormatUint(sequence, 10))
+
+	b, err := p.c.publishBatch(ctx, events, h)
+	se := &StatusError{}
+	if errors.As(err, &se) {
+		switch se.StatusCode {
+		case http.StatusConflict:
+			return nil, fmt.Errorf("%w: %s", ErrProducerFenced, se.Message)
+		case http.StatusPreconditionFailed:
+			return nil, fmt.Errorf("%w: %s", ErrSequenceOutOfOrder, se.Message)
+		}
+	}
+
+	return b, err
+}
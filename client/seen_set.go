@@ -0,0 +1,159 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// SeenSet is a bloom filter of ids of events that have been processed
+// already. Uploaded to the buffer it lets polls for a replay skip these
+// events, a fraction of unprocessed events up to the false positive rate
+// of the set is skipped as well.
+type SeenSet struct {
+	bits   []byte
+	hashes int
+}
+
+// NewSeenSet creates a seen set for the expected number of ids with the
+// given false positive rate.
+func NewSeenSet(expected int, falsePositiveRate float64) *SeenSet {
+	if expected < 1 {
+		expected = 1
+	}
+
+	m := math.Ceil(-float64(expected) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(m / float64(expected) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	// the buffer accepts at most 32 hashes
+	if hashes > 32 {
+		hashes = 32
+	}
+
+	return &SeenSet{bits: make([]byte, int(math.Ceil(m/8))+1), hashes: hashes}
+}
+
+// each calls f with the bits of the filter for id, using the same hashing
+// as the buffer, until f returns false.
+func (s *SeenSet) each(id string, f func(byteIndex uint64, mask byte) bool) bool {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+	m := uint64(len(s.bits)) * 8
+	for i := uint64(0); i < uint64(s.hashes); i++ {
+		bit := (h1 + i*h2) % m
+		if !f(bit/8, 1<<(bit%8)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Add adds the id of a processed event.
+func (s *SeenSet) Add(id string) {
+	s.each(id, func(i uint64, mask byte) bool {
+		s.bits[i] |= mask
+		return true
+	})
+}
+
+// Contains returns true if the id may have been added.
+func (s *SeenSet) Contains(id string) bool {
+	return s.each(id, func(i uint64, mask byte) bool {
+		return s.bits[i]&mask != 0
+	})
+}
+
+// UploadSeenSet stores the seen set in the buffer and returns its id for
+// PollSkippingSeen. The buffer keeps it in memory until it has not been
+// used for an hour or it is deleted.
+func (c *Client) UploadSeenSet(ctx context.Context, s *SeenSet) (string, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	u := *c.seenSetsURL
+	u.RawQuery = url.Values{"hashes": {strconv.Itoa(s.hashes)}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(s.bits))
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Set("content-type", "application/octet-stream")
+
+	res, err := c.do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		rd, _ := io.ReadAll(res.Body)
+		return "", fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	created := struct {
+		ID string `json:"id"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&created)
+	if err != nil {
+		return "", fmt.Errorf("could not decode response: %w", err)
+	}
+
+	return created.ID, nil
+}
+
+// DeleteSeenSet removes an uploaded seen set from the buffer.
+func (c *Client) DeleteSeenSet(ctx context.Context, id string) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.seenSetsURL.JoinPath(id).String(), nil)
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		rd, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	return nil
+}
+
+// PollSkippingSeen polls like Poll but leaves out events of the uploaded
+// seen set. When all events after lastID have been skipped, the poll
+// returns without IDs and its Cursor is where the next poll has to start.
+func (c *Client) PollSkippingSeen(ctx context.Context, seenSet, lastID string, limit int, sort string, evts any) (*Poll, error) {
+	for {
+		p, err := c.poll(ctx, lastID, limit, sort, url.Values{"skip-seen": {seenSet}}, evts)
+
+		if err == errTimeout {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	}
+}
@@ -0,0 +1,239 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithSpool stores events in dir when the buffer is unavailable and
+// publishes them in order once it can be reached again. While events are
+// spooled, newly sent events are spooled behind them, so the order of
+// SendEvents calls is kept. Spooled events are delivered at least once, a
+// batch may be published twice if the buffer stored it but the response
+// was lost.
+func WithSpool(dir string) Option {
+	return func(c *Client) {
+		c.spoolDir = dir
+	}
+}
+
+const (
+	spoolSuffix = ".json"
+	// rejectedSuffix is appended to spooled batches the buffer rejected,
+	// they are kept for inspection but not retried.
+	rejectedSuffix = ".rejected"
+)
+
+// spool keeps batches of events in files named by their sequence number.
+type spool struct {
+	dir string
+	// mu serializes publishing while the spool is used, so batches are
+	// published in order.
+	mu   sync.Mutex
+	next uint64
+}
+
+func openSpool(dir string) (*spool, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create spool directory: %w", err)
+	}
+
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read spool: %w", err)
+	}
+
+	s := &spool{dir: dir}
+
+	// rejected batches keep their sequence numbers as well
+	for _, de := range des {
+		name := de.Name()
+		// files starting with a dot are incomplete writes
+		if de.IsDir() || strings.HasPrefix(name, ".") || !(strings.HasSuffix(name, spoolSuffix) || strings.HasSuffix(name, spoolSuffix+rejectedSuffix)) {
+			continue
+		}
+		seq, err := strconv.ParseUint(name[:strings.Index(name, ".")], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool file %s: %w", name, err)
+		}
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+
+	return s, nil
+}
+
+// entries returns the names of spooled batches in the order they have to
+// be published.
+func (s *spool) entries() ([]string, error) {
+	des, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read spool: %w", err)
+	}
+
+	names := []string{}
+	for _, de := range des {
+		if de.IsDir() || strings.HasPrefix(de.Name(), ".") || !strings.HasSuffix(de.Name(), spoolSuffix) {
+			continue
+		}
+		names = append(names, de.Name())
+	}
+
+	// names are zero padded, so they sort by sequence
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// add durably stores a batch behind all spooled ones.
+func (s *spool) add(d []byte) error {
+	name := fmt.Sprintf("%020d%s", s.next, spoolSuffix)
+	tmp := filepath.Join(s.dir, "."+name)
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("could not create spool file: %w", err)
+	}
+
+	_, err = f.Write(d)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not write spool file: %w", err)
+	}
+
+	err = os.Rename(tmp, filepath.Join(s.dir, name))
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not store spool file: %w", err)
+	}
+
+	s.next++
+
+	return nil
+}
+
+// flush publishes spooled batches in order until the spool is empty or the
+// buffer is unavailable. Batches the buffer rejects are renamed to
+// *.rejected and skipped.
+func (c *Client) flush(ctx context.Context) (pending bool, err error) {
+	s := c.spool
+
+	entries, err := s.entries()
+	if err != nil {
+		return true, err
+	}
+
+	var rejected error
+	for _, name := range entries {
+		path := filepath.Join(s.dir, name)
+		d, err := os.ReadFile(path)
+		if err != nil {
+			return true, fmt.Errorf("could not read spool file: %w", err)
+		}
+
+		err = c.publish(ctx, d, "")
+		if err != nil && (unavailable(err) || ctx.Err() != nil) {
+			return true, err
+		}
+
+		if err != nil {
+			if rejected == nil {
+				rejected = fmt.Errorf("spooled batch %s was rejected: %w", name, err)
+			}
+			err = os.Rename(path, path+rejectedSuffix)
+		} else {
+			err = os.Remove(path)
+		}
+
+		if err != nil {
+			return true, fmt.Errorf("could not remove spool file: %w", err)
+		}
+	}
+
+	return false, rejected
+}
+
+// sendSpooled publishes d after all spooled batches, spooling it if the
+// buffer is unavailable.
+func (c *Client) sendSpooled(ctx context.Context, d []byte) error {
+	s := c.spool
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// rejected batches are reported by FlushSpool, they don't keep the
+	// events of this call from being published
+	pending, _ := c.flush(ctx)
+
+	if !pending {
+		err := c.publish(ctx, d, "")
+		if err == nil || !unavailable(err) {
+			return err
+		}
+	}
+
+	return s.add(d)
+}
+
+// FlushSpool publishes spooled events, it returns an error if the buffer
+// is unavailable or has rejected spooled events.
+func (c *Client) FlushSpool(ctx context.Context) error {
+	if c.spool == nil {
+		return nil
+	}
+
+	c.spool.mu.Lock()
+	defer c.spool.mu.Unlock()
+
+	_, err := c.flush(ctx)
+	return err
+}
+
+// Spooled returns the number of batches waiting to be published.
+func (c *Client) Spooled() (int, error) {
+	if c.spool == nil {
+		return 0, nil
+	}
+
+	entries, err := c.spool.entries()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(entries), nil
+}
+
+// FlushSpoolPeriodically flushes the spool every interval until ctx is
+// cancelled, so events spooled by producers that stopped sending are
+// published as well. onError receives failed flushes and may be nil.
+func (c *Client) FlushSpoolPeriodically(ctx context.Context, interval time.Duration, onError func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := c.FlushSpool(ctx)
+			if err != nil && onError != nil && ctx.Err() == nil {
+				onError(err)
+			}
+		}
+	}
+}
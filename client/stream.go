@@ -0,0 +1,101 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxStreamLine bounds the size of a single line of an event stream, i.e.
+// of a payload.
+const maxStreamLine = 64 * 1024 * 1024
+
+// StreamEvents receives events over a single long-lived connection, first
+// the buffered events after the id from, or all of them when it's empty,
+// then events as they are appended. handle is called for every event, the
+// stream ends when it returns an error, which is returned, when ctx is
+// cancelled or when the connection is lost. Pass the id of the last
+// handled event to resume.
+func (c *Client) StreamEvents(ctx context.Context, from string, handle func(id string, payload json.RawMessage) error) error {
+	u := *c.eventsURL.JoinPath("stream")
+	if from != "" {
+		q := u.Query()
+		q.Set("from", from)
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("accept", "text/event-stream")
+
+	res, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusGone {
+		re := &RetentionExpiredError{}
+		err = json.NewDecoder(res.Body).Decode(re)
+		if err != nil {
+			return fmt.Errorf("could not decode retention expired response: %w", err)
+		}
+		return re
+	}
+
+	if res.StatusCode != http.StatusOK {
+		rd, _ := io.ReadAll(res.Body)
+		return &StatusError{StatusCode: res.StatusCode, Status: res.Status, Message: string(rd)}
+	}
+
+	sc := bufio.NewScanner(res.Body)
+	sc.Buffer(nil, maxStreamLine)
+
+	id, event, data := "", "", ""
+	for sc.Scan() {
+		line := sc.Text()
+		if line != "" {
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "id":
+				id = value
+			case "event":
+				event = value
+			case "data":
+				data = value
+			}
+			continue
+		}
+
+		// an empty line ends an event
+		switch {
+		case event == "error":
+			return fmt.Errorf("stream failed: %s", data)
+		case data != "":
+			err = handle(id, json.RawMessage(data))
+			if err != nil {
+				return err
+			}
+		}
+		id, event, data = "", "", ""
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	err = sc.Err()
+	if err != nil {
+		return fmt.Errorf("could not read stream: %w", err)
+	}
+
+	return fmt.Errorf("stream ended: %w", io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/gofrs/uuid"
+)
+
+// TargetPolicy decides which of several buffers events are published to.
+type TargetPolicy int
+
+const (
+	// PrimaryBackup publishes to the first buffer that is available, in
+	// the order they were configured.
+	PrimaryBackup TargetPolicy = iota
+	// PublishToAll publishes every batch to all buffers, it fails unless
+	// all of them accepted the batch.
+	PublishToAll
+)
+
+// idempotencyKeyHeader carries a key identifying a batch published to
+// all targets, the same key is sent to every buffer.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// WithTargets publishes to additional buffers according to policy, the
+// buffer of the base URL comes first. Polls and consumer requests still
+// go to the base URL.
+func WithTargets(policy TargetPolicy, baseURLs ...string) Option {
+	return func(c *Client) {
+		c.targetPolicy = policy
+		c.targetURLs = append(c.targetURLs, baseURLs...)
+	}
+}
+
+func (c *Client) allTargets() []*url.URL {
+	return append([]*url.URL{c.eventsURL}, c.targets...)
+}
+
+func (c *Client) publishToFirst(ctx context.Context, d []byte, key string) error {
+	var err error
+	for _, t := range c.allTargets() {
+		err = c.publishTo(ctx, t, d, key)
+		if err == nil || !unavailable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// TargetsError is returned when some of the buffers of PublishToAll did
+// not accept a batch, Failed maps their URLs to the errors.
+type TargetsError struct {
+	Failed map[string]error
+	total  int
+}
+
+func (e *TargetsError) Error() string {
+	urls := []string{}
+	for u := range e.Failed {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+
+	if len(urls) == 0 {
+		return "all buffers accepted events"
+	}
+
+	return fmt.Sprintf("%d of %d buffers did not accept events, %s: %s", len(urls), e.total, urls[0], e.Failed[urls[0]])
+}
+
+// unavailable returns true if none of the buffers stored the batch
+// because all of them were unavailable, so it can be spooled or handed to
+// a fallback without duplicating events.
+func (e *TargetsError) unavailable() bool {
+	if len(e.Failed) < e.total {
+		return false
+	}
+	for _, err := range e.Failed {
+		if !unavailable(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// publishToAll sends the same idempotency key to all buffers, one is
+// generated unless key is given.
+func (c *Client) publishToAll(ctx context.Context, d []byte, key string) error {
+	if key == "" {
+		k, err := uuid.NewV4()
+		if err != nil {
+			return fmt.Errorf("could not generate idempotency key: %w", err)
+		}
+		key = k.String()
+	}
+
+	targets := c.allTargets()
+
+	mu := &sync.Mutex{}
+	te := &TargetsError{Failed: map[string]error{}, total: len(targets)}
+
+	wg := &sync.WaitGroup{}
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *url.URL) {
+			defer wg.Done()
+			err := c.publishTo(ctx, t, d, key)
+			if err != nil {
+				mu.Lock()
+				te.Failed[t.String()] = err
+				mu.Unlock()
+			}
+		}(t)
+	}
+	wg.Wait()
+
+	if len(te.Failed) > 0 {
+		return te
+	}
+
+	return nil
+}
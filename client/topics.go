@@ -0,0 +1,74 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// CreateTopic creates a topic or changes its retention period, zero keeps
+// the events of the topic as long as the buffer keeps its own events.
+func (c *Client) CreateTopic(ctx context.Context, topic string, retention time.Duration) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	cfg := map[string]string{}
+	if retention > 0 {
+		cfg["retention_period"] = retention.String()
+	}
+
+	d, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("could not marshal topic: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.topicsURL.JoinPath(topic).String(), bytes.NewReader(d))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Set("content-type", "application/json")
+
+	res, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		rd, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	return nil
+}
+
+// DeleteTopic removes a topic with all its events.
+func (c *Client) DeleteTopic(ctx context.Context, topic string) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.topicsURL.JoinPath(topic).String(), nil)
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		rd, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+package client
+
+import (
+	"context"
+	"net/url"
+)
+
+// PollTrace returns the events published in the trace with the trace id,
+// in the order of their ids. The buffer has to index traces. Polls for a
+// trace don't wait for events, an empty result means the trace has no
+// further events after lastID.
+func (c *Client) PollTrace(ctx context.Context, traceID, lastID string, limit int, evts any) (*Poll, error) {
+	return c.poll(ctx, lastID, limit, "", url.Values{"trace_id": {traceID}}, evts)
+}
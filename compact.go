@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/snapshot"
+	"github.com/draganm/event-buffer/statefile"
+	"github.com/urfave/cli/v2"
+)
+
+var compactCommand = &cli.Command{
+	Name:  "compact",
+	Usage: "rewrite a state file to reclaim space of pruned events, the server must not be running",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "state-file",
+			Value:   "state",
+			EnvVars: []string{"STATE_FILE"},
+		},
+	},
+	Action: func(c *cli.Context) error {
+		stateFile := c.String("state-file")
+
+		err := statefile.Recover(stateFile)
+		if err != nil {
+			return err
+		}
+
+		before, err := os.Stat(stateFile)
+		if err != nil {
+			return fmt.Errorf("could not stat state file: %w", err)
+		}
+
+		db, err := embedded.Open(stateFile, 0700, embedded.Options{})
+		if err != nil {
+			return fmt.Errorf("could not open state: %w", err)
+		}
+
+		// the snapshot is spooled to a file, so the state is closed before it
+		// is replaced
+		spool, err := os.CreateTemp(filepath.Dir(stateFile), ".compact-*")
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("could not create spool file: %w", err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		err = bolted.SugaredRead(db, func(tx bolted.SugaredReadTx) error {
+			return snapshot.Write(spool, tx)
+		})
+		closeErr := db.Close()
+		if err != nil {
+			return fmt.Errorf("could not write snapshot: %w", err)
+		}
+		if closeErr != nil {
+			return fmt.Errorf("could not close state: %w", closeErr)
+		}
+
+		_, err = spool.Seek(0, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("could not rewind spool file: %w", err)
+		}
+
+		_, err = restoreState(stateFile, spool, nil)
+		if err != nil {
+			return fmt.Errorf("could not compact state: %w", err)
+		}
+
+		after, err := os.Stat(stateFile)
+		if err != nil {
+			return fmt.Errorf("could not stat state file: %w", err)
+		}
+
+		fmt.Printf("compacted state from %d to %d bytes\n", before.Size(), after.Size())
+
+		return nil
+	},
+}
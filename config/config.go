@@ -0,0 +1,104 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/draganm/event-buffer/server"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of the configuration file passed with --config.
+type Config struct {
+	// Listeners replace the single --addr API listener when set.
+	Listeners []Listener `yaml:"listeners" json:"listeners,omitempty"`
+
+	// RedactionRules strip or mask payload fields at poll time.
+	RedactionRules []server.RedactionRule `yaml:"redaction-rules" json:"redaction_rules,omitempty"`
+
+	// DeliveryRateLimits cap the rate events are delivered to consumers.
+	DeliveryRateLimits []server.DeliveryRateLimit `yaml:"delivery-rate-limits" json:"delivery_rate_limits,omitempty"`
+
+	// Peering describes this instance and its peers, served by /peers.
+	Peering server.Peering `yaml:"peering" json:"peering"`
+}
+
+type Listener struct {
+	Name string `yaml:"name" json:"name"`
+	Addr string `yaml:"addr" json:"addr"`
+	// Network is tcp (dual-stack), tcp4 or tcp6.
+	Network string `yaml:"network,omitempty" json:"network,omitempty"`
+	// Interface binds the listener to an address of the network
+	// interface, Network has to be tcp4 or tcp6.
+	Interface string `yaml:"interface,omitempty" json:"interface,omitempty"`
+	ReusePort bool   `yaml:"reuse-port,omitempty" json:"reuse_port,omitempty"`
+	TLS       *TLS   `yaml:"tls,omitempty" json:"tls,omitempty"`
+	// Auth lists the authenticators (basic, introspection, ldap, token)
+	// accepted on the listener, an empty list disables authentication.
+	Auth []string `yaml:"auth" json:"auth"`
+}
+
+type TLS struct {
+	CertFile string `yaml:"cert-file" json:"cert_file"`
+	KeyFile  string `yaml:"key-file" json:"key_file"`
+}
+
+// Load reads and validates the configuration file.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open config file: %w", err)
+	}
+
+	defer f.Close()
+
+	c := &Config{}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return c, nil
+}
+
+func (c *Config) Validate() error {
+	names := map[string]bool{}
+	for i, l := range c.Listeners {
+		if l.Name == "" {
+			return fmt.Errorf("listener %d has no name", i)
+		}
+
+		if names[l.Name] {
+			return fmt.Errorf("duplicate listener name %q", l.Name)
+		}
+		names[l.Name] = true
+
+		if l.Addr == "" {
+			return fmt.Errorf("listener %q has no addr", l.Name)
+		}
+
+		switch l.Network {
+		case "", "tcp", "tcp4", "tcp6":
+		default:
+			return fmt.Errorf("listener %q has unsupported network %q", l.Name, l.Network)
+		}
+
+		if l.TLS != nil && (l.TLS.CertFile == "" || l.TLS.KeyFile == "") {
+			return fmt.Errorf("listener %q must have both cert-file and key-file for tls", l.Name)
+		}
+	}
+	err := server.ValidatePeering(c.Peering)
+	if err != nil {
+		return fmt.Errorf("invalid peering: %w", err)
+	}
+	return server.ValidateRules(c.RedactionRules, c.DeliveryRateLimits)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/draganm/event-buffer/config"
+	"github.com/urfave/cli/v2"
+)
+
+const maskedValue = "***"
+
+// secretFlags hold credentials or URLs carrying them, e.g. webhook tokens.
+var secretFlags = map[string]bool{
+	"claim-check-secret":          true,
+	"introspection-client-secret": true,
+	"basic-auth":                  true,
+	"api-token":                   true,
+	"encryption-key":              true,
+	"outbox-dsn":                  true,
+	"alert-webhook-url":           true,
+}
+
+// effectiveFlag is the resolved value of a flag, Source is flag, env or
+// default.
+type effectiveFlag struct {
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+}
+
+// effectiveConfig is the configuration the server runs with, served by
+// GET /config of the internal API.
+type effectiveConfig struct {
+	ConfigFile string                   `json:"config_file,omitempty"`
+	Flags      map[string]effectiveFlag `json:"flags"`
+	File       *config.Config           `json:"file"`
+}
+
+// resolveConfig returns the values of all flags after merging command
+// line, environment and defaults, with secrets masked, and the content of
+// the configuration file.
+func resolveConfig(c *cli.Context, cfg *config.Config) effectiveConfig {
+	ec := effectiveConfig{
+		ConfigFile: c.String("config"),
+		Flags:      map[string]effectiveFlag{},
+		File:       cfg,
+	}
+
+	for _, f := range c.App.Flags {
+		name := f.Names()[0]
+
+		source := "default"
+		if c.IsSet(name) {
+			source = "flag"
+			if ef, ok := f.(cli.DocGenerationFlag); ok {
+				for _, env := range ef.GetEnvVars() {
+					if _, found := os.LookupEnv(env); found {
+						source = "env"
+					}
+				}
+			}
+		}
+
+		ec.Flags[name] = effectiveFlag{Value: maskFlag(name, c.Value(name)), Source: source}
+	}
+
+	return ec
+}
+
+func maskFlag(name string, v any) any {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.String()
+	case string:
+		if secretFlags[name] && v != "" {
+			return maskedValue
+		}
+		return maskURL(v)
+	case cli.StringSlice:
+		values := []string{}
+		for _, s := range v.Value() {
+			if secretFlags[name] {
+				s = maskedValue
+			}
+			values = append(values, maskURL(s))
+		}
+		return values
+	}
+	return v
+}
+
+// maskURL masks the password of URLs with credentials.
+func maskURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/draganm/event-buffer/server"
+	"github.com/urfave/cli/v2"
+)
+
+// encryptionKeys parses the entries of encryptionKeyEntries, it returns no
+// keys when none are configured.
+func encryptionKeys(c *cli.Context) ([]server.EncryptionKey, error) {
+	entries, err := encryptionKeyEntries(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	keys, err := server.ParseEncryptionKeys(entries)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure encryption keys: %w", err)
+	}
+	return keys, nil
+}
+
+// encryptionKeyEntries returns the entries of --encryption-key followed by
+// the ones of --encryption-key-file, the first one encrypts new payloads.
+func encryptionKeyEntries(c *cli.Context) ([]string, error) {
+	entries := append([]string{}, c.StringSlice("encryption-key")...)
+	if c.String("encryption-key-file") == "" {
+		return entries, nil
+	}
+
+	f, err := os.Open(c.String("encryption-key-file"))
+	if err != nil {
+		return nil, fmt.Errorf("could not open encryption key file: %w", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+
+	err = s.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read encryption key file: %w", err)
+	}
+	return entries, nil
+}
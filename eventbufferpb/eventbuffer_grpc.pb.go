@@ -0,0 +1,263 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: eventbuffer.proto
+
+// The gRPC API of the event buffer. Payloads are JSON documents like on the
+// HTTP API, they are passed as bytes to avoid decoding them.
+
+package eventbufferpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	EventBuffer_Publish_FullMethodName      = "/eventbuffer.v1.EventBuffer/Publish"
+	EventBuffer_Poll_FullMethodName         = "/eventbuffer.v1.EventBuffer/Poll"
+	EventBuffer_StreamEvents_FullMethodName = "/eventbuffer.v1.EventBuffer/StreamEvents"
+	EventBuffer_Prune_FullMethodName        = "/eventbuffer.v1.EventBuffer/Prune"
+)
+
+// EventBufferClient is the client API for EventBuffer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type EventBufferClient interface {
+	// Publish appends events to the buffer or a topic.
+	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error)
+	// Poll returns events after a cursor, waiting for new ones up to wait_ms
+	// when there are none.
+	Poll(ctx context.Context, in *PollRequest, opts ...grpc.CallOption) (*PollResponse, error)
+	// StreamEvents sends the events after from, then events as they are
+	// appended.
+	StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (EventBuffer_StreamEventsClient, error)
+	// Prune removes events stored before a time.
+	Prune(ctx context.Context, in *PruneRequest, opts ...grpc.CallOption) (*PruneResponse, error)
+}
+
+type eventBufferClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewEventBufferClient(cc grpc.ClientConnInterface) EventBufferClient {
+	return &eventBufferClient{cc}
+}
+
+func (c *eventBufferClient) Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error) {
+	out := new(PublishResponse)
+	err := c.cc.Invoke(ctx, EventBuffer_Publish_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *eventBufferClient) Poll(ctx context.Context, in *PollRequest, opts ...grpc.CallOption) (*PollResponse, error) {
+	out := new(PollResponse)
+	err := c.cc.Invoke(ctx, EventBuffer_Poll_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *eventBufferClient) StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (EventBuffer_StreamEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &EventBuffer_ServiceDesc.Streams[0], EventBuffer_StreamEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &eventBufferStreamEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type EventBuffer_StreamEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type eventBufferStreamEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *eventBufferStreamEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *eventBufferClient) Prune(ctx context.Context, in *PruneRequest, opts ...grpc.CallOption) (*PruneResponse, error) {
+	out := new(PruneResponse)
+	err := c.cc.Invoke(ctx, EventBuffer_Prune_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// EventBufferServer is the server API for EventBuffer service.
+// All implementations must embed UnimplementedEventBufferServer
+// for forward compatibility
+type EventBufferServer interface {
+	// Publish appends events to the buffer or a topic.
+	Publish(context.Context, *PublishRequest) (*PublishResponse, error)
+	// Poll returns events after a cursor, waiting for new ones up to wait_ms
+	// when there are none.
+	Poll(context.Context, *PollRequest) (*PollResponse, error)
+	// StreamEvents sends the events after from, then events as they are
+	// appended.
+	StreamEvents(*StreamEventsRequest, EventBuffer_StreamEventsServer) error
+	// Prune removes events stored before a time.
+	Prune(context.Context, *PruneRequest) (*PruneResponse, error)
+	mustEmbedUnimplementedEventBufferServer()
+}
+
+// UnimplementedEventBufferServer must be embedded to have forward compatible implementations.
+type UnimplementedEventBufferServer struct {
+}
+
+func (UnimplementedEventBufferServer) Publish(context.Context, *PublishRequest) (*PublishResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Publish not implemented")
+}
+func (UnimplementedEventBufferServer) Poll(context.Context, *PollRequest) (*PollResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Poll not implemented")
+}
+func (UnimplementedEventBufferServer) StreamEvents(*StreamEventsRequest, EventBuffer_StreamEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamEvents not implemented")
+}
+func (UnimplementedEventBufferServer) Prune(context.Context, *PruneRequest) (*PruneResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Prune not implemented")
+}
+func (UnimplementedEventBufferServer) mustEmbedUnimplementedEventBufferServer() {}
+
+// UnsafeEventBufferServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to EventBufferServer will
+// result in compilation errors.
+type UnsafeEventBufferServer interface {
+	mustEmbedUnimplementedEventBufferServer()
+}
+
+func RegisterEventBufferServer(s grpc.ServiceRegistrar, srv EventBufferServer) {
+	s.RegisterService(&EventBuffer_ServiceDesc, srv)
+}
+
+func _EventBuffer_Publish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EventBufferServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: EventBuffer_Publish_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EventBufferServer).Publish(ctx, req.(*PublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _EventBuffer_Poll_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PollRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EventBufferServer).Poll(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: EventBuffer_Poll_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EventBufferServer).Poll(ctx, req.(*PollRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _EventBuffer_StreamEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EventBufferServer).StreamEvents(m, &eventBufferStreamEventsServer{stream})
+}
+
+type EventBuffer_StreamEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type eventBufferStreamEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *eventBufferStreamEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _EventBuffer_Prune_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PruneRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EventBufferServer).Prune(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: EventBuffer_Prune_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EventBufferServer).Prune(ctx, req.(*PruneRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// EventBuffer_ServiceDesc is the grpc.ServiceDesc for EventBuffer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var EventBuffer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "eventbuffer.v1.EventBuffer",
+	HandlerType: (*EventBufferServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    _EventBuffer_Publish_Handler,
+		},
+		{
+			MethodName: "Poll",
+			Handler:    _EventBuffer_Poll_Handler,
+		},
+		{
+			MethodName: "Prune",
+			Handler:    _EventBuffer_Prune_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvents",
+			Handler:       _EventBuffer_StreamEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "eventbuffer.proto",
+}
@@ -0,0 +1,5 @@
+// Package eventbufferpb holds the protobuf messages and gRPC service of the
+// gRPC API, generated from eventbuffer.proto.
+package eventbufferpb
+
+//go:generate buf generate
@@ -0,0 +1,183 @@
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Files of the service account mounted into pods.
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	tokenFile         = serviceAccountDir + "token"
+	caFile            = serviceAccountDir + "ca.crt"
+	namespaceFile     = serviceAccountDir + "namespace"
+)
+
+var errNotFound = errors.New("not found")
+
+// microTimeFormat is the format of MicroTime fields of Kubernetes objects.
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+func microTime(t time.Time) string {
+	return t.UTC().Format(microTimeFormat)
+}
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// lease is a coordination.k8s.io/v1 Lease.
+type lease struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   objectMeta `json:"metadata"`
+	Spec       leaseSpec  `json:"spec"`
+}
+
+// setURL advertises url, an empty one removes the annotation.
+func (l *lease) setURL(url string) {
+	if url == "" {
+		delete(l.Metadata.Annotations, URLAnnotation)
+		return
+	}
+	if l.Metadata.Annotations == nil {
+		l.Metadata.Annotations = map[string]string{}
+	}
+	l.Metadata.Annotations[URLAnnotation] = url
+}
+
+// client reads and writes leases with the in-cluster configuration.
+type client struct {
+	baseURL   string
+	namespace string
+	tokenFile string
+	http      *http.Client
+}
+
+func newInClusterClient(namespace string) (*client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA of the cluster: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+
+	if namespace == "" {
+		ns, err := os.ReadFile(namespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read namespace of the pod: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+
+	return &client{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		namespace: namespace,
+		tokenFile: tokenFile,
+		http:      &http.Client{Transport: transport},
+	}, nil
+}
+
+func (c *client) leasesURL() string {
+	return c.baseURL + "/apis/coordination.k8s.io/v1/namespaces/" + c.namespace + "/leases"
+}
+
+func (c *client) getLease(ctx context.Context, name string) (*lease, error) {
+	l := &lease{}
+	err := c.do(ctx, "GET", c.leasesURL()+"/"+name, nil, l)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (c *client) createLease(ctx context.Context, l *lease) error {
+	return c.do(ctx, "POST", c.leasesURL(), l, l)
+}
+
+// updateLease replaces the lease, it fails when the lease changed since
+// it was read.
+func (c *client) updateLease(ctx context.Context, l *lease) error {
+	return c.do(ctx, "PUT", c.leasesURL()+"/"+l.Metadata.Name, l, l)
+}
+
+// do sends body as JSON and decodes the response into res.
+func (c *client) do(ctx context.Context, method, url string, body, res any) error {
+	var r io.Reader
+	if body != nil {
+		d, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("could not marshal lease: %w", err)
+		}
+		r = bytes.NewReader(d)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("accept", "application/json")
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+
+	// tokens are rotated, they are read for every request
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return fmt.Errorf("could not read service account token: %w", err)
+	}
+	req.Header.Set("authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not perform request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		rd, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, string(rd))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(res)
+	if err != nil {
+		return fmt.Errorf("could not decode lease: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+// Package leader elects one instance of a deployment as the leader with a
+// Kubernetes Lease, so a pair of instances can run active/passive without
+// an external coordinator.
+//
+// Instances talk to the API server with the in-cluster configuration of
+// their pod, its service account needs get, create and update permissions
+// on leases in its namespace. The leader renews the lease every retry
+// period. The other instances take it over once it has not been renewed for
+// the lease duration, as observed with their own clock so clocks of the
+// nodes don't have to agree. The leader advertises its URL in an
+// annotation of the lease.
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// URLAnnotation holds the URL the leader advertises.
+const URLAnnotation = "event-buffer/url"
+
+// ErrLostLeadership is returned when the leader could not renew the lease
+// before the renew deadline, another instance may have taken over.
+var ErrLostLeadership = errors.New("lost leadership")
+
+type Options struct {
+	// Lease is the name of the Lease object, it is created when missing.
+	Lease string
+	// Namespace of the lease, it defaults to the namespace of the pod.
+	Namespace string
+	// Identity identifies the instance, it defaults to the hostname, the
+	// name of the pod.
+	Identity string
+	// URL is advertised to the other instances while the instance leads,
+	// credentials are left out.
+	URL string
+	// LeaseDuration is how long the other instances wait for the leader
+	// to renew the lease, it defaults to 15s. The leader gives up when it
+	// could not renew it for two thirds of it and retries every seventh.
+	LeaseDuration time.Duration
+}
+
+// Callbacks are called from the goroutine of Run.
+type Callbacks struct {
+	// OnStartedLeading is called when the instance becomes the leader.
+	OnStartedLeading func()
+	// OnNewLeader is called when another instance leads, url is the URL
+	// it advertises.
+	OnNewLeader func(identity, url string)
+}
+
+func (o Options) withDefaults() (Options, error) {
+	if o.Lease == "" {
+		return o, errors.New("lease name is missing")
+	}
+
+	if o.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return o, fmt.Errorf("could not determine identity: %w", err)
+		}
+		o.Identity = hostname
+	}
+
+	if o.URL != "" {
+		u, err := url.Parse(o.URL)
+		if err != nil {
+			return o, fmt.Errorf("invalid url: %w", err)
+		}
+		u.User = nil
+		o.URL = u.String()
+	}
+
+	if o.LeaseDuration == 0 {
+		o.LeaseDuration = 15 * time.Second
+	}
+	if o.LeaseDuration < time.Second {
+		return o, errors.New("lease duration must be at least 1s")
+	}
+
+	return o, nil
+}
+
+// Run takes part in the election until ctx is cancelled, the leader then
+// releases the lease so another instance takes over right away. It returns
+// ErrLostLeadership when the instance stops leading, it has to stop
+// accepting writes.
+func Run(ctx context.Context, log logr.Logger, opts Options, cb Callbacks) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	c, err := newInClusterClient(opts.Namespace)
+	if err != nil {
+		return err
+	}
+
+	e := &elector{
+		client: c,
+		opts:   opts,
+		log:    log.WithValues("lease", opts.Lease, "identity", opts.Identity),
+	}
+	return e.run(ctx, cb)
+}
+
+type elector struct {
+	client *client
+	opts   Options
+	log    logr.Logger
+
+	// observed is the last lease read and observedAt the local time it
+	// was first seen with its holder and renew time.
+	observed   *lease
+	observedAt time.Time
+	leading    bool
+}
+
+func (e *elector) renewDeadline() time.Duration {
+	return e.opts.LeaseDuration * 2 / 3
+}
+
+func (e *elector) retryPeriod() time.Duration {
+	return e.opts.LeaseDuration / 7
+}
+
+func (e *elector) run(ctx context.Context, cb Callbacks) error {
+	leader := ""
+	lastRenew := time.Time{}
+
+	ticker := time.NewTicker(e.retryPeriod())
+	defer ticker.Stop()
+
+	for {
+		acquired, err := e.tryAcquireOrRenew(ctx)
+		if ctx.Err() != nil {
+			return e.release()
+		}
+
+		switch {
+		case err != nil:
+			e.log.Error(err, "could not acquire or renew lease")
+		case acquired:
+			lastRenew = time.Now()
+			if !e.leading {
+				e.leading = true
+				e.log.Info("started leading")
+				cb.OnStartedLeading()
+			}
+		case e.observed.Spec.HolderIdentity != leader && e.observed.Spec.HolderIdentity != "":
+			leader = e.observed.Spec.HolderIdentity
+			e.log.Info("new leader", "leader", leader)
+			cb.OnNewLeader(leader, e.observed.Metadata.Annotations[URLAnnotation])
+		}
+
+		// another instance took over or the lease could not be renewed
+		// in time
+		if e.leading && !acquired && (err == nil || time.Since(lastRenew) > e.renewDeadline()) {
+			return ErrLostLeadership
+		}
+
+		select {
+		case <-ctx.Done():
+			return e.release()
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryAcquireOrRenew returns true if the instance holds the lease.
+func (e *elector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.renewDeadline())
+	defer cancel()
+
+	now := time.Now()
+	l, err := e.client.getLease(ctx, e.opts.Lease)
+	if errors.Is(err, errNotFound) {
+		l = e.newLease(now)
+		err = e.client.createLease(ctx, l)
+		if err != nil {
+			return false, err
+		}
+		e.observe(l, now)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	e.observe(l, now)
+
+	holder := l.Spec.HolderIdentity
+	if holder != "" && holder != e.opts.Identity && now.Before(e.observedAt.Add(e.leaseDuration(l))) {
+		return false, nil
+	}
+
+	if holder != e.opts.Identity {
+		l.Spec.AcquireTime = microTime(now)
+		l.Spec.LeaseTransitions++
+	}
+	l.Spec.HolderIdentity = e.opts.Identity
+	l.Spec.LeaseDurationSeconds = int(e.opts.LeaseDuration / time.Second)
+	l.Spec.RenewTime = microTime(now)
+	l.setURL(e.opts.URL)
+
+	// the resource version makes concurrent takeovers fail
+	err = e.client.updateLease(ctx, l)
+	if err != nil {
+		return false, err
+	}
+	e.observe(l, now)
+	return true, nil
+}
+
+// observe records when the holder or renew time of the lease changed.
+func (e *elector) observe(l *lease, now time.Time) {
+	if e.observed == nil || e.observed.Spec.HolderIdentity != l.Spec.HolderIdentity || e.observed.Spec.RenewTime != l.Spec.RenewTime {
+		e.observedAt = now
+	}
+	e.observed = l
+}
+
+func (e *elector) leaseDuration(l *lease) time.Duration {
+	if l.Spec.LeaseDurationSeconds > 0 {
+		return time.Duration(l.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return e.opts.LeaseDuration
+}
+
+func (e *elector) newLease(now time.Time) *lease {
+	l := &lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata:   objectMeta{Name: e.opts.Lease, Namespace: e.client.namespace},
+		Spec: leaseSpec{
+			HolderIdentity:       e.opts.Identity,
+			LeaseDurationSeconds: int(e.opts.LeaseDuration / time.Second),
+			AcquireTime:          microTime(now),
+			RenewTime:            microTime(now),
+		},
+	}
+	l.setURL(e.opts.URL)
+	return l
+}
+
+// release gives up the lease of a leader that stops.
+func (e *elector) release() error {
+	if !e.leading || e.observed == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.renewDeadline())
+	defer cancel()
+
+	l := e.observed
+	l.Spec.HolderIdentity = ""
+	l.Spec.LeaseDurationSeconds = 1
+	l.Spec.RenewTime = microTime(time.Now())
+	l.setURL("")
+
+	err := e.client.updateLease(ctx, l)
+	if err != nil {
+		e.log.Error(err, "could not release lease")
+		return nil
+	}
+	e.log.Info("released lease")
+	return nil
+}
@@ -0,0 +1,251 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// fakeAPI serves the leases of a namespace like the Kubernetes API server,
+// updates with an outdated resource version conflict.
+type fakeAPI struct {
+	mu      sync.Mutex
+	leases  map[string]*lease
+	version int
+	failing bool
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if f.failing {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := filepath.Base(r.URL.Path)
+
+	switch r.Method {
+	case "GET":
+		l, found := f.leases[name]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(l)
+	case "POST", "PUT":
+		l := &lease{}
+		err := json.NewDecoder(r.Body).Decode(l)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		current, found := f.leases[l.Metadata.Name]
+		if r.Method == "POST" && found {
+			http.Error(w, "already exists", http.StatusConflict)
+			return
+		}
+		if r.Method == "PUT" && (!found || current.Metadata.ResourceVersion != l.Metadata.ResourceVersion) {
+			http.Error(w, "conflict", http.StatusConflict)
+			return
+		}
+		f.version++
+		l.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		f.leases[l.Metadata.Name] = l
+		json.NewEncoder(w).Encode(l)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeAPI) lease(name string) lease {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return *f.leases[name]
+}
+
+func (f *fakeAPI) setFailing(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+func startFakeAPI(t *testing.T) (*fakeAPI, *client) {
+	f := &fakeAPI{leases: map[string]*lease{}}
+	hs := httptest.NewServer(f)
+	t.Cleanup(hs.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f, &client{baseURL: hs.URL, namespace: "ns", tokenFile: tokenFile, http: hs.Client()}
+}
+
+// candidate runs an elector and reports its callbacks.
+type candidate struct {
+	leading  chan struct{}
+	leaders  chan [2]string
+	done     chan error
+	cancel   context.CancelFunc
+	identity string
+}
+
+func startCandidate(t *testing.T, c *client, opts Options) *candidate {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cd := &candidate{
+		leading:  make(chan struct{}, 1),
+		leaders:  make(chan [2]string, 10),
+		done:     make(chan error, 1),
+		cancel:   cancel,
+		identity: opts.Identity,
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-cd.done
+	})
+
+	e := &elector{client: c, opts: opts, log: logr.Discard()}
+	go func() {
+		cd.done <- e.run(ctx, Callbacks{
+			OnStartedLeading: func() { cd.leading <- struct{}{} },
+			OnNewLeader:      func(identity, url string) { cd.leaders <- [2]string{identity, url} },
+		})
+	}()
+
+	return cd
+}
+
+func (cd *candidate) waitForLeading(t *testing.T, timeout time.Duration) {
+	select {
+	case <-cd.leading:
+	case err := <-cd.done:
+		t.Fatalf("%s stopped before leading: %v", cd.identity, err)
+	case <-time.After(timeout):
+		t.Fatalf("%s did not start leading within %s", cd.identity, timeout)
+	}
+}
+
+func TestElectionHandsOverWhenTheLeaderStops(t *testing.T) {
+	f, c := startFakeAPI(t)
+
+	a := startCandidate(t, c, Options{Lease: "buffer", Identity: "a", URL: "http://user:secret@a:8080", LeaseDuration: 2 * time.Second})
+	a.waitForLeading(t, time.Second)
+
+	l := f.lease("buffer")
+	if l.Spec.HolderIdentity != "a" || l.Metadata.Annotations[URLAnnotation] != "http://a:8080" {
+		t.Fatalf("unexpected lease %+v", l)
+	}
+
+	b := startCandidate(t, c, Options{Lease: "buffer", Identity: "b", URL: "http://b:8080", LeaseDuration: 2 * time.Second})
+
+	select {
+	case leader := <-b.leaders:
+		if leader != [2]string{"a", "http://a:8080"} {
+			t.Fatalf("unexpected leader %v", leader)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("b did not observe the leader")
+	}
+
+	// the released lease is taken over before it would expire
+	a.cancel()
+	err := <-a.done
+	a.done <- err
+	if err != nil {
+		t.Fatalf("expected a to stop without an error, got %v", err)
+	}
+
+	b.waitForLeading(t, time.Second)
+
+	l = f.lease("buffer")
+	if l.Spec.HolderIdentity != "b" || l.Spec.LeaseTransitions != 1 || l.Metadata.Annotations[URLAnnotation] != "http://b:8080" {
+		t.Fatalf("unexpected lease %+v", l)
+	}
+}
+
+func TestElectionTakesOverAnExpiredLease(t *testing.T) {
+	f, c := startFakeAPI(t)
+
+	// the leader crashed without releasing the lease
+	f.leases["buffer"] = &lease{
+		Metadata: objectMeta{Name: "buffer", ResourceVersion: "0"},
+		Spec: leaseSpec{
+			HolderIdentity:       "crashed",
+			LeaseDurationSeconds: 1,
+			RenewTime:            microTime(time.Now()),
+		},
+	}
+
+	started := time.Now()
+	b := startCandidate(t, c, Options{Lease: "buffer", Identity: "b", LeaseDuration: time.Second})
+	b.waitForLeading(t, 3*time.Second)
+
+	if time.Since(started) < time.Second {
+		t.Fatalf("the lease was taken over after %s, before it expired", time.Since(started))
+	}
+}
+
+func TestLeaderLosesLeadershipWhenItCannotRenew(t *testing.T) {
+	f, c := startFakeAPI(t)
+
+	a := startCandidate(t, c, Options{Lease: "buffer", Identity: "a", LeaseDuration: time.Second})
+	a.waitForLeading(t, time.Second)
+
+	f.setFailing(true)
+
+	select {
+	case err := <-a.done:
+		a.done <- err
+		if !errors.Is(err, ErrLostLeadership) {
+			t.Fatalf("expected %v, got %v", ErrLostLeadership, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the leader kept leading without renewing the lease")
+	}
+}
+
+func TestLeaderLosesLeadershipWhenAnotherTakesOver(t *testing.T) {
+	f, c := startFakeAPI(t)
+
+	a := startCandidate(t, c, Options{Lease: "buffer", Identity: "a", LeaseDuration: time.Second})
+	a.waitForLeading(t, time.Second)
+
+	f.mu.Lock()
+	f.leases["buffer"].Spec.HolderIdentity = "b"
+	f.leases["buffer"].Spec.RenewTime = microTime(time.Now())
+	f.mu.Unlock()
+
+	select {
+	case err := <-a.done:
+		a.done <- err
+		if !errors.Is(err, ErrLostLeadership) {
+			t.Fatalf("expected %v, got %v", ErrLostLeadership, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the leader kept leading after another instance took over")
+	}
+}
@@ -0,0 +1,71 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// Activated returns listeners passed by systemd socket activation, keyed
+// by their FileDescriptorName. The environment variables are unset so
+// the sockets are not inherited by child processes.
+//
+// systemd names sockets after their unit unless FileDescriptorName is set,
+// so sockets of one unit share a name. They can't be told apart and are
+// rejected with an error instead of dropping all but the last one.
+func Activated() (_ map[string]net.Listener, err error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := map[string]net.Listener{}
+	defer func() {
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+		}
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse LISTEN_FDS: %w", err)
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		name := fmt.Sprintf("fd%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		_, found := listeners[name]
+		if found {
+			return nil, fmt.Errorf("systemd passed more than one socket named %s, set a distinct FileDescriptorName for each", name)
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor, the original is not needed anymore
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not use socket %s passed by systemd: %w", name, err)
+		}
+
+		listeners[name] = l
+	}
+
+	return listeners, nil
+}
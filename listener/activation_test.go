@@ -0,0 +1,137 @@
+package listener_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/draganm/event-buffer/listener"
+)
+
+// activationResult is printed by the helper process.
+type activationResult struct {
+	Listeners map[string]string
+	Error     string
+	Unset     bool
+}
+
+// TestActivationHelper runs in a child process which inherits the sockets,
+// like a process started by systemd.
+func TestActivationHelper(t *testing.T) {
+	if os.Getenv("ACTIVATION_HELPER") == "" {
+		t.Skip("only runs as the helper process of TestActivated")
+	}
+
+	// the pid of the child is not known before it is started
+	if os.Getenv("LISTEN_PID") == "self" {
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	}
+
+	res := activationResult{Listeners: map[string]string{}}
+	ls, err := listener.Activated()
+	if err != nil {
+		res.Error = err.Error()
+	}
+	for name, l := range ls {
+		res.Listeners[name] = l.Addr().String()
+		l.Close()
+	}
+	res.Unset = os.Getenv("LISTEN_PID") == "" && os.Getenv("LISTEN_FDS") == "" && os.Getenv("LISTEN_FDNAMES") == ""
+
+	json.NewEncoder(os.Stdout).Encode(res)
+}
+
+// activate runs the helper process with one inherited socket for each
+// listener.
+func activate(t *testing.T, pid, names string, ls ...*net.TCPListener) activationResult {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivationHelper$")
+	cmd.Env = append(
+		os.Environ(),
+		"ACTIVATION_HELPER=1",
+		"LISTEN_PID="+pid,
+		"LISTEN_FDS="+strconv.Itoa(len(ls)),
+		"LISTEN_FDNAMES="+names,
+	)
+	for _, l := range ls {
+		f, err := l.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("helper failed: %v: %s", err, out)
+	}
+
+	// go test prints PASS after the output of the helper
+	res := activationResult{}
+	err = json.NewDecoder(bytes.NewReader(out)).Decode(&res)
+	if err != nil {
+		t.Fatalf("could not decode %q: %v", out, err)
+	}
+	return res
+}
+
+func tcpListener(t *testing.T) *net.TCPListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l.(*net.TCPListener)
+}
+
+func TestActivated(t *testing.T) {
+	api, internal := tcpListener(t), tcpListener(t)
+
+	t.Run("named sockets", func(t *testing.T) {
+		res := activate(t, "self", "api:internal", api, internal)
+		if res.Error != "" {
+			t.Fatal(res.Error)
+		}
+		if len(res.Listeners) != 2 || res.Listeners["api"] != api.Addr().String() || res.Listeners["internal"] != internal.Addr().String() {
+			t.Fatalf("unexpected listeners %v", res.Listeners)
+		}
+		if !res.Unset {
+			t.Fatal("the environment variables were not unset")
+		}
+	})
+
+	t.Run("unnamed sockets", func(t *testing.T) {
+		res := activate(t, "self", "", api, internal)
+		if res.Error != "" {
+			t.Fatal(res.Error)
+		}
+		if len(res.Listeners) != 2 || res.Listeners["fd3"] != api.Addr().String() || res.Listeners["fd4"] != internal.Addr().String() {
+			t.Fatalf("unexpected listeners %v", res.Listeners)
+		}
+	})
+
+	t.Run("sockets sharing a name", func(t *testing.T) {
+		res := activate(t, "self", "api:api", api, internal)
+		if !strings.Contains(res.Error, "more than one socket named api") {
+			t.Fatalf("expected an error for the duplicate name, got %q", res.Error)
+		}
+		if len(res.Listeners) != 0 {
+			t.Fatalf("expected no listeners, got %v", res.Listeners)
+		}
+	})
+
+	t.Run("sockets of another process", func(t *testing.T) {
+		res := activate(t, "1", "api", api)
+		if res.Error != "" || len(res.Listeners) != 0 {
+			t.Fatalf("expected no listeners, got %v, %q", res.Listeners, res.Error)
+		}
+		if !res.Unset {
+			t.Fatal("the environment variables were not unset")
+		}
+	})
+}
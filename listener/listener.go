@@ -0,0 +1,116 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Options control how the socket of a listener is bound.
+type Options struct {
+	// Network is one of tcp (dual-stack), tcp4, tcp6 or unix.
+	Network string
+	// Interface binds the listener to the first address of the named
+	// network interface when addr does not specify a host. Network has to
+	// be tcp4 or tcp6 to choose the address family.
+	Interface string
+	// ReusePort sets SO_REUSEPORT so several processes on one host can
+	// accept connections on the same port.
+	ReusePort bool
+}
+
+// Listen creates a TCP or Unix socket listener for addr.
+func Listen(ctx context.Context, addr string, opts Options) (net.Listener, error) {
+	network := opts.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "unix":
+		// a socket file left behind by a previous run prevents binding
+		err := os.Remove(addr)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("could not remove stale socket %s: %w", addr, err)
+		}
+		return net.Listen(network, addr)
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	if opts.Interface != "" {
+		var err error
+		addr, err = interfaceAddr(addr, network, opts.Interface)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lc := net.ListenConfig{}
+	if opts.ReusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = setReusePort(fd)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
+	return lc.Listen(ctx, network, addr)
+}
+
+func interfaceAddr(addr, network, name string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("could not parse address %s: %w", addr, err)
+	}
+
+	if host != "" {
+		return "", fmt.Errorf("address %s can't have a host when binding to interface %s", addr, name)
+	}
+
+	// interfaces commonly have addresses of both families, a dual-stack
+	// listener would only get one of them
+	if network != "tcp4" && network != "tcp6" {
+		return "", fmt.Errorf("binding to interface %s requires network tcp4 or tcp6, not %s", name, network)
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("could not find interface %s: %w", name, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("could not get addresses of interface %s: %w", name, err)
+	}
+
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip := ipNet.IP
+		is4 := ip.To4() != nil
+		if (network == "tcp4" && !is4) || (network == "tcp6" && is4) {
+			continue
+		}
+
+		if ip.IsLinkLocalUnicast() && !is4 {
+			return net.JoinHostPort(ip.String()+"%"+iface.Name, port), nil
+		}
+
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+
+	return "", fmt.Errorf("interface %s has no %s address", name, network)
+}
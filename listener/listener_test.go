@@ -0,0 +1,63 @@
+package listener_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/draganm/event-buffer/listener"
+)
+
+// loopback returns the name of the loopback interface.
+func loopback(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestListenOnAnInterface(t *testing.T) {
+	l, err := listener.Listen(context.Background(), ":0", listener.Options{Network: "tcp4", Interface: loopback(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ip := l.Addr().(*net.TCPAddr).IP
+	if !ip.IsLoopback() || ip.To4() == nil {
+		t.Fatalf("expected an IPv4 loopback address, got %s", ip)
+	}
+}
+
+func TestListenOnAnInterfaceErrors(t *testing.T) {
+	name := loopback(t)
+
+	for _, c := range []struct {
+		name     string
+		addr     string
+		network  string
+		expected string
+	}{
+		{"dual-stack network", ":0", "tcp", "requires network tcp4 or tcp6"},
+		{"address with a host", "127.0.0.1:0", "tcp4", "can't have a host"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			l, err := listener.Listen(context.Background(), c.addr, listener.Options{Network: c.network, Interface: name})
+			if err == nil {
+				l.Close()
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), c.expected) {
+				t.Fatalf("expected an error containing %q, got %v", c.expected, err)
+			}
+		})
+	}
+}
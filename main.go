@@ -1,27 +1,37 @@
 package main
 
 import (
-	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/draganm/bolted"
-	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/alert"
+	"github.com/draganm/event-buffer/app"
+	"github.com/draganm/event-buffer/auth"
+	"github.com/draganm/event-buffer/config"
+	"github.com/draganm/event-buffer/leader"
+	"github.com/draganm/event-buffer/listener"
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/draganm/event-buffer/outbox"
+	"github.com/draganm/event-buffer/remotewrite"
 	"github.com/draganm/event-buffer/server"
-	"github.com/go-logr/logr"
+	"github.com/draganm/event-buffer/statsd"
+	"github.com/draganm/event-buffer/tracing"
 	"github.com/go-logr/zapr"
-	"github.com/gorilla/mux"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
@@ -40,9 +50,20 @@ func main() {
 		},
 	}.Build()
 
+	inService := isService()
+	if inService {
+		logger = withServiceLog(logger)
+	}
+
 	defer logger.Sync()
-	app := &cli.App{
+	cliApp := &cli.App{
+		Commands: append(serviceCommands(), bundleCommand, restoreCommand, compactCommand, replayCommand, selftestCommand, validateCommand, benchCommand),
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "YAML configuration file",
+				EnvVars: []string{"CONFIG"},
+			},
 			&cli.StringFlag{
 				Name:    "addr",
 				Value:   ":5566",
@@ -58,40 +79,802 @@ func main() {
 				Value:   ":5000",
 				EnvVars: []string{"INTERNAL_ADDR"},
 			},
+			&cli.StringFlag{
+				Name:    "grpc-addr",
+				Usage:   "address of the gRPC API, disabled when empty",
+				EnvVars: []string{"GRPC_ADDR"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-cert",
+				Usage:   "PEM certificate file for serving the API, metrics, internal and gRPC servers over TLS; listeners of the config file use their own tls section",
+				EnvVars: []string{"TLS_CERT"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-key",
+				Usage:   "PEM key file of tls-cert",
+				EnvVars: []string{"TLS_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "metrics-tls-cert",
+				Usage:   "PEM certificate file of the metrics server, overrides tls-cert",
+				EnvVars: []string{"METRICS_TLS_CERT"},
+			},
+			&cli.StringFlag{
+				Name:    "metrics-tls-key",
+				Usage:   "PEM key file of metrics-tls-cert",
+				EnvVars: []string{"METRICS_TLS_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "grpc-tls-cert",
+				Usage:   "PEM certificate file of the gRPC server, overrides tls-cert",
+				EnvVars: []string{"GRPC_TLS_CERT"},
+			},
+			&cli.StringFlag{
+				Name:    "grpc-tls-key",
+				Usage:   "PEM key file of grpc-tls-cert",
+				EnvVars: []string{"GRPC_TLS_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "internal-tls-cert",
+				Usage:   "PEM certificate file of the internal server, overrides tls-cert",
+				EnvVars: []string{"INTERNAL_TLS_CERT"},
+			},
+			&cli.StringFlag{
+				Name:    "internal-tls-key",
+				Usage:   "PEM key file of internal-tls-cert",
+				EnvVars: []string{"INTERNAL_TLS_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "internal-tls-client-ca",
+				Usage:   "PEM file of CA certificates, clients of the internal server must present a certificate signed by one of them",
+				EnvVars: []string{"INTERNAL_TLS_CLIENT_CA"},
+			},
+			&cli.BoolFlag{
+				Name:    "ui",
+				Usage:   "serve a page for browsing events under /ui/ on the internal server",
+				EnvVars: []string{"UI"},
+			},
+			&cli.StringFlag{
+				Name:    "listen-network",
+				Usage:   "tcp (dual-stack), tcp4 or tcp6",
+				Value:   "tcp",
+				EnvVars: []string{"LISTEN_NETWORK"},
+			},
+			&cli.StringFlag{
+				Name:    "listen-interface",
+				Usage:   "bind listeners without a host in their address to this network interface, requires --listen-network tcp4 or tcp6",
+				EnvVars: []string{"LISTEN_INTERFACE"},
+			},
+			&cli.BoolFlag{
+				Name:    "reuse-port",
+				Usage:   "set SO_REUSEPORT on all listeners",
+				EnvVars: []string{"REUSE_PORT"},
+			},
 			&cli.StringFlag{
 				Name:    "state-file",
 				Value:   "state",
 				EnvVars: []string{"STATE_FILE"},
 			},
+			&cli.StringSliceFlag{
+				Name:    "state-shard",
+				Usage:   "file storing a shard of the topics, repeat for more shards; shards have to be given in the same order on every start",
+				EnvVars: []string{"STATE_SHARDS"},
+			},
+			&cli.StringFlag{
+				Name:    "payload-log-dir",
+				Usage:   "directory of an append-only log for large payloads, they are not stored in the state when set",
+				EnvVars: []string{"PAYLOAD_LOG_DIR"},
+			},
+			&cli.IntFlag{
+				Name:    "payload-log-min-size",
+				Usage:   "payloads of at least this many bytes are appended to the payload log",
+				EnvVars: []string{"PAYLOAD_LOG_MIN_SIZE"},
+				Value:   64 << 10,
+			},
+			&cli.Int64Flag{
+				Name:    "payload-log-segment-size",
+				Usage:   "size in bytes after which the payload log starts a new segment file",
+				EnvVars: []string{"PAYLOAD_LOG_SEGMENT_SIZE"},
+				Value:   server.DefaultPayloadLogSegmentSize,
+			},
 			&cli.DurationFlag{
 				Name:    "retention-period",
 				EnvVars: []string{"RETENTION_PERIOD"},
 				Value:   2 * time.Hour,
 			},
+			&cli.BoolFlag{
+				Name:    "protect-consumers",
+				Usage:   "don't prune events registered consumers have not consumed yet",
+				EnvVars: []string{"PROTECT_CONSUMERS"},
+			},
+			&cli.DurationFlag{
+				Name:    "max-retention-period",
+				Usage:   "events protected for consumers are pruned after this period",
+				EnvVars: []string{"MAX_RETENTION_PERIOD"},
+				Value:   24 * time.Hour,
+			},
+			&cli.Uint64Flag{
+				Name:    "max-buffer-events",
+				Usage:   "prune the oldest events of all topics once the buffer holds more events, regardless of retention and consumers, 0 disables the budget",
+				EnvVars: []string{"MAX_BUFFER_EVENTS"},
+			},
+			&cli.Uint64Flag{
+				Name:    "max-buffer-bytes",
+				Usage:   "prune the oldest events of all topics once their payloads in the state and payload log take more bytes, regardless of retention and consumers, 0 disables the budget",
+				EnvVars: []string{"MAX_BUFFER_BYTES"},
+			},
+			&cli.BoolFlag{
+				Name:    "ack-retention",
+				Usage:   "prune events once all registered consumers have acknowledged them, retention-period applies to unacknowledged events",
+				EnvVars: []string{"ACK_RETENTION"},
+			},
+			&cli.BoolFlag{
+				Name:    "cloudevents",
+				Usage:   "only accept CloudEvents 1.0 and deliver them in the structured or binary content mode",
+				EnvVars: []string{"CLOUDEVENTS"},
+			},
+			&cli.DurationFlag{
+				Name:    "max-publish-age",
+				Usage:   "reject events whose occurred_at field, or CloudEvents time, is older than this or the retention period, 0 accepts events of any age",
+				EnvVars: []string{"MAX_PUBLISH_AGE"},
+			},
+			&cli.Int64Flag{
+				Name:    "max-decompressed-size",
+				Usage:   "maximum size in bytes of gzip or zstd compressed publish requests after decompression",
+				Value:   64 << 20,
+				EnvVars: []string{"MAX_DECOMPRESSED_SIZE"},
+			},
+			&cli.IntFlag{
+				Name:    "read-concurrency",
+				Usage:   "maximum number of concurrent storage reads of polls, 0 uses twice the number of CPUs",
+				EnvVars: []string{"READ_CONCURRENCY"},
+			},
+			&cli.IntFlag{
+				Name:    "write-concurrency",
+				Usage:   "maximum number of concurrent publish requests, 0 uses twice the number of CPUs",
+				EnvVars: []string{"WRITE_CONCURRENCY"},
+			},
+			&cli.IntFlag{
+				Name:    "write-queue-size",
+				Usage:   "maximum number of publish requests waiting for a write slot before publishes are rejected with 429, 0 uses four times --write-concurrency, but at least 64",
+				EnvVars: []string{"WRITE_QUEUE_SIZE"},
+			},
+			&cli.IntFlag{
+				Name:    "read-ahead-size",
+				Usage:   "bytes of payloads prefetched for consumers catching up with sequential full polls, 0 disables read ahead",
+				EnvVars: []string{"READ_AHEAD_SIZE"},
+			},
+			&cli.IntFlag{
+				Name:    "topic-metrics-limit",
+				Usage:   "label metrics by topic while there are at most this many topics, above it the topics are aggregated",
+				EnvVars: []string{"TOPIC_METRICS_LIMIT"},
+				Value:   100,
+			},
+			&cli.StringSliceFlag{
+				Name:    "topic-metrics-topic",
+				Usage:   "topic labeled in metrics, when set only the listed topics are labeled and the others aggregated",
+				EnvVars: []string{"TOPIC_METRICS_TOPICS"},
+			},
+			&cli.IntFlag{
+				Name:    "dedup-min-size",
+				Usage:   "store identical payloads of at least this many bytes only once, 0 disables deduplication",
+				EnvVars: []string{"DEDUP_MIN_SIZE"},
+			},
+			&cli.DurationFlag{
+				Name:    "idempotency-window",
+				Usage:   "remember idempotency keys of publishes this long and don't store retries again, 0 disables idempotency keys",
+				EnvVars: []string{"IDEMPOTENCY_WINDOW"},
+			},
+			&cli.Float64Flag{
+				Name:    "load-target-publish-rate",
+				Usage:   "events published per second at which the publish rate of GET /load and event_buffer_load_score reaches 100",
+				EnvVars: []string{"LOAD_TARGET_PUBLISH_RATE"},
+				Value:   1000,
+			},
+			&cli.IntFlag{
+				Name:    "load-target-connections",
+				Usage:   "API requests in progress, including long polls, streams and WebSockets, at which the connections of GET /load reach 100",
+				EnvVars: []string{"LOAD_TARGET_CONNECTIONS"},
+				Value:   1000,
+			},
+			&cli.StringFlag{
+				Name:    "payload-compression",
+				Usage:   "compress payloads stored in the state file with zstd or snappy, payloads compressed before stay readable without it",
+				EnvVars: []string{"PAYLOAD_COMPRESSION"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "encryption-key",
+				Usage:   "id:base64-key entries of AES keys encrypting payloads in the state file, the first one encrypts new payloads and the others decrypt payloads stored before a rotation",
+				EnvVars: []string{"ENCRYPTION_KEYS"},
+			},
+			&cli.StringFlag{
+				Name:    "encryption-key-file",
+				Usage:   "file with one id:base64-key entry per line, used after the entries of encryption-key",
+				EnvVars: []string{"ENCRYPTION_KEY_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "offload-url",
+				Usage:   "object store (file:///path or s3://bucket/prefix) for large payloads",
+				EnvVars: []string{"OFFLOAD_URL"},
+			},
+			&cli.IntFlag{
+				Name:    "offload-min-size",
+				Usage:   "payloads of at least this many bytes are offloaded to the object store",
+				EnvVars: []string{"OFFLOAD_MIN_SIZE"},
+				Value:   1 << 20,
+			},
+			&cli.StringFlag{
+				Name:    "claim-check-secret",
+				Usage:   "secret signing payload URLs of claim checks, a random one is generated when empty",
+				EnvVars: []string{"CLAIM_CHECK_SECRET"},
+			},
+			&cli.DurationFlag{
+				Name:    "claim-check-ttl",
+				Usage:   "validity of payload URLs of claim checks",
+				EnvVars: []string{"CLAIM_CHECK_TTL"},
+				Value:   15 * time.Minute,
+			},
+			&cli.StringFlag{
+				Name:    "public-url",
+				Usage:   "base URL consumers reach the API at, defaults to the host of the request",
+				EnvVars: []string{"PUBLIC_URL"},
+			},
+			&cli.DurationFlag{
+				Name:    "backup-frequency",
+				Usage:   "take a backup of the state this often, 0 disables backups",
+				EnvVars: []string{"BACKUP_FREQUENCY"},
+			},
+			&cli.StringFlag{
+				Name:    "backup-target",
+				Aliases: []string{"backup-url"},
+				Usage:   "directory or object store URL (file:///path or s3://bucket/prefix) for backups",
+				EnvVars: []string{"BACKUP_TARGET"},
+			},
+			&cli.IntFlag{
+				Name:    "backup-keep",
+				Usage:   "number of backups to keep, 0 keeps all",
+				EnvVars: []string{"BACKUP_KEEP"},
+				Value:   7,
+			},
+			&cli.StringFlag{
+				Name:    "wal-target",
+				Usage:   "directory or object store URL to continuously ship appended events to",
+				EnvVars: []string{"WAL_TARGET"},
+			},
+			&cli.StringFlag{
+				Name:    "archive-url",
+				Usage:   "directory or object store URL to archive events to before they are pruned",
+				EnvVars: []string{"ARCHIVE_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "archive-format",
+				Usage:   "format of archive segments: jsonl, jsonl.gz or jsonl.zst",
+				EnvVars: []string{"ARCHIVE_FORMAT"},
+				Value:   "jsonl.zst",
+			},
+			&cli.BoolFlag{
+				Name:    "bootstrap-from-backup",
+				Usage:   "restore the latest backup and replay the WAL when the state file is missing or empty",
+				EnvVars: []string{"BOOTSTRAP_FROM_BACKUP"},
+			},
+			&cli.StringFlag{
+				Name:    "follow-url",
+				Usage:   "internal API URL of a primary to follow as a read-only standby, credentials can be given in the URL; an empty state file is bootstrapped from a snapshot of the primary",
+				EnvVars: []string{"FOLLOW_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "leader-election-lease",
+				Usage:   "name of a Kubernetes lease electing the leader of an active/passive pair, only the leader accepts writes; uses the in-cluster configuration of the pod",
+				EnvVars: []string{"LEADER_ELECTION_LEASE"},
+			},
+			&cli.StringFlag{
+				Name:    "leader-election-namespace",
+				Usage:   "namespace of the leader election lease, defaults to the namespace of the pod",
+				EnvVars: []string{"LEADER_ELECTION_NAMESPACE"},
+			},
+			&cli.StringFlag{
+				Name:    "leader-election-identity",
+				Usage:   "identity of the instance in the leader election, defaults to the hostname",
+				EnvVars: []string{"LEADER_ELECTION_IDENTITY"},
+			},
+			&cli.StringFlag{
+				Name:    "leader-election-url",
+				Usage:   "internal API URL of the instance the other instance follows while it leads, e.g. http://$(POD_IP):5000; credentials are used to follow the leader and not advertised",
+				EnvVars: []string{"LEADER_ELECTION_URL"},
+			},
+			&cli.DurationFlag{
+				Name:    "leader-election-lease-duration",
+				Usage:   "how long the other instance waits for the leader to renew the lease before taking over",
+				EnvVars: []string{"LEADER_ELECTION_LEASE_DURATION"},
+				Value:   15 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "wal-interval",
+				Usage:   "ship appended events this often",
+				EnvVars: []string{"WAL_INTERVAL"},
+				Value:   time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "wal-retention",
+				Usage:   "delete shipped WAL segments after this period, 0 keeps them",
+				EnvVars: []string{"WAL_RETENTION"},
+				Value:   7 * 24 * time.Hour,
+			},
+			&cli.StringFlag{
+				Name:    "cdc-socket",
+				Usage:   "path of a Unix socket streaming appended events to local processes",
+				EnvVars: []string{"CDC_SOCKET"},
+			},
+			&cli.StringFlag{
+				Name:    "outbox-dsn",
+				Usage:   "Postgres connection string of a transactional outbox to append events from",
+				EnvVars: []string{"OUTBOX_DSN"},
+			},
+			&cli.StringFlag{
+				Name:    "outbox-table",
+				Usage:   "outbox table with the columns id, payload, created_at and consumed_at",
+				EnvVars: []string{"OUTBOX_TABLE"},
+				Value:   "outbox",
+			},
+			&cli.DurationFlag{
+				Name:    "outbox-poll-interval",
+				EnvVars: []string{"OUTBOX_POLL_INTERVAL"},
+				Value:   time.Second,
+			},
+			&cli.IntFlag{
+				Name:    "outbox-batch-size",
+				Usage:   "maximal number of outbox rows appended in one transaction",
+				EnvVars: []string{"OUTBOX_BATCH_SIZE"},
+				Value:   100,
+			},
+			&cli.StringFlag{
+				Name:    "remote-write-url",
+				Usage:   "Prometheus remote write endpoint the metrics are pushed to",
+				EnvVars: []string{"REMOTE_WRITE_URL"},
+			},
+			&cli.DurationFlag{
+				Name:    "remote-write-interval",
+				Usage:   "interval of pushing metrics to the remote write endpoint",
+				EnvVars: []string{"REMOTE_WRITE_INTERVAL"},
+				Value:   30 * time.Second,
+			},
+			&cli.StringSliceFlag{
+				Name:    "remote-write-label",
+				Usage:   "label added to pushed metrics as <name>=<value>, job defaults to event-buffer and instance to the host name",
+				EnvVars: []string{"REMOTE_WRITE_LABELS"},
+			},
+			&cli.StringFlag{
+				Name:    "statsd-addr",
+				Usage:   "UDP address of a StatsD or DogStatsD agent the metrics are emitted to",
+				EnvVars: []string{"STATSD_ADDR"},
+			},
+			&cli.StringFlag{
+				Name:    "statsd-format",
+				Usage:   "statsd, with labels in the metric names, or dogstatsd, with labels as tags",
+				EnvVars: []string{"STATSD_FORMAT"},
+				Value:   statsd.FormatStatsD,
+			},
+			&cli.DurationFlag{
+				Name:    "statsd-interval",
+				Usage:   "interval of emitting metrics to the StatsD agent",
+				EnvVars: []string{"STATSD_INTERVAL"},
+				Value:   10 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:    "statsd-prefix",
+				Usage:   "prefix of the names of emitted metrics",
+				EnvVars: []string{"STATSD_PREFIX"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "statsd-tag",
+				Usage:   "tag added to emitted metrics as <name>:<value>, only supported by dogstatsd",
+				EnvVars: []string{"STATSD_TAGS"},
+			},
+			&cli.StringFlag{
+				Name:    "otlp-endpoint",
+				Usage:   "URL of an OpenTelemetry collector spans are exported to over OTLP/HTTP, e.g. http://localhost:4318",
+				EnvVars: []string{"OTLP_ENDPOINT"},
+			},
+			&cli.BoolFlag{
+				Name:    "trace-index",
+				Usage:   "index events by the trace id of their traceparent, so GET /events?trace_id=... returns the events of a trace",
+				EnvVars: []string{"TRACE_INDEX"},
+			},
+			&cli.StringFlag{
+				Name:    "id-prefix",
+				Usage:   "prefix of the ids of new events as <prefix>:<uuid>, to tell buffers feeding one system apart; it can only be changed while the buffer holds no events",
+				EnvVars: []string{"ID_PREFIX"},
+			},
+			&cli.BoolFlag{
+				Name:    "system-events",
+				Usage:   "publish lifecycle events of the buffer, such as startups, prunes, compactions and backups, to the _system topic",
+				EnvVars: []string{"SYSTEM_EVENTS"},
+			},
+			&cli.Float64Flag{
+				Name:    "otlp-sample-ratio",
+				Usage:   "fraction of the traces started by the buffer that are exported, traces of callers keep their sampling decision",
+				EnvVars: []string{"OTLP_SAMPLE_RATIO"},
+				Value:   1,
+			},
+			&cli.StringFlag{
+				Name:    "alert-webhook-url",
+				Usage:   "URL operational alerts are posted to as JSON",
+				EnvVars: []string{"ALERT_WEBHOOK_URL"},
+			},
+			&cli.DurationFlag{
+				Name:    "consumer-stale-after",
+				Usage:   "alert when a registered consumer has not been seen for this long, 0 disables the alert",
+				EnvVars: []string{"CONSUMER_STALE_AFTER"},
+			},
+			&cli.DurationFlag{
+				Name:    "integrity-check-frequency",
+				Usage:   "verify all events this often and export the results as metrics, 0 disables the checks",
+				EnvVars: []string{"INTEGRITY_CHECK_FREQUENCY"},
+			},
 			&cli.DurationFlag{
 				Name:    "prune-frequency",
 				EnvVars: []string{"PRUNE_FREQUENCY"},
 				Value:   5 * time.Minute,
 			},
+			&cli.StringSliceFlag{
+				Name:    "trusted-proxies",
+				Usage:   "CIDRs of proxies allowed to set X-Forwarded-For and X-Real-IP",
+				EnvVars: []string{"TRUSTED_PROXIES"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "basic-auth",
+				Usage:   "user:bcrypt-hash entries required to access the API and internal servers",
+				EnvVars: []string{"BASIC_AUTH"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "api-token",
+				Usage:   "name:token[:scopes] entries of bearer tokens accepted by the API, scopes is a comma separated list of read and write and defaults to both",
+				EnvVars: []string{"API_TOKENS"},
+			},
+			&cli.StringFlag{
+				Name:    "api-token-file",
+				Usage:   "file with one name:token[:scopes] entry per line, accepted in addition to api-token",
+				EnvVars: []string{"API_TOKEN_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "introspection-url",
+				Usage:   "OAuth2 token introspection endpoint used to validate bearer tokens",
+				EnvVars: []string{"INTROSPECTION_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "introspection-client-id",
+				EnvVars: []string{"INTROSPECTION_CLIENT_ID"},
+			},
+			&cli.StringFlag{
+				Name:    "introspection-client-secret",
+				EnvVars: []string{"INTROSPECTION_CLIENT_SECRET"},
+			},
+			&cli.DurationFlag{
+				Name:    "introspection-cache-ttl",
+				EnvVars: []string{"INTROSPECTION_CACHE_TTL"},
+				Value:   time.Minute,
+			},
+			&cli.IntFlag{
+				Name:    "introspection-cache-size",
+				Usage:   "maximum number of cached tokens",
+				EnvVars: []string{"INTROSPECTION_CACHE_SIZE"},
+				Value:   10000,
+			},
+			&cli.StringFlag{
+				Name:    "ldap-url",
+				Usage:   "LDAP server used to authenticate basic auth credentials of API requests",
+				EnvVars: []string{"LDAP_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "ldap-user-dn-template",
+				Usage:   "DN or UPN used to bind, {user} is replaced by the user name",
+				EnvVars: []string{"LDAP_USER_DN_TEMPLATE"},
+			},
+			&cli.StringFlag{
+				Name:    "ldap-base-dn",
+				EnvVars: []string{"LDAP_BASE_DN"},
+			},
+			&cli.StringFlag{
+				Name:    "ldap-user-filter",
+				EnvVars: []string{"LDAP_USER_FILTER"},
+				Value:   "(|(sAMAccountName={user})(uid={user}))",
+			},
+			&cli.StringSliceFlag{
+				Name:    "ldap-group-role",
+				Usage:   "group-dn=role mappings applied to the memberOf attribute of the user",
+				EnvVars: []string{"LDAP_GROUP_ROLE"},
+			},
+			&cli.DurationFlag{
+				Name:    "ldap-cache-ttl",
+				EnvVars: []string{"LDAP_CACHE_TTL"},
+				Value:   time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:    "ldap-timeout",
+				Usage:   "timeout of connecting to and each request to the LDAP server",
+				EnvVars: []string{"LDAP_TIMEOUT"},
+				Value:   10 * time.Second,
+			},
+			&cli.IntFlag{
+				Name:    "ldap-cache-size",
+				Usage:   "maximum number of cached credentials",
+				EnvVars: []string{"LDAP_CACHE_SIZE"},
+				Value:   10000,
+			},
+			&cli.StringFlag{
+				Name:    "bundle-signing-key",
+				Usage:   "ed25519 private key enabling signed bundle export on the internal API",
+				EnvVars: []string{"BUNDLE_SIGNING_KEY"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "bundle-trusted-keys",
+				Usage:   "ed25519 public keys of bundles accepted for import on the internal API",
+				EnvVars: []string{"BUNDLE_TRUSTED_KEYS"},
+			},
 		},
 		Action: func(c *cli.Context) error {
 			log := zapr.NewLogger(logger)
 			defer log.Info("server exiting")
-			eg, ctx := errgroup.WithContext(context.Background())
+			eg, ctx := errgroup.WithContext(c.Context)
+
+			cfg := &config.Config{}
+			if c.String("config") != "" {
+				var err error
+				cfg, err = config.Load(c.String("config"))
+				if err != nil {
+					return err
+				}
+			}
 
-			db, err := embedded.Open(c.String("state-file"), 0700, embedded.Options{})
+			trustedProxies, err := server.ParseTrustedProxies(c.StringSlice("trusted-proxies"))
 			if err != nil {
-				return fmt.Errorf("could not open state: %w", err)
+				return err
 			}
 
-			srv, err := server.New(log, db)
+			authenticators := map[string]auth.Authenticator{}
+			if len(c.StringSlice("basic-auth")) > 0 {
+				basic, err := auth.NewBasic(c.StringSlice("basic-auth"))
+				if err != nil {
+					return fmt.Errorf("could not configure basic auth: %w", err)
+				}
+				authenticators["basic"] = basic
+			}
+
+			tokenEntries, err := apiTokenEntries(c)
 			if err != nil {
-				return fmt.Errorf("could not start server: %w", err)
+				return err
+			}
+			if len(tokenEntries) > 0 {
+				tokens, err := auth.NewTokens(tokenEntries)
+				if err != nil {
+					return fmt.Errorf("could not configure api tokens: %w", err)
+				}
+				authenticators["token"] = tokens
+			}
+
+			if c.String("introspection-url") != "" {
+				authenticators["introspection"] = &auth.Introspection{
+					Endpoint:     c.String("introspection-url"),
+					ClientID:     c.String("introspection-client-id"),
+					ClientSecret: c.String("introspection-client-secret"),
+					CacheTTL:     c.Duration("introspection-cache-ttl"),
+					CacheSize:    c.Int("introspection-cache-size"),
+				}
+			}
+
+			if c.String("ldap-url") != "" {
+				groupRoles, err := auth.ParseGroupRoles(c.StringSlice("ldap-group-role"))
+				if err != nil {
+					return fmt.Errorf("could not configure ldap auth: %w", err)
+				}
+
+				authenticators["ldap"] = &auth.LDAP{
+					URL:            c.String("ldap-url"),
+					UserDNTemplate: c.String("ldap-user-dn-template"),
+					BaseDN:         c.String("ldap-base-dn"),
+					UserFilter:     c.String("ldap-user-filter"),
+					GroupRoles:     groupRoles,
+					CacheTTL:       c.Duration("ldap-cache-ttl"),
+					CacheSize:      c.Int("ldap-cache-size"),
+					Timeout:        c.Duration("ldap-timeout"),
+				}
+			}
+
+			// selectAuth combines the named authenticators, the ones that
+			// are not configured are skipped unless required
+			selectAuth := func(names []string, required bool) (auth.Authenticator, error) {
+				selected := []auth.Authenticator{}
+				for _, n := range names {
+					a, found := authenticators[n]
+					if !found && required {
+						return nil, fmt.Errorf("authenticator %q is not configured", n)
+					}
+					if found {
+						selected = append(selected, a)
+					}
+				}
+				if len(selected) == 0 {
+					return nil, nil
+				}
+				return auth.Any(selected...), nil
+			}
+
+			// protect wraps a handler with the named authenticators
+			protect := func(names []string, required bool) (func(http.Handler) http.Handler, error) {
+				a, err := selectAuth(names, required)
+				if a == nil || err != nil {
+					return nil, err
+				}
+				return auth.Middleware(log, a), nil
+			}
+
+			// protectAPI is protect that also checks the scopes of api
+			// tokens
+			protectAPI := func(names []string, required bool) (func(http.Handler) http.Handler, error) {
+				a, err := selectAuth(names, required)
+				if a == nil || err != nil {
+					return nil, err
+				}
+				return auth.Middleware(log, auth.Scoped(a, server.RequiredScope)), nil
+			}
+
+			listenOptions := listener.Options{
+				Network:   c.String("listen-network"),
+				Interface: c.String("listen-interface"),
+				ReusePort: c.Bool("reuse-port"),
 			}
 
-			err = srv.Prune(time.Now().Add(-c.Duration("retention-period")))
+			// sockets passed by systemd take precedence over binding the
+			// configured address, they are matched by FileDescriptorName
+			activated, err := listener.Activated()
 			if err != nil {
-				return fmt.Errorf("could not prune stale events: %w", err)
+				return err
+			}
+
+			listen := func(name, addr string, opts listener.Options) (net.Listener, error) {
+				l, found := activated[name]
+				if found {
+					delete(activated, name)
+					log.Info("using socket passed by systemd", "listener", name, "addr", l.Addr().String())
+					return l, nil
+				}
+				return listener.Listen(ctx, addr, opts)
+			}
+
+			listeners := cfg.Listeners
+			if len(listeners) == 0 {
+				listeners = []config.Listener{
+					{
+						Name: "api",
+						Addr: c.String("addr"),
+						Auth: []string{"basic", "introspection", "ldap", "token"},
+					},
+				}
+			}
+
+			apiListeners := []app.Listener{}
+			for _, l := range listeners {
+				required := len(cfg.Listeners) > 0
+				p, err := protectAPI(l.Auth, required)
+				if err != nil {
+					return fmt.Errorf("could not configure listener %s: %w", l.Name, err)
+				}
+
+				var tlsConfig *tls.Config
+				if l.TLS != nil {
+					cert, err := tls.LoadX509KeyPair(l.TLS.CertFile, l.TLS.KeyFile)
+					if err != nil {
+						return fmt.Errorf("could not load tls certificate of listener %s: %w", l.Name, err)
+					}
+					tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+				}
+				if len(cfg.Listeners) == 0 {
+					tlsConfig, err = listenerTLS(c, "")
+					if err != nil {
+						return fmt.Errorf("could not configure tls of listener %s: %w", l.Name, err)
+					}
+				}
+
+				opts := listenOptions
+				if l.Network != "" {
+					opts.Network = l.Network
+				}
+				if l.Interface != "" {
+					opts.Interface = l.Interface
+				}
+				opts.ReusePort = opts.ReusePort || l.ReusePort
+
+				nl, err := listen(l.Name, l.Addr, opts)
+				if err != nil {
+					return fmt.Errorf("could not listen for %s requests: %w", l.Name, err)
+				}
+
+				apiListeners = append(apiListeners, app.Listener{
+					Name:       l.Name,
+					Listener:   nl,
+					TLSConfig:  tlsConfig,
+					Middleware: p,
+				})
+			}
+
+			metricsTLSConfig, err := listenerTLS(c, "metrics")
+			if err != nil {
+				return fmt.Errorf("could not configure tls of metrics server: %w", err)
+			}
+
+			internalTLSConfig, err := internalTLS(c)
+			if err != nil {
+				return fmt.Errorf("could not configure tls of internal server: %w", err)
+			}
+
+			ml, err := listen("metrics", c.String("metrics-addr"), listenOptions)
+			if err != nil {
+				return fmt.Errorf("could not listen for metrics requests: %w", err)
+			}
+
+			protectInternal, err := protect([]string{"basic", "introspection"}, false)
+			if err != nil {
+				return err
+			}
+
+			il, err := listen("internal", c.String("internal-addr"), listenOptions)
+			if err != nil {
+				return fmt.Errorf("could not listen for internal requests: %w", err)
+			}
+
+			var grpcListener net.Listener
+			var grpcOptions []grpc.ServerOption
+			if c.String("grpc-addr") != "" {
+				grpcListener, err = listen("grpc", c.String("grpc-addr"), listenOptions)
+				if err != nil {
+					return fmt.Errorf("could not listen for grpc requests: %w", err)
+				}
+
+				grpcTLSConfig, err := listenerTLS(c, "grpc")
+				if err != nil {
+					return fmt.Errorf("could not configure tls of grpc server: %w", err)
+				}
+				if grpcTLSConfig != nil {
+					grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(grpcTLSConfig)))
+				}
+
+				a, err := selectAuth([]string{"basic", "introspection", "ldap", "token"}, false)
+				if err != nil {
+					return err
+				}
+				if a != nil {
+					a = auth.Scoped(a, server.RequiredScope)
+					grpcOptions = append(grpcOptions,
+						grpc.UnaryInterceptor(auth.UnaryServerInterceptor(log, a)),
+						grpc.StreamInterceptor(auth.StreamServerInterceptor(log, a)),
+					)
+				}
+			}
+
+			var cdcListener net.Listener
+			if c.String("cdc-socket") != "" {
+				cdcListener, err = listen("cdc", c.String("cdc-socket"), listener.Options{Network: "unix"})
+				if err != nil {
+					return fmt.Errorf("could not listen for CDC subscribers: %w", err)
+				}
+			}
+
+			for name, l := range activated {
+				log.Info("closing unused socket passed by systemd", "name", name)
+				l.Close()
+			}
+
+			var bundleKey ed25519.PrivateKey
+			if c.String("bundle-signing-key") != "" {
+				bundleKey, err = server.LoadBundleSigningKey(c.String("bundle-signing-key"))
+				if err != nil {
+					return err
+				}
+			}
+
+			bundleTrusted, err := server.LoadBundleVerifyKeys(c.StringSlice("bundle-trusted-keys"))
+			if err != nil {
+				return err
 			}
 
 			eg.Go(func() error {
@@ -106,82 +889,261 @@ func main() {
 				}
 			})
 
-			// run API server
+			appOptions := []app.Option{
+				app.WithLogger(log),
+				app.WithStateFile(c.String("state-file")),
+				app.WithStateShards(c.StringSlice("state-shard")...),
+				app.WithTrustedProxies(trustedProxies),
+				app.WithRetention(c.Duration("retention-period"), c.Duration("prune-frequency")),
+				app.WithListeners(apiListeners...),
+				app.WithMetricsListener(app.Listener{Name: "metrics", Listener: ml, TLSConfig: metricsTLSConfig}),
+				app.WithInternalListener(app.Listener{Name: "internal", Listener: il, TLSConfig: internalTLSConfig, Middleware: protectInternal}),
+				app.WithBundleKeys(bundleKey, bundleTrusted),
+				app.WithRedactionRules(cfg.RedactionRules...),
+				app.WithDeliveryRateLimits(cfg.DeliveryRateLimits...),
+				app.WithPeering(cfg.Peering),
+				app.WithDeduplication(c.Int("dedup-min-size")),
+				app.WithIdempotencyWindow(c.Duration("idempotency-window")),
+				app.WithLoadTargets(server.LoadTargets{
+					PublishRate: c.Float64("load-target-publish-rate"),
+					Connections: c.Int("load-target-connections"),
+				}),
+				app.WithPayloadCompression(c.String("payload-compression")),
+				app.WithMaxDecompressedSize(c.Int64("max-decompressed-size")),
+				app.WithConcurrency(c.Int("read-concurrency"), c.Int("write-concurrency")),
+				app.WithWriteQueueSize(c.Int("write-queue-size")),
+				app.WithReadAhead(c.Int("read-ahead-size")),
+				app.WithTopicMetrics(server.TopicMetrics{
+					Topics: c.StringSlice("topic-metrics-topic"),
+					Limit:  c.Int("topic-metrics-limit"),
+				}),
+				app.WithClaimChecks([]byte(c.String("claim-check-secret")), c.Duration("claim-check-ttl"), c.String("public-url")),
+				app.WithEffectiveConfig(resolveConfig(c, cfg)),
+			}
 
-			eg.Go(runHttp(ctx, log, c.String("addr"), "api", srv))
+			if c.String("payload-log-dir") != "" {
+				appOptions = append(appOptions, app.WithPayloadLog(c.String("payload-log-dir"), c.Int("payload-log-min-size"), c.Int64("payload-log-segment-size")))
+			}
 
-			// run metrics server
-			metricsRouter := mux.NewRouter()
-			metricsRouter.Methods("GET").Path("/metrics").Handler(promhttp.Handler())
-			eg.Go(runHttp(ctx, log, c.String("metrics-addr"), "metrics", metricsRouter))
+			if c.String("offload-url") != "" {
+				store, err := objectstore.Open(c.String("offload-url"))
+				if err != nil {
+					return fmt.Errorf("could not open offload store: %w", err)
+				}
+				appOptions = append(appOptions, app.WithOffloading(store, c.Int("offload-min-size")))
+			}
 
-			// run internal api
-			internalRouter := mux.NewRouter()
-			internalRouter.Methods("GET").Path("/dump").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.Header().Set("content-type", "application/binary")
-				err := bolted.SugaredRead(db, func(tx bolted.SugaredReadTx) error {
-					tx.Dump(w)
-					return nil
-				})
+			if c.Duration("backup-frequency") > 0 {
+				if c.String("backup-target") == "" {
+					return errors.New("backup-target must be set when backups are enabled")
+				}
+				store, err := openBackupTarget(c.String("backup-target"))
 				if err != nil {
-					http.Error(w, fmt.Errorf("could not write dump: %w", err).Error(), http.StatusInternalServerError)
-					return
+					return fmt.Errorf("could not open backup target: %w", err)
 				}
-			})
+				appOptions = append(appOptions, app.WithBackups(store, c.Duration("backup-frequency"), c.Int("backup-keep")))
+			}
 
-			eg.Go(runHttp(ctx, log, c.String("internal-addr"), "internal", internalRouter))
+			if c.String("wal-target") != "" {
+				store, err := openBackupTarget(c.String("wal-target"))
+				if err != nil {
+					return fmt.Errorf("could not open WAL target: %w", err)
+				}
+				appOptions = append(appOptions, app.WithWALShipping(store, c.Duration("wal-interval"), c.Duration("wal-retention")))
+			}
 
-			// run the pruner
-			eg.Go(func() error {
-				ticker := time.NewTicker(c.Duration("prune-frequency"))
-
-				for {
-					select {
-					case <-ctx.Done():
-						return nil
-					case <-ticker.C:
-						err = srv.Prune(time.Now().Add(-c.Duration("retention-period")))
-						if err != nil {
-							log.Error(err, "prune failed")
-						}
-					}
+			if c.String("archive-url") != "" {
+				store, err := openBackupTarget(c.String("archive-url"))
+				if err != nil {
+					return fmt.Errorf("could not open archive store: %w", err)
+				}
+				appOptions = append(appOptions, app.WithArchive(store, c.String("archive-format")))
+			}
+
+			if c.String("alert-webhook-url") != "" {
+				appOptions = append(appOptions, app.WithAlerts(&alert.Webhook{URL: c.String("alert-webhook-url")}))
+			}
+
+			if c.Duration("consumer-stale-after") > 0 {
+				appOptions = append(appOptions, app.WithStaleConsumerAlerts(c.Duration("consumer-stale-after")))
+			}
+
+			if c.Bool("ui") {
+				appOptions = append(appOptions, app.WithUI())
+			}
+
+			if c.Duration("integrity-check-frequency") > 0 {
+				appOptions = append(appOptions, app.WithIntegrityChecks(c.Duration("integrity-check-frequency")))
+			}
+
+			if cdcListener != nil {
+				appOptions = append(appOptions, app.WithCDCListener(cdcListener))
+			}
+
+			if grpcListener != nil {
+				appOptions = append(appOptions, app.WithGRPCListener(grpcListener, grpcOptions...))
+			}
+
+			if c.String("outbox-dsn") != "" {
+				appOptions = append(appOptions, app.WithOutbox(outbox.Options{
+					DSN:          c.String("outbox-dsn"),
+					Table:        c.String("outbox-table"),
+					PollInterval: c.Duration("outbox-poll-interval"),
+					BatchSize:    c.Int("outbox-batch-size"),
+				}))
+			}
+
+			if c.String("remote-write-url") != "" {
+				hostname, _ := os.Hostname()
+				labels := map[string]string{"job": "event-buffer", "instance": hostname}
+				configured, err := parseRemoteWriteLabels(c.StringSlice("remote-write-label"))
+				if err != nil {
+					return err
+				}
+				for name, value := range configured {
+					labels[name] = value
+				}
+				appOptions = append(appOptions, app.WithRemoteWrite(remotewrite.Options{
+					URL:      c.String("remote-write-url"),
+					Interval: c.Duration("remote-write-interval"),
+					Labels:   labels,
+				}))
+			}
+
+			if c.String("statsd-addr") != "" {
+				format := c.String("statsd-format")
+				if format != statsd.FormatStatsD && format != statsd.FormatDogStatsD {
+					return fmt.Errorf("invalid statsd format %q, expected statsd or dogstatsd", format)
+				}
+				tags, err := parseStatsDTags(c.StringSlice("statsd-tag"))
+				if err != nil {
+					return err
+				}
+				appOptions = append(appOptions, app.WithStatsD(statsd.Options{
+					Addr:     c.String("statsd-addr"),
+					Interval: c.Duration("statsd-interval"),
+					Format:   format,
+					Prefix:   c.String("statsd-prefix"),
+					Tags:     tags,
+				}))
+			}
 
+			if c.String("otlp-endpoint") != "" {
+				appOptions = append(appOptions, app.WithTracing(tracing.Options{
+					Endpoint:    c.String("otlp-endpoint"),
+					SampleRatio: c.Float64("otlp-sample-ratio"),
+				}))
+			}
+
+			if c.Bool("protect-consumers") {
+				appOptions = append(appOptions, app.WithConsumerProtection(c.Duration("max-retention-period")))
+			}
+
+			if c.Uint64("max-buffer-events") > 0 || c.Uint64("max-buffer-bytes") > 0 {
+				appOptions = append(appOptions, app.WithSizeBudget(c.Uint64("max-buffer-events"), c.Uint64("max-buffer-bytes")))
+			}
+
+			if c.Bool("ack-retention") {
+				appOptions = append(appOptions, app.WithAckRetention())
+			}
+
+			if c.Bool("cloudevents") {
+				appOptions = append(appOptions, app.WithCloudEvents())
+			}
+
+			keys, err := encryptionKeys(c)
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				appOptions = append(appOptions, app.WithEncryption(keys))
+			}
+
+			if c.Duration("max-publish-age") > 0 {
+				appOptions = append(appOptions, app.WithMaxPublishAge(c.Duration("max-publish-age")))
+			}
+
+			if c.Bool("trace-index") {
+				appOptions = append(appOptions, app.WithTraceIndex())
+			}
+
+			if c.String("id-prefix") != "" {
+				appOptions = append(appOptions, app.WithIDPrefix(c.String("id-prefix")))
+			}
+
+			if c.Bool("system-events") {
+				appOptions = append(appOptions, app.WithSystemEvents())
+			}
+
+			if c.Bool("bootstrap-from-backup") {
+				err = bootstrapState(ctx, log, c.String("state-file"), c.String("backup-target"), c.String("wal-target"), keys)
+				if err != nil {
+					return fmt.Errorf("could not bootstrap state: %w", err)
+				}
+			}
+
+			if c.String("follow-url") != "" {
+				err = bootstrapFollower(ctx, log, c.String("state-file"), c.String("follow-url"))
+				if err != nil {
+					return fmt.Errorf("could not bootstrap follower: %w", err)
 				}
+				appOptions = append(appOptions, app.WithFollower(c.String("follow-url")))
+			}
+
+			if c.String("leader-election-lease") != "" {
+				appOptions = append(appOptions, app.WithLeaderElection(leader.Options{
+					Lease:         c.String("leader-election-lease"),
+					Namespace:     c.String("leader-election-namespace"),
+					Identity:      c.String("leader-election-identity"),
+					URL:           c.String("leader-election-url"),
+					LeaseDuration: c.Duration("leader-election-lease-duration"),
+				}))
+			}
+
+			eg.Go(func() error {
+				return app.Run(ctx, appOptions...)
 			})
 
 			return eg.Wait()
 
 		},
 	}
-	app.RunAndExitOnError()
-}
 
-func runHttp(ctx context.Context, log logr.Logger, addr, name string, handler http.Handler) func() error {
-
-	return func() error {
-		l, err := net.Listen("tcp", addr)
+	if inService {
+		err := runService(cliApp)
 		if err != nil {
-			return fmt.Errorf("could not listen for %s requests: %w", name, err)
-
+			logger.Error("service failed", zap.Error(err))
+			os.Exit(1)
 		}
+		return
+	}
 
-		s := &http.Server{
-			Handler: handler,
-		}
+	cliApp.RunAndExitOnError()
+}
 
-		go func() {
-			<-ctx.Done()
-			shutdownContext, cancel := context.WithTimeout(context.Background(), time.Second)
-			defer cancel()
-			log.Info(fmt.Sprintf("graceful shutdown of the %s server", name))
-			err := s.Shutdown(shutdownContext)
-			if errors.Is(err, context.DeadlineExceeded) {
-				log.Info(fmt.Sprintf("%s server did not shut down gracefully, forcing close", name))
-				s.Close()
-			}
-		}()
+// parseRemoteWriteLabels parses the <name>=<value> entries of
+// --remote-write-label.
+func parseRemoteWriteLabels(entries []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, l := range entries {
+		name, value, found := strings.Cut(l, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid remote write label %q, expected <name>=<value>", l)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
 
-		log.Info(fmt.Sprintf("%s server started", name), "addr", l.Addr().String())
-		return s.Serve(l)
+// parseStatsDTags parses the <name>:<value> entries of --statsd-tag.
+func parseStatsDTags(entries []string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, t := range entries {
+		name, value, found := strings.Cut(t, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid statsd tag %q, expected <name>:<value>", t)
+		}
+		tags[name] = value
 	}
+	return tags, nil
 }
@@ -0,0 +1,152 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(u *url.URL) (*fileStore, error) {
+	if u.Path == "" {
+		return nil, errors.New("file object store URL must have a path")
+	}
+
+	// a trailing slash would break the prefix check of keys
+	dir := filepath.Clean(filepath.FromSlash(u.Path))
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create object store dir: %w", err)
+	}
+
+	return &fileStore{dir: dir}, nil
+}
+
+func (fs *fileStore) path(key string) (string, error) {
+	p := filepath.Join(fs.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, fs.dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return p, nil
+}
+
+// Put writes the object to a temp file that is renamed in place, so
+// readers never see a partial object.
+func (fs *fileStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return fmt.Errorf("could not create dir for object %s: %w", key, err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("could not create temp file for object %s: %w", key, err)
+	}
+
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not write object %s: %w", key, err)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not sync object %s: %w", key, err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("could not close object %s: %w", key, err)
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+func (fs *fileStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not open object %s: %w", key, err)
+	}
+
+	return f, nil
+}
+
+func (fs *fileStore) Delete(ctx context.Context, key string) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not delete object %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (fst *fileStore) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	err := filepath.WalkDir(fst.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(fst.dir, p)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("could not list objects: %w", err)
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (fs *fileStore) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return "", ErrPresignNotSupported
+}
@@ -0,0 +1,65 @@
+package objectstore_test
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/draganm/event-buffer/objectstore"
+)
+
+func TestFileStoreURLs(t *testing.T) {
+	for _, suffix := range []string{"", "/", "//", "/./"} {
+		t.Run("suffix "+suffix, func(t *testing.T) {
+			dir := filepath.ToSlash(t.TempDir())
+			s, err := objectstore.Open("file://" + dir + suffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+			err = s.Put(ctx, "a/b", strings.NewReader("payload"), 7)
+			if err != nil {
+				t.Fatalf("could not put object: %v", err)
+			}
+
+			r, err := s.Get(ctx, "a/b")
+			if err != nil {
+				t.Fatalf("could not get object: %v", err)
+			}
+			defer r.Close()
+
+			d, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(d) != "payload" {
+				t.Fatalf("expected payload, got %q", d)
+			}
+
+			keys, err := s.List(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 1 || keys[0] != "a/b" {
+				t.Fatalf("expected [a/b], got %v", keys)
+			}
+		})
+	}
+}
+
+func TestFileStoreRejectsKeysOutsideDir(t *testing.T) {
+	s, err := objectstore.Open("file://" + filepath.ToSlash(t.TempDir()) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../x", "a/../../x"} {
+		err = s.Put(context.Background(), key, strings.NewReader("x"), 1)
+		if err == nil {
+			t.Fatalf("expected key %q to be rejected", key)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// ErrNotFound is returned when an object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ErrPresignNotSupported is returned by stores that can't create URLs for
+// direct downloads.
+var ErrPresignNotSupported = errors.New("presigned URLs are not supported")
+
+// Store is a bucket of objects, keys are slash separated paths.
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// List returns the keys with the given prefix in lexical order.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// PresignGet returns a URL that allows downloading the object until it
+	// expires.
+	PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// Validate checks a store URL the way Open does, without creating
+// directories or clients.
+func Validate(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("could not parse object store URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return errors.New("file object store URL must have a path")
+		}
+	case "s3", "gs":
+		if u.Host == "" {
+			return errors.New("object store URL must have a bucket")
+		}
+	default:
+		return fmt.Errorf("unsupported object store scheme %q", u.Scheme)
+	}
+
+	return nil
+}
+
+// Open returns the store for a URL, supported are file:///path and
+// s3://bucket/prefix (also used for GCS through its S3 interoperability).
+func Open(rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse object store URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return newFileStore(u)
+	case "s3", "gs":
+		return newS3Store(u)
+	default:
+		return nil, fmt.Errorf("unsupported object store scheme %q", u.Scheme)
+	}
+}
@@ -0,0 +1,133 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// newS3Store creates a store for s3://bucket/prefix. The endpoint defaults
+// to AWS (storage.googleapis.com for gs://) and can be changed with the
+// endpoint query parameter, credentials are taken from the environment.
+func newS3Store(u *url.URL) (*s3Store, error) {
+	if u.Host == "" {
+		return nil, errors.New("object store URL must have a bucket")
+	}
+
+	q := u.Query()
+
+	endpoint := q.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+		if u.Scheme == "gs" {
+			endpoint = "storage.googleapis.com"
+		}
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{},
+	})
+
+	if u.Scheme == "gs" {
+		creds = credentials.NewStaticV2(os.Getenv("GCS_ACCESS_KEY_ID"), os.Getenv("GCS_SECRET_ACCESS_KEY"), "")
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: q.Get("insecure") != "true",
+		Region: q.Get("region"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create s3 client: %w", err)
+	}
+
+	return &s3Store{
+		client: client,
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+func (s *s3Store) key(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.key(key), r, size, minio.PutObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("could not put object %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	o, err := s.client.GetObject(ctx, s.bucket, s.key(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get object %s: %w", key, err)
+	}
+
+	// GetObject is lazy, stat makes missing objects fail here
+	_, err = o.Stat()
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		o.Close()
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	if err != nil {
+		o.Close()
+		return nil, fmt.Errorf("could not get object %s: %w", key, err)
+	}
+
+	return o, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	err := s.client.RemoveObject(ctx, s.bucket, s.key(key), minio.RemoveObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("could not delete object %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	fullPrefix := prefix
+	if s.prefix != "" {
+		fullPrefix = s.prefix + "/" + prefix
+	}
+
+	for o := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: fullPrefix, Recursive: true}) {
+		if o.Err != nil {
+			return nil, fmt.Errorf("could not list objects: %w", o.Err)
+		}
+		keys = append(keys, strings.TrimPrefix(o.Key, s.prefix+"/"))
+	}
+
+	return keys, nil
+}
+
+func (s *s3Store) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, s.key(key), expiry, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not presign object %s: %w", key, err)
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,138 @@
+// Package outbox appends rows of a transactional outbox table in Postgres
+// to the buffer.
+//
+// The table needs the columns id, payload, created_at and consumed_at:
+//
+//	CREATE TABLE outbox (
+//		id bigserial PRIMARY KEY,
+//		payload jsonb NOT NULL,
+//		created_at timestamptz NOT NULL DEFAULT now(),
+//		consumed_at timestamptz
+//	);
+//
+// Rows with an empty consumed_at are appended in the order they were
+// created and marked consumed afterwards.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/draganm/event-buffer/server"
+	"github.com/go-logr/logr"
+	"github.com/lib/pq"
+)
+
+type Options struct {
+	DSN          string
+	Table        string
+	PollInterval time.Duration
+	BatchSize    int
+}
+
+// Run polls the outbox table until ctx is cancelled.
+func Run(ctx context.Context, log logr.Logger, srv *server.Server, opts Options) error {
+	db, err := sql.Open("postgres", opts.DSN)
+	if err != nil {
+		return fmt.Errorf("could not open outbox database: %w", err)
+	}
+	defer db.Close()
+
+	log = log.WithValues("table", opts.Table)
+	source := "outbox/" + opts.Table
+
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		// drain the outbox before waiting for the next tick
+		for ctx.Err() == nil {
+			n, err := ingest(ctx, db, srv, source, opts)
+			if err != nil {
+				log.Error(err, "could not ingest outbox")
+				break
+			}
+			if n < opts.BatchSize {
+				break
+			}
+		}
+	}
+}
+
+// ingest appends one batch of rows and returns its size. Rows are recorded
+// as ingested in the buffer before they are marked consumed, so a failure
+// in between doesn't append them twice.
+func ingest(ctx context.Context, db *sql.DB, srv *server.Server, source string, opts Options) (int, error) {
+	table := pq.QuoteIdentifier(opts.Table)
+
+	rows, err := db.QueryContext(
+		ctx,
+		fmt.Sprintf("SELECT id::text, payload::text FROM %s WHERE consumed_at IS NULL ORDER BY created_at, id LIMIT $1", table),
+		opts.BatchSize,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("could not query outbox: %w", err)
+	}
+	defer rows.Close()
+
+	events := []server.IngestedEvent{}
+	keys := []string{}
+	for rows.Next() {
+		var id string
+		var payload []byte
+		err = rows.Scan(&id, &payload)
+		if err != nil {
+			return 0, fmt.Errorf("could not scan outbox row: %w", err)
+		}
+
+		// payloads of text columns don't have to be JSON
+		if !json.Valid(payload) {
+			payload, err = json.Marshal(string(payload))
+			if err != nil {
+				return 0, fmt.Errorf("could not encode payload of row %s: %w", id, err)
+			}
+		}
+
+		events = append(events, server.IngestedEvent{Key: id, Payload: payload})
+		keys = append(keys, id)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return 0, fmt.Errorf("could not read outbox: %w", err)
+	}
+
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	err = srv.Ingest(ctx, source, events)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = db.ExecContext(
+		ctx,
+		fmt.Sprintf("UPDATE %s SET consumed_at = now() WHERE id::text = ANY($1)", table),
+		pq.Array(keys),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("could not mark outbox rows consumed: %w", err)
+	}
+
+	err = srv.ForgetIngested(source, keys)
+	if err != nil {
+		return 0, fmt.Errorf("could not forget ingested rows: %w", err)
+	}
+
+	return len(events), nil
+}
@@ -0,0 +1,213 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/server/testrig"
+	"github.com/go-logr/logr"
+)
+
+// fakeTable is an outbox table served by the outbox-test driver. It only
+// understands the queries of ingest.
+type fakeTable struct {
+	mu         sync.Mutex
+	payloads   []string
+	consumed   map[string]bool
+	failUpdate bool
+}
+
+var tables = map[string]*fakeTable{}
+
+func init() {
+	sql.Register("outbox-test", fakeDriver{})
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	t, found := tables[name]
+	if !found {
+		return nil, fmt.Errorf("table %s not found", name)
+	}
+	return &fakeConn{t: t}, nil
+}
+
+type fakeConn struct {
+	t *fakeTable
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+
+	limit := int(args[0].Value.(int64))
+	rows := &fakeRows{}
+	for i, p := range c.t.payloads {
+		id := strconv.Itoa(i + 1)
+		if c.t.consumed[id] || len(rows.rows) == limit {
+			continue
+		}
+		rows.rows = append(rows.rows, []driver.Value{id, []byte(p)})
+	}
+	return rows, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+
+	if c.t.failUpdate {
+		return nil, errors.New("connection lost")
+	}
+
+	ids := strings.Split(strings.Trim(args[0].Value.(string), "{}"), ",")
+	for _, id := range ids {
+		c.t.consumed[strings.Trim(id, `"`)] = true
+	}
+	return driver.RowsAffected(len(ids)), nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"id", "payload"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func openTable(t *testing.T, payloads ...string) (*sql.DB, *fakeTable) {
+	ft := &fakeTable{payloads: payloads, consumed: map[string]bool{}}
+	tables[t.Name()] = ft
+
+	db, err := sql.Open("outbox-test", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db, ft
+}
+
+func startServer(t *testing.T, ctx context.Context) (*server.Server, *client.Client) {
+	url, srv, err := testrig.StartServer(ctx, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl, err := client.New(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return srv, cl
+}
+
+func bufferedPayloads(t *testing.T, ctx context.Context, cl *client.Client, n int) []string {
+	evts := []json.RawMessage{}
+	_, err := cl.PollForEvents(ctx, "", n+1, "asc", &evts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := []string{}
+	for _, e := range evts {
+		payloads = append(payloads, string(e))
+	}
+	return payloads
+}
+
+func TestIngestAppendsUnconsumedRowsInBatches(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, cl := startServer(t, ctx)
+	db, ft := openTable(t, `{"n":1}`, `{"n":2}`, `not json`)
+	opts := Options{Table: "outbox", BatchSize: 2}
+
+	for _, expected := range []int{2, 1, 0} {
+		n, err := ingest(ctx, db, srv, "outbox/outbox", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != expected {
+			t.Fatalf("expected a batch of %d rows, got %d", expected, n)
+		}
+	}
+
+	payloads := bufferedPayloads(t, ctx, cl, 3)
+	expected := []string{`{"n":1}`, `{"n":2}`, `"not json"`}
+	if strings.Join(payloads, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected payloads %v, got %v", expected, payloads)
+	}
+
+	if len(ft.consumed) != 3 {
+		t.Fatalf("expected all rows to be consumed, got %v", ft.consumed)
+	}
+}
+
+func TestIngestDoesNotAppendRowsTwice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, cl := startServer(t, ctx)
+	db, ft := openTable(t, `{"n":1}`)
+	opts := Options{Table: "outbox", BatchSize: 10}
+
+	// the rows are appended, but can't be marked consumed
+	ft.failUpdate = true
+	_, err := ingest(ctx, db, srv, "outbox/outbox", opts)
+	if err == nil {
+		t.Fatal("expected marking the rows consumed to fail")
+	}
+
+	ft.failUpdate = false
+	n, err := ingest(ctx, db, srv, "outbox/outbox", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected the unconsumed row to be read again, got %d rows", n)
+	}
+
+	payloads := bufferedPayloads(t, ctx, cl, 1)
+	if len(payloads) != 1 {
+		t.Fatalf("expected the row to be appended once, got %v", payloads)
+	}
+}
@@ -0,0 +1,218 @@
+// Package remotewrite pushes the metrics of the buffer to a Prometheus
+// remote write endpoint, for deployments without infrastructure scraping
+// them.
+//
+// Each push is a snappy compressed protobuf WriteRequest of the remote
+// write protocol 0.1.0 holding the current value of every series.
+// Histograms and summaries are sent as their _bucket, _sum and _count
+// series like Prometheus stores them when scraping.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type Options struct {
+	URL      string
+	Interval time.Duration
+	// Labels are added to every series, e.g. job and instance.
+	Labels map[string]string
+	// Timeout bounds each push, it defaults to the interval.
+	Timeout time.Duration
+}
+
+// Run pushes the metrics gathered by g every interval until ctx is
+// cancelled. Failed pushes are logged and not retried, the next push
+// carries the current values anyway.
+func Run(ctx context.Context, log logr.Logger, g prometheus.Gatherer, opts Options) error {
+	log = log.WithValues("url", opts.URL)
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = opts.Interval
+	}
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		pushCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := push(pushCtx, g, opts)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			log.Error(err, "could not push metrics")
+		}
+	}
+}
+
+func push(ctx context.Context, g prometheus.Gatherer, opts Options) error {
+	families, err := g.Gather()
+	if err != nil {
+		return fmt.Errorf("could not gather metrics: %w", err)
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(families, opts.Labels, time.Now()))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Set("content-encoding", "snappy")
+	req.Header.Set("content-type", "application/x-protobuf")
+	req.Header.Set("x-prometheus-remote-write-version", "0.1.0")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not perform request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		rd, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	return nil
+}
+
+type label struct {
+	name, value string
+}
+
+type series struct {
+	labels []label
+	value  float64
+}
+
+// flatten turns the metrics of a family into series named like the ones
+// Prometheus stores when scraping.
+func flatten(mf *dto.MetricFamily, extra map[string]string) []series {
+	name := mf.GetName()
+	all := []series{}
+
+	for _, m := range mf.GetMetric() {
+		base := []label{}
+		own := map[string]bool{}
+		for _, lp := range m.GetLabel() {
+			base = append(base, label{lp.GetName(), lp.GetValue()})
+			own[lp.GetName()] = true
+		}
+		// labels of the metric take precedence
+		for n, v := range extra {
+			if !own[n] {
+				base = append(base, label{n, v})
+			}
+		}
+
+		add := func(suffix string, value float64, more ...label) {
+			labels := append([]label{{"__name__", name + suffix}}, base...)
+			labels = append(labels, more...)
+			all = append(all, series{labels: labels, value: value})
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			add("", m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			add("", m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			add("", m.GetUntyped().GetValue())
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			for _, q := range s.GetQuantile() {
+				add("", q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())})
+			}
+			add("_sum", s.GetSampleSum())
+			add("_count", float64(s.GetSampleCount()))
+		case dto.MetricType_HISTOGRAM:
+			h := m.GetHistogram()
+			inf := false
+			for _, b := range h.GetBucket() {
+				add("_bucket", float64(b.GetCumulativeCount()), label{"le", formatFloat(b.GetUpperBound())})
+				inf = math.IsInf(b.GetUpperBound(), 1)
+			}
+			if !inf {
+				add("_bucket", float64(h.GetSampleCount()), label{"le", "+Inf"})
+			}
+			add("_sum", h.GetSampleSum())
+			add("_count", float64(h.GetSampleCount()))
+		}
+	}
+
+	return all
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(families []*dto.MetricFamily, extra map[string]string, now time.Time) []byte {
+	ts := now.UnixMilli()
+
+	var req []byte
+	for _, mf := range families {
+		for _, s := range flatten(mf, extra) {
+			// receivers expect labels sorted by name
+			sort.Slice(s.labels, func(i, j int) bool {
+				return s.labels[i].name < s.labels[j].name
+			})
+
+			var seriesMsg []byte
+			for _, l := range s.labels {
+				var labelMsg []byte
+				labelMsg = protowire.AppendTag(labelMsg, 1, protowire.BytesType)
+				labelMsg = protowire.AppendString(labelMsg, l.name)
+				labelMsg = protowire.AppendTag(labelMsg, 2, protowire.BytesType)
+				labelMsg = protowire.AppendString(labelMsg, l.value)
+
+				seriesMsg = protowire.AppendTag(seriesMsg, 1, protowire.BytesType)
+				seriesMsg = protowire.AppendBytes(seriesMsg, labelMsg)
+			}
+
+			var sampleMsg []byte
+			sampleMsg = protowire.AppendTag(sampleMsg, 1, protowire.Fixed64Type)
+			sampleMsg = protowire.AppendFixed64(sampleMsg, math.Float64bits(s.value))
+			sampleMsg = protowire.AppendTag(sampleMsg, 2, protowire.VarintType)
+			sampleMsg = protowire.AppendVarint(sampleMsg, uint64(ts))
+
+			seriesMsg = protowire.AppendTag(seriesMsg, 2, protowire.BytesType)
+			seriesMsg = protowire.AppendBytes(seriesMsg, sampleMsg)
+
+			req = protowire.AppendTag(req, 1, protowire.BytesType)
+			req = protowire.AppendBytes(req, seriesMsg)
+		}
+	}
+
+	return req
+}
@@ -0,0 +1,157 @@
+package remotewrite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeWriteRequest returns the value of each series of a WriteRequest,
+// keyed by its labels as name="value" pairs in the order they were sent.
+func decodeWriteRequest(t *testing.T, b []byte) map[string]float64 {
+	res := map[string]float64{}
+
+	fields := func(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+			n = fn(num, typ, b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+
+	fields(b, func(_ protowire.Number, _ protowire.Type, b []byte) int {
+		seriesMsg, n := protowire.ConsumeBytes(b)
+		labels := []string{}
+		value := math.NaN()
+		fields(seriesMsg, func(num protowire.Number, _ protowire.Type, b []byte) int {
+			msg, n := protowire.ConsumeBytes(b)
+			switch num {
+			case 1:
+				l := []string{}
+				fields(msg, func(_ protowire.Number, _ protowire.Type, b []byte) int {
+					s, n := protowire.ConsumeString(b)
+					l = append(l, s)
+					return n
+				})
+				labels = append(labels, fmt.Sprintf("%s=%q", l[0], l[1]))
+			case 2:
+				fields(msg, func(num protowire.Number, typ protowire.Type, b []byte) int {
+					if num == 1 {
+						v, n := protowire.ConsumeFixed64(b)
+						value = math.Float64frombits(v)
+						return n
+					}
+					return protowire.ConsumeFieldValue(num, typ, b)
+				})
+			}
+			return n
+		})
+		res[strings.Join(labels, ",")] = value
+		return n
+	})
+
+	return res
+}
+
+func TestRunPushesFlattenedSeries(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "requests"}, []string{"job"})
+	reg.MustRegister(requests)
+	requests.WithLabelValues("api").Add(3)
+
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Help: "latency", Buckets: []float64{0.5}})
+	reg.MustRegister(latency)
+	latency.Observe(0.1)
+	latency.Observe(1)
+
+	pushes := make(chan map[string]float64, 10)
+	failed := false
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first push fails, the next one carries the values anyway
+		if !failed {
+			failed = true
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get("content-encoding") != "snappy" || r.Header.Get("x-prometheus-remote-write-version") != "0.1.0" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+
+		compressed, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pushes <- decodeWriteRequest(t, b)
+	}))
+	defer hs.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go Run(ctx, logr.Discard(), reg, Options{
+		URL:      hs.URL,
+		Interval: 10 * time.Millisecond,
+		Labels:   map[string]string{"job": "event-buffer", "instance": "edge-1"},
+	})
+
+	var pushed map[string]float64
+	select {
+	case pushed = <-pushes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metrics were pushed")
+	}
+
+	expected := map[string]float64{
+		`__name__="requests_total",instance="edge-1",job="api"`:                            3,
+		`__name__="latency_seconds_bucket",instance="edge-1",job="event-buffer",le="0.5"`:  1,
+		`__name__="latency_seconds_bucket",instance="edge-1",job="event-buffer",le="+Inf"`: 2,
+		`__name__="latency_seconds_sum",instance="edge-1",job="event-buffer"`:              1.1,
+		`__name__="latency_seconds_count",instance="edge-1",job="event-buffer"`:            2,
+	}
+
+	keys := []string{}
+	for k := range pushed {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(pushed) != len(expected) {
+		t.Fatalf("expected %d series, got %v", len(expected), keys)
+	}
+	for k, v := range expected {
+		got, found := pushed[k]
+		if !found {
+			t.Fatalf("expected the series %s, got %v", k, keys)
+		}
+		if got != v {
+			t.Fatalf("expected %s to be %v, got %v", k, v, got)
+		}
+	}
+}
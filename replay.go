@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+	"github.com/urfave/cli/v2"
+)
+
+// replayProbeTimeout bounds waiting for the newest event, polls of an empty
+// buffer only return once an event is published.
+const replayProbeTimeout = 5 * time.Second
+
+var replayCommand = &cli.Command{
+	Name:  "replay",
+	Usage: "re-publish the events stored in a time range to another buffer",
+	Description: "Events stored at or after --from-time and before --to-time are read from the buffer at --source-url\n" +
+		"and published in order to --target. With --match only events where the value at the JSON pointer\n" +
+		"equals the JSON value are published, e.g. --match '/type=\"order-created\"'. Events appended after\n" +
+		"the replay started are not replayed, so the source can be the target as well. Events listed in\n" +
+		"--seen-ids are skipped by the source, it receives them as a bloom filter.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "source-url",
+			Usage:   "base URL of the API of the buffer to read from",
+			Value:   "http://localhost:5566",
+			EnvVars: []string{"SOURCE_URL"},
+		},
+		&cli.StringFlag{
+			Name:     "target",
+			Usage:    "base URL of the API of the buffer to publish to",
+			Required: true,
+		},
+		&cli.TimestampFlag{
+			Name:     "from-time",
+			Usage:    "replay events stored at or after this time (RFC 3339)",
+			Layout:   time.RFC3339,
+			Required: true,
+		},
+		&cli.TimestampFlag{
+			Name:   "to-time",
+			Usage:  "replay events stored before this time (RFC 3339), defaults to now",
+			Layout: time.RFC3339,
+		},
+		&cli.StringSliceFlag{
+			Name:  "match",
+			Usage: "only replay events where the value at the JSON pointer equals the JSON value, as <pointer>=<value>",
+		},
+		&cli.StringFlag{
+			Name:  "seen-ids",
+			Usage: "file with ids of events that have been processed already, one per line, the source skips them",
+		},
+		&cli.Float64Flag{
+			Name:  "seen-false-positive-rate",
+			Usage: "fraction of unprocessed events that may be skipped with --seen-ids",
+			Value: 0.0001,
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "number of events read and published at once",
+			Value: 100,
+		},
+	},
+	Action: func(c *cli.Context) error {
+		matchers := []*server.PayloadMatcher{}
+		for _, m := range c.StringSlice("match") {
+			pointer, value, found := strings.Cut(m, "=")
+			if !found {
+				return fmt.Errorf("invalid match %q, expected <pointer>=<value>", m)
+			}
+			pm, err := server.NewPayloadMatcher(pointer, json.RawMessage(value))
+			if err != nil {
+				return fmt.Errorf("invalid match %q: %w", m, err)
+			}
+			matchers = append(matchers, pm)
+		}
+
+		to := time.Now()
+		if c.Timestamp("to-time") != nil {
+			to = *c.Timestamp("to-time")
+		}
+
+		source, err := client.New(c.String("source-url"))
+		if err != nil {
+			return err
+		}
+
+		target, err := client.New(c.String("target"))
+		if err != nil {
+			return err
+		}
+
+		seenSet := ""
+		if c.String("seen-ids") != "" {
+			seenSet, err = uploadSeenIDs(c.Context, source, c.String("seen-ids"), c.Float64("seen-false-positive-rate"))
+			if err != nil {
+				return err
+			}
+			defer source.DeleteSeenSet(context.Background(), seenSet)
+		}
+
+		replayed, err := replay(c.Context, source, target, *c.Timestamp("from-time"), to, matchers, seenSet, c.Int("batch-size"))
+		fmt.Printf("replayed %d events\n", replayed)
+		return err
+	},
+}
+
+// uploadSeenIDs uploads the ids in the file as a seen set to the source.
+func uploadSeenIDs(ctx context.Context, source *client.Client, fileName string, falsePositiveRate float64) (string, error) {
+	d, err := os.ReadFile(fileName)
+	if err != nil {
+		return "", fmt.Errorf("could not read seen ids: %w", err)
+	}
+
+	ids := strings.Fields(string(d))
+	seen := client.NewSeenSet(len(ids), falsePositiveRate)
+	for _, id := range ids {
+		seen.Add(id)
+	}
+
+	id, err := source.UploadSeenSet(ctx, seen)
+	if err != nil {
+		return "", fmt.Errorf("could not upload seen ids: %w", err)
+	}
+
+	return id, nil
+}
+
+func replay(ctx context.Context, source, target *client.Client, from, to time.Time, matchers []*server.PayloadMatcher, seenSet string, batchSize int) (int, error) {
+	// the newest event when the replay starts bounds the replay, polling
+	// past it would wait for new events
+	probeCtx, cancel := context.WithTimeout(ctx, replayProbeTimeout)
+	newest, err := source.Poll(probeCtx, "", 1, "desc", &[]json.RawMessage{})
+	cancel()
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not get newest event: %w", err)
+	}
+
+	head := newest.IDs[0]
+	end := server.IDPrefix(head) + server.TimeCursor(to)
+	after := server.IDPrefix(head) + server.TimeCursor(from)
+
+	replayed := 0
+	for after < head && after < end {
+		payloads := []json.RawMessage{}
+		p, err := source.PollSkippingSeen(ctx, seenSet, after, batchSize, "asc", &payloads)
+
+		re := &client.RetentionExpiredError{}
+		if errors.As(err, &re) {
+			// all events after the start have been pruned, the remaining
+			// ones are all in the range
+			after = ""
+			continue
+		}
+		if err != nil {
+			return replayed, fmt.Errorf("could not read events: %w", err)
+		}
+
+		batch := []any{}
+		for i, id := range p.IDs {
+			if id >= end || id > head {
+				break
+			}
+
+			matches, err := matchesAll(matchers, payloads[i])
+			if err != nil {
+				return replayed, fmt.Errorf("could not match event %s: %w", id, err)
+			}
+			if matches {
+				batch = append(batch, payloads[i])
+			}
+		}
+		after = p.Cursor
+
+		if len(batch) == 0 {
+			continue
+		}
+
+		err = target.SendEvents(ctx, batch)
+		if err != nil {
+			return replayed, fmt.Errorf("could not publish events: %w", err)
+		}
+		replayed += len(batch)
+	}
+
+	return replayed, nil
+}
+
+func matchesAll(matchers []*server.PayloadMatcher, payload json.RawMessage) (bool, error) {
+	for _, m := range matchers {
+		matches, err := m.Matches(payload)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/backup"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/snapshot"
+	"github.com/draganm/event-buffer/statefile"
+	"github.com/go-logr/logr"
+	"github.com/urfave/cli/v2"
+)
+
+var restoreCommand = &cli.Command{
+	Name:  "restore",
+	Usage: "restore a state file from a snapshot taken with /dump?format=snapshot or from a backup",
+	Description: "Either a snapshot file or --backup-target has to be provided. With --at the state is restored from the\n" +
+		"most recent backup taken at or before that time. With --wal-target, events shipped after the backup\n" +
+		"are replayed up to --at. Restored events older than the retention period are\n" +
+		"pruned when the server starts, raise --retention-period to keep them.",
+	ArgsUsage: "[<snapshot>]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "state-file",
+			Usage:    "state file to create, it must not exist",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "backup-target",
+			Aliases: []string{"backup-url"},
+			Usage:   "directory or object store URL the backups are stored in",
+			EnvVars: []string{"BACKUP_TARGET"},
+		},
+		&cli.StringFlag{
+			Name:    "wal-target",
+			Usage:   "directory or object store URL of shipped WAL segments to replay",
+			EnvVars: []string{"WAL_TARGET"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "encryption-key",
+			Usage:   "id:base64-key entries of the AES keys of the buffer, they open encrypted WAL segments and the first one encrypts replayed payloads",
+			EnvVars: []string{"ENCRYPTION_KEYS"},
+		},
+		&cli.StringFlag{
+			Name:    "encryption-key-file",
+			Usage:   "file with one id:base64-key entry per line, used after the entries of encryption-key",
+			EnvVars: []string{"ENCRYPTION_KEY_FILE"},
+		},
+		&cli.TimestampFlag{
+			Name:   "at",
+			Usage:  "restore the state as of this time (RFC 3339), defaults to the latest backup",
+			Layout: time.RFC3339,
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() > 1 || (c.NArg() == 1) == (c.String("backup-target") != "") {
+			return errors.New("either a snapshot file or a backup target must be provided")
+		}
+
+		stateFile := c.String("state-file")
+
+		err := statefile.Recover(stateFile)
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stat(stateFile)
+		if err == nil {
+			return fmt.Errorf("state file %s already exists", stateFile)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not check state file: %w", err)
+		}
+
+		var src io.ReadCloser
+		if c.NArg() == 1 {
+			src, err = os.Open(c.Args().First())
+			if err != nil {
+				return fmt.Errorf("could not open snapshot: %w", err)
+			}
+		} else {
+			store, err := openBackupTarget(c.String("backup-target"))
+			if err != nil {
+				return fmt.Errorf("could not open backup target: %w", err)
+			}
+
+			var key string
+			if at := c.Timestamp("at"); at != nil {
+				key, err = backup.Before(c.Context, store, *at)
+			} else {
+				key, err = backup.Latest(c.Context, store)
+			}
+			if err != nil {
+				return fmt.Errorf("could not find backup: %w", err)
+			}
+
+			src, err = store.Get(c.Context, key)
+			if err != nil {
+				return fmt.Errorf("could not fetch backup %s: %w", key, err)
+			}
+		}
+		defer src.Close()
+
+		var replay func(db bolted.Database) error
+		if c.String("wal-target") != "" {
+			wal, err := openBackupTarget(c.String("wal-target"))
+			if err != nil {
+				return fmt.Errorf("could not open WAL target: %w", err)
+			}
+
+			until := time.Time{}
+			if at := c.Timestamp("at"); at != nil {
+				until = *at
+			}
+
+			keys, err := encryptionKeys(c)
+			if err != nil {
+				return err
+			}
+
+			replay = func(db bolted.Database) error {
+				n, err := server.ReplayWAL(c.Context, db, wal, until, keys)
+				if err != nil {
+					return fmt.Errorf("could not replay WAL: %w", err)
+				}
+				fmt.Printf("replayed %d events from the WAL\n", n)
+				return nil
+			}
+		}
+
+		header, err := restoreState(stateFile, src, replay)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("restored snapshot taken at %s\n", header.Created.UTC().Format(time.RFC3339))
+
+		return nil
+	},
+}
+
+// restoreState creates a state file from a snapshot and, when replay is
+// set, calls it with the restored state. The state is swapped in once it
+// is complete, so a failed restore doesn't leave a partial state behind.
+func restoreState(stateFile string, src io.Reader, replay func(db bolted.Database) error) (snapshot.Header, error) {
+	tmp := statefile.TempPath(stateFile)
+	os.Remove(tmp)
+
+	db, err := embedded.Open(tmp, 0700, embedded.Options{})
+	if err != nil {
+		return snapshot.Header{}, fmt.Errorf("could not open state: %w", err)
+	}
+
+	var header snapshot.Header
+	err = bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
+		header, err = snapshot.Restore(src, tx)
+		return err
+	})
+
+	if err == nil && replay != nil {
+		err = replay(db)
+	}
+
+	closeErr := db.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return header, fmt.Errorf("could not restore snapshot: %w", err)
+	}
+
+	err = statefile.Swap(stateFile)
+	if err != nil {
+		return header, err
+	}
+
+	return header, nil
+}
+
+// bootstrapState restores the latest backup when the state file is missing
+// or empty, so a replaced node starts with the state of the one it
+// replaces. A target without backups is not an error, the node starts
+// empty then.
+func bootstrapState(ctx context.Context, log logr.Logger, stateFile, backupTarget, walTarget string, keys []server.EncryptionKey) error {
+	if backupTarget == "" {
+		return errors.New("backup-target must be set to bootstrap from a backup")
+	}
+
+	err := statefile.Recover(stateFile)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(stateFile)
+	if err == nil && fi.Size() > 0 {
+		return nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not check state file: %w", err)
+	}
+
+	store, err := openBackupTarget(backupTarget)
+	if err != nil {
+		return fmt.Errorf("could not open backup target: %w", err)
+	}
+
+	key, err := backup.Latest(ctx, store)
+	if errors.Is(err, backup.ErrNoBackup) {
+		log.Info("no backup to bootstrap from, starting with an empty state")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not find backup: %w", err)
+	}
+
+	var replay func(db bolted.Database) error
+	if walTarget != "" {
+		wal, err := openBackupTarget(walTarget)
+		if err != nil {
+			return fmt.Errorf("could not open WAL target: %w", err)
+		}
+		replay = func(db bolted.Database) error {
+			n, err := server.ReplayWAL(ctx, db, wal, time.Time{}, keys)
+			if err != nil {
+				return fmt.Errorf("could not replay WAL: %w", err)
+			}
+			log.Info("replayed WAL", "events", n)
+			return nil
+		}
+	}
+
+	src, err := store.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("could not fetch backup %s: %w", key, err)
+	}
+	defer src.Close()
+
+	header, err := restoreState(stateFile, src, replay)
+	if err != nil {
+		return err
+	}
+
+	log.Info("bootstrapped state from backup", "key", key, "taken", header.Created)
+
+	return nil
+}
+
+// bootstrapFollower restores a snapshot of the primary at primaryURL when
+// the state file is missing or empty, a follower with a state copies only
+// the events it is missing.
+func bootstrapFollower(ctx context.Context, log logr.Logger, stateFile, primaryURL string) error {
+	err := statefile.Recover(stateFile)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(stateFile)
+	if err == nil && fi.Size() > 0 {
+		return nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not check state file: %w", err)
+	}
+
+	u, err := url.Parse(primaryURL)
+	if err != nil {
+		return fmt.Errorf("invalid primary url: %w", err)
+	}
+	u = u.JoinPath("dump")
+	u.RawQuery = url.Values{"format": {"snapshot"}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not fetch snapshot of primary: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("could not fetch snapshot of primary: unexpected status %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	header, err := restoreState(stateFile, res.Body, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Info("bootstrapped state from primary", "primary", u.Redacted(), "taken", header.Created)
+
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/backup"
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/server/testrig"
+	"github.com/draganm/event-buffer/statefile"
+	"github.com/go-logr/logr"
+	"github.com/urfave/cli/v2"
+)
+
+// buffer is a running server shipping its WAL, with its backups and WAL
+// in directories.
+type buffer struct {
+	srv       *server.Server
+	client    *client.Client
+	backupDir string
+	backups   objectstore.Store
+	walDir    string
+	wal       objectstore.Store
+}
+
+func startBuffer(t *testing.T, ctx context.Context) *buffer {
+	url, srv, err := testrig.StartServer(ctx, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl, err := client.New(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &buffer{srv: srv, client: cl, backupDir: t.TempDir(), walDir: t.TempDir()}
+
+	b.backups, err = openBackupTarget(b.backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.wal, err = openBackupTarget(b.walDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.ShipWAL(ctx, b.wal, 10*time.Millisecond)
+
+	return b
+}
+
+func (b *buffer) send(t *testing.T, ctx context.Context, events ...any) {
+	err := b.client.SendEvents(ctx, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (b *buffer) backup(t *testing.T, ctx context.Context) {
+	_, err := backup.Take(ctx, b.srv.WriteSnapshot, b.backups)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForWAL waits until n events have been shipped to the WAL.
+func (b *buffer) waitForWAL(t *testing.T, ctx context.Context, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		keys, err := b.wal.List(ctx, "wal/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shipped := 0
+		for _, k := range keys {
+			if !strings.HasSuffix(k, ".jsonl") {
+				continue
+			}
+			o, err := b.wal.Get(ctx, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc := bufio.NewScanner(o)
+			for sc.Scan() {
+				shipped++
+			}
+			o.Close()
+		}
+
+		if shipped == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d events in the WAL, got %d", n, shipped)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func runRestore(ctx context.Context, args ...string) error {
+	// timestamp flags keep the value of the previous run
+	for _, f := range restoreCommand.Flags {
+		if tf, ok := f.(*cli.TimestampFlag); ok {
+			tf.Value = nil
+		}
+	}
+
+	a := &cli.App{Commands: []*cli.Command{restoreCommand}}
+	return a.RunContext(ctx, append([]string{"event-buffer", "restore"}, args...))
+}
+
+// storedEvents returns the number of events a server on the state file
+// holds.
+func storedEvents(t *testing.T, stateFile string) uint64 {
+	db, err := embedded.Open(stateFile, 0700, embedded.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv, err := server.New(logr.Discard(), db, server.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := srv.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats.Events
+}
+
+func TestRestoreAtAPointInTime(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := startBuffer(t, ctx)
+
+	b.send(t, ctx, 1, 2)
+	b.backup(t, ctx)
+	b.send(t, ctx, 3)
+
+	// --at has a resolution of seconds
+	at := time.Now().Truncate(time.Second).Add(time.Second)
+	time.Sleep(time.Until(at.Add(10 * time.Millisecond)))
+
+	b.send(t, ctx, 4)
+	b.backup(t, ctx)
+	b.waitForWAL(t, ctx, 4)
+
+	for _, c := range []struct {
+		name     string
+		args     []string
+		expected uint64
+	}{
+		{"latest backup", nil, 4},
+		{"backup before the time", []string{"--at", at.Format(time.RFC3339)}, 2},
+		{"backup and WAL until the time", []string{"--at", at.Format(time.RFC3339), "--wal-target", b.walDir}, 3},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			stateFile := filepath.Join(t.TempDir(), "state")
+			err := runRestore(ctx, append([]string{"--state-file", stateFile, "--backup-target", b.backupDir}, c.args...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n := storedEvents(t, stateFile)
+			if n != c.expected {
+				t.Fatalf("expected %d restored events, got %d", c.expected, n)
+			}
+		})
+	}
+}
+
+func TestRestoreBeforeTheFirstBackupFails(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := startBuffer(t, ctx)
+	b.send(t, ctx, 1)
+	b.backup(t, ctx)
+
+	stateFile := filepath.Join(t.TempDir(), "state")
+	at := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	err := runRestore(ctx, "--state-file", stateFile, "--backup-target", b.backupDir, "--at", at)
+	if err == nil || !strings.Contains(err.Error(), backup.ErrNoBackup.Error()) {
+		t.Fatalf("expected %v, got %v", backup.ErrNoBackup, err)
+	}
+}
+
+func TestBootstrapRestoresTheLatestBackupAndTheWAL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := startBuffer(t, ctx)
+	b.send(t, ctx, 1, 2)
+	b.backup(t, ctx)
+	b.send(t, ctx, 3)
+	b.waitForWAL(t, ctx, 3)
+
+	stateFile := filepath.Join(t.TempDir(), "state")
+	err := bootstrapState(ctx, logr.Discard(), stateFile, b.backupDir, b.walDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := storedEvents(t, stateFile)
+	if n != 3 {
+		t.Fatalf("expected 3 bootstrapped events, got %d", n)
+	}
+}
+
+func TestBootstrapKeepsAnExistingState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := startBuffer(t, ctx)
+	b.send(t, ctx, 1, 2)
+	b.backup(t, ctx)
+
+	stateFile := filepath.Join(t.TempDir(), "state")
+	err := runRestore(ctx, "--state-file", stateFile, "--backup-target", b.backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.send(t, ctx, 3)
+	b.backup(t, ctx)
+
+	err = bootstrapState(ctx, logr.Discard(), stateFile, b.backupDir, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := storedEvents(t, stateFile)
+	if n != 2 {
+		t.Fatalf("expected the existing state with 2 events, got %d", n)
+	}
+}
+
+func TestBootstrapWithoutBackupsStartsEmpty(t *testing.T) {
+	td := t.TempDir()
+	stateFile := filepath.Join(td, "state")
+
+	err := bootstrapState(context.Background(), logr.Discard(), stateFile, filepath.Join(td, "backups"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(stateFile)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected no state file, got %v", err)
+	}
+}
+
+func TestBootstrapCompletesAnInterruptedRestore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := startBuffer(t, ctx)
+	b.send(t, ctx, 1, 2)
+	b.backup(t, ctx)
+
+	stateFile := filepath.Join(t.TempDir(), "state")
+	err := runRestore(ctx, "--state-file", statefile.TempPath(stateFile), "--backup-target", b.backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the restore crashed after the swap marker was written
+	err = os.WriteFile(stateFile+".swap", []byte(filepath.Base(statefile.TempPath(stateFile))), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.send(t, ctx, 3)
+	b.backup(t, ctx)
+
+	err = bootstrapState(ctx, logr.Discard(), stateFile, b.backupDir, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := storedEvents(t, stateFile)
+	if n != 2 {
+		t.Fatalf("expected the swapped in state with 2 events, got %d", n)
+	}
+}
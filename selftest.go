@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/config"
+	"github.com/draganm/event-buffer/listener"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/statefile"
+	"github.com/go-logr/logr"
+	"github.com/urfave/cli/v2"
+	"go.etcd.io/bbolt"
+)
+
+// selftestPath is written and removed again in the state file to check it
+// is writable, it is never read by the server.
+var selftestPath = dbpath.ToPath("selftest")
+
+// selftestCommand checks that the server can start with the configuration
+// of the main command, it is meant to gate the server in an init container.
+// Addresses and the state file are taken from the flags and environment of
+// the server, so the check runs against the same configuration.
+var selftestCommand = &cli.Command{
+	Name:  "selftest",
+	Usage: "check the state file, listen addresses and free disk space, exits non-zero if a check fails",
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:    "min-free-space",
+			Usage:   "minimum free space in bytes of the file system of the state file",
+			Value:   256 << 20,
+			EnvVars: []string{"SELFTEST_MIN_FREE_SPACE"},
+		},
+		&cli.DurationFlag{
+			Name:    "lock-timeout",
+			Usage:   "how long to wait for the state file to be released by another process",
+			Value:   5 * time.Second,
+			EnvVars: []string{"SELFTEST_LOCK_TIMEOUT"},
+		},
+	},
+	Action: func(c *cli.Context) error {
+		stateFile := c.String("state-file")
+
+		type check struct {
+			name string
+			run  func() (string, error)
+		}
+
+		checks := []check{
+			{"state file", func() (string, error) {
+				return checkStateFile(stateFile, c.Duration("lock-timeout"))
+			}},
+			{"round trip", func() (string, error) {
+				return checkRoundTrip(c.Context, filepath.Dir(stateFile))
+			}},
+			{"disk space", func() (string, error) {
+				return checkFreeSpace(filepath.Dir(stateFile), c.Int64("min-free-space"))
+			}},
+		}
+
+		cfg := &config.Config{}
+		if c.String("config") != "" {
+			var err error
+			cfg, err = config.Load(c.String("config"))
+			if err != nil {
+				return err
+			}
+		}
+
+		listenOptions := listener.Options{
+			Network:   c.String("listen-network"),
+			Interface: c.String("listen-interface"),
+			ReusePort: c.Bool("reuse-port"),
+		}
+
+		addCheck := func(name, addr string, opts listener.Options) {
+			checks = append(checks, check{"listen " + name, func() (string, error) {
+				return checkListen(c.Context, addr, opts)
+			}})
+		}
+
+		if len(cfg.Listeners) == 0 {
+			addCheck("api", c.String("addr"), listenOptions)
+		}
+		for _, l := range cfg.Listeners {
+			opts := listenOptions
+			if l.Network != "" {
+				opts.Network = l.Network
+			}
+			if l.Interface != "" {
+				opts.Interface = l.Interface
+			}
+			opts.ReusePort = opts.ReusePort || l.ReusePort
+			addCheck(l.Name, l.Addr, opts)
+		}
+		addCheck("metrics", c.String("metrics-addr"), listenOptions)
+		addCheck("internal", c.String("internal-addr"), listenOptions)
+		if c.String("grpc-addr") != "" {
+			addCheck("grpc", c.String("grpc-addr"), listenOptions)
+		}
+
+		failed := 0
+		for _, ch := range checks {
+			detail, err := ch.run()
+			if err != nil {
+				failed++
+				fmt.Printf("FAIL %s: %s\n", ch.name, err)
+				continue
+			}
+			fmt.Printf("ok   %s: %s\n", ch.name, detail)
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("self-test failed: %d of %d checks failed", failed, len(checks))
+		}
+
+		return nil
+	},
+}
+
+// checkStateFile opens the state file, creating it if needed, and writes
+// and removes a key to check it is writable.
+func checkStateFile(stateFile string, lockTimeout time.Duration) (string, error) {
+	err := statefile.Recover(stateFile)
+	if err != nil {
+		return "", err
+	}
+
+	db, err := embedded.Open(stateFile, 0700, embedded.Options{Options: bbolt.Options{Timeout: lockTimeout}})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		return "", fmt.Errorf("state file %s is locked by another process", stateFile)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not open state: %w", err)
+	}
+	defer db.Close()
+
+	written := time.Now().UTC().Format(time.RFC3339Nano)
+	err = bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
+		tx.Put(selftestPath, []byte(written))
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not write state: %w", err)
+	}
+
+	var read string
+	err = bolted.SugaredRead(db, func(tx bolted.SugaredReadTx) error {
+		read = string(tx.Get(selftestPath))
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not read state: %w", err)
+	}
+	if read != written {
+		return "", fmt.Errorf("read %q from state, expected %q", read, written)
+	}
+
+	err = bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
+		tx.Delete(selftestPath)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not delete from state: %w", err)
+	}
+
+	fi, err := os.Stat(stateFile)
+	if err != nil {
+		return "", fmt.Errorf("could not stat state file: %w", err)
+	}
+
+	return fmt.Sprintf("%s is writable, %d bytes", stateFile, fi.Size()), nil
+}
+
+// checkRoundTrip publishes, polls and prunes an event on a scratch state in
+// dir, so the events of the real state are left alone while the same file
+// system is exercised.
+func checkRoundTrip(ctx context.Context, dir string) (string, error) {
+	td, err := os.MkdirTemp(dir, ".selftest-*")
+	if err != nil {
+		return "", fmt.Errorf("could not create scratch dir: %w", err)
+	}
+	defer os.RemoveAll(td)
+
+	db, err := embedded.Open(filepath.Join(td, "state"), 0700, embedded.Options{})
+	if err != nil {
+		return "", fmt.Errorf("could not open scratch state: %w", err)
+	}
+	defer db.Close()
+
+	srv, err := server.New(logr.Discard(), db, server.Options{})
+	if err != nil {
+		return "", fmt.Errorf("could not start server: %w", err)
+	}
+
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+
+	cl, err := client.New(hs.URL)
+	if err != nil {
+		return "", fmt.Errorf("could not create client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	started := time.Now()
+
+	err = cl.SendEvents(ctx, []any{"selftest"})
+	if err != nil {
+		return "", fmt.Errorf("could not publish: %w", err)
+	}
+
+	evts := []string{}
+	_, err = cl.PollForEvents(ctx, "", 10, "asc", &evts)
+	if err != nil {
+		return "", fmt.Errorf("could not poll: %w", err)
+	}
+	if len(evts) != 1 || evts[0] != "selftest" {
+		return "", fmt.Errorf("polled %q, expected the published event", evts)
+	}
+
+	err = srv.Prune(time.Now().Add(time.Second))
+	if err != nil {
+		return "", fmt.Errorf("could not prune: %w", err)
+	}
+
+	stats, err := srv.Stats()
+	if err != nil {
+		return "", fmt.Errorf("could not get stats: %w", err)
+	}
+	if stats.Events != 0 {
+		return "", fmt.Errorf("%d events left after pruning", stats.Events)
+	}
+
+	return fmt.Sprintf("published, polled and pruned an event in %s", time.Since(started).Round(time.Millisecond)), nil
+}
+
+func checkListen(ctx context.Context, addr string, opts listener.Options) (string, error) {
+	l, err := listener.Listen(ctx, addr, opts)
+	if err != nil {
+		return "", err
+	}
+	bound := l.Addr().String()
+	err = l.Close()
+	if err != nil {
+		return "", fmt.Errorf("could not close listener: %w", err)
+	}
+	return fmt.Sprintf("%s is bindable", bound), nil
+}
+
+func checkFreeSpace(dir string, min int64) (string, error) {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not get free space of %s: %w", dir, err)
+	}
+	if free < uint64(min) {
+		return "", fmt.Errorf("%d bytes free in %s, at least %d required", free, dir, min)
+	}
+	return fmt.Sprintf("%d bytes free in %s", free, dir), nil
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the bytes available to unprivileged users in the file
+// system of dir.
+func freeSpace(dir string) (uint64, error) {
+	st := unix.Statfs_t{}
+	err := unix.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
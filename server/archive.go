@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	archivePrefix = "archive/"
+	// archiveSegmentMaxEvents limits the size of a single segment.
+	archiveSegmentMaxEvents = 10000
+)
+
+// Formats of archive segments, events are encoded one per line like in
+// WAL segments.
+const (
+	ArchiveFormatJSONL     = "jsonl"
+	ArchiveFormatJSONLGzip = "jsonl.gz"
+	ArchiveFormatJSONLZstd = "jsonl.zst"
+)
+
+var archivedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "event_buffer_archived_events_total",
+	Help: "Number of events archived to the object store before they were pruned.",
+})
+
+func checkArchiveFormat(format string) error {
+	switch format {
+	case "", ArchiveFormatJSONL, ArchiveFormatJSONLGzip, ArchiveFormatJSONLZstd:
+		return nil
+	}
+	return fmt.Errorf("unsupported archive format %q, supported are %s, %s and %s", format, ArchiveFormatJSONL, ArchiveFormatJSONLGzip, ArchiveFormatJSONLZstd)
+}
+
+// archiveFormat returns the format of new segments, it defaults to
+// jsonl.zst.
+func (s Server) archiveFormat() string {
+	if s.opts.ArchiveFormat == "" {
+		return ArchiveFormatJSONLZstd
+	}
+	return s.opts.ArchiveFormat
+}
+
+// archiveStreamPrefix returns the prefix of the segments of a stream.
+func archiveStreamPrefix(st stream) string {
+	if st.topic != "" {
+		return archivePrefix + "topics/" + st.topic + "/"
+	}
+	return archivePrefix + "events/"
+}
+
+// archiveSegmentKey names segments by their stream and their first and
+// last event, so the segments of a stream sort in the order they were
+// archived.
+func archiveSegmentKey(st stream, first, last, format string) string {
+	return archiveStreamPrefix(st) + first + "_" + last + "." + format
+}
+
+// archivedUntil returns the id of the newest archived event of a stream.
+func archivedUntil(tx bolted.SugaredReadTx, st stream) string {
+	if !tx.Exists(st.archivedUntil) {
+		return ""
+	}
+	return string(tx.Get(st.archivedUntil))
+}
+
+// pruneBound returns the id of the newest event a prune with cutoffTime
+// may remove from a stream, events are removed from the oldest one on.
+func (s Server) pruneBound(tx bolted.SugaredReadTx, st stream, cutoffTime time.Time) (string, error) {
+	bound := ""
+	it := tx.Iterator(st.events)
+	it.Seek(s.timeCursor(cutoffTime))
+	if it.IsDone() {
+		it.Last()
+	} else {
+		it.Prev()
+	}
+	if !it.IsDone() {
+		bound = it.GetKey()
+	}
+
+	if s.opts.AckRetention && st.topic == "" {
+		slowest, found, err := slowestConsumerPosition(tx)
+		if err != nil {
+			return "", err
+		}
+		if found && slowest > bound {
+			bound = slowest
+		}
+	}
+
+	return bound, nil
+}
+
+// archiveStream archives the events of a stream up to and including the
+// event until that have not been archived yet. Segments are uploaded
+// before the archived position moves, prunes never remove events past it.
+// It returns the number of archived events.
+func (s Server) archiveStream(ctx context.Context, st stream, until string) (archived int, err error) {
+	ctx, span := tracer.Start(ctx, "archive", trace.WithAttributes(streamAttribute(st)))
+	defer func() {
+		span.SetAttributes(attribute.Int("event_buffer.events", archived))
+		endSpan(span, err)
+	}()
+
+	for {
+		events := []event{}
+		err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+			it := tx.Iterator(st.events)
+			seekAfter(it, archivedUntil(tx, st), sortAsc)
+			for ; !it.IsDone() && it.GetKey() <= until && len(events) < archiveSegmentMaxEvents; it.Next() {
+				payload, err := s.loadPayload(ctx, tx, it.GetValue())
+				if err != nil {
+					return fmt.Errorf("could not load event %s: %w", it.GetKey(), err)
+				}
+				events = append(events, event{id: it.GetKey(), payload: payload})
+			}
+			return nil
+		})
+		if err != nil {
+			return archived, err
+		}
+
+		if len(events) == 0 {
+			return archived, nil
+		}
+
+		segment, err := s.encodeArchiveSegment(events)
+		if err != nil {
+			return archived, err
+		}
+		segment, err = s.sealPayload(segment)
+		if err != nil {
+			return archived, err
+		}
+
+		last := events[len(events)-1].id
+		key := archiveSegmentKey(st, events[0].id, last, s.archiveFormat())
+		err = s.opts.ArchiveStore.Put(ctx, key, bytes.NewReader(segment), int64(len(segment)))
+		if err != nil {
+			return archived, fmt.Errorf("could not upload archive segment: %w", err)
+		}
+
+		err = bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+			// a concurrent prune may have archived further
+			if last > archivedUntil(tx, st) {
+				tx.Put(st.archivedUntil, []byte(last))
+			}
+			return nil
+		})
+		if err != nil {
+			return archived, fmt.Errorf("could not record archived position: %w", err)
+		}
+
+		archived += len(events)
+		archivedEvents.Add(float64(len(events)))
+	}
+}
+
+// encodeArchiveSegment encodes events one per line in the archive format.
+func (s Server) encodeArchiveSegment(events []event) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	switch s.archiveFormat() {
+	case ArchiveFormatJSONLGzip:
+		w = gzip.NewWriter(buf)
+	case ArchiveFormatJSONLZstd:
+		zw, err := zstd.NewWriter(buf)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		w = nopWriteCloser{buf}
+	}
+
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		err := enc.Encode(e)
+		if err != nil {
+			w.Close()
+			return nil, fmt.Errorf("could not encode event %s: %w", e.id, err)
+		}
+	}
+
+	err := w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not compress archive segment: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
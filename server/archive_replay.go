@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/draganm/bolted"
+	"github.com/klauspost/compress/zstd"
+)
+
+// parseArchiveSegmentKey returns the first and last event and the format
+// of a segment. Ids of a segment share their id prefix and with it their
+// length.
+func parseArchiveSegmentKey(st stream, key string) (first, last, format string, ok bool) {
+	name := strings.TrimPrefix(key, archiveStreamPrefix(st))
+	for _, f := range []string{ArchiveFormatJSONLZstd, ArchiveFormatJSONLGzip, ArchiveFormatJSONL} {
+		if strings.HasSuffix(name, "."+f) {
+			name = strings.TrimSuffix(name, "."+f)
+			format = f
+			break
+		}
+	}
+	if format == "" || len(name)%2 == 0 || name[len(name)/2] != '_' {
+		return "", "", "", false
+	}
+	return name[:len(name)/2], name[len(name)/2+1:], format, true
+}
+
+// readArchive returns up to limit events of a stream after the cursor
+// after from the archive, when the cursor is within the pruned events of
+// the stream. It returns the id of the newest pruned event as well, the
+// events after it are still in the buffer. prunedUntil is empty when the
+// cursor is not pruned.
+func (s *Server) readArchive(ctx context.Context, st stream, after string, limit int) (events []event, prunedUntil string, err error) {
+	err = bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		if tx.Exists(st.events.Append(after)) || !tx.Exists(st.prunedUntil) {
+			return nil
+		}
+		if after <= string(tx.Get(st.prunedUntil)) {
+			prunedUntil = string(tx.Get(st.prunedUntil))
+		}
+		return nil
+	})
+	if err != nil || prunedUntil == "" {
+		return nil, "", err
+	}
+
+	keys, err := s.opts.ArchiveStore.List(ctx, archiveStreamPrefix(st))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not list archive segments: %w", err)
+	}
+
+	events = []event{}
+	for _, key := range keys {
+		first, last, format, ok := parseArchiveSegmentKey(st, key)
+		if !ok || last <= after {
+			continue
+		}
+		if first > prunedUntil {
+			break
+		}
+
+		segment, err := s.readArchiveSegment(ctx, key, format)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, e := range segment {
+			if e.id <= after || e.id > prunedUntil {
+				continue
+			}
+			events = append(events, e)
+			if len(events) == limit {
+				return events, prunedUntil, nil
+			}
+		}
+	}
+
+	return events, prunedUntil, nil
+}
+
+// readArchiveSegment reads the events of a segment.
+func (s *Server) readArchiveSegment(ctx context.Context, key, format string) ([]event, error) {
+	rc, err := s.opts.ArchiveStore.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not get archive segment %s: %w", key, err)
+	}
+	defer rc.Close()
+
+	r, err := openSegment(s.cipher, rc)
+	if err != nil {
+		return nil, fmt.Errorf("could not open archive segment %s: %w", key, err)
+	}
+	switch format {
+	case ArchiveFormatJSONLGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress archive segment %s: %w", key, err)
+		}
+		defer gr.Close()
+		r = gr
+	case ArchiveFormatJSONLZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress archive segment %s: %w", key, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	events := []event{}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for dec.More() {
+		e := event{}
+		err = dec.Decode(&e)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode archive segment %s: %w", key, err)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
@@ -0,0 +1,235 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/draganm/event-buffer/server"
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+)
+
+// unavailableStore fails every request, like an unreachable bucket.
+type unavailableStore struct{}
+
+var errUnavailable = errors.New("store is unavailable")
+
+func (unavailableStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	return errUnavailable
+}
+
+func (unavailableStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return nil, errUnavailable
+}
+
+func (unavailableStore) Delete(ctx context.Context, key string) error {
+	return errUnavailable
+}
+
+func (unavailableStore) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, errUnavailable
+}
+
+func (unavailableStore) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return "", errUnavailable
+}
+
+func startArchivingBuffer(ctx context.Context, opts server.Options) error {
+	td, err := os.MkdirTemp("", "archive")
+	if err != nil {
+		return fmt.Errorf("could not create temp dir: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		os.RemoveAll(td)
+	}()
+
+	store, err := objectstore.Open("file://" + td)
+	if err != nil {
+		return fmt.Errorf("could not open archive store: %w", err)
+	}
+
+	getState(ctx).archive = store
+	opts.ArchiveStore = store
+	return startBuffer(ctx, opts)
+}
+
+func aBufferArchivingItsEvents(ctx context.Context) error {
+	return startArchivingBuffer(ctx, server.Options{})
+}
+
+func aBufferArchivingItsEventsAndHoldingAtMostEvents(ctx context.Context, n int) error {
+	return startArchivingBuffer(ctx, server.Options{MaxBufferEvents: uint64(n)})
+}
+
+func aBufferArchivingItsEventsToAnUnavailableStore(ctx context.Context) error {
+	return startBuffer(ctx, server.Options{ArchiveStore: unavailableStore{}})
+}
+
+func theArchiveShouldHoldTheEventsNumbered(ctx context.Context, numbers string) error {
+	s := getState(ctx)
+	keys, err := s.archive.List(ctx, "archive/events/")
+	if err != nil {
+		return fmt.Errorf("could not list archive: %w", err)
+	}
+	sort.Strings(keys)
+
+	archived := []string{}
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".jsonl.zst") {
+			return fmt.Errorf("unexpected archive segment %s", key)
+		}
+		seqs, err := readArchiveSegment(ctx, s.archive, key)
+		if err != nil {
+			return err
+		}
+		archived = append(archived, seqs...)
+	}
+
+	expected := []string{}
+	if numbers != "" {
+		expected = strings.Split(numbers, ",")
+	}
+	d := cmp.Diff(expected, archived)
+	if d != "" {
+		return fmt.Errorf("unexpected archived events:\n%s", d)
+	}
+	return nil
+}
+
+func theArchiveShouldHoldNoEvents(ctx context.Context) error {
+	return theArchiveShouldHoldTheEventsNumbered(ctx, "")
+}
+
+func readArchiveSegment(ctx context.Context, store objectstore.Store, key string) ([]string, error) {
+	rc, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not get segment %s: %w", key, err)
+	}
+	defer rc.Close()
+
+	zr, err := zstd.NewReader(rc)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	seqs := []string{}
+	sc := bufio.NewScanner(zr)
+	for sc.Scan() {
+		parts := []json.RawMessage{}
+		err = json.Unmarshal(sc.Bytes(), &parts)
+		if err != nil {
+			return nil, fmt.Errorf("could not unmarshal archived event: %w", err)
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected archived event %s", sc.Text())
+		}
+		oe := orderEvent{}
+		err = json.Unmarshal(parts[1], &oe)
+		if err != nil {
+			return nil, fmt.Errorf("could not unmarshal archived payload: %w", err)
+		}
+		seqs = append(seqs, strconv.Itoa(oe.Seq))
+	}
+	return seqs, sc.Err()
+}
+
+func thePruneShouldReportArchivedEvents(ctx context.Context, n int) error {
+	ps := getState(ctx).pruneStatus
+	if ps.Archived != n {
+		return fmt.Errorf("expected %d archived events, got %d", n, ps.Archived)
+	}
+	return nil
+}
+
+func pruningAllEventsShouldFail(ctx context.Context) error {
+	_, err := getState(ctx).server.PruneReport(time.Now().Add(time.Second))
+	if err == nil {
+		return errors.New("expected the prune to fail")
+	}
+	return nil
+}
+
+// pollRaw polls the buffer with the query and records the sequence numbers
+// of the polled events and the id of the last one.
+func pollRaw(ctx context.Context, query url.Values) error {
+	s := getState(ctx)
+	res, err := http.Get(s.serverBaseURL + "/events?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	s.rawStatus = res.StatusCode
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	events := [][]json.RawMessage{}
+	err = json.NewDecoder(res.Body).Decode(&events)
+	if err != nil {
+		return fmt.Errorf("could not decode events: %w", err)
+	}
+
+	s.pollResult = []string{}
+	for _, e := range events {
+		err = json.Unmarshal(e[0], &s.lastId)
+		if err != nil {
+			return err
+		}
+		oe := orderEvent{}
+		err = json.Unmarshal(e[1], &oe)
+		if err != nil {
+			return err
+		}
+		s.pollResult = append(s.pollResult, strconv.Itoa(oe.Seq))
+	}
+	return nil
+}
+
+func iPollForEventsFromTheTime(ctx context.Context, limit int, fromTime string) error {
+	err := pollRaw(ctx, url.Values{"from_time": {fromTime}, "limit": {strconv.Itoa(limit)}, "wait": {"0"}})
+	if err != nil {
+		return err
+	}
+	if getState(ctx).rawStatus != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", getState(ctx).rawStatus)
+	}
+	return nil
+}
+
+func iPollForEventsAfterTheLastPolledEvent(ctx context.Context, limit int) error {
+	s := getState(ctx)
+	err := pollRaw(ctx, url.Values{"after": {s.lastId}, "limit": {strconv.Itoa(limit)}, "wait": {"0"}})
+	if err != nil {
+		return err
+	}
+	if s.rawStatus != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", s.rawStatus)
+	}
+	return nil
+}
+
+func pollingFromTheTimeShouldReportPrunedEvents(ctx context.Context, fromTime string) error {
+	err := pollRaw(ctx, url.Values{"from_time": {fromTime}, "wait": {"0"}})
+	if err != nil {
+		return err
+	}
+	if getState(ctx).rawStatus != http.StatusGone {
+		return fmt.Errorf("expected status %d, got %d", http.StatusGone, getState(ctx).rawStatus)
+	}
+	return nil
+}
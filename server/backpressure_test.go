@@ -0,0 +1,120 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+// heldPublish is a publish request whose body is only sent on release, it
+// holds or waits for a write slot until then.
+type heldPublish struct {
+	body   *io.PipeWriter
+	status chan int
+	err    chan error
+}
+
+func aBufferWithWriteSlotsAndAWriteQueueOf(ctx context.Context, slots, queue int) error {
+	return startBuffer(ctx, server.Options{WriteConcurrency: slots, WriteQueueSize: queue})
+}
+
+func publishesWaitingForTheirBody(ctx context.Context, n int) error {
+	s := getState(ctx)
+	for i := 0; i < n; i++ {
+		pr, pw := io.Pipe()
+		hp := &heldPublish{body: pw, status: make(chan int, 1), err: make(chan error, 1)}
+		go func() {
+			req, err := http.NewRequestWithContext(ctx, "POST", s.serverBaseURL+"/events", pr)
+			if err != nil {
+				hp.err <- err
+				return
+			}
+			req.Header.Set("content-type", "application/json")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				hp.err <- err
+				return
+			}
+			res.Body.Close()
+			hp.status <- res.StatusCode
+		}()
+		s.heldPublishes = append(s.heldPublishes, hp)
+
+		// the publishes take the slot and the place in the queue in order
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
+
+func publishingShouldBeRejectedWithARetryAfter(ctx context.Context) error {
+	s := getState(ctx)
+
+	// publishes that are not rejected wait for the slot, they give up and
+	// are tried again
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		reqCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		req, err := http.NewRequestWithContext(reqCtx, "POST", s.serverBaseURL+"/events", strings.NewReader(`["rejected"]`))
+		if err != nil {
+			cancel()
+			return err
+		}
+		req.Header.Set("content-type", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			cancel()
+			continue
+		}
+		res.Body.Close()
+		cancel()
+
+		if res.StatusCode != http.StatusTooManyRequests {
+			continue
+		}
+
+		retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After"))
+		if err != nil || retryAfter < 1 {
+			return fmt.Errorf("expected a Retry-After of at least a second, got %q", res.Header.Get("Retry-After"))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("publishing was not rejected")
+}
+
+func theWaitingPublishesAreSent(ctx context.Context) error {
+	s := getState(ctx)
+	for _, hp := range s.heldPublishes {
+		go func(hp *heldPublish) {
+			io.WriteString(hp.body, `["held"]`)
+			hp.body.Close()
+		}(hp)
+	}
+
+	for _, hp := range s.heldPublishes {
+		select {
+		case status := <-hp.status:
+			if status != http.StatusOK {
+				return fmt.Errorf("expected the held publish to succeed, got status %d", status)
+			}
+		case err := <-hp.err:
+			return err
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("held publish did not complete")
+		}
+	}
+
+	s.heldPublishes = nil
+	return nil
+}
+
+func publishingShouldBeAcceptedAgain(ctx context.Context) error {
+	return getState(ctx).client.SendEvents(ctx, []any{"accepted"})
+}
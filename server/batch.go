@@ -0,0 +1,25 @@
+package server
+
+// batchRange is the response to a batch publish. Sequence numbers count
+// the events appended to a stream, they stay consecutive within a batch
+// while ids only increase.
+type batchRange struct {
+	Count         int    `json:"count"`
+	FirstID       string `json:"first_id,omitempty"`
+	LastID        string `json:"last_id,omitempty"`
+	FirstSequence uint64 `json:"first_sequence,omitempty"`
+	LastSequence  uint64 `json:"last_sequence,omitempty"`
+}
+
+func newBatchRange(ids []string, first uint64) batchRange {
+	if len(ids) == 0 {
+		return batchRange{}
+	}
+	return batchRange{
+		Count:         len(ids),
+		FirstID:       ids[0],
+		LastID:        ids[len(ids)-1],
+		FirstSequence: first,
+		LastSequence:  first + uint64(len(ids)) - 1,
+	}
+}
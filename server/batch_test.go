@@ -0,0 +1,50 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func iPublishABatchOfTwoEvents(ctx context.Context) error {
+	s := getState(ctx)
+	b, err := s.client.PublishBatch(ctx, []any{"batch1", "batch2"})
+	if err != nil {
+		return err
+	}
+	s.batch = b
+	return nil
+}
+
+func theBatchShouldBeAssignedTheSequenceNumbersTo(ctx context.Context, first, last int) error {
+	b := getState(ctx).batch
+	if b.Count != 2 || b.FirstSequence != uint64(first) || b.LastSequence != uint64(last) {
+		return fmt.Errorf("expected 2 events with sequence numbers %d to %d, got %+v", first, last, b)
+	}
+	return nil
+}
+
+func pollingShouldReturnTheBatchAfterTheFirstEvent(ctx context.Context) error {
+	s := getState(ctx)
+	evts := []string{}
+	p, err := s.client.Poll(ctx, "", 10, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+	if len(p.IDs) != 3 {
+		return fmt.Errorf("expected 3 events, got %d", len(p.IDs))
+	}
+
+	d := cmp.Diff([]string{s.batch.FirstID, s.batch.LastID}, p.IDs[1:])
+	if d != "" {
+		return fmt.Errorf("unexpected batch ids:\n%s", d)
+	}
+
+	d = cmp.Diff([]string{"batch1", "batch2"}, evts[1:])
+	if d != "" {
+		return fmt.Errorf("unexpected batch events:\n%s", d)
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+// Package benchmarks measures the storage paths of the server: appending,
+// polling, pruning and dumping events. The server package runs its
+// scenarios from TestMain, the benchmarks live here so go test -bench
+// finds them.
+//
+// Results of two commits are compared with the bench compare command,
+// which fails when a benchmark regressed by more than a threshold:
+//
+//	go test -run '^$' -bench . -benchmem -count 6 ./server/benchmarks > old.txt
+//	# change and rebuild
+//	go test -run '^$' -bench . -benchmem -count 6 ./server/benchmarks > new.txt
+//	event-buffer bench compare old.txt new.txt
+package benchmarks
@@ -0,0 +1,187 @@
+package benchmarks_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/snapshot"
+	"github.com/go-logr/logr"
+)
+
+const benchPayload = `{"type":"order.created","order":{"id":"8d1c2f4e","customer":"c-1042","items":[{"sku":"A-1","qty":2},{"sku":"B-7","qty":1}],"total":129.9}}`
+
+// startServer starts a server on a fresh state in a temporary directory.
+// Requests are served without a listener, so the benchmarks measure the
+// handlers and the storage rather than the network.
+func startServer(b *testing.B) (*server.Server, bolted.Database) {
+	b.Helper()
+
+	db, err := embedded.Open(filepath.Join(b.TempDir(), "state"), 0700, embedded.Options{})
+	if err != nil {
+		b.Fatalf("could not open state: %s", err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	srv, err := server.New(logr.Discard(), db, server.Options{})
+	if err != nil {
+		b.Fatalf("could not start server: %s", err)
+	}
+	return srv, db
+}
+
+func batchBody(n int) []byte {
+	return []byte("[" + strings.TrimSuffix(strings.Repeat(benchPayload+",", n), ",") + "]")
+}
+
+func publish(b *testing.B, srv *server.Server, body []byte) {
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/events", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		b.Fatalf("could not publish: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// fill appends n events in batches of 1000.
+func fill(b *testing.B, srv *server.Server, n int) {
+	b.Helper()
+	for n > 0 {
+		batch := 1000
+		if n < batch {
+			batch = n
+		}
+		publish(b, srv, batchBody(batch))
+		n -= batch
+	}
+}
+
+// ids returns the ids of all events in the buffer in order.
+func ids(b *testing.B, srv *server.Server) []string {
+	b.Helper()
+
+	all := []string{}
+	after := ""
+	for {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events?limit=1000&wait=0&after="+after, nil))
+		if rec.Code != http.StatusOK {
+			b.Fatalf("could not poll: %d %s", rec.Code, rec.Body.String())
+		}
+
+		events := [][]json.RawMessage{}
+		err := json.Unmarshal(rec.Body.Bytes(), &events)
+		if err != nil {
+			b.Fatalf("could not decode events: %s", err)
+		}
+		if len(events) == 0 {
+			return all
+		}
+
+		for _, e := range events {
+			var id string
+			err = json.Unmarshal(e[0], &id)
+			if err != nil {
+				b.Fatalf("could not decode id: %s", err)
+			}
+			all = append(all, id)
+		}
+		after = all[len(all)-1]
+	}
+}
+
+func BenchmarkAppend(b *testing.B) {
+	for _, size := range []int{1, 100} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			srv, _ := startServer(b)
+			body := batchBody(size)
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			started := time.Now()
+
+			for i := 0; i < b.N; i++ {
+				publish(b, srv, body)
+			}
+
+			b.ReportMetric(float64(b.N*size)/time.Since(started).Seconds(), "events/s")
+		})
+	}
+}
+
+func BenchmarkPoll(b *testing.B) {
+	const events = 10000
+	for _, limit := range []int{10, 100} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			srv, _ := startServer(b)
+			fill(b, srv, events)
+			positions := ids(b, srv)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				// polls start at spread positions, the last ones read less
+				after := positions[(i*limit)%(len(positions)-limit)]
+				rec := httptest.NewRecorder()
+				srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/events?limit=%d&wait=0&after=%s", limit, after), nil))
+				if rec.Code != http.StatusOK {
+					b.Fatalf("could not poll: %d %s", rec.Code, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPrune(b *testing.B) {
+	const events = 5000
+	srv, _ := startServer(b)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fill(b, srv, events)
+		b.StartTimer()
+
+		err := srv.Prune(time.Now().Add(time.Second))
+		if err != nil {
+			b.Fatalf("could not prune: %s", err)
+		}
+	}
+}
+
+func BenchmarkDump(b *testing.B) {
+	const events = 10000
+	srv, db := startServer(b)
+	fill(b, srv, events)
+
+	dumps := []struct {
+		format string
+		dump   func(tx bolted.SugaredReadTx) error
+	}{
+		{"raw", func(tx bolted.SugaredReadTx) error {
+			tx.Dump(io.Discard)
+			return nil
+		}},
+		{"snapshot", func(tx bolted.SugaredReadTx) error {
+			return snapshot.Write(io.Discard, tx)
+		}},
+	}
+
+	for _, d := range dumps {
+		d := d
+		b.Run("format="+d.format, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := bolted.SugaredRead(db, d.dump)
+				if err != nil {
+					b.Fatalf("could not dump: %s", err)
+				}
+			}
+		})
+	}
+}
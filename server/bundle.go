@@ -0,0 +1,375 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/draganm/bolted"
+)
+
+const (
+	bundleVersion      = 1
+	bundleManifestName = "manifest.json"
+	bundleSigName      = "manifest.sig"
+	bundleEventsName   = "events.jsonl"
+)
+
+// BundleManifest describes the events contained in a bundle. The manifest
+// is signed, the events are covered by the signature through their hash.
+// Topic is empty for bundles of the buffer.
+type BundleManifest struct {
+	Version      int       `json:"version"`
+	Created      time.Time `json:"created"`
+	Topic        string    `json:"topic,omitempty"`
+	After        string    `json:"after"`
+	First        string    `json:"first"`
+	Last         string    `json:"last"`
+	Count        int       `json:"count"`
+	EventsSHA256 string    `json:"eventsSha256"`
+}
+
+// ExportBundle writes a signed bundle (gzipped tar) with all events of a
+// topic, or of the buffer for an empty topic, after the given event id.
+func (s Server) ExportBundle(w io.Writer, topic, after string, key ed25519.PrivateKey) error {
+	st, err := s.namedStream(topic)
+	if err != nil {
+		return err
+	}
+
+	events, err := os.CreateTemp("", "bundle-events")
+	if err != nil {
+		return fmt.Errorf("could not create temp file: %w", err)
+	}
+
+	defer os.Remove(events.Name())
+	defer events.Close()
+
+	h := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(events, h))
+	enc := json.NewEncoder(bw)
+
+	m := BundleManifest{
+		Version: bundleVersion,
+		Created: time.Now().UTC(),
+		Topic:   topic,
+		After:   after,
+	}
+
+	err = bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		it := tx.Iterator(st.events)
+		if after != "" {
+			it.Seek(after)
+			if !it.IsDone() && it.GetKey() == after {
+				it.Next()
+			}
+		}
+		for ; !it.IsDone(); it.Next() {
+			payload, err := s.loadPayload(context.Background(), tx, it.GetValue())
+			if err != nil {
+				return fmt.Errorf("could not load event %s: %w", it.GetKey(), err)
+			}
+			err = enc.Encode(event{id: it.GetKey(), payload: payload})
+			if err != nil {
+				return fmt.Errorf("could not write event: %w", err)
+			}
+			if m.First == "" {
+				m.First = it.GetKey()
+			}
+			m.Last = it.GetKey()
+			m.Count++
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("could not write events: %w", err)
+	}
+
+	m.EventsSHA256 = hex.EncodeToString(h.Sum(nil))
+
+	md, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("could not marshal manifest: %w", err)
+	}
+
+	sig := ed25519.Sign(key, md)
+
+	eventsSize, err := events.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("could not get size of events: %w", err)
+	}
+
+	_, err = events.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("could not rewind events: %w", err)
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	for _, f := range []struct {
+		name string
+		size int64
+		r    io.Reader
+	}{
+		{bundleManifestName, int64(len(md)), bytes.NewReader(md)},
+		{bundleSigName, int64(len(sig)), bytes.NewReader(sig)},
+		{bundleEventsName, eventsSize, events},
+	} {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    f.name,
+			Mode:    0600,
+			Size:    f.size,
+			ModTime: m.Created,
+		})
+		if err != nil {
+			return fmt.Errorf("could not write %s header: %w", f.name, err)
+		}
+
+		_, err = io.Copy(tw, f.r)
+		if err != nil {
+			return fmt.Errorf("could not write %s: %w", f.name, err)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return fmt.Errorf("could not finish tar: %w", err)
+	}
+
+	return gw.Close()
+}
+
+// ImportBundle verifies a bundle against the trusted keys and stores its
+// events with their original ids, in the topic the bundle was exported
+// from. The topic has to exist. Events that are already stored are
+// skipped. Nothing is stored if the bundle fails validation.
+func (s Server) ImportBundle(r io.Reader, trusted []ed25519.PublicKey) (m *BundleManifest, imported int, err error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not open bundle: %w", err)
+	}
+
+	tr := tar.NewReader(gr)
+
+	next := func(name string) error {
+		hdr, err := tr.Next()
+		if err != nil {
+			return fmt.Errorf("could not read %s from bundle: %w", name, err)
+		}
+		if hdr.Name != name {
+			return fmt.Errorf("expected %s in bundle, got %s", name, hdr.Name)
+		}
+		return nil
+	}
+
+	err = next(bundleManifestName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	md, err := io.ReadAll(io.LimitReader(tr, 1<<20))
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read manifest: %w", err)
+	}
+
+	err = next(bundleSigName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sig, err := io.ReadAll(io.LimitReader(tr, ed25519.SignatureSize+1))
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read signature: %w", err)
+	}
+
+	verified := false
+	for _, k := range trusted {
+		if ed25519.Verify(k, md, sig) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, 0, errors.New("bundle is not signed by a trusted key")
+	}
+
+	m = &BundleManifest{}
+	err = json.Unmarshal(md, m)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not parse manifest: %w", err)
+	}
+
+	if m.Version != bundleVersion {
+		return nil, 0, fmt.Errorf("unsupported bundle version %d", m.Version)
+	}
+
+	st, err := s.namedStream(m.Topic)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = next(bundleEventsName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	h := sha256.New()
+	dec := json.NewDecoder(io.TeeReader(tr, h))
+
+	err = bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		count := 0
+		for {
+			e := event{}
+			err := dec.Decode(&e)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("could not decode event: %w", err)
+			}
+			count++
+
+			if tx.Exists(st.events.Append(e.id)) {
+				continue
+			}
+			err = s.storeEvent(tx, st.events, e.id, e.payload)
+			if err != nil {
+				return err
+			}
+			imported++
+		}
+		addCounter(tx, st.appended, imported)
+
+		// the decoder might not have consumed trailing whitespace
+		_, err := io.Copy(h, tr)
+		if err != nil {
+			return fmt.Errorf("could not read events: %w", err)
+		}
+
+		if hex.EncodeToString(h.Sum(nil)) != m.EventsSHA256 {
+			return errors.New("events of the bundle don't match the manifest checksum")
+		}
+
+		if count != m.Count {
+			return fmt.Errorf("manifest lists %d events, bundle contains %d", m.Count, count)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// imported events may fall into prefetched ranges, events published
+	// later must sort after them
+	if imported > 0 {
+		s.readAhead.drop(m.Topic)
+		err = s.clock.observe(m.Last)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	s.log.Info("imported bundle", "topic", m.Topic, "first", m.First, "last", m.Last, "imported", imported, "skipped", m.Count-imported)
+
+	return m, imported, nil
+}
+
+// GenerateBundleKeys creates a PEM encoded ed25519 key pair for signing
+// bundles.
+func GenerateBundleKeys() (private, public []byte, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate key: %w", err)
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not marshal private key: %w", err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not marshal public key: %w", err)
+	}
+
+	private = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	public = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+
+	return private, public, nil
+}
+
+func LoadBundleSigningKey(path string) (ed25519.PrivateKey, error) {
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key: %w", err)
+	}
+
+	b, _ := pem.Decode(d)
+	if b == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM block", path)
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse signing key: %w", err)
+	}
+
+	pk, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", path)
+	}
+
+	return pk, nil
+}
+
+func LoadBundleVerifyKeys(paths []string) ([]ed25519.PublicKey, error) {
+	keys := []ed25519.PublicKey{}
+	for _, path := range paths {
+		d, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read verify key: %w", err)
+		}
+
+		b, _ := pem.Decode(d)
+		if b == nil {
+			return nil, fmt.Errorf("%s does not contain a PEM block", path)
+		}
+
+		k, err := x509.ParsePKIXPublicKey(b.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse verify key %s: %w", path, err)
+		}
+
+		pk, ok := k.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an ed25519 public key", path)
+		}
+
+		keys = append(keys, pk)
+	}
+	return keys, nil
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/draganm/bolted"
+)
+
+// cdcBatchSize limits the number of events read in one transaction.
+const cdcBatchSize = 1000
+
+// ServeCDC streams appended events to processes connecting to l until ctx
+// is cancelled.
+//
+// The protocol is line based: the subscriber sends the id of the last
+// event it has seen, or an empty line to start at the oldest event.
+// Subscribers of a topic prefix the line with the name of the topic and a
+// space, e.g. "orders " to start at its oldest event. The server then
+// writes every following event as a JSON array [id, payload]
+// on its own line, as soon as it is appended. If the events after the id
+// have already been pruned, a single retention expired object is written
+// instead and the connection is closed.
+func (s *Server) ServeCDC(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("could not accept CDC connection: %w", err)
+		}
+
+		go func() {
+			defer conn.Close()
+			err := s.serveCDCConn(ctx, conn)
+			if err != nil {
+				s.log.Error(err, "CDC subscriber failed")
+			}
+		}()
+	}
+}
+
+func (s *Server) serveCDCConn(ctx context.Context, conn net.Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("could not read cursor: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	st := defaultStream
+	after := strings.TrimRight(line, "\r\n")
+	topic, id, found := strings.Cut(after, " ")
+	if found {
+		st, err = s.namedStream(topic)
+		if err != nil {
+			return err
+		}
+		after = id
+	}
+
+	after = strings.TrimSpace(after)
+	if after != "" {
+		_, err = eventTime(after)
+		if err != nil {
+			return fmt.Errorf("invalid cursor: %w", err)
+		}
+	}
+
+	// subscribers don't send anything after the cursor, reading returns
+	// once they disconnect
+	go func() {
+		r.WriteTo(io.Discard)
+		cancel()
+	}()
+
+	changes, done := s.db.Observe(st.events.ToMatcher().AppendAnyElementMatcher())
+	defer done()
+
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+
+	if after != "" {
+		expired, err := s.cursorExpired(st, after)
+		if err != nil {
+			return err
+		}
+		if expired != nil {
+			enc.Encode(expired)
+			return w.Flush()
+		}
+	}
+
+	return s.tailEvents(ctx, st, changes, after, enc, w.Flush)
+}
+
+// tailEvents encodes the events of a stream after the cursor and every
+// event appended later, until ctx is cancelled. flush is called after each
+// batch of events.
+func (s *Server) tailEvents(ctx context.Context, st stream, changes <-chan bolted.ObservedChanges, after string, enc *json.Encoder, flush func() error) error {
+	for {
+		events := []event{}
+		err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+			it := tx.Iterator(st.events)
+			if after != "" {
+				it.Seek(after)
+				if !it.IsDone() && it.GetKey() == after {
+					it.Next()
+				}
+			}
+			for ; !it.IsDone() && len(events) < cdcBatchSize; it.Next() {
+				payload, err := s.loadPayload(ctx, tx, it.GetValue())
+				if err != nil {
+					return fmt.Errorf("could not load event %s: %w", it.GetKey(), err)
+				}
+				events = append(events, event{id: it.GetKey(), payload: payload})
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not read events: %w", err)
+		}
+
+		for _, e := range events {
+			err = enc.Encode(e)
+			if err != nil {
+				return fmt.Errorf("could not write event: %w", err)
+			}
+		}
+
+		if len(events) > 0 {
+			after = events[len(events)-1].id
+			err = flush()
+			if err != nil {
+				return fmt.Errorf("could not write events: %w", err)
+			}
+		}
+
+		if len(events) == cdcBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changes:
+		}
+	}
+}
+
+// cursorExpired returns the retention expired error for a cursor that
+// points at a pruned event, or nil.
+func (s *Server) cursorExpired(st stream, after string) (*retentionExpired, error) {
+	var res *retentionExpired
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		if tx.Exists(st.events.Append(after)) || !tx.Exists(st.prunedUntil) {
+			return nil
+		}
+		if after > string(tx.Get(st.prunedUntil)) {
+			return nil
+		}
+		res = &retentionExpired{Error: fmt.Sprintf("events after %s have been pruned", after)}
+		it := tx.Iterator(st.events)
+		if !it.IsDone() {
+			res.Oldest = it.GetKey()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not check cursor: %w", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,135 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// subscribeToCDC connects to the CDC socket of the buffer and sends the
+// cursor line.
+func subscribeToCDC(ctx context.Context, cursor string) error {
+	s := getState(ctx)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go s.server.ServeCDC(ctx, l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return fmt.Errorf("could not connect: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	_, err = fmt.Fprintf(conn, "%s\n", cursor)
+	if err != nil {
+		return err
+	}
+
+	s.cdc = conn
+	s.cdcLines = bufio.NewReader(conn)
+	return nil
+}
+
+// readCDC reads the next line written to the subscriber.
+func readCDC(ctx context.Context) ([]byte, error) {
+	s := getState(ctx)
+	s.cdc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return s.cdcLines.ReadBytes('\n')
+}
+
+func aCDCSubscriberStartingAtTheOldestEvent(ctx context.Context) error {
+	return subscribeToCDC(ctx, "")
+}
+
+func aCDCSubscriberStartingAfterThePolledEvent(ctx context.Context) error {
+	return subscribeToCDC(ctx, getState(ctx).lastId)
+}
+
+func aCDCSubscriberOfTheTopicStartingAfterItsOldestEvent(ctx context.Context, topic string) error {
+	tc, err := topicClient(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	evts := []json.RawMessage{}
+	ids, err := tc.PollForEvents(ctx, "", 1, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+
+	return subscribeToCDC(ctx, topic+" "+ids[0])
+}
+
+func aCDCSubscriberOfTheTopic(ctx context.Context, topic string) error {
+	return subscribeToCDC(ctx, topic+" ")
+}
+
+func theCDCSubscriberShouldReceiveThePayloads(ctx context.Context, expected string) error {
+	payloads := []json.RawMessage{}
+	err := json.Unmarshal([]byte(expected), &payloads)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range payloads {
+		line, err := readCDC(ctx)
+		if err != nil {
+			return fmt.Errorf("could not read event: %w", err)
+		}
+
+		evt := []json.RawMessage{}
+		err = json.Unmarshal(line, &evt)
+		if err != nil {
+			return fmt.Errorf("could not decode event %s: %w", line, err)
+		}
+		if len(evt) != 2 {
+			return fmt.Errorf("expected an [id, payload] array, got %s", line)
+		}
+
+		if !bytes.Equal(evt[1], p) {
+			return fmt.Errorf("expected the payload %s, got %s", p, evt[1])
+		}
+	}
+
+	return nil
+}
+
+func theCDCSubscriberShouldBeToldThatTheEventsAfterItsCursorHaveBeenPruned(ctx context.Context) error {
+	line, err := readCDC(ctx)
+	if err != nil {
+		return fmt.Errorf("could not read: %w", err)
+	}
+
+	expired := struct {
+		Error string `json:"error"`
+	}{}
+	err = json.Unmarshal(line, &expired)
+	if err != nil {
+		return fmt.Errorf("expected a retention expired object, got %s", line)
+	}
+	if expired.Error == "" {
+		return fmt.Errorf("expected a retention expired error, got %s", line)
+	}
+
+	return theCDCSubscriberShouldBeDisconnected(ctx)
+}
+
+func theCDCSubscriberShouldBeDisconnected(ctx context.Context) error {
+	line, err := readCDC(ctx)
+	if !errors.Is(err, io.EOF) {
+		return fmt.Errorf("expected the connection to be closed, got %q, %v", line, err)
+	}
+	return nil
+}
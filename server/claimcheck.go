@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/gorilla/mux"
+)
+
+// deliveryClaimCheck is the value of the `delivery` query parameter that
+// replaces payloads of polled events with URLs they can be fetched from.
+const deliveryClaimCheck = "claim-check"
+
+const defaultClaimCheckTTL = 15 * time.Minute
+
+// claimCheck is delivered instead of the payload of an event.
+type claimCheck struct {
+	URL string `json:"url"`
+}
+
+func newClaimCheckSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate claim check secret: %w", err)
+	}
+	return secret, nil
+}
+
+func (s *Server) claimCheckTTL() time.Duration {
+	if s.opts.ClaimCheckTTL > 0 {
+		return s.opts.ClaimCheckTTL
+	}
+	return defaultClaimCheckTTL
+}
+
+// claimCheckSignature covers the event, the expiry and the redaction rules
+// applied when the payload is fetched, so none of them can be changed by
+// the consumer.
+func (s *Server) claimCheckSignature(id string, expires int64, rules string) string {
+	m := hmac.New(sha256.New, s.claimCheckSecret)
+	fmt.Fprintf(m, "%s\n%d\n%s", id, expires, rules)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func formatRuleIndexes(indexes []int) string {
+	parts := make([]string, len(indexes))
+	for i, idx := range indexes {
+		parts[i] = strconv.Itoa(idx)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *Server) parseRuleIndexes(rules string) ([]compiledRedactionRule, error) {
+	if rules == "" {
+		return nil, nil
+	}
+	compiled := []compiledRedactionRule{}
+	for _, p := range strings.Split(rules, ",") {
+		idx, err := strconv.Atoi(p)
+		if err != nil || idx < 0 || idx >= len(s.redactionRules) {
+			return nil, fmt.Errorf("invalid redaction rule %q", p)
+		}
+		compiled = append(compiled, s.redactionRules[idx])
+	}
+	return compiled, nil
+}
+
+// publicURL returns the base URL of the API as seen by the consumer.
+func (s *Server) publicURL(r *http.Request) string {
+	if s.opts.PublicURL != "" {
+		return strings.TrimSuffix(s.opts.PublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// claimCheckPayload returns the claim check delivered instead of the
+// payload of an event. Offloaded payloads without redactions are fetched
+// directly from the object store when it supports presigned URLs and they
+// aren't encrypted, all others are served by the buffer.
+func (s *Server) claimCheckPayload(ctx context.Context, r *http.Request, id string, value []byte, ruleIndexes []int) (json.RawMessage, error) {
+	ttl := s.claimCheckTTL()
+
+	rec, isRecord, err := decodeRecord(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if isRecord && rec.Object != "" && len(ruleIndexes) == 0 && s.opts.OffloadStore != nil && s.cipher == nil {
+		u, err := s.opts.OffloadStore.PresignGet(ctx, rec.Object, ttl)
+		switch {
+		case err == nil:
+			return json.Marshal(claimCheck{URL: u})
+		case !errors.Is(err, objectstore.ErrPresignNotSupported):
+			return nil, fmt.Errorf("could not presign payload of %s: %w", id, err)
+		}
+	}
+
+	expires := time.Now().Add(ttl).Unix()
+	rules := formatRuleIndexes(ruleIndexes)
+
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	if rules != "" {
+		q.Set("rules", rules)
+	}
+	q.Set("signature", s.claimCheckSignature(id, expires, rules))
+
+	return json.Marshal(claimCheck{
+		URL: fmt.Sprintf("%s/payloads/%s?%s", s.publicURL(r), url.PathEscape(id), q.Encode()),
+	})
+}
+
+// getPayload serves payloads of claim checks issued by the buffer.
+func (s *Server) getPayload(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+
+	id := mux.Vars(r)["id"]
+	q := r.URL.Query()
+	rules := q.Get("rules")
+
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Errorf("could not parse expires: %w", err).Error(), http.StatusBadRequest)
+		return
+	}
+
+	expected := s.claimCheckSignature(id, expires, rules)
+	if !hmac.Equal([]byte(expected), []byte(q.Get("signature"))) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	if time.Now().Unix() > expires {
+		http.Error(w, "claim check has expired", http.StatusForbidden)
+		return
+	}
+
+	redactions, err := s.parseRuleIndexes(rules)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var payload json.RawMessage
+	found := false
+	err = bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		path := eventsPath.Append(id)
+		if !tx.Exists(path) {
+			return nil
+		}
+		found = true
+		payload, err = s.loadPayload(r.Context(), tx, tx.Get(path))
+		return err
+	})
+	if err != nil {
+		log.Error(err, "could not load payload")
+		http.Error(w, fmt.Errorf("could not load payload: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		http.Error(w, fmt.Sprintf("event %s not found", id), http.StatusNotFound)
+		return
+	}
+
+	if len(redactions) > 0 {
+		payload, err = redactPayload(payload, redactions)
+		if err != nil {
+			log.Error(err, "could not redact payload")
+			http.Error(w, fmt.Errorf("could not redact payload: %w", err).Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	s.usage.record(requestPrincipal(r), Usage{ConsumedBytes: uint64(len(payload))})
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(payload)
+}
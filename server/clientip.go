@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies is a set of networks whose X-Forwarded-For and X-Real-IP
+// headers are honored when determining the address of a client.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a list of CIDRs or single IP addresses.
+func ParseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	tp := TrustedProxies{}
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			tp = append(tp, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy CIDR %q: %w", c, err)
+		}
+		tp = append(tp, n)
+	}
+	return tp, nil
+}
+
+func (tp TrustedProxies) trusts(ip net.IP) bool {
+	for _, n := range tp {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent the request.
+// Forwarding headers are only taken into account when the request was
+// received from a trusted proxy, X-Forwarded-For is walked from the right
+// and the first address that is not a trusted proxy is the client.
+func (tp TrustedProxies) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer := net.ParseIP(host)
+	if peer == nil || !tp.trusts(peer) {
+		return host
+	}
+
+	xff := r.Header.Values("X-Forwarded-For")
+	if len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				// a malformed hop can't be trusted, so whatever was added
+				// by the last trusted proxy before it is the client
+				break
+			}
+			host = hop.String()
+			if !tp.trusts(hop) {
+				return host
+			}
+		}
+		return host
+	}
+
+	realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+	if realIP != nil {
+		return realIP.String()
+	}
+
+	return host
+}
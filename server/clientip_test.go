@@ -0,0 +1,48 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+func theTrustedProxies(ctx context.Context, cidrs string) error {
+	tp, err := server.ParseTrustedProxies(strings.Split(cidrs, ","))
+	if err != nil {
+		return err
+	}
+	getState(ctx).trustedProxies = tp
+	return nil
+}
+
+func aRequestFromWithTheHeaderSetTo(ctx context.Context, peer, header, value string) error {
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.RemoteAddr = net.JoinHostPort(peer, "41000")
+	if value != "" {
+		r.Header.Set(header, value)
+	}
+
+	s := getState(ctx)
+	s.clientIP = s.trustedProxies.ClientIP(r)
+	return nil
+}
+
+func theClientAddressShouldBe(ctx context.Context, expected string) error {
+	ip := getState(ctx).clientIP
+	if ip != expected {
+		return fmt.Errorf("expected client address %s, got %s", expected, ip)
+	}
+	return nil
+}
+
+func parsingTheTrustedProxiesShouldFail(ctx context.Context, cidrs string) error {
+	_, err := server.ParseTrustedProxies(strings.Split(cidrs, ","))
+	if err == nil {
+		return fmt.Errorf("expected %q to be rejected", cidrs)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/go-logr/logr"
+	"github.com/gofrs/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxClockSkew is how far the wall clock may move apart from the
+// monotonic clock, or from the ids already stored, before it is reported
+// as a jump. NTP slews the clock by far less.
+const maxClockSkew = time.Second
+
+// uuidEpochTicks is the number of 100ns intervals UUID timestamps count
+// from 1582-10-15 until the unix epoch.
+const uuidEpochTicks = 122192928000000000
+
+var clockSkews = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "event_buffer_clock_skews_total",
+	Help: "Number of wall clock jumps, forward or backward, seen while generating event ids or pruning.",
+}, []string{"direction"})
+
+// clockGuard generates the ids of new events and the time prunes cut off
+// at, so that jumps of the wall clock, from NTP corrections or paused VMs,
+// neither reorder events nor prune them early.
+type clockGuard struct {
+	log logr.Logger
+
+	mu sync.Mutex
+	// ref is the last reading of the wall and monotonic clocks, jumps
+	// show up as a difference of their elapsed times since then.
+	ref time.Time
+	// last is the timestamp of the newest id generated or stored, in
+	// 100ns UUID ticks.
+	last     uint64
+	clockSeq uint16
+	node     [6]byte
+	// prefix precedes the UUID of generated ids, see Options.IDPrefix.
+	prefix string
+
+	pruneRef  time.Time
+	pruneTime time.Time
+}
+
+func newClockGuard(log logr.Logger, idPrefix string) (*clockGuard, error) {
+	c := &clockGuard{log: log, ref: time.Now()}
+	if idPrefix != "" {
+		c.prefix = idPrefix + idPrefixSeparator
+	}
+
+	var random [8]byte
+	_, err := rand.Read(random[:])
+	if err != nil {
+		return nil, fmt.Errorf("could not generate node id: %w", err)
+	}
+	c.clockSeq = binary.BigEndian.Uint16(random[0:]) & 0x3fff
+	copy(c.node[:], random[2:])
+	// random node ids are marked as multicast addresses, so they can't
+	// collide with hardware addresses
+	c.node[0] |= 0x01
+	return c, nil
+}
+
+func uuidTicks(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100 + uuidEpochTicks)
+}
+
+// now reads the clock and reports jumps of the wall clock since the last
+// reading. Callers hold mu.
+func (c *clockGuard) now() time.Time {
+	now := time.Now()
+	// Round(0) strips the monotonic reading, so Sub compares wall clocks
+	skew := now.Round(0).Sub(c.ref.Round(0)) - now.Sub(c.ref)
+	c.ref = now
+
+	switch {
+	case skew > maxClockSkew:
+		clockSkews.WithLabelValues("forward").Inc()
+		c.log.Info("wall clock jumped forward", "skew", skew.String())
+	case skew < -maxClockSkew:
+		clockSkews.WithLabelValues("backward").Inc()
+		c.log.Info("wall clock jumped backward, new events are stored after the newest one", "skew", (-skew).String())
+	}
+	return now
+}
+
+// observe records the id of a stored event, ids generated later sort
+// after it even when the wall clock is behind it.
+func (c *clockGuard) observe(id string) error {
+	t, err := eventTime(id)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ticks := uuidTicks(t)
+	if ticks <= c.last {
+		return nil
+	}
+	c.last = ticks
+
+	if ahead := time.Until(t); ahead > maxClockSkew {
+		clockSkews.WithLabelValues("backward").Inc()
+		c.log.Info("stored events are newer than the wall clock, new events are stored after them", "ahead", ahead.String())
+	}
+	return nil
+}
+
+// newEventIDs generates n UUIDv6 ids with the id prefix, each sorting
+// after all ids generated or observed before. Their timestamps follow the
+// wall clock, but never go back when it does. They are cut from one
+// string, so a batch allocates its ids at once.
+func (c *clockGuard) newEventIDs(n int) []string {
+	c.mu.Lock()
+	ticks := uuidTicks(c.now())
+	if ticks <= c.last {
+		ticks = c.last + 1
+	}
+	first := ticks
+	c.last = first + uint64(n) - 1
+	c.mu.Unlock()
+
+	idLen := len(c.prefix) + 36
+	buf := make([]byte, 0, n*idLen)
+	for i := 0; i < n; i++ {
+		buf = append(buf, c.prefix...)
+		buf = appendUUID(buf, c.uuid(first+uint64(i)))
+	}
+
+	all := string(buf)
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = all[i*idLen : (i+1)*idLen]
+	}
+	return ids
+}
+
+// uuid returns the UUIDv6 of a timestamp in 100ns UUID ticks.
+func (c *clockGuard) uuid(ticks uint64) uuid.UUID {
+	u := uuid.UUID{}
+	binary.BigEndian.PutUint32(u[0:], uint32(ticks>>28))
+	binary.BigEndian.PutUint16(u[4:], uint16(ticks>>12))
+	binary.BigEndian.PutUint16(u[6:], 0x6000|uint16(ticks&0xfff))
+	binary.BigEndian.PutUint16(u[8:], 0x8000|c.clockSeq)
+	copy(u[10:], c.node[:])
+	return u
+}
+
+// PruneTime returns the time retention periods are counted back from when
+// pruning. It is the wall clock, but after the wall clock jumped forward
+// it only catches up at twice the speed of the monotonic clock, so a jump
+// doesn't prune the events of the time it skipped at once.
+func (s *Server) PruneTime() time.Time {
+	return s.clock.pruneNow()
+}
+
+func (c *clockGuard) pruneNow() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	t := now.Round(0)
+	if !c.pruneRef.IsZero() {
+		limit := c.pruneTime.Add(2 * now.Sub(c.pruneRef))
+		if t.After(limit) {
+			t = limit
+		}
+	}
+	c.pruneRef = now
+	c.pruneTime = t
+	return t
+}
+
+// observeNewestEvents records the newest ids of the buffer and its topics,
+// so events stored after a restart with the clock set back sort after
+// them.
+func observeNewestEvents(db bolted.Database, c *clockGuard) error {
+	return bolted.SugaredRead(db, func(tx bolted.SugaredReadTx) error {
+		topics, err := readTopics(tx)
+		if err != nil {
+			return fmt.Errorf("could not read topics: %w", err)
+		}
+		for _, st := range append([]stream{defaultStream}, topics...) {
+			head := headPosition(tx, st.events)
+			if head == "" {
+				continue
+			}
+			err := c.observe(head)
+			if err != nil {
+				return fmt.Errorf("could not read the newest event: %w", err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,124 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/server/testrig"
+	"github.com/go-logr/logr"
+)
+
+func eventsArePublishedConcurrentlyInBatches(ctx context.Context, batches, size int) error {
+	s := getState(ctx)
+	evts := []any{}
+	for i := 0; i < size; i++ {
+		evts = append(evts, fmt.Sprintf("evt-%d", i))
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	s.batches = nil
+	for i := 0; i < batches; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := s.client.PublishBatch(ctx, evts)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				firstErr = err
+				return
+			}
+			s.batches = append(s.batches, b)
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func theIdsOfTheBatchesShouldGrowWithTheirSequenceNumbers(ctx context.Context) error {
+	batches := getState(ctx).batches
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i].FirstSequence < batches[j].FirstSequence
+	})
+	for i := 1; i < len(batches); i++ {
+		if batches[i].FirstID <= batches[i-1].LastID {
+			return fmt.Errorf("batch %d starts at %s, before the end %s of batch %d", batches[i].FirstSequence, batches[i].FirstID, batches[i-1].LastID, batches[i-1].FirstSequence)
+		}
+	}
+	return nil
+}
+
+// aFollowerOfAPrimaryWithAnEventFromTheFuture starts a buffer replicating
+// an event stored an hour ahead of the clock, like events stored before
+// the clock of a host was set back.
+func aFollowerOfAPrimaryWithAnEventFromTheFuture(ctx context.Context) error {
+	s := getState(ctx)
+	s.futureID = server.TimeCursor(time.Now().Add(time.Hour))
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/x-ndjson")
+		json.NewEncoder(w).Encode([]any{s.futureID, "evt-future"})
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	go func() {
+		<-ctx.Done()
+		primary.Close()
+	}()
+
+	followerURL, follower, err := testrig.StartServerWithOptions(ctx, logr.FromContextOrDiscard(ctx), server.Options{})
+	if err != nil {
+		return fmt.Errorf("could not start follower: %w", err)
+	}
+	go follower.Follow(ctx, primary.URL)
+
+	s.follower, err = client.New(followerURL)
+	if err != nil {
+		return err
+	}
+	_, _, err = pollAll(ctx, s.follower, 1)
+	return err
+}
+
+func iPublishAnEventToTheFollower(ctx context.Context) error {
+	s := getState(ctx)
+	b, err := s.follower.PublishBatch(ctx, []any{"evt-now"})
+	if err != nil {
+		return err
+	}
+	s.lastId = b.FirstID
+	return nil
+}
+
+func theEventShouldBeStoredAfterTheEventFromTheFuture(ctx context.Context) error {
+	s := getState(ctx)
+	ids, evts, err := pollAll(ctx, s.follower, 2)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 2 || ids[0] != s.futureID || ids[1] != s.lastId {
+		return fmt.Errorf("expected the published event %s after %s, got %v %v", s.lastId, s.futureID, ids, evts)
+	}
+	return nil
+}
+
+func theMetricsShouldCountAClockSkew(ctx context.Context) error {
+	skews, err := gatheredMetrics("event_buffer_clock_skews_total", map[string]string{"direction": "backward"})
+	if err != nil {
+		return err
+	}
+	if len(skews) != 1 || skews[0].GetCounter().GetValue() < 1 {
+		return fmt.Errorf("expected a counted clock skew, got %v", skews)
+	}
+	return nil
+}
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With Options.CloudEvents every event has to be a CloudEvents 1.0 event in
+// the structured JSON format, events are stored as published. Besides JSON
+// arrays of events, publishes take a single event with the content type
+// application/cloudevents+json, and an event in the binary content mode of
+// the HTTP binding, where the attributes are ce- headers and the body is
+// the data.
+//
+// Reads with ?envelope=cloudevents return events in the structured format,
+// polls as an application/cloudevents-batch+json array, streams of
+// Server-Sent Events as data of each event. Polls with
+// ?envelope=cloudevents-binary return the next event in the binary content
+// mode, or 204 when there is none. Delivered events carry the id of the
+// buffer in the eventbufferid extension attribute, it is the cursor of the
+// next read.
+const (
+	cloudEventsSpecVersion      = "1.0"
+	cloudEventContentType       = "application/cloudevents+json"
+	cloudEventsBatchContentType = "application/cloudevents-batch+json"
+	bufferIDAttribute           = "eventbufferid"
+)
+
+// Values of the `envelope` query parameter of buffers storing CloudEvents.
+const (
+	envelopeCloudEvents       = "cloudevents"
+	envelopeCloudEventsBinary = "cloudevents-binary"
+)
+
+var errInvalidCloudEvent = errors.New("invalid CloudEvent")
+
+// optionalCloudEventAttributes are the attributes of the specification
+// besides the required id, source, specversion and type.
+var optionalCloudEventAttributes = map[string]bool{
+	"datacontenttype": true,
+	"dataschema":      true,
+	"subject":         true,
+	"time":            true,
+}
+
+// validateEvents checks that events are CloudEvents when the buffer stores
+// them.
+func (s Server) validateEvents(events []json.RawMessage) error {
+	if !s.opts.CloudEvents {
+		return nil
+	}
+	for i, e := range events {
+		err := validateCloudEvent(e)
+		if err != nil {
+			return fmt.Errorf("event %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateCloudEvent(payload json.RawMessage) error {
+	attrs := map[string]json.RawMessage{}
+	err := json.Unmarshal(payload, &attrs)
+	if err != nil {
+		return fmt.Errorf("%w: not a JSON object", errInvalidCloudEvent)
+	}
+
+	str := func(name string, required bool) (string, error) {
+		v, found := attrs[name]
+		if !found || string(v) == "null" {
+			if required {
+				return "", fmt.Errorf("%w: %s is missing", errInvalidCloudEvent, name)
+			}
+			return "", nil
+		}
+		var s string
+		err := json.Unmarshal(v, &s)
+		if err != nil || s == "" {
+			return "", fmt.Errorf("%w: %s must be a non-empty string", errInvalidCloudEvent, name)
+		}
+		return s, nil
+	}
+
+	specVersion, err := str("specversion", true)
+	if err != nil {
+		return err
+	}
+	if specVersion != cloudEventsSpecVersion {
+		return fmt.Errorf("%w: unsupported specversion %q", errInvalidCloudEvent, specVersion)
+	}
+
+	_, err = str("id", true)
+	if err != nil {
+		return err
+	}
+
+	_, err = str("type", true)
+	if err != nil {
+		return err
+	}
+
+	source, err := str("source", true)
+	if err != nil {
+		return err
+	}
+	_, err = url.Parse(source)
+	if err != nil {
+		return fmt.Errorf("%w: source is not a URI reference", errInvalidCloudEvent)
+	}
+
+	contentType, err := str("datacontenttype", false)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		_, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return fmt.Errorf("%w: invalid datacontenttype: %s", errInvalidCloudEvent, err)
+		}
+	}
+
+	schema, err := str("dataschema", false)
+	if err != nil {
+		return err
+	}
+	if schema != "" {
+		u, err := url.Parse(schema)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("%w: dataschema must be an absolute URI", errInvalidCloudEvent)
+		}
+	}
+
+	_, err = str("subject", false)
+	if err != nil {
+		return err
+	}
+
+	t, err := str("time", false)
+	if err != nil {
+		return err
+	}
+	if t != "" {
+		_, err = time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return fmt.Errorf("%w: time must be an RFC 3339 timestamp", errInvalidCloudEvent)
+		}
+	}
+
+	data64, hasData64 := attrs["data_base64"]
+	if hasData64 {
+		if _, hasData := attrs["data"]; hasData {
+			return fmt.Errorf("%w: data and data_base64 are exclusive", errInvalidCloudEvent)
+		}
+		var encoded string
+		err = json.Unmarshal(data64, &encoded)
+		if err == nil {
+			_, err = base64.StdEncoding.DecodeString(encoded)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: data_base64 must be a base64 string", errInvalidCloudEvent)
+		}
+	}
+
+	for name, v := range attrs {
+		switch {
+		case name == "data" || name == "data_base64" || name == "specversion" || name == "id" || name == "type" || name == "source" || optionalCloudEventAttributes[name]:
+			continue
+		case name == bufferIDAttribute:
+			return fmt.Errorf("%w: the %s attribute is set by the buffer", errInvalidCloudEvent, bufferIDAttribute)
+		case !validAttributeName(name):
+			return fmt.Errorf("%w: attribute name %q must consist of lower-case letters and digits", errInvalidCloudEvent, name)
+		}
+
+		switch v[0] {
+		case '{', '[':
+			return fmt.Errorf("%w: extension attribute %s must be a string, number or boolean", errInvalidCloudEvent, name)
+		}
+	}
+
+	return nil
+}
+
+func validAttributeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// readCloudEventsRequest reads the events of a publish to a buffer storing
+// CloudEvents. Events in the binary content mode are converted to the
+// structured format.
+func readCloudEventsRequest(r *http.Request, body io.Reader) (*publishRequest, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("content-type"))
+
+	switch {
+	case r.Header.Get("ce-specversion") != "":
+		pr := publishRequests.Get().(*publishRequest)
+		pr.body.Reset()
+		pr.events = pr.events[:0]
+
+		_, err := pr.body.ReadFrom(body)
+		if err != nil {
+			pr.release()
+			return nil, err
+		}
+
+		e, err := structuredCloudEvent(r.Header, pr.body.Bytes())
+		if err != nil {
+			pr.release()
+			return nil, err
+		}
+		pr.events = append(pr.events, e)
+		return pr, nil
+
+	case mediaType == cloudEventContentType:
+		pr := publishRequests.Get().(*publishRequest)
+		pr.body.Reset()
+		pr.events = pr.events[:0]
+
+		_, err := pr.body.ReadFrom(body)
+		if err != nil {
+			pr.release()
+			return nil, err
+		}
+
+		e := bytes.TrimSpace(pr.body.Bytes())
+		if !json.Valid(e) {
+			pr.release()
+			return nil, fmt.Errorf("%w: not valid JSON", errInvalidCloudEvent)
+		}
+		pr.events = append(pr.events, e)
+		return pr, nil
+	}
+
+	return readPublishRequest(body)
+}
+
+// structuredCloudEvent converts an event in the binary content mode to the
+// structured format. JSON data stays JSON, other data is base64 encoded.
+func structuredCloudEvent(h http.Header, data []byte) (json.RawMessage, error) {
+	attrs := map[string]any{}
+	for name, values := range h {
+		lower := strings.ToLower(name)
+		if !strings.HasPrefix(lower, "ce-") || len(values) == 0 {
+			continue
+		}
+		v, err := url.PathUnescape(values[0])
+		if err != nil {
+			v = values[0]
+		}
+		attrs[strings.TrimPrefix(lower, "ce-")] = v
+	}
+
+	contentType := h.Get("content-type")
+	if contentType != "" {
+		attrs["datacontenttype"] = contentType
+	}
+
+	if len(data) > 0 {
+		if isJSONContentType(contentType) && json.Valid(data) {
+			attrs["data"] = json.RawMessage(data)
+		} else {
+			attrs["data_base64"] = base64.StdEncoding.EncodeToString(data)
+		}
+	}
+
+	return json.Marshal(attrs)
+}
+
+// isJSONContentType returns true for the content types of JSON data,
+// events without a content type have JSON data as well.
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// withBufferID returns a CloudEvent with the id of the event in the buffer
+// as extension attribute.
+func withBufferID(e event) (json.RawMessage, error) {
+	payload := bytes.TrimSpace(e.payload)
+	if len(payload) < 2 || payload[0] != '{' {
+		return nil, fmt.Errorf("%w: event %s is not a JSON object", errInvalidCloudEvent, e.id)
+	}
+
+	buf := &bytes.Buffer{}
+	// ids are UUIDs, they need no escaping
+	buf.WriteString(`{"` + bufferIDAttribute + `":"` + e.id + `"`)
+	rest := bytes.TrimSpace(payload[1:])
+	if rest[0] != '}' {
+		buf.WriteByte(',')
+	}
+	buf.Write(rest)
+	return buf.Bytes(), nil
+}
+
+// writeCloudEvents writes events as a batch of structured CloudEvents.
+func writeCloudEvents(w io.Writer, events []event) error {
+	withIDs := make([]event, len(events))
+	for i, e := range events {
+		payload, err := withBufferID(e)
+		if err != nil {
+			return err
+		}
+		withIDs[i] = event{id: e.id, payload: payload}
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('[')
+	for i, e := range withIDs {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		err := json.Compact(buf, e.payload)
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteString("]\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeBinaryCloudEvent writes an event in the binary content mode, the
+// attributes as ce- headers and the data as body.
+func writeBinaryCloudEvent(w http.ResponseWriter, e event) error {
+	attrs := map[string]json.RawMessage{}
+	err := json.Unmarshal(e.payload, &attrs)
+	if err != nil {
+		return fmt.Errorf("could not parse event %s: %w", e.id, err)
+	}
+
+	var body []byte
+	contentType := ""
+	names := []string{}
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		v := attrs[name]
+		switch name {
+		case "data":
+			body = v
+			continue
+		case "data_base64":
+			var encoded string
+			err = json.Unmarshal(v, &encoded)
+			if err != nil {
+				return fmt.Errorf("could not parse data_base64 of event %s: %w", e.id, err)
+			}
+			body, err = base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return fmt.Errorf("could not decode data_base64 of event %s: %w", e.id, err)
+			}
+			continue
+		case "datacontenttype":
+			err = json.Unmarshal(v, &contentType)
+			if err != nil {
+				return fmt.Errorf("could not parse datacontenttype of event %s: %w", e.id, err)
+			}
+			continue
+		}
+
+		if string(v) == "null" {
+			continue
+		}
+
+		value := string(v)
+		var s string
+		if json.Unmarshal(v, &s) == nil {
+			value = s
+		}
+		w.Header().Set("ce-"+name, encodeHeaderValue(value))
+	}
+	w.Header().Set("ce-"+bufferIDAttribute, e.id)
+
+	// JSON strings are the text of data that isn't JSON
+	if _, isData := attrs["data"]; isData && !isJSONContentType(contentType) {
+		var s string
+		if json.Unmarshal(body, &s) == nil {
+			body = []byte(s)
+		}
+	}
+
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	w.Header().Set("content-type", contentType)
+	w.Header().Set("content-length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body)
+	return err
+}
+
+// encodeHeaderValue percent-encodes the characters the HTTP binding
+// requires to be encoded in header values.
+func encodeHeaderValue(v string) string {
+	b := &strings.Builder{}
+	for _, c := range []byte(v) {
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '%' {
+			fmt.Fprintf(b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+	"github.com/gofrs/uuid"
+)
+
+func aBufferStoringCloudEvents(ctx context.Context) error {
+	return startBuffer(ctx, server.Options{CloudEvents: true})
+}
+
+func iPublishACloudEventOfTheType(ctx context.Context, typ string) error {
+	s := getState(ctx)
+	return s.client.SendEvents(ctx, []any{map[string]any{
+		"specversion": "1.0",
+		"id":          "order-1",
+		"source":      "/orders",
+		"type":        typ,
+		"data":        map[string]any{"total": 42},
+	}})
+}
+
+func iPublishAnEventWithoutASpecversion(ctx context.Context) error {
+	s := getState(ctx)
+	s.publishErr = s.client.SendEvents(ctx, []any{map[string]any{
+		"id":     "order-1",
+		"source": "/orders",
+		"type":   "order.created",
+	}})
+	return nil
+}
+
+func thePublishShouldBeRejectedAsInvalid(ctx context.Context) error {
+	se := &client.StatusError{}
+	if !errors.As(getState(ctx).publishErr, &se) || se.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("expected bad request error, got %v", getState(ctx).publishErr)
+	}
+	return nil
+}
+
+func iPublishABinaryCloudEventOfTheTypeWithTheText(ctx context.Context, typ, text string) error {
+	s := getState(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.serverBaseURL+"/events", bytes.NewReader([]byte(text)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "text/plain")
+	req.Header.Set("ce-specversion", "1.0")
+	req.Header.Set("ce-id", "payment-1")
+	req.Header.Set("ce-source", "/payments")
+	req.Header.Set("ce-type", typ)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		d, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected status %s: %s", res.Status, d)
+	}
+	return nil
+}
+
+func pollCloudEvents(ctx context.Context, envelope string) error {
+	s := getState(ctx)
+	res, err := http.Get(s.serverBaseURL + "/events?wait=0&envelope=" + envelope)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	s.rawStatus = res.StatusCode
+	s.rawHeader = res.Header
+	s.rawPoll, err = io.ReadAll(res.Body)
+	return err
+}
+
+func iPollForCloudEvents(ctx context.Context) error {
+	return pollCloudEvents(ctx, "cloudevents")
+}
+
+func iPollForACloudEventInTheBinaryContentMode(ctx context.Context) error {
+	return pollCloudEvents(ctx, "cloudevents-binary")
+}
+
+func polledCloudEvent(ctx context.Context) (map[string]any, error) {
+	s := getState(ctx)
+	if s.rawStatus != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d: %s", s.rawStatus, s.rawPoll)
+	}
+	if ct := s.rawHeader.Get("content-type"); ct != "application/cloudevents-batch+json" {
+		return nil, fmt.Errorf("unexpected content type %q", ct)
+	}
+
+	events := []map[string]any{}
+	err := json.Unmarshal(s.rawPoll, &events)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode events: %w", err)
+	}
+	if len(events) != 1 {
+		return nil, fmt.Errorf("expected one event, got %s", s.rawPoll)
+	}
+	return events[0], nil
+}
+
+func iShouldReceiveACloudEventOfTheTypeWithItsBufferId(ctx context.Context, typ string) error {
+	e, err := polledCloudEvent(ctx)
+	if err != nil {
+		return err
+	}
+	if e["type"] != typ {
+		return fmt.Errorf("expected type %s, got %v", typ, e["type"])
+	}
+	id, _ := e["eventbufferid"].(string)
+	if _, err := uuid.FromString(id); err != nil {
+		return fmt.Errorf("expected the buffer id of the event, got %v", e["eventbufferid"])
+	}
+	return nil
+}
+
+func theCloudEventShouldHaveTheBase64Data(ctx context.Context, data string) error {
+	e, err := polledCloudEvent(ctx)
+	if err != nil {
+		return err
+	}
+	if e["data_base64"] != data {
+		return fmt.Errorf("expected data_base64 %s, got %v", data, e["data_base64"])
+	}
+	if e["datacontenttype"] != "text/plain" {
+		return fmt.Errorf("expected datacontenttype text/plain, got %v", e["datacontenttype"])
+	}
+	return nil
+}
+
+func thePollShouldReturnTheTypeAsHeaderAndTheTextAsBody(ctx context.Context, typ, text string) error {
+	s := getState(ctx)
+	if s.rawStatus != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", s.rawStatus, s.rawPoll)
+	}
+	if s.rawHeader.Get("ce-type") != typ {
+		return fmt.Errorf("expected ce-type %s, got %q", typ, s.rawHeader.Get("ce-type"))
+	}
+	if s.rawHeader.Get("ce-specversion") != "1.0" {
+		return fmt.Errorf("expected ce-specversion 1.0, got %q", s.rawHeader.Get("ce-specversion"))
+	}
+	if _, err := uuid.FromString(s.rawHeader.Get("ce-eventbufferid")); err != nil {
+		return fmt.Errorf("expected the buffer id of the event, got %q", s.rawHeader.Get("ce-eventbufferid"))
+	}
+	if s.rawHeader.Get("content-type") != "text/plain" {
+		return fmt.Errorf("expected content type text/plain, got %q", s.rawHeader.Get("content-type"))
+	}
+	if string(s.rawPoll) != text {
+		return fmt.Errorf("expected body %q, got %q", text, s.rawPoll)
+	}
+	return nil
+}
+
+func thePollShouldReturnNoContent(ctx context.Context) error {
+	s := getState(ctx)
+	if s.rawStatus != http.StatusNoContent {
+		return fmt.Errorf("expected status 204, got %d: %s", s.rawStatus, s.rawPoll)
+	}
+	return nil
+}
+
+func thePollShouldBeRejectedAsInvalid(ctx context.Context) error {
+	s := getState(ctx)
+	if s.rawStatus != http.StatusBadRequest {
+		return fmt.Errorf("expected status 400, got %d: %s", s.rawStatus, s.rawPoll)
+	}
+	return nil
+}
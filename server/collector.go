@@ -1,19 +1,72 @@
 package server
 
 import (
+	"time"
+
 	"github.com/draganm/bolted"
 	"github.com/go-logr/logr"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-func newStatsCollector(db bolted.Database, log logr.Logger) prometheus.Collector {
-	return &statsCollector{db: db, log: log}
+// otherTopicsLabel is the topic label of metrics aggregating the topics
+// without their own labels, it's not a valid topic name.
+const otherTopicsLabel = "(other)"
+
+const defaultTopicMetricsLimit = 100
+
+// TopicMetrics limits the cardinality of the topic label of metrics. When
+// Topics is set, only the listed topics get their own label. Otherwise
+// every topic does as long as there are at most Limit topics, above it
+// all topics are aggregated. Aggregated topics are labeled "(other)".
+type TopicMetrics struct {
+	Topics []string
+	// Limit defaults to 100.
+	Limit int
+}
+
+// labels maps the names of the topics to their label.
+func (tm TopicMetrics) labels(topics []stream) map[string]string {
+	labels := map[string]string{}
+
+	if len(tm.Topics) > 0 {
+		allowed := map[string]bool{}
+		for _, t := range tm.Topics {
+			allowed[t] = true
+		}
+		for _, st := range topics {
+			labels[st.topic] = otherTopicsLabel
+			if allowed[st.topic] {
+				labels[st.topic] = st.topic
+			}
+		}
+		return labels
+	}
+
+	limit := tm.Limit
+	if limit <= 0 {
+		limit = defaultTopicMetricsLimit
+	}
+
+	for _, st := range topics {
+		labels[st.topic] = st.topic
+		if len(topics) > limit {
+			labels[st.topic] = otherTopicsLabel
+		}
+	}
+
+	return labels
+}
+
+func newStatsCollector(db bolted.Database, log logr.Logger, topicMetrics TopicMetrics, payloadLog *PayloadLog) prometheus.Collector {
+	return &statsCollector{db: db, log: log, topicMetrics: topicMetrics, payloadLog: payloadLog}
 
 }
 
 type statsCollector struct {
-	db  bolted.Database
-	log logr.Logger
+	db           bolted.Database
+	log          logr.Logger
+	topicMetrics TopicMetrics
+	payloadLog   *PayloadLog
 }
 
 func (sc *statsCollector) Describe(ch chan<- *prometheus.Desc) {
@@ -26,14 +79,94 @@ var (
 		"Number of events in the buffer.",
 		nil, nil,
 	)
+	topicSizeCount = prometheus.NewDesc(
+		"event_buffer_topic_size",
+		"Number of events in topics.",
+		[]string{"topic"}, nil,
+	)
+	topicAppendedCount = prometheus.NewDesc(
+		"event_buffer_topic_appended_total",
+		"Number of events appended to topics.",
+		[]string{"topic"}, nil,
+	)
+	topicPrunedCount = prometheus.NewDesc(
+		"event_buffer_topic_pruned_total",
+		"Number of events pruned from topics.",
+		[]string{"topic"}, nil,
+	)
+	appendedCount = prometheus.NewDesc(
+		"event_buffer_appended_total",
+		"Number of events appended to the buffer.",
+		nil, nil,
+	)
+	prunedCount = prometheus.NewDesc(
+		"event_buffer_pruned_total",
+		"Number of events pruned from the buffer.",
+		nil, nil,
+	)
+	stateSizeBytes = prometheus.NewDesc(
+		"event_buffer_state_size_bytes",
+		"Size of the state file in bytes.",
+		nil, nil,
+	)
+	storedSizeBytes = prometheus.NewDesc(
+		"event_buffer_stored_payload_bytes",
+		"Bytes of the payloads stored in the state and the payload log, the measure of the byte budget.",
+		nil, nil,
+	)
+	payloadLogSizeBytes = prometheus.NewDesc(
+		"event_buffer_payload_log_size_bytes",
+		"Size of the segments of the payload log in bytes.",
+		nil, nil,
+	)
+	oldestEventAge = prometheus.NewDesc(
+		"event_buffer_oldest_event_age_seconds",
+		"Age of the oldest event in the buffer, 0 when it is empty.",
+		nil, nil,
+	)
 )
 
+type topicCounts struct {
+	size, appended, pruned float64
+}
+
 func (sc *statsCollector) Collect(ch chan<- prometheus.Metric) {
 
-	var messagesCount float64
+	var messagesCount, appended, pruned, stateSize, storedSize, oldestAge float64
+	topics := map[string]*topicCounts{}
 
 	err := bolted.SugaredRead(sc.db, func(tx bolted.SugaredReadTx) error {
 		messagesCount = float64(tx.Size(eventsPath))
+		appended = float64(getCounter(tx, appendedPath))
+		pruned = float64(getCounter(tx, prunedPath))
+		stateSize = float64(tx.FileSize())
+		storedSize = float64(getCounter(tx, storedBytesPath))
+
+		it := tx.Iterator(eventsPath)
+		if !it.IsDone() {
+			t, err := eventTime(it.GetKey())
+			if err != nil {
+				return err
+			}
+			oldestAge = time.Since(t).Seconds()
+		}
+
+		streams, err := readTopics(tx)
+		if err != nil {
+			return err
+		}
+
+		labels := sc.topicMetrics.labels(streams)
+		for _, st := range streams {
+			c := topics[labels[st.topic]]
+			if c == nil {
+				c = &topicCounts{}
+				topics[labels[st.topic]] = c
+			}
+			c.size += float64(tx.Size(st.events))
+			c.appended += float64(getCounter(tx, st.appended))
+			c.pruned += float64(getCounter(tx, st.pruned))
+		}
 		return nil
 	})
 
@@ -47,4 +180,24 @@ func (sc *statsCollector) Collect(ch chan<- prometheus.Metric) {
 		messagesCount,
 	)
 
+	ch <- prometheus.MustNewConstMetric(appendedCount, prometheus.CounterValue, appended)
+	ch <- prometheus.MustNewConstMetric(prunedCount, prometheus.CounterValue, pruned)
+	ch <- prometheus.MustNewConstMetric(stateSizeBytes, prometheus.GaugeValue, stateSize)
+	ch <- prometheus.MustNewConstMetric(storedSizeBytes, prometheus.GaugeValue, storedSize)
+	ch <- prometheus.MustNewConstMetric(oldestEventAge, prometheus.GaugeValue, oldestAge)
+
+	if sc.payloadLog != nil {
+		size, err := sc.payloadLog.Size()
+		if err != nil {
+			sc.log.Error(err, "could not collect payload log size")
+		}
+		ch <- prometheus.MustNewConstMetric(payloadLogSizeBytes, prometheus.GaugeValue, float64(size))
+	}
+
+	for label, c := range topics {
+		ch <- prometheus.MustNewConstMetric(topicSizeCount, prometheus.GaugeValue, c.size, label)
+		ch <- prometheus.MustNewConstMetric(topicAppendedCount, prometheus.CounterValue, c.appended, label)
+		ch <- prometheus.MustNewConstMetric(topicPrunedCount, prometheus.CounterValue, c.pruned, label)
+	}
+
 }
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// minCompressedSize is the size below which responses are sent
+// uncompressed, compressing them saves less than the encoding costs.
+// Streams are compressed regardless, their first write is no hint of
+// their size.
+const minCompressedSize = 1024
+
+var (
+	gzipWriters = sync.Pool{
+		New: func() any {
+			return gzip.NewWriter(nil)
+		},
+	}
+	zstdWriters = sync.Pool{
+		New: func() any {
+			// errors are only returned for invalid options
+			zw, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+			return zw
+		},
+	}
+)
+
+// responseEncoding returns the encoding of the Accept-Encoding header a
+// response is compressed with, zstd is preferred over gzip unless the
+// client prefers gzip. It returns "" when the response is sent as is.
+func responseEncoding(r *http.Request) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(r.Header.Get("accept-encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		q := 1.0
+		params = strings.TrimSpace(params)
+		if strings.HasPrefix(params, "q=") {
+			v, err := strconv.ParseFloat(params[2:], 64)
+			if err != nil {
+				continue
+			}
+			q = v
+		}
+
+		if name == "*" {
+			name = "gzip"
+		}
+		if q <= 0 || (name != "gzip" && name != "zstd") {
+			continue
+		}
+		if q > bestQ || (q == bestQ && name == "zstd") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressResponses compresses the responses of next with gzip or zstd
+// when the client accepts them. Flushes of streams flush the encoder, so
+// clients can decode every event as it is sent.
+func compressResponses(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("vary", "Accept-Encoding")
+
+		encoding := responseEncoding(r)
+		if encoding == "" {
+			next(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next(cw, r)
+	}
+}
+
+// compressWriter decides whether to compress a response on its first
+// write, when the status, headers and size of the first chunk are known.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	decided  bool
+	enc      interface {
+		io.Writer
+		Flush() error
+	}
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.decided {
+		return
+	}
+	cw.status = code
+}
+
+// decide sends the headers, compressing the body unless it is smaller
+// than minCompressedSize. size is -1 for streams.
+func (cw *compressWriter) decide(size int) {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	h := cw.Header()
+	compress := h.Get("content-encoding") == "" &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified &&
+		(size < 0 || size >= minCompressedSize)
+
+	if compress {
+		h.Set("content-encoding", cw.encoding)
+		h.Del("content-length")
+		switch cw.encoding {
+		case "gzip":
+			gw := gzipWriters.Get().(*gzip.Writer)
+			gw.Reset(cw.ResponseWriter)
+			cw.enc = gw
+		case "zstd":
+			zw := zstdWriters.Get().(*zstd.Encoder)
+			zw.Reset(cw.ResponseWriter)
+			cw.enc = zw
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		cw.decide(len(p))
+	}
+	if cw.enc == nil {
+		return cw.ResponseWriter.Write(p)
+	}
+	return cw.enc.Write(p)
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(-1)
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close ends the compressed stream and returns the encoder to its pool.
+// Handlers that didn't write still send their status.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		cw.decided = true
+		if cw.status != 0 {
+			cw.ResponseWriter.WriteHeader(cw.status)
+		}
+		return
+	}
+
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		enc.Close()
+		enc.Reset(nil)
+		gzipWriters.Put(enc)
+	case *zstd.Encoder:
+		enc.Close()
+		enc.Reset(nil)
+		zstdWriters.Put(enc)
+	}
+	cw.enc = nil
+}
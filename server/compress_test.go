@@ -0,0 +1,128 @@
+package server_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// rawClient doesn't ask for or decode compressed responses itself, so
+// steps see the encoding the server chose.
+var rawClient = &http.Client{
+	Transport: &http.Transport{DisableCompression: true},
+}
+
+func decompress(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		return zstd.NewReader(r)
+	case "":
+		return r, nil
+	}
+	return nil, fmt.Errorf("unexpected content encoding %q", encoding)
+}
+
+func iPollForTheEventsAccepting(ctx context.Context, n int, encoding string) error {
+	s := getState(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/events?wait=0&limit=%d", s.serverBaseURL, n), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("accept-encoding", encoding)
+
+	res, err := rawClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	s.rawStatus = res.StatusCode
+	s.rawHeader = res.Header
+	s.rawPoll, err = io.ReadAll(res.Body)
+	return err
+}
+
+func polledEventsEncodedWith(ctx context.Context, encoding string, n int) error {
+	s := getState(ctx)
+	if s.rawStatus != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", s.rawStatus, s.rawPoll)
+	}
+	if ce := s.rawHeader.Get("content-encoding"); ce != encoding {
+		return fmt.Errorf("expected content encoding %q, got %q", encoding, ce)
+	}
+
+	r, err := decompress(encoding, strings.NewReader(string(s.rawPoll)))
+	if err != nil {
+		return fmt.Errorf("could not decompress poll: %w", err)
+	}
+
+	evts := []json.RawMessage{}
+	err = json.NewDecoder(r).Decode(&evts)
+	if err != nil {
+		return fmt.Errorf("could not decode events: %w", err)
+	}
+	if len(evts) != n {
+		return fmt.Errorf("expected %d events, got %d", n, len(evts))
+	}
+	return nil
+}
+
+func thePollShouldBeCompressedWithAndReturnEvents(ctx context.Context, encoding string, n int) error {
+	return polledEventsEncodedWith(ctx, encoding, n)
+}
+
+func thePollShouldReturnTheTwoEventsUncompressed(ctx context.Context) error {
+	return polledEventsEncodedWith(ctx, "", 2)
+}
+
+func iStartStreamingTheEventsAcceptingGzip(ctx context.Context) error {
+	s := getState(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.serverBaseURL+"/events/stream", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("accept-encoding", "gzip")
+
+	res, err := rawClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if ce := res.Header.Get("content-encoding"); ce != "gzip" {
+		res.Body.Close()
+		return fmt.Errorf("expected gzip content encoding, got %q", ce)
+	}
+
+	s.streamed = make(chan string, 10)
+	go func() {
+		defer res.Body.Close()
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return
+		}
+		sc := bufio.NewScanner(zr)
+		for sc.Scan() {
+			line := sc.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var evt string
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &evt) == nil {
+				s.streamed <- evt
+			}
+		}
+	}()
+	return nil
+}
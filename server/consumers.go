@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/gorilla/mux"
+)
+
+var consumersPath = dbpath.ToPath("consumers")
+
+// consumer is a registered consumer, Position is the id of the last event
+// it has processed. LastSeen is the time of its last cursor update or
+// heartbeat.
+type consumer struct {
+	Position string    `json:"position"`
+	Updated  time.Time `json:"updated"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// lastSeen falls back to the cursor update of consumers registered before
+// heartbeats were tracked.
+func (c consumer) lastSeen() time.Time {
+	if c.LastSeen.IsZero() {
+		return c.Updated
+	}
+	return c.LastSeen
+}
+
+func (s *Server) listConsumers(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+
+	consumers := map[string]consumer{}
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		for it := tx.Iterator(consumersPath); !it.IsDone(); it.Next() {
+			c := consumer{}
+			err := json.Unmarshal(it.GetValue(), &c)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal consumer %s: %w", it.GetKey(), err)
+			}
+			consumers[it.GetKey()] = c
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Error(err, "could not read consumers")
+		http.Error(w, fmt.Errorf("could not read consumers: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(consumers)
+}
+
+func (s *Server) updateConsumerCursor(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+	name := mux.Vars(r)["name"]
+
+	c := consumer{}
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		log.Error(err, "could not decode request")
+		http.Error(w, fmt.Errorf("could not decode request: %w", err).Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = eventTime(c.Position)
+	if err != nil {
+		http.Error(w, fmt.Errorf("invalid position: %w", err).Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.storeCursor(name, c.Position)
+	if err != nil {
+		log.Error(err, "could not store consumer")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// storeCursor sets the position of a consumer, registering it if needed.
+func (s *Server) storeCursor(name, position string) error {
+	c := consumer{Position: position, Updated: time.Now().UTC()}
+	c.LastSeen = c.Updated
+
+	d, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("could not marshal consumer: %w", err)
+	}
+
+	err = bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		tx.Put(consumersPath.Append(name), d)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not store consumer: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Server) deleteConsumer(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+	name := mux.Vars(r)["name"]
+
+	found := false
+	err := bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		path := consumersPath.Append(name)
+		found = tx.Exists(path)
+		if found {
+			tx.Delete(path)
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Error(err, "could not delete consumer")
+		http.Error(w, fmt.Errorf("could not delete consumer: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		http.Error(w, fmt.Sprintf("consumer %s not found", name), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// slowestConsumerPosition returns the smallest position of all registered
+// consumers, or false if there are none.
+func slowestConsumerPosition(tx bolted.SugaredReadTx) (string, bool, error) {
+	slowest := ""
+	found := false
+	for it := tx.Iterator(consumersPath); !it.IsDone(); it.Next() {
+		c := consumer{}
+		err := json.Unmarshal(it.GetValue(), &c)
+		if err != nil {
+			return "", false, fmt.Errorf("could not unmarshal consumer %s: %w", it.GetKey(), err)
+		}
+		if !found || c.Position < slowest {
+			slowest = c.Position
+			found = true
+		}
+	}
+	return slowest, found, nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	txWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "event_buffer_tx_wait_seconds",
+		Help:    "Time transactions waited to begin by kind, read or write. Writes wait for the write lock, reads for the database to grow its memory map.",
+		Buckets: []float64{.0001, .001, .005, .01, .05, .1, .5, 1, 5, 10},
+	}, []string{"kind"})
+	txDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "event_buffer_tx_duration_seconds",
+		Help:    "Time transactions were open by kind, read or write.",
+		Buckets: []float64{.0001, .001, .005, .01, .05, .1, .5, 1, 5, 10},
+	}, []string{"kind"})
+	readSlotWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "event_buffer_read_slot_wait_seconds",
+		Help:    "Time reads waited for a read slot.",
+		Buckets: []float64{.0001, .001, .005, .01, .05, .1, .5, 1, 5, 10},
+	})
+)
+
+// contentionDB observes how long transactions wait to begin and how long
+// they are open, a long write delays the others and a growing database
+// delays the reads.
+type contentionDB struct {
+	bolted.Database
+}
+
+func (d contentionDB) BeginRead() (bolted.ReadTx, error) {
+	started := time.Now()
+	tx, err := d.Database.BeginRead()
+	if err != nil {
+		return nil, err
+	}
+	begun := time.Now()
+	txWait.WithLabelValues("read").Observe(begun.Sub(started).Seconds())
+	return &contentionReadTx{ReadTx: tx, begun: begun}, nil
+}
+
+func (d contentionDB) BeginWrite() (bolted.WriteTx, error) {
+	started := time.Now()
+	tx, err := d.Database.BeginWrite()
+	if err != nil {
+		return nil, err
+	}
+	begun := time.Now()
+	txWait.WithLabelValues("write").Observe(begun.Sub(started).Seconds())
+	return &contentionWriteTx{WriteTx: tx, begun: begun}, nil
+}
+
+type contentionReadTx struct {
+	bolted.ReadTx
+	begun time.Time
+	once  sync.Once
+}
+
+func (tx *contentionReadTx) Finish() error {
+	tx.once.Do(func() {
+		txDuration.WithLabelValues("read").Observe(time.Since(tx.begun).Seconds())
+	})
+	return tx.ReadTx.Finish()
+}
+
+type contentionWriteTx struct {
+	bolted.WriteTx
+	begun time.Time
+	once  sync.Once
+}
+
+func (tx *contentionWriteTx) Finish() error {
+	// the commit is part of the time the write lock is held
+	defer tx.once.Do(func() {
+		txDuration.WithLabelValues("write").Observe(time.Since(tx.begun).Seconds())
+	})
+	return tx.WriteTx.Finish()
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultMaxDecompressedSize limits compressed publish requests when
+// Options.MaxDecompressedSize is not set.
+const defaultMaxDecompressedSize = 64 << 20
+
+var (
+	errDecompressedTooLarge = errors.New("decompressed request is too large")
+	errUnsupportedEncoding  = errors.New("unsupported content encoding")
+)
+
+// limitedReader fails with errDecompressedTooLarge instead of silently
+// truncating like io.LimitedReader.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if l.n <= 0 {
+		// tell a body that ends exactly at the limit from a larger one
+		n, err := l.r.Read(p[:1])
+		if n > 0 {
+			return 0, errDecompressedTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func (s *Server) maxDecompressedSize() int64 {
+	if s.opts.MaxDecompressedSize > 0 {
+		return s.opts.MaxDecompressedSize
+	}
+	return defaultMaxDecompressedSize
+}
+
+// requestBody returns the body of a publish request, decompressing it
+// according to its Content-Encoding.
+func (s *Server) requestBody(r *http.Request) (io.ReadCloser, error) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("content-encoding")))
+	switch encoding {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("could not read gzip header: %w", err)
+		}
+		return readCloser{&limitedReader{r: zr, n: s.maxDecompressedSize()}, zr.Close}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(r.Body, zstd.WithDecoderMaxMemory(uint64(s.maxDecompressedSize())))
+		if err != nil {
+			return nil, fmt.Errorf("could not create zstd reader: %w", err)
+		}
+		return readCloser{&limitedReader{r: zr, n: s.maxDecompressedSize()}, func() error {
+			zr.Close()
+			return nil
+		}}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, encoding)
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc readCloser) Close() error {
+	return rc.close()
+}
+
+// decodeErrorStatus returns the status of a failure to read or decode a
+// publish request.
+func decodeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errDecompressedTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUnsupportedEncoding):
+		return http.StatusUnsupportedMediaType
+	default:
+		return http.StatusBadRequest
+	}
+}
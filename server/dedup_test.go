@@ -0,0 +1,108 @@
+package server_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/server"
+)
+
+func thePayloadIsPublishedTwice(ctx context.Context, payload string) error {
+	s := getState(ctx)
+	for i := 0; i < 2; i++ {
+		b, err := s.client.PublishBatch(ctx, []any{json.RawMessage(payload)})
+		if err != nil {
+			return err
+		}
+		s.batches = append(s.batches, b)
+		// the events are stored at distinct times so they can be pruned
+		// one by one
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func theFirstOfTheEventsIsPruned(ctx context.Context) error {
+	s := getState(ctx)
+	if len(s.batches) != 2 {
+		return fmt.Errorf("expected two published events, got %d", len(s.batches))
+	}
+
+	res, err := http.Get(s.serverBaseURL + "/events/" + s.batches[1].FirstID)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	detail := struct {
+		Time time.Time `json:"time"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&detail)
+	if err != nil {
+		return fmt.Errorf("could not decode event: %w", err)
+	}
+
+	ps, err := s.server.PruneReport(detail.Time)
+	if err != nil {
+		return err
+	}
+	if ps.Events != 1 {
+		return fmt.Errorf("expected 1 pruned event, got %+v", ps)
+	}
+	return nil
+}
+
+// readState reads the state file of the stopped buffer with fn and starts
+// the buffer again.
+func readState(ctx context.Context, fn func(tx bolted.SugaredReadTx) error) error {
+	s := getState(ctx)
+	s.stopServer()
+
+	db, err := embedded.Open(s.stateFile, 0700, embedded.Options{})
+	if err != nil {
+		return err
+	}
+
+	err = bolted.SugaredRead(db, fn)
+	closeErr := db.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return startBuffer(ctx, server.Options{DedupMinSize: s.dedupMinSize})
+}
+
+func theStateShouldHoldBlobsWithReferences(ctx context.Context, blobs, refs int) error {
+	storedBlobs, storedRefs := 0, uint64(0)
+	err := readState(ctx, func(tx bolted.SugaredReadTx) error {
+		for it := tx.Iterator(dbpath.ToPath("blobs")); !it.IsDone(); it.Next() {
+			storedBlobs++
+		}
+		for it := tx.Iterator(dbpath.ToPath("blob-refs")); !it.IsDone(); it.Next() {
+			storedRefs += binary.BigEndian.Uint64(it.GetValue())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if storedBlobs != blobs || storedRefs != uint64(refs) {
+		return fmt.Errorf("expected %d blobs with %d references, got %d with %d", blobs, refs, storedBlobs, storedRefs)
+	}
+	return nil
+}
+
+func theStateShouldHoldNoBlobs(ctx context.Context) error {
+	return theStateShouldHoldBlobsWithReferences(ctx, 0, 0)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/draganm/event-buffer/auth"
+)
+
+// RedactionRule strips or masks fields of payloads delivered to matching
+// consumers. A rule matches a poll request when the authenticated
+// principal, one of its roles or the consumer named in the `consumer`
+// query parameter is listed, a rule listing none of them matches every
+// request. Principals and roles listed in ExceptPrincipals and ExceptRoles
+// are exempted.
+//
+// The consumer parameter is chosen by the caller, who can leave it out to
+// get unredacted payloads, so Consumers alone is no security boundary.
+// Fields consumers must not see are redacted with a rule for everyone
+// that exempts the principals or roles allowed to see them.
+type RedactionRule struct {
+	Principals       []string `yaml:"principals" json:"principals,omitempty"`
+	Roles            []string `yaml:"roles" json:"roles,omitempty"`
+	Consumers        []string `yaml:"consumers" json:"consumers,omitempty"`
+	ExceptPrincipals []string `yaml:"except-principals" json:"except_principals,omitempty"`
+	ExceptRoles      []string `yaml:"except-roles" json:"except_roles,omitempty"`
+	// Strip and Mask are JSON pointers of fields to remove or overwrite.
+	Strip []string `yaml:"strip" json:"strip,omitempty"`
+	Mask  []string `yaml:"mask" json:"mask,omitempty"`
+}
+
+const maskedValue = "***"
+
+type compiledRedactionRule struct {
+	RedactionRule
+	strip []jsonPointer
+	mask  []jsonPointer
+}
+
+// ValidateRules returns the error New would return for the redaction rules
+// and delivery rate limits, so configuration files can be checked before
+// a server is started.
+func ValidateRules(redactions []RedactionRule, limits []DeliveryRateLimit) error {
+	_, err := compileRedactionRules(redactions)
+	if err != nil {
+		return err
+	}
+	_, err = newDeliveryLimiter(limits)
+	return err
+}
+
+func compileRedactionRules(rules []RedactionRule) ([]compiledRedactionRule, error) {
+	compiled := make([]compiledRedactionRule, len(rules))
+	for i, r := range rules {
+		compiled[i].RedactionRule = r
+		for _, p := range r.Strip {
+			jp, err := parseJSONPointer(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid strip field of redaction rule %d: %w", i, err)
+			}
+			compiled[i].strip = append(compiled[i].strip, jp)
+		}
+		for _, p := range r.Mask {
+			jp, err := parseJSONPointer(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mask field of redaction rule %d: %w", i, err)
+			}
+			compiled[i].mask = append(compiled[i].mask, jp)
+		}
+	}
+	return compiled, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, e := range values {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (r compiledRedactionRule) matches(p *auth.Principal, consumer string) bool {
+	if r.exempts(p) {
+		return false
+	}
+
+	if len(r.Principals) == 0 && len(r.Roles) == 0 && len(r.Consumers) == 0 {
+		return true
+	}
+
+	if consumer != "" && contains(r.Consumers, consumer) {
+		return true
+	}
+
+	if p == nil {
+		return false
+	}
+
+	if contains(r.Principals, p.Name) {
+		return true
+	}
+
+	for _, role := range r.Roles {
+		if p.HasRole(role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exempts returns true if the principal is exempted from the rule, only
+// authenticated requests can be.
+func (r compiledRedactionRule) exempts(p *auth.Principal) bool {
+	if p == nil {
+		return false
+	}
+
+	if contains(r.ExceptPrincipals, p.Name) {
+		return true
+	}
+
+	for _, role := range r.ExceptRoles {
+		if p.HasRole(role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deliveryRuleIndexes returns the indexes of the rules that apply to a
+// poll request.
+func (s *Server) deliveryRuleIndexes(r *http.Request) []int {
+	if len(s.redactionRules) == 0 {
+		return nil
+	}
+
+	p, _ := auth.FromContext(r.Context())
+	consumer := r.URL.Query().Get("consumer")
+
+	matching := []int{}
+	for i, rule := range s.redactionRules {
+		if rule.matches(p, consumer) {
+			matching = append(matching, i)
+		}
+	}
+	return matching
+}
+
+// deliveryRedactions returns the rules that apply to a poll request.
+func (s *Server) deliveryRedactions(r *http.Request) []compiledRedactionRule {
+	matching := []compiledRedactionRule{}
+	for _, i := range s.deliveryRuleIndexes(r) {
+		matching = append(matching, s.redactionRules[i])
+	}
+	return matching
+}
+
+func redactPayload(payload json.RawMessage, rules []compiledRedactionRule) (json.RawMessage, error) {
+	var doc any
+	err := json.Unmarshal(payload, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse payload: %w", err)
+	}
+
+	if !redactDoc(doc, rules) {
+		return payload, nil
+	}
+
+	return json.Marshal(doc)
+}
+
+// redactDoc redacts a payload decoded into any in place and returns
+// whether it changed.
+func redactDoc(doc any, rules []compiledRedactionRule) bool {
+	changed := false
+	for _, r := range rules {
+		for _, jp := range r.strip {
+			changed = jp.remove(doc) || changed
+		}
+		for _, jp := range r.mask {
+			changed = jp.set(doc, maskedValue) || changed
+		}
+	}
+	return changed
+}
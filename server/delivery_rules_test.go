@@ -0,0 +1,43 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferAcceptingTheTokensAndStrippingExceptFor(ctx context.Context, first, second, pointer, principal string) error {
+	return startAuthenticatedBuffer(ctx, server.Options{
+		RedactionRules: []server.RedactionRule{{ExceptPrincipals: []string{principal}, Strip: []string{pointer}}},
+	}, first, second)
+}
+
+func pollingWithTheTokenShouldReturnPayloads(ctx context.Context, token, with, pointer string) error {
+	s := getState(ctx)
+	cl, err := client.New(s.serverBaseURL, client.WithToken(token))
+	if err != nil {
+		return err
+	}
+
+	evts := []map[string]json.RawMessage{}
+	_, err = cl.PollForEvents(ctx, "", 10, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+	if len(evts) == 0 {
+		return fmt.Errorf("expected events, got none")
+	}
+
+	field := strings.TrimPrefix(pointer, "/")
+	for _, e := range evts {
+		_, found := e[field]
+		if found != (with == "with") {
+			return fmt.Errorf("expected payloads %s %s, got %v", with, pointer, e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/event-buffer/snapshot"
+)
+
+// DumpFilter selects the events of a selective dump.
+type DumpFilter struct {
+	// Topic is the topic of the events, the default stream when empty.
+	Topic string
+	// From and To limit the dump to events stored at or after From and
+	// before To, when they are set.
+	From time.Time
+	To   time.Time
+}
+
+// WriteDump writes a snapshot of the events selected by f. Restored, it is
+// a state with only these events, their shared payloads and trace
+// parents, and the configuration of their topic. Consumers, audits and
+// the events of other streams are left out. Payloads in the payload log
+// or offloaded to the object store are stored inline, so the dump doesn't
+// depend on either, encrypted payloads stay encrypted with their keys.
+func (s *Server) WriteDump(ctx context.Context, w io.Writer, f DumpFilter) error {
+	return bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		st := defaultStream
+		if f.Topic != "" {
+			var err error
+			st, err = readTopic(tx, f.Topic)
+			if err != nil {
+				return err
+			}
+		}
+
+		sw, err := snapshot.NewWriter(w)
+		if err != nil {
+			return err
+		}
+
+		maps := []dbpath.Path{st.events}
+		if st.topic != "" {
+			maps = []dbpath.Path{topicsPath, topicsPath.Append(st.topic), st.events}
+		} else {
+			maps = append(maps, metaPath)
+		}
+		for _, p := range maps {
+			err = sw.Add(snapshot.Entry{Path: p, Map: true})
+			if err != nil {
+				return err
+			}
+		}
+		if st.topic != "" {
+			err = sw.Add(snapshot.Entry{Path: topicConfigPath(st.topic), Value: tx.Get(topicConfigPath(st.topic))})
+			if err != nil {
+				return err
+			}
+		}
+
+		to := ""
+		if !f.To.IsZero() {
+			to = s.timeCursor(f.To)
+		}
+
+		blobRefs := map[string]uint64{}
+		blobs := []string{}
+		traced := []string{}
+		dumped := 0
+
+		it := tx.Iterator(st.events)
+		if !f.From.IsZero() {
+			it.Seek(s.timeCursor(f.From))
+		}
+		for ; !it.IsDone(); it.Next() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			id := it.GetKey()
+			if to != "" && id >= to {
+				break
+			}
+
+			value := it.GetValue()
+			r, isRecord, err := decodeRecord(value)
+			if err != nil {
+				return fmt.Errorf("could not read event %s: %w", id, err)
+			}
+
+			switch {
+			case isRecord && r.Blob != "":
+				if blobRefs[r.Blob] == 0 {
+					blobs = append(blobs, r.Blob)
+				}
+				blobRefs[r.Blob]++
+			case isRecord:
+				payload, err := s.loadPayload(ctx, tx, value)
+				if err != nil {
+					return fmt.Errorf("could not load payload of event %s: %w", id, err)
+				}
+				value, err = s.encodePayload(payload)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = sw.Add(snapshot.Entry{Path: st.events.Append(id), Value: value})
+			if err != nil {
+				return err
+			}
+			dumped++
+
+			if tx.Exists(traceParentsPath.Append(id)) {
+				traced = append(traced, id)
+			}
+		}
+
+		// the dump starts counting at its own events
+		err = sw.Add(snapshot.Entry{Path: st.appended, Value: binary.BigEndian.AppendUint64(nil, uint64(dumped))})
+		if err != nil {
+			return err
+		}
+		err = sw.Add(snapshot.Entry{Path: st.pruned, Value: binary.BigEndian.AppendUint64(nil, 0)})
+		if err != nil {
+			return err
+		}
+
+		entries := []snapshot.Entry{{Path: blobsPath, Map: true}}
+		for _, hash := range blobs {
+			entries = append(entries, snapshot.Entry{Path: blobsPath.Append(hash), Value: tx.Get(blobsPath.Append(hash))})
+		}
+		entries = append(entries, snapshot.Entry{Path: blobRefsPath, Map: true})
+		for _, hash := range blobs {
+			entries = append(entries, snapshot.Entry{Path: blobRefsPath.Append(hash), Value: binary.BigEndian.AppendUint64(nil, blobRefs[hash])})
+		}
+		entries = append(entries, snapshot.Entry{Path: traceParentsPath, Map: true})
+		for _, id := range traced {
+			entries = append(entries, snapshot.Entry{Path: traceParentsPath.Append(id), Value: tx.Get(traceParentsPath.Append(id))})
+		}
+		for _, e := range entries {
+			err = sw.Add(e)
+			if err != nil {
+				return err
+			}
+		}
+
+		return sw.Finish()
+	})
+}
@@ -0,0 +1,133 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/snapshot"
+	"github.com/gofrs/uuid"
+)
+
+func dumpEvents(ctx context.Context, f server.DumpFilter) error {
+	s := getState(ctx)
+	buf := &bytes.Buffer{}
+	err := s.server.WriteDump(ctx, buf, f)
+	if err != nil {
+		return fmt.Errorf("could not dump events: %w", err)
+	}
+	s.dump = buf.Bytes()
+	return nil
+}
+
+func theBufferIsDumped(ctx context.Context) error {
+	return dumpEvents(ctx, server.DumpFilter{})
+}
+
+func theTopicIsDumped(ctx context.Context, topic string) error {
+	return dumpEvents(ctx, server.DumpFilter{Topic: topic})
+}
+
+func theEventsFromTheTimeOfTheEventNumberedToTheTimeOfTheEventNumberedAreDumped(ctx context.Context, from, to int) error {
+	s := getState(ctx)
+	evts := []orderEvent{}
+	ids, err := s.client.PollForEvents(ctx, "", 10, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+
+	f := server.DumpFilter{}
+	for i, e := range evts {
+		if e.Seq != from && e.Seq != to {
+			continue
+		}
+		ts, err := uuid.TimestampFromV6(uuid.FromStringOrNil(ids[i]))
+		if err != nil {
+			return fmt.Errorf("could not get time of event %d: %w", e.Seq, err)
+		}
+		t, err := ts.Time()
+		if err != nil {
+			return err
+		}
+		if e.Seq == from {
+			f.From = t
+		} else {
+			f.To = t
+		}
+	}
+	return dumpEvents(ctx, f)
+}
+
+func theDumpIsRestored(ctx context.Context) error {
+	s := getState(ctx)
+	td, err := os.MkdirTemp("", "")
+	if err != nil {
+		return fmt.Errorf("could not create temp dir: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		os.RemoveAll(td)
+	}()
+
+	path := filepath.Join(td, "restored")
+	db, err := embedded.Open(path, 0700, embedded.Options{})
+	if err != nil {
+		return fmt.Errorf("could not open db: %w", err)
+	}
+	err = bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
+		_, err := snapshot.Restore(bytes.NewReader(s.dump), tx)
+		return err
+	})
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("could not restore dump: %w", err)
+	}
+
+	s.stateFile = path
+	return startBuffer(ctx, server.Options{})
+}
+
+func theBufferShouldHaveNoEvents(ctx context.Context) error {
+	st, err := getState(ctx).server.Stats()
+	if err != nil {
+		return err
+	}
+	if st.Events != 0 {
+		return fmt.Errorf("expected no events, got %d", st.Events)
+	}
+	return nil
+}
+
+func aSnapshotOfTheBufferIsTaken(ctx context.Context) error {
+	s := getState(ctx)
+	buf := &bytes.Buffer{}
+	err := s.server.WriteSnapshot(buf)
+	if err != nil {
+		return fmt.Errorf("could not write snapshot: %w", err)
+	}
+	s.dump = buf.Bytes()
+	return nil
+}
+
+func theSnapshotShouldRecordEventsAppendedToTheBufferAndToTheTopic(ctx context.Context, buffer, topicEvents int, topic string) error {
+	header, err := snapshot.Read(bytes.NewReader(getState(ctx).dump), func(snapshot.Entry) error { return nil })
+	if err != nil {
+		return fmt.Errorf("could not read snapshot: %w", err)
+	}
+
+	expected := map[string]uint64{"": uint64(buffer), topic: uint64(topicEvents)}
+	if len(header.Sequences) != len(expected) {
+		return fmt.Errorf("expected sequences of %d streams, got %+v", len(expected), header.Sequences)
+	}
+	for _, seq := range header.Sequences {
+		if seq.Appended != expected[seq.Stream] || seq.Pruned != 0 {
+			return fmt.Errorf("expected %d events appended to %q, got %+v", expected[seq.Stream], seq.Stream, seq)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxPooledBuffer is the capacity above which response buffers are not
+// returned to the pool, so a few huge polls don't pin their memory.
+const maxPooledBuffer = 4 << 20
+
+var responseBuffers = sync.Pool{
+	New: func() any {
+		return &bytes.Buffer{}
+	},
+}
+
+// writeEvents writes events as a JSON array followed by a newline, like
+// json.Encoder does. The array is built in a pooled buffer and written at
+// once instead of marshaling every event on its own.
+func writeEvents(w io.Writer, events []event) error {
+	buf := responseBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			responseBuffers.Put(buf)
+		}
+	}()
+
+	buf.WriteByte('[')
+	for i, e := range events {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		err := appendEvent(buf, e)
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteString("]\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// appendEvent writes the array [id, payload] of an event, or [id, payload,
+// expires] when it expires, to buf. Payloads are compacted and HTML escaped
+// as json.Marshal does.
+func appendEvent(buf *bytes.Buffer, e event) error {
+	// ids are UUIDs, they need no escaping
+	buf.WriteString(`["`)
+	buf.WriteString(e.id)
+	buf.WriteString(`",`)
+
+	start := buf.Len()
+	if len(e.payload) == 0 {
+		buf.WriteString("null")
+	} else {
+		err := json.Compact(buf, e.payload)
+		if err != nil {
+			buf.Truncate(start)
+			return err
+		}
+	}
+	if needsHTMLEscape(buf.Bytes()[start:]) {
+		compacted := append([]byte(nil), buf.Bytes()[start:]...)
+		buf.Truncate(start)
+		json.HTMLEscape(buf, compacted)
+	}
+
+	if !e.expires.IsZero() {
+		var ts [len(time.RFC3339Nano) + 8]byte
+		buf.WriteString(`,"`)
+		buf.Write(e.expires.UTC().AppendFormat(ts[:0], time.RFC3339Nano))
+		buf.WriteByte('"')
+	}
+
+	buf.WriteByte(']')
+	return nil
+}
+
+// needsHTMLEscape returns true if p contains characters json.Marshal
+// escapes, <, >, & and the line and paragraph separators.
+func needsHTMLEscape(p []byte) bool {
+	for i, c := range p {
+		switch c {
+		case '<', '>', '&':
+			return true
+		case 0xe2:
+			if i+2 < len(p) && p[i+1] == 0x80 && p[i+2]&^1 == 0xa8 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func anEventWithThePayloadInTheBuffer(ctx context.Context, payload string) error {
+	s := getState(ctx)
+	res, err := http.Post(s.serverBaseURL+"/events", "application/json", strings.NewReader("["+payload+"]"))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+func thePolledPayloadShouldBe(ctx context.Context, expected string) error {
+	events := [][]json.RawMessage{}
+	err := json.Unmarshal(getState(ctx).rawPoll, &events)
+	if err != nil {
+		return fmt.Errorf("could not decode poll response: %w", err)
+	}
+
+	if len(events) != 1 || len(events[0]) < 2 {
+		return fmt.Errorf("expected one event, got %s", getState(ctx).rawPoll)
+	}
+
+	if !bytes.Equal(events[0][1], []byte(expected)) {
+		return fmt.Errorf("expected payload %s, got %s", expected, events[0][1])
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// encryptedMarker starts payloads encrypted by payloadCipher. It is
+// followed by the length of the key id, the key id, the nonce and the
+// sealed payload, which may be compressed itself. Like the other markers
+// it can't start JSON.
+const encryptedMarker = 0x03
+
+var errNoEncryptionKey = errors.New("no such encryption key")
+
+// EncryptionKey is an AES key payloads are encrypted with, ID is stored
+// with every payload so keys can be rotated.
+type EncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// ParseEncryptionKeys parses id:key entries, keys are base64 encoded and
+// have 16, 24 or 32 bytes for AES-128, AES-192 or AES-256.
+func ParseEncryptionKeys(entries []string) ([]EncryptionKey, error) {
+	keys := []EncryptionKey{}
+	for _, e := range entries {
+		id, encoded, found := strings.Cut(e, ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("encryption key must be id:base64-key")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s is not base64 encoded: %w", id, err)
+		}
+		keys = append(keys, EncryptionKey{ID: id, Key: key})
+	}
+	return keys, nil
+}
+
+// payloadCipher encrypts payloads with the first of its keys and decrypts
+// them with the key they were encrypted with.
+type payloadCipher struct {
+	active string
+	aeads  map[string]cipher.AEAD
+	// blobKey keys the hashes of deduplicated payloads, plain sha256
+	// sums would let anyone with the state file confirm guessed payloads.
+	blobKey []byte
+}
+
+func newPayloadCipher(keys []EncryptionKey) (*payloadCipher, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	blobKey := sha256.Sum256(append([]byte("event-buffer blob hashes "), keys[0].Key...))
+	c := &payloadCipher{active: keys[0].ID, aeads: map[string]cipher.AEAD{}, blobKey: blobKey[:]}
+	for _, k := range keys {
+		if len(k.ID) > 255 {
+			return nil, fmt.Errorf("id of encryption key %s is longer than 255 bytes", k.ID)
+		}
+		if _, found := c.aeads[k.ID]; found {
+			return nil, fmt.Errorf("duplicate encryption key %s", k.ID)
+		}
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %s: %w", k.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %s: %w", k.ID, err)
+		}
+		c.aeads[k.ID] = aead
+	}
+	return c, nil
+}
+
+// seal encrypts a payload with the active key. The header with the key id
+// is authenticated with it.
+func (c *payloadCipher) seal(payload []byte) ([]byte, error) {
+	aead := c.aeads[c.active]
+
+	header := append([]byte{encryptedMarker, byte(len(c.active))}, c.active...)
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+
+	value := make([]byte, 0, len(header)+len(nonce)+len(payload)+aead.Overhead())
+	value = append(value, header...)
+	value = append(value, nonce...)
+	return aead.Seal(value, nonce, payload, header), nil
+}
+
+// blobHash returns the key of a deduplicated payload.
+func (c *payloadCipher) blobHash(payload []byte) string {
+	if c == nil {
+		sum := sha256.Sum256(payload)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, c.blobKey)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encryptionKeyID returns the id of the key a value is encrypted with, or
+// "" when it isn't encrypted.
+func encryptionKeyID(value []byte) string {
+	if len(value) < 2 || value[0] != encryptedMarker || len(value) < 2+int(value[1]) {
+		return ""
+	}
+	return string(value[2 : 2+int(value[1])])
+}
+
+// open decrypts a value sealed by a cipher with the same key.
+func (c *payloadCipher) open(value []byte) ([]byte, error) {
+	id := encryptionKeyID(value)
+	if id == "" {
+		return nil, errors.New("encrypted payload is truncated")
+	}
+	if c == nil {
+		return nil, fmt.Errorf("payload is encrypted with key %s, but no encryption keys are configured", id)
+	}
+	aead, found := c.aeads[id]
+	if !found {
+		return nil, fmt.Errorf("payload is encrypted with key %s: %w", id, errNoEncryptionKey)
+	}
+
+	headerLen := 2 + len(id)
+	if len(value) < headerLen+aead.NonceSize() {
+		return nil, errors.New("encrypted payload is truncated")
+	}
+	header := value[:headerLen]
+	nonce := value[headerLen : headerLen+aead.NonceSize()]
+	payload, err := aead.Open(nil, nonce, value[headerLen+aead.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt payload with key %s: %w", id, err)
+	}
+	return payload, nil
+}
+
+// encodePayload returns the value a payload stored in the database is
+// written as: compressed when PayloadCompression is set, then encrypted
+// when encryption keys are configured.
+func (s Server) encodePayload(payload []byte) ([]byte, error) {
+	value := s.compressPayload(payload)
+	if s.cipher == nil {
+		return value, nil
+	}
+	return s.cipher.seal(value)
+}
+
+// decodePayload returns the payload of a value written by encodePayload,
+// or by sealPayload for payloads of the payload log.
+func (s Server) decodePayload(value []byte) ([]byte, error) {
+	if len(value) > 0 && value[0] == encryptedMarker {
+		var err error
+		value, err = s.cipher.open(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decompressPayload(value)
+}
+
+// sealPayload encrypts a payload kept outside of the database when
+// encryption keys are configured. Offloaded payloads, WAL and archive
+// segments are sealed as a whole.
+func (s Server) sealPayload(payload []byte) ([]byte, error) {
+	if s.cipher == nil {
+		return payload, nil
+	}
+	return s.cipher.seal(payload)
+}
+
+// openSegment returns the content of a WAL or archive segment, segments
+// sealed by sealPayload are decrypted with c. Segments written without
+// encryption keys are returned as they are.
+func openSegment(c *payloadCipher, r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(1)
+	if len(b) == 0 || b[0] != encryptedMarker {
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		return br, err
+	}
+
+	sealed, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	opened, err := c.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(opened), nil
+}
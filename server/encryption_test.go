@@ -0,0 +1,225 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/draganm/event-buffer/server"
+	"github.com/google/go-cmp/cmp"
+)
+
+// encryptionKeys returns AES-256 keys derived from their ids.
+func encryptionKeys(ids string) []server.EncryptionKey {
+	keys := []server.EncryptionKey{}
+	for _, id := range strings.Split(ids, ",") {
+		key := sha256.Sum256([]byte(id))
+		keys = append(keys, server.EncryptionKey{ID: id, Key: key[:]})
+	}
+	return keys
+}
+
+// scenarioEncryptionKeys returns the keys the buffer of the scenario was
+// started with, if any.
+func scenarioEncryptionKeys(ctx context.Context) []server.EncryptionKey {
+	keys := getState(ctx).encryptionKeys
+	if keys == "" {
+		return nil
+	}
+	return encryptionKeys(keys)
+}
+
+func startEncryptingBuffer(ctx context.Context, keys string) error {
+	getState(ctx).encryptionKeys = keys
+	return startBuffer(ctx, server.Options{
+		EncryptionKeys: encryptionKeys(keys),
+		DedupMinSize:   getState(ctx).dedupMinSize,
+	})
+}
+
+func aBufferEncryptingPayloadsWithTheKey(ctx context.Context, key string) error {
+	td, err := os.MkdirTemp("", "")
+	if err != nil {
+		return fmt.Errorf("could not create temp dir: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		os.RemoveAll(td)
+	}()
+
+	getState(ctx).stateFile = filepath.Join(td, "state")
+	return startEncryptingBuffer(ctx, key)
+}
+
+func aBufferEncryptingAndDeduplicatingPayloadsWithTheKey(ctx context.Context, key string) error {
+	getState(ctx).dedupMinSize = 1
+	return aBufferEncryptingPayloadsWithTheKey(ctx, key)
+}
+
+func theBufferIsRestartedWithTheKeys(ctx context.Context, keys string) error {
+	getState(ctx).stopServer()
+	return startEncryptingBuffer(ctx, keys)
+}
+
+func theStateFileShouldNotContain(ctx context.Context, text string) error {
+	d, err := os.ReadFile(getState(ctx).stateFile)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(d, []byte(text)) {
+		return fmt.Errorf("state file contains %q", text)
+	}
+	return nil
+}
+
+func rawPolledIDs(ctx context.Context) ([]string, error) {
+	s := getState(ctx)
+	res, err := http.Get(s.serverBaseURL + "/events?wait=0")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	events := [][]json.RawMessage{}
+	err = json.NewDecoder(res.Body).Decode(&events)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode poll response: %w", err)
+	}
+
+	ids := []string{}
+	for _, e := range events {
+		var id string
+		err = json.Unmarshal(e[0], &id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func theEventsShouldBeEncryptedWithTheKeys(ctx context.Context, keys string) error {
+	s := getState(ctx)
+	ids, err := rawPolledIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	found := []string{}
+	for _, id := range ids {
+		res, err := http.Get(s.serverBaseURL + "/events/" + id)
+		if err != nil {
+			return err
+		}
+		detail := struct {
+			Storage struct {
+				EncryptionKey string `json:"encryption_key"`
+			} `json:"storage"`
+		}{}
+		err = json.NewDecoder(res.Body).Decode(&detail)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("could not decode event: %w", err)
+		}
+		found = append(found, detail.Storage.EncryptionKey)
+	}
+
+	d := cmp.Diff(found, strings.Split(keys, ","))
+	if d != "" {
+		return fmt.Errorf("unexpected encryption keys:\n%s", d)
+	}
+	return nil
+}
+
+func theIntegrityCheckShouldReportAnUnreadablePayload(ctx context.Context) error {
+	report, err := getState(ctx).server.CheckIntegrity(ctx, "", "")
+	if err != nil {
+		return err
+	}
+	if len(report.Problems) != 1 || !strings.Contains(report.Problems[0].Problem, "unreadable payload") {
+		return fmt.Errorf("expected an unreadable payload, got %v", report.Problems)
+	}
+	return nil
+}
+
+func aBufferEncryptingPayloadsWithTheKeyAndOffloadingPayloadsOfAtLeastBytes(ctx context.Context, key string, n int) error {
+	getState(ctx).encryptionKeys = key
+	return aBufferOffloadingPayloadsOfAtLeastBytes(ctx, n)
+}
+
+func aBufferEncryptingPayloadsWithTheKeyAndArchivingItsEvents(ctx context.Context, key string) error {
+	getState(ctx).encryptionKeys = key
+	// uncompressed segments would show plain payloads
+	return startArchivingBuffer(ctx, server.Options{
+		EncryptionKeys: encryptionKeys(key),
+		ArchiveFormat:  server.ArchiveFormatJSONL,
+	})
+}
+
+// storeShouldNotContain fails when an object of the store under prefix
+// contains text.
+func storeShouldNotContain(ctx context.Context, store objectstore.Store, prefix, text string) error {
+	keys, err := store.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no objects under %s", prefix)
+	}
+
+	for _, k := range keys {
+		o, err := store.Get(ctx, k)
+		if err != nil {
+			return err
+		}
+		d, err := io.ReadAll(o)
+		o.Close()
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(d, []byte(text)) {
+			return fmt.Errorf("%s contains %q", k, text)
+		}
+	}
+	return nil
+}
+
+func theObjectStoreShouldNotContain(ctx context.Context, text string) error {
+	return storeShouldNotContain(ctx, getState(ctx).offloadStore, "payloads/", text)
+}
+
+func theArchiveShouldNotContain(ctx context.Context, text string) error {
+	return storeShouldNotContain(ctx, getState(ctx).archive, "archive/", text)
+}
+
+func theWALShouldNotContain(ctx context.Context, text string) error {
+	s := getState(ctx)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		keys, err := s.walStore.List(ctx, "wal/")
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no WAL segment was shipped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return storeShouldNotContain(ctx, s.walStore, "wal/", text)
+}
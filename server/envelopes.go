@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/gofrs/uuid"
+)
+
+// publishRequest holds the events of a publish request. The payloads are
+// slices of the request body, so a request allocates a pooled buffer
+// instead of a copy of every payload. Payloads are only valid until
+// release is called, which happens after they were stored.
+type publishRequest struct {
+	body   bytes.Buffer
+	events []json.RawMessage
+}
+
+var publishRequests = sync.Pool{
+	New: func() any {
+		return &publishRequest{}
+	},
+}
+
+// readPublishRequest reads a JSON array of events from r.
+func readPublishRequest(r io.Reader) (*publishRequest, error) {
+	pr := publishRequests.Get().(*publishRequest)
+	pr.body.Reset()
+	pr.events = pr.events[:0]
+
+	_, err := pr.body.ReadFrom(r)
+	if err != nil {
+		pr.release()
+		return nil, err
+	}
+
+	pr.events, err = splitEvents(pr.body.Bytes(), pr.events)
+	if err != nil {
+		pr.release()
+		return nil, err
+	}
+
+	return pr, nil
+}
+
+func (pr *publishRequest) release() {
+	if pr.body.Cap() > maxPooledBuffer {
+		return
+	}
+	for i := range pr.events {
+		pr.events[i] = nil
+	}
+	pr.events = pr.events[:0]
+	publishRequests.Put(pr)
+}
+
+// splitEvents appends the elements of the JSON array in data to events as
+// slices of data. Anything but an array is decoded by encoding/json, so
+// null is no events and other values are rejected with its errors.
+func splitEvents(data []byte, events []json.RawMessage) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '[' || !json.Valid(trimmed) {
+		decoded := []json.RawMessage{}
+		err := json.Unmarshal(data, &decoded)
+		if err != nil {
+			return nil, err
+		}
+		return append(events, decoded...), nil
+	}
+
+	// the array is valid, so only strings and nesting need to be tracked to
+	// find the commas between its elements
+	depth := 0
+	inString := false
+	escaped := false
+	start := -1
+	element := func(end int) {
+		e := bytes.TrimRight(trimmed[start:end], " \t\r\n")
+		events = append(events, e[:len(e):len(e)])
+		start = -1
+	}
+
+	for i := 1; i < len(trimmed); i++ {
+		c := trimmed[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case ',':
+			if depth == 0 {
+				element(i)
+			}
+			continue
+		case ']', '}':
+			if depth == 0 {
+				if start >= 0 {
+					element(i)
+				}
+				return events, nil
+			}
+			depth--
+			continue
+		}
+
+		if start < 0 {
+			start = i
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '[', '{':
+			depth++
+		}
+	}
+
+	return nil, fmt.Errorf("unterminated array of events")
+}
+
+// appendUUID appends the canonical form of id to dst, as id.String()
+// returns it.
+func appendUUID(dst []byte, id uuid.UUID) []byte {
+	var s [36]byte
+	hex.Encode(s[0:8], id[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], id[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], id[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], id[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], id[10:])
+	return append(dst, s[:]...)
+}
@@ -1,12 +1,91 @@
 package server
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Values of the `envelope` query parameter. Without one events are sent as
+// [id, payload], the form clients have always decoded. Full envelopes add
+// the expiry of events. Lean envelopes carry only ids and payloads and
+// leave out the headers describing the buffer, for consumers that don't
+// need the metadata. Buffers storing CloudEvents have envelopes of their
+// own.
+const (
+	envelopeFull = "full"
+	envelopeLean = "lean"
+)
+
+func parseEnvelope(r *http.Request, cloudEvents bool) (string, error) {
+	envelope := r.URL.Query().Get("envelope")
+	switch envelope {
+	case "", envelopeFull, envelopeLean:
+		return envelope, nil
+	case envelopeCloudEvents, envelopeCloudEventsBinary:
+		if !cloudEvents {
+			return "", fmt.Errorf("envelope %s requires a buffer storing CloudEvents", envelope)
+		}
+		return envelope, nil
+	default:
+		return "", fmt.Errorf("invalid envelope value: %s", envelope)
+	}
+}
 
 type event struct {
 	id      string
 	payload json.RawMessage
+	// expires is the time after which the event can be pruned.
+	expires time.Time
 }
 
 func (e event) MarshalJSON() ([]byte, error) {
-	return json.Marshal([]any{e.id, e.payload})
+	buf := &bytes.Buffer{}
+	err := appendEvent(buf, e)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *event) UnmarshalJSON(d []byte) error {
+	parts := []json.RawMessage{}
+	err := json.Unmarshal(d, &parts)
+	if err != nil {
+		return fmt.Errorf("could not unmarshal event: %w", err)
+	}
+
+	if len(parts) != 2 && len(parts) != 3 {
+		return fmt.Errorf("expected 2 or 3 parts of event, got %d", len(parts))
+	}
+
+	err = json.Unmarshal(parts[0], &e.id)
+	if err != nil {
+		return fmt.Errorf("could not unmarshal event id: %w", err)
+	}
+
+	_, err = eventUUID(e.id)
+	if err != nil {
+		return fmt.Errorf("invalid event id %q: %w", e.id, err)
+	}
+
+	e.payload = parts[1]
+
+	if len(parts) == 3 {
+		err = json.Unmarshal(parts[2], &e.expires)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal event expiry: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// retentionExpired is returned when a consumer polls after an event that
+// has already been pruned. Oldest is empty if the buffer is empty.
+type retentionExpired struct {
+	Error  string `json:"error"`
+	Oldest string `json:"oldest"`
 }
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/gorilla/mux"
+)
+
+const (
+	storageInline = "inline"
+	storageBlob   = "blob"
+	storageObject = "object"
+	storageLog    = "log"
+)
+
+// eventDetail describes how a single event is stored, for debugging.
+type eventDetail struct {
+	ID      string          `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+	Time    time.Time       `json:"time"`
+	// Expires is when the event can be pruned, omitted without retention.
+	Expires *time.Time `json:"expires,omitempty"`
+	// TraceParent is the traceparent header the event was published with.
+	TraceParent string       `json:"traceparent,omitempty"`
+	Storage     eventStorage `json:"storage"`
+}
+
+type eventStorage struct {
+	// Kind is inline for payloads stored in the event, blob for
+	// deduplicated, object for offloaded payloads and log for payloads in
+	// the payload log.
+	Kind string `json:"kind"`
+	// StoredSize is the size of the value of the event in the database.
+	// PayloadSize and SHA256 are those of the delivered payload, they match
+	// the stored payload unless redactions apply to the consumer.
+	StoredSize  int         `json:"stored_size"`
+	PayloadSize int         `json:"payload_size"`
+	SHA256      string      `json:"sha256"`
+	Blob        string      `json:"blob,omitempty"`
+	BlobRefs    uint64      `json:"blob_refs,omitempty"`
+	Object      string      `json:"object,omitempty"`
+	Log         *payloadRef `json:"log,omitempty"`
+	// Compression is the compression of inline and blob payloads, omitted
+	// when they are stored as they are.
+	Compression string `json:"compression,omitempty"`
+	// EncryptionKey is the id of the key the payload is encrypted with.
+	EncryptionKey string `json:"encryption_key,omitempty"`
+}
+
+// describeEncoding sets how a payload stored in the database or the
+// payload log is compressed and encrypted.
+func (s *Server) describeEncoding(st *eventStorage, value []byte) {
+	st.EncryptionKey = encryptionKeyID(value)
+	if st.EncryptionKey != "" {
+		inner, err := s.cipher.open(value)
+		if err != nil {
+			return
+		}
+		value = inner
+	}
+	st.Compression = payloadCompression(value)
+}
+
+func (s *Server) getEvent(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+	id := mux.Vars(r)["id"]
+
+	t, err := eventTime(id)
+	if err != nil {
+		http.Error(w, fmt.Errorf("invalid event id: %w", err).Error(), http.StatusBadRequest)
+		return
+	}
+
+	d := eventDetail{ID: id, Time: t.UTC()}
+	if s.opts.RetentionPeriod > 0 {
+		expires := d.Time.Add(s.opts.RetentionPeriod)
+		d.Expires = &expires
+	}
+
+	found := false
+	err = bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		path := eventsPath.Append(id)
+		if !tx.Exists(path) {
+			return nil
+		}
+		found = true
+
+		value := tx.Get(path)
+		d.Storage.StoredSize = len(value)
+		d.TraceParent = traceParent(tx, id)
+
+		rec, isRecord, err := decodeRecord(value)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case !isRecord:
+			d.Storage.Kind = storageInline
+			s.describeEncoding(&d.Storage, value)
+		case rec.Blob != "":
+			d.Storage.Kind = storageBlob
+			d.Storage.Blob = rec.Blob
+			refPath := blobRefsPath.Append(rec.Blob)
+			if tx.Exists(refPath) {
+				d.Storage.BlobRefs = binary.BigEndian.Uint64(tx.Get(refPath))
+			}
+			if tx.Exists(blobsPath.Append(rec.Blob)) {
+				s.describeEncoding(&d.Storage, tx.Get(blobsPath.Append(rec.Blob)))
+			}
+		case rec.Object != "":
+			d.Storage.Kind = storageObject
+			d.Storage.Object = rec.Object
+		case rec.Log != nil:
+			d.Storage.Kind = storageLog
+			d.Storage.Log = rec.Log
+		}
+
+		d.Payload, err = s.loadPayload(r.Context(), tx, value)
+		return err
+	})
+
+	if err != nil {
+		log.Error(err, "could not read event")
+		http.Error(w, fmt.Errorf("could not read event: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		http.Error(w, fmt.Sprintf("event %s not found", id), http.StatusNotFound)
+		return
+	}
+
+	redactions := s.deliveryRedactions(r)
+	if len(redactions) > 0 {
+		d.Payload, err = redactPayload(d.Payload, redactions)
+		if err != nil {
+			log.Error(err, "could not redact event")
+			http.Error(w, fmt.Errorf("could not redact event: %w", err).Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	sum := sha256.Sum256(d.Payload)
+	d.Storage.SHA256 = hex.EncodeToString(sum[:])
+	d.Storage.PayloadSize = len(d.Payload)
+
+	s.recordConsumed(r, []event{{id: id, payload: d.Payload}})
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
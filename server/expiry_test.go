@@ -0,0 +1,68 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+// testRetention is the retention period of buffers started with one,
+// events sent during a scenario are always within it.
+const testRetention = time.Hour
+
+func aBufferWithARetentionPeriod(ctx context.Context) error {
+	return startBuffer(ctx, server.Options{RetentionPeriod: testRetention})
+}
+
+func iPollForTheRawEvents(ctx context.Context) error {
+	return pollRawEvents(ctx, "")
+}
+
+func iPollForTheRawEventsFromTheTime(ctx context.Context, fromTime string) error {
+	return pollRawEvents(ctx, "?"+url.Values{"from_time": {fromTime}, "wait": {"0"}}.Encode())
+}
+
+func iPollForTheRawEventsWithTheEnvelope(ctx context.Context, envelope string) error {
+	return pollRawEvents(ctx, "?envelope="+envelope)
+}
+
+func pollRawEvents(ctx context.Context, query string) error {
+	s := getState(ctx)
+	res, err := http.Get(s.serverBaseURL + "/events" + query)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	s.rawPollHeader = res.Header
+	s.rawPoll, err = io.ReadAll(res.Body)
+	return err
+}
+
+func thePolledEventsShouldHaveParts(ctx context.Context, n int) error {
+	events := [][]json.RawMessage{}
+	err := json.Unmarshal(getState(ctx).rawPoll, &events)
+	if err != nil {
+		return fmt.Errorf("could not decode poll response: %w", err)
+	}
+
+	if len(events) == 0 {
+		return fmt.Errorf("expected events, got %s", getState(ctx).rawPoll)
+	}
+	for _, e := range events {
+		if len(e) != n {
+			return fmt.Errorf("expected %d parts of events, got %s", n, getState(ctx).rawPoll)
+		}
+	}
+	return nil
+}
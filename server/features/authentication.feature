@@ -0,0 +1,8 @@
+Feature: authentication
+
+    Scenario: API tokens are limited to their scopes
+        Given a buffer accepting the tokens "reader:r-token:read" and "writer:w-token:write"
+        When I send an event with the token "w-token"
+        Then polling with the token "r-token" should return the event
+        And sending an event with the token "r-token" should be forbidden
+        And polling without a token should be unauthorized
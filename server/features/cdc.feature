@@ -0,0 +1,33 @@
+Feature: CDC socket
+
+    Scenario: subscribers receive stored and appended events
+        Given an event with the payload {"n":1} in the buffer
+        And a CDC subscriber starting at the oldest event
+        When an event with the payload {"n":2} in the buffer
+        Then the CDC subscriber should receive the payloads [{"n":1},{"n":2}]
+
+    Scenario: subscribers resume after their cursor
+        Given two events in the buffer
+        And I poll for one event
+        And a CDC subscriber starting after the polled event
+        When an event with the payload {"n":3} in the buffer
+        Then the CDC subscriber should receive the payloads ["evt2",{"n":3}]
+
+    Scenario: subscribers of a topic resume after their cursor
+        Given a topic "orders"
+        And an event with the payload {"n":1} in the buffer
+        And an event with the payload {"n":2} in the topic "orders"
+        And an event with the payload {"n":3} in the topic "orders"
+        When a CDC subscriber of the topic "orders" starting after its oldest event
+        Then the CDC subscriber should receive the payloads [{"n":3}]
+
+    Scenario: subscribers behind the retention are told so
+        Given two events in the buffer
+        And I poll for one event
+        When all events are pruned
+        And a CDC subscriber starting after the polled event
+        Then the CDC subscriber should be told that the events after its cursor have been pruned
+
+    Scenario: subscribing to a topic that does not exist
+        When a CDC subscriber of the topic "missing"
+        Then the CDC subscriber should be disconnected
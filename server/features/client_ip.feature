@@ -0,0 +1,32 @@
+Feature: client ip
+
+    Scenario Outline: client addresses of requests
+        Given the trusted proxies "<trusted>"
+        When a request from "<peer>" with the header "<header>" set to "<value>"
+        Then the client address should be "<client>"
+
+        Examples:
+            | trusted             | peer         | header          | value                                  | client       |
+            | 10.0.0.0/8          | 203.0.113.5  | X-Forwarded-For | 198.51.100.7                           | 203.0.113.5  |
+            | 10.0.0.0/8          | 203.0.113.5  | X-Real-IP       | 198.51.100.7                           | 203.0.113.5  |
+            | 10.0.0.0/8          | 10.0.0.1     | X-Forwarded-For |                                        | 10.0.0.1     |
+            | 10.0.0.0/8          | 10.0.0.1     | X-Forwarded-For | 198.51.100.7                           | 198.51.100.7 |
+            | 10.0.0.0/8          | 10.0.0.1     | X-Forwarded-For | 198.51.100.7, 10.0.0.3, 10.0.0.2       | 198.51.100.7 |
+            | 10.0.0.0/8          | 10.0.0.1     | X-Forwarded-For | 10.0.0.3, 10.0.0.2                     | 10.0.0.3     |
+            | 10.0.0.0/8          | 10.0.0.1     | X-Forwarded-For | 192.0.2.66, 198.51.100.7, 10.0.0.2     | 198.51.100.7 |
+            | 10.0.0.0/8          | 10.0.0.1     | X-Forwarded-For | 198.51.100.7, not-an-ip, 10.0.0.2      | 10.0.0.2     |
+            | 10.0.0.0/8          | 10.0.0.1     | X-Forwarded-For | 198.51.100.7:8080                      | 10.0.0.1     |
+            | 10.0.0.0/8          | 10.0.0.1     | X-Real-IP       | 198.51.100.7                           | 198.51.100.7 |
+            | 10.0.0.0/8          | 10.0.0.1     | X-Real-IP       | not-an-ip                              | 10.0.0.1     |
+            | 192.0.2.1           | 192.0.2.1    | X-Forwarded-For | 198.51.100.7                           | 198.51.100.7 |
+            | 192.0.2.1           | 192.0.2.2    | X-Forwarded-For | 198.51.100.7                           | 192.0.2.2    |
+            | ::1, 10.0.0.0/8     | ::1          | X-Forwarded-For | 2001:db8::7, 10.0.0.2                  | 2001:db8::7  |
+
+    Scenario Outline: invalid trusted proxies
+        Then parsing the trusted proxies "<trusted>" should fail
+
+        Examples:
+            | trusted      |
+            | 10.0.0.300   |
+            | 10.0.0.0/33  |
+            | proxy        |
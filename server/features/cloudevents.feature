@@ -0,0 +1,35 @@
+Feature: CloudEvents
+
+    Scenario: polling structured CloudEvents
+        Given a buffer storing CloudEvents
+        When I publish a CloudEvent of the type "order.created"
+        And I poll for CloudEvents
+        Then I should receive a CloudEvent of the type "order.created" with its buffer id
+
+    Scenario: publishing events that are not CloudEvents
+        Given a buffer storing CloudEvents
+        When I publish an event without a specversion
+        Then the publish should be rejected as invalid
+
+    Scenario: publishing a CloudEvent in the binary content mode
+        Given a buffer storing CloudEvents
+        When I publish a binary CloudEvent of the type "order.paid" with the text "paid in full"
+        And I poll for CloudEvents
+        Then I should receive a CloudEvent of the type "order.paid" with its buffer id
+        And the CloudEvent should have the base64 data "cGFpZCBpbiBmdWxs"
+
+    Scenario: polling a CloudEvent in the binary content mode
+        Given a buffer storing CloudEvents
+        When I publish a binary CloudEvent of the type "order.paid" with the text "paid in full"
+        And I poll for a CloudEvent in the binary content mode
+        Then the poll should return the type "order.paid" as header and the text "paid in full" as body
+
+    Scenario: polling the binary content mode of an empty buffer
+        Given a buffer storing CloudEvents
+        When I poll for a CloudEvent in the binary content mode
+        Then the poll should return no content
+
+    Scenario: buffers not storing CloudEvents reject their envelope
+        Given one event in the buffer
+        When I poll for CloudEvents
+        Then the poll should be rejected as invalid
@@ -0,0 +1,9 @@
+Feature: consume and publish
+
+    Scenario: acknowledging events and publishing derived events exactly once
+        Given one event in the buffer
+        When I poll for one event
+        And I acknowledge the event publishing a derived event
+        And I retry the acknowledgement
+        Then the retry should be rejected with a position conflict
+        And I should get only the derived event after the acknowledged event
@@ -0,0 +1,46 @@
+Feature: selective dumps
+
+    Scenario: dumping the events of a topic
+        Given a topic "orders"
+        And one event in the buffer
+        When I send an event to the topic "orders"
+        And the topic "orders" is dumped
+        And the dump is restored
+        Then polling the topic "orders" should return only its event
+        And the buffer should have no events
+        And the integrity check should report no problems
+
+    Scenario: dumping the events of a time range
+        Given events of the types "order,order,order" in the buffer
+        When the events from the time of the event numbered 2 to the time of the event numbered 3 are dumped
+        And the dump is restored
+        And I poll for events of the type "order"
+        Then I should get the events numbered "2"
+        And the integrity check should report no problems
+
+    Scenario: payloads of the payload log are stored in the dump
+        Given a buffer with a payload log
+        And an event with the payload {"data":"stored in the payload log"} in the buffer
+        When the buffer is dumped
+        And the dump is restored
+        And I poll for the raw events
+        Then the polled payload should be {"data":"stored in the payload log"}
+        And the integrity check should report no problems
+
+    Scenario: shared payloads are stored in the dump
+        Given a buffer compressing and deduplicating stored payloads with zstd
+        And an event with the payload {"data":"shared"} in the buffer
+        And an event with the payload {"data":"shared"} in the buffer
+        When the buffer is dumped
+        And the dump is restored
+        Then the integrity check should report no problems
+
+    Scenario: snapshots of the whole state record the sequences of its streams
+        Given a topic "orders"
+        And events of the types "order,order,order" in the buffer
+        When I send an event to the topic "orders"
+        And a snapshot of the buffer is taken
+        And the dump is restored
+        Then the snapshot should record 3 events appended to the buffer and 1 to the topic "orders"
+        And polling the topic "orders" should return only its event
+        And the integrity check should report no problems
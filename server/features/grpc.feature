@@ -0,0 +1,13 @@
+Feature: gRPC API
+
+    Scenario: publishing and polling over gRPC
+        Given a gRPC connection
+        When I publish two events over gRPC
+        Then polling over gRPC should return both events
+        And streaming over gRPC should deliver both events
+
+    Scenario: pruning over gRPC
+        Given a gRPC connection
+        And two events in the buffer
+        When I prune all events over gRPC
+        Then the buffer should be empty
@@ -0,0 +1,20 @@
+Feature: consumer heartbeats
+
+    Scenario: heartbeats register consumers at their position
+        Given two events in the buffer
+        And I poll for one event
+        When the consumer "c1" sends a heartbeat at the polled event
+        Then the consumer "c1" should have been seen at the polled event
+
+    Scenario: heartbeats of unknown consumers need a position
+        Then a heartbeat of the unknown consumer "c1" should be rejected
+
+    Scenario: silent consumers are alerted until they are seen again
+        Given two events in the buffer
+        And I poll for one event
+        And the consumer "c1" sends a heartbeat at the polled event
+        When consumers silent for 1500ms are watched
+        Then an alert "consumer-stale" should be sent for the consumer "c1"
+        When the consumer "c1" sends a heartbeat
+        Then an alert "consumer-recovered" should be sent for the consumer "c1"
+        And the consumer "c1" should have been seen at the polled event
@@ -0,0 +1,24 @@
+Feature: integrity checks
+
+    Scenario: pruned events are accounted for
+        Given two events in the buffer
+        When all events are pruned
+        Then the integrity check should report no problems
+        And the integrity check should count 2 appended and 2 pruned events
+
+    Scenario: events dropped from the state are reported missing
+        Given a buffer storing its state in a file
+        And two events in the buffer
+        When the oldest event is dropped from the state
+        Then the integrity check should report 1 missing event
+
+    Scenario: shared payloads are verified by their checksum
+        Given a buffer storing its state in a file and deduplicating payloads
+        And an event with the payload {"n":1} in the buffer
+        When the shared payloads are corrupted
+        Then the integrity check should report a checksum mismatch
+
+    Scenario: ranges are checked without counters
+        Given two events in the buffer
+        And I poll for one event
+        Then the integrity check of the polled event should check 1 event
@@ -0,0 +1,15 @@
+Feature: load
+
+    Scenario: an idle buffer has no load
+        Then the load score should be 0
+
+    Scenario: the publish rate is scored relative to its target
+        Given a buffer scaling at 1 published events per second
+        And 30 events in the buffer
+        Then the load score should be 50
+
+    Scenario: the storage is scored by the used share of the budget
+        Given a buffer holding at most 10 events
+        And 6 events in the buffer
+        Then the storage should score 60
+        And the load score should be 60
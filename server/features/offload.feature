@@ -0,0 +1,15 @@
+Feature: offload
+
+    Scenario: large payloads are offloaded to the object store
+        Given a buffer offloading payloads of at least 10 bytes
+        When an event with the payload "a large payload" in the buffer
+        And an event with the payload 1 in the buffer
+        Then the object store should hold 1 offloaded payloads
+
+    Scenario: events with offloaded payloads are pruned without an object store
+        Given a buffer offloading payloads of at least 10 bytes
+        And an event with the payload "a large payload" in the buffer
+        When the buffer is restarted without an object store
+        And all events are pruned
+        Then the buffer should have no events
+        And the object store should hold 1 offloaded payloads
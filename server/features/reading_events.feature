@@ -6,6 +6,16 @@ Feature: reading events
         When I poll for the events
         Then I should receive the buffered event
 
+    Scenario: polls are counted in the metrics
+        Given one event in the buffer
+        When I poll for the events
+        Then the metrics should count a poll of "/events" with status 200
+
+    Scenario: hedging polls to a replica
+        Given one event in the buffer
+        When I poll for the events through an unreachable buffer with a replica
+        Then I should receive the buffered event
+
     Scenario: blocking reading of events
         Given no events in the buffer
         When I start polling for the events
@@ -16,4 +26,150 @@ Feature: reading events
         Given two events in the buffer
         When I poll for one event
         And I poll for other event after the previous event
-        Then I should get one event for each poll
\ No newline at end of file
+        Then I should get one event for each poll
+
+    Scenario: polls return the ids and payloads of events by default
+        Given a buffer with a retention period
+        And one event in the buffer
+        When I poll for the raw events
+        Then the polled events should have 2 parts
+
+    Scenario: full envelopes add the expiry of events
+        Given a buffer with a retention period
+        And one event in the buffer
+        When I poll for the raw events with the full envelope
+        Then the polled events should have 3 parts
+
+    Scenario: poll responses report the head of the buffer
+        Given two events in the buffer
+        When I poll for one event
+        Then the poll should report the other event as head of the buffer
+
+    Scenario: lean envelopes leave out the metadata of the buffer
+        Given a buffer with a retention period
+        And one event in the buffer
+        When I poll for the raw events with the lean envelope
+        Then the polled events should have 2 parts
+        And the poll should not report the head of the buffer
+
+    Scenario: skipping events of a seen set
+        Given two events in the buffer
+        When I poll for one event
+        And I poll for events skipping a seen set with the polled event
+        Then I should get only the other event
+
+    Scenario: polling only events of a type
+        Given events of the types "order.created,order.paid,order.created" in the buffer
+        When I poll for events of the type "order.created"
+        Then I should get the events numbered "1,3"
+
+    Scenario: polling events matching a field
+        Given events of the types "order.created,order.paid,order.created" in the buffer
+        When I poll for events where "/seq" is 2
+        Then I should get the events numbered "2"
+
+    Scenario: filtered polls wait for a matching event
+        Given events of the types "order.paid,order.paid" in the buffer
+        When I start polling for events of the type "order.created"
+        And an event of the type "order.created" is sent
+        Then the filtered poll should return only the event numbered 3
+
+    Scenario: filters don't match redacted fields
+        Given a buffer stripping "/seq" for the consumer "analytics"
+        And events of the types "order.created" in the buffer
+        Then the consumer "analytics" polling for events where "/seq" is 1 should get 0 events
+        And the consumer "billing" polling for events where "/seq" is 1 should get 1 event
+
+    Scenario: rules for everyone redact payloads unless the principal is exempted
+        Given a buffer accepting the tokens "billing:t1" and "analytics:t2" stripping "/seq" except for "billing"
+        And events of the types "order.created" in the buffer
+        Then polling with the token "t1" should return payloads with "/seq"
+        And polling with the token "t2" should return payloads without "/seq"
+
+    Scenario: reading events after a pruned event
+        Given two events in the buffer
+        When I poll for one event
+        And all events are pruned
+        And I poll for events after the pruned event
+        Then I should get a retention expired error
+
+    Scenario: tapping appended events
+        Given one event in the buffer
+        When I tap all events
+        And there is a new event sent to the buffer
+        Then the tap should receive only the new event
+
+    Scenario: long polls return no events when their wait expires
+        Given no events in the buffer
+        When I poll for the events waiting 100ms
+        Then the poll should return no events
+
+    Scenario: long polls end when their consumer disconnects
+        Given no events in the buffer
+        When I start a poll waiting 1m and disconnect after 100ms
+        Then the metrics should count a disconnected poll
+
+    Scenario: a consumer catching up gets its next batches read ahead
+        Given a buffer with read ahead
+        And 30 events in the buffer
+        When I poll for the 30 events in batches of 10
+        Then the batches should return all 30 events in order
+        And a batch should have been served from the read ahead
+
+    Scenario: polled payloads are compacted and escaped like encoding/json
+        Given an event with the payload { "html": "<b>&</b>", "list": [1, 2] } in the buffer
+        When I poll for the raw events
+        Then the polled payload should be {"html":"\u003cb\u003e\u0026\u003c/b\u003e","list":[1,2]}
+
+    Scenario Outline: polls are compressed with the encoding the consumer accepts
+        Given 150 events in the buffer
+        When I poll for the 150 events accepting <encoding>
+        Then the poll should be compressed with <encoding> and return 150 events
+
+        Examples:
+            | encoding |
+            | gzip     |
+            | zstd     |
+
+    Scenario: small polls are not compressed
+        Given two events in the buffer
+        When I poll for the 2 events accepting gzip
+        Then the poll should return the two events uncompressed
+
+    Scenario: events are looked up by the trace id they were published with
+        Given a buffer indexing traces
+        When I send an event with the traceparent "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+        And I send an event with the traceparent "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+        And I send an event with the traceparent "00-4bf92f3577b34da6a3ce929d0e0e4736-53995c3f42cd8ad8-01"
+        Then polling for the trace "4bf92f3577b34da6a3ce929d0e0e4736" should return 2 events
+        And polling for the trace "0af7651916cd43dd8448eb211c80319c" should return 1 event
+        And polling for the trace "ffffffffffffffffffffffffffffffff" should return 0 events
+
+    Scenario: pruned events are removed from the trace index
+        Given a buffer indexing traces
+        When I send an event with the traceparent "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+        And all events are pruned
+        Then polling for the trace "4bf92f3577b34da6a3ce929d0e0e4736" should return 0 events
+
+    Scenario: events published before the trace index was enabled are indexed
+        Given a buffer storing its state in a file
+        When I send an event with the traceparent "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+        And the buffer is restarted indexing traces
+        Then polling for the trace "4bf92f3577b34da6a3ce929d0e0e4736" should return 1 event
+
+    Scenario: traces can't be looked up without the trace index
+        When I send an event with the traceparent "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+        Then polling for the trace "4bf92f3577b34da6a3ce929d0e0e4736" should be rejected as invalid
+
+    Scenario: polls of rate limited consumers wait for their budget
+        Given a buffer delivering at most 1 event per second to the consumer "c1"
+        And 3 events in the buffer
+        Then polling as the consumer "c1" waiting 100ms should return 1 event
+        And polling as the consumer "c1" waiting 100ms should return 0 events
+        And polling as the consumer "c2" waiting 100ms should return 3 events
+
+    Scenario: principals are rate limited whatever consumer they name
+        Given a buffer accepting the token "reports:t1" delivering at most 1 event per second to "reports"
+        And 3 events in the buffer
+        Then polling with the token "t1" waiting 100ms should return 1 event
+        And polling with the token "t1" waiting 100ms should return 0 events
@@ -0,0 +1,45 @@
+Feature: redactions
+
+    Scenario: redacted events are tombstoned
+        Given an event with the payload {"user":"alice"} in the buffer
+        And an event with the payload {"user":"bob"} in the buffer
+        When "dpo" redacts the first event because "erasure request"
+        Then the buffer should hold the payloads [null, {"user":"bob"}]
+
+    Scenario: redacted events are overwritten with a replacement
+        Given an event with the payload {"user":"alice"} in the buffer
+        And an event with the payload {"user":"bob"} in the buffer
+        When "dpo" redacts the first event with the replacement {"user":"redacted"} because "erasure request"
+        Then the buffer should hold the payloads [{"user":"redacted"}, {"user":"bob"}]
+
+    Scenario: redactions select events by a JSON pointer
+        Given an event with the payload {"user":"bob"} in the buffer
+        And an event with the payload {"user":"alice","total":3} in the buffer
+        When "dpo" redacts the events where /user is "alice" because "erasure request"
+        Then the buffer should hold the payloads [{"user":"bob"}, null]
+
+    Scenario: redactions erase events of topics
+        Given a topic "orders"
+        And an event with the payload {"user":"bob"} in the buffer
+        And an event with the payload {"user":"alice"} in the topic "orders"
+        When "dpo" redacts the events where /user is "alice" because "erasure request"
+        Then the topic "orders" should hold the payloads [null]
+        And the buffer should hold the payloads [{"user":"bob"}]
+
+    Scenario: redactions are audited
+        Given an event with the payload {"user":"alice"} in the buffer
+        When "dpo" redacts the first event because "erasure request"
+        Then the redaction should be audited with the principal "dpo", the reason "erasure request" and the mode "tombstone"
+        And the redaction should name the retained copies ""
+
+    Scenario: redactions need a reason
+        Given an event with the payload {"user":"alice"} in the buffer
+        Then redacting the first event without a reason should fail
+        And the buffer should hold the payloads [{"user":"alice"}]
+
+    Scenario: redactions name the archived copies they can't rewrite
+        Given a buffer archiving its events and holding at most 2 events
+        And events of the types "order,order,order" in the buffer
+        When the buffer is pruned at its retention period
+        And "dpo" redacts the events where /seq is 3 because "erasure request"
+        Then the redaction should name the retained copies "archive"
@@ -0,0 +1,31 @@
+Feature: replication
+
+    Scenario: a follower copies the events of its primary
+        Given one event in the buffer
+        And a follower of the buffer
+        When there is a new event sent to the buffer
+        Then polling the follower should return both events
+        And the follower should have the same ids as the buffer
+
+    Scenario: events are stored after replicated events ahead of the clock
+        Given a follower of a primary with an event from the future
+        When I publish an event to the follower
+        Then the event should be stored after the event from the future
+        And the metrics should count a clock skew
+
+    Scenario: clients discover the peers of a buffer
+        Given a buffer peering with the replica "eu-2" at "https://eu-2.example.com"
+        When I list the peers
+        Then the catalog should describe the instance as the primary at its URL
+        And the catalog should list the replica "eu-2" at "https://eu-2.example.com"
+
+    Scenario: peers need a role and an http url
+        Then starting a buffer peering with the leader "eu-2" at "https://eu-2.example.com" should fail
+        And starting a buffer peering with the replica "eu-2" at "ftp://eu-2.example.com" should fail
+
+    Scenario: clients fail over to the peers listed in the catalog
+        Given a buffer listing unavailable peers
+        And a client discovering the buffers from the peers catalog
+        When I send a single event
+        And I poll for the events
+        Then I should receive the buffered event
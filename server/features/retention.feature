@@ -0,0 +1,115 @@
+Feature: retention
+
+    Scenario: acknowledged events are pruned before the retention period
+        Given a buffer with acknowledgement-based retention
+        And two events in the buffer
+        When I poll for one event
+        And the consumer "c1" acknowledges the polled event
+        And the buffer is pruned at its retention period
+        Then the buffer should still have one event
+
+    Scenario: events are kept until all consumers acknowledged them
+        Given a buffer with acknowledgement-based retention
+        And two events in the buffer
+        When I poll for one event
+        And the consumer "c1" acknowledges the polled event
+        And the consumer "c2" is registered before the first event
+        And the buffer is pruned at its retention period
+        Then the buffer should still have two events
+
+    Scenario: prunes remove more events than fit in one transaction
+        Given 2500 events in the buffer
+        When all events are pruned
+        Then the buffer should be empty
+        And the buffer should have counted 2500 pruned events
+
+    Scenario: segments of the payload log are deleted once their events are pruned
+        Given a buffer with a payload log
+        And an event with the payload {"data":"stored in the payload log"} in the buffer
+        When I poll for the raw events
+        Then the polled payload should be {"data":"stored in the payload log"}
+        And the integrity check should report no problems
+        And an event with the payload {"data":"stored in the next segment"} in the buffer
+        And the payload log should have 2 segments
+        When all events are pruned
+        Then the payload log should have 1 segment
+
+    Scenario: the oldest events of all streams are pruned beyond the event budget
+        Given a buffer holding at most 2 events
+        And a topic "orders"
+        And events of the types "order,order" in the buffer
+        When I send an event to the topic "orders"
+        And events of the types "order" in the buffer
+        And the buffer is pruned at its retention period
+        And I poll for events of the type "order"
+        Then I should get the events numbered "3"
+        And polling the topic "orders" should return only its event
+        And the integrity check should report no problems
+
+    Scenario: the oldest events are pruned beyond the byte budget
+        Given a buffer holding at most 50 bytes of payloads
+        And events of the types "order,order,order" in the buffer
+        And the buffer should store 72 bytes of payloads
+        When the buffer is pruned at its retention period
+        And I poll for events of the type "order"
+        Then I should get the events numbered "2,3"
+        And the buffer should store 48 bytes of payloads
+        And the prune should report 1 removed event and 24 reclaimed bytes
+        When all events are pruned
+        Then the buffer should store 0 bytes of payloads
+        And the prune should report 2 removed events and 48 reclaimed bytes
+
+    Scenario: prune subscriptions are notified of the removed events
+        Given a prune subscription "mirror"
+        And a topic "orders"
+        And events of the types "order,order,order" in the buffer
+        And I send an event to the topic "orders"
+        When the buffer is pruned at its retention period
+        Then the subscription should not have been notified
+        When all events are pruned
+        Then the subscription "mirror" should have been notified of the events numbered 1 to 3
+        And the subscription "mirror" should have been notified of the events numbered 1 to 1 of the topic "orders"
+
+    Scenario: prune subscriptions need an http url
+        Then subscribing to prunes at "ftp://mirror" should be rejected
+
+    Scenario: events are archived before they are pruned
+        Given a buffer archiving its events
+        And events of the types "order,order,order" in the buffer
+        When the buffer is pruned at its retention period
+        Then the archive should hold no events
+        When all events are pruned
+        Then the archive should hold the events numbered "1,2,3"
+        And the prune should report 3 archived events
+        And the buffer should be empty
+
+    Scenario: events pruned beyond the event budget are archived
+        Given a buffer archiving its events and holding at most 2 events
+        And events of the types "order,order,order" in the buffer
+        When the buffer is pruned at its retention period
+        And I poll for events of the type "order"
+        Then I should get the events numbered "2,3"
+        And the archive should hold the events numbered "1,2,3"
+
+    Scenario: events are kept while the archive is unavailable
+        Given a buffer archiving its events to an unavailable store
+        And events of the types "order,order" in the buffer
+        Then pruning all events should fail
+        And the buffer should still have two events
+
+    Scenario: polls continue from the archive into the buffer
+        Given a buffer archiving its events
+        And events of the types "order,order,order" in the buffer
+        And all events are pruned
+        And events of the types "order,order" in the buffer
+        When I poll for 2 events from the time "2000-01-01T00:00:00Z"
+        Then I should get the events numbered "1,2"
+        When I poll for 2 events after the last polled event
+        Then I should get the events numbered "3,4"
+        When I poll for 2 events after the last polled event
+        Then I should get the events numbered "5"
+
+    Scenario: polls from a time before pruned events need an archive
+        Given events of the types "order,order" in the buffer
+        And all events are pruned
+        Then polling from the time "2000-01-01T00:00:00Z" should report pruned events
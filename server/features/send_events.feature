@@ -3,3 +3,208 @@ Feature: send events
     Scenario: send a single event
         When I send a single event
         Then I should get a confirmation
+
+    Scenario Outline: send compressed events
+        When I send an event compressed with <encoding>
+        And I poll for the events
+        Then I should receive the buffered event
+
+        Examples:
+            | encoding |
+            | gzip     |
+            | zstd     |
+
+    Scenario: spool events while the buffer is unreachable
+        When I send an event while the buffer is unreachable
+        And the buffer becomes reachable again
+        And I poll for the events
+        Then I should receive the buffered event
+
+    Scenario: fall back to an alternate buffer
+        When I send an event to an unreachable buffer with an alternate
+        And I poll for the events
+        Then I should receive the buffered event
+
+    Scenario: publish to the backup when the primary is unreachable
+        When I send an event with an unreachable primary and a backup
+        And I poll for the events
+        Then I should receive the buffered event
+
+    Scenario: publish a batch of events atomically
+        Given one event in the buffer
+        When I publish a batch of two events
+        Then the batch should be assigned the sequence numbers 2 to 3
+        And polling should return the batch after the first event
+
+    Scenario: payloads with delimiters in strings and nested values are kept intact
+        Given an event with the payload {"s": "a,]\"b", "n": [1, {"x": "}"}]} in the buffer
+        When I poll for the raw events
+        Then the polled payload should be {"s":"a,]\"b","n":[1,{"x":"}"}]}
+
+    Scenario: events keep the traceparent they were published with
+        When I send an event with the traceparent "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+        Then the event should have the traceparent "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+    Scenario: invalid traceparents are not stored
+        When I send an event with the traceparent "00-not-a-trace-01"
+        Then the event should have no traceparent
+
+    Scenario: events older than the maximum publish age are rejected
+        Given a buffer rejecting events older than 1h
+        When I send an event that occurred 2h ago
+        Then the publish should be rejected as stale
+
+    Scenario: events within the maximum publish age are accepted
+        Given a buffer rejecting events older than 1h
+        When I send an event that occurred 10m ago
+        Then the publish should be accepted
+
+    Scenario: the retention period bounds the maximum publish age
+        Given a buffer with a retention period of 30m rejecting events older than 1h
+        When I send an event that occurred 45m ago
+        Then the publish should be rejected as stale
+
+    Scenario Outline: payloads are compressed in the state file
+        Given a buffer compressing stored payloads with <compression>
+        And a large compressible event in the buffer
+        Then polling should return the large event
+        And the event should be stored compressed with <compression>
+        And the integrity check should report no problems
+
+        Examples:
+            | compression |
+            | zstd        |
+            | snappy      |
+
+    Scenario: deduplicated payloads are compressed in the state file
+        Given a buffer compressing and deduplicating stored payloads with zstd
+        And a large compressible event in the buffer
+        Then polling should return the large event
+        And the event should be stored compressed with zstd
+        And the integrity check should report no problems
+
+    Scenario: ids of concurrent publishes grow in the order they are stored
+        When 20 batches of 5 events are published concurrently
+        Then the ids of the batches should grow with their sequence numbers
+
+    Scenario: payloads are encrypted in the state file
+        Given a buffer encrypting payloads with the key "k1"
+        And an event with the payload {"card":"4111-1111-1111-1111"} in the buffer
+        Then the state file should not contain "4111-1111-1111-1111"
+        And the events should be encrypted with the keys "k1"
+        And the integrity check should report no problems
+
+    Scenario: deduplicated payloads are encrypted in the state file
+        Given a buffer encrypting and deduplicating payloads with the key "k1"
+        And an event with the payload {"card":"4111-1111-1111-1111"} in the buffer
+        Then the state file should not contain "4111-1111-1111-1111"
+        And the events should be encrypted with the keys "k1"
+        And the integrity check should report no problems
+
+    Scenario: payloads stay readable after a key rotation
+        Given a buffer encrypting payloads with the key "k1"
+        And an event with the payload {"n":1} in the buffer
+        When the buffer is restarted with the keys "k2,k1"
+        And an event with the payload {"n":2} in the buffer
+        Then the events should be encrypted with the keys "k1,k2"
+        And the integrity check should report no problems
+
+    Scenario: payloads of removed keys can't be read
+        Given a buffer encrypting payloads with the key "k1"
+        And an event with the payload {"n":1} in the buffer
+        When the buffer is restarted with the keys "k2"
+        Then the integrity check should report an unreadable payload
+
+    Scenario: offloaded payloads are encrypted in the object store
+        Given a buffer encrypting payloads with the key "k1" and offloading payloads of at least 10 bytes
+        And an event with the payload {"card":"4111-1111-1111-1111"} in the buffer
+        Then the object store should hold 1 offloaded payloads
+        And the object store should not contain "4111-1111-1111-1111"
+        When I poll for the raw events
+        Then the polled payload should be {"card":"4111-1111-1111-1111"}
+
+    Scenario: archived events are encrypted in the archive
+        Given a buffer encrypting payloads with the key "k1" and archiving its events
+        And an event with the payload {"card":"4111-1111-1111-1111"} in the buffer
+        When all events are pruned
+        Then the archive should not contain "4111-1111-1111-1111"
+        When I poll for the raw events from the time "2000-01-01T00:00:00Z"
+        Then the polled payload should be {"card":"4111-1111-1111-1111"}
+
+    Scenario: shipped WAL segments are encrypted
+        Given a buffer encrypting payloads with the key "k1"
+        And the buffer ships its WAL
+        And an event with the payload {"card":"4111-1111-1111-1111"} in the buffer
+        Then the WAL should not contain "4111-1111-1111-1111"
+        When the WAL is replayed into an empty state
+        Then the state file should not contain "4111-1111-1111-1111"
+        When I poll for the raw events
+        Then the polled payload should be {"card":"4111-1111-1111-1111"}
+
+    Scenario: ids of events carry the id prefix of the buffer
+        Given a buffer generating ids with the prefix "eu-1"
+        And 3 events in the buffer
+        Then the ids of the events should start with "eu-1:"
+        And the integrity check should report no problems
+
+    Scenario: the id prefix can't change while events are stored
+        Given a buffer generating ids with the prefix "eu-1"
+        And one event in the buffer
+        Then restarting the buffer with the id prefix "eu-2" should fail
+
+    Scenario: retried batches with an idempotency key are stored once
+        Given a buffer remembering idempotency keys
+        When I publish a batch with the idempotency key "batch-1" twice
+        Then the buffer should have 2 events
+
+    Scenario: retried events with an idempotency key field are stored once
+        Given a buffer remembering idempotency keys
+        When I send an event with the idempotency key field "evt-1" twice
+        Then the buffer should have 1 event
+
+    Scenario: clients retry publishes with their idempotency key
+        Given a buffer remembering idempotency keys
+        When I send events once with the key "evt-1" twice
+        Then the buffer should have 1 event
+
+    Scenario: idempotency keys are ignored without an idempotency window
+        When I send an event with the idempotency key field "evt-1" twice
+        Then the buffer should have 2 events
+
+    Scenario: retried publishes of a producer session are stored once
+        Given the producer "orders" registers a session
+        When the session publishes the sequence 1
+        And the session publishes the sequence 1 again
+        And the session publishes the sequence 2
+        Then the buffer should have 2 events
+
+    Scenario: sequences of a producer session have to follow each other
+        Given the producer "orders" registers a session
+        And the session publishes the sequence 1
+        Then publishing the sequence 3 should be rejected as out of order
+
+    Scenario: a new session of a producer fences the previous one
+        Given the producer "orders" registers a session
+        And the session publishes the sequence 1
+        When the producer "orders" registers a session
+        Then publishing with the first session should be rejected as fenced
+        And the session should continue after the sequence 1
+        And the buffer should have 1 event
+
+    Scenario: publishes are rejected with a Retry-After while the write queue is full
+        Given a buffer with 1 write slot and a write queue of 1
+        And 2 publishes waiting for their body
+        Then publishing should be rejected with a Retry-After
+        When the waiting publishes are sent
+        Then publishing should be accepted again
+
+    Scenario: identical payloads share one blob until all their events are pruned
+        Given a buffer storing its state in a file and deduplicating payloads
+        When the payload {"data":"shared"} is published twice
+        Then the state should hold 1 blob with 2 references
+        When the first of the events is pruned
+        Then the state should hold 1 blob with 1 reference
+        When I poll for the raw events
+        Then the polled payload should be {"data":"shared"}
+        When all events are pruned
+        Then the state should hold no blobs
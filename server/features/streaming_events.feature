@@ -0,0 +1,26 @@
+Feature: streaming events
+
+    Scenario: streaming buffered and appended events
+        Given two events in the buffer
+        When I start streaming the events
+        And there is a new event sent to the buffer
+        Then the stream should deliver all three events
+
+    Scenario: resuming a stream after an event
+        Given two events in the buffer
+        When I poll for one event
+        And I start streaming the events after the previous event
+        Then the stream should deliver only the other event
+
+    Scenario: streaming only events of a type
+        Given events of the types "order.created,order.paid,order.paid" in the buffer
+        When I start streaming events of the type "order.paid"
+        And an event of the type "order.created" is sent
+        And an event of the type "order.paid" is sent
+        Then the stream should deliver the events numbered "2,3,5"
+
+    Scenario: streaming compressed events
+        Given two events in the buffer
+        When I start streaming the events accepting gzip
+        And there is a new event sent to the buffer
+        Then the stream should deliver all three events
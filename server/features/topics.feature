@@ -0,0 +1,59 @@
+Feature: topics
+
+    Scenario: events of a topic are kept apart from the buffer
+        Given a topic "orders"
+        And one event in the buffer
+        When I send an event to the topic "orders"
+        Then polling the topic "orders" should return only its event
+
+    Scenario: publishing to a topic that does not exist
+        When I send an event to the topic "missing"
+        Then the publish should be rejected as not found
+
+    Scenario: topics are pruned at their own retention period
+        Given a topic "short" with a retention period of 1ms
+        And one event in the buffer
+        When I send an event to the topic "short"
+        And the retention period of the topic has passed
+        Then the topic "short" should have no events
+        And the buffer should still have one event
+
+    Scenario: topics of a sharded state are stored in their shards
+        Given a buffer with its topics sharded across 3 files
+        And a topic "orders"
+        And a topic "payments"
+        And one event in the buffer
+        When I send an event to the topic "orders"
+        And I send an event to the topic "payments"
+        Then polling the topic "orders" should return only its event
+        And polling the topic "payments" should return only its event
+        And the topics "orders" and "payments" should each be stored in one shard
+        And the buffer should still have one event
+
+    Scenario: prunes are published to the system topic
+        Given a buffer publishing system events
+        And one event in the buffer
+        When all events are pruned
+        Then the system topic should hold a prune of 1 removed event
+        And publishing to the system topic should be forbidden
+
+    Scenario: integrity checks cover topics
+        Given a buffer encrypting payloads with the key "k1"
+        And a topic "orders"
+        And an event with the payload {"n":1} in the topic "orders"
+        When the buffer is restarted with the keys "k2"
+        Then the integrity check should report an unreadable payload of the topic "orders"
+
+    Scenario: stats describe topics
+        Given a topic "orders"
+        And an event with the payload {"n":1} in the topic "orders"
+        Then the stats should describe the topic "orders" with 1 event
+
+    Scenario: bundles carry the events of a topic
+        Given a topic "orders"
+        And an event with the payload {"n":1} in the buffer
+        And an event with the payload {"n":2} in the topic "orders"
+        When the topic "orders" is exported as a bundle
+        And the bundle is imported into a new buffer with the topic "orders"
+        Then the topic "orders" should hold the payloads [{"n":2}]
+        And the buffer should have no events
@@ -0,0 +1,24 @@
+Feature: usage accounting
+
+    Scenario: usage is accounted to the principal of the request
+        Given a buffer accepting the tokens "reader:r-token:read" and "writer:w-token:write"
+        When I send an event with the token "w-token"
+        And polling with the token "r-token" should return the event
+        Then "writer" should have published 1 event of 6 bytes today
+        And "reader" should have consumed 1 event of 6 bytes today
+        And "reader" should have published 0 events of 0 bytes today
+
+    Scenario: flushed usage is reported once
+        Given a buffer accepting the tokens "reader:r-token:read" and "writer:w-token:write"
+        When I send an event with the token "w-token"
+        And the usage is flushed
+        And I send an event with the token "w-token"
+        Then "writer" should have published 2 events of 12 bytes today
+        When the usage is flushed
+        Then "writer" should have published 2 events of 12 bytes today
+
+    Scenario: requests without authentication are accounted as anonymous
+        Given one event in the buffer
+        When I poll for one event
+        Then "anonymous" should have published 1 event of 6 bytes today
+        And "anonymous" should have consumed 1 event of 6 bytes today
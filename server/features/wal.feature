@@ -0,0 +1,47 @@
+Feature: WAL shipping
+
+    Scenario: appended events are shipped as WAL segments
+        Given a buffer shipping its WAL
+        And 3 events in the buffer
+        Then the WAL should hold 3 events
+
+    Scenario: the WAL is replayed into an empty state
+        Given a buffer shipping its WAL
+        And 3 events in the buffer
+        And the WAL should hold 3 events
+        When the WAL is replayed into an empty state
+        Then 3 events should have been replayed
+        And the buffer should have 3 events
+
+    Scenario: the WAL is replayed up to a point in time
+        Given a buffer shipping its WAL
+        And 2 events in the buffer
+        And the WAL should hold 2 events
+        And a moment passes
+        And 1 event in the buffer
+        And the WAL should hold 3 events
+        When the WAL is replayed into an empty state until the moment
+        Then 2 events should have been replayed
+        And the buffer should have 2 events
+
+    Scenario: segments of events older than the cutoff are pruned
+        Given a buffer shipping its WAL
+        And 2 events in the buffer
+        And the WAL should hold 2 events
+        And a moment passes
+        And 1 event in the buffer
+        And the WAL should hold 3 events
+        When the WAL is pruned before the moment
+        Then the WAL should hold 1 event
+
+    Scenario: topics are shipped and replayed with their config
+        Given a buffer shipping its WAL
+        And a topic "orders" with a retention period of 1h
+        And an event with the payload {"n":1} in the buffer
+        And an event with the payload {"n":2} in the topic "orders"
+        And the WAL should hold 2 events
+        When the WAL is replayed into an empty state
+        Then 2 events should have been replayed
+        And the buffer should hold the payloads [{"n":1}]
+        And the topic "orders" should hold the payloads [{"n":2}]
+        And the topic "orders" should have a retention period of 1h0m0s
@@ -0,0 +1,7 @@
+Feature: WebSocket API
+
+    Scenario: publishing and consuming over one connection
+        Given a WebSocket connection subscribed as consumer "ws"
+        When I publish two events over the WebSocket
+        Then the WebSocket should deliver both events
+        And acknowledging the last event should move the cursor of "ws"
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Polls and streams of Server-Sent Events can be narrowed to matching
+// events, so consumers interested in a few kinds of events don't download
+// the others. ?type=<value> matches payloads with that value in their top
+// level type field, several of them match any of the values.
+// ?match=<json pointer>=<value> matches payloads with the value at the
+// pointer, it is compared as JSON when it is valid JSON and as a string
+// otherwise, so 42 matches a number and "42" a string. Events have to
+// match all match parameters and one of the types.
+//
+// Filters see payloads as the consumer would, after redaction, so events
+// can't be selected by fields that are stripped or masked for it. Events
+// that don't match are skipped like events of seen sets, a poll returns
+// without events but with the X-Buffer-Scanned header when it skipped
+// maxSkippedEvents.
+const maxEventFilters = 32
+
+type eventFilter struct {
+	types  []*PayloadMatcher
+	fields []*PayloadMatcher
+}
+
+// parseEventFilter returns the filter of the query of a read, nil when it
+// has none.
+func parseEventFilter(q url.Values) (*eventFilter, error) {
+	types, matches := q["type"], q["match"]
+	if len(types) == 0 && len(matches) == 0 {
+		return nil, nil
+	}
+
+	if len(types)+len(matches) > maxEventFilters {
+		return nil, fmt.Errorf("at most %d type and match filters are supported", maxEventFilters)
+	}
+
+	f := &eventFilter{}
+	for _, t := range types {
+		v, err := json.Marshal(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid type filter %q: %w", t, err)
+		}
+		m, err := NewPayloadMatcher("/type", v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid type filter %q: %w", t, err)
+		}
+		f.types = append(f.types, m)
+	}
+
+	for _, match := range matches {
+		pointer, value, found := strings.Cut(match, "=")
+		if !found {
+			return nil, fmt.Errorf("match filter %q must be <json pointer>=<value>", match)
+		}
+
+		v := json.RawMessage(value)
+		if !json.Valid(v) {
+			var err error
+			v, err = json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid match filter %q: %w", match, err)
+			}
+		}
+
+		m, err := NewPayloadMatcher(pointer, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match filter %q: %w", match, err)
+		}
+		f.fields = append(f.fields, m)
+	}
+
+	return f, nil
+}
+
+// matches returns whether a payload redacted with redactions matches the
+// filter.
+func (f *eventFilter) matches(payload json.RawMessage, redactions []compiledRedactionRule) (bool, error) {
+	var doc any
+	err := json.Unmarshal(payload, &doc)
+	if err != nil {
+		return false, fmt.Errorf("could not parse payload: %w", err)
+	}
+
+	redactDoc(doc, redactions)
+
+	for _, m := range f.fields {
+		if !m.matchesDoc(doc) {
+			return false, nil
+		}
+	}
+
+	if len(f.types) == 0 {
+		return true, nil
+	}
+
+	for _, m := range f.types {
+		if m.matchesDoc(doc) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
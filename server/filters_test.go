@@ -0,0 +1,189 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+	"github.com/google/go-cmp/cmp"
+)
+
+type orderEvent struct {
+	Type string `json:"type"`
+	Seq  int    `json:"seq"`
+}
+
+func seqs(evts []orderEvent) []string {
+	numbers := []string{}
+	for _, e := range evts {
+		numbers = append(numbers, strconv.Itoa(e.Seq))
+	}
+	return numbers
+}
+
+// sendOrderEvent sends an event of the type, numbered by the events sent
+// in the scenario so far.
+func sendOrderEvent(ctx context.Context, typ string) error {
+	s := getState(ctx)
+	s.orderSeq++
+	return s.client.SendEvents(ctx, []any{orderEvent{Type: typ, Seq: s.orderSeq}})
+}
+
+func eventsOfTheTypesInTheBuffer(ctx context.Context, types string) error {
+	for _, t := range strings.Split(types, ",") {
+		err := sendOrderEvent(ctx, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pollFiltered(ctx context.Context, f client.Filter) error {
+	s := getState(ctx)
+	evts := []orderEvent{}
+	_, err := s.client.PollFiltered(ctx, f, "", 10, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+	s.pollResult = seqs(evts)
+	return nil
+}
+
+func iPollForEventsOfTheType(ctx context.Context, typ string) error {
+	return pollFiltered(ctx, client.Filter{Types: []string{typ}})
+}
+
+func iPollForEventsWhereIs(ctx context.Context, pointer string, value int) error {
+	return pollFiltered(ctx, client.Filter{Fields: map[string]any{pointer: value}})
+}
+
+func iShouldGetTheEventsNumbered(ctx context.Context, numbers string) error {
+	s := getState(ctx)
+	d := cmp.Diff(s.pollResult, strings.Split(numbers, ","))
+	if d != "" {
+		return fmt.Errorf("unexpected poll result:\n%s", d)
+	}
+	return nil
+}
+
+func iStartPollingForEventsOfTheType(ctx context.Context, typ string) error {
+	s := getState(ctx)
+	s.longPollResult = make(chan eventsOrError, 1)
+	go func() {
+		evts := []orderEvent{}
+		_, err := s.client.PollFiltered(ctx, client.Filter{Types: []string{typ}}, "", 10, sortAsc, &evts)
+		s.longPollResult <- eventsOrError{events: seqs(evts), err: err}
+	}()
+	return nil
+}
+
+func anEventOfTheTypeIsSent(ctx context.Context, typ string) error {
+	return sendOrderEvent(ctx, typ)
+}
+
+func theFilteredPollShouldReturnOnlyTheEventNumbered(ctx context.Context, number string) error {
+	s := getState(ctx)
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("could not get long poll event: %w", ctx.Err())
+	case res := <-s.longPollResult:
+		if res.err != nil {
+			return fmt.Errorf("long poll failed: %w", res.err)
+		}
+		d := cmp.Diff(res.events, []string{number})
+		if d != "" {
+			return fmt.Errorf("unexpected poll result:\n%s", d)
+		}
+	}
+	return nil
+}
+
+func iStartStreamingEventsOfTheType(ctx context.Context, typ string) error {
+	s := getState(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.serverBaseURL+"/events/stream?"+url.Values{"type": {typ}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	s.streamed = make(chan string, 10)
+	go func() {
+		defer res.Body.Close()
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			line := sc.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			e := orderEvent{}
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e) == nil {
+				s.streamed <- strconv.Itoa(e.Seq)
+			}
+		}
+	}()
+	return nil
+}
+
+func theStreamShouldDeliverTheEventsNumbered(ctx context.Context, numbers string) error {
+	expected := strings.Split(numbers, ",")
+	evts, err := streamedEvents(ctx, len(expected))
+	if err != nil {
+		return err
+	}
+
+	d := cmp.Diff(evts, expected)
+	if d != "" {
+		return fmt.Errorf("unexpected stream result:\n%s", d)
+	}
+	return nil
+}
+
+func aBufferStrippingForTheConsumer(ctx context.Context, pointer, consumer string) error {
+	return startBuffer(ctx, server.Options{
+		RedactionRules: []server.RedactionRule{{Consumers: []string{consumer}, Strip: []string{pointer}}},
+	})
+}
+
+func theConsumerPollingForEventsWhereIsShouldGetEvents(ctx context.Context, consumer, pointer string, value, expected int) error {
+	s := getState(ctx)
+	q := url.Values{
+		"match":    {fmt.Sprintf("%s=%d", pointer, value)},
+		"consumer": {consumer},
+		"wait":     {"0"},
+	}
+	res, err := http.Get(s.serverBaseURL + "/events?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	evts := []json.RawMessage{}
+	err = json.NewDecoder(res.Body).Decode(&evts)
+	if err != nil {
+		return fmt.Errorf("could not decode events: %w", err)
+	}
+	if len(evts) != expected {
+		return fmt.Errorf("expected %d events, got %d", expected, len(evts))
+	}
+	return nil
+}
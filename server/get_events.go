@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/draganm/bolted"
+)
+
+// maxGetEvents limits the number of ids of a single POST /events/get.
+const maxGetEvents = 1000
+
+// getEvents returns the events with the requested ids in the order of
+// their ids, ids of events that don't exist (anymore) are left out.
+func (s *Server) getEvents(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+
+	st, err := s.requestStream(r)
+	if err != nil {
+		http.Error(w, err.Error(), streamErrorStatus(err))
+		return
+	}
+
+	envelope, err := parseEnvelope(r, s.opts.CloudEvents)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if envelope == envelopeCloudEventsBinary {
+		http.Error(w, "the binary content mode has room for one event, use the cloudevents envelope", http.StatusBadRequest)
+		return
+	}
+
+	ids := []string{}
+	err = json.NewDecoder(r.Body).Decode(&ids)
+	if err != nil {
+		log.Error(err, "could not decode request")
+		http.Error(w, fmt.Errorf("could not decode request: %w", err).Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(ids) > maxGetEvents {
+		http.Error(w, fmt.Errorf("requested %d events, at most %d are allowed", len(ids), maxGetEvents).Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, id := range ids {
+		_, err = eventTime(id)
+		if err != nil {
+			http.Error(w, fmt.Errorf("invalid event id: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sort.Strings(ids)
+
+	s.serveEventsByID(w, r, st, envelope, ids)
+}
+
+// serveEventsByID responds with the events of a stream with the sorted
+// ids, ids of events that don't exist (anymore) are left out.
+func (s *Server) serveEventsByID(w http.ResponseWriter, r *http.Request, st stream, envelope string, ids []string) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+
+	redactions := s.deliveryRedactions(r)
+
+	release, _, err := s.readScheduler.acquire(r.Context(), s.readerKey(r))
+	if err != nil {
+		http.Error(w, fmt.Errorf("request context cancelled: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+	defer release()
+
+	events := make([]event, 0, len(ids))
+	head := ""
+	err = bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		head = headPosition(tx, st.events)
+		for i, id := range ids {
+			if err := disconnected(r.Context()); err != nil {
+				return err
+			}
+
+			if i > 0 && ids[i-1] == id {
+				continue
+			}
+
+			path := st.events.Append(id)
+			if !tx.Exists(path) {
+				continue
+			}
+
+			payload, err := s.loadPayload(r.Context(), tx, tx.Get(path))
+			if err != nil {
+				return fmt.Errorf("could not load event %s: %w", id, err)
+			}
+
+			if len(redactions) > 0 {
+				payload, err = redactPayload(payload, redactions)
+				if err != nil {
+					return fmt.Errorf("could not redact event %s: %w", id, err)
+				}
+			}
+
+			e := event{id: id, payload: payload}
+			if s.retentionPeriod(st) > 0 && envelope == envelopeFull {
+				t, err := eventTime(id)
+				if err != nil {
+					return err
+				}
+				e.expires = t.Add(s.retentionPeriod(st))
+			}
+
+			events = append(events, e)
+		}
+		return nil
+	})
+
+	if disconnected(r.Context()) != nil {
+		return
+	}
+
+	if err != nil {
+		log.Error(err, "could not read events")
+		http.Error(w, fmt.Errorf("could not read events: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.recordConsumed(r, events)
+
+	if envelope != envelopeLean {
+		setHeadHeaders(w, head)
+	}
+	if envelope == envelopeCloudEvents {
+		w.Header().Set("content-type", cloudEventsBatchContentType)
+		err = writeCloudEvents(w, events)
+	} else {
+		w.Header().Set("content-type", "application/json")
+		err = writeEvents(w, events)
+	}
+	if err != nil {
+		log.Error(err, "could not write events")
+	}
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/event-buffer/eventbufferpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcService serves the gRPC API. Calls are adapted to HTTP requests, so
+// delivery rules, rate limits, usage and read scheduling apply like to the
+// HTTP API.
+type grpcService struct {
+	eventbufferpb.UnimplementedEventBufferServer
+	s *Server
+}
+
+// RegisterGRPC registers the gRPC API of the buffer.
+func (s *Server) RegisterGRPC(g *grpc.Server) {
+	eventbufferpb.RegisterEventBufferServer(g, &grpcService{s: s})
+}
+
+// grpcRequest returns the HTTP request equivalent to a call, for the
+// helpers shared with the HTTP API.
+func grpcRequest(ctx context.Context, method, consumer string) *http.Request {
+	q := url.Values{}
+	if consumer != "" {
+		q.Set("consumer", consumer)
+	}
+
+	r := (&http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: method, RawQuery: q.Encode()},
+		Header: http.Header{},
+	}).WithContext(ctx)
+
+	if p, found := peer.FromContext(ctx); found {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	return r
+}
+
+// grpcError converts errors to the status of a call.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrTopicNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errInvalidCloudEvent), errors.Is(err, errInvalidOccurrence):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errStaleEvent):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, errReadOnlyTopic):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, errWriteQueueFull):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (g *grpcService) Publish(ctx context.Context, req *eventbufferpb.PublishRequest) (*eventbufferpb.PublishResponse, error) {
+	ctx = grpcTraceParent(ctx)
+	st, err := g.s.namedStream(req.Topic)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	events := make([]json.RawMessage, len(req.Payloads))
+	for i, p := range req.Payloads {
+		if !json.Valid(p) {
+			return nil, status.Errorf(codes.InvalidArgument, "payload %d is not valid JSON", i)
+		}
+		events[i] = p
+	}
+
+	release, err := g.s.writeSlots.acquire(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	ids, err := g.s.appendEvents(ctx, st, events)
+	release()
+	if err != nil {
+		g.s.log.Error(err, "could not append events")
+		return nil, grpcError(err)
+	}
+
+	g.s.recordPublished(grpcRequest(ctx, eventbufferpb.EventBuffer_Publish_FullMethodName, ""), events)
+
+	return &eventbufferpb.PublishResponse{Ids: ids}, nil
+}
+
+// checkCursor fails with OUT_OF_RANGE when the cursor has been pruned.
+func (g *grpcService) checkCursor(st stream, after string) error {
+	if after == "" {
+		return nil
+	}
+
+	expired, err := g.s.cursorExpired(st, after)
+	if err != nil {
+		return grpcError(err)
+	}
+
+	if expired != nil {
+		return status.Errorf(codes.OutOfRange, "%s, oldest event is %q", expired.Error, expired.Oldest)
+	}
+
+	return nil
+}
+
+// toProto converts events, setting their expiry when the stream has a
+// retention period.
+func (g *grpcService) toProto(st stream, events []event) ([]*eventbufferpb.Event, error) {
+	retention := g.s.retentionPeriod(st)
+
+	pb := make([]*eventbufferpb.Event, len(events))
+	for i, e := range events {
+		pb[i] = &eventbufferpb.Event{Id: e.id, Payload: e.payload}
+		if retention == 0 {
+			continue
+		}
+
+		t, err := eventTime(e.id)
+		if err != nil {
+			return nil, err
+		}
+		pb[i].Expires = timestamppb.New(t.Add(retention))
+	}
+	return pb, nil
+}
+
+func (g *grpcService) Poll(ctx context.Context, req *eventbufferpb.PollRequest) (*eventbufferpb.PollResponse, error) {
+	s := g.s
+
+	st, err := s.namedStream(req.Topic)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	limit := int(req.Limit)
+	switch {
+	case limit == 0:
+		limit = 100
+	case limit < 0 || limit > maxStreamBatch:
+		return nil, status.Errorf(codes.InvalidArgument, "limit has to be between 1 and %d", maxStreamBatch)
+	}
+
+	sort := sortAsc
+	if req.Descending {
+		sort = sortDesc
+	}
+
+	err = g.checkCursor(st, req.After)
+	if err != nil {
+		return nil, err
+	}
+
+	wait := defaultPollWait
+	if req.WaitMs > 0 {
+		wait = time.Duration(req.WaitMs) * time.Millisecond
+	}
+
+	r := grpcRequest(ctx, eventbufferpb.EventBuffer_Poll_FullMethodName, req.Consumer)
+	redactions := s.deliveryRedactions(r)
+
+	changes, done := s.db.Observe(st.events.ToMatcher().AppendAnyElementMatcher())
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	maxBytes := int64(-1)
+	bucket := s.deliveryLimiter.bucket(r)
+	if bucket != nil {
+		var maxEvents int
+		maxEvents, maxBytes, err = bucket.wait(ctx)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		if maxEvents >= 0 && maxEvents < limit {
+			limit = maxEvents
+		}
+	}
+
+	for {
+		select {
+		case <-changes:
+		case <-ctx.Done():
+			return nil, grpcError(ctx.Err())
+		}
+
+		release, _, err := s.readScheduler.acquire(ctx, s.readerKey(r))
+		if err != nil {
+			return nil, grpcError(err)
+		}
+
+		events, _, size, err := s.readStreamEvents(ctx, st, req.After, sort, limit, maxBytes, redactions, nil)
+		release()
+		if err != nil {
+			if disconnected(ctx) == nil {
+				s.log.Error(err, "could not read events")
+			}
+			return nil, grpcError(err)
+		}
+
+		if len(events) == 0 {
+			continue
+		}
+
+		s.recordConsumed(r, events)
+		if bucket != nil {
+			bucket.take(len(events), size)
+		}
+
+		res := &eventbufferpb.PollResponse{}
+		res.Events, err = g.toProto(st, events)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+
+		err = bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+			res.Head = headPosition(tx, st.events)
+			return nil
+		})
+		if err != nil {
+			return nil, grpcError(err)
+		}
+
+		return res, nil
+	}
+}
+
+func (g *grpcService) StreamEvents(req *eventbufferpb.StreamEventsRequest, srv eventbufferpb.EventBuffer_StreamEventsServer) error {
+	s := g.s
+	ctx := srv.Context()
+
+	st, err := s.namedStream(req.Topic)
+	if err != nil {
+		return grpcError(err)
+	}
+
+	err = g.checkCursor(st, req.From)
+	if err != nil {
+		return err
+	}
+
+	r := grpcRequest(ctx, eventbufferpb.EventBuffer_StreamEvents_FullMethodName, req.Consumer)
+	redactions := s.deliveryRedactions(r)
+	bucket := s.deliveryLimiter.bucket(r)
+
+	changes, done := s.db.Observe(st.events.ToMatcher().AppendAnyElementMatcher())
+	defer done()
+
+	after := req.From
+	more := true
+	for {
+		if !more {
+			select {
+			case <-changes:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		limit := maxStreamBatch
+		maxBytes := int64(-1)
+		if bucket != nil {
+			var maxEvents int
+			maxEvents, maxBytes, err = bucket.wait(ctx)
+			if err != nil {
+				return nil
+			}
+			if maxEvents >= 0 && maxEvents < limit {
+				limit = maxEvents
+			}
+		}
+
+		release, _, err := s.readScheduler.acquire(ctx, s.readerKey(r))
+		if err != nil {
+			return nil
+		}
+
+		events, _, size, err := s.readStreamEvents(ctx, st, after, sortAsc, limit, maxBytes, redactions, nil)
+		release()
+		if err != nil {
+			if disconnected(ctx) == nil {
+				s.log.Error(err, "could not read events")
+			}
+			return grpcError(err)
+		}
+
+		more = len(events) > 0
+		if !more {
+			continue
+		}
+
+		s.recordConsumed(r, events)
+		if bucket != nil {
+			bucket.take(len(events), size)
+		}
+
+		pb, err := g.toProto(st, events)
+		if err != nil {
+			return grpcError(err)
+		}
+
+		for _, e := range pb {
+			err = srv.Send(e)
+			if err != nil {
+				return err
+			}
+		}
+
+		after = events[len(events)-1].id
+	}
+}
+
+func (g *grpcService) Prune(ctx context.Context, req *eventbufferpb.PruneRequest) (*eventbufferpb.PruneResponse, error) {
+	if req.Before == nil {
+		return nil, status.Error(codes.InvalidArgument, "before is required")
+	}
+
+	err := req.Before.CheckValid()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid before: %s", err))
+	}
+
+	err = g.s.Prune(req.Before.AsTime())
+	if err != nil {
+		g.s.log.Error(err, "could not prune events")
+		return nil, grpcError(err)
+	}
+
+	return &eventbufferpb.PruneResponse{}, nil
+}
@@ -0,0 +1,122 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/draganm/event-buffer/eventbufferpb"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func aGRPCConnection(ctx context.Context) error {
+	s := getState(ctx)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return err
+	}
+
+	g := grpc.NewServer()
+	s.server.RegisterGRPC(g)
+	go g.Serve(l)
+
+	conn, err := grpc.DialContext(ctx, l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		g.Stop()
+	}()
+
+	s.grpc = eventbufferpb.NewEventBufferClient(conn)
+	return nil
+}
+
+func iPublishTwoEventsOverGRPC(ctx context.Context) error {
+	s := getState(ctx)
+	res, err := s.grpc.Publish(ctx, &eventbufferpb.PublishRequest{Payloads: [][]byte{[]byte(`"evt1"`), []byte(`"evt2"`)}})
+	if err != nil {
+		return err
+	}
+	if len(res.Ids) != 2 {
+		return fmt.Errorf("expected 2 ids, got %v", res.Ids)
+	}
+	return nil
+}
+
+func payloadsOf(events []*eventbufferpb.Event) []string {
+	payloads := []string{}
+	for _, e := range events {
+		payloads = append(payloads, string(e.Payload))
+	}
+	return payloads
+}
+
+func pollingOverGRPCShouldReturnBothEvents(ctx context.Context) error {
+	s := getState(ctx)
+	res, err := s.grpc.Poll(ctx, &eventbufferpb.PollRequest{Limit: 10})
+	if err != nil {
+		return err
+	}
+
+	d := cmp.Diff(payloadsOf(res.Events), []string{`"evt1"`, `"evt2"`})
+	if d != "" {
+		return fmt.Errorf("unexpected poll result:\n%s", d)
+	}
+
+	if res.Head != res.Events[1].Id {
+		return fmt.Errorf("expected head %s, got %q", res.Events[1].Id, res.Head)
+	}
+	return nil
+}
+
+func streamingOverGRPCShouldDeliverBothEvents(ctx context.Context) error {
+	s := getState(ctx)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	stream, err := s.grpc.StreamEvents(ctx, &eventbufferpb.StreamEventsRequest{})
+	if err != nil {
+		return err
+	}
+
+	events := []*eventbufferpb.Event{}
+	for len(events) < 2 {
+		e, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		events = append(events, e)
+	}
+
+	d := cmp.Diff(payloadsOf(events), []string{`"evt1"`, `"evt2"`})
+	if d != "" {
+		return fmt.Errorf("unexpected stream result:\n%s", d)
+	}
+	return nil
+}
+
+func iPruneAllEventsOverGRPC(ctx context.Context) error {
+	s := getState(ctx)
+	_, err := s.grpc.Prune(ctx, &eventbufferpb.PruneRequest{Before: timestamppb.New(time.Now().Add(time.Second))})
+	return err
+}
+
+func theBufferShouldBeEmpty(ctx context.Context) error {
+	st, err := getState(ctx).server.Stats()
+	if err != nil {
+		return err
+	}
+	if st.Events != 0 {
+		return fmt.Errorf("expected no events, got %d", st.Events)
+	}
+	return nil
+}
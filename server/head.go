@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+)
+
+// Poll responses carry the id of the newest event and the time of the
+// server, so consumers can compute their lag without asking for stats.
+const (
+	headHeader       = "X-Buffer-Head"
+	serverTimeHeader = "X-Server-Time"
+)
+
+// headPosition returns the id of the newest of the events, or an empty
+// string if there are none.
+func headPosition(tx bolted.SugaredReadTx, events dbpath.Path) string {
+	it := tx.Iterator(events)
+	it.Last()
+	if it.IsDone() {
+		return ""
+	}
+	return it.GetKey()
+}
+
+func setHeadHeaders(w http.ResponseWriter, head string) {
+	if head != "" {
+		w.Header().Set(headHeader, head)
+	}
+	w.Header().Set(serverTimeHeader, time.Now().UTC().Format(time.RFC3339Nano))
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/event-buffer/alert"
+	"github.com/gorilla/mux"
+)
+
+type heartbeat struct {
+	// Position optionally moves the cursor of the consumer, it is required
+	// for consumers that are not registered yet.
+	Position string `json:"position"`
+}
+
+func (s *Server) consumerHeartbeat(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+	name := mux.Vars(r)["name"]
+
+	hb := heartbeat{}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&hb)
+		if err != nil {
+			log.Error(err, "could not decode request")
+			http.Error(w, fmt.Errorf("could not decode request: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if hb.Position != "" {
+		_, err := eventTime(hb.Position)
+		if err != nil {
+			http.Error(w, fmt.Errorf("invalid position: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	found := true
+	err := bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		path := consumersPath.Append(name)
+		c := consumer{}
+		if tx.Exists(path) {
+			err := json.Unmarshal(tx.Get(path), &c)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal consumer %s: %w", name, err)
+			}
+		} else if hb.Position == "" {
+			found = false
+			return nil
+		}
+
+		now := time.Now().UTC()
+		if hb.Position != "" && hb.Position != c.Position {
+			c.Position = hb.Position
+			c.Updated = now
+		}
+		c.LastSeen = now
+
+		d, err := json.Marshal(c)
+		if err != nil {
+			return fmt.Errorf("could not marshal consumer: %w", err)
+		}
+		tx.Put(path, d)
+		return nil
+	})
+
+	if err != nil {
+		log.Error(err, "could not store heartbeat")
+		http.Error(w, fmt.Errorf("could not store heartbeat: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		http.Error(w, fmt.Sprintf("consumer %s not found, a position is required to register it", name), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// WatchConsumers alerts when a registered consumer has not been seen for
+// longer than staleAfter and again when it recovers, until ctx is
+// cancelled. Alerts are only logged when notifier is nil.
+func (s *Server) WatchConsumers(ctx context.Context, staleAfter time.Duration, notifier alert.Notifier) error {
+	interval := staleAfter / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	stale := map[string]bool{}
+
+	notify := func(typ, name, message string) {
+		s.log.Info(message, "consumer", name)
+		if notifier == nil {
+			return
+		}
+		err := notifier.Notify(ctx, alert.Alert{
+			Type:    typ,
+			Message: message,
+			Time:    time.Now().UTC(),
+			Labels:  map[string]string{"consumer": name},
+		})
+		if err != nil {
+			s.log.Error(err, "could not send alert", "type", typ, "consumer", name)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		consumers := map[string]consumer{}
+		err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+			for it := tx.Iterator(consumersPath); !it.IsDone(); it.Next() {
+				c := consumer{}
+				err := json.Unmarshal(it.GetValue(), &c)
+				if err != nil {
+					return fmt.Errorf("could not unmarshal consumer %s: %w", it.GetKey(), err)
+				}
+				consumers[it.GetKey()] = c
+			}
+			return nil
+		})
+		if err != nil {
+			s.log.Error(err, "could not read consumers")
+			continue
+		}
+
+		for name := range stale {
+			if _, found := consumers[name]; !found {
+				delete(stale, name)
+			}
+		}
+
+		for name, c := range consumers {
+			silent := time.Since(c.lastSeen())
+			switch {
+			case silent > staleAfter && !stale[name]:
+				stale[name] = true
+				notify("consumer-stale", name, fmt.Sprintf("consumer %s has not been seen for %s", name, silent.Round(time.Second)))
+			case silent <= staleAfter && stale[name]:
+				delete(stale, name)
+				notify("consumer-recovered", name, fmt.Sprintf("consumer %s is active again", name))
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/draganm/event-buffer/alert"
+)
+
+func theConsumerSendsAHeartbeatAtThePolledEvent(ctx context.Context, consumer string) error {
+	s := getState(ctx)
+	return s.client.Heartbeat(ctx, consumer, s.lastId)
+}
+
+func theConsumerSendsAHeartbeat(ctx context.Context, consumer string) error {
+	return getState(ctx).client.Heartbeat(ctx, consumer, "")
+}
+
+func aHeartbeatOfTheUnknownConsumerShouldBeRejected(ctx context.Context, consumer string) error {
+	err := getState(ctx).client.Heartbeat(ctx, consumer, "")
+	if err == nil {
+		return fmt.Errorf("expected the heartbeat of %s to be rejected", consumer)
+	}
+	return nil
+}
+
+func theConsumerShouldHaveBeenSeenAtThePolledEvent(ctx context.Context, consumer string) error {
+	s := getState(ctx)
+	res, err := http.Get(s.serverBaseURL + "/consumers")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	consumers := map[string]struct {
+		Position string    `json:"position"`
+		LastSeen time.Time `json:"last_seen"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&consumers)
+	if err != nil {
+		return err
+	}
+
+	c, found := consumers[consumer]
+	if !found {
+		return fmt.Errorf("consumer %s is not registered: %v", consumer, consumers)
+	}
+	if c.Position != s.lastId {
+		return fmt.Errorf("expected the position %s, got %s", s.lastId, c.Position)
+	}
+	if time.Since(c.LastSeen) > time.Minute {
+		return fmt.Errorf("expected the consumer to have been seen just now, got %s", c.LastSeen)
+	}
+	return nil
+}
+
+func consumersSilentForAreWatched(ctx context.Context, staleAfter string) error {
+	d, err := time.ParseDuration(staleAfter)
+	if err != nil {
+		return err
+	}
+
+	s := getState(ctx)
+	s.alerts = make(chan alert.Alert, 10)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := alert.Alert{}
+		err := json.NewDecoder(r.Body).Decode(&a)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.alerts <- a
+	}))
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+
+	go s.server.WatchConsumers(ctx, d, &alert.Webhook{URL: hs.URL})
+	return nil
+}
+
+func anAlertShouldBeSentForTheConsumer(ctx context.Context, typ, consumer string) error {
+	select {
+	case a := <-getState(ctx).alerts:
+		if a.Type != typ || a.Labels["consumer"] != consumer {
+			return fmt.Errorf("expected an alert %s for %s, got %+v", typ, consumer, a)
+		}
+		return nil
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("no alert %s was sent for %s", typ, consumer)
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/gofrs/uuid"
+)
+
+// idPrefixSeparator separates the id prefix from the UUID of an event id,
+// UUIDs don't contain it.
+const idPrefixSeparator = ":"
+
+// idPrefixPath holds the id prefix the stored events were generated with.
+var idPrefixPath = metaPath.Append("id-prefix")
+
+var idPrefixRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// IDPrefix returns the part of an event id before its UUID, including the
+// separator, so IDPrefix(id)+TimeCursor(t) is a cursor of the buffer that
+// generated id.
+func IDPrefix(id string) string {
+	return id[:strings.LastIndex(id, idPrefixSeparator)+1]
+}
+
+// eventUUID returns the UUID of an event id without its prefix.
+func eventUUID(id string) (uuid.UUID, error) {
+	return uuid.FromString(id[len(IDPrefix(id)):])
+}
+
+// timeCursor is TimeCursor with the id prefix of the buffer.
+func (s *Server) timeCursor(t time.Time) string {
+	return s.clock.prefix + TimeCursor(t)
+}
+
+// initIDPrefix stores the id prefix of new events. Ids sort by their
+// prefix first, so it can only be changed while no stream holds events.
+func initIDPrefix(tx bolted.SugaredWriteTx, prefix string) error {
+	if prefix != "" && !idPrefixRegexp.MatchString(prefix) {
+		return fmt.Errorf("invalid id prefix %q, prefixes have up to 64 letters, digits, '.', '_' or '-'", prefix)
+	}
+
+	stored := ""
+	if tx.Exists(idPrefixPath) {
+		stored = string(tx.Get(idPrefixPath))
+	}
+	if stored == prefix {
+		return nil
+	}
+
+	topics, err := readTopics(tx)
+	if err != nil {
+		return err
+	}
+	for _, st := range append([]stream{defaultStream}, topics...) {
+		if headPosition(tx, st.events) != "" {
+			return fmt.Errorf("stored events have the id prefix %q, it can only be changed once the buffer and its topics hold no events", stored)
+		}
+	}
+
+	tx.Put(idPrefixPath, []byte(prefix))
+	return nil
+}
@@ -0,0 +1,55 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferGeneratingIdsWithThePrefix(ctx context.Context, prefix string) error {
+	err := aBufferStoringItsStateInAFile(ctx)
+	if err != nil {
+		return err
+	}
+	getState(ctx).stopServer()
+	return startBuffer(ctx, server.Options{IDPrefix: prefix})
+}
+
+func theIdsOfTheEventsShouldStartWith(ctx context.Context, prefix string) error {
+	s := getState(ctx)
+	evts := []json.RawMessage{}
+	ids, err := s.client.PollForEvents(ctx, "", 100, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("expected events")
+	}
+	for _, id := range ids {
+		if !strings.HasPrefix(id, prefix) {
+			return fmt.Errorf("expected id %s to start with %s", id, prefix)
+		}
+	}
+
+	evts = []json.RawMessage{}
+	after, err := s.client.PollForEvents(ctx, ids[0], 100, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling after %s: %w", ids[0], err)
+	}
+	if len(after) != len(ids)-1 {
+		return fmt.Errorf("expected %d events after %s, got %v", len(ids)-1, ids[0], after)
+	}
+	return nil
+}
+
+func restartingTheBufferWithTheIdPrefixShouldFail(ctx context.Context, prefix string) error {
+	getState(ctx).stopServer()
+	err := startBuffer(ctx, server.Options{IDPrefix: prefix})
+	if err == nil {
+		return fmt.Errorf("expected the id prefix %s to be rejected", prefix)
+	}
+	return nil
+}
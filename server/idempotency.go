@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IdempotencyKeyHeader identifies a publish request, retries of a request
+// with the same key within Options.IdempotencyWindow are not stored
+// again.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentReplayHeader marks responses to retries of a publish.
+const idempotentReplayHeader = "Idempotent-Replayed"
+
+// idempotencyKeyField identifies single events published without the
+// header.
+const idempotencyKeyField = "idempotency_key"
+
+const maxIdempotencyKeyLength = 256
+
+var errInvalidIdempotencyKey = errors.New("invalid idempotency key")
+
+var duplicatePublishes = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "event_buffer_duplicate_publishes_total",
+	Help: "Number of publish requests with an idempotency key that had already been stored.",
+})
+
+// idempotentBatch is the batch stored for an idempotency key.
+type idempotentBatch struct {
+	batchRange
+	Stored time.Time `json:"stored"`
+}
+
+// idempotencyKey returns the key of a publish request from its header or,
+// for requests publishing one event, the idempotency_key field of the
+// event. It is empty unless Options.IdempotencyWindow is set.
+func (s Server) idempotencyKey(r *http.Request, events []json.RawMessage) (string, error) {
+	if s.opts.IdempotencyWindow <= 0 {
+		return "", nil
+	}
+
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key == "" && len(events) == 1 {
+		fields := map[string]json.RawMessage{}
+		// events don't have to be objects
+		if json.Unmarshal(events[0], &fields) == nil && fields[idempotencyKeyField] != nil {
+			err := json.Unmarshal(fields[idempotencyKeyField], &key)
+			if err != nil {
+				return "", fmt.Errorf("%w: %s is not a string", errInvalidIdempotencyKey, idempotencyKeyField)
+			}
+		}
+	}
+
+	if len(key) > maxIdempotencyKeyLength {
+		return "", fmt.Errorf("%w: keys have up to %d bytes", errInvalidIdempotencyKey, maxIdempotencyKeyLength)
+	}
+	return key, nil
+}
+
+// idempotencyExpiryKey orders the keys of a stream by the time they were
+// stored.
+func idempotencyExpiryKey(stored time.Time, key string) string {
+	return fmt.Sprintf("%020d/%s", stored.UnixNano(), key)
+}
+
+// storedBatch returns the batch stored for a key within the idempotency
+// window, or nil.
+func (s Server) storedBatch(tx bolted.SugaredReadTx, st stream, key string) (*idempotentBatch, error) {
+	p := st.idempotencyKeys.Append(key)
+	if !tx.Exists(st.idempotencyKeys) || !tx.Exists(p) {
+		return nil, nil
+	}
+
+	b := &idempotentBatch{}
+	err := json.Unmarshal(tx.Get(p), b)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal idempotency key %s: %w", key, err)
+	}
+
+	if time.Since(b.Stored) > s.opts.IdempotencyWindow {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// storeBatch remembers the batch stored for a key.
+func storeBatch(tx bolted.SugaredWriteTx, st stream, key string, br batchRange) error {
+	if !tx.Exists(st.idempotencyKeys) {
+		tx.CreateMap(st.idempotencyKeys)
+		tx.CreateMap(st.idempotencyExpiry)
+	}
+
+	b := idempotentBatch{batchRange: br, Stored: time.Now()}
+	d, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("could not marshal idempotency key %s: %w", key, err)
+	}
+
+	p := st.idempotencyKeys.Append(key)
+	if tx.Exists(p) {
+		// the key expired, so does its entry in the expiry index
+		previous := idempotentBatch{}
+		if json.Unmarshal(tx.Get(p), &previous) == nil {
+			tx.Delete(st.idempotencyExpiry.Append(idempotencyExpiryKey(previous.Stored, key)))
+		}
+	}
+
+	tx.Put(p, d)
+	tx.Put(st.idempotencyExpiry.Append(idempotencyExpiryKey(b.Stored, key)), nil)
+	return nil
+}
+
+// sweepIdempotencyKeys forgets the keys of streams stored before the
+// idempotency window.
+func (s Server) sweepIdempotencyKeys(streams []stream) error {
+	if s.opts.IdempotencyWindow <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().Add(-s.opts.IdempotencyWindow).UnixNano()
+	return bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		for _, st := range streams {
+			if !tx.Exists(st.idempotencyExpiry) {
+				continue
+			}
+
+			expired := []string{}
+			for it := tx.Iterator(st.idempotencyExpiry); !it.IsDone(); it.Next() {
+				k := it.GetKey()
+				stored, err := strconv.ParseInt(k[:20], 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid idempotency expiry %s: %w", k, err)
+				}
+				if stored > cutoff {
+					break
+				}
+				expired = append(expired, k)
+			}
+
+			for _, k := range expired {
+				tx.Delete(st.idempotencyExpiry.Append(k))
+				tx.Delete(st.idempotencyKeys.Append(k[21:]))
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,96 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/draganm/event-buffer/server"
+	"github.com/google/go-cmp/cmp"
+)
+
+func aBufferRememberingIdempotencyKeys(ctx context.Context) error {
+	return startBuffer(ctx, server.Options{IdempotencyWindow: time.Hour})
+}
+
+func publishBatchWithKey(ctx context.Context, key string, events string) (map[string]any, error) {
+	s := getState(ctx)
+	req, err := http.NewRequestWithContext(ctx, "POST", s.serverBaseURL+"/events/batch", bytes.NewReader([]byte(events)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set(server.IdempotencyKeyHeader, key)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		d, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("unexpected status %s: %s", res.Status, d)
+	}
+
+	br := map[string]any{}
+	err = json.NewDecoder(res.Body).Decode(&br)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode batch: %w", err)
+	}
+	return br, nil
+}
+
+func iPublishABatchWithTheIdempotencyKeyTwice(ctx context.Context, key string) error {
+	first, err := publishBatchWithKey(ctx, key, `["evt1","evt2"]`)
+	if err != nil {
+		return err
+	}
+	second, err := publishBatchWithKey(ctx, key, `["evt1","evt2"]`)
+	if err != nil {
+		return err
+	}
+
+	d := cmp.Diff(first, second)
+	if d != "" {
+		return fmt.Errorf("retry did not return the stored batch:\n%s", d)
+	}
+	return nil
+}
+
+func iSendAnEventWithTheIdempotencyKeyFieldTwice(ctx context.Context, key string) error {
+	s := getState(ctx)
+	for i := 0; i < 2; i++ {
+		err := s.client.SendEvents(ctx, []any{map[string]string{"idempotency_key": key}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func iSendEventsOnceWithTheKeyTwice(ctx context.Context, key string) error {
+	s := getState(ctx)
+	for i := 0; i < 2; i++ {
+		err := s.client.SendEventsOnce(ctx, key, []any{"evt1"})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func theBufferShouldHaveEvents(ctx context.Context, n int) error {
+	st, err := getState(ctx).server.Stats()
+	if err != nil {
+		return err
+	}
+	if st.Events != uint64(n) {
+		return fmt.Errorf("expected %d events, got %d", n, st.Events)
+	}
+	return nil
+}
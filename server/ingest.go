@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+)
+
+// ingestedPath maps keys of events ingested from external sources to their
+// ids, so an event is appended only once when the source is retried.
+var ingestedPath = dbpath.ToPath("ingested")
+
+// IngestedEvent is an event read from an external source, Key identifies
+// it within the source.
+type IngestedEvent struct {
+	Key     string
+	Payload json.RawMessage
+}
+
+// Ingest appends events of an external source, events that have already
+// been ingested are skipped.
+func (s *Server) Ingest(ctx context.Context, source string, events []IngestedEvent) error {
+	payloads := make([]json.RawMessage, len(events))
+	for i, e := range events {
+		payloads[i] = e.Payload
+	}
+
+	uuids, objects, err := s.prepareEvents(ctx, defaultStream, payloads)
+	if err != nil {
+		return err
+	}
+
+	sourcePath := ingestedPath.Append(source)
+	skipped := []string{}
+	err = bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		skipped = skipped[:0]
+		if !tx.Exists(sourcePath) {
+			tx.CreateMap(sourcePath)
+		}
+
+		for i, e := range events {
+			keyPath := sourcePath.Append(e.Key)
+			if tx.Exists(keyPath) {
+				skipped = append(skipped, objects[i])
+				continue
+			}
+
+			err := s.storeEvents(tx, defaultStream, uuids[i:i+1], objects[i:i+1], payloads[i:i+1])
+			if err != nil {
+				return err
+			}
+			tx.Put(keyPath, []byte(uuids[i]))
+		}
+		return nil
+	})
+
+	if err != nil {
+		s.deleteObjects(objects)
+		return fmt.Errorf("could not ingest events: %w", err)
+	}
+
+	s.deleteObjects(skipped)
+
+	return nil
+}
+
+// ForgetIngested removes keys of events the source won't deliver again.
+func (s *Server) ForgetIngested(source string, keys []string) error {
+	sourcePath := ingestedPath.Append(source)
+	return bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		if !tx.Exists(sourcePath) {
+			return nil
+		}
+		for _, k := range keys {
+			if tx.Exists(sourcePath.Append(k)) {
+				tx.Delete(sourcePath.Append(k))
+			}
+		}
+		return nil
+	})
+}
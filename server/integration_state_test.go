@@ -1,7 +1,19 @@
 package server_test
 
 import (
+	"bufio"
+	"crypto/ed25519"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/event-buffer/alert"
 	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/eventbufferpb"
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/draganm/event-buffer/server"
+	"github.com/gorilla/websocket"
 )
 
 type StateKeyType string
@@ -14,11 +26,55 @@ type eventsOrError struct {
 }
 
 type State struct {
-	// serverBaseURL    string
+	serverBaseURL      string
 	client             *client.Client
+	server             *server.Server
+	poll               *client.Poll
 	pollResult         []string
 	secondPollResult   []string
 	longPollResult     chan eventsOrError
 	longPollResultDesc chan eventsOrError
 	lastId             string
+	rawPoll            []byte
+	rawPollHeader      http.Header
+	pollErr            error
+	commitErr          error
+	spoolDir           string
+	publishErr         error
+	streamed           chan string
+	tapped             chan server.TappedEvent
+	ws                 *websocket.Conn
+	grpc               eventbufferpb.EventBufferClient
+	batch              *client.Batch
+	shards             []bolted.Database
+	follower           *client.Client
+	futureID           string
+	batches            []*client.Batch
+	rawStatus          int
+	rawHeader          http.Header
+	payloadLogDir      string
+	orderSeq           int
+	stateFile          string
+	dedupMinSize       int
+	stopServer         func()
+	dump               []byte
+	pruneStatus        server.PruneStatus
+	pruneNotifications *pruneNotifications
+	archive            objectstore.Store
+	offloadStore       objectstore.Store
+	peers              server.PeerCatalog
+	producerSessions   []*client.ProducerSession
+	trustedProxies     server.TrustedProxies
+	clientIP           string
+	redaction          *server.Redaction
+	walStore           objectstore.Store
+	moment             time.Time
+	replayed           int
+	encryptionKeys     string
+	bundle             []byte
+	bundleKey          ed25519.PublicKey
+	cdc                net.Conn
+	cdcLines           *bufio.Reader
+	alerts             chan alert.Alert
+	heldPublishes      []*heldPublish
 }
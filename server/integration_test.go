@@ -2,13 +2,19 @@ package server_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http/httptest"
 	"os"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cucumber/godog"
+	"github.com/draganm/event-buffer/auth"
 	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
 	"github.com/draganm/event-buffer/server/testrig"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
@@ -53,6 +59,11 @@ func TestMain(m *testing.M) {
 		Options:             &opts,
 	}.Run()
 
+	// unit tests of the package run next to the features
+	if st := m.Run(); st > status {
+		status = st
+	}
+
 	os.Exit(status)
 }
 
@@ -75,7 +86,7 @@ func InitializeScenario(ctx *godog.ScenarioContext) {
 
 	ctx.Before(func(ctx context.Context, sc *godog.Scenario) (context.Context, error) {
 
-		serverURL, err := testrig.StartServer(ctx, logr.FromContextOrDiscard(ctx))
+		serverURL, srv, err := testrig.StartServer(ctx, logr.FromContextOrDiscard(ctx))
 		if err != nil {
 			return ctx, fmt.Errorf("could not start server: %w", err)
 		}
@@ -85,7 +96,9 @@ func InitializeScenario(ctx *godog.ScenarioContext) {
 			return ctx, fmt.Errorf("could not create client: %w", err)
 		}
 
+		state.serverBaseURL = serverURL
 		state.client = cl
+		state.server = srv
 
 		ctx = context.WithValue(ctx, stateKey, state)
 
@@ -93,9 +106,20 @@ func InitializeScenario(ctx *godog.ScenarioContext) {
 	})
 
 	ctx.Step(`^I send a single event$`, iSendASingleEvent)
+	ctx.Step(`^a buffer with a retention period$`, aBufferWithARetentionPeriod)
+	ctx.Step(`^I poll for the raw events$`, iPollForTheRawEvents)
+	ctx.Step(`^I poll for the raw events with the (\w+) envelope$`, iPollForTheRawEventsWithTheEnvelope)
+	ctx.Step(`^I poll for the raw events from the time "([^"]*)"$`, iPollForTheRawEventsFromTheTime)
+	ctx.Step(`^the polled events should have (\d+) parts$`, thePolledEventsShouldHaveParts)
 	ctx.Step(`^I should get a confirmation$`, iShouldGetAConfirmation)
+	ctx.Step(`^I send an event compressed with (gzip|zstd)$`, iSendAnEventCompressedWith)
+	ctx.Step(`^I send an event while the buffer is unreachable$`, iSendAnEventWhileTheBufferIsUnreachable)
+	ctx.Step(`^the buffer becomes reachable again$`, theBufferBecomesReachableAgain)
+	ctx.Step(`^I send an event to an unreachable buffer with an alternate$`, iSendAnEventToAnUnreachableBufferWithAnAlternate)
+	ctx.Step(`^I send an event with an unreachable primary and a backup$`, iSendAnEventWithAnUnreachablePrimaryAndABackup)
 	ctx.Step(`^I poll for the events$`, iPollForTheEvents)
 	ctx.Step(`^I should receive the buffered event$`, iShouldReceiveTheBufferedEvent)
+	ctx.Step(`^I poll for the events through an unreachable buffer with a replica$`, iPollForTheEventsThroughAnUnreachableBufferWithAReplica)
 	ctx.Step("^I should receive the buffered events in desc order$", iShouldReceiveDescTheNewEvent)
 	ctx.Step(`^one event in the buffer$`, oneEventInTheBuffer)
 	ctx.Step(`^I should receive the new event$`, iShouldReceiveTheNewEvent)
@@ -105,7 +129,258 @@ func InitializeScenario(ctx *godog.ScenarioContext) {
 	ctx.Step(`^I poll for one event$`, iPollForOneEvent)
 	ctx.Step(`^I poll for other event after the previous event$`, iPollForOtherEventAfterThePreviousEvent)
 	ctx.Step(`^I should get one event for each poll$`, iShouldGetOneEventForEachPoll)
+	ctx.Step(`^the poll should report the other event as head of the buffer$`, thePollShouldReportTheOtherEventAsHeadOfTheBuffer)
+	ctx.Step(`^the poll should not report the head of the buffer$`, thePollShouldNotReportTheHeadOfTheBuffer)
 	ctx.Step(`^two events in the buffer$`, twoEventsInTheBuffer)
+	ctx.Step(`^I start streaming the events$`, iStartStreamingTheEvents)
+	ctx.Step(`^I start streaming the events after the previous event$`, iStartStreamingTheEventsAfterThePreviousEvent)
+	ctx.Step(`^the stream should deliver all three events$`, theStreamShouldDeliverAllThreeEvents)
+	ctx.Step(`^the stream should deliver only the other event$`, theStreamShouldDeliverOnlyTheOtherEvent)
+	ctx.Step(`^I tap all events$`, iTapAllEvents)
+	ctx.Step(`^the tap should receive only the new event$`, theTapShouldReceiveOnlyTheNewEvent)
+	ctx.Step(`^a WebSocket connection subscribed as consumer "([^"]*)"$`, aWebSocketConnectionSubscribedAsConsumer)
+	ctx.Step(`^I publish two events over the WebSocket$`, iPublishTwoEventsOverTheWebSocket)
+	ctx.Step(`^the WebSocket should deliver both events$`, theWebSocketShouldDeliverBothEvents)
+	ctx.Step(`^acknowledging the last event should move the cursor of "([^"]*)"$`, acknowledgingTheLastEventShouldMoveTheCursorOf)
+	ctx.Step(`^a gRPC connection$`, aGRPCConnection)
+	ctx.Step(`^I publish two events over gRPC$`, iPublishTwoEventsOverGRPC)
+	ctx.Step(`^polling over gRPC should return both events$`, pollingOverGRPCShouldReturnBothEvents)
+	ctx.Step(`^streaming over gRPC should deliver both events$`, streamingOverGRPCShouldDeliverBothEvents)
+	ctx.Step(`^I prune all events over gRPC$`, iPruneAllEventsOverGRPC)
+	ctx.Step(`^the buffer should be empty$`, theBufferShouldBeEmpty)
+	ctx.Step(`^I poll for the events waiting (\S+)$`, iPollForTheEventsWaiting)
+	ctx.Step(`^the poll should return no events$`, thePollShouldReturnNoEvents)
+	ctx.Step(`^I start a poll waiting (\S+) and disconnect after (\S+)$`, iStartAPollWaitingAndDisconnectAfter)
+	ctx.Step(`^the metrics should count a disconnected poll$`, theMetricsShouldCountADisconnectedPoll)
+	ctx.Step(`^I publish a batch of two events$`, iPublishABatchOfTwoEvents)
+	ctx.Step(`^the batch should be assigned the sequence numbers (\d+) to (\d+)$`, theBatchShouldBeAssignedTheSequenceNumbersTo)
+	ctx.Step(`^polling should return the batch after the first event$`, pollingShouldReturnTheBatchAfterTheFirstEvent)
+	ctx.Step(`^a follower of the buffer$`, aFollowerOfTheBuffer)
+	ctx.Step(`^polling the follower should return both events$`, pollingTheFollowerShouldReturnBothEvents)
+	ctx.Step(`^the follower should have the same ids as the buffer$`, theFollowerShouldHaveTheSameIdsAsTheBuffer)
+	ctx.Step(`^an event with the payload (.+) in the buffer$`, anEventWithThePayloadInTheBuffer)
+	ctx.Step(`^the polled payload should be (.+)$`, thePolledPayloadShouldBe)
+	ctx.Step(`^a buffer accepting the tokens "([^"]*)" and "([^"]*)"$`, aBufferAcceptingTheTokensAnd)
+	ctx.Step(`^I send an event with the token "([^"]*)"$`, iSendAnEventWithTheToken)
+	ctx.Step(`^polling with the token "([^"]*)" should return the event$`, pollingWithTheTokenShouldReturnTheEvent)
+	ctx.Step(`^sending an event with the token "([^"]*)" should be forbidden$`, sendingAnEventWithTheTokenShouldBeForbidden)
+	ctx.Step(`^polling without a token should be unauthorized$`, pollingWithoutATokenShouldBeUnauthorized)
+	ctx.Step(`^a buffer with a payload log$`, aBufferWithAPayloadLog)
+	ctx.Step(`^the payload log should have (\d+) segments?$`, thePayloadLogShouldHaveSegments)
+	ctx.Step(`^the integrity check should report no problems$`, theIntegrityCheckShouldReportNoProblems)
+	ctx.Step(`^the metrics should count a poll of "([^"]*)" with status (\d+)$`, theMetricsShouldCountAPollOfWithStatus)
+	ctx.Step(`^I send an event with the traceparent "([^"]*)"$`, iSendAnEventWithTheTraceparent)
+	ctx.Step(`^the event should have the traceparent "([^"]*)"$`, theEventShouldHaveTheTraceparent)
+	ctx.Step(`^the event should have no traceparent$`, theEventShouldHaveNoTraceparent)
+	ctx.Step(`^events of the types "([^"]*)" in the buffer$`, eventsOfTheTypesInTheBuffer)
+	ctx.Step(`^a buffer accepting the tokens "([^"]*)" and "([^"]*)" stripping "([^"]*)" except for "([^"]*)"$`, aBufferAcceptingTheTokensAndStrippingExceptFor)
+	ctx.Step(`^polling with the token "([^"]*)" should return payloads (with|without) "([^"]*)"$`, pollingWithTheTokenShouldReturnPayloads)
+	ctx.Step(`^I poll for events of the type "([^"]*)"$`, iPollForEventsOfTheType)
+	ctx.Step(`^I poll for events where "([^"]*)" is (\d+)$`, iPollForEventsWhereIs)
+	ctx.Step(`^I should get the events numbered "([^"]*)"$`, iShouldGetTheEventsNumbered)
+	ctx.Step(`^I start polling for events of the type "([^"]*)"$`, iStartPollingForEventsOfTheType)
+	ctx.Step(`^an event of the type "([^"]*)" is sent$`, anEventOfTheTypeIsSent)
+	ctx.Step(`^the filtered poll should return only the event numbered (\d+)$`, theFilteredPollShouldReturnOnlyTheEventNumbered)
+	ctx.Step(`^I start streaming events of the type "([^"]*)"$`, iStartStreamingEventsOfTheType)
+	ctx.Step(`^the stream should deliver the events numbered "([^"]*)"$`, theStreamShouldDeliverTheEventsNumbered)
+	ctx.Step(`^a buffer stripping "([^"]*)" for the consumer "([^"]*)"$`, aBufferStrippingForTheConsumer)
+	ctx.Step(`^the consumer "([^"]*)" polling for events where "([^"]*)" is (\d+) should get (\d+) events?$`, theConsumerPollingForEventsWhereIsShouldGetEvents)
+	ctx.Step(`^a buffer storing CloudEvents$`, aBufferStoringCloudEvents)
+	ctx.Step(`^I publish a CloudEvent of the type "([^"]*)"$`, iPublishACloudEventOfTheType)
+	ctx.Step(`^I publish an event without a specversion$`, iPublishAnEventWithoutASpecversion)
+	ctx.Step(`^the publish should be rejected as invalid$`, thePublishShouldBeRejectedAsInvalid)
+	ctx.Step(`^I publish a binary CloudEvent of the type "([^"]*)" with the text "([^"]*)"$`, iPublishABinaryCloudEventOfTheTypeWithTheText)
+	ctx.Step(`^I poll for CloudEvents$`, iPollForCloudEvents)
+	ctx.Step(`^I poll for a CloudEvent in the binary content mode$`, iPollForACloudEventInTheBinaryContentMode)
+	ctx.Step(`^I should receive a CloudEvent of the type "([^"]*)" with its buffer id$`, iShouldReceiveACloudEventOfTheTypeWithItsBufferId)
+	ctx.Step(`^the CloudEvent should have the base64 data "([^"]*)"$`, theCloudEventShouldHaveTheBase64Data)
+	ctx.Step(`^the poll should return the type "([^"]*)" as header and the text "([^"]*)" as body$`, thePollShouldReturnTheTypeAsHeaderAndTheTextAsBody)
+	ctx.Step(`^the poll should return no content$`, thePollShouldReturnNoContent)
+	ctx.Step(`^the poll should be rejected as invalid$`, thePollShouldBeRejectedAsInvalid)
+	ctx.Step(`^I poll for the (\d+) events accepting (gzip|zstd)$`, iPollForTheEventsAccepting)
+	ctx.Step(`^the poll should be compressed with (gzip|zstd) and return (\d+) events$`, thePollShouldBeCompressedWithAndReturnEvents)
+	ctx.Step(`^the poll should return the two events uncompressed$`, thePollShouldReturnTheTwoEventsUncompressed)
+	ctx.Step(`^I start streaming the events accepting gzip$`, iStartStreamingTheEventsAcceptingGzip)
+	ctx.Step(`^a buffer rejecting events older than (\S+)$`, aBufferRejectingEventsOlderThan)
+	ctx.Step(`^a buffer with a retention period of (\S+) rejecting events older than (\S+)$`, aBufferWithARetentionPeriodOfRejectingEventsOlderThan)
+	ctx.Step(`^I send an event that occurred (\S+) ago$`, iSendAnEventThatOccurredAgo)
+	ctx.Step(`^the publish should be rejected as stale$`, thePublishShouldBeRejectedAsStale)
+	ctx.Step(`^the publish should be accepted$`, thePublishShouldBeAccepted)
+	ctx.Step(`^a buffer compressing stored payloads with (zstd|snappy)$`, aBufferCompressingStoredPayloadsWith)
+	ctx.Step(`^a buffer compressing and deduplicating stored payloads with (zstd|snappy)$`, aBufferCompressingAndDeduplicatingStoredPayloadsWith)
+	ctx.Step(`^a large compressible event in the buffer$`, aLargeCompressibleEventInTheBuffer)
+	ctx.Step(`^polling should return the large event$`, pollingShouldReturnTheLargeEvent)
+	ctx.Step(`^the event should be stored compressed with (zstd|snappy)$`, theEventShouldBeStoredCompressedWith)
+	ctx.Step(`^(\d+) batches of (\d+) events are published concurrently$`, eventsArePublishedConcurrentlyInBatches)
+	ctx.Step(`^the ids of the batches should grow with their sequence numbers$`, theIdsOfTheBatchesShouldGrowWithTheirSequenceNumbers)
+	ctx.Step(`^a follower of a primary with an event from the future$`, aFollowerOfAPrimaryWithAnEventFromTheFuture)
+	ctx.Step(`^I publish an event to the follower$`, iPublishAnEventToTheFollower)
+	ctx.Step(`^the event should be stored after the event from the future$`, theEventShouldBeStoredAfterTheEventFromTheFuture)
+	ctx.Step(`^the metrics should count a clock skew$`, theMetricsShouldCountAClockSkew)
+	ctx.Step(`^a buffer encrypting payloads with the key "([^"]*)"$`, aBufferEncryptingPayloadsWithTheKey)
+	ctx.Step(`^a buffer encrypting and deduplicating payloads with the key "([^"]*)"$`, aBufferEncryptingAndDeduplicatingPayloadsWithTheKey)
+	ctx.Step(`^the buffer is restarted with the keys "([^"]*)"$`, theBufferIsRestartedWithTheKeys)
+	ctx.Step(`^the state file should not contain "([^"]*)"$`, theStateFileShouldNotContain)
+	ctx.Step(`^the events should be encrypted with the keys "([^"]*)"$`, theEventsShouldBeEncryptedWithTheKeys)
+	ctx.Step(`^the integrity check should report an unreadable payload$`, theIntegrityCheckShouldReportAnUnreadablePayload)
+	ctx.Step(`^the buffer is dumped$`, theBufferIsDumped)
+	ctx.Step(`^the topic "([^"]*)" is dumped$`, theTopicIsDumped)
+	ctx.Step(`^the events from the time of the event numbered (\d+) to the time of the event numbered (\d+) are dumped$`, theEventsFromTheTimeOfTheEventNumberedToTheTimeOfTheEventNumberedAreDumped)
+	ctx.Step(`^the dump is restored$`, theDumpIsRestored)
+	ctx.Step(`^a snapshot of the buffer is taken$`, aSnapshotOfTheBufferIsTaken)
+	ctx.Step(`^the snapshot should record (\d+) events appended to the buffer and (\d+) to the topic "([^"]*)"$`, theSnapshotShouldRecordEventsAppendedToTheBufferAndToTheTopic)
+	ctx.Step(`^the buffer should have no events$`, theBufferShouldHaveNoEvents)
+	ctx.Step(`^a buffer storing its state in a file$`, aBufferStoringItsStateInAFile)
+	ctx.Step(`^a buffer indexing traces$`, aBufferIndexingTraces)
+	ctx.Step(`^the buffer is restarted indexing traces$`, theBufferIsRestartedIndexingTraces)
+	ctx.Step(`^a buffer offloading payloads of at least (\d+) bytes$`, aBufferOffloadingPayloadsOfAtLeastBytes)
+	ctx.Step(`^the buffer is restarted without an object store$`, theBufferIsRestartedWithoutAnObjectStore)
+	ctx.Step(`^the object store should hold (\d+) offloaded payloads$`, theObjectStoreShouldHoldOffloadedPayloads)
+	ctx.Step(`^polling for the trace "([^"]*)" should return (\d+) events?$`, pollingForTheTraceShouldReturnEvents)
+	ctx.Step(`^polling for the trace "([^"]*)" should be rejected as invalid$`, pollingForTheTraceShouldBeRejectedAsInvalid)
+	ctx.Step(`^a buffer holding at most (\d+) events$`, aBufferHoldingAtMostEvents)
+	ctx.Step(`^a buffer holding at most (\d+) bytes of payloads$`, aBufferHoldingAtMostBytesOfPayloads)
+	ctx.Step(`^the buffer should store (\d+) bytes of payloads$`, theBufferShouldStoreBytesOfPayloads)
+	ctx.Step(`^a prune subscription "([^"]*)"$`, aPruneSubscription)
+	ctx.Step(`^subscribing to prunes at "([^"]*)" should be rejected$`, subscribingToPrunesAtShouldBeRejected)
+	ctx.Step(`^the subscription should not have been notified$`, theSubscriptionShouldNotHaveBeenNotified)
+	ctx.Step(`^the subscription "([^"]*)" should have been notified of the events numbered (\d+) to (\d+)$`, theSubscriptionShouldHaveBeenNotifiedOfTheEventsNumberedTo)
+	ctx.Step(`^the subscription "([^"]*)" should have been notified of the events numbered (\d+) to (\d+) of the topic "([^"]*)"$`, theSubscriptionShouldHaveBeenNotifiedOfTheEventsNumberedToOfTheTopic)
+	ctx.Step(`^a buffer generating ids with the prefix "([^"]*)"$`, aBufferGeneratingIdsWithThePrefix)
+	ctx.Step(`^the ids of the events should start with "([^"]*)"$`, theIdsOfTheEventsShouldStartWith)
+	ctx.Step(`^restarting the buffer with the id prefix "([^"]*)" should fail$`, restartingTheBufferWithTheIdPrefixShouldFail)
+	ctx.Step(`^a buffer publishing system events$`, aBufferPublishingSystemEvents)
+	ctx.Step(`^the system topic should hold a prune of (\d+) removed events?$`, theSystemTopicShouldHoldAPruneOfRemovedEvents)
+	ctx.Step(`^publishing to the system topic should be forbidden$`, publishingToTheSystemTopicShouldBeForbidden)
+	ctx.Step(`^the prune should report (\d+) removed events? and (\d+) reclaimed bytes$`, thePruneShouldReportRemovedEventsAndReclaimedBytes)
+	ctx.Step(`^a buffer with read ahead$`, aBufferWithReadAhead)
+	ctx.Step(`^(\d+) events? in the buffer$`, eventsInTheBuffer)
+	ctx.Step(`^the trusted proxies "([^"]*)"$`, theTrustedProxies)
+	ctx.Step(`^a request from "([^"]*)" with the header "([^"]*)" set to "([^"]*)"$`, aRequestFromWithTheHeaderSetTo)
+	ctx.Step(`^the client address should be "([^"]*)"$`, theClientAddressShouldBe)
+	ctx.Step(`^parsing the trusted proxies "([^"]*)" should fail$`, parsingTheTrustedProxiesShouldFail)
+	ctx.Step(`^a buffer delivering at most (\d+) events? per second to the consumer "([^"]*)"$`, aBufferDeliveringAtMostEventsPerSecondToTheConsumer)
+	ctx.Step(`^a buffer accepting the token "([^"]*)" delivering at most (\d+) events? per second to "([^"]*)"$`, aBufferAcceptingTheTokenDeliveringAtMostEventsPerSecondTo)
+	ctx.Step(`^polling as the consumer "([^"]*)" waiting (\S+) should return (\d+) events?$`, pollingAsTheConsumerWaitingShouldReturnEvents)
+	ctx.Step(`^polling with the token "([^"]*)" waiting (\S+) should return (\d+) events?$`, pollingWithTheTokenWaitingShouldReturnEvents)
+	ctx.Step(`^I poll for the (\d+) events in batches of (\d+)$`, iPollForTheEventsInBatchesOf)
+	ctx.Step(`^the batches should return all (\d+) events in order$`, theBatchesShouldReturnAllEventsInOrder)
+	ctx.Step(`^a batch should have been served from the read ahead$`, aBatchShouldHaveBeenServedFromTheReadAhead)
+	ctx.Step(`^a buffer with its topics sharded across (\d+) files$`, aBufferWithItsTopicsShardedAcrossFiles)
+	ctx.Step(`^the topics "([^"]*)" and "([^"]*)" should each be stored in one shard$`, theTopicsShouldEachBeStoredInOneShard)
+	ctx.Step(`^a buffer with acknowledgement-based retention$`, aBufferWithAcknowledgementBasedRetention)
+	ctx.Step(`^the consumer "([^"]*)" acknowledges the polled event$`, theConsumerAcknowledgesThePolledEvent)
+	ctx.Step(`^the consumer "([^"]*)" is registered before the first event$`, theConsumerIsRegisteredBeforeTheFirstEvent)
+	ctx.Step(`^the buffer is pruned at its retention period$`, theBufferIsPrunedAtItsRetentionPeriod)
+	ctx.Step(`^the buffer should still have two events$`, theBufferShouldStillHaveTwoEvents)
+	ctx.Step(`^a buffer archiving its events$`, aBufferArchivingItsEvents)
+	ctx.Step(`^a buffer archiving its events and holding at most (\d+) events$`, aBufferArchivingItsEventsAndHoldingAtMostEvents)
+	ctx.Step(`^a buffer archiving its events to an unavailable store$`, aBufferArchivingItsEventsToAnUnavailableStore)
+	ctx.Step(`^the archive should hold the events numbered "([^"]*)"$`, theArchiveShouldHoldTheEventsNumbered)
+	ctx.Step(`^the archive should hold no events$`, theArchiveShouldHoldNoEvents)
+	ctx.Step(`^the prune should report (\d+) archived events?$`, thePruneShouldReportArchivedEvents)
+	ctx.Step(`^pruning all events should fail$`, pruningAllEventsShouldFail)
+	ctx.Step(`^I poll for (\d+) events from the time "([^"]*)"$`, iPollForEventsFromTheTime)
+	ctx.Step(`^I poll for (\d+) events after the last polled event$`, iPollForEventsAfterTheLastPolledEvent)
+	ctx.Step(`^polling from the time "([^"]*)" should report pruned events$`, pollingFromTheTimeShouldReportPrunedEvents)
+	ctx.Step(`^a buffer peering with the (\w+) "([^"]*)" at "([^"]*)"$`, aBufferPeeringWithTheAt)
+	ctx.Step(`^starting a buffer peering with the (\w+) "([^"]*)" at "([^"]*)" should fail$`, startingABufferPeeringWithTheAtShouldFail)
+	ctx.Step(`^I list the peers$`, iListThePeers)
+	ctx.Step(`^a buffer listing unavailable peers$`, aBufferListingUnavailablePeers)
+	ctx.Step(`^a client discovering the buffers from the peers catalog$`, aClientDiscoveringTheBuffersFromThePeersCatalog)
+	ctx.Step(`^the catalog should describe the instance as the primary at its URL$`, theCatalogShouldDescribeTheInstanceAsThePrimaryAtItsURL)
+	ctx.Step(`^the catalog should list the (\w+) "([^"]*)" at "([^"]*)"$`, theCatalogShouldListTheAt)
+	ctx.Step(`^a buffer remembering idempotency keys$`, aBufferRememberingIdempotencyKeys)
+	ctx.Step(`^I publish a batch with the idempotency key "([^"]*)" twice$`, iPublishABatchWithTheIdempotencyKeyTwice)
+	ctx.Step(`^I send an event with the idempotency key field "([^"]*)" twice$`, iSendAnEventWithTheIdempotencyKeyFieldTwice)
+	ctx.Step(`^I send events once with the key "([^"]*)" twice$`, iSendEventsOnceWithTheKeyTwice)
+	ctx.Step(`^the buffer should have (\d+) events?$`, theBufferShouldHaveEvents)
+	ctx.Step(`^the producer "([^"]*)" registers a session$`, theProducerRegistersASession)
+	ctx.Step(`^the session publishes the sequence (\d+)$`, theSessionPublishesTheSequence)
+	ctx.Step(`^the session publishes the sequence (\d+) again$`, theSessionPublishesTheSequenceAgain)
+	ctx.Step(`^publishing the sequence (\d+) should be rejected as out of order$`, publishingTheSequenceShouldBeRejectedAsOutOfOrder)
+	ctx.Step(`^publishing with the first session should be rejected as fenced$`, publishingWithTheFirstSessionShouldBeRejectedAsFenced)
+	ctx.Step(`^the session should continue after the sequence (\d+)$`, theSessionShouldContinueAfterTheSequence)
+	ctx.Step(`^a buffer scaling at (\d+) published events per second$`, aBufferScalingAtPublishedEventsPerSecond)
+	ctx.Step(`^the load score should be (\d+)$`, theLoadScoreShouldBe)
+	ctx.Step(`^the storage should score (\d+)$`, theStorageShouldScore)
+	ctx.Step(`^the buffer should have counted (\d+) pruned events$`, theBufferShouldHaveCountedPrunedEvents)
+	ctx.Step(`^a topic "([^"]*)"$`, aTopic)
+	ctx.Step(`^a topic "([^"]*)" with a retention period of (\S+)$`, aTopicWithARetentionPeriodOf)
+	ctx.Step(`^I send an event to the topic "([^"]*)"$`, iSendAnEventToTheTopic)
+	ctx.Step(`^polling the topic "([^"]*)" should return only its event$`, pollingTheTopicShouldReturnOnlyItsEvent)
+	ctx.Step(`^the publish should be rejected as not found$`, thePublishShouldBeRejectedAsNotFound)
+	ctx.Step(`^the retention period of the topic has passed$`, theRetentionPeriodOfTheTopicHasPassed)
+	ctx.Step(`^the topic "([^"]*)" should have no events$`, theTopicShouldHaveNoEvents)
+	ctx.Step(`^the topic "([^"]*)" should have a retention period of (\S+)$`, theTopicShouldHaveARetentionPeriodOf)
+	ctx.Step(`^the integrity check should report an unreadable payload of the topic "([^"]*)"$`, theIntegrityCheckShouldReportAnUnreadablePayloadOfTheTopic)
+	ctx.Step(`^the stats should describe the topic "([^"]*)" with (\d+) events?$`, theStatsShouldDescribeTheTopicWithEvents)
+	ctx.Step(`^the topic "([^"]*)" is exported as a bundle$`, theTopicIsExportedAsABundle)
+	ctx.Step(`^the bundle is imported into a new buffer with the topic "([^"]*)"$`, theBundleIsImportedIntoANewBufferWithTheTopic)
+	ctx.Step(`^the buffer should still have one event$`, theBufferShouldStillHaveOneEvent)
+	ctx.Step(`^I poll for events skipping a seen set with the polled event$`, iPollForEventsSkippingASeenSetWithThePolledEvent)
+	ctx.Step(`^I should get only the other event$`, iShouldGetOnlyTheOtherEvent)
+	ctx.Step(`^all events are pruned$`, allEventsArePruned)
+	ctx.Step(`^I poll for events after the pruned event$`, iPollForEventsAfterThePrunedEvent)
+	ctx.Step(`^I should get a retention expired error$`, iShouldGetARetentionExpiredError)
+	ctx.Step(`^I acknowledge the event publishing a derived event$`, iAcknowledgeTheEventPublishingADerivedEvent)
+	ctx.Step(`^I retry the acknowledgement$`, iRetryTheAcknowledgement)
+	ctx.Step(`^the retry should be rejected with a position conflict$`, theRetryShouldBeRejectedWithAPositionConflict)
+	ctx.Step(`^I should get only the derived event after the acknowledged event$`, iShouldGetOnlyTheDerivedEventAfterTheAcknowledgedEvent)
+	ctx.Step(`^an event with the payload (.+) in the topic "([^"]*)"$`, anEventWithThePayloadInTheTopic)
+	ctx.Step(`^"([^"]*)" redacts the first event because "([^"]*)"$`, redactsTheFirstEventBecause)
+	ctx.Step(`^"([^"]*)" redacts the first event with the replacement (.+) because "([^"]*)"$`, redactsTheFirstEventWithTheReplacementBecause)
+	ctx.Step(`^"([^"]*)" redacts the events where (\S+) is (.+) because "([^"]*)"$`, redactsTheEventsWhereIsBecause)
+	ctx.Step(`^redacting the first event without a reason should fail$`, redactingTheFirstEventWithoutAReasonShouldFail)
+	ctx.Step(`^the buffer should hold the payloads (.+)$`, theBufferShouldHoldThePayloads)
+	ctx.Step(`^the topic "([^"]*)" should hold the payloads (.+)$`, theTopicShouldHoldThePayloads)
+	ctx.Step(`^the redaction should be audited with the principal "([^"]*)", the reason "([^"]*)" and the mode "([^"]*)"$`, theRedactionShouldBeAuditedWithThePrincipalTheReasonAndTheMode)
+	ctx.Step(`^the redaction should name the retained copies "([^"]*)"$`, theRedactionShouldNameTheRetainedCopies)
+	ctx.Step(`^a buffer shipping its WAL$`, aBufferShippingItsWAL)
+	ctx.Step(`^the WAL should hold (\d+) events?$`, theWALShouldHoldEvents)
+	ctx.Step(`^a moment passes$`, aMomentPasses)
+	ctx.Step(`^the WAL is replayed into an empty state$`, theWALIsReplayedIntoAnEmptyState)
+	ctx.Step(`^the WAL is replayed into an empty state until the moment$`, theWALIsReplayedIntoAnEmptyStateUntilTheMoment)
+	ctx.Step(`^(\d+) events? should have been replayed$`, eventsShouldHaveBeenReplayed)
+	ctx.Step(`^the WAL is pruned before the moment$`, theWALIsPrunedBeforeTheMoment)
+	ctx.Step(`^the buffer ships its WAL$`, aBufferShippingItsWAL)
+	ctx.Step(`^a buffer encrypting payloads with the key "([^"]*)" and offloading payloads of at least (\d+) bytes$`, aBufferEncryptingPayloadsWithTheKeyAndOffloadingPayloadsOfAtLeastBytes)
+	ctx.Step(`^a buffer encrypting payloads with the key "([^"]*)" and archiving its events$`, aBufferEncryptingPayloadsWithTheKeyAndArchivingItsEvents)
+	ctx.Step(`^the object store should not contain "([^"]*)"$`, theObjectStoreShouldNotContain)
+	ctx.Step(`^the archive should not contain "([^"]*)"$`, theArchiveShouldNotContain)
+	ctx.Step(`^the WAL should not contain "([^"]*)"$`, theWALShouldNotContain)
+	ctx.Step(`^a CDC subscriber starting at the oldest event$`, aCDCSubscriberStartingAtTheOldestEvent)
+	ctx.Step(`^a CDC subscriber starting after the polled event$`, aCDCSubscriberStartingAfterThePolledEvent)
+	ctx.Step(`^a CDC subscriber of the topic "([^"]*)" starting after its oldest event$`, aCDCSubscriberOfTheTopicStartingAfterItsOldestEvent)
+	ctx.Step(`^a CDC subscriber of the topic "([^"]*)"$`, aCDCSubscriberOfTheTopic)
+	ctx.Step(`^the CDC subscriber should receive the payloads (.+)$`, theCDCSubscriberShouldReceiveThePayloads)
+	ctx.Step(`^the CDC subscriber should be told that the events after its cursor have been pruned$`, theCDCSubscriberShouldBeToldThatTheEventsAfterItsCursorHaveBeenPruned)
+	ctx.Step(`^the CDC subscriber should be disconnected$`, theCDCSubscriberShouldBeDisconnected)
+	ctx.Step(`^a buffer storing its state in a file and deduplicating payloads$`, aBufferStoringItsStateInAFileAndDeduplicatingPayloads)
+	ctx.Step(`^the oldest event is dropped from the state$`, theOldestEventIsDroppedFromTheState)
+	ctx.Step(`^the shared payloads are corrupted$`, theSharedPayloadsAreCorrupted)
+	ctx.Step(`^the integrity check should report (\d+) missing events?$`, theIntegrityCheckShouldReportMissingEvents)
+	ctx.Step(`^the integrity check should count (\d+) appended and (\d+) pruned events$`, theIntegrityCheckShouldCountAppendedAndPrunedEvents)
+	ctx.Step(`^the integrity check should report a checksum mismatch$`, theIntegrityCheckShouldReportAChecksumMismatch)
+	ctx.Step(`^the integrity check of the polled event should check (\d+) events?$`, theIntegrityCheckOfThePolledEventShouldCheckEvents)
+	ctx.Step(`^the consumer "([^"]*)" sends a heartbeat at the polled event$`, theConsumerSendsAHeartbeatAtThePolledEvent)
+	ctx.Step(`^the consumer "([^"]*)" sends a heartbeat$`, theConsumerSendsAHeartbeat)
+	ctx.Step(`^a heartbeat of the unknown consumer "([^"]*)" should be rejected$`, aHeartbeatOfTheUnknownConsumerShouldBeRejected)
+	ctx.Step(`^the consumer "([^"]*)" should have been seen at the polled event$`, theConsumerShouldHaveBeenSeenAtThePolledEvent)
+	ctx.Step(`^consumers silent for (\S+) are watched$`, consumersSilentForAreWatched)
+	ctx.Step(`^an alert "([^"]*)" should be sent for the consumer "([^"]*)"$`, anAlertShouldBeSentForTheConsumer)
+	ctx.Step(`^"([^"]*)" should have published (\d+) events? of (\d+) bytes today$`, shouldHavePublishedEventsOfBytesToday)
+	ctx.Step(`^"([^"]*)" should have consumed (\d+) events? of (\d+) bytes today$`, shouldHaveConsumedEventsOfBytesToday)
+	ctx.Step(`^the usage is flushed$`, theUsageIsFlushed)
+	ctx.Step(`^a buffer with (\d+) write slots? and a write queue of (\d+)$`, aBufferWithWriteSlotsAndAWriteQueueOf)
+	ctx.Step(`^(\d+) publishes waiting for their body$`, publishesWaitingForTheirBody)
+	ctx.Step(`^publishing should be rejected with a Retry-After$`, publishingShouldBeRejectedWithARetryAfter)
+	ctx.Step(`^the waiting publishes are sent$`, theWaitingPublishesAreSent)
+	ctx.Step(`^publishing should be accepted again$`, publishingShouldBeAcceptedAgain)
+	ctx.Step(`^the payload (.*) is published twice$`, thePayloadIsPublishedTwice)
+	ctx.Step(`^the first of the events is pruned$`, theFirstOfTheEventsIsPruned)
+	ctx.Step(`^the state should hold (\d+) blobs? with (\d+) references?$`, theStateShouldHoldBlobsWithReferences)
+	ctx.Step(`^the state should hold no blobs$`, theStateShouldHoldNoBlobs)
 
 }
 
@@ -113,6 +388,70 @@ func getState(ctx context.Context) *State {
 	return ctx.Value(stateKey).(*State)
 }
 
+// startBuffer replaces the server of the scenario with one started with
+// opts, on the state file of the scenario when it has one.
+func startBuffer(ctx context.Context, opts server.Options) error {
+	s := getState(ctx)
+	log := logr.FromContextOrDiscard(ctx)
+
+	var serverURL string
+	var srv *server.Server
+	var stop func()
+	var err error
+	if s.stateFile != "" {
+		serverURL, srv, stop, err = testrig.StartServerWithStateFile(ctx, log, s.stateFile, opts)
+	} else {
+		serverURL, srv, err = testrig.StartServerWithOptions(ctx, log, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("could not start server: %w", err)
+	}
+
+	cl, err := client.New(serverURL)
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+
+	s.serverBaseURL = serverURL
+	s.client = cl
+	s.server = srv
+	s.stopServer = stop
+	return nil
+}
+
+// startAuthenticatedBuffer is startBuffer behind the auth middleware
+// accepting the token entries, the client of the scenario uses the token
+// of the first entry.
+func startAuthenticatedBuffer(ctx context.Context, opts server.Options, tokens ...string) error {
+	s := getState(ctx)
+	log := logr.FromContextOrDiscard(ctx)
+	_, srv, err := testrig.StartServerWithOptions(ctx, log, opts)
+	if err != nil {
+		return fmt.Errorf("could not start server: %w", err)
+	}
+
+	a, err := auth.NewTokens(tokens)
+	if err != nil {
+		return err
+	}
+
+	hs := httptest.NewServer(auth.Middleware(log, auth.Scoped(a, server.RequiredScope))(srv))
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+
+	cl, err := client.New(hs.URL, client.WithToken(strings.Split(tokens[0], ":")[1]))
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+
+	s.serverBaseURL = hs.URL
+	s.client = cl
+	s.server = srv
+	return nil
+}
+
 func iSendASingleEvent(ctx context.Context) error {
 	s := getState(ctx)
 	err := s.client.SendEvents(ctx, []any{"evt1"})
@@ -122,6 +461,90 @@ func iSendASingleEvent(ctx context.Context) error {
 	return nil
 }
 
+func iSendAnEventCompressedWith(ctx context.Context, encoding string) error {
+	s := getState(ctx)
+	cl, err := client.New(s.serverBaseURL, client.WithCompression(encoding))
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+	return cl.SendEvents(ctx, []any{"evt1"})
+}
+
+func iSendAnEventWhileTheBufferIsUnreachable(ctx context.Context) error {
+	s := getState(ctx)
+	dir, err := os.MkdirTemp("", "spool")
+	if err != nil {
+		return err
+	}
+	s.spoolDir = dir
+
+	// nothing listens on the discard port
+	cl, err := client.New("http://127.0.0.1:9", client.WithSpool(dir))
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+
+	err = cl.SendEvents(ctx, []any{"evt1"})
+	if err != nil {
+		return fmt.Errorf("expected the event to be spooled: %w", err)
+	}
+
+	spooled, err := cl.Spooled()
+	if err != nil {
+		return err
+	}
+
+	if spooled != 1 {
+		return fmt.Errorf("expected 1 spooled batch, got %d", spooled)
+	}
+
+	return nil
+}
+
+func theBufferBecomesReachableAgain(ctx context.Context) error {
+	s := getState(ctx)
+	defer os.RemoveAll(s.spoolDir)
+
+	cl, err := client.New(s.serverBaseURL, client.WithSpool(s.spoolDir))
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+
+	return cl.FlushSpool(ctx)
+}
+
+func iSendAnEventToAnUnreachableBufferWithAnAlternate(ctx context.Context) error {
+	s := getState(ctx)
+	cl, err := client.New(
+		"http://127.0.0.1:9",
+		client.WithCircuitBreaker(1, time.Minute),
+		client.WithFallback(client.Alternate(s.client)),
+	)
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+
+	err = cl.SendEvents(ctx, []any{"evt1"})
+	if err != nil {
+		return fmt.Errorf("expected the event to be published to the alternate: %w", err)
+	}
+
+	if !cl.CircuitOpen() {
+		return errors.New("expected the circuit to be open")
+	}
+
+	return nil
+}
+
+func iSendAnEventWithAnUnreachablePrimaryAndABackup(ctx context.Context) error {
+	s := getState(ctx)
+	cl, err := client.New("http://127.0.0.1:9", client.WithTargets(client.PrimaryBackup, s.serverBaseURL))
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+	return cl.SendEvents(ctx, []any{"evt1"})
+}
+
 func iShouldGetAConfirmation() error {
 	// actually nothing comes back
 	return nil
@@ -147,6 +570,22 @@ func iPollForTheEvents(ctx context.Context) error {
 	return nil
 }
 
+func iPollForTheEventsThroughAnUnreachableBufferWithAReplica(ctx context.Context) error {
+	s := getState(ctx)
+	cl, err := client.New("http://127.0.0.1:9", client.WithHedgedPolls(time.Second, s.serverBaseURL))
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+
+	evts := []string{}
+	_, err = cl.PollForEvents(ctx, "", 100, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+	s.pollResult = evts
+	return nil
+}
+
 func iShouldReceiveTheBufferedEvent(ctx context.Context) error {
 	s := getState(ctx)
 	d := cmp.Diff(s.pollResult, []string{"evt1"})
@@ -228,17 +667,48 @@ func twoEventsInTheBuffer(ctx context.Context) error {
 func iPollForOneEvent(ctx context.Context) error {
 	s := getState(ctx)
 	evts := []string{}
-	ids, err := s.client.PollForEvents(ctx, "", 1, sortAsc, &evts)
+	p, err := s.client.Poll(ctx, "", 1, sortAsc, &evts)
 	if err != nil {
 		return fmt.Errorf("failed polling for events: %w", err)
 	}
 
-	if len(ids) != 1 {
-		return fmt.Errorf("expected 1 event, got %d", len(ids))
+	if len(p.IDs) != 1 {
+		return fmt.Errorf("expected 1 event, got %d", len(p.IDs))
 	}
 
+	s.poll = p
 	s.pollResult = evts
-	s.lastId = ids[len(ids)-1]
+	s.lastId = p.IDs[len(p.IDs)-1]
+	return nil
+}
+
+func thePollShouldReportTheOtherEventAsHeadOfTheBuffer(ctx context.Context) error {
+	s := getState(ctx)
+	if s.poll.Head <= s.lastId {
+		return fmt.Errorf("expected head after %s, got %q", s.lastId, s.poll.Head)
+	}
+
+	if s.poll.ServerTime.IsZero() {
+		return errors.New("server time is missing")
+	}
+
+	lag, err := s.poll.Lag()
+	if err != nil {
+		return err
+	}
+
+	if lag < 0 {
+		return fmt.Errorf("expected positive lag, got %s", lag)
+	}
+
+	return nil
+}
+
+func thePollShouldNotReportTheHeadOfTheBuffer(ctx context.Context) error {
+	h := getState(ctx).rawPollHeader
+	if h.Get("X-Buffer-Head") != "" || h.Get("X-Server-Time") != "" {
+		return fmt.Errorf("expected no headers describing the buffer, got %v", h)
+	}
 	return nil
 }
 
@@ -266,6 +736,34 @@ func iShouldGetOneEventForEachPoll(ctx context.Context) error {
 	return nil
 }
 
+func iPollForEventsSkippingASeenSetWithThePolledEvent(ctx context.Context) error {
+	s := getState(ctx)
+	seen := client.NewSeenSet(1, 0.0001)
+	seen.Add(s.lastId)
+
+	id, err := s.client.UploadSeenSet(ctx, seen)
+	if err != nil {
+		return fmt.Errorf("could not upload seen set: %w", err)
+	}
+
+	evts := []string{}
+	_, err = s.client.PollSkippingSeen(ctx, id, "", 10, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+	s.secondPollResult = evts
+	return nil
+}
+
+func iShouldGetOnlyTheOtherEvent(ctx context.Context) error {
+	s := getState(ctx)
+	d := cmp.Diff(s.secondPollResult, []string{"evt2"})
+	if d != "" {
+		return fmt.Errorf("unexpected poll result:\n%s", d)
+	}
+	return nil
+}
+
 func iShouldReceiveDescTheNewEvent(ctx context.Context) error {
 	s := getState(ctx)
 	select {
@@ -284,3 +782,67 @@ func iShouldReceiveDescTheNewEvent(ctx context.Context) error {
 
 	return nil
 }
+
+func allEventsArePruned(ctx context.Context) error {
+	s := getState(ctx)
+	var err error
+	s.pruneStatus, err = s.server.PruneReport(time.Now().Add(time.Second))
+	return err
+}
+
+func iPollForEventsAfterThePrunedEvent(ctx context.Context) error {
+	s := getState(ctx)
+	evts := []string{}
+	_, s.pollErr = s.client.PollForEvents(ctx, s.lastId, 1, sortAsc, &evts)
+	return nil
+}
+
+func iShouldGetARetentionExpiredError(ctx context.Context) error {
+	s := getState(ctx)
+	var re *client.RetentionExpiredError
+	if !errors.As(s.pollErr, &re) {
+		return fmt.Errorf("expected retention expired error, got %v", s.pollErr)
+	}
+	if re.Oldest != "" {
+		return fmt.Errorf("expected no oldest event, got %s", re.Oldest)
+	}
+	return nil
+}
+
+func iAcknowledgeTheEventPublishingADerivedEvent(ctx context.Context) error {
+	s := getState(ctx)
+	_, err := s.client.Commit(ctx, "processor", "", s.lastId, []any{"derived"})
+	return err
+}
+
+func iRetryTheAcknowledgement(ctx context.Context) error {
+	s := getState(ctx)
+	_, s.commitErr = s.client.Commit(ctx, "processor", "", s.lastId, []any{"derived"})
+	return nil
+}
+
+func theRetryShouldBeRejectedWithAPositionConflict(ctx context.Context) error {
+	s := getState(ctx)
+	var pce *client.PositionConflictError
+	if !errors.As(s.commitErr, &pce) {
+		return fmt.Errorf("expected position conflict error, got %v", s.commitErr)
+	}
+	if pce.Position != s.lastId {
+		return fmt.Errorf("expected consumer at %s, got %s", s.lastId, pce.Position)
+	}
+	return nil
+}
+
+func iShouldGetOnlyTheDerivedEventAfterTheAcknowledgedEvent(ctx context.Context) error {
+	s := getState(ctx)
+	evts := []string{}
+	_, err := s.client.PollForEvents(ctx, s.lastId, 10, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+	d := cmp.Diff(evts, []string{"derived"})
+	if d != "" {
+		return fmt.Errorf("unexpected poll result:\n%s", d)
+	}
+	return nil
+}
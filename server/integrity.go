@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// appendedPath and prunedPath count all events ever appended and pruned,
+	// their difference is the number of events the buffer has to hold.
+	appendedPath = metaPath.Append("appended")
+	prunedPath   = metaPath.Append("pruned")
+)
+
+var (
+	integrityProblems = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "event_buffer_integrity_problems",
+		Help: "Number of problems found by the last integrity check.",
+	})
+	integrityChecked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "event_buffer_integrity_checked_events",
+		Help: "Number of events verified by the last integrity check.",
+	})
+	integrityLastCheck = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "event_buffer_integrity_last_check_timestamp_seconds",
+		Help: "Time of the last completed integrity check.",
+	})
+)
+
+func getCounter(tx bolted.SugaredReadTx, path dbpath.Path) uint64 {
+	if !tx.Exists(path) {
+		return 0
+	}
+	return binary.BigEndian.Uint64(tx.Get(path))
+}
+
+func addCounter(tx bolted.SugaredWriteTx, path dbpath.Path, n int) {
+	tx.Put(path, binary.BigEndian.AppendUint64(nil, getCounter(tx, path)+uint64(n)))
+}
+
+// initCounters starts counting at the events of a state created before
+// the counters were introduced.
+func initCounters(tx bolted.SugaredWriteTx) {
+	if tx.Exists(appendedPath) {
+		return
+	}
+	n := 0
+	for it := tx.Iterator(eventsPath); !it.IsDone(); it.Next() {
+		n++
+	}
+	addCounter(tx, appendedPath, n)
+	addCounter(tx, prunedPath, 0)
+}
+
+// IntegrityProblem is a problem found by an integrity check, Topic is
+// empty for events of the buffer.
+type IntegrityProblem struct {
+	Topic   string `json:"topic,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Problem string `json:"problem"`
+}
+
+// IntegrityReport is the result of an integrity check of the buffer and
+// its topics. The counters are only reported for checks of all events and
+// sum up all streams, Missing is the number of appended events that are
+// neither stored nor pruned.
+type IntegrityReport struct {
+	From     string             `json:"from,omitempty"`
+	To       string             `json:"to,omitempty"`
+	Checked  int                `json:"checked"`
+	Problems []IntegrityProblem `json:"problems"`
+	Appended *uint64            `json:"appended,omitempty"`
+	Pruned   *uint64            `json:"pruned,omitempty"`
+	Missing  *int64             `json:"missing,omitempty"`
+}
+
+// CheckIntegrity verifies the events of the buffer and its topics with ids
+// between from and to, both inclusive and optional. Stored records have to
+// be readable, shared payloads and payloads in the payload log have to
+// match their checksum and inline payloads have to be valid JSON.
+// Offloaded payloads are not fetched. When all events are checked, the
+// number of stored events of each stream is compared with its appended and
+// pruned counters to detect dropped events.
+func (s *Server) CheckIntegrity(ctx context.Context, from, to string) (IntegrityReport, error) {
+	report := IntegrityReport{From: from, To: to, Problems: []IntegrityProblem{}}
+	full := from == "" && to == ""
+
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		topics, err := readTopics(tx)
+		if err != nil {
+			return err
+		}
+
+		verifiedBlobs := map[string]bool{}
+		appended, pruned, missing := uint64(0), uint64(0), int64(0)
+
+		for _, st := range append([]stream{defaultStream}, topics...) {
+			topic := st.topic
+			problem := func(id, format string, args ...any) {
+				report.Problems = append(report.Problems, IntegrityProblem{Topic: topic, ID: id, Problem: fmt.Sprintf(format, args...)})
+			}
+
+			checked, err := s.checkStreamIntegrity(ctx, tx, st, from, to, verifiedBlobs, problem)
+			if err != nil {
+				return err
+			}
+			report.Checked += checked
+
+			if !full {
+				continue
+			}
+
+			a := getCounter(tx, st.appended)
+			p := getCounter(tx, st.pruned)
+			m := int64(a) - int64(p) - int64(checked)
+			if m != 0 {
+				problem("", "%d of %d appended and %d pruned events are missing", m, a, p)
+			}
+			appended += a
+			pruned += p
+			missing += m
+		}
+
+		if full {
+			report.Appended = &appended
+			report.Pruned = &pruned
+			report.Missing = &missing
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return report, fmt.Errorf("could not check integrity: %w", err)
+	}
+
+	if full {
+		integrityProblems.Set(float64(len(report.Problems)))
+		integrityChecked.Set(float64(report.Checked))
+		integrityLastCheck.Set(float64(time.Now().Unix()))
+	}
+
+	return report, nil
+}
+
+// checkStreamIntegrity verifies the events of a stream between from and to
+// and returns the number of checked events. Shared payloads are verified
+// once across all streams.
+func (s *Server) checkStreamIntegrity(ctx context.Context, tx bolted.SugaredReadTx, st stream, from, to string, verifiedBlobs map[string]bool, problem func(id, format string, args ...any)) (int, error) {
+	checked := 0
+
+	it := tx.Iterator(st.events)
+	if from != "" {
+		it.Seek(from)
+	}
+
+	for ; !it.IsDone(); it.Next() {
+		if ctx.Err() != nil {
+			return checked, ctx.Err()
+		}
+
+		id := it.GetKey()
+		if to != "" && id > to {
+			break
+		}
+		checked++
+
+		_, err := eventTime(id)
+		if err != nil {
+			problem(id, "invalid id: %s", err)
+		}
+
+		r, isRecord, err := decodeRecord(it.GetValue())
+		switch {
+		case err != nil:
+			problem(id, "unreadable record: %s", err)
+		case !isRecord:
+			payload, err := s.decodePayload(it.GetValue())
+			if err != nil {
+				problem(id, "unreadable payload: %s", err)
+			} else if !json.Valid(payload) {
+				problem(id, "payload is not valid JSON")
+			}
+		case r.Blob != "":
+			if verifiedBlobs[r.Blob] {
+				continue
+			}
+			verifiedBlobs[r.Blob] = true
+			if !tx.Exists(blobsPath.Append(r.Blob)) {
+				problem(id, "shared payload %s is missing", r.Blob)
+				continue
+			}
+			if !tx.Exists(blobRefsPath.Append(r.Blob)) {
+				problem(id, "shared payload %s has no reference count", r.Blob)
+			}
+			stored := tx.Get(blobsPath.Append(r.Blob))
+			blob, err := s.decodePayload(stored)
+			if err != nil {
+				problem(id, "unreadable shared payload %s: %s", r.Blob, err)
+				continue
+			}
+			// encrypted payloads are keyed by a keyed hash and
+			// authenticated by their decryption instead
+			if encryptionKeyID(stored) != "" {
+				continue
+			}
+			sum := sha256.Sum256(blob)
+			if hex.EncodeToString(sum[:]) != r.Blob {
+				problem(id, "checksum of shared payload %s does not match", r.Blob)
+			}
+		case r.Log != nil:
+			if s.opts.PayloadLog == nil {
+				problem(id, "payload is in the payload log, which is not configured")
+				continue
+			}
+			if !tx.Exists(payloadLogRefsPath.Append(segmentKey(r.Log.Segment))) {
+				problem(id, "payload log segment %d has no reference count", r.Log.Segment)
+			}
+			_, err = s.opts.PayloadLog.read(*r.Log)
+			if err != nil {
+				problem(id, "%s", err)
+			}
+		case r.Object == "":
+			problem(id, "record does not reference a payload")
+		}
+	}
+
+	return checked, nil
+}
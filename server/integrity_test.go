@@ -0,0 +1,129 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferStoringItsStateInAFileAndDeduplicatingPayloads(ctx context.Context) error {
+	err := aBufferStoringItsStateInAFile(ctx)
+	if err != nil {
+		return err
+	}
+	s := getState(ctx)
+	s.stopServer()
+	s.dedupMinSize = 1
+	return startBuffer(ctx, server.Options{DedupMinSize: s.dedupMinSize})
+}
+
+// tamperState changes the state file of the stopped buffer with fn and
+// starts the buffer again.
+func tamperState(ctx context.Context, fn func(tx bolted.SugaredWriteTx) error) error {
+	s := getState(ctx)
+	s.stopServer()
+
+	db, err := embedded.Open(s.stateFile, 0700, embedded.Options{})
+	if err != nil {
+		return err
+	}
+
+	err = bolted.SugaredWrite(db, fn)
+	closeErr := db.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return startBuffer(ctx, server.Options{DedupMinSize: s.dedupMinSize})
+}
+
+func theOldestEventIsDroppedFromTheState(ctx context.Context) error {
+	return tamperState(ctx, func(tx bolted.SugaredWriteTx) error {
+		events := dbpath.ToPath("events")
+		it := tx.Iterator(events)
+		if it.IsDone() {
+			return fmt.Errorf("the buffer has no events")
+		}
+		tx.Delete(events.Append(it.GetKey()))
+		return nil
+	})
+}
+
+func theSharedPayloadsAreCorrupted(ctx context.Context) error {
+	return tamperState(ctx, func(tx bolted.SugaredWriteTx) error {
+		blobs := dbpath.ToPath("blobs")
+		keys := []string{}
+		for it := tx.Iterator(blobs); !it.IsDone(); it.Next() {
+			keys = append(keys, it.GetKey())
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("the buffer has no shared payloads")
+		}
+		for _, k := range keys {
+			tx.Put(blobs.Append(k), []byte(`{"corrupted":true}`))
+		}
+		return nil
+	})
+}
+
+func theIntegrityCheckShouldReportMissingEvents(ctx context.Context, n int) error {
+	report, err := getState(ctx).server.CheckIntegrity(ctx, "", "")
+	if err != nil {
+		return err
+	}
+	if report.Missing == nil || *report.Missing != int64(n) {
+		return fmt.Errorf("expected %d missing events, got %+v", n, report)
+	}
+	if len(report.Problems) != 1 || !strings.Contains(report.Problems[0].Problem, "missing") {
+		return fmt.Errorf("expected missing events to be reported, got %v", report.Problems)
+	}
+	return nil
+}
+
+func theIntegrityCheckShouldCountAppendedAndPrunedEvents(ctx context.Context, appended, pruned int) error {
+	report, err := getState(ctx).server.CheckIntegrity(ctx, "", "")
+	if err != nil {
+		return err
+	}
+	if report.Appended == nil || *report.Appended != uint64(appended) || report.Pruned == nil || *report.Pruned != uint64(pruned) {
+		return fmt.Errorf("expected %d appended and %d pruned events, got %+v", appended, pruned, report)
+	}
+	if report.Missing == nil || *report.Missing != 0 {
+		return fmt.Errorf("expected no missing events, got %+v", report)
+	}
+	return nil
+}
+
+func theIntegrityCheckShouldReportAChecksumMismatch(ctx context.Context) error {
+	report, err := getState(ctx).server.CheckIntegrity(ctx, "", "")
+	if err != nil {
+		return err
+	}
+	if len(report.Problems) != 1 || !strings.Contains(report.Problems[0].Problem, "checksum") {
+		return fmt.Errorf("expected a checksum mismatch, got %v", report.Problems)
+	}
+	return nil
+}
+
+func theIntegrityCheckOfThePolledEventShouldCheckEvents(ctx context.Context, n int) error {
+	s := getState(ctx)
+	report, err := s.server.CheckIntegrity(ctx, s.lastId, s.lastId)
+	if err != nil {
+		return err
+	}
+	if report.Checked != n || len(report.Problems) != 0 {
+		return fmt.Errorf("expected %d checked events without problems, got %+v", n, report)
+	}
+	if report.Appended != nil || report.Missing != nil {
+		return fmt.Errorf("expected no counters for a range, got %+v", report)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// jsonPointer is a parsed RFC 6901 JSON pointer.
+type jsonPointer []string
+
+func parseJSONPointer(p string) (jsonPointer, error) {
+	if p == "" {
+		return jsonPointer{}, nil
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("json pointer %q must start with /", p)
+	}
+
+	parts := strings.Split(p[1:], "/")
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+	}
+
+	return jsonPointer(parts), nil
+}
+
+// lookup returns the value the pointer refers to in a document decoded
+// into any.
+func (jp jsonPointer) lookup(doc any) (any, bool) {
+	current := doc
+	for _, part := range jp {
+		switch v := current.(type) {
+		case map[string]any:
+			next, found := v[part]
+			if !found {
+				return nil, false
+			}
+			current = next
+		case []any:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			current = v[idx]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// set replaces the value the pointer refers to, it returns false if the
+// parent of the value doesn't exist. Setting the root is not supported.
+func (jp jsonPointer) set(doc any, value any) bool {
+	if len(jp) == 0 {
+		return false
+	}
+
+	parent, found := jp[:len(jp)-1].lookup(doc)
+	if !found {
+		return false
+	}
+
+	last := jp[len(jp)-1]
+	switch v := parent.(type) {
+	case map[string]any:
+		_, found := v[last]
+		if !found {
+			return false
+		}
+		v[last] = value
+		return true
+	case []any:
+		idx, err := strconv.Atoi(last)
+		if err != nil || idx < 0 || idx >= len(v) {
+			return false
+		}
+		v[idx] = value
+		return true
+	}
+	return false
+}
+
+// remove deletes the value the pointer refers to from its parent object.
+// Array elements are replaced with null to keep indexes stable.
+func (jp jsonPointer) remove(doc any) bool {
+	if len(jp) == 0 {
+		return false
+	}
+
+	parent, found := jp[:len(jp)-1].lookup(doc)
+	if !found {
+		return false
+	}
+
+	last := jp[len(jp)-1]
+	switch v := parent.(type) {
+	case map[string]any:
+		_, found := v[last]
+		delete(v, last)
+		return found
+	case []any:
+		return jp.set(doc, nil)
+	}
+	return false
+}
+
+// PayloadMatcher matches JSON payloads where the value at a JSON pointer
+// is equal to a given value.
+type PayloadMatcher struct {
+	pointer jsonPointer
+	value   any
+}
+
+func NewPayloadMatcher(pointer string, value json.RawMessage) (*PayloadMatcher, error) {
+	jp, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	var v any
+	err = json.Unmarshal(value, &v)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse match value: %w", err)
+	}
+
+	return &PayloadMatcher{pointer: jp, value: v}, nil
+}
+
+func (m *PayloadMatcher) Matches(payload json.RawMessage) (bool, error) {
+	var doc any
+	err := json.Unmarshal(payload, &doc)
+	if err != nil {
+		return false, fmt.Errorf("could not parse payload: %w", err)
+	}
+
+	return m.matchesDoc(doc), nil
+}
+
+// matchesDoc matches a payload decoded into any.
+func (m *PayloadMatcher) matchesDoc(doc any) bool {
+	v, found := m.pointer.lookup(doc)
+	return found && reflect.DeepEqual(v, m.value)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// loadWindow is the number of seconds the publish rate is averaged over.
+const loadWindow = 60
+
+const (
+	defaultLoadPublishRate = 1000
+	defaultLoadConnections = 1000
+)
+
+// LoadTargets are the values at which the components of the load score
+// reach 100, e.g. the publish rate one instance should handle before the
+// deployment is scaled out.
+type LoadTargets struct {
+	// PublishRate is in events per second, it defaults to 1000.
+	PublishRate float64
+	// Connections counts the API requests in progress, long polls, streams
+	// and WebSockets hold one each. It defaults to 1000.
+	Connections int
+}
+
+// Load is the response of GET /load. Score is the highest score of the
+// components, each of them is its value relative to its target, from 0
+// to 100. Storage is the used share of MaxBufferEvents or MaxBufferBytes,
+// whichever is higher, it is 0 without budgets.
+type Load struct {
+	Score       int           `json:"score"`
+	PublishRate LoadComponent `json:"publish_rate"`
+	Connections LoadComponent `json:"connections"`
+	Storage     LoadComponent `json:"storage"`
+}
+
+type LoadComponent struct {
+	Value  float64 `json:"value"`
+	Target float64 `json:"target,omitempty"`
+	Score  int     `json:"score"`
+}
+
+func newLoadComponent(value, target float64) LoadComponent {
+	return LoadComponent{Value: value, Target: target, Score: loadScore(value / target)}
+}
+
+// loadScore maps a share of a target to 0-100.
+func loadScore(share float64) int {
+	return int(math.Round(math.Max(0, math.Min(1, share)) * 100))
+}
+
+// loadMeter counts the published events of the last loadWindow seconds
+// and the requests in progress.
+type loadMeter struct {
+	connections atomic.Int64
+
+	mu sync.Mutex
+	// events[i] counts the events published in the second seconds[i].
+	events  [loadWindow]uint64
+	seconds [loadWindow]int64
+}
+
+func (m *loadMeter) published(n int) {
+	now := time.Now().Unix()
+	i := now % loadWindow
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.seconds[i] != now {
+		m.seconds[i] = now
+		m.events[i] = 0
+	}
+	m.events[i] += uint64(n)
+}
+
+// publishRate returns the events published per second over the last
+// loadWindow seconds.
+func (m *loadMeter) publishRate() float64 {
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total := uint64(0)
+	for i, second := range m.seconds {
+		if second > now-loadWindow {
+			total += m.events[i]
+		}
+	}
+	return float64(total) / loadWindow
+}
+
+// trackConnections counts the requests in progress.
+func (m *loadMeter) trackConnections(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.connections.Add(1)
+		defer m.connections.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Load summarizes the load of the buffer in a score, e.g. for scaling the
+// deployment on it.
+func (s *Server) Load() (Load, error) {
+	targets := s.opts.Load
+	if targets.PublishRate <= 0 {
+		targets.PublishRate = defaultLoadPublishRate
+	}
+	if targets.Connections <= 0 {
+		targets.Connections = defaultLoadConnections
+	}
+
+	storage := 0.0
+	if s.opts.MaxBufferEvents > 0 || s.opts.MaxBufferBytes > 0 {
+		err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+			if s.opts.MaxBufferEvents > 0 {
+				topics, err := readTopics(tx)
+				if err != nil {
+					return err
+				}
+				events := totalEvents(tx, append([]stream{defaultStream}, topics...))
+				storage = float64(events) / float64(s.opts.MaxBufferEvents)
+			}
+			if s.opts.MaxBufferBytes > 0 {
+				storage = math.Max(storage, float64(getCounter(tx, storedBytesPath))/float64(s.opts.MaxBufferBytes))
+			}
+			return nil
+		})
+		if err != nil {
+			return Load{}, fmt.Errorf("could not read storage: %w", err)
+		}
+	}
+
+	l := Load{
+		PublishRate: newLoadComponent(s.load.publishRate(), targets.PublishRate),
+		Connections: newLoadComponent(float64(s.load.connections.Load()), float64(targets.Connections)),
+		Storage:     LoadComponent{Value: storage, Score: loadScore(storage)},
+	}
+	for _, c := range []LoadComponent{l.PublishRate, l.Connections, l.Storage} {
+		if c.Score > l.Score {
+			l.Score = c.Score
+		}
+	}
+	return l, nil
+}
+
+func (s *Server) serveLoad(w http.ResponseWriter, r *http.Request) {
+	l, err := s.Load()
+	if err != nil {
+		s.log.Error(err, "could not determine load")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
+
+var loadScoreDesc = prometheus.NewDesc(
+	"event_buffer_load_score",
+	"Load of the buffer from 0 to 100, the highest score of its publish rate, connections and storage, see GET /load.",
+	nil, nil,
+)
+
+// loadCollector exposes the load score of a server.
+type loadCollector struct {
+	s *Server
+}
+
+func (lc loadCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- loadScoreDesc
+}
+
+func (lc loadCollector) Collect(ch chan<- prometheus.Metric) {
+	l, err := lc.s.Load()
+	if err != nil {
+		lc.s.log.Error(err, "could not collect load")
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(loadScoreDesc, prometheus.GaugeValue, float64(l.Score))
+}
@@ -0,0 +1,52 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferScalingAtPublishedEventsPerSecond(ctx context.Context, rate int) error {
+	return startBuffer(ctx, server.Options{Load: server.LoadTargets{PublishRate: float64(rate)}})
+}
+
+func getLoad(ctx context.Context) (server.Load, error) {
+	l := server.Load{}
+	res, err := http.Get(getState(ctx).serverBaseURL + "/load")
+	if err != nil {
+		return l, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return l, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&l)
+	return l, err
+}
+
+func theLoadScoreShouldBe(ctx context.Context, score int) error {
+	l, err := getLoad(ctx)
+	if err != nil {
+		return err
+	}
+	if l.Score != score {
+		return fmt.Errorf("expected a load score of %d, got %#v", score, l)
+	}
+	return nil
+}
+
+func theStorageShouldScore(ctx context.Context, score int) error {
+	l, err := getLoad(ctx)
+	if err != nil {
+		return err
+	}
+	if l.Storage.Score != score {
+		return fmt.Errorf("expected a storage score of %d, got %#v", score, l.Storage)
+	}
+	return nil
+}
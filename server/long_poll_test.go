@@ -0,0 +1,84 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/draganm/event-buffer/client"
+)
+
+func iPollForTheEventsWaiting(ctx context.Context, wait string) error {
+	s := getState(ctx)
+	d, err := time.ParseDuration(wait)
+	if err != nil {
+		return err
+	}
+
+	cl, err := client.New(s.serverBaseURL, client.WithPollWait(d))
+	if err != nil {
+		return err
+	}
+
+	evts := []string{}
+	s.poll, err = cl.Poll(ctx, "", 10, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+	s.pollResult = evts
+	return nil
+}
+
+func iStartAPollWaitingAndDisconnectAfter(ctx context.Context, wait, after string) error {
+	s := getState(ctx)
+	w, err := time.ParseDuration(wait)
+	if err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(after)
+	if err != nil {
+		return err
+	}
+
+	cl, err := client.New(s.serverBaseURL, client.WithPollWait(w))
+	if err != nil {
+		return err
+	}
+
+	pollCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	evts := []string{}
+	_, err = cl.Poll(pollCtx, "", 10, sortAsc, &evts)
+	if err == nil {
+		return fmt.Errorf("expected the poll to be cancelled, got %d events", len(evts))
+	}
+	return nil
+}
+
+func theMetricsShouldCountADisconnectedPoll(ctx context.Context) error {
+	// the server notices the disconnect shortly after the client, long
+	// before the wait of the poll expires
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		polls, err := gatheredMetrics("event_buffer_poll_duration_seconds", map[string]string{"result": "disconnected"})
+		if err != nil {
+			return err
+		}
+		if len(polls) > 0 && polls[0].GetHistogram().GetSampleCount() > 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no disconnected poll was observed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func thePollShouldReturnNoEvents(ctx context.Context) error {
+	s := getState(ctx)
+	if len(s.poll.IDs) != 0 {
+		return fmt.Errorf("expected no events, got %d", len(s.poll.IDs))
+	}
+	return nil
+}
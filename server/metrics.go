@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "event_buffer_http_requests_total",
+		Help: "Number of API requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "event_buffer_http_request_duration_seconds",
+		Help:    "Duration of API requests by route and method, long polls and streams include the time they wait.",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60, 300},
+	}, []string{"route", "method"})
+	pollDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "event_buffer_poll_duration_seconds",
+		Help:    "Duration of polls until they respond, by whether they returned events or their consumer disconnected.",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60, 300},
+	}, []string{"result"})
+	pollReadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "event_buffer_poll_read_duration_seconds",
+		Help: "Duration of reading the events of a poll from the state, without waiting for events.",
+	})
+	lastPruneDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "event_buffer_last_prune_duration_seconds",
+		Help: "Duration of the last prune.",
+	})
+	lastPruneTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "event_buffer_last_prune_timestamp_seconds",
+		Help: "Unix time the last prune finished.",
+	})
+	pruneErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "event_buffer_prune_errors_total",
+		Help: "Number of prunes that failed.",
+	})
+)
+
+// observePoll records the duration of a poll started at started.
+func observePoll(started time.Time, events int) {
+	result := "events"
+	if events == 0 {
+		result = "empty"
+	}
+	pollDuration.WithLabelValues(result).Observe(time.Since(started).Seconds())
+}
+
+// observeDisconnectedPoll records the duration of a poll whose consumer
+// disconnected before it responded.
+func observeDisconnectedPoll(started time.Time) {
+	pollDuration.WithLabelValues("disconnected").Observe(time.Since(started).Seconds())
+}
+
+// instrumentRoutes counts the requests of the matched routes, observes
+// their duration and records their spans. Routes are labeled with their
+// path template, so topics and ids don't add labels.
+func instrumentRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			tmpl, err := cr.GetPathTemplate()
+			if err == nil {
+				route = tmpl
+			}
+		}
+
+		started := time.Now()
+		r, span := startRequestSpan(r, route)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		code := sw.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		endRequestSpan(span, code)
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(code)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(started).Seconds())
+	})
+}
+
+// statusWriter records the status code of a response. It flushes and
+// hijacks like the writer it wraps, for streams and WebSockets.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.code == 0 {
+		sw.code = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.code == 0 {
+		sw.code = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	// hijacked connections are upgraded, e.g. to WebSockets
+	if sw.code == 0 {
+		sw.code = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
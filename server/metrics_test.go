@@ -0,0 +1,56 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatheredMetrics returns the metrics of the family name whose labels
+// include all of labels.
+func gatheredMetrics(name string, labels map[string]string) ([]*dto.Metric, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	matching := []*dto.Metric{}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			found := 0
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v == l.GetValue() {
+					found++
+				}
+			}
+			if found == len(labels) {
+				matching = append(matching, m)
+			}
+		}
+	}
+	return matching, nil
+}
+
+func theMetricsShouldCountAPollOfWithStatus(ctx context.Context, route, code string) error {
+	requests, err := gatheredMetrics("event_buffer_http_requests_total", map[string]string{"route": route, "method": "GET", "code": code})
+	if err != nil {
+		return err
+	}
+	if len(requests) == 0 || requests[0].GetCounter().GetValue() == 0 {
+		return fmt.Errorf("no request of %s with status %s was counted", route, code)
+	}
+
+	polls, err := gatheredMetrics("event_buffer_poll_duration_seconds", map[string]string{"result": "events"})
+	if err != nil {
+		return err
+	}
+	if len(polls) == 0 || polls[0].GetHistogram().GetSampleCount() == 0 {
+		return fmt.Errorf("no poll duration was observed")
+	}
+	return nil
+}
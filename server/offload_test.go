@@ -0,0 +1,52 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferOffloadingPayloadsOfAtLeastBytes(ctx context.Context, n int) error {
+	err := aBufferStoringItsStateInAFile(ctx)
+	if err != nil {
+		return err
+	}
+
+	td, err := os.MkdirTemp("", "offload")
+	if err != nil {
+		return fmt.Errorf("could not create temp dir: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		os.RemoveAll(td)
+	}()
+
+	store, err := objectstore.Open("file://" + td + "/")
+	if err != nil {
+		return fmt.Errorf("could not open offload store: %w", err)
+	}
+
+	s := getState(ctx)
+	s.offloadStore = store
+	s.stopServer()
+	return startBuffer(ctx, server.Options{OffloadStore: store, OffloadMinSize: n, EncryptionKeys: scenarioEncryptionKeys(ctx)})
+}
+
+func theBufferIsRestartedWithoutAnObjectStore(ctx context.Context) error {
+	getState(ctx).stopServer()
+	return startBuffer(ctx, server.Options{})
+}
+
+func theObjectStoreShouldHoldOffloadedPayloads(ctx context.Context, n int) error {
+	keys, err := getState(ctx).offloadStore.List(ctx, "payloads/")
+	if err != nil {
+		return fmt.Errorf("could not list offloaded payloads: %w", err)
+	}
+	if len(keys) != n {
+		return fmt.Errorf("expected %d offloaded payloads, got %v", n, keys)
+	}
+	return nil
+}
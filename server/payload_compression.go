@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Payloads stored in the database, inline or as blobs, start with one of
+// these markers when they are compressed. Like recordMarker they can't
+// start JSON.
+const (
+	zstdMarker   = 0x01
+	snappyMarker = 0x02
+)
+
+// Values of Options.PayloadCompression.
+const (
+	PayloadCompressionZstd   = "zstd"
+	PayloadCompressionSnappy = "snappy"
+)
+
+var (
+	zstdPayloads       sync.Once
+	zstdPayloadEncoder *zstd.Encoder
+	zstdPayloadDecoder *zstd.Decoder
+)
+
+// zstdCodec returns the encoder and decoder of stored payloads, both are
+// only used with EncodeAll and DecodeAll, which are safe for concurrent
+// use.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdPayloads.Do(func() {
+		// errors are only returned for invalid options
+		zstdPayloadEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		zstdPayloadDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdPayloadEncoder, zstdPayloadDecoder
+}
+
+func checkPayloadCompression(compression string) error {
+	switch compression {
+	case "", PayloadCompressionZstd, PayloadCompressionSnappy:
+		return nil
+	}
+	return fmt.Errorf("unsupported payload compression %q, must be zstd or snappy", compression)
+}
+
+// compressPayload returns the value a payload is stored as in the
+// database. Payloads are kept as they are when compression is disabled or
+// doesn't make them smaller.
+func (s Server) compressPayload(payload []byte) []byte {
+	var compressed []byte
+	switch s.opts.PayloadCompression {
+	case PayloadCompressionZstd:
+		enc, _ := zstdCodec()
+		compressed = enc.EncodeAll(payload, []byte{zstdMarker})
+	case PayloadCompressionSnappy:
+		compressed = append([]byte{snappyMarker}, s2.EncodeSnappy(nil, payload)...)
+	default:
+		return payload
+	}
+
+	if len(compressed) >= len(payload) {
+		return payload
+	}
+	return compressed
+}
+
+// payloadCompression returns the compression of a stored payload, or ""
+// when it is stored as is.
+func payloadCompression(value []byte) string {
+	if len(value) == 0 {
+		return ""
+	}
+	switch value[0] {
+	case zstdMarker:
+		return PayloadCompressionZstd
+	case snappyMarker:
+		return PayloadCompressionSnappy
+	}
+	return ""
+}
+
+// decompressPayload returns the payload of a value stored by
+// compressPayload. Payloads are decompressed regardless of the current
+// compression option, so it can be changed or disabled at any time.
+func decompressPayload(value []byte) ([]byte, error) {
+	switch payloadCompression(value) {
+	case PayloadCompressionZstd:
+		_, dec := zstdCodec()
+		payload, err := dec.DecodeAll(value[1:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress zstd payload: %w", err)
+		}
+		return payload, nil
+	case PayloadCompressionSnappy:
+		payload, err := s2.Decode(nil, value[1:])
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress snappy payload: %w", err)
+		}
+		return payload, nil
+	}
+	return value, nil
+}
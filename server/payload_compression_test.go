@@ -0,0 +1,85 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/draganm/event-buffer/server"
+	"github.com/google/go-cmp/cmp"
+)
+
+// compressibleEvent is large and repetitive, like the JSON of verbose
+// producers.
+var compressibleEvent = map[string]any{
+	"type":        "order.created",
+	"description": strings.Repeat("a verbose description of the order ", 100),
+}
+
+func aBufferCompressingStoredPayloadsWith(ctx context.Context, compression string) error {
+	return startBuffer(ctx, server.Options{PayloadCompression: compression})
+}
+
+func aBufferCompressingAndDeduplicatingStoredPayloadsWith(ctx context.Context, compression string) error {
+	return startBuffer(ctx, server.Options{PayloadCompression: compression, DedupMinSize: 1})
+}
+
+func aLargeCompressibleEventInTheBuffer(ctx context.Context) error {
+	s := getState(ctx)
+	b, err := s.client.PublishBatch(ctx, []any{compressibleEvent})
+	if err != nil {
+		return err
+	}
+	s.lastId = b.FirstID
+	return nil
+}
+
+func pollingShouldReturnTheLargeEvent(ctx context.Context) error {
+	s := getState(ctx)
+	evts := []map[string]any{}
+	_, err := s.client.PollForEvents(ctx, "", 1, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+
+	d := cmp.Diff(evts, []map[string]any{compressibleEvent})
+	if d != "" {
+		return fmt.Errorf("unexpected poll result:\n%s", d)
+	}
+	return nil
+}
+
+func theEventShouldBeStoredCompressedWith(ctx context.Context, compression string) error {
+	s := getState(ctx)
+	res, err := http.Get(s.serverBaseURL + "/events/" + s.lastId)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	detail := struct {
+		Storage struct {
+			Kind        string `json:"kind"`
+			StoredSize  int    `json:"stored_size"`
+			PayloadSize int    `json:"payload_size"`
+			Compression string `json:"compression"`
+		} `json:"storage"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&detail)
+	if err != nil {
+		return fmt.Errorf("could not decode event: %w", err)
+	}
+	if detail.Storage.Compression != compression {
+		return fmt.Errorf("expected %s compression, got %q", compression, detail.Storage.Compression)
+	}
+	if detail.Storage.Kind == "inline" && detail.Storage.StoredSize >= detail.Storage.PayloadSize {
+		return fmt.Errorf("expected the stored size %d to be less than the payload size %d", detail.Storage.StoredSize, detail.Storage.PayloadSize)
+	}
+	return nil
+}
@@ -0,0 +1,477 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+)
+
+// payloadLogRefsPath holds the number of events referencing each segment
+// of the payload log, keyed by the segment number.
+var payloadLogRefsPath = dbpath.ToPath("payload-log-refs")
+
+const (
+	// DefaultPayloadLogSegmentSize is the size after which a new segment
+	// of the payload log is started.
+	DefaultPayloadLogSegmentSize = 64 << 20
+
+	payloadLogSuffix = ".log"
+	// entries start with the length and the CRC-32C of their payload
+	payloadLogHeaderSize = 8
+)
+
+var payloadLogTable = crc32.MakeTable(crc32.Castagnoli)
+
+// payloadRef locates a payload in the payload log.
+type payloadRef struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Length  int    `json:"length"`
+}
+
+// PayloadLog stores large payloads in append-only segment files next to
+// the state, events only keep their location. Large values fragment the
+// pages of the state and are copied whenever it is compacted, appending
+// them to a file avoids both. Events are pruned in the order they were
+// appended, so old segments run empty and are deleted as a whole.
+type PayloadLog struct {
+	dir         string
+	segmentSize int64
+
+	// writes is held for reading by write transactions of the state, the
+	// sweep of empty segments takes it for writing, so it never deletes a
+	// segment referenced by a transaction that is not committed yet
+	writes sync.RWMutex
+
+	mu         sync.Mutex
+	active     *os.File
+	activeSeg  uint64
+	activeSize int64
+	dirty      bool
+
+	// rmu is held for reading while segments are read, so the sweep only
+	// closes segments no read is using
+	rmu     sync.RWMutex
+	readers map[uint64]*os.File
+}
+
+// OpenPayloadLog opens the payload log in dir, creating it if needed.
+// Payloads are appended to a new segment, segments are started anew once
+// they reach segmentSize bytes.
+func OpenPayloadLog(dir string, segmentSize int64) (*PayloadLog, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultPayloadLogSegmentSize
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create payload log dir: %w", err)
+	}
+
+	l := &PayloadLog{dir: dir, segmentSize: segmentSize, readers: map[uint64]*os.File{}}
+
+	segments, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	// a segment may end in a partial entry after a crash, so appending
+	// continues in a new one
+	next := uint64(1)
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+
+	err = l.startSegment(next)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *PayloadLog) segmentPath(seg uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016x%s", seg, payloadLogSuffix))
+}
+
+// segments returns the numbers of the segment files in ascending order.
+func (l *PayloadLog) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not list payload log: %w", err)
+	}
+
+	segments := []uint64{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, payloadLogSuffix) {
+			continue
+		}
+		seg, err := strconv.ParseUint(strings.TrimSuffix(name, payloadLogSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seg)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// startSegment makes seg the active segment, l.mu has to be held or l not
+// shared yet.
+func (l *PayloadLog) startSegment(seg uint64) error {
+	f, err := os.OpenFile(l.segmentPath(seg), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("could not create payload log segment: %w", err)
+	}
+
+	// the entry of the segment in the directory has to be durable as well
+	d, err := os.Open(l.dir)
+	if err == nil {
+		err = d.Sync()
+		d.Close()
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not sync payload log dir: %w", err)
+	}
+
+	if l.active != nil {
+		err = l.active.Sync()
+		if err == nil {
+			err = l.active.Close()
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("could not close payload log segment: %w", err)
+		}
+	}
+
+	l.active, l.activeSeg, l.activeSize, l.dirty = f, seg, 0, false
+	return nil
+}
+
+// append writes a payload to the active segment. It is not durable before
+// sync is called.
+func (l *PayloadLog) append(payload []byte) (payloadRef, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	size := int64(payloadLogHeaderSize + len(payload))
+	if l.activeSize > 0 && l.activeSize+size > l.segmentSize {
+		err := l.startSegment(l.activeSeg + 1)
+		if err != nil {
+			return payloadRef{}, err
+		}
+	}
+
+	var header [payloadLogHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, payloadLogTable))
+
+	ref := payloadRef{Segment: l.activeSeg, Offset: l.activeSize, Length: len(payload)}
+
+	_, err := l.active.Write(header[:])
+	if err == nil {
+		_, err = l.active.Write(payload)
+	}
+	if err != nil {
+		// a partial entry would shift the offsets of the following ones
+		l.startSegment(l.activeSeg + 1)
+		return payloadRef{}, fmt.Errorf("could not append to payload log: %w", err)
+	}
+
+	l.activeSize += size
+	l.dirty = true
+	return ref, nil
+}
+
+// sync makes the appended payloads durable.
+func (l *PayloadLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.dirty {
+		return nil
+	}
+
+	err := l.active.Sync()
+	if err != nil {
+		return fmt.Errorf("could not sync payload log: %w", err)
+	}
+
+	l.dirty = false
+	return nil
+}
+
+// read returns the payload at ref and verifies its checksum.
+func (l *PayloadLog) read(ref payloadRef) ([]byte, error) {
+	err := l.openReader(ref.Segment)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, payloadLogHeaderSize+ref.Length)
+	l.rmu.RLock()
+	f, found := l.readers[ref.Segment]
+	if found {
+		_, err = f.ReadAt(buf, ref.Offset)
+	}
+	l.rmu.RUnlock()
+
+	if !found {
+		return nil, fmt.Errorf("payload log segment %d was deleted", ref.Segment)
+	}
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("payload log segment %d ends before the payload at %d", ref.Segment, ref.Offset)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read payload log: %w", err)
+	}
+
+	length := binary.BigEndian.Uint32(buf[0:4])
+	if int(length) != ref.Length {
+		return nil, fmt.Errorf("payload at %d of payload log segment %d has %d bytes, expected %d", ref.Offset, ref.Segment, length, ref.Length)
+	}
+
+	payload := buf[payloadLogHeaderSize:]
+	if crc32.Checksum(payload, payloadLogTable) != binary.BigEndian.Uint32(buf[4:8]) {
+		return nil, fmt.Errorf("checksum of payload at %d of payload log segment %d does not match", ref.Offset, ref.Segment)
+	}
+
+	return payload, nil
+}
+
+// openReader opens a segment for reading unless it is open already.
+func (l *PayloadLog) openReader(seg uint64) error {
+	l.rmu.RLock()
+	_, found := l.readers[seg]
+	l.rmu.RUnlock()
+	if found {
+		return nil
+	}
+
+	l.rmu.Lock()
+	defer l.rmu.Unlock()
+
+	if _, found := l.readers[seg]; found {
+		return nil
+	}
+
+	f, err := os.Open(l.segmentPath(seg))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("payload log segment %d is missing", seg)
+	}
+	if err != nil {
+		return fmt.Errorf("could not open payload log segment: %w", err)
+	}
+
+	l.readers[seg] = f
+	return nil
+}
+
+// sweep deletes the segments no event references anymore, except for the
+// active one. It returns the number of deleted segments.
+func (l *PayloadLog) sweep(db bolted.Database) (int, error) {
+	l.writes.Lock()
+	defer l.writes.Unlock()
+
+	segments, err := l.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	active := l.activeSeg
+	l.mu.Unlock()
+
+	unreferenced := []uint64{}
+	err = bolted.SugaredRead(db, func(tx bolted.SugaredReadTx) error {
+		for _, seg := range segments {
+			if seg != active && !tx.Exists(payloadLogRefsPath.Append(segmentKey(seg))) {
+				unreferenced = append(unreferenced, seg)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not read payload log references: %w", err)
+	}
+
+	for i, seg := range unreferenced {
+		l.rmu.Lock()
+		f, found := l.readers[seg]
+		if found {
+			f.Close()
+			delete(l.readers, seg)
+		}
+		l.rmu.Unlock()
+
+		err = os.Remove(l.segmentPath(seg))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return i, fmt.Errorf("could not delete payload log segment: %w", err)
+		}
+	}
+
+	return len(unreferenced), nil
+}
+
+// Size returns the size of all segments in bytes.
+func (l *PayloadLog) Size() (int64, error) {
+	segments, err := l.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	size := int64(0)
+	for _, seg := range segments {
+		fi, err := os.Stat(l.segmentPath(seg))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("could not stat payload log segment: %w", err)
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+// Close closes the segments of the log.
+func (l *PayloadLog) Close() error {
+	l.rmu.Lock()
+	for seg, f := range l.readers {
+		f.Close()
+		delete(l.readers, seg)
+	}
+	l.rmu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.active.Sync()
+	closeErr := l.active.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func segmentKey(seg uint64) string {
+	return fmt.Sprintf("%016x", seg)
+}
+
+// storeLogged appends a payload to the payload log and stores its location
+// as the value of the event. Payloads are encrypted when EncryptionKeys are
+// set, the log is on disk like the database.
+func (s Server) storeLogged(tx bolted.SugaredWriteTx, events dbpath.Path, id string, payload []byte) error {
+	sealed, err := s.sealPayload(payload)
+	if err != nil {
+		return err
+	}
+	ref, err := s.opts.PayloadLog.append(sealed)
+	if err != nil {
+		return err
+	}
+
+	addCounter(tx, payloadLogRefsPath.Append(segmentKey(ref.Segment)), 1)
+	addStoredBytes(tx, ref.Length)
+
+	v, err := encodeRecord(storedRecord{Log: &ref})
+	if err != nil {
+		return err
+	}
+	tx.Put(events.Append(id), v)
+	return nil
+}
+
+// releaseLogged drops the reference of a deleted event to its segment,
+// segments without references are deleted by the next sweep.
+func releaseLogged(tx bolted.SugaredWriteTx, ref payloadRef) {
+	refPath := payloadLogRefsPath.Append(segmentKey(ref.Segment))
+	if !tx.Exists(refPath) {
+		return
+	}
+	if getCounter(tx, refPath) <= 1 {
+		tx.Delete(refPath)
+		return
+	}
+	addCounter(tx, refPath, -1)
+}
+
+// shouldLog returns true if the payload is appended to the payload log.
+func (s Server) shouldLog(payload []byte) bool {
+	return s.opts.PayloadLog != nil && len(payload) >= s.opts.PayloadLogMinSize
+}
+
+// sweepPayloadLog deletes segments of the payload log pruned events were
+// the last ones to reference.
+func (s Server) sweepPayloadLog() {
+	if s.opts.PayloadLog == nil {
+		return
+	}
+
+	n, err := s.opts.PayloadLog.sweep(s.db)
+	if err != nil {
+		s.log.Error(err, "could not delete unreferenced payload log segments")
+	}
+	if n > 0 {
+		s.log.Info("deleted unreferenced payload log segments", "segments", n)
+	}
+}
+
+// payloadLogDB syncs the payload log before write transactions commit, so
+// committed events never reference payloads that could be lost.
+type payloadLogDB struct {
+	bolted.Database
+	log *PayloadLog
+}
+
+func (d *payloadLogDB) BeginWrite() (bolted.WriteTx, error) {
+	d.log.writes.RLock()
+	tx, err := d.Database.BeginWrite()
+	if err != nil {
+		d.log.writes.RUnlock()
+		return nil, err
+	}
+	return &payloadLogWriteTx{WriteTx: tx, log: d.log}, nil
+}
+
+type payloadLogWriteTx struct {
+	bolted.WriteTx
+	log        *PayloadLog
+	once       sync.Once
+	rolledBack bool
+}
+
+func (tx *payloadLogWriteTx) Rollback() error {
+	tx.rolledBack = true
+	return tx.WriteTx.Rollback()
+}
+
+func (tx *payloadLogWriteTx) Finish() error {
+	defer tx.once.Do(tx.log.writes.RUnlock)
+
+	if !tx.rolledBack {
+		err := tx.log.sync()
+		if err != nil {
+			tx.WriteTx.Rollback()
+			tx.WriteTx.Finish()
+			return err
+		}
+	}
+
+	return tx.WriteTx.Finish()
+}
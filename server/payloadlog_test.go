@@ -0,0 +1,59 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server/testrig"
+	"github.com/go-logr/logr"
+)
+
+// payloads of the payload log steps are larger than testPayloadLogMinSize,
+// every one of them fills a segment
+const (
+	testPayloadLogMinSize     = 16
+	testPayloadLogSegmentSize = 1
+)
+
+func aBufferWithAPayloadLog(ctx context.Context) error {
+	s := getState(ctx)
+	serverURL, srv, logDir, err := testrig.StartServerWithPayloadLog(ctx, logr.FromContextOrDiscard(ctx), testPayloadLogMinSize, testPayloadLogSegmentSize)
+	if err != nil {
+		return fmt.Errorf("could not start server: %w", err)
+	}
+
+	cl, err := client.New(serverURL)
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+
+	s.serverBaseURL = serverURL
+	s.client = cl
+	s.server = srv
+	s.payloadLogDir = logDir
+	return nil
+}
+
+func thePayloadLogShouldHaveSegments(ctx context.Context, expected int) error {
+	segments, err := filepath.Glob(filepath.Join(getState(ctx).payloadLogDir, "*.log"))
+	if err != nil {
+		return err
+	}
+	if len(segments) != expected {
+		return fmt.Errorf("expected %d segments, got %d", expected, len(segments))
+	}
+	return nil
+}
+
+func theIntegrityCheckShouldReportNoProblems(ctx context.Context) error {
+	report, err := getState(ctx).server.CheckIntegrity(ctx, "", "")
+	if err != nil {
+		return err
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("unexpected problems: %v", report.Problems)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Roles of the instances of a multi-instance topology.
+const (
+	// PeerRolePrimary accepts publishes and polls.
+	PeerRolePrimary = "primary"
+	// PeerRoleReplica is a read-only follower of a primary.
+	PeerRoleReplica = "replica"
+	// PeerRoleMirror is an independent buffer receiving copies of the
+	// events of another one.
+	PeerRoleMirror = "mirror"
+	// PeerRoleShard holds a part of the topics.
+	PeerRoleShard = "shard"
+)
+
+// Peer is an instance of a multi-instance topology.
+type Peer struct {
+	Name string `yaml:"name" json:"name"`
+	// URL is the base URL of the API of the peer, it defaults to the
+	// public URL for the instance itself.
+	URL  string `yaml:"url,omitempty" json:"url"`
+	Role string `yaml:"role" json:"role"`
+	// Topics lists the topics a shard holds, the other roles hold all
+	// topics.
+	Topics []string `yaml:"topics,omitempty" json:"topics,omitempty"`
+	// Priority orders peers of the same role clients fail over to, lower
+	// ones first.
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty"`
+}
+
+// Peering describes the instance and the peers it knows of, clients and
+// tooling discover them with GET /peers.
+type Peering struct {
+	// Self is the instance itself, its role defaults to primary.
+	Self  Peer   `yaml:"self" json:"self"`
+	Peers []Peer `yaml:"peers" json:"peers,omitempty"`
+}
+
+// PeerCatalog is the response of GET /peers, the peers are ordered by
+// their priority.
+type PeerCatalog struct {
+	Self  Peer   `json:"self"`
+	Peers []Peer `json:"peers"`
+}
+
+func checkPeerRole(role string) error {
+	switch role {
+	case PeerRolePrimary, PeerRoleReplica, PeerRoleMirror, PeerRoleShard:
+		return nil
+	}
+	return fmt.Errorf("unsupported role %q, supported are %s, %s, %s and %s", role, PeerRolePrimary, PeerRoleReplica, PeerRoleMirror, PeerRoleShard)
+}
+
+func checkPeerURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", rawURL)
+	}
+	// the catalog is served to every client
+	if u.User != nil {
+		return fmt.Errorf("%q must not contain credentials", rawURL)
+	}
+	return nil
+}
+
+// ValidatePeering checks that peers have unique names, a role and an
+// http URL.
+func ValidatePeering(p Peering) error {
+	if p.Self.Role != "" {
+		err := checkPeerRole(p.Self.Role)
+		if err != nil {
+			return fmt.Errorf("invalid role of self: %w", err)
+		}
+	}
+	if p.Self.URL != "" {
+		err := checkPeerURL(p.Self.URL)
+		if err != nil {
+			return fmt.Errorf("invalid url of self: %w", err)
+		}
+	}
+
+	names := map[string]bool{p.Self.Name: p.Self.Name != ""}
+	for i, peer := range p.Peers {
+		if peer.Name == "" {
+			return fmt.Errorf("peer %d has no name", i)
+		}
+		if names[peer.Name] {
+			return fmt.Errorf("duplicate peer name %q", peer.Name)
+		}
+		names[peer.Name] = true
+
+		err := checkPeerRole(peer.Role)
+		if err != nil {
+			return fmt.Errorf("invalid role of peer %q: %w", peer.Name, err)
+		}
+		err = checkPeerURL(peer.URL)
+		if err != nil {
+			return fmt.Errorf("invalid url of peer %q: %w", peer.Name, err)
+		}
+	}
+	return nil
+}
+
+// peerCatalog returns the catalog as seen by the client of r.
+func (s *Server) peerCatalog(r *http.Request) PeerCatalog {
+	self := s.opts.Peering.Self
+	if self.URL == "" {
+		self.URL = s.publicURL(r)
+	}
+	if self.Role == "" {
+		self.Role = PeerRolePrimary
+	}
+
+	peers := append([]Peer{}, s.opts.Peering.Peers...)
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].Priority < peers[j].Priority
+	})
+
+	return PeerCatalog{Self: self, Peers: peers}
+}
+
+func (s *Server) listPeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(s.peerCatalog(r))
+}
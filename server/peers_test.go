@@ -0,0 +1,87 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+)
+
+func peeringWith(name, url, role string) server.Peering {
+	return server.Peering{
+		Self:  server.Peer{Name: "eu-1"},
+		Peers: []server.Peer{{Name: name, URL: url, Role: role}},
+	}
+}
+
+func aBufferPeeringWithTheAt(ctx context.Context, role, name, url string) error {
+	return startBuffer(ctx, server.Options{Peering: peeringWith(name, url, role)})
+}
+
+func startingABufferPeeringWithTheAtShouldFail(ctx context.Context, role, name, url string) error {
+	err := startBuffer(ctx, server.Options{Peering: peeringWith(name, url, role)})
+	if err == nil {
+		return fmt.Errorf("expected the peer %s at %s to be rejected", name, url)
+	}
+	return nil
+}
+
+func iListThePeers(ctx context.Context) error {
+	s := getState(ctx)
+	res, err := http.Get(s.serverBaseURL + "/peers")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	s.peers = server.PeerCatalog{}
+	return json.NewDecoder(res.Body).Decode(&s.peers)
+}
+
+func theCatalogShouldDescribeTheInstanceAsThePrimaryAtItsURL(ctx context.Context) error {
+	s := getState(ctx)
+	self := s.peers.Self
+	if self.Name != "eu-1" || self.Role != server.PeerRolePrimary || self.URL != s.serverBaseURL {
+		return fmt.Errorf("unexpected self %#v", self)
+	}
+	return nil
+}
+
+func theCatalogShouldListTheAt(ctx context.Context, role, name, url string) error {
+	for _, p := range getState(ctx).peers.Peers {
+		if p.Name == name {
+			if p.Role != role || p.URL != url {
+				return fmt.Errorf("unexpected peer %#v", p)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("peer %s is not listed", name)
+}
+
+func aBufferListingUnavailablePeers(ctx context.Context) error {
+	return startBuffer(ctx, server.Options{Peering: server.Peering{
+		Self: server.Peer{Name: "eu-1"},
+		Peers: []server.Peer{
+			{Name: "eu-0", URL: "http://127.0.0.1:9", Role: server.PeerRolePrimary, Priority: -1},
+			{Name: "eu-2", URL: "http://127.0.0.1:9", Role: server.PeerRoleReplica},
+		},
+	}})
+}
+
+func aClientDiscoveringTheBuffersFromThePeersCatalog(ctx context.Context) error {
+	s := getState(ctx)
+	cl, err := client.NewFromPeers(ctx, s.serverBaseURL)
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+	s.client = cl
+	return nil
+}
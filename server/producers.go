@@ -0,0 +1,231 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Producer sessions publish exactly once. A producer registers with
+// POST /producers/{name}/sessions and gets a session, the epoch of the
+// session and the sequence of the last publish stored for the producer.
+// Each publish carries the session, the epoch and the next sequence in the
+// Producer-Session, Producer-Epoch and Producer-Sequence headers. A new
+// session of the producer fences the previous one, e.g. after a failover
+// publishes of the old instance are rejected. Publishes with the sequence
+// of the last stored publish are retries, they get its batch back without
+// storing the events again; other sequences that don't follow it are
+// rejected.
+const (
+	ProducerSessionHeader  = "Producer-Session"
+	ProducerEpochHeader    = "Producer-Epoch"
+	ProducerSequenceHeader = "Producer-Sequence"
+)
+
+var (
+	producersPath = dbpath.ToPath("producers")
+	// producerSessionsPath maps the current session of each producer to
+	// its name.
+	producerSessionsPath = dbpath.ToPath("producer-sessions")
+)
+
+var (
+	errProducerFenced       = errors.New("producer session is unknown or was fenced by a newer one")
+	errSequenceOutOfOrder   = errors.New("sequence out of order")
+	errInvalidProducerWrite = errors.New("invalid producer headers")
+)
+
+// producer is a registered producer, Batch is the batch of the publish
+// with the sequence Sequence.
+type producer struct {
+	Session    string     `json:"session"`
+	Epoch      uint64     `json:"epoch"`
+	Sequence   uint64     `json:"sequence"`
+	Batch      batchRange `json:"batch"`
+	Registered time.Time  `json:"registered"`
+}
+
+// ProducerSession is the response of a producer registration, new
+// sessions continue after Sequence.
+type ProducerSession struct {
+	Session  string `json:"session"`
+	Epoch    uint64 `json:"epoch"`
+	Sequence uint64 `json:"sequence"`
+}
+
+// producerWrite is a publish of a producer session.
+type producerWrite struct {
+	session  string
+	epoch    uint64
+	sequence uint64
+}
+
+// producerWriteOf returns the producer session of a publish request, or
+// nil when it has none.
+func producerWriteOf(r *http.Request) (*producerWrite, error) {
+	session := r.Header.Get(ProducerSessionHeader)
+	if session == "" {
+		return nil, nil
+	}
+
+	epoch, err := strconv.ParseUint(r.Header.Get(ProducerEpochHeader), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s must be a number", errInvalidProducerWrite, ProducerEpochHeader)
+	}
+
+	sequence, err := strconv.ParseUint(r.Header.Get(ProducerSequenceHeader), 10, 64)
+	if err != nil || sequence == 0 {
+		return nil, fmt.Errorf("%w: %s must be a positive number", errInvalidProducerWrite, ProducerSequenceHeader)
+	}
+
+	return &producerWrite{session: session, epoch: epoch, sequence: sequence}, nil
+}
+
+func getProducer(tx bolted.SugaredReadTx, name string) (*producer, error) {
+	p := producersPath.Append(name)
+	if !tx.Exists(p) {
+		return nil, nil
+	}
+
+	pr := &producer{}
+	err := json.Unmarshal(tx.Get(p), pr)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal producer %s: %w", name, err)
+	}
+	return pr, nil
+}
+
+func putProducer(tx bolted.SugaredWriteTx, name string, pr *producer) error {
+	d, err := json.Marshal(pr)
+	if err != nil {
+		return fmt.Errorf("could not marshal producer %s: %w", name, err)
+	}
+	tx.Put(producersPath.Append(name), d)
+	return nil
+}
+
+// sessionProducer returns the name and state of the producer of a write
+// after checking that its session is the current one.
+func sessionProducer(tx bolted.SugaredReadTx, pw producerWrite) (string, *producer, error) {
+	p := producerSessionsPath.Append(pw.session)
+	if !tx.Exists(p) {
+		return "", nil, errProducerFenced
+	}
+
+	name := string(tx.Get(p))
+	pr, err := getProducer(tx, name)
+	if err != nil {
+		return "", nil, err
+	}
+	if pr == nil || pr.Session != pw.session || pr.Epoch != pw.epoch {
+		return "", nil, errProducerFenced
+	}
+	return name, pr, nil
+}
+
+// checkProducerSequence returns the batch of a retried publish, or an
+// error unless the write follows the last publish of its session.
+func checkProducerSequence(tx bolted.SugaredReadTx, pw producerWrite) (*batchRange, error) {
+	_, pr, err := sessionProducer(tx, pw)
+	if err != nil {
+		return nil, err
+	}
+
+	switch pw.sequence {
+	case pr.Sequence:
+		return &pr.Batch, nil
+	case pr.Sequence + 1:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%w: expected %d, got %d", errSequenceOutOfOrder, pr.Sequence+1, pw.sequence)
+}
+
+// storeProducerSequence records the batch stored by a write.
+func storeProducerSequence(tx bolted.SugaredWriteTx, pw producerWrite, br batchRange) error {
+	name, pr, err := sessionProducer(tx, pw)
+	if err != nil {
+		return err
+	}
+	pr.Sequence = pw.sequence
+	pr.Batch = br
+	return putProducer(tx, name, pr)
+}
+
+func (s *Server) registerProducer(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+	name := mux.Vars(r)["name"]
+
+	ps := ProducerSession{}
+	err := bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		pr, err := getProducer(tx, name)
+		if err != nil {
+			return err
+		}
+		if pr == nil {
+			pr = &producer{}
+		} else {
+			tx.Delete(producerSessionsPath.Append(pr.Session))
+		}
+
+		session, err := uuid.NewV4()
+		if err != nil {
+			return fmt.Errorf("could not generate session: %w", err)
+		}
+
+		pr.Session = session.String()
+		pr.Epoch++
+		pr.Registered = time.Now().UTC()
+		tx.Put(producerSessionsPath.Append(pr.Session), []byte(name))
+
+		ps = ProducerSession{Session: pr.Session, Epoch: pr.Epoch, Sequence: pr.Sequence}
+		return putProducer(tx, name, pr)
+	})
+
+	if err != nil {
+		log.Error(err, "could not register producer")
+		http.Error(w, fmt.Errorf("could not register producer: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ps)
+}
+
+func (s *Server) deleteProducer(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+	name := mux.Vars(r)["name"]
+
+	found := false
+	err := bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		pr, err := getProducer(tx, name)
+		if err != nil || pr == nil {
+			return err
+		}
+		found = true
+		tx.Delete(producerSessionsPath.Append(pr.Session))
+		tx.Delete(producersPath.Append(name))
+		return nil
+	})
+
+	if err != nil {
+		log.Error(err, "could not delete producer")
+		http.Error(w, fmt.Errorf("could not delete producer: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		http.Error(w, fmt.Sprintf("producer %s not found", name), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,78 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/google/go-cmp/cmp"
+)
+
+func theProducerRegistersASession(ctx context.Context, name string) error {
+	s := getState(ctx)
+	ps, err := s.client.RegisterProducer(ctx, name)
+	if err != nil {
+		return err
+	}
+	s.producerSessions = append(s.producerSessions, ps)
+	return nil
+}
+
+// currentSession is the session registered last.
+func currentSession(ctx context.Context) *client.ProducerSession {
+	sessions := getState(ctx).producerSessions
+	return sessions[len(sessions)-1]
+}
+
+func theSessionPublishesTheSequence(ctx context.Context, sequence int) error {
+	s := getState(ctx)
+	b, err := currentSession(ctx).PublishBatch(ctx, uint64(sequence), []any{"evt1"})
+	if err != nil {
+		return err
+	}
+	s.batch = b
+	return nil
+}
+
+func theSessionPublishesTheSequenceAgain(ctx context.Context, sequence int) error {
+	s := getState(ctx)
+	b, err := currentSession(ctx).PublishBatch(ctx, uint64(sequence), []any{"evt1"})
+	if err != nil {
+		return err
+	}
+
+	d := cmp.Diff(s.batch, b)
+	if d != "" {
+		return fmt.Errorf("retry did not return the stored batch:\n%s", d)
+	}
+	return nil
+}
+
+func publishingTheSequenceShouldBeRejectedAsOutOfOrder(ctx context.Context, sequence int) error {
+	_, err := currentSession(ctx).PublishBatch(ctx, uint64(sequence), []any{"evt1"})
+	if !errors.Is(err, client.ErrSequenceOutOfOrder) {
+		return fmt.Errorf("expected the sequence to be out of order, got %v", err)
+	}
+	return nil
+}
+
+func publishingWithTheFirstSessionShouldBeRejectedAsFenced(ctx context.Context) error {
+	ps := getState(ctx).producerSessions[0]
+	_, err := ps.PublishBatch(ctx, ps.Sequence+1, []any{"evt1"})
+	if !errors.Is(err, client.ErrProducerFenced) {
+		return fmt.Errorf("expected the session to be fenced, got %v", err)
+	}
+	return nil
+}
+
+func theSessionShouldContinueAfterTheSequence(ctx context.Context, sequence int) error {
+	ps := currentSession(ctx)
+	if ps.Sequence != uint64(sequence) {
+		return fmt.Errorf("expected the session to continue after %d, got %d", sequence, ps.Sequence)
+	}
+	if len(getState(ctx).producerSessions) > 1 && ps.Epoch <= getState(ctx).producerSessions[0].Epoch {
+		return fmt.Errorf("expected a newer epoch than %d, got %d", getState(ctx).producerSessions[0].Epoch, ps.Epoch)
+	}
+	return nil
+}
@@ -1,48 +1,342 @@
 package server
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/draganm/bolted"
 	"github.com/gofrs/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func (s Server) Prune(cutoffTime time.Time) (err error) {
-	return bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) (err error) {
-		toDelete := []string{}
-		defer func() {
-			if err == nil {
-				s.log.Info("pruned state events", "count", len(toDelete))
-			}
-		}()
-		it := tx.Iterator(eventsPath)
-		for ; !it.IsDone(); it.Next() {
-			id, err := uuid.FromString(it.GetKey())
+// eventTime returns the time an event was stored at, encoded in its UUIDv6 id.
+func eventTime(id string) (time.Time, error) {
+	u, err := eventUUID(id)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse uuid %s: %w", id, err)
+	}
+
+	ts, err := uuid.TimestampFromV6(u)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not get uuid timestamp: %w", err)
+	}
+
+	t, err := ts.Time()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not get time from uuid timestamp: %w", err)
+	}
+
+	return t, nil
+}
+
+// TimeCursor returns the smallest event id of time t, polling after it
+// returns the events stored at or after t. Buffers with an id prefix need
+// it in front, see IDPrefix.
+func TimeCursor(t time.Time) string {
+	ts := uuidTicks(t)
+	u := uuid.UUID{}
+	binary.BigEndian.PutUint32(u[0:], uint32(ts>>28))
+	binary.BigEndian.PutUint16(u[4:], uint16(ts>>12))
+	binary.BigEndian.PutUint16(u[6:], 0x6000|uint16(ts&0xfff))
+	return u.String()
+}
+
+// PruneStatus describes the last prune, it is empty before the first one.
+type PruneStatus struct {
+	Started  time.Time `json:"started,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	Cutoff   time.Time `json:"cutoff,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// Events and Bytes are the events the prune removed and the bytes of
+	// their payloads, see Stats.StoredBytes.
+	Events int    `json:"events"`
+	Bytes  uint64 `json:"bytes"`
+	// Archived is the number of events archived before they were pruned.
+	Archived int `json:"archived,omitempty"`
+	// Ranges are the removed events of each stream.
+	Ranges []PrunedRange `json:"ranges,omitempty"`
+	// Running is true while a prune is in progress.
+	Running bool `json:"running"`
+}
+
+// PrunedRange are the events a prune removed from a stream, they are
+// always its oldest. Sequence numbers are those assigned on publish, a
+// stream holds the events after LastSequence.
+type PrunedRange struct {
+	// Topic is empty for the default stream.
+	Topic         string `json:"topic,omitempty"`
+	Count         int    `json:"count"`
+	FirstID       string `json:"first_id"`
+	LastID        string `json:"last_id"`
+	FirstSequence uint64 `json:"first_sequence"`
+	LastSequence  uint64 `json:"last_sequence"`
+}
+
+// addRange adds the removal of count events of a topic, the batches of a
+// prune extend the range of their stream.
+func (ps *PruneStatus) addRange(topic, firstID, lastID string, firstSequence uint64, count int) {
+	ps.Events += count
+	for i, r := range ps.Ranges {
+		if r.Topic == topic {
+			ps.Ranges[i].Count += count
+			ps.Ranges[i].LastID = lastID
+			ps.Ranges[i].LastSequence = firstSequence + uint64(count) - 1
+			return
+		}
+	}
+	ps.Ranges = append(ps.Ranges, PrunedRange{
+		Topic:         topic,
+		Count:         count,
+		FirstID:       firstID,
+		LastID:        lastID,
+		FirstSequence: firstSequence,
+		LastSequence:  firstSequence + uint64(count) - 1,
+	})
+}
+
+type pruneTracker struct {
+	mu     sync.Mutex
+	status PruneStatus
+}
+
+// PruneStatus returns the status of the last prune.
+func (s *Server) PruneStatus() PruneStatus {
+	s.prunes.mu.Lock()
+	defer s.prunes.mu.Unlock()
+	return s.prunes.status
+}
+
+// Prune removes events of the buffer stored before cutoffTime and events
+// of topics older than their retention period, topics without their own
+// retention period are pruned at cutoffTime as well. The oldest events
+// beyond the size budgets are removed afterwards.
+func (s Server) Prune(cutoffTime time.Time) error {
+	_, err := s.PruneReport(cutoffTime)
+	return err
+}
+
+// PruneReport prunes like Prune and returns the status of this prune, it
+// is also the last status until the next prune starts. Prune subscriptions
+// are notified of the removed events before it returns, and they are
+// published to the system topic.
+func (s Server) PruneReport(cutoffTime time.Time) (ps PruneStatus, err error) {
+	started := time.Now()
+	ps = PruneStatus{Started: started.UTC(), Cutoff: cutoffTime.UTC(), Running: true}
+	s.prunes.mu.Lock()
+	s.prunes.status = ps
+	s.prunes.mu.Unlock()
+
+	ctx, span := tracer.Start(context.Background(), "prune", trace.WithAttributes(attribute.String("event_buffer.cutoff", cutoffTime.UTC().Format(time.RFC3339))))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	defer func() {
+		ps.Running = false
+		ps.Duration = time.Since(started).String()
+		if err != nil {
+			ps.Error = err.Error()
+			pruneErrors.Inc()
+		}
+		s.prunes.mu.Lock()
+		// a later prune may have started in the meantime
+		if s.prunes.status.Started.Equal(ps.Started) {
+			s.prunes.status = ps
+		}
+		s.prunes.mu.Unlock()
+		lastPruneDuration.Set(time.Since(started).Seconds())
+		lastPruneTime.SetToCurrentTime()
+		// batches committed before an error removed events as well
+		s.notifyPrune(ps)
+		s.publishPruned(ps)
+	}()
+
+	err = s.pruneStream(ctx, defaultStream, cutoffTime, &ps)
+	if err != nil {
+		return ps, err
+	}
+
+	var topics []stream
+	err = bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) (err error) {
+		topics, err = readTopics(tx)
+		return err
+	})
+	if err != nil {
+		return ps, fmt.Errorf("could not read topics: %w", err)
+	}
+
+	for _, st := range topics {
+		cutoff := cutoffTime
+		if st.retention > 0 {
+			cutoff = s.clock.pruneNow().Add(-st.retention)
+		}
+		err = s.pruneStream(ctx, st, cutoff, &ps)
+		if err != nil {
+			return ps, fmt.Errorf("could not prune topic %s: %w", st.topic, err)
+		}
+	}
+
+	err = s.trimToBudget(ctx, append([]stream{defaultStream}, topics...), &ps)
+	if err != nil {
+		return ps, fmt.Errorf("could not trim events to the size budget: %w", err)
+	}
+
+	err = s.sweepIdempotencyKeys(append([]stream{defaultStream}, topics...))
+	if err != nil {
+		return ps, fmt.Errorf("could not sweep idempotency keys: %w", err)
+	}
+
+	s.sweepPayloadLog()
+
+	return ps, nil
+}
+
+// pruneBatchSize is the number of events a prune deletes per write
+// transaction. Short transactions let publishes take the write lock in
+// between and keep the pages a commit writes, and with them the stalls of
+// reads while the database grows its memory map, small.
+const pruneBatchSize = 1000
+
+// pruneStream removes the events of a stream stored before cutoffTime.
+// Consumer protection applies to the default stream, the cursors of
+// consumers are positions in it. With an archive store, the events are
+// archived first. The removed events are added to ps.
+func (s Server) pruneStream(ctx context.Context, st stream, cutoffTime time.Time, ps *PruneStatus) (err error) {
+	pruned := 0
+	defer func() {
+		// topics are only logged when something was pruned, there may be
+		// many of them
+		if err == nil && st.topic == "" {
+			s.log.Info("pruned state events", "count", pruned)
+		}
+		if err == nil && st.topic != "" && pruned > 0 {
+			s.log.Info("pruned topic events", "count", pruned, "topic", st.topic)
+		}
+		// prefetched events may have been pruned, even by the batches
+		// committed before an error
+		if pruned > 0 {
+			s.readAhead.drop(st.topic)
+		}
+	}()
+
+	if s.opts.ArchiveStore != nil {
+		var bound string
+		err = bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) (err error) {
+			bound, err = s.pruneBound(tx, st, cutoffTime)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		n, err := s.archiveStream(ctx, st, bound)
+		ps.Archived += n
+		if err != nil {
+			return fmt.Errorf("could not archive events: %w", err)
+		}
+	}
+
+	for {
+		n, objects, err := s.pruneBatch(ctx, st, cutoffTime, ps)
+		if err != nil {
+			return err
+		}
+		s.deleteObjects(objects)
+		pruned += n
+		if n < pruneBatchSize {
+			return nil
+		}
+	}
+}
+
+// pruneBatch removes up to pruneBatchSize events of a stream stored before
+// cutoffTime in one transaction and adds them to ps. It returns the number
+// of removed events and the keys of their offloaded payloads.
+func (s Server) pruneBatch(ctx context.Context, st stream, cutoffTime time.Time, ps *PruneStatus) (int, []string, error) {
+	objects := []string{}
+	toDelete := []string{}
+	freed := uint64(0)
+	first := uint64(0)
+	_, span := tracer.Start(ctx, "bolted.write prune", trace.WithAttributes(streamAttribute(st)))
+	err := bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) (err error) {
+		slowest, found := "", false
+		if (s.opts.ProtectConsumers || s.opts.AckRetention) && st.topic == "" {
+			slowest, found, err = slowestConsumerPosition(tx)
 			if err != nil {
-				return fmt.Errorf("could not parse uuid %s: %w", it.GetKey(), err)
+				return err
 			}
+		}
+		protect := found && s.opts.ProtectConsumers
+		acked := found && s.opts.AckRetention
+		hardCutoff := s.clock.pruneNow().Add(-s.opts.MaxRetentionPeriod)
+		archived := archivedUntil(tx, st)
 
-			ts, err := uuid.TimestampFromV6(id)
-			if err != nil {
-				return fmt.Errorf("could not get uuid timestamp: %w", err)
+		it := tx.Iterator(st.events)
+		for ; !it.IsDone() && len(toDelete) < pruneBatchSize; it.Next() {
+			// events that were not archived are kept for the next prune
+			if s.opts.ArchiveStore != nil && it.GetKey() > archived {
+				break
+			}
+
+			// events all consumers have acknowledged don't wait for the
+			// retention period
+			if acked && it.GetKey() <= slowest {
+				toDelete = append(toDelete, it.GetKey())
+				continue
 			}
 
-			t, err := ts.Time()
+			t, err := eventTime(it.GetKey())
 			if err != nil {
-				return fmt.Errorf("could not get time from uuid timestamp: %w", err)
+				return err
 			}
 
 			if !t.Before(cutoffTime) {
 				break
 			}
+
+			// events the slowest consumer has not seen yet are kept until
+			// they reach the maximal retention period
+			if protect && it.GetKey() > slowest && !t.Before(hardCutoff) {
+				break
+			}
 			toDelete = append(toDelete, it.GetKey())
 
 		}
 
+		stored := getCounter(tx, storedBytesPath)
+		defer func() {
+			freed = stored - getCounter(tx, storedBytesPath)
+		}()
+
 		for _, id := range toDelete {
-			tx.Delete(eventsPath.Append(id))
+			object, err := deleteEvent(tx, st.events, id)
+			if err != nil {
+				return err
+			}
+			if object != "" {
+				objects = append(objects, object)
+			}
+		}
+
+		if len(toDelete) > 0 {
+			first = getCounter(tx, st.pruned) + 1
+			tx.Put(st.prunedUntil, []byte(toDelete[len(toDelete)-1]))
+			addCounter(tx, st.pruned, len(toDelete))
 		}
 		return nil
 	})
+	span.SetAttributes(attribute.Int("event_buffer.events", len(toDelete)))
+	endSpan(span, err)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(toDelete) > 0 {
+		ps.addRange(st.topic, toDelete[0], toDelete[len(toDelete)-1], first, len(toDelete))
+		ps.Bytes += freed
+	}
+	return len(toDelete), objects, nil
 }
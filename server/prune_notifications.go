@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pruneSubscriptionsPath holds the webhooks notified of prunes by name.
+var pruneSubscriptionsPath = dbpath.ToPath("prune-subscriptions")
+
+// pruneNotificationTimeout bounds the delivery of a notification, prunes
+// wait for their notifications.
+const pruneNotificationTimeout = 10 * time.Second
+
+// ErrPruneSubscriptionNotFound is returned for unknown subscriptions.
+var ErrPruneSubscriptionNotFound = errors.New("prune subscription not found")
+
+var pruneNotificationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "event_buffer_prune_notification_errors_total",
+	Help: "Number of prune notifications that could not be delivered.",
+}, []string{"subscription"})
+
+// PruneSubscription is a webhook that is posted a PruneNotification after
+// every prune that removed events.
+type PruneSubscription struct {
+	URL     string    `json:"url"`
+	Created time.Time `json:"created"`
+}
+
+// PruneNotification is posted as JSON to prune subscriptions. Notifications
+// are not retried, the last sequence of every stream is where it starts, a
+// missed notification is covered by the next one.
+type PruneNotification struct {
+	Subscription string        `json:"subscription"`
+	Time         time.Time     `json:"time"`
+	Cutoff       time.Time     `json:"cutoff"`
+	Ranges       []PrunedRange `json:"ranges"`
+}
+
+// PutPruneSubscription subscribes the webhook at rawURL to prunes, it
+// replaces an existing subscription of the same name.
+func (s Server) PutPruneSubscription(name, rawURL string) (*PruneSubscription, error) {
+	if name == "" {
+		return nil, errors.New("name must be provided")
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %s: an absolute http or https url is required", rawURL)
+	}
+
+	sub := &PruneSubscription{URL: rawURL, Created: time.Now().UTC()}
+	d, err := json.Marshal(sub)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal subscription: %w", err)
+	}
+
+	err = bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		tx.Put(pruneSubscriptionsPath.Append(name), d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// DeletePruneSubscription stops notifying a subscription.
+func (s Server) DeletePruneSubscription(name string) error {
+	return bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		path := pruneSubscriptionsPath.Append(name)
+		if !tx.Exists(path) {
+			return fmt.Errorf("%w: %s", ErrPruneSubscriptionNotFound, name)
+		}
+		tx.Delete(path)
+		return nil
+	})
+}
+
+// PruneSubscriptions returns the subscriptions by name.
+func (s Server) PruneSubscriptions() (map[string]PruneSubscription, error) {
+	subs := map[string]PruneSubscription{}
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		for it := tx.Iterator(pruneSubscriptionsPath); !it.IsDone(); it.Next() {
+			sub := PruneSubscription{}
+			err := json.Unmarshal(it.GetValue(), &sub)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal prune subscription %s: %w", it.GetKey(), err)
+			}
+			subs[it.GetKey()] = sub
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// notifyPrune posts the ranges of a prune to all subscriptions at once and
+// waits for their responses. Failed deliveries are logged and counted.
+func (s Server) notifyPrune(ps PruneStatus) {
+	if len(ps.Ranges) == 0 {
+		return
+	}
+
+	subs, err := s.PruneSubscriptions()
+	if err != nil {
+		s.log.Error(err, "could not read prune subscriptions")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pruneNotificationTimeout)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	for name, sub := range subs {
+		name, sub := name, sub
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := postPruneNotification(ctx, sub.URL, PruneNotification{
+				Subscription: name,
+				Time:         time.Now().UTC(),
+				Cutoff:       ps.Cutoff,
+				Ranges:       ps.Ranges,
+			})
+			if err != nil {
+				pruneNotificationErrors.WithLabelValues(name).Inc()
+				s.log.Error(err, "could not notify prune subscription", "subscription", name)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func postPruneNotification(ctx context.Context, url string, n PruneNotification) error {
+	d, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("could not marshal notification: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(d))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("content-type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not post notification: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		rd, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", res.Status, string(rd))
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+// pruneNotifications records the notifications posted to a subscription.
+type pruneNotifications struct {
+	mu       sync.Mutex
+	received []server.PruneNotification
+}
+
+func (pn *pruneNotifications) last() (server.PruneNotification, bool) {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	if len(pn.received) == 0 {
+		return server.PruneNotification{}, false
+	}
+	return pn.received[len(pn.received)-1], true
+}
+
+func aPruneSubscription(ctx context.Context, name string) error {
+	s := getState(ctx)
+	pn := &pruneNotifications{}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := server.PruneNotification{}
+		err := json.NewDecoder(r.Body).Decode(&n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pn.mu.Lock()
+		pn.received = append(pn.received, n)
+		pn.mu.Unlock()
+	}))
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+
+	_, err := s.server.PutPruneSubscription(name, hs.URL)
+	if err != nil {
+		return err
+	}
+	s.pruneNotifications = pn
+	return nil
+}
+
+func subscribingToPrunesAtShouldBeRejected(ctx context.Context, url string) error {
+	_, err := getState(ctx).server.PutPruneSubscription("mirror", url)
+	if err == nil {
+		return fmt.Errorf("expected %s to be rejected", url)
+	}
+	return nil
+}
+
+func theSubscriptionShouldNotHaveBeenNotified(ctx context.Context) error {
+	n, found := getState(ctx).pruneNotifications.last()
+	if found {
+		return fmt.Errorf("expected no notification, got %v", n)
+	}
+	return nil
+}
+
+func notifiedRange(ctx context.Context, name, topic string, first, last int) error {
+	n, found := getState(ctx).pruneNotifications.last()
+	if !found {
+		return fmt.Errorf("expected a notification")
+	}
+	if n.Subscription != name {
+		return fmt.Errorf("expected a notification of %s, got %s", name, n.Subscription)
+	}
+	for _, r := range n.Ranges {
+		if r.Topic != topic {
+			continue
+		}
+		if r.FirstSequence != uint64(first) || r.LastSequence != uint64(last) || r.Count != last-first+1 {
+			return fmt.Errorf("expected events %d to %d, got %+v", first, last, r)
+		}
+		return nil
+	}
+	return fmt.Errorf("expected a range of topic %q, got %+v", topic, n.Ranges)
+}
+
+func theSubscriptionShouldHaveBeenNotifiedOfTheEventsNumberedTo(ctx context.Context, name string, first, last int) error {
+	return notifiedRange(ctx, name, "", first, last)
+}
+
+func theSubscriptionShouldHaveBeenNotifiedOfTheEventsNumberedToOfTheTopic(ctx context.Context, name string, first, last int, topic string) error {
+	return notifiedRange(ctx, name, topic, first, last)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errStaleEvent rejects events that occurred before the maximum publish
+// age, they would be expired for consumers as soon as they are stored.
+var errStaleEvent = errors.New("event is older than the maximum publish age")
+
+var errInvalidOccurrence = errors.New("invalid occurrence time")
+
+var staleEventsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "event_buffer_stale_events_rejected_total",
+	Help: "Number of published events rejected because they occurred before the maximum publish age.",
+})
+
+// maxPublishAge returns how long ago events published to a stream may
+// have occurred, the retention period of the stream when it is shorter
+// than MaxPublishAge. It returns 0 when the age of events is not checked.
+func (s Server) maxPublishAge(st stream) time.Duration {
+	if s.opts.MaxPublishAge <= 0 {
+		return 0
+	}
+	retention := s.retentionPeriod(st)
+	if retention > 0 && retention < s.opts.MaxPublishAge {
+		return retention
+	}
+	return s.opts.MaxPublishAge
+}
+
+// checkPublishAge rejects events occurring before the maximum publish age
+// of the stream. Events occurred at their occurred_at field, or at the
+// time attribute of CloudEvents, events without one are accepted.
+func (s Server) checkPublishAge(st stream, events []json.RawMessage) error {
+	maxAge := s.maxPublishAge(st)
+	if maxAge == 0 {
+		return nil
+	}
+
+	field := "occurred_at"
+	if s.opts.CloudEvents {
+		field = "time"
+	}
+
+	oldest := time.Now().Add(-maxAge)
+	for i, e := range events {
+		occurred, err := occurredAt(e, field)
+		if err != nil {
+			return fmt.Errorf("event %d: %w", i, err)
+		}
+		if !occurred.IsZero() && occurred.Before(oldest) {
+			staleEventsRejected.Inc()
+			return fmt.Errorf("event %d: %w of %s: it occurred at %s", i, errStaleEvent, maxAge, occurred.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// occurredAt returns the time in the field of an event, or the zero time
+// when the event has none.
+func occurredAt(payload json.RawMessage, field string) (time.Time, error) {
+	attrs := map[string]json.RawMessage{}
+	if json.Unmarshal(payload, &attrs) != nil {
+		// only objects have an occurrence time
+		return time.Time{}, nil
+	}
+
+	v, found := attrs[field]
+	if !found {
+		return time.Time{}, nil
+	}
+
+	ts := ""
+	err := json.Unmarshal(v, &ts)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s must be an RFC 3339 timestamp", errInvalidOccurrence, field)
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s must be an RFC 3339 timestamp", errInvalidOccurrence, field)
+	}
+	return t, nil
+}
@@ -0,0 +1,56 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferRejectingEventsOlderThan(ctx context.Context, maxAge string) error {
+	d, err := time.ParseDuration(maxAge)
+	if err != nil {
+		return err
+	}
+	return startBuffer(ctx, server.Options{MaxPublishAge: d})
+}
+
+func aBufferWithARetentionPeriodOfRejectingEventsOlderThan(ctx context.Context, retention, maxAge string) error {
+	r, err := time.ParseDuration(retention)
+	if err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(maxAge)
+	if err != nil {
+		return err
+	}
+	return startBuffer(ctx, server.Options{RetentionPeriod: r, MaxPublishAge: d})
+}
+
+func iSendAnEventThatOccurredAgo(ctx context.Context, ago string) error {
+	d, err := time.ParseDuration(ago)
+	if err != nil {
+		return err
+	}
+	s := getState(ctx)
+	s.publishErr = s.client.SendEvents(ctx, []any{map[string]any{
+		"occurred_at": time.Now().Add(-d).Format(time.RFC3339Nano),
+	}})
+	return nil
+}
+
+func thePublishShouldBeRejectedAsStale(ctx context.Context) error {
+	se := &client.StatusError{}
+	if !errors.As(getState(ctx).publishErr, &se) || se.StatusCode != http.StatusUnprocessableEntity {
+		return fmt.Errorf("expected unprocessable entity error, got %v", getState(ctx).publishErr)
+	}
+	return nil
+}
+
+func thePublishShouldBeAccepted(ctx context.Context) error {
+	return getState(ctx).publishErr
+}
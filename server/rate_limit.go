@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/draganm/event-buffer/auth"
+)
+
+// DeliveryRateLimit caps how fast events are delivered to each of the
+// authenticated principals or the consumers named in the `consumer` query
+// parameter of polls, so a consumer catching up on a large backlog can't
+// saturate its own database or the disk of the buffer. Each principal and
+// consumer has its own budget, zero rates are not limited. Polls wait
+// until the budget allows delivering an event and return at most as many
+// events and bytes as it allows.
+//
+// The consumer parameter is chosen by the caller, polls leaving it out or
+// naming another consumer escape its limit. Limits that have to hold list
+// the principals instead, their polls are limited whatever consumer they
+// name.
+type DeliveryRateLimit struct {
+	Principals      []string `yaml:"principals" json:"principals,omitempty"`
+	Consumers       []string `yaml:"consumers" json:"consumers,omitempty"`
+	EventsPerSecond float64  `yaml:"events-per-second" json:"events_per_second,omitempty"`
+	BytesPerSecond  float64  `yaml:"bytes-per-second" json:"bytes_per_second,omitempty"`
+}
+
+// deliveryBucket is a token bucket holding up to a second of a rate limit.
+// Events larger than the remaining bytes are delivered anyway, the bucket
+// goes into debt then and the next poll waits until it is paid off.
+type deliveryBucket struct {
+	limit DeliveryRateLimit
+
+	mu      sync.Mutex
+	events  float64
+	bytes   float64
+	updated time.Time
+}
+
+func newDeliveryBucket(limit DeliveryRateLimit) *deliveryBucket {
+	b := &deliveryBucket{limit: limit, updated: time.Now()}
+	b.events, b.bytes = b.capacity()
+	return b
+}
+
+func (b *deliveryBucket) capacity() (events, bytes float64) {
+	return math.Max(b.limit.EventsPerSecond, 1), b.limit.BytesPerSecond
+}
+
+// refill adds the tokens accumulated since the last update, b.mu has to be
+// held.
+func (b *deliveryBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.updated = now
+
+	maxEvents, maxBytes := b.capacity()
+	if b.limit.EventsPerSecond > 0 {
+		b.events = math.Min(b.events+elapsed*b.limit.EventsPerSecond, maxEvents)
+	}
+	if b.limit.BytesPerSecond > 0 {
+		b.bytes = math.Min(b.bytes+elapsed*b.limit.BytesPerSecond, maxBytes)
+	}
+}
+
+// wait blocks until at least one event may be delivered and returns how
+// many events and bytes may be delivered then, -1 means unlimited.
+func (b *deliveryBucket) wait(ctx context.Context) (events int, bytes int64, err error) {
+	for {
+		b.mu.Lock()
+		b.refill(time.Now())
+
+		delay := time.Duration(0)
+		if b.limit.EventsPerSecond > 0 && b.events < 1 {
+			delay = time.Duration((1 - b.events) / b.limit.EventsPerSecond * float64(time.Second))
+		}
+		if b.limit.BytesPerSecond > 0 && b.bytes <= 0 {
+			bytesDelay := time.Duration((1 - b.bytes) / b.limit.BytesPerSecond * float64(time.Second))
+			if bytesDelay > delay {
+				delay = bytesDelay
+			}
+		}
+
+		if delay == 0 {
+			events, bytes = -1, -1
+			if b.limit.EventsPerSecond > 0 {
+				events = int(b.events)
+			}
+			if b.limit.BytesPerSecond > 0 {
+				bytes = int64(b.bytes)
+			}
+			b.mu.Unlock()
+			return events, bytes, nil
+		}
+		b.mu.Unlock()
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return 0, 0, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// take charges delivered events against the budget.
+func (b *deliveryBucket) take(events int, bytes int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.limit.EventsPerSecond > 0 {
+		b.events -= float64(events)
+	}
+	if b.limit.BytesPerSecond > 0 {
+		b.bytes -= float64(bytes)
+	}
+}
+
+// deliveryLimiter holds the buckets of the consumers with rate limits.
+type deliveryLimiter struct {
+	limits []DeliveryRateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*deliveryBucket
+}
+
+func newDeliveryLimiter(limits []DeliveryRateLimit) (*deliveryLimiter, error) {
+	seen := map[string]bool{}
+	for i, l := range limits {
+		if l.EventsPerSecond < 0 || l.BytesPerSecond < 0 {
+			return nil, fmt.Errorf("delivery rate limit %d has a negative rate", i)
+		}
+		for _, p := range l.Principals {
+			if seen[principalBucket(p)] {
+				return nil, fmt.Errorf("principal %q has more than one delivery rate limit", p)
+			}
+			seen[principalBucket(p)] = true
+		}
+		for _, c := range l.Consumers {
+			if seen[consumerBucket(c)] {
+				return nil, fmt.Errorf("consumer %q has more than one delivery rate limit", c)
+			}
+			seen[consumerBucket(c)] = true
+		}
+	}
+	return &deliveryLimiter{limits: limits, buckets: map[string]*deliveryBucket{}}, nil
+}
+
+// Buckets of principals and consumers are kept apart, a consumer may be
+// named like a principal.
+func principalBucket(name string) string {
+	return "principal/" + name
+}
+
+func consumerBucket(name string) string {
+	return "consumer/" + name
+}
+
+// bucket returns the bucket of a poll request, the one of its principal
+// when it has a limit or else the one of its consumer, or nil if its
+// deliveries are not limited.
+func (l *deliveryLimiter) bucket(r *http.Request) *deliveryBucket {
+	if len(l.limits) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, _ := auth.FromContext(r.Context())
+	if p != nil {
+		b := l.bucketOf(principalBucket(p.Name), func(limit DeliveryRateLimit) bool {
+			return contains(limit.Principals, p.Name)
+		})
+		if b != nil {
+			return b
+		}
+	}
+
+	consumer := r.URL.Query().Get("consumer")
+	if consumer == "" {
+		return nil
+	}
+	return l.bucketOf(consumerBucket(consumer), func(limit DeliveryRateLimit) bool {
+		return contains(limit.Consumers, consumer)
+	})
+}
+
+// bucketOf returns the bucket with the key, it is created with the first
+// matching limit. l.mu has to be held.
+func (l *deliveryLimiter) bucketOf(key string, matches func(DeliveryRateLimit) bool) *deliveryBucket {
+	b, found := l.buckets[key]
+	if found {
+		return b
+	}
+
+	for _, limit := range l.limits {
+		if matches(limit) {
+			b = newDeliveryBucket(limit)
+			l.buckets[key] = b
+			return b
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferDeliveringAtMostEventsPerSecondToTheConsumer(ctx context.Context, n int, consumer string) error {
+	return startBuffer(ctx, server.Options{
+		DeliveryRateLimits: []server.DeliveryRateLimit{{Consumers: []string{consumer}, EventsPerSecond: float64(n)}},
+	})
+}
+
+func aBufferAcceptingTheTokenDeliveringAtMostEventsPerSecondTo(ctx context.Context, entry string, n int, principal string) error {
+	return startAuthenticatedBuffer(ctx, server.Options{
+		DeliveryRateLimits: []server.DeliveryRateLimit{{Principals: []string{principal}, EventsPerSecond: float64(n)}},
+	}, entry)
+}
+
+// pollLimited polls waiting at most wait and returns the number of
+// events.
+func pollLimited(ctx context.Context, q url.Values, token string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getState(ctx).serverBaseURL+"/events?"+q.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("authorization", "Bearer "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	evts := []json.RawMessage{}
+	err = json.NewDecoder(res.Body).Decode(&evts)
+	if err != nil {
+		return 0, fmt.Errorf("could not decode events: %w", err)
+	}
+	return len(evts), nil
+}
+
+func pollingAsTheConsumerWaitingShouldReturnEvents(ctx context.Context, consumer, wait string, expected int) error {
+	n, err := pollLimited(ctx, url.Values{"consumer": {consumer}, "wait": {wait}}, "")
+	if err != nil {
+		return err
+	}
+	if n != expected {
+		return fmt.Errorf("expected %d events, got %d", expected, n)
+	}
+	return nil
+}
+
+func pollingWithTheTokenWaitingShouldReturnEvents(ctx context.Context, token, wait string, expected int) error {
+	n, err := pollLimited(ctx, url.Values{"wait": {wait}}, token)
+	if err != nil {
+		return err
+	}
+	if n != expected {
+		return fmt.Errorf("expected %d events, got %d", expected, n)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var readAheadPolls = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "event_buffer_read_ahead_polls_total",
+	Help: "Number of polls continuing a sequential read, by whether their events were prefetched.",
+}, []string{"result"})
+
+const (
+	// readAheadTTL drops prefetched events no poll asked for in time.
+	readAheadTTL = 30 * time.Second
+	// maxReadAheadReaders bounds the readers whose position is followed,
+	// positions are forgotten when there are more.
+	maxReadAheadReaders = 10000
+)
+
+type readAheadKey struct {
+	topic string
+	after string
+}
+
+type readAheadEntry struct {
+	key     readAheadKey
+	limit   int
+	created time.Time
+	// ready is closed once events are read, events is nil when the read
+	// failed or fewer than limit events followed the cursor
+	ready  chan struct{}
+	events []event
+	size   int
+}
+
+// readAhead prefetches the events following the last poll of consumers
+// reading a stream sequentially in full batches, i.e. catching up. The
+// next batch is read while the current one is sent, so the poll asking for
+// it is served from memory.
+type readAhead struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	// positions holds where the previous poll of each reader ended
+	positions map[string]readAheadKey
+	entries   map[readAheadKey]*readAheadEntry
+	// order holds the entries from oldest to newest
+	order []*readAheadEntry
+}
+
+func newReadAhead(maxSize int) *readAhead {
+	return &readAhead{
+		maxSize:   maxSize,
+		positions: map[string]readAheadKey{},
+		entries:   map[readAheadKey]*readAheadEntry{},
+	}
+}
+
+func (ra *readAhead) enabled() bool {
+	return ra.maxSize > 0
+}
+
+// take returns the limit events prefetched after the cursor and waits for
+// a prefetch in progress. found is false when the events after the cursor
+// were not prefetched, events is nil as well when the prefetch failed or
+// read fewer events.
+func (ra *readAhead) take(ctx context.Context, topic, after string, limit int) (events []event, found bool) {
+	key := readAheadKey{topic: topic, after: after}
+	ra.mu.Lock()
+	e := ra.entries[key]
+	ra.mu.Unlock()
+	if e == nil {
+		return nil, false
+	}
+
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		return nil, true
+	}
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.entries[key] != e {
+		return nil, true
+	}
+	ra.remove(e)
+
+	if len(e.events) < limit {
+		return nil, true
+	}
+	return e.events[:limit], true
+}
+
+// next records where the poll of reader ended and returns the entry to
+// prefetch the events after it into, which is when the poll continued
+// where the previous one of the reader ended.
+func (ra *readAhead) next(reader, topic, after, last string, limit int) *readAheadEntry {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	previous, found := ra.positions[reader]
+	if !found && len(ra.positions) >= maxReadAheadReaders {
+		ra.positions = map[string]readAheadKey{}
+	}
+	ra.positions[reader] = readAheadKey{topic: topic, after: last}
+
+	sequential := found && previous == readAheadKey{topic: topic, after: after}
+	if !sequential {
+		return nil
+	}
+
+	key := readAheadKey{topic: topic, after: last}
+	if ra.entries[key] != nil {
+		return nil
+	}
+
+	e := &readAheadEntry{key: key, limit: limit, created: time.Now(), ready: make(chan struct{})}
+	ra.entries[key] = e
+	ra.order = append(ra.order, e)
+	return e
+}
+
+// fill stores the events of a prefetch, they are dropped when they don't
+// fit the cache even after evicting all older entries.
+func (ra *readAhead) fill(e *readAheadEntry, events []event) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	defer close(e.ready)
+
+	// the entry was dropped while its events were read
+	if ra.entries[e.key] != e {
+		return
+	}
+
+	size := 0
+	for _, ev := range events {
+		size += len(ev.id) + len(ev.payload)
+	}
+
+	if len(events) < e.limit || size > ra.maxSize {
+		ra.remove(e)
+		return
+	}
+
+	now := time.Now()
+	for _, o := range append([]*readAheadEntry(nil), ra.order...) {
+		if o != e && (ra.size+size > ra.maxSize || now.Sub(o.created) > readAheadTTL) {
+			ra.remove(o)
+		}
+	}
+
+	e.events = events
+	e.size = size
+	ra.size += size
+}
+
+// drop removes the prefetched events of a stream, e.g. after some of them
+// were pruned.
+func (ra *readAhead) drop(topic string) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for _, e := range append([]*readAheadEntry(nil), ra.order...) {
+		if e.key.topic == topic {
+			ra.remove(e)
+		}
+	}
+}
+
+// clear removes the prefetched events of all streams.
+func (ra *readAhead) clear() {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.entries = map[readAheadKey]*readAheadEntry{}
+	ra.order = nil
+	ra.size = 0
+}
+
+func (ra *readAhead) remove(e *readAheadEntry) {
+	if ra.entries[e.key] != e {
+		return
+	}
+	delete(ra.entries, e.key)
+	ra.size -= e.size
+	for i, o := range ra.order {
+		if o == e {
+			ra.order = append(ra.order[:i:i], ra.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// prefetch reads the events of a read ahead entry. It takes a read slot of
+// the reader like its polls do.
+func (s *Server) prefetch(reader string, st stream, e *readAheadEntry) {
+	events := []event{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultPollWait)
+	defer cancel()
+
+	defer func() {
+		s.readAhead.fill(e, events)
+	}()
+
+	release, _, err := s.readScheduler.acquire(ctx, reader)
+	if err != nil {
+		events = nil
+		return
+	}
+	defer release()
+
+	err = bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		it := tx.Iterator(st.events)
+		seekAfter(it, e.key.after, sortAsc)
+		for ; !it.IsDone() && len(events) < e.limit; it.Next() {
+			payload, err := s.loadPayload(ctx, tx, it.GetValue())
+			if err != nil {
+				return fmt.Errorf("could not load event %s: %w", it.GetKey(), err)
+			}
+			events = append(events, event{id: it.GetKey(), payload: payload})
+		}
+		return nil
+	})
+	if err != nil {
+		s.log.Error(err, "could not prefetch events", "topic", st.topic, "after", e.key.after)
+		events = nil
+	}
+}
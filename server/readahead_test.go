@@ -0,0 +1,76 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/draganm/event-buffer/server"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func aBufferWithReadAhead(ctx context.Context) error {
+	return startBuffer(ctx, server.Options{ReadAheadSize: 1 << 20})
+}
+
+func numberedEvents(n int) []string {
+	evts := []string{}
+	for i := 0; i < n; i++ {
+		evts = append(evts, fmt.Sprintf("evt-%d", i))
+	}
+	return evts
+}
+
+func eventsInTheBuffer(ctx context.Context, n int) error {
+	evts := []any{}
+	for _, e := range numberedEvents(n) {
+		evts = append(evts, e)
+	}
+	return getState(ctx).client.SendEvents(ctx, evts)
+}
+
+// iPollForTheEventsInBatchesOf polls n events, polls block until events
+// arrive, so it stops once all of them were returned.
+func iPollForTheEventsInBatchesOf(ctx context.Context, n, size int) error {
+	s := getState(ctx)
+	s.pollResult = []string{}
+	after := ""
+	for len(s.pollResult) < n {
+		evts := []string{}
+		ids, err := s.client.PollForEvents(ctx, after, size, sortAsc, &evts)
+		if err != nil {
+			return fmt.Errorf("failed polling for events: %w", err)
+		}
+		s.pollResult = append(s.pollResult, evts...)
+		after = ids[len(ids)-1]
+	}
+	return nil
+}
+
+func theBatchesShouldReturnAllEventsInOrder(ctx context.Context, n int) error {
+	d := cmp.Diff(getState(ctx).pollResult, numberedEvents(n))
+	if d != "" {
+		return fmt.Errorf("unexpected poll result:\n%s", d)
+	}
+	return nil
+}
+
+func aBatchShouldHaveBeenServedFromTheReadAhead(ctx context.Context) error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+	for _, f := range families {
+		if f.GetName() != "event_buffer_read_ahead_polls_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "result" && l.GetValue() == "hit" && m.GetCounter().GetValue() > 0 {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("no poll was served from the read ahead")
+}
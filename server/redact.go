@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/gofrs/uuid"
+)
+
+// auditPath holds a record of every redaction, it is not pruned.
+var auditPath = dbpath.ToPath("audit")
+
+// RedactionRequest selects events by id and/or by the value of a field of
+// their payload. Selected events are overwritten with Replacement, or
+// tombstoned with a null payload when no replacement is given. The events
+// keep their ids so consumer cursors remain valid.
+type RedactionRequest struct {
+	IDs         []string        `json:"ids"`
+	Match       *RedactionMatch `json:"match,omitempty"`
+	Replacement json.RawMessage `json:"replacement,omitempty"`
+	Reason      string          `json:"reason"`
+}
+
+// RedactionMatch selects events where the value at the JSON pointer is
+// equal to Value.
+type RedactionMatch struct {
+	Pointer string          `json:"pointer"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// Redaction is the audit record of a redaction.
+type Redaction struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	Reason    string    `json:"reason"`
+	Mode      string    `json:"mode"`
+	Events    []string  `json:"events"`
+	// Retained names the copies of the original payloads the buffer can't
+	// rewrite, see Redact.
+	Retained []string `json:"retained,omitempty"`
+}
+
+// Copies of payloads that outlive a redaction.
+const (
+	retainedWAL        = "wal"
+	retainedArchive    = "archive"
+	retainedPayloadLog = "payload-log"
+)
+
+var tombstone = json.RawMessage("null")
+
+// Redact overwrites the selected events of the buffer and its topics and
+// stores an audit record in the same transaction. Shipped WAL segments,
+// archive segments and the payload log are append-only and keep the
+// original payloads, the audit record names the ones holding redacted
+// events so they can be purged by hand. Backups and dumps taken earlier
+// are never rewritten either.
+func (s Server) Redact(req RedactionRequest, principal string) (*Redaction, error) {
+	if req.Reason == "" {
+		return nil, errors.New("reason must be provided")
+	}
+
+	if len(req.IDs) == 0 && req.Match == nil {
+		return nil, errors.New("either ids or match must be provided")
+	}
+
+	replacement := tombstone
+	mode := "tombstone"
+	if len(req.Replacement) > 0 {
+		if !json.Valid(req.Replacement) {
+			return nil, errors.New("replacement is not valid JSON")
+		}
+		replacement = req.Replacement
+		mode = "overwrite"
+	}
+
+	var matcher *PayloadMatcher
+	if req.Match != nil {
+		var err error
+		matcher, err = NewPayloadMatcher(req.Match.Pointer, req.Match.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	auditID, err := uuid.NewV6()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate UUID: %w", err)
+	}
+
+	rd := &Redaction{
+		ID:        auditID.String(),
+		Time:      time.Now().UTC(),
+		Principal: principal,
+		Reason:    req.Reason,
+		Mode:      mode,
+		Events:    []string{},
+	}
+
+	objects := []string{}
+	redacted := []string{}
+
+	err = bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		topics, err := readTopics(tx)
+		if err != nil {
+			return err
+		}
+
+		retained := map[string]bool{}
+		for _, st := range append([]stream{defaultStream}, topics...) {
+			ids, err := s.selectForRedaction(tx, st, req.IDs, matcher)
+			if err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				continue
+			}
+
+			for _, id := range ids {
+				tp := traceParent(tx, id)
+				// deleting first releases the reference to a shared payload,
+				// which is removed once no event references it anymore
+				object, err := deleteEvent(tx, st.events, id)
+				if err != nil {
+					return err
+				}
+				if object != "" {
+					objects = append(objects, object)
+				}
+				err = s.storeEvent(tx, st.events, id, replacement)
+				if err != nil {
+					return err
+				}
+				if tp != "" {
+					s.putTraceParent(tx, id, tp)
+				}
+
+				if id <= archivedUntil(tx, st) {
+					retained[retainedArchive] = true
+				}
+				if tx.Exists(st.walShipped) && id <= string(tx.Get(st.walShipped)) {
+					retained[retainedWAL] = true
+				}
+			}
+
+			rd.Events = append(rd.Events, ids...)
+			redacted = append(redacted, st.topic)
+		}
+
+		if s.opts.PayloadLog != nil && len(rd.Events) > 0 {
+			retained[retainedPayloadLog] = true
+		}
+		for _, r := range []string{retainedWAL, retainedArchive, retainedPayloadLog} {
+			if retained[r] {
+				rd.Retained = append(rd.Retained, r)
+			}
+		}
+
+		d, err := json.Marshal(rd)
+		if err != nil {
+			return fmt.Errorf("could not marshal audit record: %w", err)
+		}
+
+		tx.Put(auditPath.Append(rd.ID), d)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.deleteObjects(objects)
+	// prefetched events still have their original payloads
+	for _, topic := range redacted {
+		s.readAhead.drop(topic)
+	}
+
+	s.log.Info("redacted events", "audit", rd.ID, "principal", principal, "mode", mode, "count", len(rd.Events), "retained", rd.Retained)
+
+	return rd, nil
+}
+
+// selectForRedaction returns the ids of the events of a stream that are
+// listed in ids or matched by matcher, in the order of the stream.
+func (s Server) selectForRedaction(tx bolted.SugaredWriteTx, st stream, ids []string, matcher *PayloadMatcher) ([]string, error) {
+	selected := map[string]bool{}
+	for _, id := range ids {
+		if tx.Exists(st.events.Append(id)) {
+			selected[id] = true
+		}
+	}
+
+	if matcher != nil {
+		for it := tx.Iterator(st.events); !it.IsDone(); it.Next() {
+			payload, err := s.loadPayload(context.Background(), tx, it.GetValue())
+			if err != nil {
+				return nil, fmt.Errorf("could not load event %s: %w", it.GetKey(), err)
+			}
+			matches, err := matcher.Matches(payload)
+			if err != nil {
+				return nil, fmt.Errorf("could not match event %s: %w", it.GetKey(), err)
+			}
+			if matches {
+				selected[it.GetKey()] = true
+			}
+		}
+	}
+
+	found := []string{}
+	if len(selected) == 0 {
+		return found, nil
+	}
+	for it := tx.Iterator(st.events); !it.IsDone(); it.Next() {
+		if selected[it.GetKey()] {
+			found = append(found, it.GetKey())
+		}
+	}
+	return found, nil
+}
+
+// Redactions returns the audit records of all redactions.
+func (s Server) Redactions() ([]Redaction, error) {
+	redactions := []Redaction{}
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		for it := tx.Iterator(auditPath); !it.IsDone(); it.Next() {
+			rd := Redaction{}
+			err := json.Unmarshal(it.GetValue(), &rd)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal audit record %s: %w", it.GetKey(), err)
+			}
+			redactions = append(redactions, rd)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return redactions, nil
+}
@@ -0,0 +1,168 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+	"github.com/google/go-cmp/cmp"
+)
+
+func anEventWithThePayloadInTheTopic(ctx context.Context, payload, topic string) error {
+	tc, err := topicClient(ctx, topic)
+	if err != nil {
+		return err
+	}
+	return tc.SendEvents(ctx, []any{json.RawMessage(payload)})
+}
+
+// polledPayloads returns the ids and compacted payloads of the events of
+// the buffer, or of a topic when cl is a topic client.
+func polledPayloads(ctx context.Context, cl *client.Client) ([]string, []string, error) {
+	evts := []json.RawMessage{}
+	ids, err := cl.PollForEvents(ctx, "", 10, sortAsc, &evts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed polling for events: %w", err)
+	}
+
+	payloads := []string{}
+	for _, e := range evts {
+		payloads = append(payloads, string(e))
+	}
+	return ids, payloads, nil
+}
+
+func redact(ctx context.Context, principal string, req server.RedactionRequest) error {
+	s := getState(ctx)
+	rd, err := s.server.Redact(req, principal)
+	if err != nil {
+		return err
+	}
+	s.redaction = rd
+	return nil
+}
+
+func redactTheFirstEvent(ctx context.Context, principal, replacement, reason string) error {
+	ids, _, err := polledPayloads(ctx, getState(ctx).client)
+	if err != nil {
+		return err
+	}
+	return redact(ctx, principal, server.RedactionRequest{
+		IDs:         ids[:1],
+		Replacement: json.RawMessage(replacement),
+		Reason:      reason,
+	})
+}
+
+func redactsTheFirstEventBecause(ctx context.Context, principal, reason string) error {
+	return redactTheFirstEvent(ctx, principal, "", reason)
+}
+
+func redactsTheFirstEventWithTheReplacementBecause(ctx context.Context, principal, replacement, reason string) error {
+	return redactTheFirstEvent(ctx, principal, replacement, reason)
+}
+
+func redactsTheEventsWhereIsBecause(ctx context.Context, principal, pointer, value, reason string) error {
+	return redact(ctx, principal, server.RedactionRequest{
+		Match:  &server.RedactionMatch{Pointer: pointer, Value: json.RawMessage(value)},
+		Reason: reason,
+	})
+}
+
+func redactingTheFirstEventWithoutAReasonShouldFail(ctx context.Context) error {
+	err := redactTheFirstEvent(ctx, "dpo", "", "")
+	if err == nil {
+		return errors.New("expected the redaction to fail")
+	}
+	return nil
+}
+
+func payloadsShouldBe(ctx context.Context, cl *client.Client, expected string) error {
+	want := []json.RawMessage{}
+	err := json.Unmarshal([]byte(expected), &want)
+	if err != nil {
+		return fmt.Errorf("could not decode expected payloads: %w", err)
+	}
+
+	compacted := []string{}
+	for _, w := range want {
+		b := &bytes.Buffer{}
+		err = json.Compact(b, w)
+		if err != nil {
+			return err
+		}
+		compacted = append(compacted, b.String())
+	}
+
+	_, payloads, err := polledPayloads(ctx, cl)
+	if err != nil {
+		return err
+	}
+
+	d := cmp.Diff(payloads, compacted)
+	if d != "" {
+		return fmt.Errorf("unexpected payloads:\n%s", d)
+	}
+	return nil
+}
+
+func theBufferShouldHoldThePayloads(ctx context.Context, expected string) error {
+	return payloadsShouldBe(ctx, getState(ctx).client, expected)
+}
+
+func theTopicShouldHoldThePayloads(ctx context.Context, topic, expected string) error {
+	tc, err := topicClient(ctx, topic)
+	if err != nil {
+		return err
+	}
+	return payloadsShouldBe(ctx, tc, expected)
+}
+
+func theRedactionShouldBeAuditedWithThePrincipalTheReasonAndTheMode(ctx context.Context, principal, reason, mode string) error {
+	s := getState(ctx)
+	redactions, err := s.server.Redactions()
+	if err != nil {
+		return err
+	}
+
+	if len(redactions) != 1 {
+		return fmt.Errorf("expected one audit record, got %d", len(redactions))
+	}
+
+	rd := redactions[0]
+	if rd.ID != s.redaction.ID || rd.Principal != principal || rd.Reason != reason || rd.Mode != mode {
+		return fmt.Errorf("unexpected audit record %+v", rd)
+	}
+
+	d := cmp.Diff(rd.Events, s.redaction.Events)
+	if d != "" {
+		return fmt.Errorf("unexpected events of the audit record:\n%s", d)
+	}
+	if len(rd.Events) != 1 {
+		return fmt.Errorf("expected one redacted event, got %v", rd.Events)
+	}
+	return nil
+}
+
+func theRedactionShouldNameTheRetainedCopies(ctx context.Context, copies string) error {
+	expected := []string{}
+	if copies != "" {
+		expected = strings.Split(copies, ",")
+	}
+
+	retained := getState(ctx).redaction.Retained
+	if retained == nil {
+		retained = []string{}
+	}
+
+	d := cmp.Diff(retained, expected)
+	if d != "" {
+		return fmt.Errorf("unexpected retained copies:\n%s", d)
+	}
+	return nil
+}
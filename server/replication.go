@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/draganm/bolted"
+)
+
+// errFollowerBehind stops following a primary that has pruned events the
+// follower has not copied yet, the follower has to be bootstrapped again.
+var errFollowerBehind = errors.New("follower is behind the retention of the primary")
+
+const maxFollowBackoff = 30 * time.Second
+
+// ServeReplication streams the events of the buffer after the cursor in
+// the after parameter, followed by every event appended later, as one
+// JSON array [id, payload] per line. Events after a pruned cursor are
+// answered with 410 Gone.
+func (s *Server) ServeReplication(w http.ResponseWriter, r *http.Request) {
+	compressResponses(s.serveReplication)(w, r)
+}
+
+func (s *Server) serveReplication(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+
+	after := r.URL.Query().Get("after")
+	if after != "" {
+		_, err := eventTime(after)
+		if err != nil {
+			http.Error(w, fmt.Errorf("invalid cursor: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, done := s.db.Observe(eventsPath.ToMatcher().AppendAnyElementMatcher())
+	defer done()
+
+	if after != "" {
+		expired, err := s.cursorExpired(defaultStream, after)
+		if err != nil {
+			log.Error(err, "could not check cursor")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if expired != nil {
+			w.Header().Set("content-type", "application/json")
+			w.WriteHeader(http.StatusGone)
+			json.NewEncoder(w).Encode(expired)
+			return
+		}
+	}
+
+	w.Header().Set("content-type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	flush := func() error {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	flush()
+
+	log.Info("follower connected", "after", after)
+	err := s.tailEvents(r.Context(), defaultStream, changes, after, json.NewEncoder(w), flush)
+	if err != nil && r.Context().Err() == nil {
+		log.Error(err, "could not replicate events")
+	}
+}
+
+// Follow copies the events appended to the primary at primaryURL, the
+// internal API of another instance, until ctx is cancelled. Connections
+// are retried when they fail, an error is only returned when the primary
+// has pruned events that were not copied yet.
+//
+// Only events of the buffer are copied, consumers and topics of the
+// primary are copied once when the follower is bootstrapped from its
+// snapshot.
+func (s *Server) Follow(ctx context.Context, primaryURL string) error {
+	u, err := url.Parse(primaryURL)
+	if err != nil {
+		return fmt.Errorf("invalid primary url: %w", err)
+	}
+	u = u.JoinPath("replication", "events")
+
+	backoff := time.Second
+	for {
+		connected, err := s.follow(ctx, u)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errFollowerBehind) {
+			return err
+		}
+		if connected {
+			backoff = time.Second
+		}
+
+		s.log.Error(err, "lost connection to primary, reconnecting", "primary", u.Redacted(), "backoff", backoff)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxFollowBackoff {
+			backoff = maxFollowBackoff
+		}
+	}
+}
+
+// follow copies events from one connection to the primary, connected is
+// true once the primary started sending events.
+func (s *Server) follow(ctx context.Context, u *url.URL) (connected bool, err error) {
+	newest := ""
+	err = bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		it := tx.Iterator(eventsPath)
+		it.Last()
+		if !it.IsDone() {
+			newest = it.GetKey()
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("could not find newest event: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	q := url.Values{}
+	q.Set("after", newest)
+	ru := *u
+	ru.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", ru.String(), nil)
+	if err != nil {
+		return false, fmt.Errorf("could not create request: %w", err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("could not connect: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusGone {
+		expired := retentionExpired{}
+		json.NewDecoder(res.Body).Decode(&expired)
+		return false, fmt.Errorf("%w: %s", errFollowerBehind, expired.Error)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return false, fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	s.log.Info("following primary", "primary", u.Redacted(), "after", newest)
+
+	// events are decoded while the previous ones are stored, storing takes
+	// all the decoded ones in one transaction
+	events := make(chan event, cdcBatchSize)
+	decodeErr := make(chan error, 1)
+	go func() {
+		defer close(events)
+		dec := json.NewDecoder(bufio.NewReader(res.Body))
+		for {
+			e := event{}
+			err := dec.Decode(&e)
+			if err != nil {
+				decodeErr <- err
+				return
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				decodeErr <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	for {
+		e, ok := <-events
+		if !ok {
+			return true, fmt.Errorf("could not read events: %w", <-decodeErr)
+		}
+
+		batch := []event{e}
+	drain:
+		for len(batch) < cdcBatchSize {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, e)
+			default:
+				break drain
+			}
+		}
+
+		err = bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+			n := 0
+			for _, e := range batch {
+				if e.id <= newest {
+					continue
+				}
+				err := s.storeEvent(tx, eventsPath, e.id, e.payload)
+				if err != nil {
+					return err
+				}
+				n++
+			}
+			addCounter(tx, appendedPath, n)
+			return nil
+		})
+		if err != nil {
+			return true, fmt.Errorf("could not store events: %w", err)
+		}
+
+		if last := batch[len(batch)-1].id; last > newest {
+			newest = last
+			// a promoted follower stores its own events after them
+			err = s.clock.observe(newest)
+			if err != nil {
+				return true, err
+			}
+		}
+	}
+}
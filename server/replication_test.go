@@ -0,0 +1,84 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"time"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server/testrig"
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/mux"
+)
+
+func aFollowerOfTheBuffer(ctx context.Context) error {
+	s := getState(ctx)
+
+	// the replication endpoint is part of the internal API of the primary
+	internal := mux.NewRouter()
+	internal.Methods("GET").Path("/replication/events").HandlerFunc(s.server.ServeReplication)
+	primary := httptest.NewServer(internal)
+	go func() {
+		<-ctx.Done()
+		primary.Close()
+	}()
+
+	followerURL, follower, err := testrig.StartServer(ctx, logr.FromContextOrDiscard(ctx))
+	if err != nil {
+		return fmt.Errorf("could not start follower: %w", err)
+	}
+
+	go follower.Follow(ctx, primary.URL)
+
+	s.follower, err = client.New(followerURL)
+	return err
+}
+
+// pollAll polls until n events are returned.
+func pollAll(ctx context.Context, cl *client.Client, n int) ([]string, []string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	for {
+		evts := []string{}
+		ids, err := cl.PollForEvents(ctx, "", 10, sortAsc, &evts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(ids) >= n {
+			return ids, evts, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func pollingTheFollowerShouldReturnBothEvents(ctx context.Context) error {
+	_, evts, err := pollAll(ctx, getState(ctx).follower, 2)
+	if err != nil {
+		return fmt.Errorf("failed polling the follower: %w", err)
+	}
+	d := cmp.Diff(evts, []string{"evt1", "evt1"})
+	if d != "" {
+		return fmt.Errorf("unexpected poll result:\n%s", d)
+	}
+	return nil
+}
+
+func theFollowerShouldHaveTheSameIdsAsTheBuffer(ctx context.Context) error {
+	s := getState(ctx)
+	primary, _, err := pollAll(ctx, s.client, 2)
+	if err != nil {
+		return err
+	}
+	follower, _, err := pollAll(ctx, s.follower, 2)
+	if err != nil {
+		return err
+	}
+	d := cmp.Diff(follower, primary)
+	if d != "" {
+		return fmt.Errorf("ids differ:\n%s", d)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"io"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/event-buffer/snapshot"
+)
+
+// sequences returns the counters of the buffer and its topics.
+func sequences(tx bolted.SugaredReadTx) ([]snapshot.Sequence, error) {
+	topics, err := readTopics(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := []snapshot.Sequence{}
+	for _, st := range append([]stream{defaultStream}, topics...) {
+		seqs = append(seqs, snapshot.Sequence{
+			Stream:   st.topic,
+			Appended: getCounter(tx, st.appended),
+			Pruned:   getCounter(tx, st.pruned),
+		})
+	}
+	return seqs, nil
+}
+
+// WriteSnapshot writes a consistent snapshot of the whole state, its header
+// holds the counters of all streams. Payloads in the payload log are not
+// part of the state.
+func (s *Server) WriteSnapshot(w io.Writer) error {
+	return bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		seqs, err := sequences(tx)
+		if err != nil {
+			return err
+		}
+		return snapshot.WriteWithSequences(w, tx, seqs)
+	})
+}
+
+// Restored prepares the server for a state that replaced its state while
+// it was running. Maps missing in the restored state are created and
+// prefetched events are dropped.
+func (s *Server) Restored() error {
+	err := bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		return initState(tx, s.opts, false)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.readAhead.clear()
+
+	return observeNewestEvents(s.db, s.clock)
+}
@@ -0,0 +1,55 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferWithAcknowledgementBasedRetention(ctx context.Context) error {
+	return startBuffer(ctx, server.Options{
+		RetentionPeriod: testRetention,
+		AckRetention:    true,
+	})
+}
+
+func theConsumerAcknowledgesThePolledEvent(ctx context.Context, consumer string) error {
+	s := getState(ctx)
+	return s.client.UpdateCursor(ctx, consumer, s.lastId)
+}
+
+func theConsumerIsRegisteredBeforeTheFirstEvent(ctx context.Context, consumer string) error {
+	s := getState(ctx)
+	return s.client.UpdateCursor(ctx, consumer, server.TimeCursor(time.Now().Add(-time.Minute)))
+}
+
+func theBufferIsPrunedAtItsRetentionPeriod(ctx context.Context) error {
+	s := getState(ctx)
+	var err error
+	s.pruneStatus, err = s.server.PruneReport(time.Now().Add(-testRetention))
+	return err
+}
+
+func theBufferShouldStillHaveTwoEvents(ctx context.Context) error {
+	st, err := getState(ctx).server.Stats()
+	if err != nil {
+		return err
+	}
+	if st.Events != 2 {
+		return fmt.Errorf("expected 2 events, got %d", st.Events)
+	}
+	return nil
+}
+
+func theBufferShouldHaveCountedPrunedEvents(ctx context.Context, n int) error {
+	st, err := getState(ctx).server.Stats()
+	if err != nil {
+		return err
+	}
+	if st.Pruned != uint64(n) {
+		return fmt.Errorf("expected %d pruned events, got %d", n, st.Pruned)
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/draganm/event-buffer/auth"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errWriteQueueFull rejects publishes while too many others wait for a
+// write slot, producers are asked to retry later instead of timing out.
+var errWriteQueueFull = errors.New("too many publish requests are waiting, retry later")
+
+var (
+	writeBackpressure = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "event_buffer_write_backpressure",
+		Help: "Publish requests waiting for a write slot relative to the size of the write queue, publishes are rejected above 1.",
+	})
+	writeRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "event_buffer_write_rejected_total",
+		Help: "Number of publish requests rejected because the write queue was full.",
+	})
+)
+
+// fairShareLimit caps the events a poll reads while polls of other
+// consumers are waiting, so a consumer catching up doesn't hold a read
+// slot for long.
+const fairShareLimit = 100
+
+// readScheduler limits the concurrent storage reads of polls. When all
+// slots are busy, freed slots are handed to the waiting consumers in turn,
+// so a consumer polling a lot, e.g. a large replay with parallel polls,
+// gets one read per round like everybody else.
+type readScheduler struct {
+	mu   sync.Mutex
+	free int
+	// waiting holds the waiters of each consumer, order the consumers with
+	// waiters in the order they are served.
+	waiting map[string][]chan struct{}
+	order   []string
+}
+
+func newReadScheduler(slots int) *readScheduler {
+	if slots <= 0 {
+		slots = runtime.GOMAXPROCS(0) * 2
+	}
+	return &readScheduler{free: slots, waiting: map[string][]chan struct{}{}}
+}
+
+// acquire waits for a read slot for the consumer. contended is true when
+// other reads are waiting, release has to be called once the read is done.
+func (s *readScheduler) acquire(ctx context.Context, consumer string) (release func(), contended bool, err error) {
+	started := time.Now()
+	s.mu.Lock()
+	if s.free > 0 {
+		s.free--
+		contended = len(s.order) > 0
+		s.mu.Unlock()
+		readSlotWait.Observe(time.Since(started).Seconds())
+		return s.release, contended, nil
+	}
+
+	granted := make(chan struct{}, 1)
+	if len(s.waiting[consumer]) == 0 {
+		s.order = append(s.order, consumer)
+	}
+	s.waiting[consumer] = append(s.waiting[consumer], granted)
+	s.mu.Unlock()
+
+	select {
+	case <-granted:
+		s.mu.Lock()
+		contended = len(s.order) > 0
+		s.mu.Unlock()
+		readSlotWait.Observe(time.Since(started).Seconds())
+		return s.release, contended, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.remove(consumer, granted) {
+		// the slot was handed over before the wait was given up
+		s.releaseLocked()
+	}
+
+	return nil, false, ctx.Err()
+}
+
+// remove drops a waiter, it returns false if it is not waiting anymore.
+func (s *readScheduler) remove(consumer string, granted chan struct{}) bool {
+	waiters := s.waiting[consumer]
+	for i, w := range waiters {
+		if w != granted {
+			continue
+		}
+
+		waiters = append(waiters[:i], waiters[i+1:]...)
+		if len(waiters) > 0 {
+			s.waiting[consumer] = waiters
+			return true
+		}
+
+		delete(s.waiting, consumer)
+		for j, c := range s.order {
+			if c == consumer {
+				s.order = append(s.order[:j], s.order[j+1:]...)
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (s *readScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+// releaseLocked hands the slot to the first waiter of the next consumer,
+// s.mu has to be held.
+func (s *readScheduler) releaseLocked() {
+	if len(s.order) == 0 {
+		s.free++
+		return
+	}
+
+	consumer := s.order[0]
+	s.order = s.order[1:]
+
+	waiters := s.waiting[consumer]
+	waiters[0] <- struct{}{}
+	if len(waiters) > 1 {
+		s.waiting[consumer] = waiters[1:]
+		s.order = append(s.order, consumer)
+	} else {
+		delete(s.waiting, consumer)
+	}
+}
+
+// minWriteQueueSize is the smallest default write queue, so bursts of
+// publishes are not rejected on machines with few CPUs.
+const minWriteQueueSize = 64
+
+// writeSlots limits the concurrent publish requests, so they are served
+// next to a surge of polls and don't pile up on the write lock of the
+// database. Requests arriving while queueSize others wait are rejected,
+// see errWriteQueueFull.
+type writeSlots struct {
+	slots     chan struct{}
+	queueSize int64
+	waiting   atomic.Int64
+	// avgHold is a moving average of how long requests hold a slot.
+	avgHold atomic.Int64
+}
+
+func newWriteSlots(slots, queueSize int) *writeSlots {
+	if slots <= 0 {
+		slots = runtime.GOMAXPROCS(0) * 2
+	}
+	if queueSize <= 0 {
+		queueSize = slots * 4
+		if queueSize < minWriteQueueSize {
+			queueSize = minWriteQueueSize
+		}
+	}
+	return &writeSlots{slots: make(chan struct{}, slots), queueSize: int64(queueSize)}
+}
+
+// acquire waits for a write slot, release has to be called once the
+// request is done.
+func (w *writeSlots) acquire(ctx context.Context) (release func(), err error) {
+	waiting := w.waiting.Add(1)
+	defer func() {
+		writeBackpressure.Set(float64(w.waiting.Add(-1)) / float64(w.queueSize))
+	}()
+
+	if waiting > w.queueSize {
+		writeRejected.Inc()
+		return nil, errWriteQueueFull
+	}
+
+	writeBackpressure.Set(float64(waiting) / float64(w.queueSize))
+
+	select {
+	case w.slots <- struct{}{}:
+		start := time.Now()
+		return func() {
+			<-w.slots
+			hold := int64(time.Since(start))
+			avg := w.avgHold.Load()
+			// exponentially weighted with 1/8 for the new value
+			w.avgHold.Store(avg + (hold-avg)/8)
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// retryAfter estimates when the queue has drained, in whole seconds.
+func (w *writeSlots) retryAfter() int {
+	queued := float64(w.waiting.Load() + 1)
+	drain := time.Duration(queued / float64(cap(w.slots)) * float64(w.avgHold.Load()))
+	seconds := int(math.Ceil(drain.Seconds()))
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// acquireWriteSlot waits for a write slot for a publish request. It answers
+// the request with 429 and a Retry-After header when the write queue is
+// full and returns false when the request can't be handled.
+func (s *Server) acquireWriteSlot(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	release, err := s.writeSlots.acquire(r.Context())
+	if errors.Is(err, errWriteQueueFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(s.writeSlots.retryAfter()))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, fmt.Errorf("request context cancelled: %w", err).Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return release, true
+}
+
+// readerKey identifies the consumer of a read request for scheduling, the
+// authenticated principal and the consumer query parameter, the consumer
+// query parameter or the client address. Principals can't take the turns
+// of others by naming their consumers.
+func (s *Server) readerKey(r *http.Request) string {
+	consumer := r.URL.Query().Get("consumer")
+
+	p, found := auth.FromContext(r.Context())
+	if found {
+		if consumer != "" {
+			return "principal:" + p.Name + "/consumer:" + consumer
+		}
+		return "principal:" + p.Name
+	}
+
+	if consumer != "" {
+		return "consumer:" + consumer
+	}
+
+	return "client:" + s.opts.TrustedProxies.ClientIP(r)
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/draganm/event-buffer/auth"
+)
+
+// waiters returns the number of reads waiting for the consumer.
+func (s *readScheduler) waiters(consumer string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiting[consumer])
+}
+
+// queueRead starts a read of the consumer that reports its consumer on
+// served and holds its slot until release is called. It returns once the
+// read waits for a slot.
+func queueRead(t *testing.T, s *readScheduler, consumer string, served chan<- string, release <-chan struct{}) {
+	waiting := s.waiters(consumer)
+	go func() {
+		done, _, err := s.acquire(context.Background(), consumer)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		served <- consumer
+		<-release
+		done()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.waiters(consumer) == waiting {
+		if time.Now().After(deadline) {
+			t.Fatalf("read of %s is not waiting", consumer)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReadSchedulerServesWaitingConsumersInTurn(t *testing.T) {
+	s := newReadScheduler(1)
+
+	done, contended, err := s.acquire(context.Background(), "busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contended {
+		t.Fatal("expected an uncontended read")
+	}
+
+	served := make(chan string, 4)
+	release := make(chan struct{})
+	queueRead(t, s, "busy", served, release)
+	queueRead(t, s, "busy", served, release)
+	queueRead(t, s, "busy", served, release)
+	queueRead(t, s, "other", served, release)
+
+	done()
+
+	order := []string{}
+	for i := 0; i < 4; i++ {
+		select {
+		case c := <-served:
+			order = append(order, c)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("reads were not served, got %v", order)
+		}
+		release <- struct{}{}
+	}
+
+	expected := []string{"busy", "other", "busy", "busy"}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected reads to be served in the order %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestReadSchedulerReportsContention(t *testing.T) {
+	s := newReadScheduler(2)
+
+	first, _, err := s.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, _, err := s.acquire(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan string, 1)
+	release := make(chan struct{}, 1)
+	release <- struct{}{}
+	queueRead(t, s, "c", served, release)
+
+	// the slot of the first read goes to c, the one of the second is free
+	first()
+	<-served
+	second()
+
+	_, contended, err := s.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contended {
+		t.Fatal("expected an uncontended read once nobody waits")
+	}
+}
+
+func TestReadSchedulerKeepsTheSlotsOfCancelledWaits(t *testing.T) {
+	s := newReadScheduler(1)
+
+	done, _, err := s.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = s.acquire(ctx, "b")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+
+	done()
+
+	if s.waiters("b") != 0 || s.free != 1 {
+		t.Fatalf("expected one free slot and no waiters, got %d free and %v waiting", s.free, s.waiting)
+	}
+}
+
+func TestWriteSlotsLimitConcurrentPublishes(t *testing.T) {
+	w := newWriteSlots(1, 1)
+
+	release, err := w.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan func(), 1)
+	go func() {
+		r, err := w.acquire(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		acquired <- r
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for w.waiting.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("second publish is not waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = w.acquire(context.Background())
+	if !errors.Is(err, errWriteQueueFull) {
+		t.Fatalf("expected %v while the queue is full, got %v", errWriteQueueFull, err)
+	}
+
+	select {
+	case <-acquired:
+		t.Fatal("second publish was served while the slot was held")
+	default:
+	}
+
+	release()
+
+	select {
+	case r := <-acquired:
+		r()
+	case <-time.After(5 * time.Second):
+		t.Fatal("second publish was not served after the slot was released")
+	}
+}
+
+func TestReaderKey(t *testing.T) {
+	s := &Server{}
+
+	for _, c := range []struct {
+		name      string
+		url       string
+		principal string
+		expected  string
+	}{
+		{"principal", "/events", "alice", "principal:alice"},
+		{"consumer of a principal", "/events?consumer=c1", "alice", "principal:alice/consumer:c1"},
+		{"consumer named like another principal", "/events?consumer=alice", "mallory", "principal:mallory/consumer:alice"},
+		{"anonymous consumer", "/events?consumer=c1", "", "consumer:c1"},
+		{"client", "/events", "", "client:192.0.2.1"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", c.url, nil)
+			if c.principal != "" {
+				r = r.WithContext(auth.NewContext(r.Context(), &auth.Principal{Name: c.principal}))
+			}
+
+			key := s.readerKey(r)
+			if key != c.expected {
+				t.Fatalf("expected %s, got %s", c.expected, key)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/draganm/event-buffer/auth"
+	"github.com/draganm/event-buffer/eventbufferpb"
+)
+
+// RequiredScope returns the scope a request of the API or a gRPC call,
+// whose path is its full method, requires. Reads, fetching events by id,
+// seen sets and moving the cursor of consumers require the read scope,
+// publishing, transactions, WebSockets and changes of topics and consumers
+// the write scope.
+func RequiredScope(r *http.Request) string {
+	switch r.URL.Path {
+	case eventbufferpb.EventBuffer_Poll_FullMethodName, eventbufferpb.EventBuffer_StreamEvents_FullMethodName:
+		return auth.ScopeRead
+	case eventbufferpb.EventBuffer_Publish_FullMethodName, eventbufferpb.EventBuffer_Prune_FullMethodName:
+		return auth.ScopeWrite
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	// WebSockets publish as well as deliver events
+	if strings.HasSuffix(path, "/ws") {
+		return auth.ScopeWrite
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return auth.ScopeRead
+	}
+
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/events/get"):
+		return auth.ScopeRead
+	case strings.HasPrefix(path, "/seen-sets"):
+		return auth.ScopeRead
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "/consumers/") &&
+		(strings.HasSuffix(path, "/cursor") || strings.HasSuffix(path, "/heartbeat")):
+		return auth.ScopeRead
+	}
+
+	return auth.ScopeWrite
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Seen sets are bloom filters of ids of events a consumer has processed
+// already, uploaded before replaying a large window so polls can leave
+// them out. The body of POST /seen-sets is the bit array of the filter,
+// bit j is the bit 1<<(j%8) of byte j/8, and ?hashes=k the number of bits
+// set for each id. For an id with the 64 bit FNV-1a hash h the bits
+// (h1 + i*h2) mod m are set, where h1 is the lower and h2 the upper 32 bits
+// of h, i counts from 0 to k-1 and m is the number of bits of the filter.
+// Polling with ?skip-seen=<id> skips events that may be in the set, like
+// with any bloom filter a small fraction of unprocessed events is skipped
+// as well.
+const (
+	// seenSetTTL is how long a seen set is kept after it was last used,
+	// seen sets are not persisted.
+	seenSetTTL = time.Hour
+
+	maxSeenSetSize = 64 << 20
+	// maxSeenSetsSize limits the memory used by all seen sets.
+	maxSeenSetsSize  = 256 << 20
+	maxSeenSetHashes = 32
+
+	// maxSkippedEvents limits the events a poll skips before it returns,
+	// so skipping a large part of the buffer doesn't hold a read
+	// transaction for long.
+	maxSkippedEvents = 10000
+
+	// scannedHeader tells polls skipping a seen set the id of the last
+	// event they looked at, it is the cursor of the next poll when all
+	// events were skipped.
+	scannedHeader = "X-Buffer-Scanned"
+)
+
+type seenSet struct {
+	bits    []byte
+	hashes  int
+	expires time.Time
+}
+
+func (s *seenSet) mayContain(id string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+	m := uint64(len(s.bits)) * 8
+	for i := uint64(0); i < uint64(s.hashes); i++ {
+		bit := (h1 + i*h2) % m
+		if s.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type seenSets struct {
+	mu   sync.Mutex
+	sets map[string]*seenSet
+	size int
+}
+
+// expire removes seen sets that have not been used for seenSetTTL, s.mu
+// has to be held.
+func (s *seenSets) expire(now time.Time) {
+	for id, set := range s.sets {
+		if now.After(set.expires) {
+			s.size -= len(set.bits)
+			delete(s.sets, id)
+		}
+	}
+}
+
+func (s *seenSets) add(set *seenSet) (string, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+
+	if s.size+len(set.bits) > maxSeenSetsSize {
+		return "", time.Time{}, false
+	}
+
+	id := uuid.Must(uuid.NewV4()).String()
+	set.expires = now.Add(seenSetTTL)
+	if s.sets == nil {
+		s.sets = map[string]*seenSet{}
+	}
+	s.sets[id] = set
+	s.size += len(set.bits)
+
+	return id, set.expires, true
+}
+
+// get returns the seen set with the id and keeps it for another
+// seenSetTTL.
+func (s *seenSets) get(id string) *seenSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+
+	set := s.sets[id]
+	if set != nil {
+		set.expires = now.Add(seenSetTTL)
+	}
+	return set
+}
+
+func (s *seenSets) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := s.sets[id]
+	if set == nil {
+		return false
+	}
+	s.size -= len(set.bits)
+	delete(s.sets, id)
+	return true
+}
+
+type seenSetCreated struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+func (s *Server) createSeenSet(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+
+	hashes, err := strconv.Atoi(r.URL.Query().Get("hashes"))
+	if err != nil || hashes < 1 || hashes > maxSeenSetHashes {
+		http.Error(w, fmt.Sprintf("hashes must be between 1 and %d", maxSeenSetHashes), http.StatusBadRequest)
+		return
+	}
+
+	bits, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSeenSetSize))
+	if err != nil {
+		http.Error(w, fmt.Errorf("could not read request: %w", err).Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if len(bits) == 0 {
+		http.Error(w, "seen set is empty", http.StatusBadRequest)
+		return
+	}
+
+	id, expires, ok := s.seenSets.add(&seenSet{bits: bits, hashes: hashes})
+	if !ok {
+		log.Info("too many seen sets", "size", len(bits))
+		http.Error(w, "too many seen sets, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(seenSetCreated{ID: id, Expires: expires.UTC()})
+}
+
+func (s *Server) deleteSeenSet(w http.ResponseWriter, r *http.Request) {
+	if !s.seenSets.remove(mux.Vars(r)["id"]) {
+		http.Error(w, "seen set not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,10 +11,12 @@ import (
 
 	"github.com/draganm/bolted"
 	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/event-buffer/objectstore"
 	"github.com/go-logr/logr"
-	"github.com/gofrs/uuid"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -22,72 +25,447 @@ const (
 )
 
 type Server struct {
-	db  bolted.Database
-	log logr.Logger
+	db             bolted.Database
+	log            logr.Logger
+	opts           Options
+	redactionRules []compiledRedactionRule
+	// claimCheckSecret signs payload URLs of claim checks.
+	claimCheckSecret []byte
+	usage            *usageRecorder
+	seenSets         *seenSets
+	deliveryLimiter  *deliveryLimiter
+	readScheduler    *readScheduler
+	writeSlots       *writeSlots
+	prunes           *pruneTracker
+	readAhead        *readAhead
+	clock            *clockGuard
+	cipher           *payloadCipher
+	load             *loadMeter
 	http.Handler
 }
 
-var eventsPath = dbpath.ToPath("events")
+type Options struct {
+	// TrustedProxies are the networks allowed to set the client address
+	// using X-Forwarded-For or X-Real-IP headers.
+	TrustedProxies TrustedProxies
+
+	// RetentionPeriod is used to tell consumers until when an event is
+	// guaranteed to be available, expiry is omitted when it's zero.
+	RetentionPeriod time.Duration
+
+	// ProtectConsumers keeps events that have not been consumed by all
+	// registered consumers past the retention period, up to
+	// MaxRetentionPeriod.
+	ProtectConsumers   bool
+	MaxRetentionPeriod time.Duration
+
+	// AckRetention prunes events of the buffer once all registered
+	// consumers have acknowledged them, the retention period remains the
+	// ceiling for events that have not been acknowledged. Without
+	// registered consumers only the retention period applies.
+	AckRetention bool
+
+	// RedactionRules are applied to payloads of polled events.
+	RedactionRules []RedactionRule
+
+	// DedupMinSize enables content addressed storage of payloads with at
+	// least this many bytes, identical payloads are stored only once.
+	DedupMinSize int
+
+	// OffloadStore keeps payloads of at least OffloadMinSize bytes outside
+	// of the database, they are inlined again when polled.
+	OffloadStore   objectstore.Store
+	OffloadMinSize int
+
+	// PayloadLog keeps payloads of at least PayloadLogMinSize bytes in
+	// append-only files instead of the database, it takes precedence over
+	// deduplication. The log has to be given on every start once used.
+	PayloadLog        *PayloadLog
+	PayloadLogMinSize int
+
+	// ClaimCheckSecret signs URLs of payloads delivered as claim checks,
+	// a random secret is used when it's empty. ClaimCheckTTL is the
+	// validity of these URLs.
+	ClaimCheckSecret []byte
+	ClaimCheckTTL    time.Duration
+
+	// PublicURL is the base URL consumers reach the API at, it defaults
+	// to the scheme and host of the poll request.
+	PublicURL string
+
+	// MaxDecompressedSize limits the size of gzip or zstd compressed
+	// publish requests after decompression, it defaults to 64MiB.
+	MaxDecompressedSize int64
+
+	// DeliveryRateLimits cap the rate events are delivered to principals
+	// and consumers.
+	DeliveryRateLimits []DeliveryRateLimit
+
+	// ReadConcurrency and WriteConcurrency limit the concurrent storage
+	// reads of polls and the concurrent publish requests, they default to
+	// twice GOMAXPROCS.
+	ReadConcurrency  int
+	WriteConcurrency int
+
+	// WriteQueueSize is the number of publish requests that may wait for
+	// a write slot, further ones are rejected with 429 Too Many Requests.
+	// It defaults to four times WriteConcurrency, but at least 64.
+	WriteQueueSize int
+
+	// TopicMetrics limits the topics with their own metric labels.
+	TopicMetrics TopicMetrics
+
+	// ReadAheadSize is the number of payload bytes prefetched for consumers
+	// reading sequentially in full batches, read ahead is disabled when
+	// it's zero.
+	ReadAheadSize int
+
+	// CloudEvents only accepts CloudEvents 1.0 in the structured JSON
+	// format, and lets consumers read them in the structured or binary
+	// content mode.
+	CloudEvents bool
+
+	// MaxPublishAge rejects events whose occurred_at field, or time
+	// attribute of CloudEvents, is older than it or the retention period
+	// of their stream, whichever is shorter. Ages are not checked when
+	// it's zero.
+	MaxPublishAge time.Duration
+
+	// PayloadCompression compresses payloads stored in the database with
+	// zstd or snappy when set, payloads in the payload log or object store
+	// are stored as they are. Compressed payloads stay readable when it is
+	// changed or disabled.
+	PayloadCompression string
+
+	// EncryptionKeys encrypt payloads stored in the database, the payload
+	// log, offloaded payloads, WAL and archive segments with AES-GCM. The
+	// first key encrypts new payloads, the others only decrypt payloads
+	// stored before it was rotated in.
+	EncryptionKeys []EncryptionKey
+
+	// MaxBufferEvents and MaxBufferBytes are budgets for the events of
+	// all streams and the bytes of their payloads. Prunes remove the
+	// oldest events beyond them, regardless of retention periods and
+	// consumers. Zero disables a budget.
+	MaxBufferEvents uint64
+	MaxBufferBytes  uint64
+
+	// TraceIndex indexes events by the trace id of the traceparent they
+	// were published with, polls with a trace_id return the events of a
+	// trace.
+	TraceIndex bool
+
+	// ArchiveStore keeps the events of all streams before they are
+	// pruned, in segments of ArchiveFormat. Prunes never remove events
+	// that could not be archived. ArchiveFormat is one of jsonl, jsonl.gz
+	// and jsonl.zst, it defaults to jsonl.zst.
+	ArchiveStore  objectstore.Store
+	ArchiveFormat string
+
+	// IDPrefix precedes the ids of new events as <prefix>:<uuid>, so the
+	// buffer that generated an event is known from its id. It can only be
+	// changed while the buffer and its topics hold no events.
+	IDPrefix string
+
+	// IdempotencyWindow is how long the idempotency keys of publishes are
+	// remembered, retries of a publish within it return the batch stored
+	// by the first request instead of storing the events again. Keys are
+	// not remembered when it's zero.
+	IdempotencyWindow time.Duration
+
+	// Peering describes the instance and its peers in multi-instance
+	// topologies, served by GET /peers.
+	Peering Peering
+
+	// Load are the targets of the load score served by GET /load.
+	Load LoadTargets
+
+	// SystemEvents publishes lifecycle events of the server, such as
+	// prunes, to the SystemTopic.
+	SystemEvents bool
+}
 
-func New(log logr.Logger, db bolted.Database) (*Server, error) {
-	err := bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
-		if !tx.Exists(eventsPath) {
-			tx.CreateMap(eventsPath)
+var (
+	eventsPath = dbpath.ToPath("events")
+	metaPath   = dbpath.ToPath("meta")
+	// prunedUntilPath holds the id of the newest pruned event.
+	prunedUntilPath = metaPath.Append("pruned-until")
+)
 
-		}
-		return nil
+// initState creates the maps and counters of the state that are missing,
+// states of earlier versions are upgraded in place.
+func initState(tx bolted.SugaredWriteTx, opts Options, sharded bool) error {
+	// topics of a sharded state are missing without their shards
+	if !sharded && tx.Exists(stateShardsPath) {
+		return fmt.Errorf("state is sharded across %d files, its shards have to be given", binary.BigEndian.Uint64(tx.Get(stateShardsPath)))
+	}
+	if !tx.Exists(eventsPath) {
+		tx.CreateMap(eventsPath)
+
+	}
+	if !tx.Exists(metaPath) {
+		tx.CreateMap(metaPath)
+	}
+	if !tx.Exists(consumersPath) {
+		tx.CreateMap(consumersPath)
+	}
+	if !tx.Exists(producersPath) {
+		tx.CreateMap(producersPath)
+		tx.CreateMap(producerSessionsPath)
+	}
+	if !tx.Exists(auditPath) {
+		tx.CreateMap(auditPath)
+	}
+	if !tx.Exists(blobsPath) {
+		tx.CreateMap(blobsPath)
+	}
+	if !tx.Exists(blobRefsPath) {
+		tx.CreateMap(blobRefsPath)
+	}
+	if !tx.Exists(payloadLogRefsPath) {
+		tx.CreateMap(payloadLogRefsPath)
+	}
+	if !tx.Exists(traceParentsPath) {
+		tx.CreateMap(traceParentsPath)
+	}
+	initTraceIndex(tx, opts.TraceIndex)
+	if !tx.Exists(ingestedPath) {
+		tx.CreateMap(ingestedPath)
+	}
+	if !tx.Exists(usagePath) {
+		tx.CreateMap(usagePath)
+	}
+	if !tx.Exists(topicsPath) {
+		tx.CreateMap(topicsPath)
+	}
+	initSystemTopic(tx, opts.SystemEvents)
+	if !tx.Exists(pruneSubscriptionsPath) {
+		tx.CreateMap(pruneSubscriptionsPath)
+	}
+	initCounters(tx)
+	err := initIDPrefix(tx, opts.IDPrefix)
+	if err != nil {
+		return err
+	}
+	err = initOffloaded(tx)
+	if err != nil {
+		return err
+	}
+	return initStoredBytes(tx)
+}
+
+func New(log logr.Logger, db bolted.Database, opts Options) (*Server, error) {
+	_, sharded := db.(*shardedDB)
+	err := bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
+		return initState(tx, opts, sharded)
 	})
 
 	if err != nil {
 		return nil, fmt.Errorf("could not initialize db: %w", err)
 	}
 
-	r := mux.NewRouter()
+	if opts.PayloadLog != nil {
+		db = &payloadLogDB{Database: db, log: opts.PayloadLog}
+	}
+	db = contentionDB{Database: db}
 
-	r.Methods("POST").Path("/events").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	err = checkPayloadCompression(opts.PayloadCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkArchiveFormat(opts.ArchiveFormat)
+	if err != nil {
+		return nil, err
+	}
 
-		log := log.WithValues("method", r.Method, "path", r.URL.Path)
-		events := []json.RawMessage{}
+	err = ValidatePeering(opts.Peering)
+	if err != nil {
+		return nil, err
+	}
 
-		err := json.NewDecoder(r.Body).Decode(&events)
+	encryption, err := newPayloadCipher(opts.EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
 
+	clock, err := newClockGuard(log, opts.IDPrefix)
+	if err != nil {
+		return nil, err
+	}
+	err = observeNewestEvents(db, clock)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.OffloadStore == nil {
+		err = warnAboutOffloaded(log, db)
 		if err != nil {
-			log.Error(err, "could not decode request")
-			http.Error(w, fmt.Errorf("could not decode request: %w", err).Error(), http.StatusBadRequest)
-			return
+			return nil, err
+		}
+	}
+
+	redactionRules, err := compileRedactionRules(opts.RedactionRules)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveryLimiter, err := newDeliveryLimiter(opts.DeliveryRateLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	claimCheckSecret := opts.ClaimCheckSecret
+	if len(claimCheckSecret) == 0 {
+		claimCheckSecret, err = newClaimCheckSecret()
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	s := &Server{
+		db:               db,
+		log:              log,
+		opts:             opts,
+		redactionRules:   redactionRules,
+		claimCheckSecret: claimCheckSecret,
+		usage:            &usageRecorder{},
+		seenSets:         &seenSets{},
+		deliveryLimiter:  deliveryLimiter,
+		readScheduler:    newReadScheduler(opts.ReadConcurrency),
+		writeSlots:       newWriteSlots(opts.WriteConcurrency, opts.WriteQueueSize),
+		prunes:           &pruneTracker{},
+		readAhead:        newReadAhead(opts.ReadAheadSize),
+		clock:            clock,
+		cipher:           encryption,
+		load:             &loadMeter{},
+	}
 
-		uuids := make([]string, len(events))
-		for i := range events {
-			id, err := uuid.NewV6()
+	r := mux.NewRouter()
+
+	r.Methods("GET").Path("/consumers").HandlerFunc(s.listConsumers)
+	r.Methods("PUT").Path("/consumers/{name}/cursor").HandlerFunc(s.updateConsumerCursor)
+	r.Methods("DELETE").Path("/consumers/{name}").HandlerFunc(s.deleteConsumer)
+	r.Methods("POST").Path("/producers/{name}/sessions").HandlerFunc(s.registerProducer)
+	r.Methods("DELETE").Path("/producers/{name}").HandlerFunc(s.deleteProducer)
+	r.Methods("PUT").Path("/consumers/{name}/heartbeat").HandlerFunc(s.consumerHeartbeat)
+	r.Methods("POST").Path("/consumers/{name}/transactions").HandlerFunc(s.commitTransaction)
+	r.Methods("GET").Path("/payloads/{id}").HandlerFunc(compressResponses(s.getPayload))
+	r.Methods("POST").Path("/events/get").HandlerFunc(compressResponses(s.getEvents))
+	r.Methods("POST").Path("/topics/{topic}/events/get").HandlerFunc(compressResponses(s.getEvents))
+	r.Methods("GET").Path("/events/stream").HandlerFunc(compressResponses(s.streamEvents))
+	r.Methods("GET").Path("/topics/{topic}/events/stream").HandlerFunc(compressResponses(s.streamEvents))
+	r.Methods("GET").Path("/ws").HandlerFunc(s.serveWebSocket)
+	r.Methods("GET").Path("/topics/{topic}/ws").HandlerFunc(s.serveWebSocket)
+	r.Methods("GET").Path("/events/{id}").HandlerFunc(compressResponses(s.getEvent))
+	r.Methods("POST").Path("/seen-sets").HandlerFunc(s.createSeenSet)
+	r.Methods("DELETE").Path("/seen-sets/{id}").HandlerFunc(s.deleteSeenSet)
+	r.Methods("GET").Path("/topics").HandlerFunc(s.listTopics)
+	r.Methods("PUT").Path("/topics/{topic}").HandlerFunc(s.putTopic)
+	r.Methods("GET").Path("/topics/{topic}").HandlerFunc(s.getTopic)
+	r.Methods("DELETE").Path("/topics/{topic}").HandlerFunc(s.deleteTopic)
+	r.Methods("GET").Path("/peers").HandlerFunc(s.listPeers)
+	r.Methods("GET").Path("/load").HandlerFunc(s.serveLoad)
+
+	// publish appends the events of the request in one transaction, batch
+	// publishes respond with the ids and sequence numbers assigned to them
+	publish := func(batch bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+
+			log := log.WithValues("method", r.Method, "path", r.URL.Path, "client", opts.TrustedProxies.ClientIP(r))
+
+			st, err := s.requestStream(r)
 			if err != nil {
-				log.Error(err, "could not generate UUID")
-				http.Error(w, fmt.Errorf("could not generate UUID: %w", err).Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), streamErrorStatus(err))
 				return
 			}
-			uuids[i] = id.String()
-		}
 
-		err = bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
-			for i, ev := range events {
-				tx.Put(eventsPath.Append(uuids[i]), ev)
+			release, ok := s.acquireWriteSlot(w, r)
+			if !ok {
+				return
 			}
-			return nil
-		})
+			defer release()
 
-		if err != nil {
-			log.Error(err, "could not store events")
-			http.Error(w, fmt.Errorf("could not store events: %w", err).Error(), http.StatusInternalServerError)
-			return
-		}
+			body, err := s.requestBody(r)
+			if err != nil {
+				http.Error(w, fmt.Errorf("could not read request: %w", err).Error(), decodeErrorStatus(err))
+				return
+			}
+			defer body.Close()
 
-		w.WriteHeader(http.StatusOK)
+			var pr *publishRequest
+			if opts.CloudEvents {
+				pr, err = readCloudEventsRequest(r, body)
+			} else {
+				pr, err = readPublishRequest(body)
+			}
+			if err != nil {
+				log.Error(err, "could not decode request")
+				http.Error(w, fmt.Errorf("could not decode request: %w", err).Error(), decodeErrorStatus(err))
+				return
+			}
+			defer pr.release()
+			events := pr.events
+
+			key, err := s.idempotencyKey(r, events)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			pw, err := producerWriteOf(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			ids, first, stored, err := s.appendBatchOnce(r.Context(), st, events, key, pw)
+			if err != nil {
+				log.Error(err, "could not append events")
+				http.Error(w, err.Error(), streamErrorStatus(err))
+				return
+			}
+
+			// retries get the batch stored by the first request
+			if stored != nil {
+				w.Header().Set(idempotentReplayHeader, "true")
+				if !batch {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				w.Header().Set("content-type", "application/json")
+				json.NewEncoder(w).Encode(stored)
+				return
+			}
+
+			s.recordPublished(r, events)
+
+			if !batch {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(newBatchRange(ids, first))
+
+		}
+	}
+	r.Methods("POST").Path("/events").HandlerFunc(publish(false))
+	r.Methods("POST").Path("/topics/{topic}/events").HandlerFunc(publish(false))
+	r.Methods("POST").Path("/events/batch").HandlerFunc(publish(true))
+	r.Methods("POST").Path("/topics/{topic}/events/batch").HandlerFunc(publish(true))
 
-	})
 	const maxLimit = 1000
 
-	r.Methods("GET").Path("/events").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log := log.WithValues("method", r.Method, "path", r.URL.Path)
+	poll := func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		log := log.WithValues("method", r.Method, "path", r.URL.Path, "client", opts.TrustedProxies.ClientIP(r))
+
+		st, err := s.requestStream(r)
+		if err != nil {
+			http.Error(w, err.Error(), streamErrorStatus(err))
+			return
+		}
 
 		q := r.URL.Query()
 
@@ -105,6 +483,56 @@ func New(log logr.Logger, db bolted.Database) (*Server, error) {
 
 		after := q.Get("after")
 
+		// from_time starts at the first event stored at or after it
+		if fromTime := q.Get("from_time"); fromTime != "" {
+			if after != "" || sort != sortAsc {
+				http.Error(w, "from_time can't be combined with after or a descending sort", http.StatusBadRequest)
+				return
+			}
+			t, err := time.Parse(time.RFC3339Nano, fromTime)
+			if err != nil {
+				http.Error(w, fmt.Errorf("invalid from_time value: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+			after = s.timeCursor(t)
+		}
+
+		envelope, err := parseEnvelope(r, opts.CloudEvents)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		delivery := q.Get("delivery")
+		if delivery != "" && delivery != deliveryClaimCheck {
+			http.Error(w, fmt.Errorf("invalid delivery value: %s", delivery).Error(), http.StatusBadRequest)
+			return
+		}
+
+		// payload URLs of claim checks reference events of the buffer
+		if delivery == deliveryClaimCheck && st.topic != "" {
+			http.Error(w, "claim check delivery is not supported for topics", http.StatusBadRequest)
+			return
+		}
+
+		var seen *seenSet
+		if id := q.Get("skip-seen"); id != "" {
+			seen = s.seenSets.get(id)
+			if seen == nil {
+				http.Error(w, fmt.Sprintf("seen set %s not found", id), http.StatusNotFound)
+				return
+			}
+		}
+
+		filter, err := parseEventFilter(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ruleIndexes := s.deliveryRuleIndexes(r)
+		redactions := s.deliveryRedactions(r)
+
 		limit := 100
 		limitString := q.Get("limit")
 		if limitString != "" {
@@ -122,15 +550,122 @@ func New(log logr.Logger, db bolted.Database) (*Server, error) {
 			limit = int(limit64)
 		}
 
-		changes, done := db.Observe(eventsPath.ToMatcher().AppendAnyElementMatcher())
+		if traceID := q.Get("trace_id"); traceID != "" {
+			s.pollTrace(w, r, st, envelope, traceID, after, limit)
+			return
+		}
+
+		// the binary content mode has room for one event
+		if envelope == envelopeCloudEventsBinary {
+			limit = 1
+		}
+
+		// with an archive, pruned events are read from it further down
+		if after != "" && (opts.ArchiveStore == nil || sort == sortDesc) {
+			expired, err := s.cursorExpired(st, after)
+			if err != nil {
+				log.Error(err, "could not check cursor")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if expired != nil {
+				w.Header().Set("content-type", "application/json")
+				w.WriteHeader(http.StatusGone)
+				json.NewEncoder(w).Encode(expired)
+				return
+			}
+		}
+
+		changes, done := db.Observe(st.events.ToMatcher().AppendAnyElementMatcher())
 		defer done()
-		events := []event{}
+		events := make([]event, 0, limit)
+		head := ""
+		// scanned is the last event looked at, skipped counts the events
+		// of the seen set and filtered those not matching the filter
+		scanned := ""
+		skipped := 0
+		filtered := 0
+
+		timeout := defaultPollWait
+		// with wait, polls time out with an empty list instead of a 408,
+		// a wait of zero doesn't block at all
+		wait := q.Has("wait")
+		if wait {
+			timeout, err = parsePollWait(q.Get("wait"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 
-		timeout := time.Second * 20
+		// a poll without waiting still needs time for its read
+		readTimeout := timeout
+		if readTimeout == 0 {
+			readTimeout = defaultPollWait
+		}
 
-		ctx, done := context.WithTimeout(r.Context(), timeout)
+		ctx, done := context.WithTimeout(r.Context(), readTimeout)
 		defer done()
 
+		// maxBytes limits the payload bytes of rate limited consumers, -1
+		// means unlimited
+		maxBytes := int64(-1)
+		size := 0
+		bucket := s.deliveryLimiter.bucket(r)
+		if bucket != nil {
+			var maxEvents int
+			maxEvents, maxBytes, err = bucket.wait(ctx)
+			switch {
+			case disconnected(ctx) != nil:
+				observeDisconnectedPoll(started)
+				return
+			case err != nil && !wait:
+				http.Error(w, "request timed out waiting for the delivery rate limit", http.StatusRequestTimeout)
+				return
+			case err != nil:
+				// the wait ended before the budget allowed delivering an
+				// event
+				observePoll(started, 0)
+				err = writePoll(w, envelope, nil)
+				if err != nil {
+					log.Error(err, "could not write events")
+				}
+				return
+			}
+			if maxEvents >= 0 && maxEvents < limit {
+				limit = maxEvents
+			}
+		}
+
+		// consumers reading forward in full batches get their next batch
+		// prefetched, filters and rate limits read differently
+		readAhead := s.readAhead.enabled() && sort == sortAsc && seen == nil && filter == nil && delivery == "" && bucket == nil
+		readLimit := limit
+
+		// polls after pruned events start with the archived ones and
+		// continue with the buffer
+		if after != "" && opts.ArchiveStore != nil && sort == sortAsc {
+			archived, prunedUntil, err := s.readArchive(ctx, st, after, limit)
+			if err != nil {
+				log.Error(err, "could not read archive")
+				http.Error(w, fmt.Errorf("could not read archive: %w", err).Error(), http.StatusInternalServerError)
+				return
+			}
+			if prunedUntil != "" {
+				if seen != nil || filter != nil || delivery != "" {
+					http.Error(w, "seen sets, filters and claim checks are not supported for archived events", http.StatusBadRequest)
+					return
+				}
+				events = append(events, archived...)
+				for _, e := range archived {
+					size += len(e.payload)
+				}
+				after = prunedUntil
+				readAhead = false
+			}
+		}
+
 		for ctx.Err() == nil {
 
 			select {
@@ -139,28 +674,113 @@ func New(log logr.Logger, db bolted.Database) (*Server, error) {
 				continue
 			}
 
-			err := bolted.SugaredRead(db, func(tx bolted.SugaredReadTx) error {
-				it := tx.Iterator(eventsPath)
-				if after != "" {
-					it.Seek(after)
-					if sort == sortAsc && !it.IsDone() && it.GetKey() == after {
-						it.Next()
-					} else if sort == "desc" && !it.IsDone() && it.GetKey() == after {
-						it.Prev()
+			var prefetched []event
+			if readAhead {
+				var found bool
+				prefetched, found = s.readAhead.take(ctx, st.topic, after, limit)
+				if found && prefetched != nil {
+					readAheadPolls.WithLabelValues("hit").Inc()
+				} else if found {
+					readAheadPolls.WithLabelValues("miss").Inc()
+				}
+			}
+
+			release, contended, err := s.readScheduler.acquire(ctx, s.readerKey(r))
+			if err != nil {
+				continue
+			}
+
+			readLimit = limit
+			if contended && readLimit > fairShareLimit && prefetched == nil {
+				readLimit = fairShareLimit
+			}
+
+			readStarted := time.Now()
+			_, span := tracer.Start(ctx, "bolted.read poll", trace.WithAttributes(streamAttribute(st)))
+			err = bolted.SugaredRead(db, func(tx bolted.SugaredReadTx) error {
+				head = headPosition(tx, st.events)
+				if prefetched != nil {
+					events = append(events, prefetched...)
+				}
+				it := tx.Iterator(st.events)
+				seekAfter(it, after, sort)
+				for prefetched == nil && !it.IsDone() && len(events) < readLimit && skipped+filtered < maxSkippedEvents && (maxBytes < 0 || len(events) == 0 || int64(size) < maxBytes) {
+					if err := disconnected(ctx); err != nil {
+						return err
+					}
+
+					scanned = it.GetKey()
+					if seen != nil && seen.mayContain(it.GetKey()) {
+						skipped++
+						advance(it, sort)
+						continue
 					}
+
+					var payload json.RawMessage
+					var err error
+					if filter != nil || delivery != deliveryClaimCheck {
+						payload, err = s.loadPayload(ctx, tx, it.GetValue())
+						if err != nil {
+							return fmt.Errorf("could not load event %s: %w", it.GetKey(), err)
+						}
+					}
+
+					if filter != nil {
+						matched, err := filter.matches(payload, redactions)
+						if err != nil {
+							return fmt.Errorf("could not filter event %s: %w", it.GetKey(), err)
+						}
+						if !matched {
+							filtered++
+							advance(it, sort)
+							continue
+						}
+					}
+
+					if delivery == deliveryClaimCheck {
+						payload, err = s.claimCheckPayload(ctx, r, it.GetKey(), it.GetValue(), ruleIndexes)
+						if err != nil {
+							return fmt.Errorf("could not load event %s: %w", it.GetKey(), err)
+						}
+					}
+					events = append(events, event{id: it.GetKey(), payload: payload})
+					size += len(payload)
+					advance(it, sort)
 				}
-				switch sort {
-				case sortAsc:
-					for ; !it.IsDone() && len(events) < limit; it.Next() {
-						events = append(events, event{it.GetKey(), it.GetValue()})
+
+				if len(redactions) > 0 && delivery != deliveryClaimCheck {
+					for i, e := range events {
+						p, err := redactPayload(e.payload, redactions)
+						if err != nil {
+							return fmt.Errorf("could not redact event %s: %w", e.id, err)
+						}
+						events[i].payload = p
 					}
-				case sortDesc:
-					for ; !it.IsDone() && len(events) < limit; it.Prev() {
-						events = append(events, event{it.GetKey(), it.GetValue()})
+				}
+
+				retention := s.retentionPeriod(st)
+				if retention == 0 || envelope != envelopeFull {
+					return nil
+				}
+
+				for i, e := range events {
+					t, err := eventTime(e.id)
+					if err != nil {
+						return err
 					}
+					events[i].expires = t.Add(retention)
 				}
+
 				return nil
 			})
+			release()
+			span.SetAttributes(attribute.Int("event_buffer.events", len(events)))
+			endSpan(span, err)
+			pollReadDuration.Observe(time.Since(readStarted).Seconds())
+
+			if disconnected(ctx) != nil {
+				break
+			}
 
 			if err != nil {
 				log.Error(err, "could not read events: %w", err)
@@ -168,33 +788,141 @@ func New(log logr.Logger, db bolted.Database) (*Server, error) {
 				return
 			}
 
-			if len(events) > 0 {
+			if len(events) > 0 || skipped > 0 || timeout == 0 || filtered >= maxSkippedEvents {
 				break
 			}
+
+			if filtered > 0 {
+				// none of the events so far matched, wait for the next
+				after = scanned
+				filtered = 0
+			}
+		}
+
+		// filtered polls that time out have still moved past the events
+		// they looked at
+		if filter != nil && scanned != "" {
+			w.Header().Set(scannedHeader, scanned)
 		}
 
-		if ctx.Err() == context.DeadlineExceeded {
+		if ctx.Err() == context.DeadlineExceeded && !wait {
 			log.Error(err, "request timed out")
 			http.Error(w, fmt.Errorf("request timed out: %w", err).Error(), http.StatusRequestTimeout)
 			return
 		}
 
-		if ctx.Err() != nil {
-			log.Error(err, "request context cancelled")
-			http.Error(w, fmt.Errorf("request context cancelled: %w", err).Error(), http.StatusInternalServerError)
+		// nobody is left to respond to, disconnects are counted instead of
+		// logged
+		if disconnected(ctx) != nil {
+			observeDisconnectedPoll(started)
 			return
 		}
 
-		w.Header().Set("content-type", "application/json")
-		json.NewEncoder(w).Encode(events)
+		s.recordConsumed(r, events)
+		if bucket != nil {
+			bucket.take(len(events), size)
+		}
 
-	})
+		if readAhead && len(events) == readLimit {
+			last := events[len(events)-1].id
+			e := s.readAhead.next(s.readerKey(r), st.topic, after, last, readLimit)
+			if e != nil {
+				go s.prefetch(s.readerKey(r), st, e)
+			}
+		}
+
+		if envelope != envelopeLean {
+			setHeadHeaders(w, head)
+		}
+		if seen != nil {
+			w.Header().Set(scannedHeader, scanned)
+		}
+		observePoll(started, len(events))
+		err = writePoll(w, envelope, events)
+		if err != nil {
+			log.Error(err, "could not write events")
+		}
 
-	prometheus.Register(newStatsCollector(db, log))
+	}
+	r.Methods("GET").Path("/events").HandlerFunc(compressResponses(poll))
+	r.Methods("GET").Path("/topics/{topic}/events").HandlerFunc(compressResponses(poll))
+
+	prometheus.Register(newStatsCollector(db, log, opts.TopicMetrics, opts.PayloadLog))
+	prometheus.Register(integrityProblems)
+	prometheus.Register(integrityChecked)
+	prometheus.Register(integrityLastCheck)
+	prometheus.Register(writeBackpressure)
+	prometheus.Register(writeRejected)
+	prometheus.Register(staleEventsRejected)
+	prometheus.Register(clockSkews)
+	prometheus.Register(trimmedEvents)
+	prometheus.Register(archivedEvents)
+	prometheus.Register(duplicatePublishes)
+	prometheus.Register(readAheadPolls)
+	prometheus.Register(httpRequests)
+	prometheus.Register(httpRequestDuration)
+	prometheus.Register(pollDuration)
+	prometheus.Register(pollReadDuration)
+	prometheus.Register(lastPruneDuration)
+	prometheus.Register(lastPruneTime)
+	prometheus.Register(pruneErrors)
+	prometheus.Register(pruneNotificationErrors)
+	prometheus.Register(txWait)
+	prometheus.Register(txDuration)
+	prometheus.Register(readSlotWait)
+	prometheus.Register(loadCollector{s: s})
+
+	r.Use(instrumentRoutes, s.load.trackConnections)
+	s.Handler = r
+
+	return s, nil
+}
+
+// writePoll writes the events of a poll in the envelope.
+func writePoll(w http.ResponseWriter, envelope string, events []event) error {
+	switch {
+	case envelope == envelopeCloudEventsBinary && len(events) == 0:
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case envelope == envelopeCloudEventsBinary:
+		return writeBinaryCloudEvent(w, events[0])
+	case envelope == envelopeCloudEvents:
+		w.Header().Set("content-type", cloudEventsBatchContentType)
+		return writeCloudEvents(w, events)
+	default:
+		w.Header().Set("content-type", "application/json")
+		return writeEvents(w, events)
+	}
+}
 
-	return &Server{
-		Handler: r,
-		db:      db,
-		log:     log,
-	}, nil
+// seekAfter moves it to the first event after the cursor in sort order,
+// or to the first event when the cursor is empty.
+func seekAfter(it bolted.SugaredIterator, after, sort string) {
+	switch {
+	case after != "" && sort == sortAsc:
+		it.Seek(after)
+		if !it.IsDone() && it.GetKey() == after {
+			it.Next()
+		}
+	case after != "" && sort == sortDesc:
+		// Seek lands on the first event at or past the cursor
+		it.Seek(after)
+		if it.IsDone() {
+			it.Last()
+		} else if it.GetKey() >= after {
+			it.Prev()
+		}
+	case sort == sortDesc:
+		it.Last()
+	}
+}
+
+// advance moves it to the next event in sort order.
+func advance(it bolted.SugaredIterator, sort string) {
+	switch sort {
+	case sortAsc:
+		it.Next()
+	case sortDesc:
+		it.Prev()
+	}
 }
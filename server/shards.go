@@ -0,0 +1,574 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"go.etcd.io/bbolt"
+)
+
+// stateShardsPath holds the number of shards the topics of the state are
+// spread across, it is missing in states that are not sharded.
+var stateShardsPath = dbpath.ToPath("state-shards")
+
+var errShardedDump = errors.New("a sharded state can't be dumped as one file")
+
+// ShardTopics spreads the topics of a state across shards, each topic is
+// stored in the shard its name hashes to and only its configuration stays
+// in main together with the default stream and all other state. Topics are
+// assigned by the number of shards, so a state has to be opened with the
+// same shards in the same order every time.
+//
+// Changes of a transaction are committed to each state separately, a crash
+// during a commit can leave a change spanning a topic and the main state
+// half applied. Transactions only touching topics are committed without
+// holding up writers of other shards.
+func ShardTopics(main bolted.Database, shards ...bolted.Database) (bolted.Database, error) {
+	if len(shards) == 0 {
+		return main, nil
+	}
+
+	err := bolted.SugaredWrite(main, func(tx bolted.SugaredWriteTx) error {
+		if tx.Exists(stateShardsPath) {
+			n := binary.BigEndian.Uint64(tx.Get(stateShardsPath))
+			if n != uint64(len(shards)) {
+				return fmt.Errorf("state is sharded across %d files, %d given", n, len(shards))
+			}
+			return nil
+		}
+
+		// topics of an unsharded state are stored in it, they would be
+		// looked up in the shards
+		if tx.Exists(topicsPath) && tx.Size(topicsPath) > 0 {
+			return errors.New("topics of an existing state can't be moved to shards")
+		}
+
+		tx.Put(stateShardsPath, binary.BigEndian.AppendUint64(nil, uint64(len(shards))))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not shard state: %w", err)
+	}
+
+	return &shardedDB{main: main, shards: shards}, nil
+}
+
+type shardedDB struct {
+	main   bolted.Database
+	shards []bolted.Database
+}
+
+// shardOf returns the shard storing path or -1 for paths of the main
+// state.
+func (d *shardedDB) shardOf(path dbpath.Path) int {
+	if len(path) < 3 || !topicsPath.IsPrefixOf(path) || path[2] == "config" {
+		return -1
+	}
+	return d.topicShard(path[1])
+}
+
+func (d *shardedDB) topicShard(topic string) int {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return int(h.Sum32() % uint32(len(d.shards)))
+}
+
+func (d *shardedDB) BeginWrite() (bolted.WriteTx, error) {
+	tx, err := d.main.BeginWrite()
+	if err != nil {
+		return nil, err
+	}
+	return &shardedWriteTx{
+		d:        d,
+		main:     tx,
+		shards:   make([]bolted.WriteTx, len(d.shards)),
+		prepared: map[string]bool{},
+	}, nil
+}
+
+func (d *shardedDB) BeginRead() (bolted.ReadTx, error) {
+	tx, err := d.main.BeginRead()
+	if err != nil {
+		return nil, err
+	}
+	return &shardedReadTx{d: d, main: tx, shards: make([]bolted.ReadTx, len(d.shards))}, nil
+}
+
+// Observe merges the changes of the main state and all shards.
+func (d *shardedDB) Observe(m dbpath.Matcher) (<-chan bolted.ObservedChanges, func()) {
+	out := make(chan bolted.ObservedChanges, 1)
+	stop := make(chan struct{})
+	dbs := append([]bolted.Database{d.main}, d.shards...)
+
+	wg := &sync.WaitGroup{}
+	dones := make([]func(), len(dbs))
+	for i, db := range dbs {
+		var changes <-chan bolted.ObservedChanges
+		changes, dones[i] = db.Observe(m)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case ch, ok := <-changes:
+					if !ok {
+						return
+					}
+					select {
+					case out <- ch:
+					case <-stop:
+						return
+					}
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	var once sync.Once
+	return out, func() {
+		once.Do(func() {
+			close(stop)
+			for _, done := range dones {
+				done()
+			}
+		})
+	}
+}
+
+func (d *shardedDB) Close() error {
+	var first error
+	for _, db := range append([]bolted.Database{d.main}, d.shards...) {
+		err := db.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Stats returns the statistics of the main state.
+func (d *shardedDB) Stats() (*bbolt.Stats, error) {
+	return d.main.Stats()
+}
+
+type shardedReadTx struct {
+	d      *shardedDB
+	main   bolted.ReadTx
+	shards []bolted.ReadTx
+}
+
+func (tx *shardedReadTx) route(path dbpath.Path) (bolted.ReadTx, error) {
+	i := tx.d.shardOf(path)
+	if i < 0 {
+		return tx.main, nil
+	}
+	return tx.shard(i)
+}
+
+func (tx *shardedReadTx) shard(i int) (bolted.ReadTx, error) {
+	if tx.shards[i] == nil {
+		stx, err := tx.d.shards[i].BeginRead()
+		if err != nil {
+			return nil, fmt.Errorf("could not read shard %d: %w", i, err)
+		}
+		tx.shards[i] = stx
+	}
+	return tx.shards[i], nil
+}
+
+func (tx *shardedReadTx) Get(path dbpath.Path) ([]byte, error) {
+	r, err := tx.route(path)
+	if err != nil {
+		return nil, err
+	}
+	return r.Get(path)
+}
+
+func (tx *shardedReadTx) Iterator(path dbpath.Path) (bolted.Iterator, error) {
+	r, err := tx.route(path)
+	if err != nil {
+		return nil, err
+	}
+	return r.Iterator(path)
+}
+
+func (tx *shardedReadTx) Exists(path dbpath.Path) (bool, error) {
+	r, err := tx.route(path)
+	if err != nil {
+		return false, err
+	}
+	return r.Exists(path)
+}
+
+func (tx *shardedReadTx) IsMap(path dbpath.Path) (bool, error) {
+	r, err := tx.route(path)
+	if err != nil {
+		return false, err
+	}
+	return r.IsMap(path)
+}
+
+func (tx *shardedReadTx) Size(path dbpath.Path) (uint64, error) {
+	r, err := tx.route(path)
+	if err != nil {
+		return 0, err
+	}
+	return r.Size(path)
+}
+
+func (tx *shardedReadTx) ID() (uint64, error) {
+	return tx.main.ID()
+}
+
+func (tx *shardedReadTx) Dump(w io.Writer) (int64, error) {
+	return 0, errShardedDump
+}
+
+// FileSize returns the size of the main state and all shards.
+func (tx *shardedReadTx) FileSize() (int64, error) {
+	return fileSize(tx.main, len(tx.shards), func(i int) (bolted.ReadTx, error) {
+		return tx.shard(i)
+	})
+}
+
+func (tx *shardedReadTx) Finish() error {
+	var first error
+	for _, stx := range append([]bolted.ReadTx{tx.main}, tx.shards...) {
+		if stx == nil {
+			continue
+		}
+		err := stx.Finish()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// fileSize returns the size of the main state and all shards.
+func fileSize(main bolted.ReadTx, shards int, shard func(i int) (bolted.ReadTx, error)) (int64, error) {
+	size, err := main.FileSize()
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < shards; i++ {
+		stx, err := shard(i)
+		if err != nil {
+			return 0, err
+		}
+		s, err := stx.FileSize()
+		if err != nil {
+			return 0, err
+		}
+		size += s
+	}
+	return size, nil
+}
+
+// shardedWriteTx begins write transactions of shards when a topic stored
+// in them is accessed. The main transaction is always begun first and
+// shards are only begun while holding it, so transactions can't wait on
+// each other in a cycle.
+type shardedWriteTx struct {
+	d      *shardedDB
+	main   bolted.WriteTx
+	shards []bolted.WriteTx
+	// prepared holds the topics with maps in their shard
+	prepared    map[string]bool
+	mainChanged bool
+	rolledBack  bool
+	fillPercent float64
+}
+
+func (tx *shardedWriteTx) shard(i int) (bolted.WriteTx, error) {
+	if tx.shards[i] == nil {
+		stx, err := tx.d.shards[i].BeginWrite()
+		if err != nil {
+			return nil, fmt.Errorf("could not write shard %d: %w", i, err)
+		}
+		if tx.fillPercent != 0 {
+			err = stx.SetFillPercent(tx.fillPercent)
+			if err != nil {
+				stx.Rollback()
+				stx.Finish()
+				return nil, err
+			}
+		}
+		tx.shards[i] = stx
+	}
+	return tx.shards[i], nil
+}
+
+func (tx *shardedWriteTx) route(path dbpath.Path) (bolted.WriteTx, error) {
+	i := tx.d.shardOf(path)
+	if i < 0 {
+		return tx.main, nil
+	}
+	return tx.shard(i)
+}
+
+// routeChange routes a change and creates the maps of its topic in the
+// shard, they only exist in the main state until the topic is changed.
+func (tx *shardedWriteTx) routeChange(path dbpath.Path) (bolted.WriteTx, error) {
+	i := tx.d.shardOf(path)
+	if i < 0 {
+		tx.mainChanged = true
+		return tx.main, nil
+	}
+
+	stx, err := tx.shard(i)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := path[1]
+	if tx.prepared[topic] {
+		return stx, nil
+	}
+
+	for _, p := range []dbpath.Path{topicsPath, topicsPath.Append(topic)} {
+		exists, err := stx.Exists(p)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			err = stx.CreateMap(p)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	tx.prepared[topic] = true
+
+	return stx, nil
+}
+
+func (tx *shardedWriteTx) CreateMap(path dbpath.Path) error {
+	w, err := tx.routeChange(path)
+	if err != nil {
+		return err
+	}
+	return w.CreateMap(path)
+}
+
+func (tx *shardedWriteTx) Put(path dbpath.Path, value []byte) error {
+	w, err := tx.routeChange(path)
+	if err != nil {
+		return err
+	}
+	return w.Put(path, value)
+}
+
+// Delete removes path, deleting a topic or all topics removes them from
+// the shards as well.
+func (tx *shardedWriteTx) Delete(path dbpath.Path) error {
+	w, err := tx.routeChange(path)
+	if err != nil {
+		return err
+	}
+	err = w.Delete(path)
+	if err != nil {
+		return err
+	}
+
+	if tx.d.shardOf(path) >= 0 || !topicsPath.IsPrefixOf(path) || len(path) > 2 {
+		return nil
+	}
+
+	shards := []int{}
+	if len(path) == 2 {
+		shards = append(shards, tx.d.topicShard(path[1]))
+	} else {
+		for i := range tx.d.shards {
+			shards = append(shards, i)
+		}
+	}
+
+	for _, i := range shards {
+		stx, err := tx.shard(i)
+		if err != nil {
+			return err
+		}
+		exists, err := stx.Exists(path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		err = stx.Delete(path)
+		if err != nil {
+			return err
+		}
+	}
+	if len(path) == 2 {
+		delete(tx.prepared, path[1])
+	} else {
+		tx.prepared = map[string]bool{}
+	}
+
+	return nil
+}
+
+func (tx *shardedWriteTx) SetFillPercent(fillPercent float64) error {
+	err := tx.main.SetFillPercent(fillPercent)
+	if err != nil {
+		return err
+	}
+	for _, stx := range tx.shards {
+		if stx == nil {
+			continue
+		}
+		err = stx.SetFillPercent(fillPercent)
+		if err != nil {
+			return err
+		}
+	}
+	tx.fillPercent = fillPercent
+	return nil
+}
+
+func (tx *shardedWriteTx) Rollback() error {
+	tx.rolledBack = true
+	var first error
+	for _, stx := range append([]bolted.WriteTx{tx.main}, tx.shards...) {
+		if stx == nil {
+			continue
+		}
+		err := stx.Rollback()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Finish commits the shards before the main state, a topic created in a
+// failed commit is left without its configuration and stays invisible.
+// Unchanged main transactions are rolled back first, so other writers can
+// go on while the shards are committed.
+func (tx *shardedWriteTx) Finish() error {
+	if tx.rolledBack {
+		return tx.finish()
+	}
+
+	if !tx.mainChanged {
+		err := tx.main.Rollback()
+		if err != nil {
+			tx.Rollback()
+			tx.finish()
+			return err
+		}
+		// finishing releases wrappers of the main state, the rolled back
+		// transaction itself can't be finished again
+		tx.main.Finish()
+		tx.main = nil
+	}
+
+	for i, stx := range tx.shards {
+		if stx == nil {
+			continue
+		}
+		tx.shards[i] = nil
+		err := stx.Finish()
+		if err != nil {
+			// the remaining shards are rolled back, so only committed
+			// shards differ from the main state
+			tx.Rollback()
+			tx.finish()
+			return fmt.Errorf("could not commit shard %d: %w", i, err)
+		}
+	}
+
+	if tx.mainChanged {
+		return tx.main.Finish()
+	}
+	return nil
+}
+
+// finish ends the transactions that were not committed or ended yet.
+func (tx *shardedWriteTx) finish() error {
+	var first error
+	if tx.main != nil {
+		first = tx.main.Finish()
+		tx.main = nil
+	}
+	for i, stx := range tx.shards {
+		if stx == nil {
+			continue
+		}
+		tx.shards[i] = nil
+		err := stx.Finish()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (tx *shardedWriteTx) Get(path dbpath.Path) ([]byte, error) {
+	r, err := tx.route(path)
+	if err != nil {
+		return nil, err
+	}
+	return r.Get(path)
+}
+
+func (tx *shardedWriteTx) Iterator(path dbpath.Path) (bolted.Iterator, error) {
+	r, err := tx.route(path)
+	if err != nil {
+		return nil, err
+	}
+	return r.Iterator(path)
+}
+
+func (tx *shardedWriteTx) Exists(path dbpath.Path) (bool, error) {
+	r, err := tx.route(path)
+	if err != nil {
+		return false, err
+	}
+	return r.Exists(path)
+}
+
+func (tx *shardedWriteTx) IsMap(path dbpath.Path) (bool, error) {
+	r, err := tx.route(path)
+	if err != nil {
+		return false, err
+	}
+	return r.IsMap(path)
+}
+
+func (tx *shardedWriteTx) Size(path dbpath.Path) (uint64, error) {
+	r, err := tx.route(path)
+	if err != nil {
+		return 0, err
+	}
+	return r.Size(path)
+}
+
+func (tx *shardedWriteTx) ID() (uint64, error) {
+	return tx.main.ID()
+}
+
+func (tx *shardedWriteTx) Dump(w io.Writer) (int64, error) {
+	return 0, errShardedDump
+}
+
+func (tx *shardedWriteTx) FileSize() (int64, error) {
+	return fileSize(tx.main, len(tx.shards), func(i int) (bolted.ReadTx, error) {
+		return tx.shard(i)
+	})
+}
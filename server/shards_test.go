@@ -0,0 +1,53 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server/testrig"
+	"github.com/go-logr/logr"
+)
+
+func aBufferWithItsTopicsShardedAcrossFiles(ctx context.Context, shards int) error {
+	s := getState(ctx)
+	serverURL, srv, dbs, err := testrig.StartShardedServer(ctx, logr.FromContextOrDiscard(ctx), shards)
+	if err != nil {
+		return fmt.Errorf("could not start server: %w", err)
+	}
+
+	cl, err := client.New(serverURL)
+	if err != nil {
+		return fmt.Errorf("could not create client: %w", err)
+	}
+
+	s.serverBaseURL = serverURL
+	s.client = cl
+	s.server = srv
+	s.shards = dbs
+	return nil
+}
+
+func theTopicsShouldEachBeStoredInOneShard(ctx context.Context, first, second string) error {
+	for _, topic := range []string{first, second} {
+		events := dbpath.ToPath("topics", topic, "events")
+		found := 0
+		for _, db := range getState(ctx).shards {
+			err := bolted.SugaredRead(db, func(tx bolted.SugaredReadTx) error {
+				if tx.Exists(events) && tx.Size(events) == 1 {
+					found++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if found != 1 {
+			return fmt.Errorf("expected the event of topic %s in one shard, found it in %d", topic, found)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/draganm/bolted"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// storedBytesPath counts the bytes of the payloads stored in the state
+// and the payload log, shared payloads are counted once. Offloaded
+// payloads are not stored locally and not counted.
+var storedBytesPath = metaPath.Append("stored-bytes")
+
+var trimmedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "event_buffer_trimmed_events_total",
+	Help: "Number of events pruned before their retention period to keep the buffer within its size budget.",
+}, []string{"budget"})
+
+func addStoredBytes(tx bolted.SugaredWriteTx, n int) {
+	stored := int64(getCounter(tx, storedBytesPath)) + int64(n)
+	if stored < 0 {
+		stored = 0
+	}
+	tx.Put(storedBytesPath, binary.BigEndian.AppendUint64(nil, uint64(stored)))
+}
+
+// initStoredBytes counts the payloads of a state created before the bytes
+// were counted.
+func initStoredBytes(tx bolted.SugaredWriteTx) error {
+	if tx.Exists(storedBytesPath) {
+		return nil
+	}
+
+	topics, err := readTopics(tx)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, st := range append([]stream{defaultStream}, topics...) {
+		for it := tx.Iterator(st.events); !it.IsDone(); it.Next() {
+			r, isRecord, err := decodeRecord(it.GetValue())
+			if err != nil {
+				return err
+			}
+			switch {
+			case !isRecord:
+				n += len(it.GetValue())
+			case r.Log != nil:
+				n += r.Log.Length
+			}
+		}
+	}
+	for it := tx.Iterator(blobsPath); !it.IsDone(); it.Next() {
+		n += len(it.GetValue())
+	}
+
+	addStoredBytes(tx, n)
+	return nil
+}
+
+// totalEvents returns the number of events of all streams.
+func totalEvents(tx bolted.SugaredReadTx, streams []stream) uint64 {
+	n := uint64(0)
+	for _, st := range streams {
+		n += getCounter(tx, st.appended) - getCounter(tx, st.pruned)
+	}
+	return n
+}
+
+// overBudget returns the budget the buffer exceeds, if any.
+func (s Server) overBudget(tx bolted.SugaredReadTx, streams []stream) string {
+	if s.opts.MaxBufferEvents > 0 && totalEvents(tx, streams) > s.opts.MaxBufferEvents {
+		return "events"
+	}
+	if s.opts.MaxBufferBytes > 0 && getCounter(tx, storedBytesPath) > s.opts.MaxBufferBytes {
+		return "bytes"
+	}
+	return ""
+}
+
+// trimToBudget prunes the oldest events of all streams until the buffer
+// is within MaxBufferEvents and MaxBufferBytes. The budgets protect the
+// disk, they apply regardless of retention periods and consumers. The
+// removed events are added to ps.
+func (s Server) trimToBudget(ctx context.Context, streams []stream, ps *PruneStatus) error {
+	if s.opts.MaxBufferEvents == 0 && s.opts.MaxBufferBytes == 0 {
+		return nil
+	}
+
+	if s.opts.ArchiveStore != nil {
+		err := s.archiveForTrim(ctx, streams, ps)
+		if err != nil {
+			return err
+		}
+	}
+
+	trimmed := map[string]int{}
+	defer func() {
+		for topic, n := range trimmed {
+			s.readAhead.drop(topic)
+			s.log.Info("trimmed events to the size budget", "count", n, "topic", topic)
+		}
+	}()
+
+	for {
+		n, objects, err := s.trimBatch(ctx, streams, trimmed, ps)
+		if err != nil {
+			return err
+		}
+		s.deleteObjects(objects)
+		if n < pruneBatchSize {
+			return nil
+		}
+	}
+}
+
+// trimBatch prunes up to pruneBatchSize of the oldest events of all
+// streams in one transaction, while the buffer exceeds its budget. The
+// events pruned of each topic are added to trimmed and ps, the keys of
+// their offloaded payloads are returned.
+func (s Server) trimBatch(ctx context.Context, streams []stream, trimmed map[string]int, ps *PruneStatus) (int, []string, error) {
+	objects := []string{}
+	deleted := 0
+	freed := uint64(0)
+	ranges := []PrunedRange{}
+	topics := map[string]int{}
+	budgets := map[string]int{}
+	_, span := tracer.Start(ctx, "bolted.write trim")
+	err := bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		if s.overBudget(tx, streams) == "" {
+			return nil
+		}
+
+		stored := getCounter(tx, storedBytesPath)
+		defer func() {
+			freed = stored - getCounter(tx, storedBytesPath)
+		}()
+
+		// ids of all streams are taken from one clock, merging the
+		// streams by id removes the oldest events first
+		type candidate struct {
+			st stream
+			id string
+		}
+		candidates := []candidate{}
+		its := make([]bolted.SugaredIterator, len(streams))
+		for i, st := range streams {
+			its[i] = tx.Iterator(st.events)
+		}
+		for len(candidates) < pruneBatchSize {
+			next := -1
+			for i, it := range its {
+				if !it.IsDone() && (next < 0 || it.GetKey() < its[next].GetKey()) {
+					next = i
+				}
+			}
+			if next < 0 {
+				break
+			}
+			candidates = append(candidates, candidate{st: streams[next], id: its[next].GetKey()})
+			its[next].Next()
+		}
+
+		archived := map[string]string{}
+		for _, st := range streams {
+			archived[st.topic] = archivedUntil(tx, st)
+		}
+
+		for _, c := range candidates {
+			budget := s.overBudget(tx, streams)
+			if budget == "" {
+				break
+			}
+			// the later events of the stream were not archived either
+			if s.opts.ArchiveStore != nil && c.id > archived[c.st.topic] {
+				continue
+			}
+			object, err := deleteEvent(tx, c.st.events, c.id)
+			if err != nil {
+				return err
+			}
+			if object != "" {
+				objects = append(objects, object)
+			}
+			if topics[c.st.topic] == 0 {
+				ranges = append(ranges, PrunedRange{Topic: c.st.topic, FirstID: c.id, FirstSequence: getCounter(tx, c.st.pruned) + 1})
+			}
+			for i := range ranges {
+				if ranges[i].Topic == c.st.topic {
+					ranges[i].Count++
+					ranges[i].LastID = c.id
+				}
+			}
+			tx.Put(c.st.prunedUntil, []byte(c.id))
+			addCounter(tx, c.st.pruned, 1)
+			budgets[budget]++
+			topics[c.st.topic]++
+			deleted++
+		}
+		return nil
+	})
+	span.SetAttributes(attribute.Int("event_buffer.events", deleted))
+	endSpan(span, err)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, r := range ranges {
+		ps.addRange(r.Topic, r.FirstID, r.LastID, r.FirstSequence, r.Count)
+	}
+	ps.Bytes += freed
+	for budget, n := range budgets {
+		trimmedEvents.WithLabelValues(budget).Add(float64(n))
+	}
+	for topic, n := range topics {
+		trimmed[topic] += n
+	}
+	return deleted, objects, nil
+}
+
+// archiveForTrim archives all events of the streams while the buffer
+// exceeds its budget, the events a trim removes are only known while it
+// removes them. The archived events are added to ps.
+func (s Server) archiveForTrim(ctx context.Context, streams []stream, ps *PruneStatus) error {
+	heads := map[string]string{}
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		if s.overBudget(tx, streams) == "" {
+			return nil
+		}
+		for _, st := range streams {
+			heads[st.topic] = headPosition(tx, st.events)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, st := range streams {
+		head, found := heads[st.topic]
+		if !found {
+			continue
+		}
+		n, err := s.archiveStream(ctx, st, head)
+		ps.Archived += n
+		if err != nil {
+			return fmt.Errorf("could not archive events: %w", err)
+		}
+	}
+	return nil
+}
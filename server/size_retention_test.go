@@ -0,0 +1,35 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferHoldingAtMostEvents(ctx context.Context, n int) error {
+	return startBuffer(ctx, server.Options{MaxBufferEvents: uint64(n)})
+}
+
+func aBufferHoldingAtMostBytesOfPayloads(ctx context.Context, n int) error {
+	return startBuffer(ctx, server.Options{MaxBufferBytes: uint64(n)})
+}
+
+func theBufferShouldStoreBytesOfPayloads(ctx context.Context, expected int) error {
+	st, err := getState(ctx).server.Stats()
+	if err != nil {
+		return err
+	}
+	if st.StoredBytes != uint64(expected) {
+		return fmt.Errorf("expected %d stored bytes, got %d", expected, st.StoredBytes)
+	}
+	return nil
+}
+
+func thePruneShouldReportRemovedEventsAndReclaimedBytes(ctx context.Context, events, bytes int) error {
+	ps := getState(ctx).pruneStatus
+	if ps.Events != events || ps.Bytes != uint64(bytes) {
+		return fmt.Errorf("expected %d removed events and %d reclaimed bytes, got %d and %d", events, bytes, ps.Events, ps.Bytes)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/draganm/bolted"
+)
+
+// streamHeartbeatInterval is how often idle streams send a comment, so
+// proxies don't close the connection.
+const streamHeartbeatInterval = 15 * time.Second
+
+// maxStreamBatch is the number of events read from storage at once.
+const maxStreamBatch = 1000
+
+// streamEvents sends events as Server-Sent Events. Events after the id
+// passed as from, or the Last-Event-ID header of reconnecting clients, are
+// sent first, then events as they are appended. Without either, all
+// buffered events are sent. Each event is sent with its id and payload.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+
+	st, err := s.requestStream(r)
+	if err != nil {
+		http.Error(w, err.Error(), streamErrorStatus(err))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	after := r.URL.Query().Get("from")
+	if after == "" {
+		after = r.Header.Get("Last-Event-ID")
+	}
+
+	if after != "" {
+		expired, err := s.cursorExpired(st, after)
+		if err != nil {
+			log.Error(err, "could not check cursor")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if expired != nil {
+			w.Header().Set("content-type", "application/json")
+			w.WriteHeader(http.StatusGone)
+			json.NewEncoder(w).Encode(expired)
+			return
+		}
+	}
+
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	envelope, err := parseEnvelope(r, s.opts.CloudEvents)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if envelope == envelopeCloudEventsBinary {
+		http.Error(w, "streams carry events in the structured content mode, use the cloudevents envelope", http.StatusBadRequest)
+		return
+	}
+
+	redactions := s.deliveryRedactions(r)
+	bucket := s.deliveryLimiter.bucket(r)
+
+	changes, done := s.db.Observe(st.events.ToMatcher().AppendAnyElementMatcher())
+	defer done()
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	// nginx buffers responses otherwise
+	w.Header().Set("x-accel-buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	ctx := r.Context()
+
+	// more is true while the last read may have left events behind
+	more := true
+	for {
+		if !more {
+			select {
+			case <-changes:
+			case <-heartbeat.C:
+				_, err = fmt.Fprint(w, ": heartbeat\n\n")
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		limit := maxStreamBatch
+		maxBytes := int64(-1)
+		if bucket != nil {
+			var maxEvents int
+			maxEvents, maxBytes, err = bucket.wait(ctx)
+			if err != nil {
+				return
+			}
+			if maxEvents >= 0 && maxEvents < limit {
+				limit = maxEvents
+			}
+		}
+
+		release, _, err := s.readScheduler.acquire(ctx, s.readerKey(r))
+		if err != nil {
+			return
+		}
+
+		events, scanned, size, err := s.readStreamEvents(ctx, st, after, sortAsc, limit, maxBytes, redactions, filter)
+		release()
+
+		if disconnected(ctx) != nil {
+			return
+		}
+
+		if err != nil {
+			log.Error(err, "could not read events")
+			fmt.Fprintf(w, "event: error\ndata: could not read events: %s\n\n", oneLine(err.Error()))
+			flusher.Flush()
+			return
+		}
+
+		more = scanned != ""
+		if !more {
+			continue
+		}
+
+		after = scanned
+		if len(events) == 0 {
+			continue
+		}
+
+		s.recordConsumed(r, events)
+		if bucket != nil {
+			bucket.take(len(events), size)
+		}
+
+		buf := &bytes.Buffer{}
+		for _, e := range events {
+			payload := e.payload
+			if envelope == envelopeCloudEvents {
+				payload, err = withBufferID(e)
+				if err != nil {
+					log.Error(err, "could not add the buffer id", "id", e.id)
+					return
+				}
+			}
+
+			buf.WriteString("id: " + e.id + "\ndata: ")
+			// data fields end at a newline
+			err = json.Compact(buf, payload)
+			if err != nil {
+				log.Error(err, "could not compact payload", "id", e.id)
+				return
+			}
+			buf.WriteString("\n\n")
+		}
+
+		_, err = w.Write(buf.Bytes())
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+
+		heartbeat.Reset(streamHeartbeatInterval)
+	}
+}
+
+// readStreamEvents reads up to limit events of a stream after the id after
+// in sort order, and returns them with the id of the last event looked at
+// and the size of their payloads. Events not matching filter are skipped,
+// at most maxSkippedEvents of them.
+func (s *Server) readStreamEvents(ctx context.Context, st stream, after, sort string, limit int, maxBytes int64, redactions []compiledRedactionRule, filter *eventFilter) ([]event, string, int, error) {
+	events := []event{}
+	scanned := ""
+	filtered := 0
+	size := 0
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		it := tx.Iterator(st.events)
+		seekAfter(it, after, sort)
+
+		for ; !it.IsDone() && len(events) < limit && filtered < maxSkippedEvents && (maxBytes < 0 || len(events) == 0 || int64(size) < maxBytes); advance(it, sort) {
+			if err := disconnected(ctx); err != nil {
+				return err
+			}
+
+			scanned = it.GetKey()
+			payload, err := s.loadPayload(ctx, tx, it.GetValue())
+			if err != nil {
+				return fmt.Errorf("could not load event %s: %w", it.GetKey(), err)
+			}
+
+			if filter != nil {
+				matched, err := filter.matches(payload, redactions)
+				if err != nil {
+					return fmt.Errorf("could not filter event %s: %w", it.GetKey(), err)
+				}
+				if !matched {
+					filtered++
+					continue
+				}
+			}
+
+			if len(redactions) > 0 {
+				payload, err = redactPayload(payload, redactions)
+				if err != nil {
+					return fmt.Errorf("could not redact event %s: %w", it.GetKey(), err)
+				}
+			}
+
+			events = append(events, event{id: it.GetKey(), payload: payload})
+			size += len(payload)
+		}
+		return nil
+	})
+	return events, scanned, size, err
+}
+
+func oneLine(s string) string {
+	return strings.ReplaceAll(s, "\n", " ")
+}
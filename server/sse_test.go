@@ -0,0 +1,75 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func startStreaming(ctx context.Context, from string) {
+	s := getState(ctx)
+	s.streamed = make(chan string, 10)
+	go s.client.StreamEvents(ctx, from, func(id string, payload json.RawMessage) error {
+		var evt string
+		err := json.Unmarshal(payload, &evt)
+		if err != nil {
+			return err
+		}
+		s.streamed <- evt
+		return nil
+	})
+}
+
+func iStartStreamingTheEvents(ctx context.Context) error {
+	startStreaming(ctx, "")
+	return nil
+}
+
+func iStartStreamingTheEventsAfterThePreviousEvent(ctx context.Context) error {
+	startStreaming(ctx, getState(ctx).lastId)
+	return nil
+}
+
+func streamedEvents(ctx context.Context, n int) ([]string, error) {
+	s := getState(ctx)
+	evts := []string{}
+	timeout := time.After(5 * time.Second)
+	for len(evts) < n {
+		select {
+		case evt := <-s.streamed:
+			evts = append(evts, evt)
+		case <-timeout:
+			return nil, fmt.Errorf("expected %d streamed events, got %v", n, evts)
+		}
+	}
+	return evts, nil
+}
+
+func theStreamShouldDeliverAllThreeEvents(ctx context.Context) error {
+	evts, err := streamedEvents(ctx, 3)
+	if err != nil {
+		return err
+	}
+
+	d := cmp.Diff(evts, []string{"evt1", "evt2", "evt1"})
+	if d != "" {
+		return fmt.Errorf("unexpected stream result:\n%s", d)
+	}
+	return nil
+}
+
+func theStreamShouldDeliverOnlyTheOtherEvent(ctx context.Context) error {
+	evts, err := streamedEvents(ctx, 1)
+	if err != nil {
+		return err
+	}
+
+	d := cmp.Diff(evts, []string{"evt2"})
+	if d != "" {
+		return fmt.Errorf("unexpected stream result:\n%s", d)
+	}
+	return nil
+}
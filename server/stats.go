@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/draganm/bolted"
+)
+
+// Stats is an overview of the buffer, Oldest and Newest are empty when the
+// buffer holds no events. Events, Appended and Pruned count the events of
+// the buffer, Topics describes each topic. StoredBytes are the bytes of
+// the payloads of all streams, as measured against the byte budget.
+type Stats struct {
+	Events      uint64    `json:"events"`
+	Appended    uint64    `json:"appended"`
+	Pruned      uint64    `json:"pruned"`
+	StoredBytes uint64    `json:"stored_bytes"`
+	Consumers   int       `json:"consumers"`
+	Oldest      string    `json:"oldest,omitempty"`
+	Newest      string    `json:"newest,omitempty"`
+	Retention   string    `json:"retention,omitempty"`
+	Topics      []Topic   `json:"topics,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+func (s *Server) Stats() (Stats, error) {
+	st := Stats{Time: time.Now().UTC()}
+	if s.opts.RetentionPeriod > 0 {
+		st.Retention = s.opts.RetentionPeriod.String()
+	}
+
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		st.Appended = getCounter(tx, appendedPath)
+		st.Pruned = getCounter(tx, prunedPath)
+		st.Events = st.Appended - st.Pruned
+		st.StoredBytes = getCounter(tx, storedBytesPath)
+
+		for it := tx.Iterator(consumersPath); !it.IsDone(); it.Next() {
+			st.Consumers++
+		}
+
+		it := tx.Iterator(eventsPath)
+		it.First()
+		if !it.IsDone() {
+			st.Oldest = it.GetKey()
+		}
+		it.Last()
+		if !it.IsDone() {
+			st.Newest = it.GetKey()
+		}
+
+		topics, err := readTopics(tx)
+		if err != nil {
+			return err
+		}
+		for _, t := range topics {
+			st.Topics = append(st.Topics, describeTopic(tx, t))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return Stats{}, fmt.Errorf("could not read stats: %w", err)
+	}
+
+	return st, nil
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// blobsPath holds deduplicated payloads keyed by their sha256,
+	// blobRefsPath the number of events referencing each of them.
+	blobsPath    = dbpath.ToPath("blobs")
+	blobRefsPath = dbpath.ToPath("blob-refs")
+)
+
+// Values of events are either the raw JSON payload, a compressed payload
+// or, when they start with recordMarker, a JSON encoded storedRecord. JSON
+// never starts with a zero byte, so they can be told apart.
+const recordMarker = 0x00
+
+type storedRecord struct {
+	// Blob is the sha256 of a payload stored under blobsPath.
+	Blob string `json:"blob,omitempty"`
+	// Object is the key of a payload offloaded to the object store.
+	Object string `json:"object,omitempty"`
+	// Log is the location of a payload in the payload log.
+	Log *payloadRef `json:"log,omitempty"`
+}
+
+func encodeRecord(r storedRecord) ([]byte, error) {
+	d, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal record: %w", err)
+	}
+	return append([]byte{recordMarker}, d...), nil
+}
+
+func decodeRecord(value []byte) (storedRecord, bool, error) {
+	r := storedRecord{}
+	if len(value) == 0 || value[0] != recordMarker {
+		return r, false, nil
+	}
+
+	err := json.Unmarshal(value[1:], &r)
+	if err != nil {
+		return r, false, fmt.Errorf("could not unmarshal record: %w", err)
+	}
+
+	return r, true, nil
+}
+
+// storeEvent stores the payload of an event, payloads of at least
+// DedupMinSize bytes are stored once and shared by all events with the
+// same payload. Payloads of at least PayloadLogMinSize bytes are appended
+// to the payload log instead when it is configured. Payloads stored in the
+// database are compressed when PayloadCompression is set and encrypted
+// when EncryptionKeys are.
+func (s Server) storeEvent(tx bolted.SugaredWriteTx, events dbpath.Path, id string, payload []byte) error {
+	if s.shouldLog(payload) {
+		return s.storeLogged(tx, events, id, payload)
+	}
+
+	if s.opts.DedupMinSize <= 0 || len(payload) < s.opts.DedupMinSize {
+		v, err := s.encodePayload(payload)
+		if err != nil {
+			return err
+		}
+		tx.Put(events.Append(id), v)
+		addStoredBytes(tx, len(v))
+		return nil
+	}
+
+	hash := s.cipher.blobHash(payload)
+
+	refs := uint64(0)
+	refPath := blobRefsPath.Append(hash)
+	if tx.Exists(refPath) {
+		refs = binary.BigEndian.Uint64(tx.Get(refPath))
+	} else {
+		v, err := s.encodePayload(payload)
+		if err != nil {
+			return err
+		}
+		tx.Put(blobsPath.Append(hash), v)
+		addStoredBytes(tx, len(v))
+	}
+
+	tx.Put(refPath, binary.BigEndian.AppendUint64(nil, refs+1))
+
+	v, err := encodeRecord(storedRecord{Blob: hash})
+	if err != nil {
+		return err
+	}
+
+	tx.Put(events.Append(id), v)
+
+	return nil
+}
+
+// prepareEvents validates new events of a stream, generates their ids and offloads
+// their large payloads. This happens before the write transaction, so
+// uploads don't block other writers. Keys of offloaded payloads are
+// returned at the index of their event and have to be deleted if storing
+// fails.
+func (s Server) prepareEvents(ctx context.Context, st stream, events []json.RawMessage) ([]string, []string, error) {
+	err := s.validateEvents(events)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.checkPublishAge(st, events)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uuids := s.clock.newEventIDs(len(events))
+
+	objects := make([]string, len(events))
+	for i, ev := range events {
+		if !s.shouldOffload(ev) {
+			continue
+		}
+		key, err := s.offloadPayload(ctx, uuids[i], ev)
+		if err != nil {
+			s.deleteObjects(objects[:i])
+			return nil, nil, err
+		}
+		objects[i] = key
+	}
+
+	return uuids, objects, nil
+}
+
+// storeEvents stores events prepared by prepareEvents in a stream. Ids
+// are generated before the write transaction, when another publish
+// committed later ids in the meantime the events get new ids in place, so
+// ids of a stream always grow in the order events are stored.
+func (s Server) storeEvents(tx bolted.SugaredWriteTx, st stream, uuids, objects []string, events []json.RawMessage) error {
+	if len(uuids) > 0 && uuids[0] <= headPosition(tx, st.events) {
+		copy(uuids, s.clock.newEventIDs(len(uuids)))
+	}
+
+	for i, ev := range events {
+		if objects[i] != "" {
+			err := storeOffloaded(tx, st.events, uuids[i], objects[i])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := s.storeEvent(tx, st.events, uuids[i], ev)
+		if err != nil {
+			return err
+		}
+	}
+	addCounter(tx, st.appended, len(events))
+	return nil
+}
+
+// appendEvents prepares and stores events in a stream and returns their
+// ids.
+func (s Server) appendEvents(ctx context.Context, st stream, events []json.RawMessage) ([]string, error) {
+	ids, _, err := s.appendBatch(ctx, st, events)
+	return ids, err
+}
+
+// appendBatch is appendEvents that also returns the sequence number of the
+// first event. Events of a stream are numbered from 1 by its appended
+// counter, the events of one call are numbered consecutively as they are
+// stored in one transaction.
+func (s Server) appendBatch(ctx context.Context, st stream, events []json.RawMessage) ([]string, uint64, error) {
+	ids, first, _, err := s.appendBatchOnce(ctx, st, events, "", nil)
+	return ids, first, err
+}
+
+// appendBatchOnce is appendBatch for publishes with an idempotency key or
+// of a producer session. When a batch was stored for the key within the
+// idempotency window or for the sequence of the producer, the events are
+// not stored again and that batch is returned instead.
+func (s Server) appendBatchOnce(ctx context.Context, st stream, events []json.RawMessage, key string, pw *producerWrite) ([]string, uint64, *batchRange, error) {
+	if st.readOnly {
+		return nil, 0, nil, fmt.Errorf("%w: %s", errReadOnlyTopic, st.topic)
+	}
+
+	uuids, objects, err := s.prepareEvents(ctx, st, events)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("could not prepare events: %w", err)
+	}
+
+	var first uint64
+	var stored *batchRange
+	_, span := tracer.Start(ctx, "bolted.write append", trace.WithAttributes(streamAttribute(st), attribute.Int("event_buffer.events", len(events))))
+	err = bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) (err error) {
+		// the topic may have been deleted in the meantime
+		if !tx.Exists(st.events) {
+			return fmt.Errorf("%w: %s", ErrTopicNotFound, st.topic)
+		}
+		if pw != nil {
+			stored, err = checkProducerSequence(tx, *pw)
+			if err != nil || stored != nil {
+				return err
+			}
+		}
+		if key != "" {
+			b, err := s.storedBatch(tx, st, key)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				stored = &b.batchRange
+				return nil
+			}
+		}
+		first = getCounter(tx, st.appended) + 1
+		err = s.storeEvents(tx, st, uuids, objects, events)
+		if err != nil {
+			return err
+		}
+		s.storeTraceParents(ctx, tx, uuids)
+		br := newBatchRange(uuids, first)
+		if pw != nil {
+			err = storeProducerSequence(tx, *pw, br)
+			if err != nil {
+				return err
+			}
+		}
+		if key != "" {
+			return storeBatch(tx, st, key, br)
+		}
+		return nil
+	})
+	endSpan(span, err)
+
+	if err != nil {
+		s.deleteObjects(objects)
+		return nil, 0, nil, fmt.Errorf("could not store events: %w", err)
+	}
+
+	if stored != nil {
+		s.deleteObjects(objects)
+		duplicatePublishes.Inc()
+		return nil, 0, stored, nil
+	}
+
+	s.load.published(len(uuids))
+
+	return uuids, first, nil, nil
+}
+
+// shouldOffload returns true if the payload is stored in the object store
+// instead of the database.
+func (s Server) shouldOffload(payload []byte) bool {
+	return s.opts.OffloadStore != nil && s.opts.OffloadMinSize > 0 && len(payload) >= s.opts.OffloadMinSize
+}
+
+// offloadPayload uploads a payload to the object store, sealed when
+// EncryptionKeys are set. This happens before the write transaction, so
+// uploads don't block other writers.
+func (s Server) offloadPayload(ctx context.Context, id string, payload []byte) (string, error) {
+	key := path.Join("payloads", id)
+	sealed, err := s.sealPayload(payload)
+	if err != nil {
+		return "", err
+	}
+	err = s.opts.OffloadStore.Put(ctx, key, bytes.NewReader(sealed), int64(len(sealed)))
+	if err != nil {
+		return "", fmt.Errorf("could not offload payload of %s: %w", id, err)
+	}
+	return key, nil
+}
+
+func storeOffloaded(tx bolted.SugaredWriteTx, events dbpath.Path, id, object string) error {
+	v, err := encodeRecord(storedRecord{Object: object})
+	if err != nil {
+		return err
+	}
+	tx.Put(events.Append(id), v)
+	addOffloaded(tx, 1)
+	return nil
+}
+
+// offloadedPath counts the events with offloaded payloads.
+var offloadedPath = metaPath.Append("offloaded")
+
+func addOffloaded(tx bolted.SugaredWriteTx, n int) {
+	offloaded := int64(getCounter(tx, offloadedPath)) + int64(n)
+	if offloaded < 0 {
+		offloaded = 0
+	}
+	tx.Put(offloadedPath, binary.BigEndian.AppendUint64(nil, uint64(offloaded)))
+}
+
+// initOffloaded counts the offloaded payloads of a state created before
+// they were counted.
+func initOffloaded(tx bolted.SugaredWriteTx) error {
+	if tx.Exists(offloadedPath) {
+		return nil
+	}
+
+	topics, err := readTopics(tx)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, st := range append([]stream{defaultStream}, topics...) {
+		for it := tx.Iterator(st.events); !it.IsDone(); it.Next() {
+			r, isRecord, err := decodeRecord(it.GetValue())
+			if err != nil {
+				return err
+			}
+			if isRecord && r.Object != "" {
+				n++
+			}
+		}
+	}
+
+	addOffloaded(tx, n)
+	return nil
+}
+
+// warnAboutOffloaded logs events with offloaded payloads of a state that
+// is opened without an object store, their payloads can't be read and are
+// left behind when the events are deleted.
+func warnAboutOffloaded(log logr.Logger, db bolted.Database) error {
+	n := uint64(0)
+	err := bolted.SugaredRead(db, func(tx bolted.SugaredReadTx) error {
+		n = getCounter(tx, offloadedPath)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not count offloaded payloads: %w", err)
+	}
+	if n > 0 {
+		log.Info("payloads of events are offloaded, but no object store is configured, they can't be read and are left behind when the events are deleted", "events", n)
+	}
+	return nil
+}
+
+// deleteObjects removes offloaded payloads of deleted events, failures
+// only leave orphaned objects behind and are logged. Without an object
+// store the keys are logged, so the objects can be removed by hand.
+func (s Server) deleteObjects(keys []string) {
+	for _, k := range keys {
+		if k == "" {
+			continue
+		}
+		if s.opts.OffloadStore == nil {
+			s.log.Info("no object store is configured, offloaded payload is left behind", "key", k)
+			continue
+		}
+		err := s.opts.OffloadStore.Delete(context.Background(), k)
+		if err != nil {
+			s.log.Error(err, "could not delete offloaded payload", "key", k)
+		}
+	}
+}
+
+// loadPayload returns the payload of an event from its stored value,
+// offloaded payloads are fetched from the object store.
+func (s Server) loadPayload(ctx context.Context, tx bolted.SugaredReadTx, value []byte) (json.RawMessage, error) {
+	r, isRecord, err := decodeRecord(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isRecord {
+		return s.decodePayload(value)
+	}
+
+	if r.Blob != "" {
+		return s.decodePayload(tx.Get(blobsPath.Append(r.Blob)))
+	}
+
+	if r.Log != nil {
+		if s.opts.PayloadLog == nil {
+			return nil, fmt.Errorf("payload is in segment %d of the payload log, but no payload log is configured", r.Log.Segment)
+		}
+		v, err := s.opts.PayloadLog.read(*r.Log)
+		if err != nil {
+			return nil, err
+		}
+		return s.decodePayload(v)
+	}
+
+	if r.Object != "" {
+		if s.opts.OffloadStore == nil {
+			return nil, fmt.Errorf("payload is offloaded to %s, but no object store is configured", r.Object)
+		}
+
+		o, err := s.opts.OffloadStore.Get(ctx, r.Object)
+		if err != nil {
+			return nil, err
+		}
+
+		defer o.Close()
+
+		v, err := io.ReadAll(o)
+		if err != nil {
+			return nil, err
+		}
+		return s.decodePayload(v)
+	}
+
+	return nil, fmt.Errorf("record does not reference a payload")
+}
+
+// deleteEvent removes an event and releases its blob reference. The key of
+// an offloaded payload is returned, it has to be deleted once the
+// transaction is committed.
+func deleteEvent(tx bolted.SugaredWriteTx, events dbpath.Path, id string) (string, error) {
+	path := events.Append(id)
+
+	value := tx.Get(path)
+	r, isRecord, err := decodeRecord(value)
+	if err != nil {
+		return "", err
+	}
+
+	tx.Delete(path)
+
+	tpPath := traceParentsPath.Append(id)
+	if tx.Exists(tpPath) {
+		unindexTrace(tx, id, string(tx.Get(tpPath)))
+		tx.Delete(tpPath)
+	}
+
+	if !isRecord {
+		addStoredBytes(tx, -len(value))
+		return "", nil
+	}
+
+	if r.Object != "" {
+		addOffloaded(tx, -1)
+		return r.Object, nil
+	}
+
+	if r.Log != nil {
+		releaseLogged(tx, *r.Log)
+		addStoredBytes(tx, -r.Log.Length)
+		return "", nil
+	}
+
+	if r.Blob == "" {
+		return "", nil
+	}
+
+	refPath := blobRefsPath.Append(r.Blob)
+	if !tx.Exists(refPath) {
+		return "", nil
+	}
+
+	refs := binary.BigEndian.Uint64(tx.Get(refPath))
+	if refs <= 1 {
+		tx.Delete(refPath)
+		addStoredBytes(tx, -len(tx.Get(blobsPath.Append(r.Blob))))
+		tx.Delete(blobsPath.Append(r.Blob))
+		return "", nil
+	}
+
+	tx.Put(refPath, binary.BigEndian.AppendUint64(nil, refs-1))
+
+	return "", nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/gofrs/uuid"
+)
+
+// SystemTopic carries the lifecycle events of the server when
+// Options.SystemEvents is set. Consumers read it like any other topic,
+// only the server publishes to it.
+const SystemTopic = "_system"
+
+// Types of system events.
+const (
+	SystemEventStarted     = "event_buffer.started"
+	SystemEventStopped     = "event_buffer.stopped"
+	SystemEventPruned      = "event_buffer.pruned"
+	SystemEventCompacted   = "event_buffer.compacted"
+	SystemEventRelocated   = "event_buffer.relocated"
+	SystemEventRestored    = "event_buffer.restored"
+	SystemEventBackupTaken = "event_buffer.backup_taken"
+)
+
+// errReadOnlyTopic rejects publishes of clients to the system topic.
+var errReadOnlyTopic = errors.New("topic is read only")
+
+// systemEvent is a CloudEvent in the structured JSON format, so it is
+// readable in every content mode.
+type systemEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            any       `json:"data,omitempty"`
+}
+
+// initSystemTopic creates the system topic with the retention period of
+// the buffer, an existing topic keeps its configuration.
+func initSystemTopic(tx bolted.SugaredWriteTx, enabled bool) {
+	p := topicsPath.Append(SystemTopic)
+	if !enabled || tx.Exists(p) {
+		return
+	}
+	tx.CreateMap(p)
+	tx.CreateMap(p.Append("events"))
+	tx.Put(topicConfigPath(SystemTopic), []byte("{}"))
+}
+
+// PublishSystemEvent appends an event of the given type to the system
+// topic, data is its JSON encoded data. It does nothing unless
+// Options.SystemEvents is set.
+func (s Server) PublishSystemEvent(ctx context.Context, eventType string, data any) error {
+	if !s.opts.SystemEvents {
+		return nil
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Errorf("could not generate id: %w", err)
+	}
+
+	d, err := json.Marshal(systemEvent{
+		SpecVersion:     "1.0",
+		ID:              id.String(),
+		Source:          "event-buffer",
+		Type:            eventType,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal system event: %w", err)
+	}
+
+	st, err := s.namedStream(SystemTopic)
+	if err != nil {
+		return err
+	}
+	st.readOnly = false
+
+	_, err = s.appendEvents(ctx, st, []json.RawMessage{d})
+	return err
+}
+
+// publishPruned publishes the ranges removed by a prune. Prunes that only
+// removed system events are left out, they would keep the topic from ever
+// becoming empty.
+func (s Server) publishPruned(ps PruneStatus) {
+	for _, r := range ps.Ranges {
+		if r.Topic == SystemTopic {
+			continue
+		}
+		err := s.PublishSystemEvent(context.Background(), SystemEventPruned, ps)
+		if err != nil {
+			s.log.Error(err, "could not publish system event", "type", SystemEventPruned)
+		}
+		return
+	}
+}
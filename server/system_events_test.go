@@ -0,0 +1,61 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferPublishingSystemEvents(ctx context.Context) error {
+	return startBuffer(ctx, server.Options{SystemEvents: true})
+}
+
+func theSystemTopicShouldHoldAPruneOfRemovedEvents(ctx context.Context, expected int) error {
+	tc, err := topicClient(ctx, server.SystemTopic)
+	if err != nil {
+		return err
+	}
+
+	evts := []json.RawMessage{}
+	_, err = tc.PollForEvents(ctx, "", 10, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for system events: %w", err)
+	}
+
+	for _, e := range evts {
+		se := struct {
+			Type string             `json:"type"`
+			Data server.PruneStatus `json:"data"`
+		}{}
+		err = json.Unmarshal(e, &se)
+		if err != nil {
+			return err
+		}
+		if se.Type != server.SystemEventPruned {
+			continue
+		}
+		if se.Data.Events != expected {
+			return fmt.Errorf("expected a prune of %d events, got %d", expected, se.Data.Events)
+		}
+		return nil
+	}
+	return fmt.Errorf("expected a prune event, got %s", evts)
+}
+
+func publishingToTheSystemTopicShouldBeForbidden(ctx context.Context) error {
+	err := iSendAnEventToTheTopic(ctx, server.SystemTopic)
+	if err != nil {
+		return err
+	}
+	se := &client.StatusError{}
+	publishErr := getState(ctx).publishErr
+	if !errors.As(publishErr, &se) || se.StatusCode != http.StatusForbidden {
+		return fmt.Errorf("expected forbidden error, got %v", publishErr)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/event-buffer/auth"
+)
+
+const defaultTapFraction = 0.01
+
+// TappedEvent is an event sampled by the tap with all its metadata.
+type TappedEvent struct {
+	ID    string    `json:"id"`
+	Topic string    `json:"topic,omitempty"`
+	Time  time.Time `json:"time"`
+	// Expires is nil without a retention period.
+	Expires *time.Time `json:"expires,omitempty"`
+	Size    int        `json:"size"`
+	// Storage is inline, blob for deduplicated, offloaded for payloads in
+	// the object store or log for payloads in the payload log.
+	Storage string `json:"storage"`
+	// TraceParent is the traceparent header the event was published with.
+	TraceParent string          `json:"traceparent,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// Tap calls handle with a sampled fraction of the events appended to the
+// buffer, or to the topic when it's not empty, until ctx is cancelled or
+// handle fails. Tapped events are not accounted as consumed.
+func (s *Server) Tap(ctx context.Context, topic string, fraction float64, handle func(TappedEvent) error) error {
+	st := defaultStream
+	after := ""
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) (err error) {
+		if topic != "" {
+			st, err = readTopic(tx, topic)
+			if err != nil {
+				return err
+			}
+		}
+		after = headPosition(tx, st.events)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	changes, done := s.db.Observe(st.events.ToMatcher().AppendAnyElementMatcher())
+	defer done()
+
+	for {
+		select {
+		case <-changes:
+		case <-ctx.Done():
+			return nil
+		}
+
+		// keep reading while events are appended faster than they are read
+		for more := true; more; {
+			tapped := []TappedEvent{}
+			err = bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+				it := tx.Iterator(st.events)
+				if after != "" {
+					it.Seek(after)
+					if !it.IsDone() && it.GetKey() == after {
+						it.Next()
+					}
+				}
+
+				read := 0
+				for ; !it.IsDone() && read < maxStreamBatch; it.Next() {
+					read++
+					after = it.GetKey()
+					if rand.Float64() >= fraction {
+						continue
+					}
+
+					te, err := s.tappedEvent(ctx, tx, st, it.GetKey(), it.GetValue())
+					if err != nil {
+						return err
+					}
+					tapped = append(tapped, te)
+				}
+				more = read == maxStreamBatch
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("could not read events: %w", err)
+			}
+
+			for _, te := range tapped {
+				err = handle(te)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) tappedEvent(ctx context.Context, tx bolted.SugaredReadTx, st stream, id string, value []byte) (TappedEvent, error) {
+	t, err := eventTime(id)
+	if err != nil {
+		return TappedEvent{}, err
+	}
+
+	te := TappedEvent{ID: id, Topic: st.topic, Time: t.UTC(), Storage: "inline", TraceParent: traceParent(tx, id)}
+
+	if retention := s.retentionPeriod(st); retention > 0 {
+		expires := t.Add(retention).UTC()
+		te.Expires = &expires
+	}
+
+	r, isRecord, err := decodeRecord(value)
+	if err != nil {
+		return TappedEvent{}, err
+	}
+	switch {
+	case isRecord && r.Blob != "":
+		te.Storage = "blob"
+	case isRecord && r.Object != "":
+		te.Storage = "offloaded"
+	case isRecord && r.Log != nil:
+		te.Storage = "log"
+	}
+
+	te.Payload, err = s.loadPayload(ctx, tx, value)
+	if err != nil {
+		return TappedEvent{}, fmt.Errorf("could not load event %s: %w", id, err)
+	}
+	te.Size = len(te.Payload)
+
+	return te, nil
+}
+
+// ServeTap streams the events sampled by Tap as Server-Sent Events to
+// authenticated clients. The fraction query parameter sets the sampled
+// fraction, it defaults to 1%, topic taps a topic instead of the buffer.
+func (s *Server) ServeTap(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+
+	p, found := auth.FromContext(r.Context())
+	if !found {
+		http.Error(w, "the tap requires an authenticated client", http.StatusUnauthorized)
+		return
+	}
+
+	fraction := defaultTapFraction
+	if f := r.URL.Query().Get("fraction"); f != "" {
+		var err error
+		fraction, err = strconv.ParseFloat(f, 64)
+		if err != nil || fraction <= 0 || fraction > 1 {
+			http.Error(w, fmt.Sprintf("invalid fraction %q, expected a number in (0, 1]", f), http.StatusBadRequest)
+			return
+		}
+	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic != "" {
+		err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+			_, err := readTopic(tx, topic)
+			return err
+		})
+		if err != nil {
+			http.Error(w, err.Error(), streamErrorStatus(err))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	tapped := make(chan TappedEvent, 100)
+	tapErr := make(chan error, 1)
+	go func() {
+		tapErr <- s.Tap(ctx, topic, fraction, func(te TappedEvent) error {
+			select {
+			case tapped <- te:
+			default:
+				// the client doesn't keep up, sampling drops events anyway
+			}
+			return nil
+		})
+	}()
+
+	log.Info("tap started", "principal", p.Name, "fraction", fraction)
+	defer log.Info("tap stopped", "principal", p.Name)
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("x-accel-buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case te := <-tapped:
+			var d []byte
+			d, err = json.Marshal(te)
+			if err == nil {
+				_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", te.ID, d)
+			}
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case err = <-tapErr:
+			if err != nil {
+				log.Error(err, "tap failed")
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", oneLine(err.Error()))
+				flusher.Flush()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
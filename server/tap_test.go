@@ -0,0 +1,46 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+func iTapAllEvents(ctx context.Context) error {
+	s := getState(ctx)
+	s.tapped = make(chan server.TappedEvent, 10)
+	go s.server.Tap(ctx, "", 1, func(te server.TappedEvent) error {
+		s.tapped <- te
+		return nil
+	})
+	// the tap starts at the head of the buffer
+	time.Sleep(50 * time.Millisecond)
+	return nil
+}
+
+func theTapShouldReceiveOnlyTheNewEvent(ctx context.Context) error {
+	s := getState(ctx)
+	select {
+	case te := <-s.tapped:
+		var evt string
+		err := json.Unmarshal(te.Payload, &evt)
+		if err != nil {
+			return err
+		}
+		if evt != "evt1" || te.Storage != "inline" || te.Size != len(te.Payload) {
+			return fmt.Errorf("unexpected tapped event %+v", te)
+		}
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("no event tapped")
+	}
+
+	select {
+	case te := <-s.tapped:
+		return fmt.Errorf("unexpected second tapped event %+v", te)
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+}
@@ -6,26 +6,147 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync"
 
+	"github.com/draganm/bolted"
 	"github.com/draganm/bolted/embedded"
 	"github.com/draganm/event-buffer/server"
 	"github.com/go-logr/logr"
 )
 
-func StartServer(ctx context.Context, log logr.Logger) (string, error) {
+func StartServer(ctx context.Context, log logr.Logger) (string, *server.Server, error) {
+	return StartServerWithOptions(ctx, log, server.Options{})
+}
+
+func StartServerWithOptions(ctx context.Context, log logr.Logger, opts server.Options) (string, *server.Server, error) {
+	td, err := os.MkdirTemp("", "")
+	if err != nil {
+		return "", nil, fmt.Errorf("could not create temp dir: %w", err)
+	}
+
+	db, err := embedded.Open(filepath.Join(td, "db"), 0700, embedded.Options{})
+	if err != nil {
+		return "", nil, fmt.Errorf("could not open db: %w", err)
+	}
+
+	server, err := server.New(log, db, opts)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not start server: %w", err)
+	}
+
+	hs := httptest.NewServer(server)
+
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+		db.Close()
+		os.RemoveAll(td)
+	}()
+
+	return hs.URL, server, nil
+}
+
+// StartServerWithStateFile starts a server on the state file at path, the
+// file is kept when ctx is done. Stop closes the server and the state
+// file, so tests can start another server on it.
+func StartServerWithStateFile(ctx context.Context, log logr.Logger, path string, opts server.Options) (serverURL string, srv *server.Server, stop func(), err error) {
+	db, err := embedded.Open(path, 0700, embedded.Options{})
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("could not open db: %w", err)
+	}
+
+	srv, err = server.New(log, db, opts)
+	if err != nil {
+		db.Close()
+		return "", nil, nil, fmt.Errorf("could not start server: %w", err)
+	}
+
+	hs := httptest.NewServer(srv)
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			hs.Close()
+			db.Close()
+		})
+	}
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	return hs.URL, srv, stop, nil
+}
+
+// StartServerWithPayloadLog starts a server appending payloads of at least
+// minSize bytes to a payload log and returns its directory, so tests can
+// look at its segments.
+func StartServerWithPayloadLog(ctx context.Context, log logr.Logger, minSize int, segmentSize int64) (string, *server.Server, string, error) {
 	td, err := os.MkdirTemp("", "")
 	if err != nil {
-		return "", fmt.Errorf("could not create temp dir: %w", err)
+		return "", nil, "", fmt.Errorf("could not create temp dir: %w", err)
 	}
 
 	db, err := embedded.Open(filepath.Join(td, "db"), 0700, embedded.Options{})
 	if err != nil {
-		return "", fmt.Errorf("could not open db: %w", err)
+		return "", nil, "", fmt.Errorf("could not open db: %w", err)
+	}
+
+	logDir := filepath.Join(td, "payloads")
+	pl, err := server.OpenPayloadLog(logDir, segmentSize)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	server, err := server.New(log, db, server.Options{PayloadLog: pl, PayloadLogMinSize: minSize})
+	if err != nil {
+		return "", nil, "", fmt.Errorf("could not start server: %w", err)
+	}
+
+	hs := httptest.NewServer(server)
+
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+		db.Close()
+		pl.Close()
+		os.RemoveAll(td)
+	}()
+
+	return hs.URL, server, logDir, nil
+}
+
+// StartShardedServer starts a server with its topics spread across shards
+// and returns the shard databases, so tests can look up where topics are
+// stored.
+func StartShardedServer(ctx context.Context, log logr.Logger, shards int) (string, *server.Server, []bolted.Database, error) {
+	td, err := os.MkdirTemp("", "")
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("could not create temp dir: %w", err)
+	}
+
+	main, err := embedded.Open(filepath.Join(td, "db"), 0700, embedded.Options{})
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("could not open db: %w", err)
+	}
+
+	shardDBs := []bolted.Database{}
+	for i := 0; i < shards; i++ {
+		shard, err := embedded.Open(filepath.Join(td, fmt.Sprintf("shard-%d", i)), 0700, embedded.Options{})
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("could not open shard: %w", err)
+		}
+		shardDBs = append(shardDBs, shard)
+	}
+
+	db, err := server.ShardTopics(main, shardDBs...)
+	if err != nil {
+		return "", nil, nil, err
 	}
 
-	server, err := server.New(log, db)
+	server, err := server.New(log, db, server.Options{})
 	if err != nil {
-		return "", fmt.Errorf("could not start server: %w", err)
+		return "", nil, nil, fmt.Errorf("could not start server: %w", err)
 	}
 
 	hs := httptest.NewServer(server)
@@ -37,5 +158,5 @@ func StartServer(ctx context.Context, log logr.Logger) (string, error) {
 		os.RemoveAll(td)
 	}()
 
-	return hs.URL, nil
+	return hs.URL, server, shardDBs, nil
 }
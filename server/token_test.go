@@ -0,0 +1,74 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+	"github.com/google/go-cmp/cmp"
+)
+
+func aBufferAcceptingTheTokensAnd(ctx context.Context, first, second string) error {
+	return startAuthenticatedBuffer(ctx, server.Options{}, first, second)
+}
+
+func iSendAnEventWithTheToken(ctx context.Context, token string) error {
+	s := getState(ctx)
+	cl, err := client.New(s.serverBaseURL, client.WithToken(token))
+	if err != nil {
+		return err
+	}
+	s.publishErr = cl.SendEvents(ctx, []any{"evt1"})
+	return s.publishErr
+}
+
+func pollingWithTheTokenShouldReturnTheEvent(ctx context.Context, token string) error {
+	s := getState(ctx)
+	cl, err := client.New(s.serverBaseURL, client.WithToken(token))
+	if err != nil {
+		return err
+	}
+
+	evts := []string{}
+	_, err = cl.PollForEvents(ctx, "", 10, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+
+	d := cmp.Diff(evts, []string{"evt1"})
+	if d != "" {
+		return fmt.Errorf("unexpected poll result:\n%s", d)
+	}
+	return nil
+}
+
+func sendingAnEventWithTheTokenShouldBeForbidden(ctx context.Context, token string) error {
+	s := getState(ctx)
+	cl, err := client.New(s.serverBaseURL, client.WithToken(token))
+	if err != nil {
+		return err
+	}
+
+	err = cl.SendEvents(ctx, []any{"evt2"})
+	se := &client.StatusError{}
+	if !errors.As(err, &se) || se.StatusCode != http.StatusForbidden {
+		return fmt.Errorf("expected the publish to be forbidden, got %v", err)
+	}
+	return nil
+}
+
+func pollingWithoutATokenShouldBeUnauthorized(ctx context.Context) error {
+	res, err := http.Get(getState(ctx).serverBaseURL + "/events")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("expected status 401, got %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/gorilla/mux"
+)
+
+// topicsPath holds a map for each topic with its events, configuration
+// and counters.
+var topicsPath = dbpath.ToPath("topics")
+
+var topicNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,128}$`)
+
+// ErrTopicNotFound is returned for topics that were never created.
+var ErrTopicNotFound = errors.New("topic not found")
+
+// stream is a sequence of events with its own ids, cursors, retention and
+// pruning. The buffer itself is the default stream, topics are further
+// streams published to and polled under /topics/{topic}/events.
+type stream struct {
+	// topic is empty for the default stream.
+	topic       string
+	events      dbpath.Path
+	prunedUntil dbpath.Path
+	appended    dbpath.Path
+	pruned      dbpath.Path
+	// archivedUntil holds the id of the newest archived event.
+	archivedUntil dbpath.Path
+	// walShipped holds the id of the newest event shipped to the WAL.
+	walShipped dbpath.Path
+	// idempotencyKeys maps the idempotency keys of publishes to their
+	// batches, idempotencyExpiry orders them by the time they were
+	// stored. Both are created with the first key.
+	idempotencyKeys   dbpath.Path
+	idempotencyExpiry dbpath.Path
+	// retention overrides the retention period of the buffer when set.
+	retention time.Duration
+	// readOnly rejects publishes of clients, see SystemTopic.
+	readOnly bool
+}
+
+var defaultStream = stream{
+	events:            eventsPath,
+	prunedUntil:       prunedUntilPath,
+	appended:          appendedPath,
+	pruned:            prunedPath,
+	archivedUntil:     metaPath.Append("archived-until"),
+	walShipped:        metaPath.Append("wal-shipped-until"),
+	idempotencyKeys:   dbpath.ToPath("idempotency-keys"),
+	idempotencyExpiry: dbpath.ToPath("idempotency-expiry"),
+}
+
+func topicStream(name string, retention time.Duration) stream {
+	p := topicsPath.Append(name)
+	return stream{
+		topic:             name,
+		events:            p.Append("events"),
+		prunedUntil:       p.Append("pruned-until"),
+		appended:          p.Append("appended"),
+		pruned:            p.Append("pruned"),
+		archivedUntil:     p.Append("archived-until"),
+		walShipped:        p.Append("wal-shipped-until"),
+		idempotencyKeys:   p.Append("idempotency-keys"),
+		idempotencyExpiry: p.Append("idempotency-expiry"),
+		retention:         retention,
+	}
+}
+
+// retentionPeriod returns the retention period of the events of a stream.
+func (s *Server) retentionPeriod(st stream) time.Duration {
+	if st.retention > 0 {
+		return st.retention
+	}
+	return s.opts.RetentionPeriod
+}
+
+type topicConfig struct {
+	RetentionPeriod string `json:"retention_period,omitempty"`
+}
+
+func topicConfigPath(name string) dbpath.Path {
+	return topicsPath.Append(name).Append("config")
+}
+
+// readTopic returns the stream of an existing topic.
+func readTopic(tx bolted.SugaredReadTx, name string) (stream, error) {
+	path := topicConfigPath(name)
+	if !topicNameRegexp.MatchString(name) || !tx.Exists(path) {
+		return stream{}, fmt.Errorf("%w: %s", ErrTopicNotFound, name)
+	}
+
+	cfg := topicConfig{}
+	err := json.Unmarshal(tx.Get(path), &cfg)
+	if err != nil {
+		return stream{}, fmt.Errorf("could not unmarshal config of topic %s: %w", name, err)
+	}
+
+	retention := time.Duration(0)
+	if cfg.RetentionPeriod != "" {
+		retention, err = time.ParseDuration(cfg.RetentionPeriod)
+		if err != nil {
+			return stream{}, fmt.Errorf("invalid retention period of topic %s: %w", name, err)
+		}
+	}
+
+	st := topicStream(name, retention)
+	st.readOnly = name == SystemTopic
+	return st, nil
+}
+
+func readTopics(tx bolted.SugaredReadTx) ([]stream, error) {
+	streams := []stream{}
+	for it := tx.Iterator(topicsPath); !it.IsDone(); it.Next() {
+		st, err := readTopic(tx, it.GetKey())
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, st)
+	}
+	return streams, nil
+}
+
+// requestStream returns the stream named by the topic of the request path,
+// or the default stream for paths without a topic.
+func (s *Server) requestStream(r *http.Request) (stream, error) {
+	return s.namedStream(mux.Vars(r)["topic"])
+}
+
+// namedStream returns the stream of a topic, or the default stream for an
+// empty name.
+func (s *Server) namedStream(name string) (stream, error) {
+	if name == "" {
+		return defaultStream, nil
+	}
+
+	var st stream
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) (err error) {
+		st, err = readTopic(tx, name)
+		return err
+	})
+	return st, err
+}
+
+// streamErrorStatus returns the status of a failure to resolve the stream
+// of a request.
+func streamErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTopicNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errInvalidCloudEvent), errors.Is(err, errInvalidOccurrence):
+		return http.StatusBadRequest
+	case errors.Is(err, errStaleEvent):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errReadOnlyTopic):
+		return http.StatusForbidden
+	case errors.Is(err, errProducerFenced):
+		return http.StatusConflict
+	case errors.Is(err, errSequenceOutOfOrder):
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusInternalServerError
+}
+
+// Topic describes a topic, RetentionPeriod is empty when the retention
+// period of the buffer applies.
+type Topic struct {
+	Name            string `json:"name"`
+	RetentionPeriod string `json:"retention_period,omitempty"`
+	Events          uint64 `json:"events"`
+	Newest          string `json:"newest,omitempty"`
+}
+
+func describeTopic(tx bolted.SugaredReadTx, st stream) Topic {
+	t := Topic{
+		Name:   st.topic,
+		Events: getCounter(tx, st.appended) - getCounter(tx, st.pruned),
+		Newest: headPosition(tx, st.events),
+	}
+	if st.retention > 0 {
+		t.RetentionPeriod = st.retention.String()
+	}
+	return t
+}
+
+// putTopic creates a topic or changes its retention period.
+func (s *Server) putTopic(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+	name := mux.Vars(r)["topic"]
+
+	if !topicNameRegexp.MatchString(name) {
+		http.Error(w, fmt.Sprintf("invalid topic name %q, names have up to 128 letters, digits, '.', '_' or '-'", name), http.StatusBadRequest)
+		return
+	}
+
+	// the retention period of the system topic can be changed
+	if name == SystemTopic && !s.opts.SystemEvents {
+		http.Error(w, fmt.Sprintf("topic name %q is reserved for system events", name), http.StatusBadRequest)
+		return
+	}
+
+	cfg := topicConfig{}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&cfg)
+		if err != nil {
+			http.Error(w, fmt.Errorf("could not decode request: %w", err).Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if cfg.RetentionPeriod != "" {
+		d, err := time.ParseDuration(cfg.RetentionPeriod)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid retention period %q", cfg.RetentionPeriod), http.StatusBadRequest)
+			return
+		}
+		cfg.RetentionPeriod = d.String()
+	}
+
+	d, err := json.Marshal(cfg)
+	if err != nil {
+		http.Error(w, fmt.Errorf("could not marshal topic config: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var t Topic
+	err = bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		p := topicsPath.Append(name)
+		if !tx.Exists(p) {
+			tx.CreateMap(p)
+			tx.CreateMap(p.Append("events"))
+		}
+		tx.Put(topicConfigPath(name), d)
+
+		st, err := readTopic(tx, name)
+		if err != nil {
+			return err
+		}
+		t = describeTopic(tx, st)
+		return nil
+	})
+
+	if err != nil {
+		log.Error(err, "could not store topic")
+		http.Error(w, fmt.Errorf("could not store topic: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+func (s *Server) listTopics(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+
+	topics := []Topic{}
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		streams, err := readTopics(tx)
+		if err != nil {
+			return err
+		}
+		for _, st := range streams {
+			topics = append(topics, describeTopic(tx, st))
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Error(err, "could not read topics")
+		http.Error(w, fmt.Errorf("could not read topics: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(topics)
+}
+
+func (s *Server) getTopic(w http.ResponseWriter, r *http.Request) {
+	var t Topic
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		st, err := readTopic(tx, mux.Vars(r)["topic"])
+		if err != nil {
+			return err
+		}
+		t = describeTopic(tx, st)
+		return nil
+	})
+
+	if err != nil {
+		http.Error(w, fmt.Errorf("could not read topic: %w", err).Error(), streamErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// deleteTopic removes a topic with all its events.
+func (s *Server) deleteTopic(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+
+	if mux.Vars(r)["topic"] == SystemTopic && s.opts.SystemEvents {
+		http.Error(w, "the system topic can't be deleted while system events are published", http.StatusForbidden)
+		return
+	}
+
+	objects := []string{}
+	err := bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		st, err := readTopic(tx, mux.Vars(r)["topic"])
+		if err != nil {
+			return err
+		}
+
+		ids := []string{}
+		for it := tx.Iterator(st.events); !it.IsDone(); it.Next() {
+			ids = append(ids, it.GetKey())
+		}
+
+		for _, id := range ids {
+			object, err := deleteEvent(tx, st.events, id)
+			if err != nil {
+				return err
+			}
+			if object != "" {
+				objects = append(objects, object)
+			}
+		}
+
+		tx.Delete(topicsPath.Append(st.topic))
+		return nil
+	})
+
+	if err != nil {
+		log.Error(err, "could not delete topic")
+		http.Error(w, fmt.Errorf("could not delete topic: %w", err).Error(), streamErrorStatus(err))
+		return
+	}
+
+	s.deleteObjects(objects)
+	s.sweepPayloadLog()
+	s.readAhead.drop(mux.Vars(r)["topic"])
+
+	w.WriteHeader(http.StatusNoContent)
+}
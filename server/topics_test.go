@@ -0,0 +1,203 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/draganm/event-buffer/client"
+	"github.com/draganm/event-buffer/server"
+	"github.com/google/go-cmp/cmp"
+)
+
+func topicClient(ctx context.Context, topic string) (*client.Client, error) {
+	return client.New(getState(ctx).serverBaseURL, client.WithTopic(topic))
+}
+
+func aTopic(ctx context.Context, topic string) error {
+	return getState(ctx).client.CreateTopic(ctx, topic, 0)
+}
+
+func aTopicWithARetentionPeriodOf(ctx context.Context, topic, retention string) error {
+	d, err := time.ParseDuration(retention)
+	if err != nil {
+		return err
+	}
+	return getState(ctx).client.CreateTopic(ctx, topic, d)
+}
+
+func iSendAnEventToTheTopic(ctx context.Context, topic string) error {
+	s := getState(ctx)
+	tc, err := topicClient(ctx, topic)
+	if err != nil {
+		return err
+	}
+	s.publishErr = tc.SendEvents(ctx, []any{"topic-evt"})
+	return nil
+}
+
+func pollingTheTopicShouldReturnOnlyItsEvent(ctx context.Context, topic string) error {
+	s := getState(ctx)
+	if s.publishErr != nil {
+		return s.publishErr
+	}
+
+	tc, err := topicClient(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	evts := []string{}
+	_, err = tc.PollForEvents(ctx, "", 10, sortAsc, &evts)
+	if err != nil {
+		return fmt.Errorf("failed polling for events: %w", err)
+	}
+
+	d := cmp.Diff(evts, []string{"topic-evt"})
+	if d != "" {
+		return fmt.Errorf("unexpected poll result:\n%s", d)
+	}
+	return nil
+}
+
+func thePublishShouldBeRejectedAsNotFound(ctx context.Context) error {
+	se := &client.StatusError{}
+	if !errors.As(getState(ctx).publishErr, &se) || se.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("expected not found error, got %v", getState(ctx).publishErr)
+	}
+	return nil
+}
+
+func theRetentionPeriodOfTheTopicHasPassed(ctx context.Context) error {
+	s := getState(ctx)
+	if s.publishErr != nil {
+		return s.publishErr
+	}
+	time.Sleep(10 * time.Millisecond)
+	// the buffer keeps its events for an hour
+	return s.server.Prune(time.Now().Add(-time.Hour))
+}
+
+func theTopicShouldHaveNoEvents(ctx context.Context, topic string) error {
+	tc, err := topicClient(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	evts := []string{}
+	ids, err := tc.PollForEvents(ctx, "", 10, sortAsc, &evts)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("expected no events, got %v, %v", ids, err)
+	}
+	return nil
+}
+
+func theBufferShouldStillHaveOneEvent(ctx context.Context) error {
+	st, err := getState(ctx).server.Stats()
+	if err != nil {
+		return err
+	}
+	if st.Events != 1 {
+		return fmt.Errorf("expected 1 event, got %d", st.Events)
+	}
+	return nil
+}
+
+func theTopicShouldHaveARetentionPeriodOf(ctx context.Context, topic, retention string) error {
+	res, err := http.Get(getState(ctx).serverBaseURL + "/topics/" + topic)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	t := server.Topic{}
+	err = json.NewDecoder(res.Body).Decode(&t)
+	if err != nil {
+		return err
+	}
+
+	if t.RetentionPeriod != retention {
+		return fmt.Errorf("expected retention period %q, got %q", retention, t.RetentionPeriod)
+	}
+	return nil
+}
+
+func theIntegrityCheckShouldReportAnUnreadablePayloadOfTheTopic(ctx context.Context, topic string) error {
+	report, err := getState(ctx).server.CheckIntegrity(ctx, "", "")
+	if err != nil {
+		return err
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Topic != topic || !strings.Contains(report.Problems[0].Problem, "unreadable payload") {
+		return fmt.Errorf("expected an unreadable payload of the topic %s, got %v", topic, report.Problems)
+	}
+	return nil
+}
+
+func theStatsShouldDescribeTheTopicWithEvents(ctx context.Context, topic string, n int) error {
+	stats, err := getState(ctx).server.Stats()
+	if err != nil {
+		return err
+	}
+	for _, t := range stats.Topics {
+		if t.Name != topic {
+			continue
+		}
+		if t.Events != uint64(n) {
+			return fmt.Errorf("expected %d events of the topic %s, got %d", n, topic, t.Events)
+		}
+		return nil
+	}
+	return fmt.Errorf("stats don't describe the topic %s: %+v", topic, stats.Topics)
+}
+
+func theTopicIsExportedAsABundle(ctx context.Context, topic string) error {
+	s := getState(ctx)
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	s.bundleKey = pub
+
+	buf := &bytes.Buffer{}
+	err = s.server.ExportBundle(buf, topic, "", key)
+	if err != nil {
+		return err
+	}
+	s.bundle = buf.Bytes()
+	return nil
+}
+
+func theBundleIsImportedIntoANewBufferWithTheTopic(ctx context.Context, topic string) error {
+	s := getState(ctx)
+	err := startBuffer(ctx, server.Options{})
+	if err != nil {
+		return err
+	}
+
+	err = s.client.CreateTopic(ctx, topic, 0)
+	if err != nil {
+		return err
+	}
+
+	m, _, err := s.server.ImportBundle(bytes.NewReader(s.bundle), []ed25519.PublicKey{s.bundleKey})
+	if err != nil {
+		return err
+	}
+	if m.Topic != topic {
+		return fmt.Errorf("expected a bundle of the topic %s, got %q", topic, m.Topic)
+	}
+	return nil
+}
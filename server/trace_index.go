@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+)
+
+// traceIndexPath indexes the events published with a traceparent by its
+// trace id. Keys are the trace id followed by the event id, trace ids
+// have a fixed length, so the events of a trace are next to each other.
+var traceIndexPath = dbpath.ToPath("trace-index")
+
+var traceIDRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// traceIDOf returns the trace id of a traceparent.
+func traceIDOf(traceParent string) string {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) < 2 || !traceIDRegexp.MatchString(parts[1]) {
+		return ""
+	}
+	return parts[1]
+}
+
+// putTraceParent stores the traceparent of an event and, with the trace
+// index enabled, indexes the event by its trace id.
+func (s Server) putTraceParent(tx bolted.SugaredWriteTx, id, traceParent string) {
+	tx.Put(traceParentsPath.Append(id), []byte(traceParent))
+	if !s.opts.TraceIndex {
+		return
+	}
+	if traceID := traceIDOf(traceParent); traceID != "" {
+		tx.Put(traceIndexPath.Append(traceID+id), nil)
+	}
+}
+
+// unindexTrace removes an event from the trace index, whether or not it
+// is enabled.
+func unindexTrace(tx bolted.SugaredWriteTx, id, traceParent string) {
+	traceID := traceIDOf(traceParent)
+	if traceID == "" || !tx.Exists(traceIndexPath) {
+		return
+	}
+	path := traceIndexPath.Append(traceID + id)
+	if tx.Exists(path) {
+		tx.Delete(path)
+	}
+}
+
+// initTraceIndex indexes the events published before the trace index was
+// enabled and drops the index once it is disabled, it would miss the
+// events published in the meantime.
+func initTraceIndex(tx bolted.SugaredWriteTx, enabled bool) {
+	exists := tx.Exists(traceIndexPath)
+	switch {
+	case enabled && !exists:
+		tx.CreateMap(traceIndexPath)
+		for it := tx.Iterator(traceParentsPath); !it.IsDone(); it.Next() {
+			if traceID := traceIDOf(string(it.GetValue())); traceID != "" {
+				tx.Put(traceIndexPath.Append(traceID+it.GetKey()), nil)
+			}
+		}
+	case !enabled && exists:
+		tx.Delete(traceIndexPath)
+	}
+}
+
+// pollTrace responds to polls with a trace_id with the events of the
+// stream published in that trace, in the order of their ids. after and
+// limit page through large traces, polls for traces don't wait for
+// events.
+func (s *Server) pollTrace(w http.ResponseWriter, r *http.Request, st stream, envelope string, traceID, after string, limit int) {
+	if !s.opts.TraceIndex {
+		http.Error(w, "the trace index is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	if !traceIDRegexp.MatchString(traceID) {
+		http.Error(w, fmt.Errorf("invalid trace id: %s", traceID).Error(), http.StatusBadRequest)
+		return
+	}
+
+	if envelope == envelopeCloudEventsBinary {
+		http.Error(w, "the binary content mode has room for one event, use the cloudevents envelope", http.StatusBadRequest)
+		return
+	}
+
+	ids := []string{}
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		it := tx.Iterator(traceIndexPath)
+		it.Seek(traceID + after)
+		for ; !it.IsDone() && len(ids) < limit; it.Next() {
+			key := it.GetKey()
+			if !strings.HasPrefix(key, traceID) {
+				break
+			}
+			id := strings.TrimPrefix(key, traceID)
+			// events of other streams are indexed as well
+			if id == after || !tx.Exists(st.events.Append(id)) {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Errorf("could not read trace index: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.serveEventsByID(w, r, st, envelope, ids)
+}
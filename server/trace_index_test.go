@@ -0,0 +1,72 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferStoringItsStateInAFile(ctx context.Context) error {
+	td, err := os.MkdirTemp("", "")
+	if err != nil {
+		return fmt.Errorf("could not create temp dir: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		os.RemoveAll(td)
+	}()
+
+	getState(ctx).stateFile = filepath.Join(td, "state")
+	return startBuffer(ctx, server.Options{})
+}
+
+func aBufferIndexingTraces(ctx context.Context) error {
+	err := aBufferStoringItsStateInAFile(ctx)
+	if err != nil {
+		return err
+	}
+	getState(ctx).stopServer()
+	return startBuffer(ctx, server.Options{TraceIndex: true})
+}
+
+func theBufferIsRestartedIndexingTraces(ctx context.Context) error {
+	getState(ctx).stopServer()
+	return startBuffer(ctx, server.Options{TraceIndex: true})
+}
+
+func pollTrace(ctx context.Context, traceID string) ([]string, error) {
+	evts := []string{}
+	p, err := getState(ctx).client.PollTrace(ctx, traceID, "", 10, &evts)
+	if err != nil {
+		return nil, err
+	}
+	return p.IDs, nil
+}
+
+func pollingForTheTraceShouldReturnEvents(ctx context.Context, traceID string, expected int) error {
+	ids, err := pollTrace(ctx, traceID)
+	if err != nil {
+		return fmt.Errorf("failed polling for the trace: %w", err)
+	}
+	if len(ids) != expected {
+		return fmt.Errorf("expected %d events, got %v", expected, ids)
+	}
+	return nil
+}
+
+func pollingForTheTraceShouldBeRejectedAsInvalid(ctx context.Context, traceID string) error {
+	res, err := http.Get(getState(ctx).serverBaseURL + "/events?trace_id=" + traceID)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("expected status 400, got %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// traceParentsPath holds the traceparent of the publish of events, keyed
+// by their id. Events published without one have no entry.
+var traceParentsPath = dbpath.ToPath("trace-parents")
+
+// tracer records spans with the global tracer provider, they are dropped
+// unless the app installs an exporting one.
+var tracer = otel.Tracer("github.com/draganm/event-buffer/server")
+
+// traceContext parses traceparent headers whether or not spans are
+// exported, they are stored with the events either way.
+var traceContext = propagation.TraceContext{}
+
+type traceParentKey struct{}
+
+// startRequestSpan starts the span of an API request, continuing the trace
+// of its traceparent header. The traceparent is kept in the context of the
+// returned request for the events it publishes.
+func startRequestSpan(r *http.Request, route string) (*http.Request, trace.Span) {
+	ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	if remote := trace.SpanContextFromContext(ctx); remote.IsValid() {
+		ctx = context.WithValue(ctx, traceParentKey{}, formatTraceParent(remote))
+	}
+
+	ctx, span := tracer.Start(ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", route),
+		),
+	)
+	return r.WithContext(ctx), span
+}
+
+// endRequestSpan records the status code of a request, server errors mark
+// the span as failed.
+func endRequestSpan(span trace.Span, code int) {
+	span.SetAttributes(attribute.Int("http.status_code", code))
+	if code >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(code))
+	}
+	span.End()
+}
+
+// grpcTraceParent keeps the traceparent of the metadata of a call in its
+// context, like startRequestSpan does for requests.
+func grpcTraceParent(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("traceparent")
+	if len(values) == 0 {
+		return ctx
+	}
+
+	remote := trace.SpanContextFromContext(traceContext.Extract(ctx, propagation.MapCarrier{"traceparent": values[0]}))
+	if !remote.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, traceParentKey{}, formatTraceParent(remote))
+}
+
+func formatTraceParent(sc trace.SpanContext) string {
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(trace.ContextWithSpanContext(context.Background(), sc), carrier)
+	return carrier.Get("traceparent")
+}
+
+// storeTraceParents stores the traceparent of the publish in ctx for the
+// events with ids, if it had one.
+func (s Server) storeTraceParents(ctx context.Context, tx bolted.SugaredWriteTx, ids []string) {
+	tp, _ := ctx.Value(traceParentKey{}).(string)
+	if tp == "" {
+		return
+	}
+	for _, id := range ids {
+		s.putTraceParent(tx, id, tp)
+	}
+}
+
+// traceParent returns the traceparent an event was published with.
+func traceParent(tx bolted.SugaredReadTx, id string) string {
+	path := traceParentsPath.Append(id)
+	if !tx.Exists(path) {
+		return ""
+	}
+	return string(tx.Get(path))
+}
+
+// endSpan ends a span, marking it as failed when err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// streamAttribute labels spans with the topic of a stream, the default
+// stream has none.
+func streamAttribute(st stream) attribute.KeyValue {
+	return attribute.String("event_buffer.topic", st.topic)
+}
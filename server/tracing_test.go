@@ -0,0 +1,69 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func iSendAnEventWithTheTraceparent(ctx context.Context, traceParent string) error {
+	s := getState(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.serverBaseURL+"/events/batch", strings.NewReader(`["evt1"]`))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("traceparent", traceParent)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	batch := struct {
+		FirstID string `json:"first_id"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&batch)
+	if err != nil {
+		return fmt.Errorf("could not decode batch: %w", err)
+	}
+
+	s.lastId = batch.FirstID
+	return nil
+}
+
+func theEventShouldHaveTheTraceparent(ctx context.Context, expected string) error {
+	s := getState(ctx)
+	res, err := http.Get(s.serverBaseURL + "/events/" + s.lastId)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	detail := struct {
+		TraceParent string `json:"traceparent"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&detail)
+	if err != nil {
+		return fmt.Errorf("could not decode event: %w", err)
+	}
+	if detail.TraceParent != expected {
+		return fmt.Errorf("expected traceparent %q, got %q", expected, detail.TraceParent)
+	}
+	return nil
+}
+
+func theEventShouldHaveNoTraceparent(ctx context.Context) error {
+	return theEventShouldHaveTheTraceparent(ctx, "")
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/gorilla/mux"
+)
+
+// transaction acknowledges consumed events by moving the cursor of a
+// consumer to Position and publishes Events in the same transaction.
+type transaction struct {
+	// Expected is the position the consumer has to be at, an empty string
+	// for a consumer that is not registered yet. It is not checked when
+	// omitted. Retrying a committed transaction fails on this check, so
+	// derived events are published exactly once.
+	Expected *string           `json:"expected"`
+	Position string            `json:"position"`
+	Events   []json.RawMessage `json:"events"`
+}
+
+type transactionCommitted struct {
+	IDs []string `json:"ids"`
+}
+
+type positionConflict struct {
+	Error    string `json:"error"`
+	Position string `json:"position"`
+}
+
+var errPositionConflict = errors.New("position conflict")
+
+func (s *Server) commitTransaction(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+	name := mux.Vars(r)["name"]
+
+	release, ok := s.acquireWriteSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	body, err := s.requestBody(r)
+	if err != nil {
+		http.Error(w, fmt.Errorf("could not read request: %w", err).Error(), decodeErrorStatus(err))
+		return
+	}
+	defer body.Close()
+
+	t := transaction{}
+	err = json.NewDecoder(body).Decode(&t)
+	if err != nil {
+		log.Error(err, "could not decode request")
+		http.Error(w, fmt.Errorf("could not decode request: %w", err).Error(), decodeErrorStatus(err))
+		return
+	}
+
+	_, err = eventTime(t.Position)
+	if err != nil {
+		http.Error(w, fmt.Errorf("invalid position: %w", err).Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	d, err := json.Marshal(consumer{Position: t.Position, Updated: now, LastSeen: now})
+	if err != nil {
+		log.Error(err, "could not marshal consumer")
+		http.Error(w, fmt.Errorf("could not marshal consumer: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uuids, objects, err := s.prepareEvents(r.Context(), defaultStream, t.Events)
+	if err != nil {
+		log.Error(err, "could not prepare events")
+		http.Error(w, fmt.Errorf("could not prepare events: %w", err).Error(), streamErrorStatus(err))
+		return
+	}
+
+	current := ""
+	err = bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		path := consumersPath.Append(name)
+		if tx.Exists(path) {
+			c := consumer{}
+			err := json.Unmarshal(tx.Get(path), &c)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal consumer %s: %w", name, err)
+			}
+			current = c.Position
+		}
+
+		if t.Expected != nil && *t.Expected != current {
+			return errPositionConflict
+		}
+
+		tx.Put(path, d)
+
+		return s.storeEvents(tx, defaultStream, uuids, objects, t.Events)
+	})
+
+	if errors.Is(err, errPositionConflict) {
+		s.deleteObjects(objects)
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(positionConflict{
+			Error:    fmt.Sprintf("consumer %s is at %q", name, current),
+			Position: current,
+		})
+		return
+	}
+
+	if err != nil {
+		s.deleteObjects(objects)
+		log.Error(err, "could not commit transaction")
+		http.Error(w, fmt.Errorf("could not commit transaction: %w", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.recordPublished(r, t.Events)
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(transactionCommitted{IDs: uuids})
+}
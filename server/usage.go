@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/event-buffer/auth"
+)
+
+// usagePath holds daily usage per principal under usage/<day>/<principal>.
+var usagePath = dbpath.ToPath("usage")
+
+const (
+	usageDayFormat = "2006-01-02"
+	// anonymousPrincipal accounts requests of listeners without
+	// authentication.
+	anonymousPrincipal = "anonymous"
+)
+
+type Usage struct {
+	PublishedEvents uint64 `json:"published_events"`
+	PublishedBytes  uint64 `json:"published_bytes"`
+	ConsumedEvents  uint64 `json:"consumed_events"`
+	ConsumedBytes   uint64 `json:"consumed_bytes"`
+}
+
+func (u *Usage) add(o Usage) {
+	u.PublishedEvents += o.PublishedEvents
+	u.PublishedBytes += o.PublishedBytes
+	u.ConsumedEvents += o.ConsumedEvents
+	u.ConsumedBytes += o.ConsumedBytes
+}
+
+// usageRecorder aggregates usage in memory, so requests don't need a write
+// transaction. It is persisted by FlushUsage.
+type usageRecorder struct {
+	mu      sync.Mutex
+	pending map[string]map[string]*Usage
+	// flushing is held while usage is persisted, so reports don't miss
+	// usage that is neither pending nor stored.
+	flushing sync.Mutex
+}
+
+func (ur *usageRecorder) record(principal string, u Usage) {
+	ur.recordOn(time.Now().UTC().Format(usageDayFormat), principal, u)
+}
+
+func (ur *usageRecorder) recordOn(day, principal string, u Usage) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+
+	if ur.pending == nil {
+		ur.pending = map[string]map[string]*Usage{}
+	}
+	if ur.pending[day] == nil {
+		ur.pending[day] = map[string]*Usage{}
+	}
+	if ur.pending[day][principal] == nil {
+		ur.pending[day][principal] = &Usage{}
+	}
+	ur.pending[day][principal].add(u)
+}
+
+func (ur *usageRecorder) take() map[string]map[string]*Usage {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	p := ur.pending
+	ur.pending = nil
+	return p
+}
+
+func (ur *usageRecorder) snapshot() map[string]map[string]Usage {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	res := map[string]map[string]Usage{}
+	for day, principals := range ur.pending {
+		res[day] = map[string]Usage{}
+		for p, u := range principals {
+			res[day][p] = *u
+		}
+	}
+	return res
+}
+
+func requestPrincipal(r *http.Request) string {
+	p, found := auth.FromContext(r.Context())
+	if !found {
+		return anonymousPrincipal
+	}
+	return p.Name
+}
+
+func (s *Server) recordPublished(r *http.Request, payloads []json.RawMessage) {
+	u := Usage{PublishedEvents: uint64(len(payloads))}
+	for _, p := range payloads {
+		u.PublishedBytes += uint64(len(p))
+	}
+	s.usage.record(requestPrincipal(r), u)
+}
+
+func (s *Server) recordConsumed(r *http.Request, events []event) {
+	u := Usage{ConsumedEvents: uint64(len(events))}
+	for _, e := range events {
+		u.ConsumedBytes += uint64(len(e.payload))
+	}
+	s.usage.record(requestPrincipal(r), u)
+}
+
+// FlushUsage persists the usage recorded since the last flush.
+func (s *Server) FlushUsage() error {
+	s.usage.flushing.Lock()
+	defer s.usage.flushing.Unlock()
+
+	pending := s.usage.take()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+		for day, principals := range pending {
+			dayPath := usagePath.Append(day)
+			if !tx.Exists(dayPath) {
+				tx.CreateMap(dayPath)
+			}
+			for p, u := range principals {
+				stored := Usage{}
+				path := dayPath.Append(p)
+				if tx.Exists(path) {
+					err := json.Unmarshal(tx.Get(path), &stored)
+					if err != nil {
+						return fmt.Errorf("could not unmarshal usage of %s on %s: %w", p, day, err)
+					}
+				}
+				stored.add(*u)
+				d, err := json.Marshal(stored)
+				if err != nil {
+					return fmt.Errorf("could not marshal usage: %w", err)
+				}
+				tx.Put(path, d)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		// keep the usage for the next flush
+		for day, principals := range pending {
+			for p, u := range principals {
+				s.usage.recordOn(day, p, *u)
+			}
+		}
+		return fmt.Errorf("could not store usage: %w", err)
+	}
+
+	return nil
+}
+
+// FlushUsagePeriodically persists usage every interval and once more when
+// ctx is cancelled.
+func (s *Server) FlushUsagePeriodically(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			err := s.FlushUsage()
+			if err != nil {
+				s.log.Error(err, "could not flush usage")
+			}
+			return nil
+		case <-ticker.C:
+			err := s.FlushUsage()
+			if err != nil {
+				s.log.Error(err, "could not flush usage")
+			}
+		}
+	}
+}
+
+// UsageReport returns the usage per day and principal for days between
+// from and to (both inclusive, formatted as 2006-01-02 and optional),
+// limited to principal when it's not empty.
+func (s *Server) UsageReport(from, to, principal string) (map[string]map[string]Usage, error) {
+	s.usage.flushing.Lock()
+	defer s.usage.flushing.Unlock()
+
+	report := map[string]map[string]Usage{}
+
+	include := func(day, p string) bool {
+		return (from == "" || day >= from) && (to == "" || day <= to) && (principal == "" || p == principal)
+	}
+
+	add := func(day, p string, u Usage) {
+		if report[day] == nil {
+			report[day] = map[string]Usage{}
+		}
+		total := report[day][p]
+		total.add(u)
+		report[day][p] = total
+	}
+
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+		it := tx.Iterator(usagePath)
+		if from != "" {
+			it.Seek(from)
+		}
+		for ; !it.IsDone(); it.Next() {
+			day := it.GetKey()
+			if to != "" && day > to {
+				break
+			}
+			for pit := tx.Iterator(usagePath.Append(day)); !pit.IsDone(); pit.Next() {
+				if !include(day, pit.GetKey()) {
+					continue
+				}
+				u := Usage{}
+				err := json.Unmarshal(pit.GetValue(), &u)
+				if err != nil {
+					return fmt.Errorf("could not unmarshal usage of %s on %s: %w", pit.GetKey(), day, err)
+				}
+				add(day, pit.GetKey(), u)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read usage: %w", err)
+	}
+
+	for day, principals := range s.usage.snapshot() {
+		for p, u := range principals {
+			if include(day, p) {
+				add(day, p, u)
+			}
+		}
+	}
+
+	return report, nil
+}
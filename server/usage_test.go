@@ -0,0 +1,44 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/draganm/event-buffer/server"
+)
+
+func todaysUsage(ctx context.Context, principal string) (server.Usage, error) {
+	today := time.Now().UTC().Format("2006-01-02")
+	report, err := getState(ctx).server.UsageReport(today, today, principal)
+	if err != nil {
+		return server.Usage{}, err
+	}
+	return report[today][principal], nil
+}
+
+func shouldHavePublishedEventsOfBytesToday(ctx context.Context, principal string, events, bytes int) error {
+	u, err := todaysUsage(ctx, principal)
+	if err != nil {
+		return err
+	}
+	if u.PublishedEvents != uint64(events) || u.PublishedBytes != uint64(bytes) {
+		return fmt.Errorf("expected %s to have published %d events of %d bytes, got %+v", principal, events, bytes, u)
+	}
+	return nil
+}
+
+func shouldHaveConsumedEventsOfBytesToday(ctx context.Context, principal string, events, bytes int) error {
+	u, err := todaysUsage(ctx, principal)
+	if err != nil {
+		return err
+	}
+	if u.ConsumedEvents != uint64(events) || u.ConsumedBytes != uint64(bytes) {
+		return fmt.Errorf("expected %s to have consumed %d events of %d bytes, got %+v", principal, events, bytes, u)
+	}
+	return nil
+}
+
+func theUsageIsFlushed(ctx context.Context) error {
+	return getState(ctx).server.FlushUsage()
+}
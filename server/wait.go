@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultPollWait is how long polls block for new events, polls
+	// without a wait parameter time out with 408 after it.
+	defaultPollWait = 20 * time.Second
+
+	// maxPollWait caps the wait parameter, so proxies between consumers
+	// and the buffer don't cut off idle requests.
+	maxPollWait = 5 * time.Minute
+)
+
+// disconnected returns the error of ctx once the client of a read has gone
+// away, reads check it between events, so they end their transaction
+// instead of reading for nobody. Reads running into their deadline finish.
+func disconnected(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// parsePollWait parses the wait parameter of polls, a duration like 30s or
+// a number of seconds.
+func parsePollWait(v string) (time.Duration, error) {
+	wait, err := time.ParseDuration(v)
+	if err != nil {
+		seconds, serr := strconv.Atoi(v)
+		if serr != nil {
+			return 0, fmt.Errorf("invalid wait %q: %w", v, err)
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	if wait < 0 || wait > maxPollWait {
+		return 0, fmt.Errorf("wait has to be between 0 and %s", maxPollWait)
+	}
+
+	return wait, nil
+}
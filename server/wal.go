@@ -0,0 +1,410 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"github.com/draganm/event-buffer/objectstore"
+)
+
+const (
+	walPrefix = "wal/"
+	// walTopicsPrefix holds the segments of each topic under its name,
+	// together with the config of the topic.
+	walTopicsPrefix = walPrefix + "topics/"
+	walTopicConfig  = "config.json"
+	walSuffix       = ".jsonl"
+	// walSegmentMaxEvents limits the size of a single segment.
+	walSegmentMaxEvents = 1000
+)
+
+// walStreamPrefix returns the prefix of the segments of a topic, or of the
+// buffer for an empty topic.
+func walStreamPrefix(topic string) string {
+	if topic == "" {
+		return walPrefix
+	}
+	return walTopicsPrefix + topic + "/"
+}
+
+// walSegmentKey names segments by their first and last event, so they
+// sort in the order they were shipped.
+func walSegmentKey(topic, first, last string) string {
+	return walStreamPrefix(topic) + first + "_" + last + walSuffix
+}
+
+// walSegmentLast returns the id of the last event of a segment.
+func walSegmentLast(key string) (string, bool) {
+	if !strings.HasSuffix(key, walSuffix) {
+		return "", false
+	}
+	name := strings.TrimSuffix(path.Base(key), walSuffix)
+	_, last, found := strings.Cut(name, "_")
+	return last, found
+}
+
+// walSegmentTopic returns the topic of a segment, empty for segments of
+// the buffer.
+func walSegmentTopic(key string) string {
+	if !strings.HasPrefix(key, walTopicsPrefix) {
+		return ""
+	}
+	topic, _, _ := strings.Cut(strings.TrimPrefix(key, walTopicsPrefix), "/")
+	return topic
+}
+
+// ShipWAL continuously ships newly appended events of the buffer and its
+// topics as WAL segments to the store until ctx is cancelled, so at most
+// interval worth of events is lost when the node fails.
+func (s *Server) ShipWAL(ctx context.Context, store objectstore.Store, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := s.shipWAL(ctx, store)
+			if err != nil {
+				s.log.Error(err, "could not ship WAL")
+			}
+		}
+	}
+}
+
+// shipWAL ships all events of all streams that have not been shipped yet.
+func (s *Server) shipWAL(ctx context.Context, store objectstore.Store) error {
+	var topics []stream
+	err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) (err error) {
+		topics, err = readTopics(tx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not read topics: %w", err)
+	}
+
+	for _, st := range append([]stream{defaultStream}, topics...) {
+		err = s.shipStreamWAL(ctx, store, st)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shipStreamWAL ships the events of a stream that have not been shipped
+// yet. The config of a topic is uploaded with its segments, so replays
+// can create the topic.
+func (s *Server) shipStreamWAL(ctx context.Context, store objectstore.Store, st stream) error {
+	for {
+		events := []event{}
+		var config []byte
+		err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+			// the topic was deleted since the topics were read
+			if !tx.Exists(st.events) {
+				return nil
+			}
+
+			if st.topic != "" {
+				config = tx.Get(topicConfigPath(st.topic))
+			}
+
+			after := ""
+			if tx.Exists(st.walShipped) {
+				after = string(tx.Get(st.walShipped))
+			}
+
+			it := tx.Iterator(st.events)
+			if after != "" {
+				it.Seek(after)
+				if !it.IsDone() && it.GetKey() == after {
+					it.Next()
+				}
+			}
+
+			for ; !it.IsDone() && len(events) < walSegmentMaxEvents; it.Next() {
+				payload, err := s.loadPayload(ctx, tx, it.GetValue())
+				if err != nil {
+					return fmt.Errorf("could not load event %s: %w", it.GetKey(), err)
+				}
+				events = append(events, event{id: it.GetKey(), payload: payload})
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		if config != nil {
+			err = store.Put(ctx, walStreamPrefix(st.topic)+walTopicConfig, bytes.NewReader(config), int64(len(config)))
+			if err != nil {
+				return fmt.Errorf("could not upload WAL config of topic %s: %w", st.topic, err)
+			}
+		}
+
+		buf := &bytes.Buffer{}
+		enc := json.NewEncoder(buf)
+		for _, e := range events {
+			err = enc.Encode(e)
+			if err != nil {
+				return fmt.Errorf("could not encode event %s: %w", e.id, err)
+			}
+		}
+
+		segment, err := s.sealPayload(buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		last := events[len(events)-1].id
+		key := walSegmentKey(st.topic, events[0].id, last)
+		err = store.Put(ctx, key, bytes.NewReader(segment), int64(len(segment)))
+		if err != nil {
+			return fmt.Errorf("could not upload WAL segment: %w", err)
+		}
+
+		err = bolted.SugaredWrite(s.db, func(tx bolted.SugaredWriteTx) error {
+			if !tx.Exists(st.events) {
+				return nil
+			}
+			tx.Put(st.walShipped, []byte(last))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not record shipped WAL position: %w", err)
+		}
+	}
+}
+
+// PruneWAL deletes WAL segments that contain only events older than
+// cutoff.
+func PruneWAL(ctx context.Context, store objectstore.Store, cutoff time.Time) error {
+	keys, err := store.List(ctx, walPrefix)
+	if err != nil {
+		return fmt.Errorf("could not list WAL segments: %w", err)
+	}
+
+	for _, k := range keys {
+		last, ok := walSegmentLast(k)
+		if !ok {
+			continue
+		}
+		t, err := eventTime(last)
+		if err != nil || !t.Before(cutoff) {
+			continue
+		}
+		err = store.Delete(ctx, k)
+		if err != nil {
+			return fmt.Errorf("could not delete WAL segment %s: %w", k, err)
+		}
+	}
+
+	return nil
+}
+
+// ReplayWAL appends the events of WAL segments that are newer than the
+// newest event of their stream in db, up to and including until. A zero
+// until replays all segments. Topics that don't exist in db are created
+// with their shipped config, this includes topics deleted after their
+// events were shipped. Segments shipped by a buffer with encryption keys
+// are opened with encryptionKeys, replayed payloads are encrypted with the
+// first of them. The number of replayed events is returned.
+func ReplayWAL(ctx context.Context, db bolted.Database, store objectstore.Store, until time.Time, encryptionKeys []EncryptionKey) (int, error) {
+	c, err := newPayloadCipher(encryptionKeys)
+	if err != nil {
+		return 0, err
+	}
+
+	err = bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
+		// the state is empty when there was no backup to restore
+		for _, p := range []dbpath.Path{eventsPath, metaPath, topicsPath} {
+			if !tx.Exists(p) {
+				tx.CreateMap(p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not prepare state: %w", err)
+	}
+
+	keys, err := store.List(ctx, walPrefix)
+	if err != nil {
+		return 0, fmt.Errorf("could not list WAL segments: %w", err)
+	}
+
+	topics := []string{""}
+	segments := map[string][]string{}
+	for _, k := range keys {
+		_, ok := walSegmentLast(k)
+		if !ok {
+			continue
+		}
+		topic := walSegmentTopic(k)
+		_, found := segments[topic]
+		if !found && topic != "" {
+			topics = append(topics, topic)
+		}
+		segments[topic] = append(segments[topic], k)
+	}
+
+	replayed := 0
+	for _, topic := range topics {
+		n, err := replayStreamWAL(ctx, db, c, store, topic, segments[topic], until)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+
+	return replayed, nil
+}
+
+// replayStreamWAL replays the segments of a topic, or of the buffer for an
+// empty topic.
+func replayStreamWAL(ctx context.Context, db bolted.Database, c *payloadCipher, store objectstore.Store, topic string, keys []string, until time.Time) (int, error) {
+	st := defaultStream
+	config := []byte("{}")
+	if topic != "" {
+		if !topicNameRegexp.MatchString(topic) {
+			return 0, fmt.Errorf("invalid topic name %q in WAL", topic)
+		}
+		st = topicStream(topic, 0)
+
+		o, err := store.Get(ctx, walStreamPrefix(topic)+walTopicConfig)
+		switch {
+		case errors.Is(err, objectstore.ErrNotFound):
+		case err != nil:
+			return 0, fmt.Errorf("could not fetch WAL config of topic %s: %w", topic, err)
+		default:
+			config, err = io.ReadAll(o)
+			o.Close()
+			if err != nil {
+				return 0, fmt.Errorf("could not read WAL config of topic %s: %w", topic, err)
+			}
+		}
+	}
+
+	newest := ""
+	err := bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
+		if topic != "" && !tx.Exists(topicsPath.Append(topic)) {
+			tx.CreateMap(topicsPath.Append(topic))
+			tx.CreateMap(st.events)
+			tx.Put(topicConfigPath(topic), config)
+		}
+		it := tx.Iterator(st.events)
+		it.Last()
+		if !it.IsDone() {
+			newest = it.GetKey()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not find newest event: %w", err)
+	}
+
+	replayed := 0
+	for _, k := range keys {
+		last, _ := walSegmentLast(k)
+		if last <= newest {
+			continue
+		}
+
+		events, err := readWALSegment(ctx, c, store, k)
+		if err != nil {
+			return replayed, err
+		}
+
+		done := false
+		n := 0
+		err = bolted.SugaredWrite(db, func(tx bolted.SugaredWriteTx) error {
+			n = 0
+			defer func() {
+				addCounter(tx, st.appended, n)
+			}()
+			for _, e := range events {
+				if e.id <= newest {
+					continue
+				}
+				t, err := eventTime(e.id)
+				if err != nil {
+					return err
+				}
+				if !until.IsZero() && t.After(until) {
+					done = true
+					return nil
+				}
+				value := []byte(e.payload)
+				if c != nil {
+					value, err = c.seal(value)
+					if err != nil {
+						return err
+					}
+				}
+				tx.Put(st.events.Append(e.id), value)
+				addStoredBytes(tx, len(value))
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			return replayed, fmt.Errorf("could not replay WAL segment %s: %w", k, err)
+		}
+		replayed += n
+
+		if done {
+			break
+		}
+	}
+
+	return replayed, nil
+}
+
+func readWALSegment(ctx context.Context, c *payloadCipher, store objectstore.Store, key string) ([]event, error) {
+	o, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch WAL segment %s: %w", key, err)
+	}
+	defer o.Close()
+
+	r, err := openSegment(c, o)
+	if err != nil {
+		return nil, fmt.Errorf("could not open WAL segment %s: %w", key, err)
+	}
+
+	events := []event{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<30)
+	for sc.Scan() {
+		e := event{}
+		err = json.Unmarshal(sc.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse WAL segment %s: %w", key, err)
+		}
+		events = append(events, e)
+	}
+
+	err = sc.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read WAL segment %s: %w", key, err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,142 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/draganm/bolted/embedded"
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/draganm/event-buffer/server"
+)
+
+func aBufferShippingItsWAL(ctx context.Context) error {
+	td, err := os.MkdirTemp("", "wal")
+	if err != nil {
+		return fmt.Errorf("could not create temp dir: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		os.RemoveAll(td)
+	}()
+
+	store, err := objectstore.Open("file://" + td + "/")
+	if err != nil {
+		return fmt.Errorf("could not open WAL store: %w", err)
+	}
+
+	s := getState(ctx)
+	s.walStore = store
+	go s.server.ShipWAL(ctx, store, 10*time.Millisecond)
+	return nil
+}
+
+// walEvents returns the number of events in the shipped WAL segments.
+func walEvents(ctx context.Context) (int, error) {
+	store := getState(ctx).walStore
+	keys, err := store.List(ctx, "wal/")
+	if err != nil {
+		return 0, fmt.Errorf("could not list WAL segments: %w", err)
+	}
+
+	n := 0
+	for _, k := range keys {
+		// topics ship their config next to their segments
+		if !strings.HasSuffix(k, ".jsonl") {
+			continue
+		}
+		o, err := store.Get(ctx, k)
+		if err != nil {
+			return 0, err
+		}
+		sc := bufio.NewScanner(o)
+		for sc.Scan() {
+			n++
+		}
+		o.Close()
+		if sc.Err() != nil {
+			return 0, sc.Err()
+		}
+	}
+	return n, nil
+}
+
+func theWALShouldHoldEvents(ctx context.Context, expected int) error {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n, err := walEvents(ctx)
+		if err != nil {
+			return err
+		}
+		if n == expected {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("expected %d events in the WAL, got %d", expected, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func aMomentPasses(ctx context.Context) error {
+	time.Sleep(10 * time.Millisecond)
+	getState(ctx).moment = time.Now()
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+// replayWAL replays the WAL into a new state and starts a buffer on it.
+func replayWAL(ctx context.Context, until time.Time) error {
+	s := getState(ctx)
+	td, err := os.MkdirTemp("", "")
+	if err != nil {
+		return fmt.Errorf("could not create temp dir: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		os.RemoveAll(td)
+	}()
+
+	path := filepath.Join(td, "replayed")
+	db, err := embedded.Open(path, 0700, embedded.Options{})
+	if err != nil {
+		return fmt.Errorf("could not open db: %w", err)
+	}
+	keys := scenarioEncryptionKeys(ctx)
+	s.replayed, err = server.ReplayWAL(ctx, db, s.walStore, until, keys)
+	closeErr := db.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	s.stateFile = path
+	return startBuffer(ctx, server.Options{EncryptionKeys: keys})
+}
+
+func theWALIsReplayedIntoAnEmptyState(ctx context.Context) error {
+	return replayWAL(ctx, time.Time{})
+}
+
+func theWALIsReplayedIntoAnEmptyStateUntilTheMoment(ctx context.Context) error {
+	return replayWAL(ctx, getState(ctx).moment)
+}
+
+func eventsShouldHaveBeenReplayed(ctx context.Context, n int) error {
+	replayed := getState(ctx).replayed
+	if replayed != n {
+		return fmt.Errorf("expected %d replayed events, got %d", n, replayed)
+	}
+	return nil
+}
+
+func theWALIsPrunedBeforeTheMoment(ctx context.Context) error {
+	s := getState(ctx)
+	return server.PruneWAL(ctx, s.walStore, s.moment)
+}
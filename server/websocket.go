@@ -0,0 +1,315 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/gorilla/websocket"
+)
+
+// Types of WebSocket messages. Clients send publish, subscribe,
+// unsubscribe and ack messages, the server answers with published,
+// subscribed, unsubscribed, acked or error messages carrying the ref of
+// the request, and sends event messages to subscribed clients.
+const (
+	wsPublish      = "publish"
+	wsPublished    = "published"
+	wsSubscribe    = "subscribe"
+	wsSubscribed   = "subscribed"
+	wsUnsubscribe  = "unsubscribe"
+	wsUnsubscribed = "unsubscribed"
+	wsAck          = "ack"
+	wsAcked        = "acked"
+	wsEvent        = "event"
+	wsError        = "error"
+)
+
+type wsMessage struct {
+	Type string `json:"type"`
+	// Ref correlates answers with requests of the client.
+	Ref    string            `json:"ref,omitempty"`
+	Events []json.RawMessage `json:"events,omitempty"`
+	IDs    []string          `json:"ids,omitempty"`
+	// From is the id of the event a subscription starts after, it
+	// defaults to the cursor of Consumer.
+	From     string          `json:"from,omitempty"`
+	Consumer string          `json:"consumer,omitempty"`
+	ID       string          `json:"id,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	// RetryAfter is set in seconds when a publish was rejected because the
+	// write queue is full.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{}
+
+// wsConn serializes the writes to a WebSocket connection.
+type wsConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (c *wsConn) send(m wsMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteJSON(m)
+}
+
+func (c *wsConn) sendError(ref string, err error) error {
+	return c.send(wsMessage{Type: wsError, Ref: ref, Error: err.Error()})
+}
+
+// serveWebSocket publishes and delivers events of a stream over a single
+// WebSocket connection. A subscription delivers the events after its start
+// like the event stream does and is replaced by the next subscribe.
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	log := s.log.WithValues("method", r.Method, "path", r.URL.Path, "client", s.opts.TrustedProxies.ClientIP(r))
+
+	st, err := s.requestStream(r)
+	if err != nil {
+		http.Error(w, err.Error(), streamErrorStatus(err))
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has answered the request
+		return
+	}
+
+	defer conn.Close()
+
+	conn.SetReadLimit(s.maxDecompressedSize())
+	c := &wsConn{conn: conn}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// keep the connection alive through proxies
+	go func() {
+		ticker := time.NewTicker(streamHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// stop ends the current subscription and waits for it
+	stop := func() {}
+	defer func() { stop() }()
+
+	for {
+		m := wsMessage{}
+		err = conn.ReadJSON(&m)
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) && ctx.Err() == nil {
+				log.Error(err, "could not read message")
+			}
+			return
+		}
+
+		switch m.Type {
+		case wsPublish:
+			err = s.wsPublish(ctx, r, st, c, m)
+		case wsSubscribe:
+			stop()
+			stop, err = s.wsSubscribe(ctx, r, st, c, m)
+		case wsUnsubscribe:
+			stop()
+			stop = func() {}
+			err = c.send(wsMessage{Type: wsUnsubscribed, Ref: m.Ref})
+		case wsAck:
+			err = s.wsAck(st, c, m)
+		default:
+			err = c.sendError(m.Ref, fmt.Errorf("unsupported message type %q", m.Type))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// wsPublish stores the events of a publish message, only failures to
+// answer are returned.
+func (s *Server) wsPublish(ctx context.Context, r *http.Request, st stream, c *wsConn, m wsMessage) error {
+	release, err := s.writeSlots.acquire(ctx)
+	if errors.Is(err, errWriteQueueFull) {
+		return c.send(wsMessage{Type: wsError, Ref: m.Ref, Error: err.Error(), RetryAfter: s.writeSlots.retryAfter()})
+	}
+	if err != nil {
+		return err
+	}
+
+	ids, err := s.appendEvents(ctx, st, m.Events)
+	release()
+	if err != nil {
+		s.log.Error(err, "could not append events")
+		return c.sendError(m.Ref, err)
+	}
+
+	s.recordPublished(r, m.Events)
+
+	return c.send(wsMessage{Type: wsPublished, Ref: m.Ref, IDs: ids})
+}
+
+// wsAck moves the cursor of a consumer to the acknowledged event.
+func (s *Server) wsAck(st stream, c *wsConn, m wsMessage) error {
+	if st.topic != "" {
+		return c.sendError(m.Ref, errors.New("consumer cursors are not supported for topics"))
+	}
+
+	if m.Consumer == "" {
+		return c.sendError(m.Ref, errors.New("ack without consumer"))
+	}
+
+	_, err := eventTime(m.ID)
+	if err != nil {
+		return c.sendError(m.Ref, fmt.Errorf("invalid position: %w", err))
+	}
+
+	err = s.storeCursor(m.Consumer, m.ID)
+	if err != nil {
+		s.log.Error(err, "could not store consumer")
+		return c.sendError(m.Ref, err)
+	}
+
+	return c.send(wsMessage{Type: wsAcked, Ref: m.Ref, Consumer: m.Consumer, ID: m.ID})
+}
+
+// wsSubscribe starts delivering events to the client, the returned func
+// ends the subscription.
+func (s *Server) wsSubscribe(ctx context.Context, r *http.Request, st stream, c *wsConn, m wsMessage) (func(), error) {
+	noop := func() {}
+
+	after := m.From
+	if after == "" && m.Consumer != "" && st.topic == "" {
+		err := bolted.SugaredRead(s.db, func(tx bolted.SugaredReadTx) error {
+			p := consumersPath.Append(m.Consumer)
+			if !tx.Exists(p) {
+				return nil
+			}
+			cs := consumer{}
+			err := json.Unmarshal(tx.Get(p), &cs)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal consumer %s: %w", m.Consumer, err)
+			}
+			after = cs.Position
+			return nil
+		})
+		if err != nil {
+			return noop, c.sendError(m.Ref, err)
+		}
+	}
+
+	if after != "" {
+		expired, err := s.cursorExpired(st, after)
+		if err != nil {
+			return noop, c.sendError(m.Ref, err)
+		}
+		if expired != nil {
+			return noop, c.send(wsMessage{Type: wsError, Ref: m.Ref, Error: expired.Error, ID: expired.Oldest})
+		}
+	}
+
+	err := c.send(wsMessage{Type: wsSubscribed, Ref: m.Ref, From: after})
+	if err != nil {
+		return noop, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := s.deliverToWebSocket(ctx, r, st, c, after)
+		if err != nil && ctx.Err() == nil {
+			s.log.Error(err, "could not deliver events")
+			c.sendError(m.Ref, err)
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// deliverToWebSocket sends events after the id after until ctx is
+// cancelled.
+func (s *Server) deliverToWebSocket(ctx context.Context, r *http.Request, st stream, c *wsConn, after string) error {
+	redactions := s.deliveryRedactions(r)
+	bucket := s.deliveryLimiter.bucket(r)
+
+	changes, done := s.db.Observe(st.events.ToMatcher().AppendAnyElementMatcher())
+	defer done()
+
+	more := true
+	for {
+		if !more {
+			select {
+			case <-changes:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		limit := maxStreamBatch
+		maxBytes := int64(-1)
+		if bucket != nil {
+			maxEvents, mb, err := bucket.wait(ctx)
+			if err != nil {
+				return nil
+			}
+			maxBytes = mb
+			if maxEvents >= 0 && maxEvents < limit {
+				limit = maxEvents
+			}
+		}
+
+		release, _, err := s.readScheduler.acquire(ctx, s.readerKey(r))
+		if err != nil {
+			return nil
+		}
+
+		events, _, size, err := s.readStreamEvents(ctx, st, after, sortAsc, limit, maxBytes, redactions, nil)
+		release()
+		if err != nil {
+			return fmt.Errorf("could not read events: %w", err)
+		}
+
+		more = len(events) > 0
+		if !more {
+			continue
+		}
+
+		s.recordConsumed(r, events)
+		if bucket != nil {
+			bucket.take(len(events), size)
+		}
+
+		for _, e := range events {
+			err = c.send(wsMessage{Type: wsEvent, ID: e.id, Payload: e.payload})
+			if err != nil {
+				return nil
+			}
+		}
+
+		after = events[len(events)-1].id
+	}
+}
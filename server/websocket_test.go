@@ -0,0 +1,132 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
+)
+
+type wsMessage struct {
+	Type     string            `json:"type"`
+	Ref      string            `json:"ref,omitempty"`
+	Events   []json.RawMessage `json:"events,omitempty"`
+	IDs      []string          `json:"ids,omitempty"`
+	Consumer string            `json:"consumer,omitempty"`
+	ID       string            `json:"id,omitempty"`
+	Payload  json.RawMessage   `json:"payload,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// readWS reads the next message of one of the types.
+func readWS(conn *websocket.Conn, types ...string) (wsMessage, error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		m := wsMessage{}
+		err := conn.ReadJSON(&m)
+		if err != nil {
+			return m, err
+		}
+		if m.Type == "error" {
+			return m, fmt.Errorf("websocket error: %s", m.Error)
+		}
+		for _, t := range types {
+			if m.Type == t {
+				return m, nil
+			}
+		}
+	}
+}
+
+func aWebSocketConnectionSubscribedAsConsumer(ctx context.Context, consumer string) error {
+	s := getState(ctx)
+	u := "ws" + strings.TrimPrefix(s.serverBaseURL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u, nil)
+	if err != nil {
+		return fmt.Errorf("could not connect: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	s.ws = conn
+
+	err = conn.WriteJSON(wsMessage{Type: "subscribe", Ref: "1", Consumer: consumer})
+	if err != nil {
+		return err
+	}
+
+	_, err = readWS(conn, "subscribed")
+	return err
+}
+
+func iPublishTwoEventsOverTheWebSocket(ctx context.Context) error {
+	s := getState(ctx)
+	return s.ws.WriteJSON(wsMessage{Type: "publish", Ref: "2", Events: []json.RawMessage{json.RawMessage(`"evt1"`), json.RawMessage(`"evt2"`)}})
+}
+
+func theWebSocketShouldDeliverBothEvents(ctx context.Context) error {
+	s := getState(ctx)
+	evts := []string{}
+	published := false
+	for len(evts) < 2 || !published {
+		m, err := readWS(s.ws, "event", "published")
+		if err != nil {
+			return err
+		}
+		if m.Type == "published" {
+			published = len(m.IDs) == 2
+			continue
+		}
+		var evt string
+		err = json.Unmarshal(m.Payload, &evt)
+		if err != nil {
+			return err
+		}
+		evts = append(evts, evt)
+		s.lastId = m.ID
+	}
+
+	d := cmp.Diff(evts, []string{"evt1", "evt2"})
+	if d != "" {
+		return fmt.Errorf("unexpected events:\n%s", d)
+	}
+	return nil
+}
+
+func acknowledgingTheLastEventShouldMoveTheCursorOf(ctx context.Context, consumer string) error {
+	s := getState(ctx)
+	err := s.ws.WriteJSON(wsMessage{Type: "ack", Ref: "3", Consumer: consumer, ID: s.lastId})
+	if err != nil {
+		return err
+	}
+
+	_, err = readWS(s.ws, "acked")
+	if err != nil {
+		return err
+	}
+
+	res, err := http.Get(s.serverBaseURL + "/consumers")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	consumers := map[string]struct {
+		Position string `json:"position"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&consumers)
+	if err != nil {
+		return err
+	}
+
+	if consumers[consumer].Position != s.lastId {
+		return fmt.Errorf("expected cursor %s, got %q", s.lastId, consumers[consumer].Position)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+func isService() bool {
+	return false
+}
+
+func withServiceLog(logger *zap.Logger) *zap.Logger {
+	return logger
+}
+
+func runService(app *cli.App) error {
+	return errors.New("running as a service is only supported on windows")
+}
+
+func serviceCommands() []*cli.Command {
+	return nil
+}
@@ -0,0 +1,234 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "event-buffer"
+
+func isService() bool {
+	inService, err := svc.IsWindowsService()
+	return err == nil && inService
+}
+
+// withServiceLog tees the log into the windows event log, stdout is not
+// visible when running under the service control manager.
+func withServiceLog(logger *zap.Logger) *zap.Logger {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		logger.Error("could not open event log", zap.Error(err))
+		return logger
+	}
+
+	return logger.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(c, &eventLogCore{
+			LevelEnabler: zapcore.InfoLevel,
+			enc:          zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+			elog:         elog,
+		})
+	}))
+}
+
+type eventLogCore struct {
+	zapcore.LevelEnabler
+	enc  zapcore.Encoder
+	elog *eventlog.Log
+}
+
+func (c *eventLogCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	return &eventLogCore{LevelEnabler: c.LevelEnabler, enc: enc, elog: c.elog}
+}
+
+func (c *eventLogCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *eventLogCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(e, fields)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+
+	switch {
+	case e.Level >= zapcore.ErrorLevel:
+		return c.elog.Error(1, buf.String())
+	case e.Level == zapcore.WarnLevel:
+		return c.elog.Warning(1, buf.String())
+	default:
+		return c.elog.Info(1, buf.String())
+	}
+}
+
+func (c *eventLogCore) Sync() error {
+	return nil
+}
+
+// runService runs the app under the service control manager, stopping
+// the service cancels the context of the app.
+func runService(app *cli.App) error {
+	return svc.Run(serviceName, &service{app: app})
+}
+
+type service struct {
+	app *cli.App
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.app.RunContext(ctx, os.Args)
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			changes <- svc.Status{State: svc.StopPending}
+			if err != nil && ctx.Err() == nil {
+				return true, 1
+			}
+			return false, 0
+		case cr := <-requests:
+			switch cr.Cmd {
+			case svc.Interrogate:
+				changes <- cr.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
+
+func serviceCommands() []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:  "service",
+			Usage: "manage the windows service",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "install",
+					Usage:     "install the windows service, remaining arguments are passed to the server",
+					ArgsUsage: "[-- server flags]",
+					Action:    installService,
+				},
+				{
+					Name:   "uninstall",
+					Usage:  "remove the windows service",
+					Action: uninstallService,
+				},
+				{
+					Name:  "start",
+					Usage: "start the windows service",
+					Action: withService(func(s *mgr.Service) error {
+						return s.Start()
+					}),
+				},
+				{
+					Name:  "stop",
+					Usage: "stop the windows service",
+					Action: withService(func(s *mgr.Service) error {
+						_, err := s.Control(svc.Stop)
+						return err
+					}),
+				},
+			},
+		},
+	}
+}
+
+func installService(c *cli.Context) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not get executable path: %w", err)
+	}
+
+	exe, err = filepath.Abs(exe)
+	if err != nil {
+		return fmt.Errorf("could not get absolute executable path: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("could not connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Event Buffer",
+		Description: "Buffers events for consumers that poll for them.",
+		StartType:   mgr.StartAutomatic,
+	}, c.Args().Slice()...)
+	if err != nil {
+		return fmt.Errorf("could not create service: %w", err)
+	}
+	defer s.Close()
+
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("could not install event log source: %w", err)
+	}
+
+	return nil
+}
+
+func uninstallService(c *cli.Context) error {
+	err := withService(func(s *mgr.Service) error {
+		return s.Delete()
+	})(c)
+	if err != nil {
+		return err
+	}
+
+	err = eventlog.Remove(serviceName)
+	if err != nil {
+		return fmt.Errorf("could not remove event log source: %w", err)
+	}
+
+	return nil
+}
+
+func withService(fn func(s *mgr.Service) error) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		m, err := mgr.Connect()
+		if err != nil {
+			return fmt.Errorf("could not connect to service manager: %w", err)
+		}
+		defer m.Disconnect()
+
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("could not open service: %w", err)
+		}
+		defer s.Close()
+
+		return fn(s)
+	}
+}
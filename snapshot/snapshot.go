@@ -0,0 +1,457 @@
+// Package snapshot implements a portable, versioned format for the state
+// of the buffer, independent of the storage engine. The format is
+// documented in snapshot.proto.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/draganm/bolted"
+	"github.com/draganm/bolted/dbpath"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Version is the version of the format written by Write.
+const Version = 1
+
+// maxRecordSize protects readers from allocating huge buffers for corrupt
+// length prefixes.
+const maxRecordSize = 1 << 30
+
+// field numbers of snapshot.proto
+const (
+	recordHeader  protowire.Number = 1
+	recordEntry   protowire.Number = 2
+	recordTrailer protowire.Number = 3
+
+	headerVersion   protowire.Number = 1
+	headerCreated   protowire.Number = 2
+	headerSequences protowire.Number = 3
+
+	sequenceStream   protowire.Number = 1
+	sequenceAppended protowire.Number = 2
+	sequencePruned   protowire.Number = 3
+
+	entryPath  protowire.Number = 1
+	entryValue protowire.Number = 2
+	entryMap   protowire.Number = 3
+
+	trailerEntries protowire.Number = 1
+	trailerSHA256  protowire.Number = 2
+)
+
+type Header struct {
+	Version uint32
+	Created time.Time
+	// Sequences are the counters of the streams when the snapshot was
+	// taken, they are missing in snapshots of a selection of the state.
+	Sequences []Sequence
+}
+
+// Sequence counts the events appended to and pruned from a stream, the
+// stream holds the events numbered after Pruned up to Appended.
+type Sequence struct {
+	// Stream is the topic of the stream, empty for the default stream.
+	Stream   string `json:"stream,omitempty"`
+	Appended uint64 `json:"appended"`
+	Pruned   uint64 `json:"pruned"`
+}
+
+// Entry is a map or a value of the database.
+type Entry struct {
+	Path  dbpath.Path
+	Value []byte
+	Map   bool
+}
+
+type writer struct {
+	w       io.Writer
+	h       hash.Hash
+	entries uint64
+}
+
+func (w *writer) writeRecord(field protowire.Number, msg []byte) error {
+	rec := protowire.AppendTag(nil, field, protowire.BytesType)
+	rec = protowire.AppendBytes(rec, msg)
+	d := protowire.AppendVarint(nil, uint64(len(rec)))
+	d = append(d, rec...)
+	w.h.Write(d)
+	_, err := w.w.Write(d)
+	return err
+}
+
+func (w *writer) writeEntry(e Entry) error {
+	msg := []byte{}
+	for _, p := range e.Path {
+		msg = protowire.AppendTag(msg, entryPath, protowire.BytesType)
+		msg = protowire.AppendString(msg, p)
+	}
+	if e.Map {
+		msg = protowire.AppendTag(msg, entryMap, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, 1)
+	} else {
+		msg = protowire.AppendTag(msg, entryValue, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, e.Value)
+	}
+	w.entries++
+	return w.writeRecord(recordEntry, msg)
+}
+
+func (w *writer) walk(tx bolted.SugaredReadTx, path dbpath.Path) error {
+	for it := tx.Iterator(path); !it.IsDone(); it.Next() {
+		p := path.Append(it.GetKey())
+		if tx.IsMap(p) {
+			err := w.writeEntry(Entry{Path: p, Map: true})
+			if err != nil {
+				return err
+			}
+			err = w.walk(tx, p)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := w.writeEntry(Entry{Path: p, Value: it.GetValue()})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writer writes a snapshot entry by entry, for snapshots of a selection
+// of the state. Maps have to be added before their entries.
+type Writer struct {
+	sw *writer
+}
+
+// NewWriter writes the header of a snapshot.
+func NewWriter(w io.Writer) (*Writer, error) {
+	return NewWriterWithSequences(w, nil)
+}
+
+// NewWriterWithSequences writes the header of a snapshot of the whole
+// state, with the counters of its streams.
+func NewWriterWithSequences(w io.Writer, sequences []Sequence) (*Writer, error) {
+	sw := &writer{w: w, h: sha256.New()}
+
+	header := protowire.AppendTag(nil, headerVersion, protowire.VarintType)
+	header = protowire.AppendVarint(header, Version)
+	header = protowire.AppendTag(header, headerCreated, protowire.VarintType)
+	header = protowire.AppendVarint(header, uint64(time.Now().UnixNano()))
+	for _, s := range sequences {
+		seq := protowire.AppendTag(nil, sequenceStream, protowire.BytesType)
+		seq = protowire.AppendString(seq, s.Stream)
+		seq = protowire.AppendTag(seq, sequenceAppended, protowire.VarintType)
+		seq = protowire.AppendVarint(seq, s.Appended)
+		seq = protowire.AppendTag(seq, sequencePruned, protowire.VarintType)
+		seq = protowire.AppendVarint(seq, s.Pruned)
+		header = protowire.AppendTag(header, headerSequences, protowire.BytesType)
+		header = protowire.AppendBytes(header, seq)
+	}
+
+	err := sw.writeRecord(recordHeader, header)
+	if err != nil {
+		return nil, fmt.Errorf("could not write header: %w", err)
+	}
+
+	return &Writer{sw: sw}, nil
+}
+
+// Add writes an entry.
+func (w *Writer) Add(e Entry) error {
+	err := w.sw.writeEntry(e)
+	if err != nil {
+		return fmt.Errorf("could not write entry: %w", err)
+	}
+	return nil
+}
+
+// Finish writes the trailer, the snapshot is incomplete without it.
+func (w *Writer) Finish() error {
+	trailer := protowire.AppendTag(nil, trailerEntries, protowire.VarintType)
+	trailer = protowire.AppendVarint(trailer, w.sw.entries)
+	trailer = protowire.AppendTag(trailer, trailerSHA256, protowire.BytesType)
+	trailer = protowire.AppendBytes(trailer, w.sw.h.Sum(nil))
+
+	err := w.sw.writeRecord(recordTrailer, trailer)
+	if err != nil {
+		return fmt.Errorf("could not write trailer: %w", err)
+	}
+
+	return nil
+}
+
+// Write writes a snapshot of everything visible to the transaction.
+func Write(w io.Writer, tx bolted.SugaredReadTx) error {
+	return WriteWithSequences(w, tx, nil)
+}
+
+// WriteWithSequences is Write with the counters of the streams in the
+// header, they have to be read in the same transaction.
+func WriteWithSequences(w io.Writer, tx bolted.SugaredReadTx, sequences []Sequence) error {
+	sw, err := NewWriterWithSequences(w, sequences)
+	if err != nil {
+		return err
+	}
+
+	err = sw.sw.walk(tx, dbpath.NilPath)
+	if err != nil {
+		return fmt.Errorf("could not write entry: %w", err)
+	}
+
+	return sw.Finish()
+}
+
+// fields calls fn for every field of a protobuf message, unknown fields
+// are skipped by callers.
+func fields(msg []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		err := fn(num, typ, msg[:n])
+		if err != nil {
+			return err
+		}
+		msg = msg[n:]
+	}
+	return nil
+}
+
+func consumeVarint(v []byte) (uint64, error) {
+	x, n := protowire.ConsumeVarint(v)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	return x, nil
+}
+
+func consumeBytes(v []byte) ([]byte, error) {
+	b, n := protowire.ConsumeBytes(v)
+	if n < 0 {
+		return nil, protowire.ParseError(n)
+	}
+	return b, nil
+}
+
+func parseHeader(msg []byte) (Header, error) {
+	h := Header{}
+	err := fields(msg, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == headerVersion && typ == protowire.VarintType:
+			x, err := consumeVarint(v)
+			h.Version = uint32(x)
+			return err
+		case num == headerCreated && typ == protowire.VarintType:
+			x, err := consumeVarint(v)
+			h.Created = time.Unix(0, int64(x))
+			return err
+		case num == headerSequences && typ == protowire.BytesType:
+			b, err := consumeBytes(v)
+			if err != nil {
+				return err
+			}
+			s, err := parseSequence(b)
+			h.Sequences = append(h.Sequences, s)
+			return err
+		}
+		return nil
+	})
+	return h, err
+}
+
+func parseSequence(msg []byte) (Sequence, error) {
+	s := Sequence{}
+	err := fields(msg, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == sequenceStream && typ == protowire.BytesType:
+			b, err := consumeBytes(v)
+			s.Stream = string(b)
+			return err
+		case num == sequenceAppended && typ == protowire.VarintType:
+			x, err := consumeVarint(v)
+			s.Appended = x
+			return err
+		case num == sequencePruned && typ == protowire.VarintType:
+			x, err := consumeVarint(v)
+			s.Pruned = x
+			return err
+		}
+		return nil
+	})
+	return s, err
+}
+
+func parseEntry(msg []byte) (Entry, error) {
+	e := Entry{}
+	err := fields(msg, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == entryPath && typ == protowire.BytesType:
+			b, err := consumeBytes(v)
+			e.Path = append(e.Path, string(b))
+			return err
+		case num == entryValue && typ == protowire.BytesType:
+			b, err := consumeBytes(v)
+			e.Value = append([]byte{}, b...)
+			return err
+		case num == entryMap && typ == protowire.VarintType:
+			x, err := consumeVarint(v)
+			e.Map = x != 0
+			return err
+		}
+		return nil
+	})
+	if err == nil && len(e.Path) == 0 {
+		err = errors.New("entry has no path")
+	}
+	return e, err
+}
+
+type trailer struct {
+	entries uint64
+	sum     []byte
+}
+
+func parseTrailer(msg []byte) (trailer, error) {
+	t := trailer{}
+	err := fields(msg, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == trailerEntries && typ == protowire.VarintType:
+			x, err := consumeVarint(v)
+			t.entries = x
+			return err
+		case num == trailerSHA256 && typ == protowire.BytesType:
+			b, err := consumeBytes(v)
+			t.sum = b
+			return err
+		}
+		return nil
+	})
+	return t, err
+}
+
+// hashingReader hashes all bytes read from the underlying reader.
+type hashingReader struct {
+	r *bufio.Reader
+	h hash.Hash
+}
+
+func (r *hashingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	return n, err
+}
+
+// Read parses a snapshot and calls fn for every entry. Entries are passed
+// before the checksum in the trailer is verified, callers have to discard
+// them when an error is returned.
+func Read(r io.Reader, fn func(Entry) error) (Header, error) {
+	hr := &hashingReader{r: bufio.NewReader(r), h: sha256.New()}
+
+	header := Header{}
+	entries := uint64(0)
+	for first := true; ; first = false {
+		sum := hr.h.Sum(nil)
+
+		size, err := binary.ReadUvarint(hr)
+		if err == io.EOF {
+			return header, errors.New("snapshot is truncated: trailer is missing")
+		}
+		if err != nil {
+			return header, fmt.Errorf("could not read record length: %w", err)
+		}
+		if size > maxRecordSize {
+			return header, fmt.Errorf("record of %d bytes is too large", size)
+		}
+
+		rec := make([]byte, size)
+		_, err = io.ReadFull(hr, rec)
+		if err != nil {
+			return header, fmt.Errorf("could not read record: %w", err)
+		}
+
+		num, typ, n := protowire.ConsumeTag(rec)
+		if n < 0 || typ != protowire.BytesType {
+			return header, errors.New("invalid record")
+		}
+		msg, err := consumeBytes(rec[n:])
+		if err != nil {
+			return header, fmt.Errorf("invalid record: %w", err)
+		}
+
+		if first != (num == recordHeader) {
+			return header, errors.New("snapshot has to start with a header")
+		}
+
+		switch num {
+		case recordHeader:
+			header, err = parseHeader(msg)
+			if err != nil {
+				return header, fmt.Errorf("could not parse header: %w", err)
+			}
+			if header.Version != Version {
+				return header, fmt.Errorf("unsupported snapshot version %d", header.Version)
+			}
+		case recordEntry:
+			e, err := parseEntry(msg)
+			if err != nil {
+				return header, fmt.Errorf("could not parse entry: %w", err)
+			}
+			entries++
+			err = fn(e)
+			if err != nil {
+				return header, err
+			}
+		case recordTrailer:
+			t, err := parseTrailer(msg)
+			if err != nil {
+				return header, fmt.Errorf("could not parse trailer: %w", err)
+			}
+			if t.entries != entries {
+				return header, fmt.Errorf("snapshot has %d entries, trailer expects %d", entries, t.entries)
+			}
+			if !bytes.Equal(t.sum, sum) {
+				return header, errors.New("snapshot checksum mismatch")
+			}
+			return header, nil
+		}
+	}
+}
+
+// Restore writes all entries of a snapshot. Nothing should be committed
+// when an error is returned, as the snapshot might be corrupt.
+func Restore(r io.Reader, tx bolted.SugaredWriteTx) (Header, error) {
+	return Read(r, func(e Entry) error {
+		if e.Map {
+			if !tx.Exists(e.Path) {
+				tx.CreateMap(e.Path)
+			}
+			return nil
+		}
+		tx.Put(e.Path, e.Value)
+		return nil
+	})
+}
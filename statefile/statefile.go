@@ -0,0 +1,117 @@
+// Package statefile replaces state files atomically. A new state is written
+// to a temporary file next to the state file and swapped in with a rename.
+// A marker records a swap in progress, so Recover can complete it after a
+// crash and the state file never points at a half written state.
+package statefile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TempPath returns the path new states for stateFile are written to.
+func TempPath(stateFile string) string {
+	return stateFile + ".new"
+}
+
+func markerPath(stateFile string) string {
+	return stateFile + ".swap"
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// syncDir persists renames and creations of files in dir.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	closeErr := d.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Swap replaces stateFile with the complete state at TempPath(stateFile).
+func Swap(stateFile string) error {
+	tmp := TempPath(stateFile)
+	dir := filepath.Dir(stateFile)
+
+	err := syncFile(tmp)
+	if err != nil {
+		return fmt.Errorf("could not sync new state: %w", err)
+	}
+
+	// from here on the new state is complete, the marker tells Recover to
+	// finish the swap
+	err = os.WriteFile(markerPath(stateFile), []byte(filepath.Base(tmp)), 0600)
+	if err != nil {
+		return fmt.Errorf("could not write swap marker: %w", err)
+	}
+
+	err = syncFile(markerPath(stateFile))
+	if err != nil {
+		return fmt.Errorf("could not sync swap marker: %w", err)
+	}
+
+	err = syncDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not sync state dir: %w", err)
+	}
+
+	return complete(stateFile)
+}
+
+func complete(stateFile string) error {
+	err := os.Rename(TempPath(stateFile), stateFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not move new state in place: %w", err)
+	}
+
+	err = syncDir(filepath.Dir(stateFile))
+	if err != nil {
+		return fmt.Errorf("could not sync state dir: %w", err)
+	}
+
+	err = os.Remove(markerPath(stateFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove swap marker: %w", err)
+	}
+
+	return nil
+}
+
+// Recover completes a swap interrupted by a crash and removes new states
+// that were not completely written. It has to be called before the state
+// file is opened.
+func Recover(stateFile string) error {
+	_, err := os.Stat(markerPath(stateFile))
+	if err == nil {
+		return complete(stateFile)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not check swap marker: %w", err)
+	}
+
+	err = os.Remove(TempPath(stateFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove incomplete state: %w", err)
+	}
+
+	return nil
+}
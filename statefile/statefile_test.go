@@ -0,0 +1,115 @@
+package statefile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func requireContent(t *testing.T, path, expected string) {
+	d, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d) != expected {
+		t.Fatalf("expected %s to contain %q, got %q", path, expected, string(d))
+	}
+}
+
+func requireMissing(t *testing.T, path string) {
+	_, err := os.Stat(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s not to exist, got %v", path, err)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state")
+	writeFile(t, stateFile, "old")
+	writeFile(t, TempPath(stateFile), "new")
+
+	err := Swap(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requireContent(t, stateFile, "new")
+	requireMissing(t, TempPath(stateFile))
+	requireMissing(t, markerPath(stateFile))
+}
+
+func TestRecoverCompletesASwapWithAMarker(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state")
+	writeFile(t, stateFile, "old")
+	writeFile(t, TempPath(stateFile), "new")
+
+	// crashed after the marker was written, before the rename
+	writeFile(t, markerPath(stateFile), filepath.Base(TempPath(stateFile)))
+
+	err := Recover(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requireContent(t, stateFile, "new")
+	requireMissing(t, TempPath(stateFile))
+	requireMissing(t, markerPath(stateFile))
+}
+
+func TestRecoverCompletesASwapAfterTheRename(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state")
+	writeFile(t, stateFile, "new")
+
+	// crashed after the rename, before the marker was removed
+	writeFile(t, markerPath(stateFile), filepath.Base(TempPath(stateFile)))
+
+	err := Recover(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requireContent(t, stateFile, "new")
+	requireMissing(t, markerPath(stateFile))
+}
+
+func TestRecoverRemovesAnIncompleteState(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state")
+	writeFile(t, stateFile, "old")
+
+	// crashed while the new state was written
+	writeFile(t, TempPath(stateFile), "partial")
+
+	err := Recover(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requireContent(t, stateFile, "old")
+	requireMissing(t, TempPath(stateFile))
+}
+
+func TestRecoverWithoutASwap(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state")
+
+	err := Recover(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireMissing(t, stateFile)
+
+	writeFile(t, stateFile, "state")
+
+	err = Recover(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireContent(t, stateFile, "state")
+}
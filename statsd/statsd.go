@@ -0,0 +1,274 @@
+// Package statsd emits the metrics of the buffer to a StatsD or DogStatsD
+// agent, for environments without Prometheus.
+//
+// The same metrics the Prometheus endpoint exposes are sent every
+// interval. Counters, and the buckets, sums and counts of histograms and
+// summaries, are sent as counters of their increase since the previous
+// emit, gauges and quantiles as gauges. DogStatsD receives the labels as
+// tags, plain StatsD as segments of the metric name.
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	FormatStatsD    = "statsd"
+	FormatDogStatsD = "dogstatsd"
+)
+
+// maxPacketSize keeps packets below the common MTU of 1500 bytes.
+const maxPacketSize = 1432
+
+type Options struct {
+	// Addr is the UDP address of the agent, e.g. localhost:8125.
+	Addr     string
+	Interval time.Duration
+	// Format is FormatStatsD or FormatDogStatsD.
+	Format string
+	// Prefix is prepended to every metric name, separated by a dot.
+	Prefix string
+	// Tags are added to every metric, plain StatsD ignores them.
+	Tags map[string]string
+}
+
+// Run emits the metrics gathered by g every interval until ctx is
+// cancelled. Failed emits are logged and not retried.
+func Run(ctx context.Context, log logr.Logger, g prometheus.Gatherer, opts Options) error {
+	log = log.WithValues("addr", opts.Addr)
+
+	if opts.Format != FormatStatsD && opts.Format != FormatDogStatsD {
+		return fmt.Errorf("unsupported statsd format %q", opts.Format)
+	}
+
+	conn, err := net.Dial("udp", opts.Addr)
+	if err != nil {
+		return fmt.Errorf("could not connect to statsd agent: %w", err)
+	}
+
+	defer conn.Close()
+
+	e := &emitter{opts: opts, sent: map[metricLine]float64{}}
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		families, err := g.Gather()
+		if err != nil {
+			log.Error(err, "could not gather metrics")
+			continue
+		}
+
+		for _, p := range e.packets(families) {
+			_, err = conn.Write(p)
+			if err != nil {
+				log.Error(err, "could not emit metrics")
+				break
+			}
+		}
+	}
+}
+
+type emitter struct {
+	opts Options
+	// sent holds the counter values already sent.
+	sent map[metricLine]float64
+	// pending holds the values of counters being sent, they become sent
+	// once all packets are built.
+	pending map[metricLine]float64
+}
+
+type label struct {
+	name, value string
+}
+
+// packets encodes the metrics into packets of newline separated lines.
+func (e *emitter) packets(families []*dto.MetricFamily) [][]byte {
+	e.pending = map[metricLine]float64{}
+
+	packets := [][]byte{}
+	var p []byte
+	add := func(line string) {
+		if len(p) > 0 && len(p)+1+len(line) > maxPacketSize {
+			packets = append(packets, p)
+			p = nil
+		}
+		if len(p) > 0 {
+			p = append(p, '\n')
+		}
+		p = append(p, line...)
+	}
+
+	for _, mf := range families {
+		for _, line := range e.lines(mf) {
+			add(line)
+		}
+	}
+
+	if len(p) > 0 {
+		packets = append(packets, p)
+	}
+
+	for k, v := range e.pending {
+		e.sent[k] = v
+	}
+
+	return packets
+}
+
+func (e *emitter) lines(mf *dto.MetricFamily) []string {
+	name := mf.GetName()
+	lines := []string{}
+
+	for _, m := range mf.GetMetric() {
+		labels := []label{}
+		for _, lp := range m.GetLabel() {
+			labels = append(labels, label{lp.GetName(), lp.GetValue()})
+		}
+
+		gauge := func(suffix string, value float64, more ...label) {
+			metric := e.metric(name+suffix, append(labels, more...))
+			lines = append(lines, formatLine(metric, value, "g"))
+		}
+		counter := func(suffix string, value float64, more ...label) {
+			metric := e.metric(name+suffix, append(labels, more...))
+			delta := value - e.sent[metric]
+			if delta < 0 {
+				// the counter was reset
+				delta = value
+			}
+			e.pending[metric] = value
+			if delta != 0 {
+				lines = append(lines, formatLine(metric, delta, "c"))
+			}
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			counter("", m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			gauge("", m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			gauge("", m.GetUntyped().GetValue())
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			for _, q := range s.GetQuantile() {
+				if math.IsNaN(q.GetValue()) {
+					continue
+				}
+				gauge("", q.GetValue(), label{"quantile", formatValue(q.GetQuantile())})
+			}
+			counter("_sum", s.GetSampleSum())
+			counter("_count", float64(s.GetSampleCount()))
+		case dto.MetricType_HISTOGRAM:
+			h := m.GetHistogram()
+			for _, b := range h.GetBucket() {
+				counter("_bucket", float64(b.GetCumulativeCount()), label{"le", formatValue(b.GetUpperBound())})
+			}
+			counter("_sum", h.GetSampleSum())
+			counter("_count", float64(h.GetSampleCount()))
+		}
+	}
+
+	return lines
+}
+
+// metricLine holds the name and the tags of a line, around its value and
+// type.
+type metricLine struct {
+	name string
+	tags string
+}
+
+func formatLine(m metricLine, value float64, kind string) string {
+	line := m.name + ":" + formatValue(value) + "|" + kind
+	if m.tags != "" {
+		line += "|#" + m.tags
+	}
+	return line
+}
+
+// metric returns the name and tags a metric is sent with.
+func (e *emitter) metric(name string, labels []label) metricLine {
+	if e.opts.Prefix != "" {
+		name = e.opts.Prefix + "." + name
+	}
+	name = sanitizeName(name)
+
+	if e.opts.Format == FormatStatsD {
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+		for _, l := range labels {
+			name += "." + sanitizeSegment(l.name) + "_" + sanitizeSegment(l.value)
+		}
+		return metricLine{name: name}
+	}
+
+	tags := []string{}
+	own := map[string]bool{}
+	for _, l := range labels {
+		tags = append(tags, sanitizeTag(l.name)+":"+sanitizeTag(l.value))
+		own[l.name] = true
+	}
+	// labels of the metric take precedence
+	for n, v := range e.opts.Tags {
+		if !own[n] {
+			tags = append(tags, sanitizeTag(n)+":"+sanitizeTag(v))
+		}
+	}
+	sort.Strings(tags)
+
+	return metricLine{name: name, tags: strings.Join(tags, ",")}
+}
+
+func formatValue(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// sanitizeName replaces characters StatsD uses as separators.
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// sanitizeSegment replaces separators of StatsD and of the segments of
+// metric names in label names and values.
+func sanitizeSegment(s string) string {
+	return strings.ReplaceAll(sanitizeName(s), ".", "_")
+}
+
+// sanitizeTag replaces characters DogStatsD uses as separators of tags.
+func sanitizeTag(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '|', '#', ',', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,140 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lines returns the sorted lines of the packets.
+func lines(packets [][]byte) []string {
+	res := []string{}
+	for _, p := range packets {
+		res = append(res, strings.Split(string(p), "\n")...)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func requireLines(t *testing.T, got []string, expected ...string) {
+	sort.Strings(expected)
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected the lines\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestRunEmitsDogStatsDCountersAsIncreases(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	reg := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "requests"}, []string{"job"})
+	reg.MustRegister(requests)
+	requests.WithLabelValues("api").Add(3)
+	queued := prometheus.NewGauge(prometheus.GaugeOpts{Name: "queued", Help: "queued"})
+	reg.MustRegister(queued)
+	queued.Set(7)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go Run(ctx, logr.Discard(), reg, Options{
+		Addr:     pc.LocalAddr().String(),
+		Interval: 20 * time.Millisecond,
+		Format:   FormatDogStatsD,
+		Prefix:   "eb",
+		Tags:     map[string]string{"env": "prod", "job": "event-buffer"},
+	})
+
+	receive := func() []string {
+		buf := make([]byte, maxPacketSize)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lines([][]byte{buf[:n]})
+	}
+
+	requireLines(t, receive(),
+		"eb.requests_total:3|c|#env:prod,job:api",
+		"eb.queued:7|g|#env:prod,job:event-buffer",
+	)
+
+	// unchanged counters are not sent again
+	requireLines(t, receive(),
+		"eb.queued:7|g|#env:prod,job:event-buffer",
+	)
+
+	requests.WithLabelValues("api").Add(2)
+
+	// the increase may arrive with the next emit
+	for i := 0; i < 2; i++ {
+		got := receive()
+		if len(got) == 2 {
+			requireLines(t, got,
+				"eb.requests_total:2|c|#env:prod,job:api",
+				"eb.queued:7|g|#env:prod,job:event-buffer",
+			)
+			return
+		}
+	}
+	t.Fatal("the increase of the counter was not sent")
+}
+
+func TestStatsDSendsLabelsAsSegments(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "latency_seconds", Help: "latency", Buckets: []float64{0.5}}, []string{"path"})
+	reg.MustRegister(latency)
+	latency.WithLabelValues("/v1.events").Observe(0.25)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &emitter{opts: Options{Format: FormatStatsD}, sent: map[metricLine]float64{}}
+	requireLines(t, lines(e.packets(families)),
+		"latency_seconds_bucket.le_0_5.path_/v1_events:1|c",
+		"latency_seconds_sum.path_/v1_events:0.25|c",
+		"latency_seconds_count.path_/v1_events:1|c",
+	)
+}
+
+func TestPacketsStayBelowTheMaximumSize(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	for i := 0; i < 200; i++ {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{Name: fmt.Sprintf("gauge_with_a_long_name_%d", i), Help: "gauge"})
+		reg.MustRegister(g)
+		g.Set(float64(i))
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &emitter{opts: Options{Format: FormatDogStatsD}, sent: map[metricLine]float64{}}
+	packets := e.packets(families)
+	if len(packets) < 2 {
+		t.Fatalf("expected the metrics to be split into several packets, got %d", len(packets))
+	}
+	for _, p := range packets {
+		if len(p) > maxPacketSize {
+			t.Fatalf("packet of %d bytes exceeds %d", len(p), maxPacketSize)
+		}
+	}
+	if n := len(lines(packets)); n != 200 {
+		t.Fatalf("expected 200 lines, got %d", n)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+// listenerTLS returns the TLS configuration of the metrics, internal or gRPC
+// server from the <name>-tls-cert and <name>-tls-key flags, falling back to
+// --tls-cert and --tls-key, an empty name returns the one of the API
+// server. It is nil when no certificate is configured.
+func listenerTLS(c *cli.Context, name string) (*tls.Config, error) {
+	certFile, keyFile := c.String("tls-cert"), c.String("tls-key")
+	if name != "" && (c.String(name+"-tls-cert") != "" || c.String(name+"-tls-key") != "") {
+		certFile, keyFile = c.String(name+"-tls-cert"), c.String(name+"-tls-key")
+	}
+	return loadTLS(certFile, keyFile)
+}
+
+// internalTLS returns the TLS configuration of the internal server, client
+// certificates are required and verified when --internal-tls-client-ca is
+// set.
+func internalTLS(c *cli.Context) (*tls.Config, error) {
+	tlsConfig, err := listenerTLS(c, "internal")
+	if err != nil {
+		return nil, err
+	}
+
+	caFile := c.String("internal-tls-client-ca")
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+	if tlsConfig == nil {
+		return nil, errors.New("internal-tls-client-ca requires a certificate of the internal server")
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client ca %s", caFile)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
+}
+
+func loadTLS(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both a tls certificate and key are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load tls certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
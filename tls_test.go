@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+func (tc *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.cert.Raw}, PrivateKey: tc.key}
+}
+
+// newCert creates a certificate for name signed by parent, or a self
+// signed CA when parent is nil, and writes it to PEM files.
+func newCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	td := t.TempDir()
+	tc := &testCert{cert: cert, key: key, certFile: filepath.Join(td, name+".crt"), keyFile: filepath.Join(td, name+".key")}
+
+	err = os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tc
+}
+
+// withTLSFlags runs fn with a context holding the TLS flags of args.
+func withTLSFlags(fn func(c *cli.Context) error, args ...string) error {
+	flags := []cli.Flag{}
+	for _, name := range []string{"tls-cert", "tls-key", "metrics-tls-cert", "metrics-tls-key", "internal-tls-cert", "internal-tls-key", "internal-tls-client-ca"} {
+		flags = append(flags, &cli.StringFlag{Name: name})
+	}
+
+	a := &cli.App{Flags: flags, Action: fn}
+	return a.Run(append([]string{"event-buffer"}, args...))
+}
+
+// serveTLS serves 200 OK with the configuration and returns its URL.
+func serveTLS(t *testing.T, config *tls.Config) string {
+	hs := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	hs.TLS = config
+	// rejected handshakes are expected
+	hs.Config.ErrorLog = log.New(io.Discard, "", 0)
+	hs.StartTLS()
+	t.Cleanup(hs.Close)
+	return hs.URL
+}
+
+// get requests url trusting ca, with the client certificates.
+func get(url string, ca *testCert, certs ...tls.Certificate) (*http.Response, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	cl := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs}}}
+	return cl.Get(url)
+}
+
+func TestServersFallBackToTheAPICertificate(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	api := newCert(t, "api", ca)
+	metrics := newCert(t, "metrics", ca)
+
+	err := withTLSFlags(func(c *cli.Context) error {
+		for name, expected := range map[string]string{"": "api", "internal": "api", "metrics": "metrics"} {
+			config, err := listenerTLS(c, name)
+			if err != nil {
+				return err
+			}
+
+			res, err := get(serveTLS(t, config), ca)
+			if err != nil {
+				return err
+			}
+			res.Body.Close()
+
+			served := res.TLS.PeerCertificates[0].Subject.CommonName
+			if served != expected {
+				t.Errorf("expected the %q server to serve the %s certificate, got %s", name, expected, served)
+			}
+		}
+		return nil
+	},
+		"--tls-cert", api.certFile, "--tls-key", api.keyFile,
+		"--metrics-tls-cert", metrics.certFile, "--metrics-tls-key", metrics.keyFile,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInternalServerVerifiesClientCertificates(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	server := newCert(t, "internal", ca)
+	client := newCert(t, "client", ca)
+	otherCA := newCert(t, "other-ca", nil)
+	stranger := newCert(t, "stranger", otherCA)
+
+	var url string
+	err := withTLSFlags(func(c *cli.Context) error {
+		config, err := internalTLS(c)
+		if err != nil {
+			return err
+		}
+		url = serveTLS(t, config)
+		return nil
+	}, "--internal-tls-cert", server.certFile, "--internal-tls-key", server.keyFile, "--internal-tls-client-ca", ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := get(url, ca, client.tlsCertificate())
+	if err != nil {
+		t.Fatalf("expected a client with a certificate of the CA to be accepted, got %v", err)
+	}
+	res.Body.Close()
+
+	for name, certs := range map[string][]tls.Certificate{
+		"without a certificate":            nil,
+		"with a certificate of another CA": {stranger.tlsCertificate()},
+	} {
+		res, err := get(url, ca, certs...)
+		if err == nil {
+			res.Body.Close()
+			t.Fatalf("expected a client %s to be rejected", name)
+		}
+	}
+}
+
+func TestTLSConfigurationErrors(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	server := newCert(t, "server", ca)
+
+	for _, c := range []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{"certificate without key", []string{"--tls-cert", server.certFile}, "both a tls certificate and key are required"},
+		{"client CA without certificate", []string{"--internal-tls-client-ca", ca.certFile}, "requires a certificate of the internal server"},
+		{"client CA without certificates", []string{"--internal-tls-cert", server.certFile, "--internal-tls-key", server.keyFile, "--internal-tls-client-ca", server.keyFile}, "no certificates found"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := withTLSFlags(func(c *cli.Context) error {
+				_, err := listenerTLS(c, "")
+				if err != nil {
+					return err
+				}
+				_, err = internalTLS(c)
+				return err
+			}, c.args...)
+			if err == nil || !strings.Contains(err.Error(), c.expected) {
+				t.Fatalf("expected an error containing %q, got %v", c.expected, err)
+			}
+		})
+	}
+}
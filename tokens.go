@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/draganm/event-buffer/auth"
+	"github.com/urfave/cli/v2"
+)
+
+// apiTokenEntries returns the entries of --api-token followed by the ones
+// of --api-token-file.
+func apiTokenEntries(c *cli.Context) ([]string, error) {
+	entries := append([]string{}, c.StringSlice("api-token")...)
+	if c.String("api-token-file") != "" {
+		fromFile, err := auth.LoadTokenFile(c.String("api-token-file"))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fromFile...)
+	}
+	return entries, nil
+}
@@ -0,0 +1,119 @@
+// Package tracing exports the spans of the buffer to an OpenTelemetry
+// collector over OTLP/HTTP.
+//
+// Spans are recorded for API requests, the transactions storing and
+// reading events and prunes. Incoming traceparent headers continue the
+// traces of producers and consumers, so latency spikes of a producer can
+// be matched with the writes of the buffer.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// shutdownTimeout bounds the export of the remaining spans on shutdown.
+const shutdownTimeout = 5 * time.Second
+
+type Options struct {
+	// Endpoint is the URL of the collector, e.g. http://localhost:4318.
+	// Spans are sent to /v1/traces unless it has a path.
+	Endpoint string
+	// ServiceName defaults to event-buffer.
+	ServiceName string
+	// SampleRatio is the fraction of traces started by the buffer that
+	// are sampled, traces of callers keep their sampling decision.
+	SampleRatio float64
+}
+
+// Validate checks the URL of a collector.
+func Validate(endpoint string) error {
+	_, err := exporterOptions(endpoint)
+	return err
+}
+
+func exporterOptions(endpoint string) ([]otlptracehttp.Option, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	switch u.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("OTLP endpoint must be an http or https URL, got %q", endpoint)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("OTLP endpoint %q has no host", endpoint)
+	}
+	if strings.Trim(u.Path, "/") != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	return opts, nil
+}
+
+// Run installs a tracer provider exporting to the collector and the W3C
+// trace context propagator, and exports spans until ctx is cancelled.
+// Spans still buffered then are flushed before it returns.
+func Run(ctx context.Context, log logr.Logger, opts Options) error {
+	exporterOpts, err := exporterOptions(opts.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+	if err != nil {
+		return fmt.Errorf("could not create OTLP exporter: %w", err)
+	}
+
+	serviceName := opts.ServiceName
+	if serviceName == "" {
+		serviceName = "event-buffer"
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return fmt.Errorf("could not create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Error(err, "could not export spans")
+	}))
+
+	log.Info("exporting traces", "endpoint", opts.Endpoint)
+
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = provider.Shutdown(shutdownCtx)
+	if err != nil {
+		return fmt.Errorf("could not flush spans: %w", err)
+	}
+
+	return nil
+}
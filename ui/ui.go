@@ -0,0 +1,22 @@
+// Package ui serves a single page for browsing the buffer. It expects the
+// read endpoints of the events API under api/ and the buffer stats at
+// ../stats relative to the page.
+package ui
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed index.html
+var index []byte
+
+// Handler serves the page for every path it receives.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		w.Header().Set("cache-control", "no-cache")
+		w.Header().Set("content-security-policy", "default-src 'self'; script-src 'unsafe-inline' 'self'; style-src 'unsafe-inline' 'self'")
+		w.Write(index)
+	})
+}
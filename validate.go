@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/draganm/event-buffer/auth"
+	"github.com/draganm/event-buffer/config"
+	"github.com/draganm/event-buffer/objectstore"
+	"github.com/draganm/event-buffer/server"
+	"github.com/draganm/event-buffer/statsd"
+	"github.com/draganm/event-buffer/tracing"
+	_ "github.com/lib/pq"
+	"github.com/urfave/cli/v2"
+)
+
+// validateCommand checks the configuration file together with the flags
+// and environment of the server without starting it. Flags of the server
+// are read from the environment or have to be given before the command.
+var validateCommand = &cli.Command{
+	Name:  "validate",
+	Usage: "check the configuration file and server flags without starting the server",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "YAML configuration file",
+			EnvVars: []string{"CONFIG"},
+		},
+		&cli.BoolFlag{
+			Name:  "check-connectivity",
+			Usage: "also connect to the configured object stores and outbox database",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		problems := []string{}
+		fail := func(format string, args ...any) {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+
+		cfg := &config.Config{}
+		if c.String("config") != "" {
+			var err error
+			cfg, err = config.Load(c.String("config"))
+			if err != nil {
+				fail("%s", err)
+				cfg = &config.Config{}
+			}
+		}
+
+		validateAuth(c, cfg, fail)
+		validateListeners(c, cfg, fail)
+		validateRetention(c, fail)
+		validateIntegrations(c, fail)
+
+		if c.Bool("check-connectivity") && len(problems) == 0 {
+			ctx, cancel := context.WithTimeout(c.Context, 10*time.Second)
+			defer cancel()
+			checkConnectivity(ctx, c, fail)
+		}
+
+		for _, p := range problems {
+			fmt.Printf("invalid: %s\n", p)
+		}
+
+		if len(problems) > 0 {
+			return fmt.Errorf("configuration has %d problems", len(problems))
+		}
+
+		fmt.Println("configuration is valid")
+		return nil
+	},
+}
+
+// configuredAuthenticators returns the names of the authenticators enabled
+// by flags, as the server configures them.
+func configuredAuthenticators(c *cli.Context) map[string]bool {
+	return map[string]bool{
+		"basic":         len(c.StringSlice("basic-auth")) > 0,
+		"introspection": c.String("introspection-url") != "",
+		"ldap":          c.String("ldap-url") != "",
+		"token":         len(c.StringSlice("api-token")) > 0 || c.String("api-token-file") != "",
+	}
+}
+
+func validateAuth(c *cli.Context, cfg *config.Config, fail func(string, ...any)) {
+	if len(c.StringSlice("basic-auth")) > 0 {
+		_, err := auth.NewBasic(c.StringSlice("basic-auth"))
+		if err != nil {
+			fail("basic-auth: %s", err)
+		}
+	}
+
+	tokenEntries, err := apiTokenEntries(c)
+	if err != nil {
+		fail("api-token-file: %s", err)
+	}
+	_, err = auth.NewTokens(tokenEntries)
+	if err != nil {
+		fail("api-token: %s", err)
+	}
+
+	if c.String("introspection-url") != "" {
+		validateURL("introspection-url", c.String("introspection-url"), fail)
+	}
+
+	if c.String("ldap-url") != "" {
+		validateURL("ldap-url", c.String("ldap-url"), fail)
+		_, err := auth.ParseGroupRoles(c.StringSlice("ldap-group-role"))
+		if err != nil {
+			fail("ldap-group-role: %s", err)
+		}
+	}
+
+	// listeners of the configuration file require their authenticators,
+	// the default listener skips the ones that are not configured
+	configured := configuredAuthenticators(c)
+	for _, l := range cfg.Listeners {
+		for _, name := range l.Auth {
+			enabled, known := configured[name]
+			switch {
+			case !known:
+				fail("listener %q: unknown authenticator %q, expected basic, introspection, ldap or token", l.Name, name)
+			case !enabled:
+				fail("listener %q: authenticator %q is not configured", l.Name, name)
+			}
+		}
+	}
+
+	_, err = server.ParseTrustedProxies(c.StringSlice("trusted-proxies"))
+	if err != nil {
+		fail("trusted-proxies: %s", err)
+	}
+
+	if c.String("bundle-signing-key") != "" {
+		_, err = server.LoadBundleSigningKey(c.String("bundle-signing-key"))
+		if err != nil {
+			fail("bundle-signing-key: %s", err)
+		}
+	}
+
+	_, err = server.LoadBundleVerifyKeys(c.StringSlice("bundle-trusted-keys"))
+	if err != nil {
+		fail("bundle-trusted-keys: %s", err)
+	}
+}
+
+func validateListeners(c *cli.Context, cfg *config.Config, fail func(string, ...any)) {
+	switch c.String("listen-network") {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		fail("listen-network: unsupported network %q, expected tcp, tcp4 or tcp6", c.String("listen-network"))
+	}
+
+	validateAddr := func(name, addr string) {
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			fail("%s: invalid address %q: %s", name, addr, err)
+		}
+	}
+
+	if len(cfg.Listeners) == 0 {
+		validateAddr("addr", c.String("addr"))
+	}
+	for _, l := range cfg.Listeners {
+		validateAddr(fmt.Sprintf("listener %q", l.Name), l.Addr)
+		if l.TLS != nil {
+			_, err := tls.LoadX509KeyPair(l.TLS.CertFile, l.TLS.KeyFile)
+			if err != nil {
+				fail("listener %q: could not load tls certificate: %s", l.Name, err)
+			}
+		}
+	}
+
+	if c.String("tls-cert") != "" || c.String("tls-key") != "" {
+		_, err := listenerTLS(c, "")
+		if err != nil {
+			fail("tls-cert: %s", err)
+		}
+	}
+	if c.String("metrics-tls-cert") != "" || c.String("metrics-tls-key") != "" {
+		_, err := listenerTLS(c, "metrics")
+		if err != nil {
+			fail("metrics-tls-cert: %s", err)
+		}
+	}
+	if c.String("grpc-tls-cert") != "" || c.String("grpc-tls-key") != "" {
+		_, err := listenerTLS(c, "grpc")
+		if err != nil {
+			fail("grpc-tls-cert: %s", err)
+		}
+	}
+	if c.String("internal-tls-cert") != "" || c.String("internal-tls-key") != "" || c.String("internal-tls-client-ca") != "" {
+		_, err := internalTLS(c)
+		if err != nil {
+			fail("internal-tls-cert: %s", err)
+		}
+	}
+
+	validateAddr("metrics-addr", c.String("metrics-addr"))
+	validateAddr("internal-addr", c.String("internal-addr"))
+	if c.String("grpc-addr") != "" {
+		validateAddr("grpc-addr", c.String("grpc-addr"))
+	}
+}
+
+func validateRetention(c *cli.Context, fail func(string, ...any)) {
+	retention := c.Duration("retention-period")
+	prune := c.Duration("prune-frequency")
+
+	if retention <= 0 {
+		fail("retention-period must be positive, got %s", retention)
+	}
+
+	// the ticker of the pruner panics on non-positive intervals
+	if prune <= 0 {
+		fail("prune-frequency must be positive, got %s", prune)
+	}
+
+	// events are kept for up to retention-period plus prune-frequency, a
+	// longer prune frequency than retention is almost certainly a mistake
+	if retention > 0 && prune > retention {
+		fail("prune-frequency %s is longer than retention-period %s, events would be kept up to %s", prune, retention, prune+retention)
+	}
+
+	if c.Bool("protect-consumers") && c.Duration("max-retention-period") < retention {
+		fail("max-retention-period %s is shorter than retention-period %s", c.Duration("max-retention-period"), retention)
+	}
+
+	if c.Duration("backup-frequency") > 0 && c.String("backup-target") == "" {
+		fail("backup-target must be set when backups are enabled")
+	}
+
+	if c.Bool("bootstrap-from-backup") && c.String("backup-target") == "" {
+		fail("backup-target must be set to bootstrap from a backup")
+	}
+
+	if len(c.StringSlice("state-shard")) > 0 && c.Duration("backup-frequency") > 0 {
+		fail("backups of a sharded state are not supported, unset backup-frequency or state-shard")
+	}
+
+	if c.String("payload-log-dir") != "" && c.Duration("backup-frequency") > 0 {
+		fail("backups of a state with a payload log are not supported, unset backup-frequency or payload-log-dir")
+	}
+
+	if c.String("wal-target") != "" && c.Duration("wal-interval") <= 0 {
+		fail("wal-interval must be positive, got %s", c.Duration("wal-interval"))
+	}
+}
+
+func validateIntegrations(c *cli.Context, fail func(string, ...any)) {
+	if c.String("offload-url") != "" {
+		err := objectstore.Validate(c.String("offload-url"))
+		if err != nil {
+			fail("offload-url: %s", err)
+		}
+		if c.Int("offload-min-size") <= 0 {
+			fail("offload-min-size must be positive when offload-url is set")
+		}
+	}
+
+	if c.String("payload-log-dir") != "" {
+		if c.Int("payload-log-min-size") <= 0 {
+			fail("payload-log-min-size must be positive when payload-log-dir is set")
+		}
+		if c.Int64("payload-log-segment-size") <= 0 {
+			fail("payload-log-segment-size must be positive, got %d", c.Int64("payload-log-segment-size"))
+		}
+	}
+
+	for _, name := range []string{"backup-target", "wal-target", "archive-url"} {
+		target := c.String(name)
+		// plain paths are backup directories
+		if !strings.Contains(target, "://") {
+			continue
+		}
+		err := objectstore.Validate(target)
+		if err != nil {
+			fail("%s: %s", name, err)
+		}
+	}
+
+	if c.String("remote-write-url") != "" {
+		validateURL("remote-write-url", c.String("remote-write-url"), fail)
+		_, err := parseRemoteWriteLabels(c.StringSlice("remote-write-label"))
+		if err != nil {
+			fail("remote-write-label: %s", err)
+		}
+	}
+
+	if c.String("statsd-addr") != "" {
+		format := c.String("statsd-format")
+		if format != statsd.FormatStatsD && format != statsd.FormatDogStatsD {
+			fail("statsd-format: invalid format %q, expected statsd or dogstatsd", format)
+		}
+		_, err := parseStatsDTags(c.StringSlice("statsd-tag"))
+		if err != nil {
+			fail("statsd-tag: %s", err)
+		}
+	}
+
+	if c.String("otlp-endpoint") != "" {
+		err := tracing.Validate(c.String("otlp-endpoint"))
+		if err != nil {
+			fail("otlp-endpoint: %s", err)
+		}
+		if ratio := c.Float64("otlp-sample-ratio"); ratio < 0 || ratio > 1 {
+			fail("otlp-sample-ratio must be between 0 and 1, got %v", ratio)
+		}
+	}
+
+	if c.String("alert-webhook-url") != "" {
+		validateURL("alert-webhook-url", c.String("alert-webhook-url"), fail)
+	}
+
+	if c.String("follow-url") != "" {
+		validateURL("follow-url", c.String("follow-url"), fail)
+		if c.String("grpc-addr") != "" {
+			fail("gRPC is not supported on a follower, unset grpc-addr or follow-url")
+		}
+	}
+
+	if c.String("leader-election-lease") != "" {
+		if c.String("leader-election-url") == "" {
+			fail("leader-election-url is required with leader-election-lease, the other instance follows it")
+		} else {
+			validateURL("leader-election-url", c.String("leader-election-url"), fail)
+		}
+		if c.String("follow-url") != "" {
+			fail("leader election and following a primary can't be combined, unset follow-url or leader-election-lease")
+		}
+		if c.String("grpc-addr") != "" {
+			fail("gRPC is not supported with leader election, unset grpc-addr or leader-election-lease")
+		}
+		if c.Duration("leader-election-lease-duration") < time.Second {
+			fail("leader-election-lease-duration must be at least 1s, got %s", c.Duration("leader-election-lease-duration"))
+		}
+	}
+
+	if c.String("outbox-dsn") != "" && c.Duration("outbox-poll-interval") <= 0 {
+		fail("outbox-poll-interval must be positive, got %s", c.Duration("outbox-poll-interval"))
+	}
+}
+
+func validateURL(name, rawURL string, fail func(string, ...any)) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		fail("%s: %s", name, err)
+		return
+	}
+	if u.Scheme == "" || u.Host == "" {
+		fail("%s: %q is not an absolute URL", name, rawURL)
+	}
+}
+
+// checkConnectivity lists the configured object stores and pings the outbox
+// database.
+func checkConnectivity(ctx context.Context, c *cli.Context, fail func(string, ...any)) {
+	stores := map[string]func() (objectstore.Store, error){}
+	if c.String("offload-url") != "" {
+		stores["offload-url"] = func() (objectstore.Store, error) {
+			return objectstore.Open(c.String("offload-url"))
+		}
+	}
+	for _, name := range []string{"backup-target", "wal-target", "archive-url"} {
+		target := c.String(name)
+		if target == "" {
+			continue
+		}
+		stores[name] = func() (objectstore.Store, error) {
+			return openBackupTarget(target)
+		}
+	}
+
+	for name, open := range stores {
+		store, err := open()
+		if err != nil {
+			fail("%s: %s", name, err)
+			continue
+		}
+		_, err = store.List(ctx, "")
+		if err != nil {
+			fail("%s: could not list objects: %s", name, err)
+		}
+	}
+
+	if c.String("outbox-dsn") != "" {
+		db, err := sql.Open("postgres", c.String("outbox-dsn"))
+		if err != nil {
+			fail("outbox-dsn: %s", err)
+			return
+		}
+		defer db.Close()
+		err = db.PingContext(ctx)
+		if err != nil {
+			fail("outbox-dsn: could not connect: %s", err)
+		}
+	}
+}